@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"go.hollow.sh/metadataservice/internal/upserter"
+)
+
+// compactIPAddressesCmd represents the compact-ip-addresses command
+var compactIPAddressesCmd = &cobra.Command{
+	Use:   "compact-ip-addresses",
+	Short: "resolves IP addresses associated to more than one instance to a single owner",
+	Long: `Scans instance_ip_addresses for addresses with more than one row (left behind
+by writes made before the unique_address constraint), and keeps only the most
+recently updated row for each. Run with --dry-run first to see what would be
+removed. This is needed before the unique_address migration can be applied to
+such a database.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		compactIPAddresses(cmd)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(compactIPAddressesCmd)
+
+	compactIPAddressesCmd.Flags().Bool("dry-run", false, "Report the rows which would be removed, without removing them")
+	viperBindFlag("compact_ip_addresses.dry_run", compactIPAddressesCmd.Flags().Lookup("dry-run"))
+}
+
+func compactIPAddresses(cmd *cobra.Command) {
+	db := initDB()
+	defer db.Close()
+
+	dryRun := viper.GetBool("compact_ip_addresses.dry_run")
+
+	resolutions, err := upserter.CompactDuplicateIPs(cmd.Context(), db, logger.Desugar(), dryRun)
+
+	for _, resolution := range resolutions {
+		for _, removed := range resolution.Removed {
+			logger.Infow("removing duplicate ip address row",
+				"address", resolution.Address,
+				"kept_instance_id", resolution.InstanceID,
+				"removed_instance_id", removed.InstanceID,
+				"dry_run", dryRun,
+			)
+		}
+	}
+
+	if err != nil {
+		logger.Fatalw("failed compacting ip addresses", "error", err, "resolved", len(resolutions))
+	}
+
+	logger.Infow("compacted ip addresses", "resolved", len(resolutions), "dry_run", dryRun)
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"net/http"
 	"net/url"
+	"os"
 	"text/template"
 	"time"
 
@@ -20,18 +21,50 @@ import (
 	"golang.org/x/oauth2/clientcredentials"
 
 	"go.hollow.sh/metadataservice/internal/config"
+	"go.hollow.sh/metadataservice/internal/events"
 	"go.hollow.sh/metadataservice/internal/httpsrv"
+	"go.hollow.sh/metadataservice/internal/idempotency"
+	"go.hollow.sh/metadataservice/internal/inventory"
+	"go.hollow.sh/metadataservice/internal/lastfetch"
 	"go.hollow.sh/metadataservice/internal/lookup"
+	"go.hollow.sh/metadataservice/internal/metadatahistory"
+	"go.hollow.sh/metadataservice/internal/metadataschema"
+	"go.hollow.sh/metadataservice/internal/middleware"
+	"go.hollow.sh/metadataservice/internal/orphanedips"
+	"go.hollow.sh/metadataservice/internal/prewrite"
+	"go.hollow.sh/metadataservice/internal/ratelimit"
+	"go.hollow.sh/metadataservice/internal/readcache"
+	"go.hollow.sh/metadataservice/internal/readonly"
+	"go.hollow.sh/metadataservice/internal/sessiontoken"
+	"go.hollow.sh/metadataservice/internal/stalecache"
+	"go.hollow.sh/metadataservice/internal/upserter"
+	"go.hollow.sh/metadataservice/internal/userdata"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
 )
 
 const (
 	serviceName = "metadata-service"
 
-	dbMaxRetriesDefault       = 5
-	dbRetryMaxIntervalDefault = 3 * time.Second
-	dbTxTimoutDefault         = 15 * time.Second
+	dbMaxRetriesDefault           = 5
+	dbRetryMaxIntervalDefault     = 3 * time.Second
+	dbRetryInitialIntervalDefault = 50 * time.Millisecond
+	dbTxTimoutDefault             = 15 * time.Second
+
+	// The pool defaults follow CockroachDB's recommendations: as many idle
+	// connections as open ones, so bursts don't churn connections, and a
+	// bounded lifetime, so connections rebalance across nodes after restarts
+	dbMaxOpenConnsDefault    = 25
+	dbMaxIdleConnsDefault    = dbMaxOpenConnsDefault
+	dbConnMaxLifetimeDefault = 5 * time.Minute
+	dbConnMaxIdleTimeDefault = 5 * time.Minute
 
 	shutdownGracePeriod = 10 * time.Second
+
+	maxMetadataBodySizeDefault = 1 << 20
+	maxUserdataBodySizeDefault = 4 << 20
+	maxBatchBodySizeDefault    = 32 << 20
+
+	defaultServeStaleMaxAge = time.Hour
 )
 
 // serveCmd represents the serve command
@@ -48,21 +81,78 @@ func init() {
 	serveCmd.Flags().String("listen", "0.0.0.0:8000", "address on which to listen")
 	viperBindFlag("listen", serveCmd.Flags().Lookup("listen"))
 
+	serveCmd.Flags().String("tls-cert-file", "", "The path to a PEM-encoded certificate (followed by any intermediates) to terminate TLS with. TLS is only served when a certificate and key are given. The certificate and key are read again on SIGHUP, so they can be rotated without a restart.")
+	viperBindFlag("tls.cert_file", serveCmd.Flags().Lookup("tls-cert-file"))
+
+	serveCmd.Flags().String("tls-key-file", "", "The path to the PEM-encoded private key of the TLS certificate.")
+	viperBindFlag("tls.key_file", serveCmd.Flags().Lookup("tls-key-file"))
+
+	serveCmd.Flags().String("tls-min-version", "1.2", "The minimum TLS version accepted. One of '1.2' or '1.3'.")
+	viperBindFlag("tls.min_version", serveCmd.Flags().Lookup("tls-min-version"))
+
+	serveCmd.Flags().StringSlice("tls-cipher-suites", []string{}, "Comma-separated list of the cipher suites offered for TLS 1.2 connections, like \"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256\". TLS 1.3 cipher suites can't be configured. Go's defaults are used when unset.")
+	viperBindFlag("tls.cipher_suites", serveCmd.Flags().Lookup("tls-cipher-suites"))
+
+	serveCmd.Flags().String("tls-client-ca-file", "", "The path to the PEM-encoded CA certificates client certificates are verified against. When set, clients may present a certificate, which can identify the instance (see --instance-auth).")
+	viperBindFlag("tls.client_ca_file", serveCmd.Flags().Lookup("tls-client-ca-file"))
+
+	serveCmd.Flags().String("instance-auth", "source-ip", "How the instance is identified on the instance-facing routes: 'source-ip' by the address the request came from, 'client-cert' by its verified client certificate (which is then required), or 'client-cert-or-source-ip' by its client certificate when one is presented, and by address otherwise. Client certificates require --tls-client-ca-file.")
+	viperBindFlag("instance_auth.mode", serveCmd.Flags().Lookup("instance-auth"))
+
+	serveCmd.Flags().StringToString("instance-auth-routes", map[string]string{}, "Overrides --instance-auth for individual routes, like \"metadata=client-cert,ec2-metadata=source-ip\". The routes are metadata, userdata, boot-config, instance-data, ec2-metadata, ec2-userdata and openstack-metadata.")
+	viperBindFlag("instance_auth.routes", serveCmd.Flags().Lookup("instance-auth-routes"))
+
+	serveCmd.Flags().String("instance-auth-cert-identity", "cn", "The part of the client certificate the instance ID is read from: 'cn' for the subject common name, 'dns-san' for the first DNS name, or 'uri-san' for the last path segment of the first URI (like a SPIFFE ID), in the subject alternative names, which is a valid instance ID.")
+	viperBindFlag("instance_auth.cert_identity", serveCmd.Flags().Lookup("instance-auth-cert-identity"))
+
+	serveCmd.Flags().StringSlice("cors-allowed-origins", []string{}, "Comma-separated list of the origins, like \"https://console.example.com\", browsers may make cross-origin requests from, or \"*\" for any origin. No CORS headers are sent when unset, so browsers only allow same-origin requests.")
+	viperBindFlag("cors.allowed_origins", serveCmd.Flags().Lookup("cors-allowed-origins"))
+
+	serveCmd.Flags().StringSlice("cors-allowed-methods", httpsrv.DefaultCORSMethods, "Comma-separated list of the methods allowed for cross-origin requests.")
+	viperBindFlag("cors.allowed_methods", serveCmd.Flags().Lookup("cors-allowed-methods"))
+
+	serveCmd.Flags().StringSlice("cors-allowed-headers", httpsrv.DefaultCORSHeaders, "Comma-separated list of the request headers allowed for cross-origin requests.")
+	viperBindFlag("cors.allowed_headers", serveCmd.Flags().Lookup("cors-allowed-headers"))
+
+	serveCmd.Flags().Bool("cors-allow-credentials", false, "Allow cross-origin requests to include cookies and authorization headers. Only takes effect with an explicit --cors-allowed-origins list; credentials are never allowed for the \"*\" origin.")
+	viperBindFlag("cors.allow_credentials", serveCmd.Flags().Lookup("cors-allow-credentials"))
+
+	serveCmd.Flags().Duration("cors-max-age", httpsrv.DefaultCORSMaxAge, "How long browsers may cache the response to a cross-origin preflight request.")
+	viperBindFlag("cors.max_age", serveCmd.Flags().Lookup("cors-max-age"))
+
 	// Otel flags
 	otelx.MustViperFlags(viper.GetViper(), serveCmd.Flags())
 
 	// DB flags
 	crdbx.MustViperFlags(viper.GetViper(), serveCmd.Flags())
 
+	serveCmd.Flags().Int("db-max-open-conns", dbMaxOpenConnsDefault, "maximum number of open connections to the database, 0 for no limit")
+	viperBindFlag("crdb.connections.max_open", serveCmd.Flags().Lookup("db-max-open-conns"))
+
+	serveCmd.Flags().Int("db-max-idle-conns", dbMaxIdleConnsDefault, "maximum number of idle connections kept open to the database, which can't be more than --db-max-open-conns")
+	viperBindFlag("crdb.connections.max_idle", serveCmd.Flags().Lookup("db-max-idle-conns"))
+
+	serveCmd.Flags().Duration("db-conn-max-lifetime", dbConnMaxLifetimeDefault, "maximum time a database connection is reused for, so connections are spread across the cluster's nodes again after they restart. 0 to reuse connections forever")
+	viperBindFlag("crdb.connections.max_lifetime", serveCmd.Flags().Lookup("db-conn-max-lifetime"))
+
+	serveCmd.Flags().Duration("db-conn-max-idle-time", dbConnMaxIdleTimeDefault, "maximum time a database connection is kept open while idle. 0 to keep idle connections open until their lifetime ends")
+	viperBindFlag("crdb.connections.max_idle_time", serveCmd.Flags().Lookup("db-conn-max-idle-time"))
+
 	serveCmd.Flags().Int("db-tx-max-retries", dbMaxRetriesDefault, "maximum number of times to retry failed db transactions")
 	viperBindFlag("crdb.max_retries", serveCmd.Flags().Lookup("db-tx-max-retries"))
 
 	serveCmd.Flags().Duration("db-retry-max-interval", dbRetryMaxIntervalDefault, "maximum number of seconds to sleep between db transaction retries (includes random jitter)")
 	viperBindFlag("crdb.retry_interval", serveCmd.Flags().Lookup("db-retry-max-interval"))
 
+	serveCmd.Flags().Duration("db-retry-initial-interval", dbRetryInitialIntervalDefault, "maximum time to sleep before the first db transaction retry, doubling with each retry up to --db-retry-max-interval (includes random jitter)")
+	viperBindFlag("crdb.retry_initial_interval", serveCmd.Flags().Lookup("db-retry-initial-interval"))
+
 	serveCmd.Flags().Duration("db-tx-timeout", dbTxTimoutDefault, "maximum number of seconds to allow db transactions to run for")
 	viperBindFlag("crdb.tx_timeout", serveCmd.Flags().Lookup("db-tx-timeout"))
 
+	serveCmd.Flags().Duration("db-tx-max-retry-duration", 0, "maximum total time to spend attempting and retrying a failed db upsert transaction, 0 for no limit")
+	viperBindFlag("crdb.max_retry_duration", serveCmd.Flags().Lookup("db-tx-max-retry-duration"))
+
 	// OIDC Flags
 	serveCmd.Flags().Bool("oidc", true, "use oidc auth")
 	viperBindFlag("oidc.enabled", serveCmd.Flags().Lookup("oidc"))
@@ -105,9 +195,12 @@ func init() {
 	viperBindFlag("lookup.oidc.scopes", serveCmd.Flags().Lookup("lookup-oidc-scopes"))
 
 	// Misc serve flags
-	serveCmd.Flags().StringSlice("gin-trusted-proxies", []string{}, "Comma-separated list of IP addresses, like `\"192.168.1.1,10.0.0.1\"`. When running the Metadata Service behind something like a reverse proxy or load balancer, you may need to set this so that gin's `(*Context).ClientIP()` method returns a value provided by the proxy in a header like `X-Forwarded-For`.")
+	serveCmd.Flags().StringSlice("gin-trusted-proxies", []string{}, "Comma-separated list of IP addresses or CIDRs, like `\"192.168.1.1,10.0.0.0/24\"`. When running the Metadata Service behind something like a reverse proxy or load balancer, you may need to set this so that gin's `(*Context).ClientIP()` method returns a value provided by the proxy in a header like `X-Forwarded-For`. When unset, those headers are ignored and the peer address is always used.")
 	viperBindFlag("gin.trustedproxies", serveCmd.Flags().Lookup("gin-trusted-proxies"))
 
+	serveCmd.Flags().String("forwarded-for-policy", string(middleware.ForwardedForIgnore), "What to do with instance-facing requests whose X-Forwarded-For chain looks spoofed, judged against the trusted proxies. One of 'ignore', 'warn' (log them) or 'reject' (log them and respond with a 403).")
+	viperBindFlag("gin.forwarded_for_policy", serveCmd.Flags().Lookup("forwarded-for-policy"))
+
 	serveCmd.Flags().String("api-url", "", "An optional golang template string used to build a URL which instances can use as a reference to the Metadata Service API itself. This template string will be evaluated against the instance metadata, and appended as an 'api_url' field on the metadata document served to instances. If no template string is specified, the 'api_url' field will not be added to the metadata document.")
 	viperBindFlag("metadata.api_url", serveCmd.Flags().Lookup("api-url"))
 
@@ -117,8 +210,258 @@ func init() {
 	serveCmd.Flags().String("user-state-url", "", "An optional golang template string used to build a URL which instances can use for sending user state events. This template string will be evaluated against the instance metadata, and appended as a 'user_state_url' field on the metadata document served to instances. If no template string is specified, the 'user_state_url' field will not be added to the metadata document.")
 	viperBindFlag("metadata.user_state_url", serveCmd.Flags().Lookup("user-state-url"))
 
+	serveCmd.Flags().StringToString("metadata-field-templates", map[string]string{}, "Top-level metadata fields served to instances from a golang template rather than as stored, like \"hostname={{.InstanceID}}.{{.Metro}}.internal\". The templates are rendered with the instance's InstanceID, Hostname, Facility and Metro, and the whole stored document as Metadata, and replace any stored value. A template which fails to render for an instance serves the stored value instead.")
+	viperBindFlag("metadata.field_templates", serveCmd.Flags().Lookup("metadata-field-templates"))
+
+	serveCmd.Flags().StringSlice("metadata-sensitive-paths", []string{}, "Dot-separated paths to metadata fields, like \"bootstrap.token\", which are removed from the metadata served to instances identified by the address their request came from. They're only served to instances identified by a client certificate, and on the authenticated internal routes. A path running through an array applies to each of its elements.")
+	viperBindFlag("metadata.sensitive_paths", serveCmd.Flags().Lookup("metadata-sensitive-paths"))
+
+	serveCmd.Flags().Bool("read-coalescing", false, "Coalesce identical, concurrent metadata and userdata reads (for example, during a boot storm) so they share a single database query.")
+	viperBindFlag("read_coalescing", serveCmd.Flags().Lookup("read-coalescing"))
+
+	serveCmd.Flags().Bool("userdata-normalize-line-endings", false, "Convert CRLF line endings to LF in text-based userdata when it is served to instances. Gzip and MIME multipart userdata is never modified.")
+	viperBindFlag("userdata.transform.normalize_line_endings", serveCmd.Flags().Lookup("userdata-normalize-line-endings"))
+
+	serveCmd.Flags().String("userdata-default-shebang", "", "An optional interpreter line (like '#!/bin/sh') prepended to userdata served to instances when the userdata format can't be detected (that is, it isn't a script, #cloud-config, #include, boothook, gzip or MIME multipart document).")
+	viperBindFlag("userdata.transform.default_shebang", serveCmd.Flags().Lookup("userdata-default-shebang"))
+
+	serveCmd.Flags().String("userdata-vendordata-file", "", "An optional path to a vendor-data file provided by the operator. When set, userdata served to instances is combined with the vendor-data into a single MIME multipart document, so cloud-init processes both. Gzip and MIME multipart userdata is served unchanged.")
+	viperBindFlag("userdata.transform.vendordata_file", serveCmd.Flags().Lookup("userdata-vendordata-file"))
+
+	serveCmd.Flags().Bool("record-last-fetch", false, "Record the source IP and time of the most recent successful metadata fetch for each instance, and report it in the instance status endpoint. Fetches are written to the database in batches.")
+	viperBindFlag("last_fetch.enabled", serveCmd.Flags().Lookup("record-last-fetch"))
+
+	serveCmd.Flags().Duration("record-last-fetch-interval", lastfetch.DefaultFlushInterval, "How often recorded metadata fetches are written to the database.")
+	viperBindFlag("last_fetch.flush_interval", serveCmd.Flags().Lookup("record-last-fetch-interval"))
+
+	serveCmd.Flags().Bool("metadata-history", false, "Keep the previous versions of each instance's metadata, recording when and by whom (the JWT subject) they were replaced, and serve them from the metadata history endpoint.")
+	viperBindFlag("metadata_history.enabled", serveCmd.Flags().Lookup("metadata-history"))
+
+	serveCmd.Flags().Int("metadata-history-max-versions", 0, "The number of previous metadata versions kept for each instance. Older versions are removed in the background. 0 for no limit.")
+	viperBindFlag("metadata_history.max_versions", serveCmd.Flags().Lookup("metadata-history-max-versions"))
+
+	serveCmd.Flags().Duration("metadata-history-max-age", 0, "How long previous metadata versions are kept after being replaced. Older versions are removed in the background. 0 for no limit.")
+	viperBindFlag("metadata_history.max_age", serveCmd.Flags().Lookup("metadata-history-max-age"))
+
+	serveCmd.Flags().Duration("metadata-history-prune-interval", metadatahistory.DefaultPruneInterval, "How often metadata history beyond the retention limits is removed.")
+	viperBindFlag("metadata_history.prune_interval", serveCmd.Flags().Lookup("metadata-history-prune-interval"))
+
+	serveCmd.Flags().Bool("idempotency-keys", false, "Honor the Idempotency-Key header on the metadata, userdata and batch upserts and metadata patches: the first response to a key is stored, and repeats of the same request with the key get it back without the upsert being made again.")
+	viperBindFlag("idempotency_keys.enabled", serveCmd.Flags().Lookup("idempotency-keys"))
+
+	serveCmd.Flags().Duration("idempotency-key-ttl", idempotency.DefaultTTL, "How long the response to an Idempotency-Key is kept. Repeats of the key after then are handled as new requests.")
+	viperBindFlag("idempotency_keys.ttl", serveCmd.Flags().Lookup("idempotency-key-ttl"))
+
+	serveCmd.Flags().Duration("idempotency-key-prune-interval", idempotency.DefaultPruneInterval, "How often expired Idempotency-Key responses are removed.")
+	viperBindFlag("idempotency_keys.prune_interval", serveCmd.Flags().Lookup("idempotency-key-prune-interval"))
+
+	serveCmd.Flags().Duration("orphaned-ip-cleanup-interval", 0, "How often the IP associations of instances with neither metadata nor userdata stored are removed in the background. 0 to disable.")
+	viperBindFlag("orphaned_ips.interval", serveCmd.Flags().Lookup("orphaned-ip-cleanup-interval"))
+	serveCmd.Flags().Int("orphaned-ip-cleanup-batch-size", orphanedips.DefaultBatchSize, "The number of IP associations checked in each of the orphaned IP cleanup's transactions.")
+	viperBindFlag("orphaned_ips.batch_size", serveCmd.Flags().Lookup("orphaned-ip-cleanup-batch-size"))
+	serveCmd.Flags().Duration("orphaned-ip-cleanup-min-age", orphanedips.DefaultMinAge, "How long after it was last updated an orphaned IP association is left alone, so associations pre-loaded ahead of their instance's metadata aren't removed.")
+	viperBindFlag("orphaned_ips.min_age", serveCmd.Flags().Lookup("orphaned-ip-cleanup-min-age"))
+
+	serveCmd.Flags().Duration("inventory-metrics-interval", inventory.DefaultInterval, "How often the stored instances, userdata and IP associations are counted for the inventory Prometheus gauges. 0 to disable.")
+	viperBindFlag("inventory_metrics.interval", serveCmd.Flags().Lookup("inventory-metrics-interval"))
+
+	serveCmd.Flags().Bool("db-stats-metrics", true, "Publish the database connection pool's stats as Prometheus metrics. The stats are always available from /healthz/db on the admin port.")
+	viperBindFlag("db_stats.metrics", serveCmd.Flags().Lookup("db-stats-metrics"))
+
+	serveCmd.Flags().Bool("metadata-schema-validation", true, "Validate the metadata written to the service against a JSON Schema, rejecting metadata which doesn't match with a 422. Disable to accept metadata in any format, as before validation was introduced.")
+	viperBindFlag("metadata_schema.enabled", serveCmd.Flags().Lookup("metadata-schema-validation"))
+
+	serveCmd.Flags().String("metadata-schema", "", "The path to the JSON Schema metadata is validated against. When empty, the default schema is used, which checks the network.addresses[].address structure instances are looked up by, when the metadata has one.")
+	viperBindFlag("metadata_schema.path", serveCmd.Flags().Lookup("metadata-schema"))
+
+	serveCmd.Flags().Bool("datasource-native-enabled", true, "Serve the native JSON datasource routes (like /metadata and /userdata) to instances. The internal, authenticated routes are always served.")
+	viperBindFlag("datasources.native.enabled", serveCmd.Flags().Lookup("datasource-native-enabled"))
+
+	serveCmd.Flags().Bool("datasource-ec2-enabled", true, "Serve the ec2-style datasource routes (under /2009-04-04) to instances.")
+	viperBindFlag("datasources.ec2.enabled", serveCmd.Flags().Lookup("datasource-ec2-enabled"))
+
+	serveCmd.Flags().Bool("datasource-openstack-enabled", true, "Serve the OpenStack-style datasource routes (under /openstack) to instances.")
+	viperBindFlag("datasources.openstack.enabled", serveCmd.Flags().Lookup("datasource-openstack-enabled"))
+
+	serveCmd.Flags().Bool("datasource-ignition-enabled", true, "Serve the Ignition config stored as an instance's userdata (at /ignition/config.ign) to instances.")
+	viperBindFlag("datasources.ignition.enabled", serveCmd.Flags().Lookup("datasource-ignition-enabled"))
+
+	serveCmd.Flags().Bool("ignition-validate", false, "Reject userdata upserts whose userdata is an Ignition config which doesn't declare a supported spec version.")
+	viperBindFlag("ignition.validate", serveCmd.Flags().Lookup("ignition-validate"))
+
+	serveCmd.Flags().Bool("debug-source-ip-header", false, "Add an X-Resolved-Source-IP header to instance-facing responses, reporting the client IP (after any trusted proxy resolution) the service used to identify the instance.")
+	viperBindFlag("debug.source_ip_header", serveCmd.Flags().Lookup("debug-source-ip-header"))
+
+	serveCmd.Flags().String("ec2-not-found-body", string(v1api.NotFoundBodyEmpty), "The body sent with 404 responses from the ec2-style routes served to instances. One of 'empty', 'text' or 'json'. Some clients (like cloud-init) misbehave when these responses have a JSON body.")
+	viperBindFlag("ec2.not_found_body", serveCmd.Flags().Lookup("ec2-not-found-body"))
+
+	serveCmd.Flags().Bool("etags", false, "Set an ETag and Last-Modified on metadata and userdata responses served to instances, and reply with a 304 when the If-None-Match (or If-Modified-Since) request header matches. Metadata and userdata are versioned independently.")
+	viperBindFlag("etags.enabled", serveCmd.Flags().Lookup("etags"))
+
+	serveCmd.Flags().Bool("response-compression", true, "Compress responses with gzip or deflate, when the client accepts it in the Accept-Encoding request header. Streamed responses (like exports) aren't compressed.")
+	viperBindFlag("compression.enabled", serveCmd.Flags().Lookup("response-compression"))
+
+	serveCmd.Flags().Int("response-compression-min-size", middleware.DefaultCompressionMinSize, "The smallest response body (in bytes) compressed, with --response-compression.")
+	viperBindFlag("compression.min_size", serveCmd.Flags().Lookup("response-compression-min-size"))
+
+	serveCmd.Flags().String("instance-id-format", v1api.InstanceIDFormatUUID, "The format instance IDs must be in. One of 'uuid' or 'regex' (UUIDs matching --instance-id-regex).")
+	viperBindFlag("instance_id.format", serveCmd.Flags().Lookup("instance-id-format"))
+
+	serveCmd.Flags().String("instance-id-regex", "", "The regular expression instance IDs must fully match, as well as being UUIDs, when the 'regex' instance ID format is used.")
+	viperBindFlag("instance_id.regex", serveCmd.Flags().Lookup("instance-id-regex"))
+
+	serveCmd.Flags().Int64("max-metadata-body-size", maxMetadataBodySizeDefault, "The maximum size (in bytes) of a request body accepted when creating or updating metadata. Larger requests are rejected with a 413. 0 for no limit.")
+	viperBindFlag("limits.metadata_body_size", serveCmd.Flags().Lookup("max-metadata-body-size"))
+
+	serveCmd.Flags().Int64("max-userdata-body-size", maxUserdataBodySizeDefault, "The maximum size (in bytes) of a request body accepted when creating or updating userdata. Larger requests are rejected with a 413. 0 for no limit.")
+	viperBindFlag("limits.userdata_body_size", serveCmd.Flags().Lookup("max-userdata-body-size"))
+
+	serveCmd.Flags().Int64("max-batch-body-size", maxBatchBodySizeDefault, "The maximum size (in bytes) of a request body accepted when upserting a batch of instances. Larger requests are rejected with a 413. 0 for no limit.")
+	viperBindFlag("limits.batch_body_size", serveCmd.Flags().Lookup("max-batch-body-size"))
+
+	serveCmd.Flags().Bool("stable-instance-id", false, "Always serve the ID of the instance record as the instance-id (the metadata 'id' field), rather than whatever 'id' the stored metadata contains, so clients like cloud-init see a stable instance-id.")
+	viperBindFlag("instance_id.stable", serveCmd.Flags().Lookup("stable-instance-id"))
+
+	serveCmd.Flags().Bool("stable-instance-id-by-source-ip", false, "With --stable-instance-id, derive the instance-id from the request's source IP rather than the instance record, so it stays the same when the address is moved to a different record.")
+	viperBindFlag("instance_id.stable_by_source_ip", serveCmd.Flags().Lookup("stable-instance-id-by-source-ip"))
+
+	serveCmd.Flags().Int64("max-instances", 0, "The maximum number of instances data can be stored for. Requests which would store data for a new instance beyond the limit are rejected with a 403. 0 for no limit.")
+	viperBindFlag("limits.max_instances", serveCmd.Flags().Lookup("max-instances"))
+
+	serveCmd.Flags().Bool("bootstrap-tokens", false, "Allow bootstrap tokens to be issued for instances. Once an instance has been issued a token, it must present it in the X-Metadata-Bootstrap-Token header to be served its metadata or userdata.")
+	viperBindFlag("bootstrap_tokens.enabled", serveCmd.Flags().Lookup("bootstrap-tokens"))
+
+	serveCmd.Flags().Duration("upsert-retry-after", v1api.DefaultUpsertRetryAfter, "How long clients are told to wait (in the Retry-After header of a 504) before retrying a metadata or userdata upsert whose database transaction timed out.")
+	viperBindFlag("crdb.upsert_retry_after", serveCmd.Flags().Lookup("upsert-retry-after"))
+
+	serveCmd.Flags().Bool("serve-stale", false, "Keep the data most recently read from the database for each instance in memory, and serve it to instances when the database can't be read.")
+	viperBindFlag("serve_stale.enabled", serveCmd.Flags().Lookup("serve-stale"))
+
+	serveCmd.Flags().Duration("serve-stale-max-age", defaultServeStaleMaxAge, "The oldest cached data served (with --serve-stale) when the database can't be read. Requests are answered with a 503 instead when the cached data is older than this. 0 for no limit.")
+	viperBindFlag("serve_stale.max_age", serveCmd.Flags().Lookup("serve-stale-max-age"))
+
+	serveCmd.Flags().Bool("read-cache", false, "Cache recently read metadata, userdata and instance IP lookups in memory, so repeated reads don't hit the database. Writes made through this replica invalidate its cache, while other replicas keep serving their cached entries until they expire.")
+	viperBindFlag("read_cache.enabled", serveCmd.Flags().Lookup("read-cache"))
+	serveCmd.Flags().Int("read-cache-size", readcache.DefaultSize, "The maximum number of entries kept in the read cache (with --read-cache), the least recently used ones are evicted first.")
+	viperBindFlag("read_cache.size", serveCmd.Flags().Lookup("read-cache-size"))
+	serveCmd.Flags().Duration("read-cache-ttl", readcache.DefaultTTL, "How long entries are served from the read cache (with --read-cache).")
+	viperBindFlag("read_cache.ttl", serveCmd.Flags().Lookup("read-cache-ttl"))
+	serveCmd.Flags().Float64("read-rate-limit", 0, "The number of reads per second each instance (or address, for requests which don't identify an instance) is allowed, beyond which they're rejected with a 429. Reads aren't limited when 0.")
+	viperBindFlag("read_rate_limit.rate", serveCmd.Flags().Lookup("read-rate-limit"))
+	serveCmd.Flags().Int("read-rate-limit-burst", ratelimit.DefaultBurst, "The number of reads each instance can make at once before being held to --read-rate-limit.")
+	viperBindFlag("read_rate_limit.burst", serveCmd.Flags().Lookup("read-rate-limit-burst"))
+
+	serveCmd.Flags().String("events-nats-url", "", "URL of the NATS server(s) an event is published to whenever an instance's metadata or userdata is upserted. No events are published when empty.")
+	viperBindFlag("events.nats_url", serveCmd.Flags().Lookup("events-nats-url"))
+	serveCmd.Flags().String("events-nats-subject", events.DefaultSubject, "The NATS subject instance change events are published to.")
+	viperBindFlag("events.nats_subject", serveCmd.Flags().Lookup("events-nats-subject"))
+	serveCmd.Flags().String("events-webhook-url", "", "URL instance change events are POSTed to, in the background, whenever an instance's metadata or userdata is upserted. No webhook is called when empty.")
+	viperBindFlag("events.webhook_url", serveCmd.Flags().Lookup("events-webhook-url"))
+	serveCmd.Flags().Duration("events-webhook-timeout", events.DefaultWebhookTimeout, "How long each webhook delivery attempt is given to complete.")
+	viperBindFlag("events.webhook_timeout", serveCmd.Flags().Lookup("events-webhook-timeout"))
+	serveCmd.Flags().Int("events-webhook-retries", events.DefaultWebhookRetries, "How many times a failed webhook delivery is retried before it's given up on.")
+	viperBindFlag("events.webhook_retries", serveCmd.Flags().Lookup("events-webhook-retries"))
+
+	serveCmd.Flags().StringSlice("instance-data-public-fields", v1api.DefaultInstanceDataPublicFields, "The top-level metadata fields which aren't sensitive, and are included unredacted in the cloud-init instance-data.json document. Every other field is treated as sensitive, and only included in instance-data-sensitive.json.")
+	viperBindFlag("instance_data.public_fields", serveCmd.Flags().Lookup("instance-data-public-fields"))
+
+	serveCmd.Flags().Bool("reject-ip-conflicts", false, "Reject upserts including IP addresses associated to other instances with a 409 listing their current owners, rather than reassigning the addresses.")
+	viperBindFlag("ip_conflicts.reject", serveCmd.Flags().Lookup("reject-ip-conflicts"))
+	serveCmd.Flags().Bool("delete-orphaned-instances", false, "Delete the metadata and userdata of an instance when an upsert reassigns its last IP address to another instance, rather than keeping them.")
+	viperBindFlag("ip_conflicts.delete_orphans", serveCmd.Flags().Lookup("delete-orphaned-instances"))
+	serveCmd.Flags().String("ip-less-instances", string(v1api.IPlessAllow), "What to do with metadata upserts which would leave the instance without any IP address, so it could only be fetched by id. One of 'allow', 'warn' (log them) or 'reject' (respond with a 400).")
+	viperBindFlag("ip_less_instances.policy", serveCmd.Flags().Lookup("ip-less-instances"))
+	serveCmd.Flags().Bool("provisioning-marker", false, "Serve the /metadata/provisioning route, which responds to instances whose metadata hasn't been provisioned yet with a 200 and a pending marker rather than a 404.")
+	viperBindFlag("provisioning_marker.enabled", serveCmd.Flags().Lookup("provisioning-marker"))
+	serveCmd.Flags().Bool("default-metadata-enabled", false, "Respond to metadata requests from instances which can't be identified with a default metadata document, rather than a 404.")
+	viperBindFlag("default_metadata.enabled", serveCmd.Flags().Lookup("default-metadata-enabled"))
+	serveCmd.Flags().String("default-metadata-template", v1api.DefaultMetadataTemplate, "Go template rendered into the default metadata document, which must be a JSON object. It's given the request's source address as .SourceIP, and a json function to quote values.")
+	viperBindFlag("default_metadata.template", serveCmd.Flags().Lookup("default-metadata-template"))
+
+	serveCmd.Flags().String("ip-transfer-snapshot", upserter.TransferSnapshotNone, "What to log about an instance when an upsert takes one of its IP addresses. One of 'none', 'hash' (its ID and a hash of its metadata) or 'full' (its ID and its full metadata, which may be sensitive).")
+	viperBindFlag("ip_transfer.snapshot", serveCmd.Flags().Lookup("ip-transfer-snapshot"))
+
+	serveCmd.Flags().String("pre-write-hook-url", "", "URL of a policy service asked to approve each metadata, userdata or IP address change before it's written. Changes it doesn't approve are rejected with a 403. No hook is called when empty.")
+	viperBindFlag("pre_write_hook.url", serveCmd.Flags().Lookup("pre-write-hook-url"))
+
+	serveCmd.Flags().Duration("pre-write-hook-timeout", prewrite.DefaultTimeout, "How long the pre-write hook is given to approve a change. Changes are rejected with a 503 when it doesn't answer in time.")
+	viperBindFlag("pre_write_hook.timeout", serveCmd.Flags().Lookup("pre-write-hook-timeout"))
+
+	serveCmd.Flags().String("session-token-key", "", "Key used to sign IMDSv2-style session tokens, at least 32 bytes long. When set, instances can PUT to /latest/api/token for a token, which they then present in the X-aws-ec2-metadata-token header. Prefer setting it through METADATASERVICE_SESSION_TOKENS_KEY.")
+	viperBindFlag("session_tokens.key", serveCmd.Flags().Lookup("session-token-key"))
+	serveCmd.Flags().Duration("session-token-max-ttl", sessiontoken.DefaultMaxTTL, "The longest session tokens are issued for. Longer requested TTLs are clamped to it.")
+	viperBindFlag("session_tokens.max_ttl", serveCmd.Flags().Lookup("session-token-max-ttl"))
+	serveCmd.Flags().String("metrics-bearer-token", "", "A bearer token required to read /metrics. The endpoint is open unless a token or basic auth credentials are set. Prefer setting it through METADATASERVICE_METRICS_AUTH_BEARER_TOKEN.")
+	viperBindFlag("metrics.auth.bearer_token", serveCmd.Flags().Lookup("metrics-bearer-token"))
+
+	serveCmd.Flags().String("metrics-basic-auth-username", "", "A basic auth username required to read /metrics, along with --metrics-basic-auth-password. When a bearer token is also set, either is accepted.")
+	viperBindFlag("metrics.auth.username", serveCmd.Flags().Lookup("metrics-basic-auth-username"))
+
+	serveCmd.Flags().String("metrics-basic-auth-password", "", "The basic auth password required to read /metrics. Prefer setting it through METADATASERVICE_METRICS_AUTH_PASSWORD.")
+	viperBindFlag("metrics.auth.password", serveCmd.Flags().Lookup("metrics-basic-auth-password"))
+
+	serveCmd.Flags().Bool("require-session-token", false, "Reject instance-facing metadata and userdata reads without a session token with a 401. Requires --session-token-key.")
+	viperBindFlag("session_tokens.required", serveCmd.Flags().Lookup("require-session-token"))
+
+	serveCmd.Flags().StringSlice("liveness-paths", httpsrv.DefaultLivenessPaths, "The paths the liveness check is served on. Replaces the defaults, so include them to serve the check on both.")
+	viperBindFlag("health.liveness_paths", serveCmd.Flags().Lookup("liveness-paths"))
+
+	serveCmd.Flags().StringSlice("readiness-paths", httpsrv.DefaultReadinessPaths, "The paths the readiness check (which also checks the database) is served on. Replaces the defaults, so include them to serve the check on both.")
+	viperBindFlag("health.readiness_paths", serveCmd.Flags().Lookup("readiness-paths"))
+
+	serveCmd.Flags().Bool("readiness-skip-migration-check", false, "Don't fail the readiness check while the database schema is behind the migrations in this build, for environments which manage migrations out of band.")
+	viperBindFlag("health.skip_migration_check", serveCmd.Flags().Lookup("readiness-skip-migration-check"))
+
+	serveCmd.Flags().Duration("read-timeout", 0, "How long instance-facing routes, and internal routes reading a single instance's data, have to respond. 0 for no limit beyond the server's own.")
+	viperBindFlag("timeouts.read", serveCmd.Flags().Lookup("read-timeout"))
+
+	serveCmd.Flags().Duration("write-timeout", 0, "How long internal routes creating, updating or deleting data have to respond, including any database retries. 0 for no limit beyond the server's own.")
+	viperBindFlag("timeouts.write", serveCmd.Flags().Lookup("write-timeout"))
+
+	serveCmd.Flags().Duration("admin-timeout", 0, "How long long-running internal routes working on every instance (exports, re-deriving all IP associations) have to respond. 0 for no limit beyond the server's own.")
+	viperBindFlag("timeouts.admin", serveCmd.Flags().Lookup("admin-timeout"))
+
+	serveCmd.Flags().Duration("server-read-timeout", httpsrv.DefaultServerTimeouts.Read, "How long the server allows for reading a whole request, including its body.")
+	viperBindFlag("server_timeouts.read", serveCmd.Flags().Lookup("server-read-timeout"))
+
+	serveCmd.Flags().Duration("server-write-timeout", httpsrv.DefaultServerTimeouts.Write, "How long the server allows for writing a response, from the end of reading the request's headers. Raise it to serve large userdata over slow links. It can't be shorter than any of the route timeouts.")
+	viperBindFlag("server_timeouts.write", serveCmd.Flags().Lookup("server-write-timeout"))
+
+	serveCmd.Flags().Duration("server-idle-timeout", httpsrv.DefaultServerTimeouts.Idle, "How long the server keeps an idle keep-alive connection open waiting for the next request.")
+	viperBindFlag("server_timeouts.idle", serveCmd.Flags().Lookup("server-idle-timeout"))
+
+	serveCmd.Flags().Duration("server-read-header-timeout", httpsrv.DefaultServerTimeouts.ReadHeader, "How long the server allows for reading a request's headers.")
+	viperBindFlag("server_timeouts.read_header", serveCmd.Flags().Lookup("server-read-header-timeout"))
+
+	serveCmd.Flags().String("root-response", string(httpsrv.RootResponseNotFound), "The response for requests to the exact root path. One of 'not-found' (a 404, like any unknown route), 'no-content' (an empty 204) or 'info' (a JSON document with the service name and version).")
+	viperBindFlag("root_response", serveCmd.Flags().Lookup("root-response"))
+
+	serveCmd.Flags().String("unix-socket", "", "Path of a unix socket to serve the service on as well as its TCP address, for host-local agents. Not served on a socket when empty.")
+	viperBindFlag("unix_socket.path", serveCmd.Flags().Lookup("unix-socket"))
+
+	serveCmd.Flags().String("unix-socket-mode", "0660", "The octal permissions the unix socket is created with.")
+	viperBindFlag("unix_socket.mode", serveCmd.Flags().Lookup("unix-socket-mode"))
+
+	serveCmd.Flags().String("unix-socket-instance-id", "", "The instance served on the instance-facing routes for requests over the unix socket which don't select one, as there's no source IP to identify them by.")
+	viperBindFlag("unix_socket.instance_id", serveCmd.Flags().Lookup("unix-socket-instance-id"))
+
+	serveCmd.Flags().String("unix-socket-instance-id-header", "", "A header requests over the unix socket can select the instance served on the instance-facing routes with. Not read when empty.")
+	viperBindFlag("unix_socket.instance_id_header", serveCmd.Flags().Lookup("unix-socket-instance-id-header"))
+
+	serveCmd.Flags().String("admin-listen", "", "address on which to serve the authenticated admin endpoints, like pprof. The admin server isn't started when empty.")
+	viperBindFlag("admin.listen", serveCmd.Flags().Lookup("admin-listen"))
+
+	serveCmd.Flags().Bool("pprof-enabled", false, "Serve the net/http/pprof endpoints under /debug/pprof on the admin port. Requires --admin-listen.")
+	viperBindFlag("admin.pprof.enabled", serveCmd.Flags().Lookup("pprof-enabled"))
+
+	serveCmd.Flags().Bool("read-only", false, "Start in read-only mode, rejecting upserts and deletes with a 503 while reads are served. It can be switched at runtime with PUT /read-only on the admin port.")
+	viperBindFlag("read_only.enabled", serveCmd.Flags().Lookup("read-only"))
+
 	serveCmd.Flags().Duration("shutdown-grace-period", shutdownGracePeriod, "The grace period for requests to finish before forcibly exiting.")
 	viperBindFlag("shutdown_grace_period", serveCmd.Flags().Lookup("shutdown-grace-period"))
+
+	serveCmd.Flags().Duration("shutdown-drain-delay", 0, "How long to keep serving requests after a shutdown signal, while the readiness check fails, so load balancers can stop routing new requests to the service before it stops accepting connections.")
+	viperBindFlag("shutdown_drain_delay", serveCmd.Flags().Lookup("shutdown-drain-delay"))
 }
 
 func serve(ctx context.Context) {
@@ -133,6 +476,82 @@ func serve(ctx context.Context) {
 		logger.Fatalw("error getting lookup service client", "error", err)
 	}
 
+	ec2NotFoundBody, err := v1api.ParseNotFoundBody(viper.GetString("ec2.not_found_body"))
+	if err != nil {
+		logger.Fatalw("invalid ec2 not found body", "error", err)
+	}
+
+	instanceIDFormat, err := v1api.ParseInstanceIDFormat(viper.GetString("instance_id.format"), viper.GetString("instance_id.regex"))
+	if err != nil {
+		logger.Fatalw("invalid instance id format", "error", err)
+	}
+
+	if err := upserter.ValidateTransferSnapshot(viper.GetString("ip_transfer.snapshot")); err != nil {
+		logger.Fatalw("invalid ip transfer snapshot mode", "error", err)
+	}
+
+	forwardedForPolicy, err := middleware.ParseForwardedForPolicy(viper.GetString("gin.forwarded_for_policy"))
+	if err != nil {
+		logger.Fatalw("invalid x-forwarded-for policy", "error", err)
+	}
+
+	iplessPolicy, err := v1api.ParseIPlessPolicy(viper.GetString("ip_less_instances.policy"))
+	if err != nil {
+		logger.Fatalw("invalid ip-less instances policy", "error", err)
+	}
+
+	rootResponse, err := httpsrv.ParseRootResponse(viper.GetString("root_response"))
+	if err != nil {
+		logger.Fatalw("invalid root response", "error", err)
+	}
+
+	serverTimeouts := httpsrv.ServerTimeouts{
+		Read:       viper.GetDuration("server_timeouts.read"),
+		Write:      viper.GetDuration("server_timeouts.write"),
+		Idle:       viper.GetDuration("server_timeouts.idle"),
+		ReadHeader: viper.GetDuration("server_timeouts.read_header"),
+	}
+
+	routeTimeouts := v1api.RouteTimeouts{
+		Read:  viper.GetDuration("timeouts.read"),
+		Write: viper.GetDuration("timeouts.write"),
+		Admin: viper.GetDuration("timeouts.admin"),
+	}
+
+	if err := serverTimeouts.Validate(routeTimeouts); err != nil {
+		logger.Fatalw("invalid server timeouts", "error", err)
+	}
+
+	livenessPaths := viper.GetStringSlice("health.liveness_paths")
+	readinessPaths := viper.GetStringSlice("health.readiness_paths")
+
+	if err := httpsrv.ValidateHealthPaths(livenessPaths, readinessPaths); err != nil {
+		logger.Fatalw("invalid health check paths", "error", err)
+	}
+
+	var defaultMetadata *v1api.DefaultMetadata
+
+	if viper.GetBool("default_metadata.enabled") {
+		defaultMetadata, err = v1api.ParseDefaultMetadata(viper.GetString("default_metadata.template"))
+		if err != nil {
+			logger.Fatalw("invalid default metadata template", "error", err)
+		}
+	}
+
+	var metadataSchema *metadataschema.Validator
+
+	if viper.GetBool("metadata_schema.enabled") {
+		metadataSchema, err = metadataschema.Load(viper.GetString("metadata_schema.path"))
+		if err != nil {
+			logger.Fatalw("invalid metadata schema", "error", err)
+		}
+	}
+
+	// pprof is never served on the instance-facing port
+	if viper.GetBool("admin.pprof.enabled") && viper.GetString("admin.listen") == "" {
+		logger.Fatal("pprof requires an admin listen address (--admin-listen)")
+	}
+
 	hs := &httpsrv.Server{
 		Logger: logger.Desugar(),
 		Listen: viper.GetString("listen"),
@@ -152,9 +571,152 @@ func serve(ctx context.Context) {
 		LookupClient:    lookupClient,
 		TemplateFields:  getTemplateFields(),
 		ShutdownTimeout: viper.GetDuration("shutdown_grace_period"),
+		ReadCoalescing:  viper.GetBool("read_coalescing"),
+		UserdataTransformer: userdata.Transformer{
+			NormalizeLineEndings: viper.GetBool("userdata.transform.normalize_line_endings"),
+			DefaultShebang:       viper.GetString("userdata.transform.default_shebang"),
+			VendorData:           getVendorData(),
+		},
+		Datasources: v1api.DatasourceConfig{
+			v1api.DatasourceNative:    viper.GetBool("datasources.native.enabled"),
+			v1api.DatasourceEc2:       viper.GetBool("datasources.ec2.enabled"),
+			v1api.DatasourceOpenstack: viper.GetBool("datasources.openstack.enabled"),
+			v1api.DatasourceIgnition:  viper.GetBool("datasources.ignition.enabled"),
+		},
+		SourceIPDebugHeader: viper.GetBool("debug.source_ip_header"),
+		Ec2NotFoundBody:     ec2NotFoundBody,
+		MaxMetadataBodySize: viper.GetInt64("limits.metadata_body_size"),
+		MaxUserdataBodySize: viper.GetInt64("limits.userdata_body_size"),
+		MaxBatchBodySize:    viper.GetInt64("limits.batch_body_size"),
+		ETags:               viper.GetBool("etags.enabled"),
+		Compression:         viper.GetBool("compression.enabled"),
+		CompressionMinSize:  viper.GetInt("compression.min_size"),
+		AdminListen:         viper.GetString("admin.listen"),
+		PprofEnabled:        viper.GetBool("admin.pprof.enabled"),
+		InstanceIDFormat:    instanceIDFormat,
+		MaxInstances:        viper.GetInt64("limits.max_instances"),
+		StableInstanceID:    viper.GetBool("instance_id.stable"),
+		StableIDBySourceIP:  viper.GetBool("instance_id.stable_by_source_ip"),
+		MetadataTemplates:   getMetadataTemplates(),
+		SensitivePaths:      getSensitivePaths(),
+		RootResponse:        rootResponse,
+		BootstrapTokens:     viper.GetBool("bootstrap_tokens.enabled"),
+		MetadataHistory:     viper.GetBool("metadata_history.enabled"),
+		IdempotencyKeys:     viper.GetBool("idempotency_keys.enabled"),
+		IdempotencyTTL:      viper.GetDuration("idempotency_keys.ttl"),
+		ValidateIgnition:    viper.GetBool("ignition.validate"),
+		InventoryInterval:   viper.GetDuration("inventory_metrics.interval"),
+		DBStatsMetrics:      viper.GetBool("db_stats.metrics"),
+		MetadataSchema:      metadataSchema,
+		Deprecations:        getAPIDeprecations(),
+		UpsertRetryAfter:    viper.GetDuration("crdb.upsert_retry_after"),
+		ForwardedForPolicy:  forwardedForPolicy,
+		LivenessPaths:       livenessPaths,
+		ReadinessPaths:      readinessPaths,
+		SkipMigrationCheck:  viper.GetBool("health.skip_migration_check"),
+		RejectIPConflicts:   viper.GetBool("ip_conflicts.reject"),
+		IPlessPolicy:        iplessPolicy,
+		ProvisioningMarker:  viper.GetBool("provisioning_marker.enabled"),
+		DefaultMetadata:     defaultMetadata,
+		ReadOnly:            readonly.New(viper.GetBool("read_only.enabled")),
+		ShutdownDrainDelay:  viper.GetDuration("shutdown_drain_delay"),
+		TLS:                 getTLSConfig(),
+		UnixSocket:          getUnixSocketConfig(),
+		CORS:                getCORSConfig(),
+		MetricsAuth:         getMetricsAuthConfig(),
+		InstanceAuth:        getInstanceAuth(),
+		ServerTimeouts:      serverTimeouts,
+		RouteTimeouts:       routeTimeouts,
+
+		InstanceDataPublicFields: viper.GetStringSlice("instance_data.public_fields"),
+	}
+
+	if viper.GetBool("serve_stale.enabled") {
+		hs.StaleCache = stalecache.New(viper.GetDuration("serve_stale.max_age"))
+	}
+
+	if viper.GetBool("read_cache.enabled") {
+		hs.ReadCache = readcache.New(viper.GetInt("read_cache.size"), viper.GetDuration("read_cache.ttl"))
+	}
+
+	hs.ReadRateLimiter = ratelimit.New(viper.GetFloat64("read_rate_limit.rate"), viper.GetInt("read_rate_limit.burst"), ratelimit.DefaultIdleTimeout)
+
+	if natsURL := viper.GetString("events.nats_url"); natsURL != "" {
+		publisher, err := events.Connect(natsURL, viper.GetString("events.nats_subject"), logger.Desugar())
+		if err != nil {
+			logger.Fatalw("failed to connect to nats", "error", err)
+		}
+
+		defer publisher.Close()
+
+		hs.Events = publisher
+	}
+
+	if webhookURL := viper.GetString("events.webhook_url"); webhookURL != "" {
+		webhook, err := events.NewWebhook(webhookURL, viper.GetString("events.webhook_secret"), viper.GetDuration("events.webhook_timeout"), viper.GetInt("events.webhook_retries"), &http.Client{}, logger.Desugar())
+		if err != nil {
+			logger.Fatalw("invalid events webhook", "error", err)
+		}
+
+		if hs.Events == nil {
+			hs.Events = events.NewPublisher(nil, "", logger.Desugar())
+
+			defer hs.Events.Close()
+		}
+
+		hs.Events.SetWebhook(webhook)
+	}
+
+	if hookURL := viper.GetString("pre_write_hook.url"); hookURL != "" {
+		hook, err := prewrite.NewHook(hookURL, viper.GetDuration("pre_write_hook.timeout"), &http.Client{})
+		if err != nil {
+			logger.Fatalw("invalid pre-write hook", "error", err)
+		}
+
+		hs.PreWriteHook = hook
 	}
 
-	if err := hs.Run(ctx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+	if key := viper.GetString("session_tokens.key"); key != "" {
+		issuer, err := sessiontoken.NewIssuer([]byte(key), viper.GetDuration("session_tokens.max_ttl"))
+		if err != nil {
+			logger.Fatalw("invalid session token config", "error", err)
+		}
+
+		hs.SessionTokens = issuer
+		hs.RequireSessionToken = viper.GetBool("session_tokens.required")
+	} else if viper.GetBool("session_tokens.required") {
+		logger.Fatal("session tokens can't be required without a session token key (--session-token-key)")
+	}
+
+	if viper.GetBool("last_fetch.enabled") {
+		hs.FetchRecorder = lastfetch.NewRecorder(db, logger.Desugar(), viper.GetDuration("last_fetch.flush_interval"))
+	}
+
+	retention := metadatahistory.Retention{
+		MaxVersions: viper.GetInt("metadata_history.max_versions"),
+		MaxAge:      viper.GetDuration("metadata_history.max_age"),
+	}
+
+	if hs.MetadataHistory && retention.Limited() {
+		hs.HistoryPruner = metadatahistory.NewPruner(db, logger.Desugar(), hs.ReadOnly, retention, viper.GetDuration("metadata_history.prune_interval"))
+	}
+
+	if hs.IdempotencyKeys {
+		hs.IdempotencyPruner = idempotency.NewPruner(db, logger.Desugar(), hs.ReadOnly, viper.GetDuration("idempotency_keys.prune_interval"))
+	}
+
+	if interval := viper.GetDuration("orphaned_ips.interval"); interval > 0 {
+		hs.OrphanedIPs = orphanedips.NewReconciler(db, logger.Desugar(), hs.ReadOnly, hs.ReadCache, interval, viper.GetInt("orphaned_ips.batch_size"), viper.GetDuration("orphaned_ips.min_age"))
+	}
+
+	err = hs.Run(ctx)
+
+	// The database is only closed once in-flight requests have finished
+	if closeErr := db.Close(); closeErr != nil {
+		logger.Warnw("failed to close database connections", "error", closeErr)
+	}
+
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		logger.Fatalw("failure running metadata server", "error", err)
 	}
 }
@@ -178,9 +740,42 @@ func initDB() *sqlx.DB {
 
 	db := sqlx.NewDb(sqldb, dbDriverName)
 
+	configureDBPool(db)
+
 	return db
 }
 
+// configureDBPool applies the connection pool settings. crdbx only sets the
+// number of connections, and uses the lifetime as the idle time, so every
+// setting is applied here.
+func configureDBPool(db *sqlx.DB) {
+	maxOpen := viper.GetInt("crdb.connections.max_open")
+	maxIdle := viper.GetInt("crdb.connections.max_idle")
+	maxLifetime := viper.GetDuration("crdb.connections.max_lifetime")
+	maxIdleTime := viper.GetDuration("crdb.connections.max_idle_time")
+
+	switch {
+	case maxOpen < 0 || maxIdle < 0:
+		logger.Fatalw("the database connection limits can't be negative", "max_open", maxOpen, "max_idle", maxIdle)
+	case maxOpen > 0 && maxIdle > maxOpen:
+		logger.Fatalw("the idle database connections (--db-max-idle-conns) can't be more than the open connections (--db-max-open-conns)", "max_open", maxOpen, "max_idle", maxIdle)
+	case maxLifetime < 0 || maxIdleTime < 0:
+		logger.Fatalw("the database connection lifetime and idle time can't be negative", "max_lifetime", maxLifetime, "max_idle_time", maxIdleTime)
+	}
+
+	db.SetMaxOpenConns(maxOpen)
+	db.SetMaxIdleConns(maxIdle)
+	db.SetConnMaxLifetime(maxLifetime)
+	db.SetConnMaxIdleTime(maxIdleTime)
+
+	logger.Infow("configured database connection pool",
+		"max_open", maxOpen,
+		"max_idle", maxIdle,
+		"max_lifetime", maxLifetime.String(),
+		"max_idle_time", maxIdleTime.String(),
+	)
+}
+
 func getLookupClient(ctx context.Context) (*lookup.ServiceClient, error) {
 	if viper.GetBool("lookup.enabled") {
 		provider, err := oidc.NewProvider(ctx, viper.GetString("lookup.oidc.issuer"))
@@ -202,6 +797,195 @@ func getLookupClient(ctx context.Context) (*lookup.ServiceClient, error) {
 	return nil, nil
 }
 
+// getAPIDeprecations reads the deprecation schedule for each API version from
+// the api_versions.<version> config, for example api_versions.v1.sunset_at
+func getAPIDeprecations() map[string]httpsrv.APIDeprecation {
+	deprecations := make(map[string]httpsrv.APIDeprecation)
+
+	for _, version := range httpsrv.APIVersions {
+		key := "api_versions." + version
+
+		deprecations[version] = httpsrv.APIDeprecation{
+			DeprecatedAt: viper.GetTime(key + ".deprecated_at"),
+			SunsetAt:     viper.GetTime(key + ".sunset_at"),
+			Link:         viper.GetString(key + ".link"),
+		}
+	}
+
+	return deprecations
+}
+
+// getMetricsAuthConfig returns the credentials guarding the metrics endpoint,
+// or nil when the endpoint is left open
+func getMetricsAuthConfig() *httpsrv.MetricsAuthConfig {
+	cfg := &httpsrv.MetricsAuthConfig{
+		BearerToken: viper.GetString("metrics.auth.bearer_token"),
+		Username:    viper.GetString("metrics.auth.username"),
+		Password:    viper.GetString("metrics.auth.password"),
+	}
+
+	if (cfg.Username == "") != (cfg.Password == "") {
+		logger.Fatal("metrics basic auth requires both a username (--metrics-basic-auth-username) and a password (--metrics-basic-auth-password)")
+	}
+
+	if cfg.BearerToken == "" && cfg.Username == "" {
+		return nil
+	}
+
+	return cfg
+}
+
+// getUnixSocketConfig returns the unix socket the service is also served on,
+// or nil when no socket path is configured
+func getUnixSocketConfig() *httpsrv.UnixSocketConfig {
+	path := viper.GetString("unix_socket.path")
+	if path == "" {
+		return nil
+	}
+
+	mode, err := httpsrv.ParseUnixSocketMode(viper.GetString("unix_socket.mode"))
+	if err != nil {
+		logger.Fatalw("invalid unix socket mode", "error", err)
+	}
+
+	return &httpsrv.UnixSocketConfig{
+		Path: path,
+		Mode: mode,
+		Identity: v1api.UnixSocketIdentity{
+			InstanceID:       viper.GetString("unix_socket.instance_id"),
+			InstanceIDHeader: viper.GetString("unix_socket.instance_id_header"),
+		},
+	}
+}
+
+// getTLSConfig returns the TLS config for the server, or nil when TLS isn't
+// configured
+func getTLSConfig() *httpsrv.TLSConfig {
+	certFile := viper.GetString("tls.cert_file")
+	keyFile := viper.GetString("tls.key_file")
+
+	if certFile == "" && keyFile == "" {
+		if viper.GetString("tls.client_ca_file") != "" {
+			logger.Fatal("a client ca (--tls-client-ca-file) requires tls (--tls-cert-file)")
+		}
+
+		return nil
+	}
+
+	if certFile == "" || keyFile == "" {
+		logger.Fatal("tls requires both a certificate (--tls-cert-file) and a key (--tls-key-file)")
+	}
+
+	minVersion, err := httpsrv.ParseTLSVersion(viper.GetString("tls.min_version"))
+	if err != nil {
+		logger.Fatalw("invalid tls min version", "error", err)
+	}
+
+	cipherSuites, err := httpsrv.ParseCipherSuites(viper.GetStringSlice("tls.cipher_suites"))
+	if err != nil {
+		logger.Fatalw("invalid tls cipher suites", "error", err)
+	}
+
+	return &httpsrv.TLSConfig{
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		MinVersion:   minVersion,
+		CipherSuites: cipherSuites,
+		ClientCAFile: viper.GetString("tls.client_ca_file"),
+	}
+}
+
+// getCORSConfig returns the CORS config for the server, or nil when no
+// origins are allowed to make cross-origin requests
+func getCORSConfig() *httpsrv.CORSConfig {
+	origins := viper.GetStringSlice("cors.allowed_origins")
+	if len(origins) == 0 {
+		return nil
+	}
+
+	config := &httpsrv.CORSConfig{
+		AllowOrigins:     origins,
+		AllowMethods:     viper.GetStringSlice("cors.allowed_methods"),
+		AllowHeaders:     viper.GetStringSlice("cors.allowed_headers"),
+		AllowCredentials: viper.GetBool("cors.allow_credentials"),
+		MaxAge:           viper.GetDuration("cors.max_age"),
+	}
+
+	if err := config.Validate(); err != nil {
+		logger.Fatalw("invalid cors config", "error", err)
+	}
+
+	if config.AllowCredentials && config.AllowsAllOrigins() {
+		logger.Warn("cors credentials (--cors-allow-credentials) can't be allowed for any origin (\"*\"), so they won't be; list the allowed origins instead")
+	}
+
+	return config
+}
+
+// getInstanceAuth returns how instances are identified on each of the
+// instance-facing routes
+func getInstanceAuth() v1api.InstanceAuthConfig {
+	mode, err := v1api.ParseInstanceAuthMode(viper.GetString("instance_auth.mode"))
+	if err != nil {
+		logger.Fatalw("invalid instance auth mode", "error", err)
+	}
+
+	routes, err := v1api.ParseInstanceAuthRoutes(viper.GetStringMapString("instance_auth.routes"))
+	if err != nil {
+		logger.Fatalw("invalid instance auth routes", "error", err)
+	}
+
+	identity, err := v1api.ParseClientCertIdentity(viper.GetString("instance_auth.cert_identity"))
+	if err != nil {
+		logger.Fatalw("invalid instance auth certificate identity", "error", err)
+	}
+
+	auth := v1api.InstanceAuthConfig{
+		Default:  mode,
+		Routes:   routes,
+		Identity: identity,
+	}
+
+	// Client certificates can only be presented, and verified, over TLS
+	if auth.UsesClientCerts() && (viper.GetString("tls.cert_file") == "" || viper.GetString("tls.client_ca_file") == "") {
+		logger.Fatal("identifying instances by client certificate requires tls (--tls-cert-file) and a client ca (--tls-client-ca-file)")
+	}
+
+	return auth
+}
+
+func getVendorData() []byte {
+	path := viper.GetString("userdata.transform.vendordata_file")
+	if path == "" {
+		return nil
+	}
+
+	vendorData, err := os.ReadFile(path)
+	if err != nil {
+		logger.Fatalw("failed to read vendor-data file", "path", path, "error", err)
+	}
+
+	return vendorData
+}
+
+func getSensitivePaths() []v1api.SensitivePath {
+	paths, err := v1api.ParseSensitivePaths(viper.GetStringSlice("metadata.sensitive_paths"))
+	if err != nil {
+		logger.Fatalw("invalid metadata sensitive paths", "error", err)
+	}
+
+	return paths
+}
+
+func getMetadataTemplates() map[string]template.Template {
+	templates, err := v1api.ParseMetadataTemplates(viper.GetStringMapString("metadata.field_templates"))
+	if err != nil {
+		logger.Fatalw("invalid metadata field templates", "error", err)
+	}
+
+	return templates
+}
+
 func getTemplateFields() map[string]template.Template {
 	templates := make(map[string]template.Template)
 
@@ -210,7 +994,7 @@ func getTemplateFields() map[string]template.Template {
 	userStateURL := viper.GetString("metadata.user_state_url")
 
 	if len(apiURL) > 0 {
-		apiURLTempl, err := template.New("apiURL").Parse(apiURL)
+		apiURLTempl, err := v1api.NewTemplate("apiURL").Parse(apiURL)
 		if err != nil {
 			logger.Fatalf("failed to parse API URL template (%s)", apiURL, "error", err)
 		}
@@ -219,7 +1003,7 @@ func getTemplateFields() map[string]template.Template {
 	}
 
 	if len(phoneHomeURL) > 0 {
-		phoneHomeTempl, err := template.New("phoneHomeURL").Parse(phoneHomeURL)
+		phoneHomeTempl, err := v1api.NewTemplate("phoneHomeURL").Parse(phoneHomeURL)
 		if err != nil {
 			logger.Fatalf("failed to parse phone home URL template (%s)", phoneHomeURL, "error", err)
 		}
@@ -228,7 +1012,7 @@ func getTemplateFields() map[string]template.Template {
 	}
 
 	if len(userStateURL) > 0 {
-		userStateTempl, err := template.New("userStateURL").Parse(userStateURL)
+		userStateTempl, err := v1api.NewTemplate("userStateURL").Parse(userStateURL)
 		if err != nil {
 			logger.Fatalf("failed to parse user state URL template (%s)", userStateURL, "error", err)
 		}
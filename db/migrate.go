@@ -3,9 +3,42 @@ package db
 
 import (
 	"embed"
+	"fmt"
+	"io/fs"
+	"strconv"
+	"strings"
 )
 
 // Migrations contain an embedded filesystem with all the sql migration files
 //
 //go:embed migrations/*.sql
 var Migrations embed.FS
+
+// LatestVersion returns the version of the newest embedded migration, which
+// the database schema has to be migrated to for this build of the service.
+// Migration versions are the numeric prefix of their file names.
+func LatestVersion() (int64, error) {
+	files, err := fs.Glob(Migrations, "migrations/*.sql")
+	if err != nil {
+		return 0, err
+	}
+
+	var latest int64
+
+	for _, file := range files {
+		name := strings.TrimPrefix(file, "migrations/")
+
+		prefix, _, _ := strings.Cut(name, "_")
+
+		version, err := strconv.ParseInt(prefix, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("migration %s doesn't start with a version: %w", name, err)
+		}
+
+		if version > latest {
+			latest = version
+		}
+	}
+
+	return latest, nil
+}
@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+
+CREATE TABLE instance_last_fetches (
+  instance_id UUID PRIMARY KEY NOT NULL,
+  source_ip INET NOT NULL,
+  fetched_at TIMESTAMPTZ NOT NULL
+);
+
+COMMENT ON COLUMN instance_last_fetches.instance_id is 'The instance ID';
+COMMENT ON COLUMN instance_last_fetches.source_ip is 'The source IP of the most recent successful metadata fetch for the instance';
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+DROP TABLE instance_last_fetches;
+
+-- +goose StatementEnd
@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+
+CREATE TABLE instance_bootstrap_tokens (
+  instance_id UUID PRIMARY KEY NOT NULL,
+  token_hash STRING NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL
+);
+
+COMMENT ON COLUMN instance_bootstrap_tokens.instance_id is 'The instance ID';
+COMMENT ON COLUMN instance_bootstrap_tokens.token_hash is 'The SHA-256 hash of the instance''s current bootstrap token. The token itself is never stored';
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+DROP TABLE instance_bootstrap_tokens;
+
+-- +goose StatementEnd
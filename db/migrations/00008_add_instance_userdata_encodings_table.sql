@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+
+CREATE TABLE instance_userdata_encodings (
+  instance_id UUID PRIMARY KEY NOT NULL,
+  encoding STRING NOT NULL
+);
+
+COMMENT ON COLUMN instance_userdata_encodings.instance_id is 'The instance ID';
+COMMENT ON COLUMN instance_userdata_encodings.encoding is 'How the instance''s stored userdata is encoded, and so needs to be decoded before being served. Userdata without a row is stored raw';
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+DROP TABLE instance_userdata_encodings;
+
+-- +goose StatementEnd
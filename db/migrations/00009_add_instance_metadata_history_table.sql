@@ -0,0 +1,27 @@
+-- +goose Up
+-- +goose StatementBegin
+
+CREATE TABLE instance_metadata_history (
+  id UUID PRIMARY KEY NOT NULL DEFAULT gen_random_uuid(),
+  instance_id UUID NOT NULL,
+  metadata json NOT NULL,
+  updated_at TIMESTAMPTZ NOT NULL,
+  replaced_at TIMESTAMPTZ NOT NULL,
+  replaced_by STRING NOT NULL DEFAULT '',
+  INDEX instance_metadata_history_instance_id_replaced_at_idx (instance_id, replaced_at DESC)
+);
+
+COMMENT ON COLUMN instance_metadata_history.instance_id is 'The instance ID';
+COMMENT ON COLUMN instance_metadata_history.metadata is 'A previous version of the instance metadata';
+COMMENT ON COLUMN instance_metadata_history.updated_at is 'When this version of the metadata was stored';
+COMMENT ON COLUMN instance_metadata_history.replaced_at is 'When this version of the metadata was replaced';
+COMMENT ON COLUMN instance_metadata_history.replaced_by is 'The JWT subject which replaced this version of the metadata';
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+DROP TABLE instance_metadata_history;
+
+-- +goose StatementEnd
@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+
+CREATE INDEX index_instance_metadata_updated_at_id ON instance_metadata (updated_at, id);
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+DROP INDEX index_instance_metadata_updated_at_id;
+
+-- +goose StatementEnd
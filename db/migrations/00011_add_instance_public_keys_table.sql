@@ -0,0 +1,26 @@
+-- +goose Up
+-- +goose StatementBegin
+
+CREATE TABLE instance_public_keys (
+  instance_id UUID NOT NULL,
+  key_index INT NOT NULL,
+  key_name STRING NOT NULL DEFAULT '',
+  public_key STRING NOT NULL,
+  updated_at TIMESTAMPTZ NOT NULL,
+  PRIMARY KEY (instance_id, key_index)
+);
+
+COMMENT ON COLUMN instance_public_keys.instance_id is 'The instance ID';
+COMMENT ON COLUMN instance_public_keys.key_index is 'The position of the key in the instance''s list of keys, which it''s served at under public-keys/';
+COMMENT ON COLUMN instance_public_keys.key_name is 'The name the key is listed with under public-keys/';
+COMMENT ON COLUMN instance_public_keys.public_key is 'The SSH public key, in authorized_keys format';
+COMMENT ON COLUMN instance_public_keys.updated_at is 'When the instance''s keys were last stored';
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+DROP TABLE instance_public_keys;
+
+-- +goose StatementEnd
@@ -0,0 +1,30 @@
+-- +goose Up
+-- +goose StatementBegin
+
+CREATE TABLE idempotency_keys (
+  idempotency_key STRING PRIMARY KEY NOT NULL,
+  request_hash STRING NOT NULL,
+  response_status INT NOT NULL,
+  response_content_type STRING NOT NULL DEFAULT '',
+  response_body BYTES NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL,
+  expires_at TIMESTAMPTZ NOT NULL,
+  INDEX idempotency_keys_expires_at_idx (expires_at)
+);
+
+COMMENT ON COLUMN idempotency_keys.idempotency_key is 'The Idempotency-Key header the upsert was made with';
+COMMENT ON COLUMN idempotency_keys.request_hash is 'The SHA-256 of the upsert''s method, route, query and body, to detect a key reused for a different request';
+COMMENT ON COLUMN idempotency_keys.response_status is 'The HTTP status the upsert was answered with';
+COMMENT ON COLUMN idempotency_keys.response_content_type is 'The Content-Type of the upsert''s response';
+COMMENT ON COLUMN idempotency_keys.response_body is 'The body of the upsert''s response, replayed for repeats of the request';
+COMMENT ON COLUMN idempotency_keys.created_at is 'When the upsert was made';
+COMMENT ON COLUMN idempotency_keys.expires_at is 'When the key can be used again, and the response is removed';
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+DROP TABLE idempotency_keys;
+
+-- +goose StatementEnd
@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+
+CREATE TABLE instance_tags (
+  instance_id UUID NOT NULL,
+  tag_key STRING NOT NULL,
+  tag_value STRING NOT NULL,
+  updated_at TIMESTAMPTZ NOT NULL,
+  PRIMARY KEY (instance_id, tag_key),
+  INDEX idx_tag (tag_key, tag_value)
+);
+
+COMMENT ON COLUMN instance_tags.instance_id is 'The instance ID';
+COMMENT ON COLUMN instance_tags.tag_key is 'The tag''s key, like "environment"';
+COMMENT ON COLUMN instance_tags.tag_value is 'The tag''s value, like "production"';
+COMMENT ON COLUMN instance_tags.updated_at is 'When the instance''s tags were last stored';
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+DROP TABLE instance_tags;
+
+-- +goose StatementEnd
@@ -0,0 +1,70 @@
+package apierror
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"go.hollow.sh/metadataservice/internal/correlation"
+)
+
+// Code is a stable, machine-readable identifier for the kind of error a
+// response describes. The codes returned by the API are listed in the v1 API
+// package.
+type Code string
+
+const (
+	// CodeRequestTimeout is returned when a request wasn't handled within its
+	// route's timeout
+	CodeRequestTimeout Code = "request_timeout"
+
+	// CodeInvalidForwardedFor is returned when an instance-facing request's
+	// X-Forwarded-For header looks spoofed, and those requests are rejected
+	CodeInvalidForwardedFor Code = "invalid_forwarded_for"
+
+	// CodeServiceUnavailable is returned when something the request depends
+	// on, like the database or the pre-write hook, is unavailable
+	CodeServiceUnavailable Code = "service_unavailable"
+
+	// CodeInternal is returned for any other error handling the request
+	CodeInternal Code = "internal_error"
+)
+
+// Error describes what went wrong handling a request
+type Error struct {
+	Code    Code   `json:"code"`
+	Message string `json:"message"`
+
+	// Details are any further messages, like the fields which failed
+	// validation
+	Details []string `json:"details,omitempty"`
+
+	// RequestID is the request's correlation ID, which is also returned in
+	// the X-Request-ID header and logged with everything done for the request
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// Response is the body of an error response
+type Response struct {
+	Error Error `json:"error"`
+}
+
+// New returns an Error for the request, carrying its request ID
+func New(c *gin.Context, code Code, message string, details ...string) Error {
+	return Error{
+		Code:      code,
+		Message:   message,
+		Details:   details,
+		RequestID: correlation.FromContext(c.Request.Context()),
+	}
+}
+
+// Abort stops the request from being handled any further, responding with
+// an error
+func Abort(c *gin.Context, status int, code Code, message string, details ...string) {
+	c.AbortWithStatusJSON(status, &Response{Error: New(c, code, message, details...)})
+}
+
+// Respond responds with an error, without stopping the handlers which follow
+// from running
+func Respond(c *gin.Context, status int, code Code, message string, details ...string) {
+	c.JSON(status, &Response{Error: New(c, code, message, details...)})
+}
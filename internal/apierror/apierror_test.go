@@ -0,0 +1,41 @@
+package apierror_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/apierror"
+	"go.hollow.sh/metadataservice/internal/correlation"
+)
+
+func TestAbort(t *testing.T) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+
+	req, _ := http.NewRequestWithContext(correlation.NewContext(context.TODO(), "request-id"), http.MethodGet, "/", nil)
+	c.Request = req
+
+	apierror.Abort(c, http.StatusUnprocessableEntity, "invalid_metadata", "invalid metadata", "hostname: is required")
+
+	assert.True(t, c.IsAborted())
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.JSONEq(t, `{"error":{"code":"invalid_metadata","message":"invalid metadata","details":["hostname: is required"],"request_id":"request-id"}}`, w.Body.String())
+}
+
+func TestRespondWithoutRequestID(t *testing.T) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, "/", nil)
+	c.Request = req
+
+	apierror.Respond(c, http.StatusInternalServerError, "internal_error", "internal server error")
+
+	assert.False(t, c.IsAborted())
+	assert.JSONEq(t, `{"error":{"code":"internal_error","message":"internal server error"}}`, w.Body.String())
+}
@@ -0,0 +1,4 @@
+// Package apierror builds the error envelope every route responds with, so
+// clients can branch on a stable, machine-readable code rather than the
+// message, and correlate the error with the service's logs by its request ID.
+package apierror // import go.hollow.sh/metadataservice/internal/apierror
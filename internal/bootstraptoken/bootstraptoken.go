@@ -0,0 +1,98 @@
+package bootstraptoken
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/volatiletech/sqlboiler/v4/boil"
+)
+
+const (
+	// tokenBytes is the number of random bytes in a token
+	tokenBytes = 32
+
+	upsertQuery = `INSERT INTO instance_bootstrap_tokens (instance_id, token_hash, created_at) VALUES ($1, $2, $3)
+ON CONFLICT (instance_id) DO UPDATE SET token_hash = excluded.token_hash, created_at = excluded.created_at`
+
+	selectHashQuery = `SELECT token_hash FROM instance_bootstrap_tokens WHERE instance_id = $1`
+
+	deleteQuery = `DELETE FROM instance_bootstrap_tokens WHERE instance_id = $1`
+)
+
+// Token is a newly issued bootstrap token. The token itself is only available
+// when it's issued.
+type Token struct {
+	InstanceID string    `json:"id"`
+	Token      string    `json:"token"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Issue generates a new bootstrap token for the instance, replacing (and so
+// invalidating) any token previously issued for it.
+func Issue(ctx context.Context, db *sqlx.DB, instanceID string) (*Token, error) {
+	raw := make([]byte, tokenBytes)
+
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+
+	token := &Token{
+		InstanceID: instanceID,
+		Token:      base64.RawURLEncoding.EncodeToString(raw),
+		CreatedAt:  time.Now().UTC(),
+	}
+
+	if _, err := db.ExecContext(ctx, upsertQuery, instanceID, hash(token.Token), token.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// Verify checks the token presented for an instance. required is false when no
+// token has been issued for the instance, in which case none is needed.
+// Otherwise valid reports whether the token is the instance's current one.
+func Verify(ctx context.Context, db *sqlx.DB, instanceID string, token string) (required bool, valid bool, err error) {
+	var stored string
+
+	err = db.GetContext(ctx, &stored, selectHashQuery, instanceID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, false, nil
+	}
+
+	if err != nil {
+		return false, false, err
+	}
+
+	if token == "" {
+		return true, false, nil
+	}
+
+	return true, subtle.ConstantTimeCompare([]byte(stored), []byte(hash(token))) == 1, nil
+}
+
+// Delete removes the token issued for the instance, so none is needed any
+// more, and returns the number of tokens removed. It's meant to be called in
+// the same transaction as the rest of the instance's records are deleted.
+func Delete(ctx context.Context, exec boil.ContextExecutor, instanceID string) (int64, error) {
+	result, err := exec.ExecContext(ctx, deleteQuery, instanceID)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+func hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(sum[:])
+}
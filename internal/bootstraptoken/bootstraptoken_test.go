@@ -0,0 +1,51 @@
+package bootstraptoken_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/bootstraptoken"
+	"go.hollow.sh/metadataservice/internal/dbtools"
+)
+
+func TestIssueAndVerify(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+	instanceID := dbtools.FixtureInstanceA.InstanceID
+
+	// No token is needed until one has been issued
+	required, _, err := bootstraptoken.Verify(context.TODO(), testDB, instanceID, "")
+	assert.NoError(t, err)
+	assert.False(t, required)
+
+	first, err := bootstraptoken.Issue(context.TODO(), testDB, instanceID)
+	assert.NoError(t, err)
+
+	for token, expected := range map[string]bool{"": false, "not-the-token": false, first.Token: true} {
+		required, valid, err := bootstraptoken.Verify(context.TODO(), testDB, instanceID, token)
+		assert.NoError(t, err)
+		assert.True(t, required)
+		assert.Equal(t, expected, valid, token)
+	}
+
+	// Rotating the token invalidates the previous one
+	second, err := bootstraptoken.Issue(context.TODO(), testDB, instanceID)
+	assert.NoError(t, err)
+	assert.NotEqual(t, first.Token, second.Token)
+
+	_, valid, err := bootstraptoken.Verify(context.TODO(), testDB, instanceID, first.Token)
+	assert.NoError(t, err)
+	assert.False(t, valid)
+
+	_, valid, err = bootstraptoken.Verify(context.TODO(), testDB, instanceID, second.Token)
+	assert.NoError(t, err)
+	assert.True(t, valid)
+
+	// Only the hash is stored
+	var stored int
+
+	err = testDB.GetContext(context.TODO(), &stored, "SELECT count(*) FROM instance_bootstrap_tokens WHERE token_hash = $1", second.Token)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, stored)
+}
@@ -0,0 +1,4 @@
+// Package bootstraptoken issues and verifies the per-instance bootstrap tokens
+// instances must present to read their data, once a token has been issued for
+// them. Only a hash of each token is stored.
+package bootstraptoken // import go.hollow.sh/metadataservice/internal/bootstraptoken
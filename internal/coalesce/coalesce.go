@@ -0,0 +1,68 @@
+package coalesce
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// CallTimeout is how long a coalesced call is given to complete. It's run
+// apart from the request which started it, so other requests waiting on it
+// aren't failed when that request is cancelled.
+const CallTimeout = 10 * time.Second
+
+// Group coalesces concurrent calls sharing the same key so that only one of
+// them executes, with the rest waiting on and sharing its result. A nil or
+// disabled Group simply calls through to the provided function, which makes
+// it safe to use unconditionally in the read path.
+type Group struct {
+	enabled bool
+	sf      singleflight.Group
+}
+
+// New returns a new Group. When enabled is false, calls to Do are not
+// coalesced.
+func New(enabled bool) *Group {
+	return &Group{enabled: enabled}
+}
+
+// Enabled reports whether calls made through the group will be coalesced.
+func (g *Group) Enabled() bool {
+	return g != nil && g.enabled
+}
+
+// Do executes and returns the results of fn, making sure that only one
+// execution is in-flight for a given key at a time. If a duplicate call comes
+// in while one is already in-flight, the duplicate caller waits for the
+// original to complete and receives the same results. The shared return value
+// reports whether the result was delivered to more than one caller.
+//
+// When calls are coalesced, fn is given a context which carries ctx's values
+// but isn't cancelled with it, and times out after CallTimeout, since the
+// caller which started the call may go away while others still wait on it.
+// Each caller stops waiting, with its context's error, once its own context
+// is done. When they aren't, fn is given ctx.
+//
+// Callers must treat any returned value as read-only, since it may be handed
+// to several goroutines at once.
+func (g *Group) Do(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (v interface{}, err error, shared bool) {
+	if !g.Enabled() {
+		v, err = fn(ctx)
+		return v, err, false
+	}
+
+	results := g.sf.DoChan(key, func() (interface{}, error) {
+		callCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), CallTimeout)
+		defer cancel()
+
+		return fn(callCtx)
+	})
+
+	select {
+	case result := <-results:
+		return result.Val, result.Err, result.Shared
+	case <-ctx.Done():
+		return nil, ctx.Err(), false
+	}
+}
@@ -0,0 +1,135 @@
+package coalesce_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/coalesce"
+)
+
+func TestDisabledGroupCallsThrough(t *testing.T) {
+	var calls int32
+
+	g := coalesce.New(false)
+
+	for i := 0; i < 3; i++ {
+		v, err, shared := g.Do(context.TODO(), "key", func(context.Context) (interface{}, error) {
+			atomic.AddInt32(&calls, 1)
+			return "value", nil
+		})
+
+		assert.Nil(t, err)
+		assert.Equal(t, "value", v)
+		assert.False(t, shared)
+	}
+
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+func TestNilGroupCallsThrough(t *testing.T) {
+	var g *coalesce.Group
+
+	v, err, shared := g.Do(context.TODO(), "key", func(context.Context) (interface{}, error) {
+		return "value", nil
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "value", v)
+	assert.False(t, shared)
+	assert.False(t, g.Enabled())
+}
+
+func TestEnabledGroupCoalescesConcurrentCalls(t *testing.T) {
+	var (
+		calls   int32
+		wg      sync.WaitGroup
+		release = make(chan struct{})
+	)
+
+	g := coalesce.New(true)
+
+	callers := 10
+	results := make([]interface{}, callers)
+
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			v, _, _ := g.Do(context.TODO(), "key", func(context.Context) (interface{}, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+
+				return "value", nil
+			})
+
+			results[i] = v
+		}(i)
+	}
+
+	// Give the goroutines a chance to pile up behind the first call
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	for _, v := range results {
+		assert.Equal(t, "value", v)
+	}
+}
+
+func TestCoalescedCallOutlivesItsCaller(t *testing.T) {
+	g := coalesce.New(true)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	callDone := make(chan error, 1)
+
+	firstCtx, cancelFirst := context.WithCancel(context.Background())
+	firstDone := make(chan error, 1)
+
+	go func() {
+		_, err, _ := g.Do(firstCtx, "key", func(ctx context.Context) (interface{}, error) {
+			close(started)
+			<-release
+
+			callDone <- ctx.Err()
+
+			return "value", nil
+		})
+
+		firstDone <- err
+	}()
+
+	<-started
+
+	secondDone := make(chan interface{}, 1)
+
+	go func() {
+		v, _, _ := g.Do(context.Background(), "key", func(context.Context) (interface{}, error) {
+			return "not coalesced", nil
+		})
+
+		secondDone <- v
+	}()
+
+	// Give the second caller a chance to wait on the first call, then cancel
+	// the request which started it. It stops waiting, while the call carries
+	// on for the second caller.
+	time.Sleep(100 * time.Millisecond)
+	cancelFirst()
+
+	assert.ErrorIs(t, <-firstDone, context.Canceled)
+
+	close(release)
+
+	assert.NoError(t, <-callDone)
+	assert.Equal(t, "value", <-secondDone)
+}
@@ -0,0 +1,3 @@
+// Package coalesce provides a small wrapper around singleflight used to
+// collapse identical, concurrent reads into a single database query.
+package coalesce // import go.hollow.sh/metadataservice/internal/coalesce
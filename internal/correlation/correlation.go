@@ -0,0 +1,73 @@
+package correlation
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// LogField is the name of the log field the correlation ID is recorded in
+const LogField = "correlation_id"
+
+// maxRequestIDLength is the longest request ID accepted from a caller
+const maxRequestIDLength = 128
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying the correlation ID
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the correlation ID carried by ctx, or an empty string if
+// there isn't one
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+
+	return id
+}
+
+// ID determines the correlation ID for a request. The trace ID is used when
+// the request is being traced, so logs line up with the trace. Otherwise the
+// request ID provided by the caller is used, and if there isn't a usable one a
+// new ID is generated.
+func ID(ctx context.Context, requestID string) string {
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		return sc.TraceID().String()
+	}
+
+	if validRequestID(requestID) {
+		return requestID
+	}
+
+	return uuid.NewString()
+}
+
+// Logger returns the logger with the correlation ID carried by ctx attached,
+// or the logger unchanged if ctx doesn't carry one
+func Logger(ctx context.Context, logger *zap.Logger) *zap.Logger {
+	id := FromContext(ctx)
+	if id == "" {
+		return logger
+	}
+
+	return logger.With(zap.String(LogField, id))
+}
+
+// validRequestID reports whether a caller-provided request ID is short and
+// only contains printable ASCII, so it's safe to log and echo back
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		if id[i] < ' ' || id[i] > '~' {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,43 @@
+package correlation_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
+
+	"go.hollow.sh/metadataservice/internal/correlation"
+)
+
+func TestID(t *testing.T) {
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	traced := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: traceID,
+		SpanID:  spanID,
+	}))
+
+	// The trace ID wins over a request ID when tracing
+	assert.Equal(t, traceID.String(), correlation.ID(traced, "my-request"))
+
+	// Without a trace, the caller's request ID is used
+	assert.Equal(t, "my-request", correlation.ID(context.Background(), "my-request"))
+
+	// Missing or unusable request IDs are replaced with a generated one
+	for _, requestID := range []string{"", "bad\nid", strings.Repeat("a", 129)} {
+		id := correlation.ID(context.Background(), requestID)
+
+		_, err := uuid.Parse(id)
+		assert.Nil(t, err, requestID)
+	}
+}
+
+func TestContext(t *testing.T) {
+	assert.Empty(t, correlation.FromContext(context.Background()))
+
+	ctx := correlation.NewContext(context.Background(), "my-request")
+	assert.Equal(t, "my-request", correlation.FromContext(ctx))
+}
@@ -0,0 +1,3 @@
+// Package correlation carries the ID used to correlate everything done on
+// behalf of a single request, like its logs, across systems.
+package correlation // import go.hollow.sh/metadataservice/internal/correlation
@@ -0,0 +1,57 @@
+package dbstats
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// DBName is the db_name label of the connection pool metrics
+const DBName = "metadata"
+
+// Response reports the state of the connection pool. Durations are formatted
+// like "1.5s".
+type Response struct {
+	MaxOpenConnections int    `json:"max_open_connections"`
+	OpenConnections    int    `json:"open_connections"`
+	InUse              int    `json:"in_use"`
+	Idle               int    `json:"idle"`
+	WaitCount          int64  `json:"wait_count"`
+	WaitDuration       string `json:"wait_duration"`
+	MaxIdleClosed      int64  `json:"max_idle_closed"`
+	MaxIdleTimeClosed  int64  `json:"max_idle_time_closed"`
+	MaxLifetimeClosed  int64  `json:"max_lifetime_closed"`
+}
+
+// NewResponse returns the report of the pool's stats
+func NewResponse(stats sql.DBStats) *Response {
+	return &Response{
+		MaxOpenConnections: stats.MaxOpenConnections,
+		OpenConnections:    stats.OpenConnections,
+		InUse:              stats.InUse,
+		Idle:               stats.Idle,
+		WaitCount:          stats.WaitCount,
+		WaitDuration:       stats.WaitDuration.String(),
+		MaxIdleClosed:      stats.MaxIdleClosed,
+		MaxIdleTimeClosed:  stats.MaxIdleTimeClosed,
+		MaxLifetimeClosed:  stats.MaxLifetimeClosed,
+	}
+}
+
+// Register publishes the stats of the database connection pool as the
+// go_sql_* Prometheus metrics of client_golang's DBStatsCollector, labelled
+// with DBName. The stats are read whenever the metrics are scraped. Only the
+// first pool registered is published, so registering again, like when the
+// server is restarted in the same process, is a no-op.
+func Register(db *sql.DB) error {
+	err := prometheus.Register(collectors.NewDBStatsCollector(db, DBName))
+
+	var registered prometheus.AlreadyRegisteredError
+	if errors.As(err, &registered) {
+		return nil
+	}
+
+	return err
+}
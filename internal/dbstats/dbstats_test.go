@@ -0,0 +1,65 @@
+package dbstats_test
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq" // Register the Postgres driver.
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/dbstats"
+)
+
+var testStats = sql.DBStats{
+	MaxOpenConnections: 25,
+	OpenConnections:    10,
+	InUse:              7,
+	Idle:               3,
+	WaitCount:          42,
+	WaitDuration:       1500 * time.Millisecond,
+	MaxIdleClosed:      1,
+	MaxIdleTimeClosed:  2,
+	MaxLifetimeClosed:  3,
+}
+
+func TestRegister(t *testing.T) {
+	db, err := sql.Open("postgres", "postgres://root@127.0.0.1:1/metadataservice?sslmode=disable")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	db.SetMaxOpenConns(25)
+
+	assert.NoError(t, dbstats.Register(db))
+
+	// Registering again is a no-op
+	assert.NoError(t, dbstats.Register(db))
+
+	expected := `
+# HELP go_sql_max_open_connections Maximum number of open connections to the database.
+# TYPE go_sql_max_open_connections gauge
+go_sql_max_open_connections{db_name="metadata"} 25
+`
+
+	assert.NoError(t, testutil.GatherAndCompare(prometheus.DefaultGatherer, strings.NewReader(expected), "go_sql_max_open_connections"))
+}
+
+func TestNewResponse(t *testing.T) {
+	assert.Equal(t, &dbstats.Response{
+		MaxOpenConnections: 25,
+		OpenConnections:    10,
+		InUse:              7,
+		Idle:               3,
+		WaitCount:          42,
+		WaitDuration:       "1.5s",
+		MaxIdleClosed:      1,
+		MaxIdleTimeClosed:  2,
+		MaxLifetimeClosed:  3,
+	}, dbstats.NewResponse(testStats))
+}
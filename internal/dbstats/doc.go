@@ -0,0 +1,4 @@
+// Package dbstats reports the health of the database connection pool, both as
+// Prometheus metrics and as a JSON document for the admin port, so pool
+// exhaustion can be spotted alongside write latency.
+package dbstats // import go.hollow.sh/metadataservice/internal/dbstats
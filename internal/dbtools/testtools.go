@@ -78,5 +78,12 @@ func cleanDB() {
 	models.InstanceMetadata().DeleteAll(ctx, testDB)
 	models.InstanceUserdata().DeleteAll(ctx, testDB)
 	models.InstanceIPAddresses().DeleteAll(ctx, testDB)
+	testDB.Exec("DELETE FROM instance_last_fetches;")
+	testDB.Exec("DELETE FROM instance_bootstrap_tokens;")
+	testDB.Exec("DELETE FROM instance_userdata_encodings;")
+	testDB.Exec("DELETE FROM instance_metadata_history;")
+	testDB.Exec("DELETE FROM instance_public_keys;")
+	testDB.Exec("DELETE FROM instance_tags;")
+	testDB.Exec("DELETE FROM idempotency_keys;")
 	testDB.Exec("SET sql_safe_updates = true;")
 }
@@ -0,0 +1,4 @@
+// Package events publishes an event to NATS, and/or POSTs it to a webhook,
+// whenever an instance's metadata or userdata has been upserted, so other
+// systems can react to the change.
+package events // import go.hollow.sh/metadataservice/internal/events
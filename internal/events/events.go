@@ -0,0 +1,151 @@
+package events
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+// DefaultSubject is the NATS subject events are published to unless
+// configured otherwise.
+const DefaultSubject = "metadataservice.instances.changed"
+
+var (
+	// MetricPublished counts the events published
+	MetricPublished = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "metadata_events_published_total",
+		Help: "Number of instance change events published to NATS.",
+	})
+
+	// MetricPublishFailures counts the events which couldn't be published
+	MetricPublishFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "metadata_events_publish_failures_total",
+		Help: "Number of instance change events which couldn't be published to NATS.",
+	})
+)
+
+// Event describes a committed upsert of an instance's metadata or userdata.
+// CorrelationID is the correlation ID of the request which made the upsert,
+// when there was one.
+type Event struct {
+	InstanceID    string    `json:"instance_id"`
+	Metadata      bool      `json:"metadata"`
+	Userdata      bool      `json:"userdata"`
+	AddedIPs      []string  `json:"added_ips"`
+	RemovedIPs    []string  `json:"removed_ips"`
+	Timestamp     time.Time `json:"timestamp"`
+	CorrelationID string    `json:"correlation_id,omitempty"`
+}
+
+// Conn is the part of a NATS connection used to publish events.
+type Conn interface {
+	Publish(subject string, data []byte) error
+}
+
+// Publisher publishes events to a NATS subject, and delivers them to a
+// webhook when one is set. A nil *Publisher is valid, and publishes nothing.
+type Publisher struct {
+	conn    Conn
+	subject string
+	logger  *zap.Logger
+	webhook *Webhook
+
+	// nc is set when the publisher owns the connection, so it's drained on Close
+	nc *nats.Conn
+}
+
+// NewPublisher returns a Publisher sending events over the given connection.
+// The connection can be nil, for a Publisher only delivering events to a
+// webhook.
+func NewPublisher(conn Conn, subject string, logger *zap.Logger) *Publisher {
+	return &Publisher{conn: conn, subject: subject, logger: logger}
+}
+
+// Connect connects to the NATS server(s) at url, returning a Publisher for the
+// subject. A NATS server which can't be reached yet doesn't fail the
+// connection, it's retried in the background, and events published meanwhile
+// are buffered by the client.
+func Connect(url, subject string, logger *zap.Logger) (*Publisher, error) {
+	nc, err := nats.Connect(url,
+		nats.Name("metadataservice"),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				logger.Warn("disconnected from nats", zap.Error(err))
+			}
+		}),
+		nats.ReconnectHandler(func(_ *nats.Conn) {
+			logger.Info("reconnected to nats")
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	p := NewPublisher(nc, subject, logger)
+	p.nc = nc
+
+	return p, nil
+}
+
+// SetWebhook also delivers each event published to the webhook. It should be
+// called before any event is published.
+func (p *Publisher) SetWebhook(webhook *Webhook) {
+	p.webhook = webhook
+}
+
+// Publish sends the event. Failures are logged and counted, but never
+// returned, as the change has already been committed.
+func (p *Publisher) Publish(event Event) {
+	if p == nil {
+		return
+	}
+
+	p.webhook.Deliver(event)
+
+	if p.conn == nil {
+		return
+	}
+
+	data, err := json.Marshal(event)
+	if err == nil {
+		err = p.conn.Publish(p.subject, data)
+	}
+
+	if err != nil {
+		MetricPublishFailures.Inc()
+
+		p.logger.Error("unable to publish instance change event",
+			zap.String("instance_id", event.InstanceID),
+			zap.String("subject", p.subject),
+			zap.Error(err),
+		)
+
+		return
+	}
+
+	MetricPublished.Inc()
+}
+
+// Close flushes any buffered events and closes the connection, when the
+// publisher owns it, and waits for queued webhook deliveries.
+func (p *Publisher) Close() {
+	if p == nil {
+		return
+	}
+
+	p.webhook.Close()
+
+	if p.nc == nil {
+		return
+	}
+
+	if err := p.nc.Drain(); err != nil {
+		p.logger.Warn("unable to drain nats connection", zap.Error(err))
+	}
+}
@@ -0,0 +1,79 @@
+package events_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/events"
+)
+
+type fakeConn struct {
+	subject string
+	data    []byte
+	err     error
+}
+
+func (f *fakeConn) Publish(subject string, data []byte) error {
+	f.subject = subject
+	f.data = data
+
+	return f.err
+}
+
+func TestNilPublisher(t *testing.T) {
+	var publisher *events.Publisher
+
+	// None of these should panic
+	publisher.Publish(events.Event{InstanceID: "a"})
+	publisher.Close()
+}
+
+func TestPublish(t *testing.T) {
+	conn := &fakeConn{}
+	publisher := events.NewPublisher(conn, "instances.changed", zap.NewNop())
+
+	event := events.Event{
+		InstanceID:    "316ed337-feee-48c6-a11b-3d4738e3cd6d",
+		Metadata:      true,
+		AddedIPs:      []string{"10.0.0.1"},
+		RemovedIPs:    []string{},
+		Timestamp:     time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		CorrelationID: "4bf92f3577b34da6a3ce929d0e0e4736",
+	}
+
+	before := testutil.ToFloat64(events.MetricPublished)
+
+	publisher.Publish(event)
+
+	assert.Equal(t, "instances.changed", conn.subject)
+	assert.JSONEq(t, `{
+		"instance_id": "316ed337-feee-48c6-a11b-3d4738e3cd6d",
+		"metadata": true,
+		"userdata": false,
+		"added_ips": ["10.0.0.1"],
+		"removed_ips": [],
+		"timestamp": "2024-01-02T03:04:05Z",
+		"correlation_id": "4bf92f3577b34da6a3ce929d0e0e4736"
+	}`, string(conn.data))
+	assert.Equal(t, before+1, testutil.ToFloat64(events.MetricPublished))
+
+	decoded := events.Event{}
+	assert.NoError(t, json.Unmarshal(conn.data, &decoded))
+	assert.Equal(t, event, decoded)
+}
+
+func TestPublishFailure(t *testing.T) {
+	publisher := events.NewPublisher(&fakeConn{err: errors.New("nats unavailable")}, "instances.changed", zap.NewNop())
+
+	before := testutil.ToFloat64(events.MetricPublishFailures)
+
+	publisher.Publish(events.Event{InstanceID: "a"})
+
+	assert.Equal(t, before+1, testutil.ToFloat64(events.MetricPublishFailures))
+}
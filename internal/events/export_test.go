@@ -0,0 +1,12 @@
+package events
+
+import "time"
+
+// SetWebhookRetryDelay changes the wait before retrying a webhook delivery
+// for the tests, returning a func restoring it
+func SetWebhookRetryDelay(delay time.Duration) func() {
+	previous := webhookRetryDelay
+	webhookRetryDelay = delay
+
+	return func() { webhookRetryDelay = previous }
+}
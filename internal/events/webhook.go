@@ -0,0 +1,299 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.hollow.sh/toolbox/version"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultWebhookTimeout is how long each webhook delivery attempt is given
+	// to complete, when no other value has been configured
+	DefaultWebhookTimeout = 5 * time.Second
+
+	// DefaultWebhookRetries is how many times a failed webhook delivery is
+	// retried, when no other value has been configured
+	DefaultWebhookRetries = 3
+
+	// HeaderWebhookSignature is the request header carrying the HMAC-SHA256
+	// of the webhook request body, as "sha256=<hex>", when a secret is
+	// configured
+	HeaderWebhookSignature = "X-Metadataservice-Signature-256"
+
+	// ChangeMetadata is listed in a webhook payload's changes when the
+	// instance's metadata was upserted
+	ChangeMetadata = "metadata"
+
+	// ChangeUserdata is listed in a webhook payload's changes when the
+	// instance's userdata was upserted
+	ChangeUserdata = "userdata"
+
+	// webhookQueueSize is the number of events waiting to be delivered kept
+	// before new ones are dropped
+	webhookQueueSize = 1000
+
+	// webhookCloseTimeout bounds how long Close waits for queued events to be
+	// delivered
+	webhookCloseTimeout = 10 * time.Second
+)
+
+var (
+	// MetricWebhookDelivered counts the events delivered to the webhook
+	MetricWebhookDelivered = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "metadata_events_webhook_delivered_total",
+		Help: "Number of instance change events delivered to the webhook.",
+	})
+
+	// MetricWebhookFailures counts the events which couldn't be delivered to
+	// the webhook, after all retries, or because too many were queued
+	MetricWebhookFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "metadata_events_webhook_failures_total",
+		Help: "Number of instance change events which couldn't be delivered to the webhook.",
+	})
+
+	errInvalidWebhookURL = errors.New("invalid webhook URL")
+	errWebhookQueueFull  = errors.New("too many events waiting to be delivered")
+	errWebhookClosed     = errors.New("webhook closed")
+	errWebhookStatus     = errors.New("unexpected webhook response status")
+
+	webhookUserAgent = fmt.Sprintf("go-hollow-metadataservice-webhook-client (%s)", version.String())
+
+	// webhookRetryDelay is the wait before the first retry of a failed
+	// delivery, doubled for each retry after it
+	webhookRetryDelay = time.Second
+)
+
+// WebhookPayload is the JSON body POSTed to the webhook for each event. It
+// carries the same fields as the event published to NATS, along with the list
+// of what changed.
+type WebhookPayload struct {
+	Event
+
+	Changes []string `json:"changes"`
+}
+
+// Webhook POSTs events to an HTTP endpoint in the background, so deliveries
+// never hold up the write which caused them. Failed deliveries are retried
+// with a bounded timeout for each attempt, then logged and counted. A nil
+// *Webhook is valid, and delivers nothing.
+type Webhook struct {
+	url     string
+	secret  []byte
+	timeout time.Duration
+	retries int
+	client  *http.Client
+	logger  *zap.Logger
+
+	// mu guards closed, so events aren't sent on the queue once it's closed
+	mu     sync.Mutex
+	closed bool
+	queue  chan Event
+	done   chan struct{}
+}
+
+// NewWebhook returns a Webhook delivering events to webhookURL, signed with
+// secret when it isn't empty. Each attempt is given up to timeout
+// (DefaultWebhookTimeout when it isn't positive), and failed deliveries are
+// retried up to retries times (none when negative). Deliveries start straight
+// away, until Close is called.
+func NewWebhook(webhookURL, secret string, timeout time.Duration, retries int, httpClient *http.Client, logger *zap.Logger) (*Webhook, error) {
+	parsedURL, err := url.Parse(webhookURL)
+	if err != nil || parsedURL.Host == "" || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") {
+		return nil, fmt.Errorf("%w: %q", errInvalidWebhookURL, webhookURL)
+	}
+
+	if timeout <= 0 {
+		timeout = DefaultWebhookTimeout
+	}
+
+	if retries < 0 {
+		retries = 0
+	}
+
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	w := &Webhook{
+		url:     parsedURL.String(),
+		secret:  []byte(secret),
+		timeout: timeout,
+		retries: retries,
+		client:  httpClient,
+		logger:  logger,
+		queue:   make(chan Event, webhookQueueSize),
+		done:    make(chan struct{}),
+	}
+
+	go w.run()
+
+	return w, nil
+}
+
+// Deliver queues the event to be delivered. It never blocks: when too many
+// events are already waiting, or the Webhook has been closed, the event is
+// dropped, logged and counted.
+func (w *Webhook) Deliver(event Event) {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		w.failed(event, errWebhookClosed)
+		return
+	}
+
+	select {
+	case w.queue <- event:
+	default:
+		w.failed(event, errWebhookQueueFull)
+	}
+}
+
+// Close stops accepting events, and waits a bounded time for the queued ones
+// to be delivered. Events delivered after Close are dropped.
+func (w *Webhook) Close() {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+
+	if w.closed {
+		w.mu.Unlock()
+		return
+	}
+
+	w.closed = true
+	close(w.queue)
+	w.mu.Unlock()
+
+	select {
+	case <-w.done:
+	case <-time.After(webhookCloseTimeout):
+		w.logger.Warn("gave up waiting for webhook deliveries", zap.Int("undelivered", len(w.queue)))
+	}
+}
+
+func (w *Webhook) run() {
+	defer close(w.done)
+
+	for event := range w.queue {
+		w.deliver(event)
+	}
+}
+
+// deliver POSTs the event, retrying failed attempts with an increasing delay
+func (w *Webhook) deliver(event Event) {
+	body, err := json.Marshal(newWebhookPayload(event))
+	if err != nil {
+		w.failed(event, err)
+		return
+	}
+
+	delay := webhookRetryDelay
+
+	for attempt := 0; ; attempt++ {
+		err = w.post(body)
+		if err == nil {
+			MetricWebhookDelivered.Inc()
+			return
+		}
+
+		if attempt >= w.retries {
+			break
+		}
+
+		w.logger.Debug("retrying webhook delivery", zap.String("instance_id", event.InstanceID), zap.Int("attempt", attempt+1), zap.Error(err))
+
+		time.Sleep(delay)
+
+		delay *= 2
+	}
+
+	w.failed(event, err)
+}
+
+// post makes a single delivery attempt
+func (w *Webhook) post(body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), w.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", webhookUserAgent)
+
+	if len(w.secret) > 0 {
+		req.Header.Set(HeaderWebhookSignature, Sign(w.secret, body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%w: %d", errWebhookStatus, resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (w *Webhook) failed(event Event, err error) {
+	MetricWebhookFailures.Inc()
+
+	w.logger.Error("unable to deliver instance change event to webhook",
+		zap.String("instance_id", event.InstanceID),
+		zap.String("url", w.url),
+		zap.Error(err),
+	)
+}
+
+// Sign returns the value of the HeaderWebhookSignature header for a webhook
+// request body, so receivers can check it with the shared secret.
+func Sign(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newWebhookPayload(event Event) WebhookPayload {
+	payload := WebhookPayload{Event: event, Changes: []string{}}
+
+	if event.Metadata {
+		payload.Changes = append(payload.Changes, ChangeMetadata)
+	}
+
+	if event.Userdata {
+		payload.Changes = append(payload.Changes, ChangeUserdata)
+	}
+
+	return payload
+}
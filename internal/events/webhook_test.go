@@ -0,0 +1,150 @@
+package events_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/events"
+)
+
+type webhookReceiver struct {
+	mu         sync.Mutex
+	bodies     [][]byte
+	signatures []string
+	failures   int
+}
+
+func (wr *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+
+	if wr.failures > 0 {
+		wr.failures--
+
+		w.WriteHeader(http.StatusServiceUnavailable)
+
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+
+	wr.bodies = append(wr.bodies, body)
+	wr.signatures = append(wr.signatures, r.Header.Get(events.HeaderWebhookSignature))
+}
+
+func TestNilWebhook(t *testing.T) {
+	var webhook *events.Webhook
+
+	// None of these should panic
+	webhook.Deliver(events.Event{InstanceID: "a"})
+	webhook.Close()
+
+	_, err := events.NewWebhook("not a url", "", 0, 0, nil, zap.NewNop())
+	assert.Error(t, err)
+}
+
+func TestWebhook(t *testing.T) {
+	defer events.SetWebhookRetryDelay(time.Millisecond)()
+
+	receiver := &webhookReceiver{failures: 1}
+	server := httptest.NewServer(receiver)
+
+	t.Cleanup(server.Close)
+
+	webhook, err := events.NewWebhook(server.URL, "s3cret", time.Second, 2, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publisher := events.NewPublisher(nil, "", zap.NewNop())
+	publisher.SetWebhook(webhook)
+
+	before := testutil.ToFloat64(events.MetricWebhookDelivered)
+
+	publisher.Publish(events.Event{
+		InstanceID: "316ed337-feee-48c6-a11b-3d4738e3cd6d",
+		Metadata:   true,
+		AddedIPs:   []string{"10.0.0.1"},
+		RemovedIPs: []string{},
+		Timestamp:  time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	})
+
+	// Close waits for queued deliveries
+	publisher.Close()
+
+	assert.Equal(t, before+1, testutil.ToFloat64(events.MetricWebhookDelivered))
+
+	if assert.Len(t, receiver.bodies, 1) {
+		assert.JSONEq(t, `{
+			"instance_id": "316ed337-feee-48c6-a11b-3d4738e3cd6d",
+			"metadata": true,
+			"userdata": false,
+			"added_ips": ["10.0.0.1"],
+			"removed_ips": [],
+			"timestamp": "2024-01-02T03:04:05Z",
+			"changes": ["metadata"]
+		}`, string(receiver.bodies[0]))
+
+		assert.Equal(t, events.Sign([]byte("s3cret"), receiver.bodies[0]), receiver.signatures[0])
+
+		payload := events.WebhookPayload{}
+		assert.NoError(t, json.Unmarshal(receiver.bodies[0], &payload))
+		assert.Equal(t, "316ed337-feee-48c6-a11b-3d4738e3cd6d", payload.InstanceID)
+	}
+}
+
+func TestWebhookFailure(t *testing.T) {
+	defer events.SetWebhookRetryDelay(time.Millisecond)()
+
+	receiver := &webhookReceiver{failures: 3}
+	server := httptest.NewServer(receiver)
+
+	t.Cleanup(server.Close)
+
+	webhook, err := events.NewWebhook(server.URL, "", time.Second, 2, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := testutil.ToFloat64(events.MetricWebhookFailures)
+
+	webhook.Deliver(events.Event{InstanceID: "a", Userdata: true})
+	webhook.Close()
+
+	assert.Equal(t, before+1, testutil.ToFloat64(events.MetricWebhookFailures))
+	assert.Empty(t, receiver.bodies)
+	assert.Zero(t, receiver.failures)
+}
+
+func TestWebhookDeliverAfterClose(t *testing.T) {
+	receiver := &webhookReceiver{}
+	server := httptest.NewServer(receiver)
+
+	t.Cleanup(server.Close)
+
+	webhook, err := events.NewWebhook(server.URL, "", time.Second, 0, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	webhook.Close()
+
+	before := testutil.ToFloat64(events.MetricWebhookFailures)
+
+	// Events delivered once it's closed are dropped and counted, rather than
+	// panicking, and closing again does nothing
+	webhook.Deliver(events.Event{InstanceID: "a", Metadata: true})
+	webhook.Close()
+
+	assert.Equal(t, before+1, testutil.ToFloat64(events.MetricWebhookFailures))
+	assert.Empty(t, receiver.bodies)
+}
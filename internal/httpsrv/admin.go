@@ -0,0 +1,203 @@
+package httpsrv
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	ginzap "github.com/gin-contrib/zap"
+	"github.com/gin-gonic/gin"
+	"go.hollow.sh/toolbox/ginjwt"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/apierror"
+	"go.hollow.sh/metadataservice/internal/correlation"
+	"go.hollow.sh/metadataservice/internal/dbstats"
+	"go.hollow.sh/metadataservice/internal/middleware"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+const (
+	pprofURI    = "/debug/pprof"
+	configURI   = "/config"
+	dbStatsURI  = "/healthz/db"
+	readOnlyURI = "/read-only"
+)
+
+var (
+	// pprofScopes are the scopes allowing a caller to profile the service
+	pprofScopes = []string{"admin", "metadata:admin:pprof"}
+
+	// configScopes are the scopes allowing a caller to inspect the service's
+	// effective configuration
+	configScopes = []string{"admin", "metadata:admin:config"}
+
+	// dbStatsScopes are the scopes allowing a caller to inspect the database
+	// connection pool
+	dbStatsScopes = []string{"admin", "metadata:admin:db"}
+
+	// readOnlyScopes are the scopes allowing a caller to inspect and switch
+	// read-only mode
+	readOnlyScopes = []string{"admin", "metadata:admin:read-only"}
+)
+
+// ConfigResponse is the effective configuration reported by the admin config
+// endpoint, for diagnosing how the service is running.
+type ConfigResponse struct {
+	RouteTimeouts  RouteTimeoutsResponse  `json:"route_timeouts"`
+	ServerTimeouts ServerTimeoutsResponse `json:"server_timeouts"`
+}
+
+// RouteTimeoutsResponse reports the timeouts for each class of route, as
+// durations like "5s". "0s" means there's no limit beyond the server's own.
+type RouteTimeoutsResponse struct {
+	Read  string `json:"read"`
+	Write string `json:"write"`
+	Admin string `json:"admin"`
+}
+
+// ServerTimeoutsResponse reports the timeouts the instance-facing HTTP server
+// applies to every connection, as durations like "10s".
+type ServerTimeoutsResponse struct {
+	Read       string `json:"read"`
+	Write      string `json:"write"`
+	Idle       string `json:"idle"`
+	ReadHeader string `json:"read_header"`
+}
+
+// ReadOnlyResponse reports whether the service is in read-only mode. It's also
+// the body of a request switching the mode.
+type ReadOnlyResponse struct {
+	Enabled *bool `json:"enabled" binding:"required"`
+}
+
+// adminSetup builds the router served on the admin port. Nothing served here
+// is reachable from the instance-facing port.
+func (s *Server) adminSetup() *gin.Engine {
+	authMW, err := ginjwt.NewAuthMiddleware(s.AuthConfig)
+	if err != nil {
+		s.Logger.Sugar().Fatal("failed to initialize auth middleware", "error", err)
+	}
+
+	r := gin.New()
+
+	r.Use(ginzap.Logger(s.Logger.With(zap.String("component", "adminsrv")), ginzap.WithTimeFormat(time.RFC3339),
+		ginzap.WithUTC(true),
+		ginzap.WithCustomFields(
+			func(c *gin.Context) zap.Field { return zap.String("jwt_subject", ginjwt.GetSubject(c)) },
+			func(c *gin.Context) zap.Field { return zap.String("jwt_user", ginjwt.GetUser(c)) },
+			func(c *gin.Context) zap.Field {
+				return zap.String(correlation.LogField, c.GetString(middleware.ContextKeyCorrelationID))
+			},
+		),
+	))
+	r.Use(ginzap.RecoveryWithZap(s.Logger.With(zap.String("component", "adminsrv")), true))
+
+	// Admin requests get a request ID too, so their errors can be correlated
+	// with the logs
+	r.Use(middleware.CorrelationID())
+
+	r.GET(configURI, authMW.AuthRequired(), authMW.RequiredScopes(configScopes), s.configGet)
+	r.GET(dbStatsURI, authMW.AuthRequired(), authMW.RequiredScopes(dbStatsScopes), s.dbStatsGet)
+
+	if s.ReadOnly != nil {
+		r.GET(readOnlyURI, authMW.AuthRequired(), authMW.RequiredScopes(readOnlyScopes), s.readOnlyGet)
+		r.PUT(readOnlyURI, authMW.AuthRequired(), authMW.RequiredScopes(readOnlyScopes), s.readOnlySet)
+	}
+
+	if s.PprofEnabled {
+		debug := r.Group(pprofURI, authMW.AuthRequired(), authMW.RequiredScopes(pprofScopes))
+		{
+			pprofRoutes(debug)
+		}
+	}
+
+	r.NoRoute(routeNotFound)
+
+	return r
+}
+
+// configGet reports the service's effective configuration
+func (s *Server) configGet(c *gin.Context) {
+	serverTimeouts := s.ServerTimeouts.withDefaults()
+
+	c.JSON(http.StatusOK, &ConfigResponse{
+		RouteTimeouts: RouteTimeoutsResponse{
+			Read:  s.RouteTimeouts.Read.String(),
+			Write: s.RouteTimeouts.Write.String(),
+			Admin: s.RouteTimeouts.Admin.String(),
+		},
+		ServerTimeouts: ServerTimeoutsResponse{
+			Read:       serverTimeouts.Read.String(),
+			Write:      serverTimeouts.Write.String(),
+			Idle:       serverTimeouts.Idle.String(),
+			ReadHeader: serverTimeouts.ReadHeader.String(),
+		},
+	})
+}
+
+// dbStatsGet reports the state of the database connection pool
+func (s *Server) dbStatsGet(c *gin.Context) {
+	if s.DB == nil {
+		apierror.Respond(c, http.StatusServiceUnavailable, v1api.ErrorCodeServiceUnavailable, "no database configured")
+		return
+	}
+
+	c.JSON(http.StatusOK, dbstats.NewResponse(s.DB.Stats()))
+}
+
+// readOnlyGet reports whether the service is in read-only mode
+func (s *Server) readOnlyGet(c *gin.Context) {
+	enabled := s.ReadOnly.Enabled()
+
+	c.JSON(http.StatusOK, &ReadOnlyResponse{Enabled: &enabled})
+}
+
+// readOnlySet switches read-only mode on or off. The mode is only held in
+// memory, so it's switched for this replica alone, and lasts until it's
+// restarted.
+func (s *Server) readOnlySet(c *gin.Context) {
+	var body ReadOnlyResponse
+
+	if err := c.ShouldBindJSON(&body); err != nil {
+		apierror.Abort(c, http.StatusBadRequest, v1api.ErrorCodeInvalidRequestBody, "invalid request body", err.Error())
+		return
+	}
+
+	s.ReadOnly.Set(*body.Enabled)
+
+	s.Logger.Info("read-only mode switched", zap.Bool("enabled", *body.Enabled), zap.String("jwt_subject", ginjwt.GetSubject(c)), zap.String(correlation.LogField, c.GetString(middleware.ContextKeyCorrelationID)))
+
+	c.JSON(http.StatusOK, &body)
+}
+
+// pprofRoutes registers the net/http/pprof handlers. The handlers expect to be
+// served under /debug/pprof/.
+func pprofRoutes(rg *gin.RouterGroup) {
+	rg.GET("/", gin.WrapF(pprof.Index))
+	rg.GET("/cmdline", gin.WrapF(pprof.Cmdline))
+	rg.GET("/profile", gin.WrapF(pprof.Profile))
+	rg.GET("/symbol", gin.WrapF(pprof.Symbol))
+	rg.POST("/symbol", gin.WrapF(pprof.Symbol))
+	rg.GET("/trace", gin.WrapF(pprof.Trace))
+
+	for _, profile := range []string{"allocs", "block", "goroutine", "heap", "mutex", "threadcreate"} {
+		rg.GET("/"+profile, gin.WrapH(pprof.Handler(profile)))
+	}
+}
+
+// NewAdminServer returns a configured admin server
+func (s *Server) NewAdminServer() *http.Server {
+	if !s.Debug {
+		gin.SetMode(gin.ReleaseMode)
+	}
+
+	srv := &http.Server{
+		Handler: s.adminSetup(),
+		Addr:    s.AdminListen,
+	}
+
+	s.ServerTimeouts.applyAdmin(srv)
+
+	return srv
+}
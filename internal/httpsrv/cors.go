@@ -0,0 +1,122 @@
+package httpsrv
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+)
+
+// CORSWildcardOrigin allows requests from any origin
+const CORSWildcardOrigin = "*"
+
+// ErrInvalidCORSConfig is returned when the CORS config can't be used
+var ErrInvalidCORSConfig = errors.New("invalid cors config")
+
+var (
+	// DefaultCORSMethods are the methods allowed for cross-origin requests
+	// when none are configured
+	DefaultCORSMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD"}
+
+	// DefaultCORSHeaders are the request headers allowed for cross-origin
+	// requests when none are configured
+	DefaultCORSHeaders = []string{"Origin", "Content-Length", "Content-Type", "Authorization"}
+
+	// DefaultCORSMaxAge is how long browsers may cache a preflight response
+	// when no other value is configured
+	DefaultCORSMaxAge = 12 * time.Hour
+)
+
+// CORSConfig configures the CORS headers sent to browsers making cross-origin
+// requests. Without a CORSConfig no CORS headers are sent, so browsers only
+// allow same-origin requests.
+type CORSConfig struct {
+	// AllowOrigins are the origins, like "https://console.example.com",
+	// allowed to make requests, or just CORSWildcardOrigin to allow any
+	AllowOrigins []string
+
+	// AllowMethods and AllowHeaders are the methods and request headers
+	// allowed, DefaultCORSMethods and DefaultCORSHeaders when unset
+	AllowMethods []string
+	AllowHeaders []string
+
+	// AllowCredentials allows requests to include cookies and authorization
+	// headers. It's ignored when any origin is allowed, since browsers refuse
+	// credentials with a wildcard origin.
+	AllowCredentials bool
+
+	// MaxAge is how long browsers may cache a preflight response,
+	// DefaultCORSMaxAge when unset
+	MaxAge time.Duration
+}
+
+// Validate checks the allowed origins are either a list of origins with a
+// scheme and host and no path, or just the wildcard.
+func (c *CORSConfig) Validate() error {
+	if len(c.AllowOrigins) == 0 {
+		return fmt.Errorf("%w: no allowed origins", ErrInvalidCORSConfig)
+	}
+
+	if c.AllowsAllOrigins() {
+		if len(c.AllowOrigins) > 1 {
+			return fmt.Errorf("%w: the wildcard origin %q can't be combined with other origins", ErrInvalidCORSConfig, CORSWildcardOrigin)
+		}
+
+		return nil
+	}
+
+	for _, origin := range c.AllowOrigins {
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.Fragment != "" {
+			return fmt.Errorf("%w: origin %q must be a scheme and host, like \"https://console.example.com\"", ErrInvalidCORSConfig, origin)
+		}
+	}
+
+	return nil
+}
+
+// AllowsAllOrigins reports whether requests from any origin are allowed
+func (c *CORSConfig) AllowsAllOrigins() bool {
+	for _, origin := range c.AllowOrigins {
+		if origin == CORSWildcardOrigin {
+			return true
+		}
+	}
+
+	return false
+}
+
+// middleware returns the handler adding the CORS headers. Credentials are
+// never allowed along with any origin.
+func (c *CORSConfig) middleware() gin.HandlerFunc {
+	config := cors.Config{
+		AllowMethods:     c.AllowMethods,
+		AllowHeaders:     c.AllowHeaders,
+		AllowCredentials: c.AllowCredentials,
+		MaxAge:           c.MaxAge,
+	}
+
+	if c.AllowsAllOrigins() {
+		config.AllowAllOrigins = true
+		config.AllowCredentials = false
+	} else {
+		config.AllowOrigins = c.AllowOrigins
+	}
+
+	if len(config.AllowMethods) == 0 {
+		config.AllowMethods = DefaultCORSMethods
+	}
+
+	if len(config.AllowHeaders) == 0 {
+		config.AllowHeaders = DefaultCORSHeaders
+	}
+
+	if config.MaxAge <= 0 {
+		config.MaxAge = DefaultCORSMaxAge
+	}
+
+	return cors.New(config)
+}
@@ -0,0 +1,95 @@
+package httpsrv_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/httpsrv"
+)
+
+func corsPreflight(t *testing.T, cors *httpsrv.CORSConfig, origin string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	hs := httpsrv.Server{Logger: zap.NewNop(), AuthConfig: serverAuthConfig, CORS: cors}
+	router := hs.NewServer().Handler
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodOptions, "/healthz", nil)
+	req.Header.Set("Origin", origin)
+	req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+	router.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestCORSDisabledByDefault(t *testing.T) {
+	w := corsPreflight(t, nil, "https://console.example.com")
+
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Credentials"))
+}
+
+func TestCORSAllowedOrigins(t *testing.T) {
+	cors := &httpsrv.CORSConfig{
+		AllowOrigins:     []string{"https://console.example.com"},
+		AllowCredentials: true,
+	}
+
+	w := corsPreflight(t, cors, "https://console.example.com")
+
+	assert.Equal(t, "https://console.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "43200", w.Header().Get("Access-Control-Max-Age"))
+
+	// Origins which aren't listed are refused
+	w = corsPreflight(t, cors, "https://evil.example.com")
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestCORSWildcardOriginDisallowsCredentials(t *testing.T) {
+	cors := &httpsrv.CORSConfig{
+		AllowOrigins:     []string{httpsrv.CORSWildcardOrigin},
+		AllowCredentials: true,
+	}
+
+	w := corsPreflight(t, cors, "https://console.example.com")
+
+	assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Credentials"))
+}
+
+func TestCORSConfigValidate(t *testing.T) {
+	testCases := []struct {
+		name    string
+		origins []string
+		valid   bool
+	}{
+		{"origin", []string{"https://console.example.com"}, true},
+		{"origin with port", []string{"http://localhost:3000"}, true},
+		{"wildcard", []string{"*"}, true},
+		{"no origins", []string{}, false},
+		{"wildcard with origins", []string{"*", "https://console.example.com"}, false},
+		{"no scheme", []string{"console.example.com"}, false},
+		{"unsupported scheme", []string{"ftp://console.example.com"}, false},
+		{"path", []string{"https://console.example.com/app"}, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := (&httpsrv.CORSConfig{AllowOrigins: tc.origins}).Validate()
+
+			if tc.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, httpsrv.ErrInvalidCORSConfig)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package httpsrv
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// APIVersionLatest names the latest version of the API, hosted under /
+	APIVersionLatest = "latest"
+
+	// APIVersionV1 names the v1 API, hosted under /api/v1
+	APIVersionV1 = "v1"
+
+	// APIVersionEc2 names the EC2-style API, hosted under /2009-04-04
+	APIVersionEc2 = "2009-04-04"
+)
+
+// APIVersions lists the names of the API version groups which can be
+// deprecated
+var APIVersions = []string{APIVersionLatest, APIVersionV1, APIVersionEc2}
+
+// APIDeprecation describes the planned removal of an API version. Responses
+// from a deprecated version carry the Deprecation (RFC 9745) and Sunset
+// (RFC 8594) headers, to signal clients to migrate.
+type APIDeprecation struct {
+	// DeprecatedAt is when the version was, or will be, deprecated
+	DeprecatedAt time.Time
+
+	// SunsetAt is when the version is expected to stop being served
+	SunsetAt time.Time
+
+	// Link is an optional URL with more information, like a migration guide
+	Link string
+}
+
+// enabled reports whether any headers should be sent for the version
+func (d APIDeprecation) enabled() bool {
+	return !d.DeprecatedAt.IsZero() || !d.SunsetAt.IsZero()
+}
+
+// deprecationHeaders returns the middleware setting the deprecation headers
+// configured for the named API version on every response from it
+func (s *Server) deprecationHeaders(version string) []gin.HandlerFunc {
+	d, ok := s.Deprecations[version]
+	if !ok || !d.enabled() {
+		return nil
+	}
+
+	return []gin.HandlerFunc{func(c *gin.Context) {
+		if !d.DeprecatedAt.IsZero() {
+			c.Header("Deprecation", "@"+strconv.FormatInt(d.DeprecatedAt.Unix(), 10))
+		}
+
+		if !d.SunsetAt.IsZero() {
+			c.Header("Sunset", d.SunsetAt.UTC().Format(http.TimeFormat))
+		}
+
+		if d.Link != "" {
+			c.Header("Link", "<"+d.Link+`>; rel="deprecation"`)
+		}
+
+		c.Next()
+	}}
+}
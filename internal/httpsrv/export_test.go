@@ -0,0 +1,4 @@
+package httpsrv
+
+// CheckMigrations exposes checkMigrations to the tests
+var CheckMigrations = checkMigrations
@@ -0,0 +1,108 @@
+package httpsrv
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+// StartupPath is the path the startup check is served on
+const StartupPath = "/healthz/startup"
+
+var (
+	// DefaultLivenessPaths are the paths the liveness check is served on when
+	// no others have been configured
+	DefaultLivenessPaths = []string{"/healthz", "/healthz/liveness"}
+
+	// DefaultReadinessPaths are the paths the readiness check is served on when
+	// no others have been configured
+	DefaultReadinessPaths = []string{"/healthz/readiness"}
+
+	// ErrInvalidHealthPath is returned when a configured health check path
+	// can't be served.
+	ErrInvalidHealthPath = errors.New("invalid health check path")
+
+	// reservedPaths are served by the service's other routes, along with
+	// everything under them, so health checks can't be served on them
+	reservedPaths = []string{
+		"/version",
+		"/metrics",
+		v1api.V1URI,
+		v1api.MetadataURI,
+		v1api.UserdataURI,
+		"/device",
+		v1api.InternalMetadataURI,
+		v1api.InternalUserdataURI,
+		v1api.InternalIPAddressesURI,
+		v1api.InternalInstancesURI,
+		v1api.InstanceDataURI,
+		v1api.InstanceDataSensitiveURI,
+		v1api.V20090404URI,
+		v1api.DiscoveryURI,
+		v1api.OpenstackURI,
+		v1api.IgnitionURI,
+	}
+)
+
+// isReservedPath reports whether the path is served by another route
+func isReservedPath(p string) bool {
+	for _, reserved := range reservedPaths {
+		if p == reserved || strings.HasPrefix(p, reserved+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ValidateHealthPaths checks the configured liveness and readiness check
+// paths. Each must be an absolute path without any wildcards, and no path can
+// be used more than once, be the StartupPath, or be served by another route
+// (like /metadata, or anything under /api/v1).
+func ValidateHealthPaths(liveness []string, readiness []string) error {
+	seen := make(map[string]bool, len(liveness)+len(readiness)+1)
+	seen[StartupPath] = true
+
+	for _, path := range append(append([]string{}, liveness...), readiness...) {
+		switch {
+		case !strings.HasPrefix(path, "/") || path == "/":
+			return fmt.Errorf("%w: %q must start with / and can't be the root", ErrInvalidHealthPath, path)
+		case strings.ContainsAny(path, ":*"):
+			return fmt.Errorf("%w: %q can't contain wildcards", ErrInvalidHealthPath, path)
+		case seen[path]:
+			return fmt.Errorf("%w: %q is used more than once, or is the startup check's path", ErrInvalidHealthPath, path)
+		case isReservedPath(path):
+			return fmt.Errorf("%w: %q is already served by another route", ErrInvalidHealthPath, path)
+		}
+
+		seen[path] = true
+	}
+
+	return nil
+}
+
+// healthRoutes registers the liveness and readiness checks on their configured
+// paths, or on the defaults when none are configured.
+func (s *Server) healthRoutes(r *gin.Engine) {
+	liveness := s.LivenessPaths
+	if len(liveness) == 0 {
+		liveness = DefaultLivenessPaths
+	}
+
+	readiness := s.ReadinessPaths
+	if len(readiness) == 0 {
+		readiness = DefaultReadinessPaths
+	}
+
+	for _, path := range liveness {
+		r.GET(path, s.livenessCheck)
+	}
+
+	for _, path := range readiness {
+		r.GET(path, s.readinessCheck)
+	}
+}
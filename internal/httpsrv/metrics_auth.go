@@ -0,0 +1,67 @@
+package httpsrv
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"go.hollow.sh/metadataservice/internal/apierror"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+// MetricsAuthConfig guards the Prometheus metrics endpoint, for deployments
+// where it can't be firewalled off. A request is allowed when it presents any
+// of the configured credentials.
+type MetricsAuthConfig struct {
+	// BearerToken, when set, is accepted in an "Authorization: Bearer" header
+	BearerToken string
+
+	// Username and Password, when set, are accepted as basic auth
+	Username string
+	Password string
+}
+
+// middleware returns the middleware rejecting requests to the metrics
+// endpoint which don't present the configured credentials with a 401
+func (cfg *MetricsAuthConfig) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if cfg.allowed(c.Request) {
+			c.Next()
+			return
+		}
+
+		if cfg.BearerToken != "" {
+			c.Header("WWW-Authenticate", `Bearer realm="metrics"`)
+		} else {
+			c.Header("WWW-Authenticate", `Basic realm="metrics"`)
+		}
+
+		apierror.Abort(c, http.StatusUnauthorized, v1api.ErrorCodeUnauthorized, "invalid metrics credentials")
+	}
+}
+
+// allowed reports whether the request presents the configured credentials.
+// They're compared in constant time.
+func (cfg *MetricsAuthConfig) allowed(req *http.Request) bool {
+	if cfg.BearerToken != "" {
+		scheme, token, ok := strings.Cut(req.Header.Get("Authorization"), " ")
+		if ok && strings.EqualFold(scheme, "Bearer") && secretsEqual(token, cfg.BearerToken) {
+			return true
+		}
+	}
+
+	if cfg.Username != "" {
+		username, password, ok := req.BasicAuth()
+		if ok && secretsEqual(username, cfg.Username) && secretsEqual(password, cfg.Password) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func secretsEqual(presented, expected string) bool {
+	return subtle.ConstantTimeCompare([]byte(presented), []byte(expected)) == 1
+}
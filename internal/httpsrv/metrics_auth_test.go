@@ -0,0 +1,112 @@
+package httpsrv_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/httpsrv"
+)
+
+func TestMetricsAuth(t *testing.T) {
+	testCases := []struct {
+		testName       string
+		metricsAuth    *httpsrv.MetricsAuthConfig
+		path           string
+		setAuth        func(req *http.Request)
+		expectedStatus int
+		expectMetrics  bool
+	}{
+		{
+			"open by default",
+			nil,
+			"/metrics",
+			func(req *http.Request) {},
+			http.StatusOK,
+			true,
+		},
+		{
+			"missing bearer token",
+			&httpsrv.MetricsAuthConfig{BearerToken: "s3cret"},
+			"/metrics",
+			func(req *http.Request) {},
+			http.StatusUnauthorized,
+			false,
+		},
+		{
+			"wrong bearer token",
+			&httpsrv.MetricsAuthConfig{BearerToken: "s3cret"},
+			"/metrics",
+			func(req *http.Request) { req.Header.Set("Authorization", "Bearer wrong") },
+			http.StatusUnauthorized,
+			false,
+		},
+		{
+			"right bearer token",
+			&httpsrv.MetricsAuthConfig{BearerToken: "s3cret"},
+			"/metrics",
+			func(req *http.Request) { req.Header.Set("Authorization", "Bearer s3cret") },
+			http.StatusOK,
+			true,
+		},
+		{
+			"wrong basic auth password",
+			&httpsrv.MetricsAuthConfig{Username: "prometheus", Password: "s3cret"},
+			"/metrics",
+			func(req *http.Request) { req.SetBasicAuth("prometheus", "wrong") },
+			http.StatusUnauthorized,
+			false,
+		},
+		{
+			"right basic auth",
+			&httpsrv.MetricsAuthConfig{Username: "prometheus", Password: "s3cret"},
+			"/metrics",
+			func(req *http.Request) { req.SetBasicAuth("prometheus", "s3cret") },
+			http.StatusOK,
+			true,
+		},
+		{
+			"basic auth accepted alongside a bearer token",
+			&httpsrv.MetricsAuthConfig{BearerToken: "t0ken", Username: "prometheus", Password: "s3cret"},
+			"/metrics",
+			func(req *http.Request) { req.SetBasicAuth("prometheus", "s3cret") },
+			http.StatusOK,
+			true,
+		},
+		{
+			"other routes aren't guarded",
+			&httpsrv.MetricsAuthConfig{BearerToken: "s3cret"},
+			"/healthz/liveness",
+			func(req *http.Request) {},
+			http.StatusOK,
+			false,
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			hs := httpsrv.Server{Logger: zap.NewNop(), AuthConfig: serverAuthConfig, MetricsAuth: testcase.metricsAuth}
+			router := hs.NewServer().Handler
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequestWithContext(context.TODO(), "GET", testcase.path, nil)
+			testcase.setAuth(req)
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+
+			if testcase.expectedStatus == http.StatusUnauthorized {
+				assert.NotEmpty(t, w.Header().Get("WWW-Authenticate"))
+				assert.Contains(t, w.Body.String(), `"unauthorized"`)
+			}
+
+			if testcase.expectMetrics {
+				assert.Contains(t, w.Body.String(), "go_goroutines")
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package httpsrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// migrationVersionQuery returns the version of the newest migration goose has
+// applied to the database
+const migrationVersionQuery = `SELECT COALESCE(MAX(version_id), 0) FROM goose_db_version WHERE is_applied`
+
+// ErrSchemaOutdated is returned when the database hasn't been migrated to the
+// schema this build of the service expects
+var ErrSchemaOutdated = errors.New("database schema is out of date")
+
+// checkMigrations returns an error unless the database has been migrated to
+// at least the expected version. Newer versions are accepted, so instances
+// still running the previous build stay ready while a rollout migrates the
+// database ahead of them.
+func checkMigrations(ctx context.Context, db *sqlx.DB, expected int64) error {
+	var applied int64
+
+	if err := db.GetContext(ctx, &applied, migrationVersionQuery); err != nil {
+		return fmt.Errorf("%w: reading the applied migrations: %s", ErrSchemaOutdated, err.Error())
+	}
+
+	if applied < expected {
+		return fmt.Errorf("%w: migrated to version %d, expected %d", ErrSchemaOutdated, applied, expected)
+	}
+
+	return nil
+}
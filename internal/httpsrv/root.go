@@ -0,0 +1,72 @@
+package httpsrv
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.hollow.sh/toolbox/version"
+)
+
+// RootResponse is the configurable style of response for requests to the exact
+// root path ("/"), which doesn't host any of the API routes.
+type RootResponse string
+
+const (
+	// RootResponseNotFound sends the same 404 as any other unknown route. This
+	// is the default.
+	RootResponseNotFound RootResponse = "not-found"
+
+	// RootResponseNoContent sends an empty 204.
+	RootResponseNoContent RootResponse = "no-content"
+
+	// RootResponseInfo sends a small JSON document identifying the service and
+	// its version.
+	RootResponseInfo RootResponse = "info"
+
+	serviceName = "metadataservice"
+)
+
+// ErrInvalidRootResponse is returned when an unknown root response style is
+// provided.
+var ErrInvalidRootResponse = errors.New("invalid root response style")
+
+// ParseRootResponse parses a configured root response style. An empty string
+// results in the default (RootResponseNotFound).
+func ParseRootResponse(style string) (RootResponse, error) {
+	switch RootResponse(style) {
+	case "", RootResponseNotFound:
+		return RootResponseNotFound, nil
+	case RootResponseNoContent, RootResponseInfo:
+		return RootResponse(style), nil
+	default:
+		return "", fmt.Errorf("%w: %q", ErrInvalidRootResponse, style)
+	}
+}
+
+// rootRoutes registers the handlers for the exact root path, when a response
+// other than a 404 has been configured. Only "/" itself is handled, so the
+// latest API routes hosted under / are unaffected.
+func (s *Server) rootRoutes(r *gin.Engine) {
+	switch s.RootResponse {
+	case RootResponseNoContent:
+		r.GET("/", s.rootNoContent)
+		r.HEAD("/", s.rootNoContent)
+	case RootResponseInfo:
+		r.GET("/", s.rootInfo)
+		r.HEAD("/", s.rootInfo)
+	}
+}
+
+func (s *Server) rootNoContent(c *gin.Context) {
+	c.Status(http.StatusNoContent)
+}
+
+// rootInfo identifies the service, for monitoring or humans hitting the root
+func (s *Server) rootInfo(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"service": serviceName,
+		"version": version.String(),
+	})
+}
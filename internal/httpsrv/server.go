@@ -2,18 +2,21 @@ package httpsrv
 
 import (
 	"context"
+	"crypto/x509"
 	"errors"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
 	"text/template"
 	"time"
 
-	"github.com/gin-contrib/cors"
 	ginzap "github.com/gin-contrib/zap"
 	"github.com/gin-gonic/gin"
 	"github.com/jmoiron/sqlx"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	ginprometheus "github.com/zsais/go-gin-prometheus"
 	"go.hollow.sh/toolbox/ginjwt"
 	"go.hollow.sh/toolbox/version"
@@ -21,30 +24,126 @@ import (
 	"go.opentelemetry.io/otel"
 	"go.uber.org/zap"
 
+	dbm "go.hollow.sh/metadataservice/db"
+	"go.hollow.sh/metadataservice/internal/apierror"
+	"go.hollow.sh/metadataservice/internal/coalesce"
+	"go.hollow.sh/metadataservice/internal/correlation"
+	"go.hollow.sh/metadataservice/internal/dbstats"
+	"go.hollow.sh/metadataservice/internal/events"
+	"go.hollow.sh/metadataservice/internal/idempotency"
+	"go.hollow.sh/metadataservice/internal/inventory"
+	"go.hollow.sh/metadataservice/internal/lastfetch"
 	"go.hollow.sh/metadataservice/internal/lookup"
+	"go.hollow.sh/metadataservice/internal/metadatahistory"
+	"go.hollow.sh/metadataservice/internal/metadataschema"
+	"go.hollow.sh/metadataservice/internal/middleware"
+	"go.hollow.sh/metadataservice/internal/orphanedips"
+	"go.hollow.sh/metadataservice/internal/prewrite"
+	"go.hollow.sh/metadataservice/internal/ratelimit"
+	"go.hollow.sh/metadataservice/internal/readcache"
+	"go.hollow.sh/metadataservice/internal/readonly"
+	"go.hollow.sh/metadataservice/internal/sessiontoken"
+	"go.hollow.sh/metadataservice/internal/stalecache"
+	"go.hollow.sh/metadataservice/internal/userdata"
 	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
 )
 
 // Server contains the HTTP server configuration
 type Server struct {
-	Logger          *zap.Logger
-	Listen          string
-	Debug           bool
-	DB              *sqlx.DB
-	AuthConfig      ginjwt.AuthConfig
-	TrustedProxies  []string
-	LookupEnabled   bool
-	LookupClient    lookup.Client
-	TemplateFields  map[string]template.Template
-	ShutdownTimeout time.Duration
+	Logger              *zap.Logger
+	Listen              string
+	Debug               bool
+	DB                  *sqlx.DB
+	AuthConfig          ginjwt.AuthConfig
+	TrustedProxies      []string
+	LookupEnabled       bool
+	LookupClient        lookup.Client
+	TemplateFields      map[string]template.Template
+	MetadataTemplates   map[string]template.Template
+	SensitivePaths      []v1api.SensitivePath
+	ShutdownTimeout     time.Duration
+	ShutdownDrainDelay  time.Duration
+	TLS                 *TLSConfig
+	UnixSocket          *UnixSocketConfig
+	CORS                *CORSConfig
+	MetricsAuth         *MetricsAuthConfig
+	ReadCoalescing      bool
+	UserdataTransformer userdata.Transformer
+	Datasources         v1api.DatasourceConfig
+	SourceIPDebugHeader bool
+	Ec2NotFoundBody     v1api.NotFoundBody
+	MaxMetadataBodySize int64
+	MaxUserdataBodySize int64
+	MaxBatchBodySize    int64
+	FetchRecorder       *lastfetch.Recorder
+	ETags               bool
+	Compression         bool
+	CompressionMinSize  int
+	AdminListen         string
+	PprofEnabled        bool
+	InstanceIDFormat    *v1api.InstanceIDFormat
+	MaxInstances        int64
+	StableInstanceID    bool
+	StableIDBySourceIP  bool
+	RootResponse        RootResponse
+	BootstrapTokens     bool
+	MetadataHistory     bool
+	HistoryPruner       *metadatahistory.Pruner
+	IdempotencyKeys     bool
+	IdempotencyTTL      time.Duration
+	ValidateIgnition    bool
+	DefaultMetadata     *v1api.DefaultMetadata
+	IdempotencyPruner   *idempotency.Pruner
+	OrphanedIPs         *orphanedips.Reconciler
+	MetadataSchema      *metadataschema.Validator
+	Deprecations        map[string]APIDeprecation
+	UpsertRetryAfter    time.Duration
+	ForwardedForPolicy  middleware.ForwardedForPolicy
+	StaleCache          *stalecache.Cache
+	ReadCache           *readcache.Cache
+	ReadRateLimiter     *ratelimit.Limiter
+	Events              *events.Publisher
+	PreWriteHook        *prewrite.Hook
+	LivenessPaths       []string
+	ReadinessPaths      []string
+	RejectIPConflicts   bool
+	IPlessPolicy        v1api.IPlessPolicy
+	ProvisioningMarker  bool
+	ReadOnly            *readonly.Mode
+	SessionTokens       *sessiontoken.Issuer
+	RequireSessionToken bool
+	RouteTimeouts       v1api.RouteTimeouts
+	ServerTimeouts      ServerTimeouts
+	InstanceAuth        v1api.InstanceAuthConfig
+	InventoryInterval   time.Duration
+	DBStatsMetrics      bool
+	SkipMigrationCheck  bool
+
+	InstanceDataPublicFields []string
+
+	// draining is set once shutdown begins, failing the readiness check
+	draining atomic.Bool
+
+	// schemaCurrent is set once the readiness check has seen the database
+	// migrated to the expected version, so it's only checked until then
+	schemaCurrent atomic.Bool
+
+	// startupComplete is set once the boot sequence has finished, passing the
+	// startup check from then on
+	startupComplete atomic.Bool
 }
 
 var (
-	readTimeout     = 10 * time.Second
-	writeTimeout    = 20 * time.Second
-	corsMaxAge      = 12 * time.Hour
 	dbPingTimeout   = 10 * time.Second
 	shutdownTimeout = 10 * time.Second
+
+	// startupRetryInterval is how long the boot sequence waits before trying
+	// again when a step fails
+	startupRetryInterval = time.Second
+
+	// errNoDatabase is returned by the boot sequence when the server hasn't
+	// been given a database
+	errNoDatabase = errors.New("no database configured")
 )
 
 func (s *Server) setup() *gin.Engine {
@@ -61,21 +160,23 @@ func (s *Server) setup() *gin.Engine {
 	// Setup default gin router
 	r := gin.New()
 
-	// Set the trusted proxies, if they were specified by config
-	if len(s.TrustedProxies) > 0 {
-		err = r.SetTrustedProxies(s.TrustedProxies)
-		if err != nil {
-			s.Logger.Sugar().Fatal("failed to set gin trusted proxies", "error", err)
-		}
+	trustedProxies, err := middleware.ParseTrustedProxies(s.TrustedProxies)
+	if err != nil {
+		s.Logger.Sugar().Fatal("failed to parse gin trusted proxies", "error", err)
 	}
 
-	r.Use(cors.New(cors.Config{
-		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD"},
-		AllowHeaders:     []string{"Origin", "Content-Length", "Content-Type", "Authorization"},
-		AllowAllOrigins:  true,
-		AllowCredentials: true,
-		MaxAge:           corsMaxAge,
-	}))
+	// Set the trusted proxies given by config. Gin trusts every proxy by
+	// default, so this is always set: without any trusted proxies, the
+	// X-Forwarded-For and X-Real-IP headers are ignored and the client IP is
+	// always the peer address, so clients can't spoof their address.
+	err = r.SetTrustedProxies(s.TrustedProxies)
+	if err != nil {
+		s.Logger.Sugar().Fatal("failed to set gin trusted proxies", "error", err)
+	}
+
+	if s.CORS != nil {
+		r.Use(s.CORS.middleware())
+	}
 
 	p := ginprometheus.NewPrometheus("gin")
 
@@ -84,13 +185,24 @@ func (s *Server) setup() *gin.Engine {
 		return c.FullPath()
 	}
 
-	p.Use(r)
+	// The metrics endpoint is open unless credentials are configured for it,
+	// which only guard the endpoint itself
+	if s.MetricsAuth == nil {
+		p.Use(r)
+	} else {
+		r.Use(p.HandlerFunc())
+		r.GET(p.MetricsPath, s.MetricsAuth.middleware(), gin.WrapH(promhttp.Handler()))
+	}
 
 	r.Use(ginzap.Logger(s.Logger.With(zap.String("component", "httpsrv")), ginzap.WithTimeFormat(time.RFC3339),
 		ginzap.WithUTC(true),
 		ginzap.WithCustomFields(
 			func(c *gin.Context) zap.Field { return zap.String("jwt_subject", ginjwt.GetSubject(c)) },
 			func(c *gin.Context) zap.Field { return zap.String("jwt_user", ginjwt.GetUser(c)) },
+			func(c *gin.Context) zap.Field { return zap.String("client_cert_subject", clientCertSubject(c)) },
+			func(c *gin.Context) zap.Field {
+				return zap.String(correlation.LogField, c.GetString(middleware.ContextKeyCorrelationID))
+			},
 		),
 	))
 	r.Use(ginzap.RecoveryWithZap(s.Logger.With(zap.String("component", "httpsrv")), true))
@@ -105,72 +217,283 @@ func (s *Server) setup() *gin.Engine {
 		r.Use(otelgin.Middleware(hostname, otelgin.WithTracerProvider(tp)))
 	}
 
+	// Correlate everything done for a request, falling back to a request ID
+	// when it isn't traced
+	r.Use(middleware.CorrelationID())
+
+	// Compress large responses, like userdata, for clients which accept it
+	if s.Compression {
+		r.Use(middleware.Compress(s.CompressionMinSize))
+	}
+
 	// Version endpoint returns build information
 	r.GET("/version", s.version)
 
 	// Health endpoints
-	r.GET("/healthz", s.livenessCheck)
-	r.GET("/healthz/liveness", s.livenessCheck)
-	r.GET("/healthz/readiness", s.readinessCheck)
+	s.healthRoutes(r)
+	r.GET(StartupPath, s.startupCheck)
+
+	// The exact root path, which isn't otherwise routed
+	s.rootRoutes(r)
+
+	v1Rtr := v1api.Router{
+		AuthMW:         authMW,
+		DB:             s.DB,
+		Logger:         s.Logger,
+		LookupEnabled:  s.LookupEnabled,
+		LookupClient:   s.LookupClient,
+		TemplateFields: s.TemplateFields,
+		Coalescer:      coalesce.New(s.ReadCoalescing),
+
+		UserdataTransformer: s.UserdataTransformer,
+		Datasources:         s.Datasources,
+		SourceIPDebugHeader: s.SourceIPDebugHeader,
+		Ec2NotFoundBody:     s.Ec2NotFoundBody,
+		MaxMetadataBodySize: s.MaxMetadataBodySize,
+		MaxUserdataBodySize: s.MaxUserdataBodySize,
+		MaxBatchBodySize:    s.MaxBatchBodySize,
+		FetchRecorder:       s.FetchRecorder,
+		ETags:               s.ETags,
+		InstanceIDFormat:    s.InstanceIDFormat,
+		MaxInstances:        s.MaxInstances,
+		StableInstanceID:    s.StableInstanceID,
+		StableIDBySourceIP:  s.StableIDBySourceIP,
+		MetadataTemplates:   s.MetadataTemplates,
+		SensitivePaths:      s.SensitivePaths,
+		BootstrapTokens:     s.BootstrapTokens,
+		MetadataHistory:     s.MetadataHistory,
+		MetadataSchema:      s.MetadataSchema,
+		UpsertRetryAfter:    s.UpsertRetryAfter,
+		ForwardedForPolicy:  s.ForwardedForPolicy,
+		TrustedProxies:      trustedProxies,
+		StaleCache:          s.StaleCache,
+		ReadCache:           s.ReadCache,
+		ReadRateLimiter:     s.ReadRateLimiter,
+		Events:              s.Events,
+		PreWriteHook:        s.PreWriteHook,
+		RejectIPConflicts:   s.RejectIPConflicts,
+		IPlessPolicy:        s.IPlessPolicy,
+		ProvisioningMarker:  s.ProvisioningMarker,
+		ReadOnly:            s.ReadOnly,
+		SessionTokens:       s.SessionTokens,
+		RequireSessionToken: s.RequireSessionToken,
+		Timeouts:            s.RouteTimeouts,
+		InstanceAuth:        s.InstanceAuth,
+		UnixSocket:          s.unixSocketIdentity(),
+		IdempotencyKeys:     s.IdempotencyKeys,
+		IdempotencyTTL:      s.IdempotencyTTL,
+		ValidateIgnition:    s.ValidateIgnition,
+		DefaultMetadata:     s.DefaultMetadata,
+
+		InstanceDataPublicFields: s.InstanceDataPublicFields,
+	}
+
+	// Unauthenticated discovery, for clients probing whether the service exists
+	v1Rtr.DiscoveryRoutes(&r.RouterGroup)
 
-	v1Rtr := v1api.Router{AuthMW: authMW, DB: s.DB, Logger: s.Logger, LookupEnabled: s.LookupEnabled, LookupClient: s.LookupClient, TemplateFields: s.TemplateFields}
+	// IMDSv2-style session tokens, served at the root like on AWS
+	v1Rtr.SessionTokenRoutes(&r.RouterGroup)
 
 	// Host our latest version of the API under / in addition to /api/v*
-	latest := r.Group("/")
+	latest := r.Group("/", s.deprecationHeaders(APIVersionLatest)...)
 	{
 		v1Rtr.Routes(latest)
 	}
 
-	v1 := r.Group(v1api.V1URI)
+	v1 := r.Group(v1api.V1URI, s.deprecationHeaders(APIVersionV1)...)
 	{
 		v1Rtr.Routes(v1)
 	}
 
-	ec2 := r.Group(v1api.V20090404URI)
-	{
-		v1Rtr.Ec2Routes(ec2)
+	if s.Datasources.Enabled(v1api.DatasourceEc2) {
+		ec2 := r.Group(v1api.V20090404URI, s.deprecationHeaders(APIVersionEc2)...)
+		{
+			v1Rtr.Ec2Routes(ec2)
+		}
+
+		// The raw userdata, served at the root like on AWS
+		v1Rtr.Ec2LatestRoutes(r.Group("/", s.deprecationHeaders(APIVersionEc2)...))
 	}
 
-	r.NoRoute(func(c *gin.Context) {
-		c.JSON(http.StatusNotFound, gin.H{"message": "invalid request - route not found"})
-	})
+	if s.Datasources.Enabled(v1api.DatasourceOpenstack) {
+		v1Rtr.OpenstackRoutes(r.Group(v1api.OpenstackURI))
+	}
+
+	if s.Datasources.Enabled(v1api.DatasourceIgnition) {
+		v1Rtr.IgnitionRoutes(r.Group(v1api.IgnitionURI))
+	}
+
+	r.NoRoute(routeNotFound)
 
 	return r
 }
 
+// routeNotFound responds to requests for routes which don't exist, on both
+// the instance-facing and admin ports
+func routeNotFound(c *gin.Context) {
+	apierror.Respond(c, http.StatusNotFound, v1api.ErrorCodeRouteNotFound, "invalid request - route not found")
+}
+
 // NewServer returns a configured server
 func (s *Server) NewServer() *http.Server {
 	if !s.Debug {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
-	return &http.Server{
-		Handler:      s.setup(),
-		Addr:         s.Listen,
-		ReadTimeout:  readTimeout,
-		WriteTimeout: writeTimeout,
+	srv := &http.Server{
+		Handler:     s.setup(),
+		Addr:        s.Listen,
+		ConnContext: connContext,
+	}
+
+	s.ServerTimeouts.apply(srv)
+
+	return srv
+}
+
+// unixSocketIdentity returns how instances making requests over the unix
+// socket are identified
+func (s *Server) unixSocketIdentity() v1api.UnixSocketIdentity {
+	if s.UnixSocket == nil {
+		return v1api.UnixSocketIdentity{}
 	}
+
+	return s.UnixSocket.Identity
 }
 
-// Run will start the server listening on the specified address
+// Run will start the server listening on the specified address, until it
+// receives a SIGINT or SIGTERM or the context is cancelled. It then shuts down
+// gracefully: the readiness check starts failing straight away, and after the
+// drain delay the server stops accepting connections and waits (up to the
+// shutdown timeout) for in-flight requests to finish.
 func (s *Server) Run(ctx context.Context) error {
 	if !s.Debug {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
 	srv := &http.Server{
-		Addr:    s.Listen,
-		Handler: s.setup(),
+		Addr:        s.Listen,
+		Handler:     s.setup(),
+		ConnContext: connContext,
+	}
+
+	s.ServerTimeouts.apply(srv)
+
+	// Terminate TLS when it's configured, reloading the certificate on SIGHUP
+	// so it can be rotated without a restart
+	if s.TLS != nil {
+		certs, err := newCertReloader(s.TLS.CertFile, s.TLS.KeyFile)
+		if err != nil {
+			return err
+		}
+
+		var clientCAs *x509.CertPool
+
+		if s.TLS.ClientCAFile != "" {
+			if clientCAs, err = loadClientCAs(s.TLS.ClientCAFile); err != nil {
+				return err
+			}
+		}
+
+		srv.TLSConfig = s.TLS.config(certs, clientCAs)
+
+		stopReloading := certs.reloadOnSIGHUP(s.Logger)
+		defer stopReloading()
 	}
 
-	exit := make(chan error, 1)
+	// The unix socket is created before anything is started, so a path which
+	// can't be used fails startup straight away. It's removed on shutdown.
+	var unixListener net.Listener
+
+	if s.UnixSocket != nil {
+		listener, err := s.UnixSocket.listen()
+		if err != nil {
+			return err
+		}
+
+		unixListener = listener
+
+		defer func() {
+			if err := s.UnixSocket.remove(); err != nil {
+				s.Logger.Warn("failed to remove the unix socket", zap.String("path", s.UnixSocket.Path), zap.Error(err))
+			}
+		}()
+	}
+
+	// Flush any recorded metadata fetches once we've stopped serving requests
+	s.FetchRecorder.Start(ctx)
+	defer s.FetchRecorder.Stop()
+
+	s.HistoryPruner.Start(ctx)
+	defer s.HistoryPruner.Stop()
+
+	s.IdempotencyPruner.Start(ctx)
+	defer s.IdempotencyPruner.Stop()
+
+	s.OrphanedIPs.Start(ctx)
+	defer s.OrphanedIPs.Stop()
+
+	s.ReadRateLimiter.Start(ctx)
+	defer s.ReadRateLimiter.Stop()
+
+	// Publish the number of stored instances and IP associations, when enabled
+	var inventoryCollector *inventory.Collector
+	if s.InventoryInterval > 0 {
+		inventoryCollector = inventory.NewCollector(s.DB, s.Logger, s.InventoryInterval)
+	}
+
+	inventoryCollector.Start(ctx)
+	defer inventoryCollector.Stop()
+
+	// Publish the database connection pool's stats, when enabled
+	if s.DBStatsMetrics {
+		if err := dbstats.Register(s.DB.DB); err != nil {
+			s.Logger.Warn("failed to register the database connection pool metrics", zap.Error(err))
+		}
+	}
+
+	// Work through the boot sequence while serving, so the startup check can
+	// report when it's done
+	go s.startup(ctx)
+
+	exit := make(chan error, 3)
+
+	// Serving sets up HTTP/2, which sets the server's TLS config, so whether to
+	// terminate TLS is decided before anything is served
+	listen := srv.ListenAndServe
+	if srv.TLSConfig != nil {
+		listen = func() error { return srv.ListenAndServeTLS("", "") }
+	}
 
 	go func() {
-		if err := srv.ListenAndServe(); err != nil {
+		if err := listen(); err != nil {
 			exit <- err
 		}
 	}()
 
+	// The unix socket is served by the same server, without TLS, so it's
+	// shut down along with the TCP listener
+	if unixListener != nil {
+		go func() {
+			if err := srv.Serve(unixListener); err != nil {
+				exit <- err
+			}
+		}()
+	}
+
+	// The admin server is only started when it has been given an address
+	var adminSrv *http.Server
+
+	if s.AdminListen != "" {
+		adminSrv = s.NewAdminServer()
+
+		go func() {
+			if err := adminSrv.ListenAndServe(); err != nil {
+				exit <- err
+			}
+		}()
+	}
+
 	quit := make(chan os.Signal, 1)
 
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -184,6 +507,18 @@ func (s *Server) Run(ctx context.Context) error {
 		return err
 	case <-quit:
 		s.Logger.Warn("server shutting down")
+	case <-ctx.Done():
+		s.Logger.Warn("server shutting down")
+	}
+
+	// Stop being ready first, so a load balancer can stop routing new
+	// requests here before the listeners are closed
+	s.draining.Store(true)
+
+	if s.ShutdownDrainDelay > 0 {
+		s.Logger.Info("draining before shutdown", zap.Duration("delay", s.ShutdownDrainDelay))
+
+		time.Sleep(s.ShutdownDrainDelay)
 	}
 
 	timeout := shutdownTimeout
@@ -192,9 +527,17 @@ func (s *Server) Run(ctx context.Context) error {
 		timeout = s.ShutdownTimeout
 	}
 
-	ctx, cancel := context.WithTimeout(ctx, timeout)
+	// In-flight requests still get the full timeout when the context was what
+	// triggered the shutdown
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
 	defer cancel()
 
+	if adminSrv != nil {
+		if err := adminSrv.Shutdown(ctx); err != nil {
+			s.Logger.Error("forcing admin server shutdown")
+		}
+	}
+
 	if err := srv.Shutdown(ctx); err != nil {
 		s.Logger.Error("forcing server shutdown")
 
@@ -211,10 +554,92 @@ func (s *Server) livenessCheck(c *gin.Context) {
 	})
 }
 
+// startupCheck reports whether the boot sequence has finished, for startup
+// probes holding off the liveness probe while the service starts. Unlike
+// the readiness check, it never fails again once it has passed.
+func (s *Server) startupCheck(c *gin.Context) {
+	if !s.startupComplete.Load() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status": "STARTING",
+		})
+
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "UP",
+	})
+}
+
+// startup works through the boot sequence, trying again until it succeeds or
+// the context is cancelled: the database must be reachable and, unless
+// SkipMigrationCheck is set, migrated to the version this build expects. The
+// caches are filled as instances are served, so there's nothing to warm.
+func (s *Server) startup(ctx context.Context) {
+	for {
+		err := s.boot(ctx)
+		if err == nil {
+			s.startupComplete.Store(true)
+			s.Logger.Info("startup complete")
+
+			return
+		}
+
+		s.Logger.Warn("startup not complete, retrying", zap.Error(err), zap.Duration("retry_interval", startupRetryInterval))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(startupRetryInterval):
+		}
+	}
+}
+
+// boot runs each step of the boot sequence once
+func (s *Server) boot(ctx context.Context) error {
+	if s.DB == nil {
+		return errNoDatabase
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dbPingTimeout)
+	defer cancel()
+
+	if err := s.DB.PingContext(ctx); err != nil {
+		return err
+	}
+
+	if s.SkipMigrationCheck || s.schemaCurrent.Load() {
+		return nil
+	}
+
+	expected, err := dbm.LatestVersion()
+	if err != nil {
+		return err
+	}
+
+	if err := checkMigrations(ctx, s.DB, expected); err != nil {
+		return err
+	}
+
+	s.schemaCurrent.Store(true)
+
+	return nil
+}
+
 // readinessCheck ensures that the server is up and that we are able to process
 // requests. Currently our only dependency is the DB so we just ensure that it
-// is responding.
+// is responding, and (unless SkipMigrationCheck is set) that its schema has
+// been migrated to the version this build expects. It fails as soon as
+// shutdown begins.
 func (s *Server) readinessCheck(c *gin.Context) {
+	if s.draining.Load() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status": "DOWN",
+		})
+
+		return
+	}
+
 	startTime := time.Now()
 
 	ctx, cancel := context.WithTimeout(c.Request.Context(), dbPingTimeout)
@@ -230,6 +655,24 @@ func (s *Server) readinessCheck(c *gin.Context) {
 		return
 	}
 
+	if !s.SkipMigrationCheck && !s.schemaCurrent.Load() {
+		expected, err := dbm.LatestVersion()
+		if err == nil {
+			err = checkMigrations(ctx, s.DB, expected)
+		}
+
+		if err != nil {
+			s.Logger.Error("readiness check failed, the database schema isn't current", zap.Error(err))
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"status": "DOWN",
+			})
+
+			return
+		}
+
+		s.schemaCurrent.Store(true)
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"status": "UP",
 	})
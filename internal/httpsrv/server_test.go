@@ -2,17 +2,38 @@ package httpsrv_test
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/stretchr/testify/assert"
 	"go.hollow.sh/toolbox/ginjwt"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 
+	dbm "go.hollow.sh/metadataservice/db"
 	"go.hollow.sh/metadataservice/internal/dbtools"
 	"go.hollow.sh/metadataservice/internal/httpsrv"
+	"go.hollow.sh/metadataservice/internal/prewrite"
+	"go.hollow.sh/metadataservice/internal/readonly"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
 )
 
 var serverAuthConfig = ginjwt.AuthConfig{
@@ -29,7 +50,31 @@ func TestUnknownRoute(t *testing.T) {
 	router.ServeHTTP(w, req)
 
 	assert.Equal(t, 404, w.Code)
-	assert.Equal(t, `{"message":"invalid request - route not found"}`, w.Body.String())
+
+	var resp v1api.ErrorResponse
+
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, v1api.ErrorCodeRouteNotFound, resp.Error.Code)
+	assert.Equal(t, "invalid request - route not found", resp.Error.Message)
+
+	// The request ID is generated for the request, and echoed in the header
+	assert.NotEmpty(t, resp.Error.RequestID)
+	assert.Equal(t, w.Header().Get("X-Request-ID"), resp.Error.RequestID)
+}
+
+func TestUnknownRouteRequestID(t *testing.T) {
+	hs := httpsrv.Server{Logger: zap.NewNop(), AuthConfig: serverAuthConfig}
+	router := hs.NewServer().Handler
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequestWithContext(context.TODO(), "GET", "a/route/that/doesnt/exist", nil)
+	req.Header.Set("X-Request-ID", "caller-request-id")
+	router.ServeHTTP(w, req)
+
+	assert.JSONEq(t, `{"error":{"code":"route_not_found","message":"invalid request - route not found","request_id":"caller-request-id"}}`, w.Body.String())
 }
 
 func TestHealthzRoute(t *testing.T) {
@@ -87,3 +132,959 @@ func TestReadinessRouteUp(t *testing.T) {
 	assert.Equal(t, 200, w.Code)
 	assert.Equal(t, `{"status":"UP"}`, w.Body.String())
 }
+
+func TestReadinessRouteUpInReadOnlyMode(t *testing.T) {
+	db := dbtools.DatabaseTest(t)
+
+	hs := httpsrv.Server{Logger: zap.NewNop(), AuthConfig: serverAuthConfig, DB: db, ReadOnly: readonly.New(true)}
+	router := hs.NewServer().Handler
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequestWithContext(context.TODO(), "GET", "/healthz/readiness", nil)
+	router.ServeHTTP(w, req)
+
+	// Read-only replicas are still serving reads, so they stay in rotation
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, `{"status":"UP"}`, w.Body.String())
+}
+
+// runServer runs the server on a free local address until the test ends,
+// returning its base URL once it's serving
+func runServer(t *testing.T, hs *httpsrv.Server) string {
+	addr := freeAddress(t)
+	hs.Listen = addr
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	runErr := make(chan error, 1)
+
+	go func() {
+		runErr <- hs.Run(ctx)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		<-runErr
+	})
+
+	baseURL := "http://" + addr
+
+	assert.Eventually(t, func() bool {
+		code, _ := getStatus(baseURL + "/healthz/liveness")
+		return code == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+
+	return baseURL
+}
+
+// getStatus returns the status code of a GET request to the url
+func getStatus(url string) (int, error) {
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: 5 * time.Second}
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, url, nil)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+
+	resp.Body.Close()
+
+	return resp.StatusCode, nil
+}
+
+func TestStartupRouteStarting(t *testing.T) {
+	db, _ := sqlx.Open("postgres", "localhost:12341")
+
+	hs := httpsrv.Server{Logger: zap.NewNop(), AuthConfig: serverAuthConfig, DB: db}
+
+	// The boot sequence only runs with the server
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequestWithContext(context.TODO(), "GET", httpsrv.StartupPath, nil)
+	hs.NewServer().Handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, `{"status":"STARTING"}`, w.Body.String())
+
+	// It can't finish while the database is unreachable, while the liveness
+	// check passes regardless
+	baseURL := runServer(t, &hs)
+
+	code, err := getStatus(baseURL + httpsrv.StartupPath)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	code, err = getStatus(baseURL + "/healthz/liveness")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestStartupRouteUp(t *testing.T) {
+	db := dbtools.DatabaseTest(t)
+
+	hs := httpsrv.Server{Logger: zap.NewNop(), AuthConfig: serverAuthConfig, DB: db}
+	baseURL := runServer(t, &hs)
+
+	assert.Eventually(t, func() bool {
+		code, err := getStatus(baseURL + httpsrv.StartupPath)
+		return err == nil && code == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestCheckMigrations(t *testing.T) {
+	db := dbtools.DatabaseTest(t)
+
+	latest, err := dbm.LatestVersion()
+	assert.NoError(t, err)
+	assert.Greater(t, latest, int64(0))
+
+	// The test database is migrated with the embedded migrations
+	assert.NoError(t, httpsrv.CheckMigrations(context.TODO(), db, latest))
+	assert.NoError(t, httpsrv.CheckMigrations(context.TODO(), db, latest-1))
+	assert.ErrorIs(t, httpsrv.CheckMigrations(context.TODO(), db, latest+1), httpsrv.ErrSchemaOutdated)
+}
+
+func TestConfiguredHealthPaths(t *testing.T) {
+	db, _ := sqlx.Open("postgres", "localhost:12341")
+
+	hs := httpsrv.Server{
+		Logger:         zap.NewNop(),
+		AuthConfig:     serverAuthConfig,
+		DB:             db,
+		LivenessPaths:  []string{"/live", "/health"},
+		ReadinessPaths: []string{"/ready"},
+	}
+	s := hs.NewServer()
+	router := s.Handler
+
+	testCases := map[string]int{
+		"/live":              200,
+		"/health":            200,
+		"/ready":             503,
+		"/healthz":           404,
+		"/healthz/readiness": 404,
+	}
+
+	for path, expectedStatus := range testCases {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequestWithContext(context.TODO(), "GET", path, nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, expectedStatus, w.Code, path)
+	}
+}
+
+func TestValidateHealthPaths(t *testing.T) {
+	assert.Nil(t, httpsrv.ValidateHealthPaths(httpsrv.DefaultLivenessPaths, httpsrv.DefaultReadinessPaths))
+	assert.Nil(t, httpsrv.ValidateHealthPaths([]string{"/live"}, nil))
+
+	for _, paths := range [][]string{{"health"}, {"/"}, {"/health/:probe"}, {"/health", "/health"}, {httpsrv.StartupPath}} {
+		assert.ErrorIs(t, httpsrv.ValidateHealthPaths(paths, nil), httpsrv.ErrInvalidHealthPath, paths)
+	}
+
+	assert.ErrorIs(t, httpsrv.ValidateHealthPaths([]string{"/health"}, []string{"/health"}), httpsrv.ErrInvalidHealthPath)
+}
+
+func TestValidateHealthPathsReserved(t *testing.T) {
+	// Paths served by other routes, or under them, can't be used
+	for _, path := range []string{
+		"/metadata",
+		"/metadata/health",
+		"/userdata",
+		"/metrics",
+		"/version",
+		"/api/v1/healthz",
+		"/device-metadata",
+		"/device/health",
+		"/latest/meta-data",
+		"/2009-04-04/health",
+		"/openstack",
+		"/ignition/health",
+		"/instance-data.json",
+	} {
+		assert.ErrorIs(t, httpsrv.ValidateHealthPaths([]string{path}, nil), httpsrv.ErrInvalidHealthPath, path)
+		assert.ErrorIs(t, httpsrv.ValidateHealthPaths(nil, []string{path}), httpsrv.ErrInvalidHealthPath, path)
+	}
+
+	// Paths merely sharing a prefix with them can
+	assert.Nil(t, httpsrv.ValidateHealthPaths([]string{"/metadata-health", "/versionz"}, []string{"/ready"}))
+}
+
+func TestRootResponse(t *testing.T) {
+	testCases := []struct {
+		testName       string
+		rootResponse   httpsrv.RootResponse
+		expectedStatus int
+	}{
+		{"default", "", http.StatusNotFound},
+		{"not found", httpsrv.RootResponseNotFound, http.StatusNotFound},
+		{"no content", httpsrv.RootResponseNoContent, http.StatusNoContent},
+		{"info", httpsrv.RootResponseInfo, http.StatusOK},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			hs := httpsrv.Server{Logger: zap.NewNop(), AuthConfig: serverAuthConfig, RootResponse: testcase.rootResponse}
+			s := hs.NewServer()
+			router := s.Handler
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequestWithContext(context.TODO(), "GET", "/", nil)
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+
+			if testcase.rootResponse == httpsrv.RootResponseInfo {
+				assert.Contains(t, w.Body.String(), `"service":"metadataservice"`)
+			}
+
+			// Routes under the root are unaffected
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequestWithContext(context.TODO(), "GET", "/healthz", nil)
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+		})
+	}
+}
+
+func TestParseRootResponse(t *testing.T) {
+	style, err := httpsrv.ParseRootResponse("")
+	assert.Nil(t, err)
+	assert.Equal(t, httpsrv.RootResponseNotFound, style)
+
+	_, err = httpsrv.ParseRootResponse("teapot")
+	assert.ErrorIs(t, err, httpsrv.ErrInvalidRootResponse)
+}
+
+func TestRequestIDHeader(t *testing.T) {
+	hs := httpsrv.Server{Logger: zap.NewNop(), AuthConfig: serverAuthConfig}
+	s := hs.NewServer()
+	router := s.Handler
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequestWithContext(context.TODO(), "GET", "/healthz", nil)
+	req.Header.Set("X-Request-ID", "my-request")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, "my-request", w.Header().Get("X-Request-ID"))
+
+	// A correlation ID is generated when the caller doesn't provide one
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequestWithContext(context.TODO(), "GET", "/healthz", nil)
+	router.ServeHTTP(w, req)
+
+	assert.NotEmpty(t, w.Header().Get("X-Request-ID"))
+}
+
+func TestDatabaseErrorsLoggedWithRequestID(t *testing.T) {
+	db, _ := sqlx.Open("postgres", "localhost:12341")
+
+	core, logs := observer.New(zapcore.ErrorLevel)
+
+	hs := httpsrv.Server{Logger: zap.New(core), AuthConfig: serverAuthConfig, DB: db}
+	router := hs.NewServer().Handler
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequestWithContext(context.TODO(), "GET", v1api.GetInternalMetadataByIDPath("6bd001dd-0523-4002-93e9-36a98607638a"), nil)
+	req.Header.Set("X-Request-ID", "db-error-request")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	dbErrors := logs.FilterMessage("database error").All()
+	if assert.Len(t, dbErrors, 1) {
+		assert.Equal(t, "db-error-request", dbErrors[0].ContextMap()["correlation_id"])
+	}
+}
+
+func TestDeprecationHeaders(t *testing.T) {
+	deprecatedAt := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+	sunsetAt := time.Date(2026, time.July, 1, 0, 0, 0, 0, time.UTC)
+
+	hs := httpsrv.Server{Logger: zap.NewNop(), AuthConfig: serverAuthConfig, Deprecations: map[string]httpsrv.APIDeprecation{
+		httpsrv.APIVersionV1: {DeprecatedAt: deprecatedAt, SunsetAt: sunsetAt, Link: "https://example.com/migrating"},
+	}}
+	s := hs.NewServer()
+	router := s.Handler
+
+	// The deprecated version carries the headers
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequestWithContext(context.TODO(), "GET", "/api/v1/device-metadata/not-a-uuid", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, "@1767225600", w.Header().Get("Deprecation"))
+	assert.Equal(t, "Wed, 01 Jul 2026 00:00:00 GMT", w.Header().Get("Sunset"))
+	assert.Equal(t, `<https://example.com/migrating>; rel="deprecation"`, w.Header().Get("Link"))
+
+	// Other versions, and routes outside the version groups, don't
+	for _, path := range []string{"/device-metadata/not-a-uuid", "/healthz"} {
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequestWithContext(context.TODO(), "GET", path, nil)
+		router.ServeHTTP(w, req)
+
+		assert.Empty(t, w.Header().Get("Deprecation"), path)
+		assert.Empty(t, w.Header().Get("Sunset"), path)
+	}
+}
+
+func TestPprofRoutes(t *testing.T) {
+	testCases := []struct {
+		testName       string
+		pprofEnabled   bool
+		admin          bool
+		expectedStatus int
+	}{
+		{"disabled on admin port", false, true, http.StatusNotFound},
+		{"enabled on admin port", true, true, http.StatusOK},
+		{"never on instance-facing port", true, false, http.StatusNotFound},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			hs := httpsrv.Server{Logger: zap.NewNop(), AuthConfig: serverAuthConfig, PprofEnabled: testcase.pprofEnabled}
+
+			s := hs.NewServer()
+			if testcase.admin {
+				s = hs.NewAdminServer()
+			}
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequestWithContext(context.TODO(), "GET", "/debug/pprof/goroutine", nil)
+			s.Handler.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+		})
+	}
+}
+
+func TestAdminConfig(t *testing.T) {
+	hs := httpsrv.Server{
+		Logger:     zap.NewNop(),
+		AuthConfig: serverAuthConfig,
+		RouteTimeouts: v1api.RouteTimeouts{
+			Read:  2 * time.Second,
+			Write: time.Minute,
+		},
+		ServerTimeouts: httpsrv.ServerTimeouts{Write: 5 * time.Minute},
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequestWithContext(context.TODO(), "GET", "/config", nil)
+	hs.NewAdminServer().Handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{
+		"route_timeouts":{"read":"2s","write":"1m0s","admin":"0s"},
+		"server_timeouts":{"read":"10s","write":"5m0s","idle":"10s","read_header":"10s"}
+	}`, w.Body.String())
+
+	// It's never served on the instance-facing port
+	w = httptest.NewRecorder()
+	hs.NewServer().Handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestAdminDBStats(t *testing.T) {
+	db, _ := sqlx.Open("postgres", "localhost:12341")
+	db.SetMaxOpenConns(5)
+
+	hs := httpsrv.Server{Logger: zap.NewNop(), AuthConfig: serverAuthConfig, DB: db}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequestWithContext(context.TODO(), "GET", "/healthz/db", nil)
+	hs.NewAdminServer().Handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{
+		"max_open_connections": 5,
+		"open_connections": 0,
+		"in_use": 0,
+		"idle": 0,
+		"wait_count": 0,
+		"wait_duration": "0s",
+		"max_idle_closed": 0,
+		"max_idle_time_closed": 0,
+		"max_lifetime_closed": 0
+	}`, w.Body.String())
+
+	// It's never served on the instance-facing port
+	w = httptest.NewRecorder()
+	hs.NewServer().Handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestAdminReadOnly(t *testing.T) {
+	db, _ := sqlx.Open("postgres", "localhost:12341")
+
+	hs := httpsrv.Server{Logger: zap.NewNop(), AuthConfig: serverAuthConfig, DB: db, ReadOnly: readonly.New(false)}
+	admin := hs.NewAdminServer().Handler
+	router := hs.NewServer().Handler
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequestWithContext(context.TODO(), "GET", "/read-only", nil)
+	admin.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"enabled":false}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequestWithContext(context.TODO(), "PUT", "/read-only", strings.NewReader(`{}`))
+	admin.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.False(t, hs.ReadOnly.Enabled())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequestWithContext(context.TODO(), "PUT", "/read-only", strings.NewReader(`{"enabled":true}`))
+	admin.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"enabled":true}`, w.Body.String())
+	assert.True(t, hs.ReadOnly.Enabled())
+
+	// Writes are rejected before the database is used
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequestWithContext(context.TODO(), "POST", v1api.GetInternalMetadataPath(), strings.NewReader(`{"id":"6bd001dd-0523-4002-93e9-36a98607638a","metadata":{}}`))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	var body v1api.ErrorResponse
+
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, v1api.ErrorCodeReadOnly, body.Error.Code)
+	assert.Equal(t, "service in read-only mode", body.Error.Message)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequestWithContext(context.TODO(), "DELETE", v1api.GetInternalMetadataByIDPath("6bd001dd-0523-4002-93e9-36a98607638a"), nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	// Reads still reach the database, which is unreachable here
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequestWithContext(context.TODO(), "GET", v1api.GetInternalMetadataByIDPath("6bd001dd-0523-4002-93e9-36a98607638a"), nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	// The mode isn't switched from the instance-facing port
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequestWithContext(context.TODO(), "PUT", "/read-only", strings.NewReader(`{"enabled":false}`))
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.True(t, hs.ReadOnly.Enabled())
+}
+
+func TestClientIPResolution(t *testing.T) {
+	testCases := []struct {
+		testName       string
+		trustedProxies []string
+		remoteAddr     string
+		headers        map[string]string
+		expectedIP     string
+	}{
+		{
+			"no trusted proxies ignores forwarded-for",
+			nil,
+			"192.0.2.10:4000",
+			map[string]string{"X-Forwarded-For": "203.0.113.5"},
+			"192.0.2.10",
+		},
+		{
+			"no trusted proxies ignores real-ip",
+			nil,
+			"192.0.2.10:4000",
+			map[string]string{"X-Real-IP": "203.0.113.5"},
+			"192.0.2.10",
+		},
+		{
+			"untrusted peer ignores forwarded-for",
+			[]string{"198.51.100.0/24"},
+			"192.0.2.10:4000",
+			map[string]string{"X-Forwarded-For": "203.0.113.5"},
+			"192.0.2.10",
+		},
+		{
+			"trusted peer uses forwarded-for",
+			[]string{"192.0.2.10"},
+			"192.0.2.10:4000",
+			map[string]string{"X-Forwarded-For": "203.0.113.5"},
+			"203.0.113.5",
+		},
+		{
+			"trusted hops are skipped right to left",
+			[]string{"192.0.2.10", "198.51.100.0/24"},
+			"192.0.2.10:4000",
+			map[string]string{"X-Forwarded-For": "203.0.113.99, 203.0.113.5, 198.51.100.7"},
+			"203.0.113.5",
+		},
+		{
+			"trusted peer uses real-ip without forwarded-for",
+			[]string{"192.0.2.10"},
+			"192.0.2.10:4000",
+			map[string]string{"X-Real-IP": "203.0.113.5"},
+			"203.0.113.5",
+		},
+	}
+
+	db := dbtools.DatabaseTest(t)
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			hs := httpsrv.Server{
+				Logger:              zap.NewNop(),
+				AuthConfig:          serverAuthConfig,
+				DB:                  db,
+				TrustedProxies:      testcase.trustedProxies,
+				SourceIPDebugHeader: true,
+			}
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequestWithContext(context.TODO(), "GET", v1api.GetMetadataPath(), nil)
+			req.RemoteAddr = testcase.remoteAddr
+
+			for header, value := range testcase.headers {
+				req.Header.Set(header, value)
+			}
+
+			hs.NewServer().Handler.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedIP, w.Header().Get("X-Resolved-Source-IP"))
+		})
+	}
+}
+
+// freeAddress returns a local address nothing is listening on
+func freeAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	return l.Addr().String()
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	hookCalled := make(chan struct{})
+	releaseHook := make(chan struct{})
+
+	// The pre-write hook holds the upsert in flight until it's released
+	hookSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		close(hookCalled)
+		<-releaseHook
+
+		_, _ = w.Write([]byte(`{"allowed": false, "reason": "test"}`))
+	}))
+	defer hookSrv.Close()
+
+	hook, err := prewrite.NewHook(hookSrv.URL, 10*time.Second, hookSrv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := freeAddress(t)
+	baseURL := "http://" + addr
+
+	hs := httpsrv.Server{
+		Logger:             zap.NewNop(),
+		AuthConfig:         serverAuthConfig,
+		Listen:             addr,
+		PreWriteHook:       hook,
+		ShutdownDrainDelay: 500 * time.Millisecond,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	runErr := make(chan error, 1)
+
+	go func() {
+		runErr <- hs.Run(ctx)
+	}()
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: 5 * time.Second}
+
+	get := func(path string) (int, error) {
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, baseURL+path, nil)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+
+		resp.Body.Close()
+
+		return resp.StatusCode, nil
+	}
+
+	assert.Eventually(t, func() bool {
+		code, err := get("/healthz/liveness")
+		return err == nil && code == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+
+	inFlight := make(chan int, 1)
+
+	go func() {
+		body := `{"id":"22bc79fc-3834-40b8-b734-30bef9634939","metadata":"{}","ipAddresses":["10.0.0.1"]}`
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, baseURL+v1api.GetInternalMetadataPath(), strings.NewReader(body))
+
+		resp, err := client.Do(req)
+		if err != nil {
+			inFlight <- 0
+			return
+		}
+
+		resp.Body.Close()
+
+		inFlight <- resp.StatusCode
+	}()
+
+	<-hookCalled
+	cancel()
+
+	// The readiness check fails while draining, before connections are refused
+	assert.Eventually(t, func() bool {
+		code, err := get("/healthz/readiness")
+		return err == nil && code == http.StatusServiceUnavailable
+	}, time.Second, 10*time.Millisecond)
+
+	// Then new requests are refused
+	assert.Eventually(t, func() bool {
+		_, err := get("/healthz/liveness")
+		return err != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	select {
+	case <-runErr:
+		t.Fatal("server stopped with a request in flight")
+	default:
+	}
+
+	// The in-flight request still completes
+	close(releaseHook)
+
+	assert.Equal(t, http.StatusForbidden, <-inFlight)
+	assert.NoError(t, <-runErr)
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	testCases := []struct {
+		version string
+		want    uint16
+		wantErr bool
+	}{
+		{"", tls.VersionTLS12, false},
+		{"1.2", tls.VersionTLS12, false},
+		{"1.3", tls.VersionTLS13, false},
+		{"1.1", 0, true},
+		{"tls1.3", 0, true},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.version, func(t *testing.T) {
+			version, err := httpsrv.ParseTLSVersion(testcase.version)
+			if testcase.wantErr {
+				assert.ErrorIs(t, err, httpsrv.ErrInvalidTLSConfig)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, testcase.want, version)
+		})
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	suites, err := httpsrv.ParseCipherSuites([]string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}, suites)
+
+	suites, err = httpsrv.ParseCipherSuites(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, suites)
+
+	// Insecure and unknown cipher suites are rejected
+	for _, name := range []string{"TLS_RSA_WITH_RC4_128_SHA", "TLS_NOT_A_CIPHER_SUITE"} {
+		_, err = httpsrv.ParseCipherSuites([]string{name})
+		assert.ErrorIs(t, err, httpsrv.ErrInvalidTLSConfig, name)
+	}
+}
+
+// writeTestCert writes a self-signed certificate with the given serial number
+// and its key to the given paths
+func writeTestCert(t *testing.T, certFile, keyFile string, serial int64) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "metadataservice-test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+
+	writeTestCert(t, certFile, keyFile, 1)
+
+	addr := freeAddress(t)
+
+	hs := httpsrv.Server{
+		Logger:     zap.NewNop(),
+		AuthConfig: serverAuthConfig,
+		Listen:     addr,
+		TLS: &httpsrv.TLSConfig{
+			CertFile:   certFile,
+			KeyFile:    keyFile,
+			MinVersion: tls.VersionTLS13,
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	runErr := make(chan error, 1)
+
+	go func() {
+		runErr <- hs.Run(ctx)
+	}()
+
+	defer func() {
+		cancel()
+		assert.NoError(t, <-runErr)
+	}()
+
+	// serial connects with the given client TLS config, and returns the
+	// serial number of the certificate served
+	serial := func(config *tls.Config) (int64, error) {
+		conn, err := tls.Dial("tcp", addr, config)
+		if err != nil {
+			return 0, err
+		}
+		defer conn.Close()
+
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64(), nil
+	}
+
+	insecure := &tls.Config{InsecureSkipVerify: true} //nolint:gosec // the test certificate is self-signed
+
+	assert.Eventually(t, func() bool {
+		got, err := serial(insecure)
+		return err == nil && got == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Connections below the minimum version are refused
+	_, err := serial(&tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12}) //nolint:gosec // the test certificate is self-signed
+	assert.Error(t, err)
+
+	// Plain HTTP isn't served
+	client := &http.Client{Timeout: 5 * time.Second}
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, "http://"+addr+"/healthz/liveness", nil)
+
+	if resp, err := client.Do(req); err == nil {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	}
+
+	// The certificate is reloaded on SIGHUP
+	writeTestCert(t, certFile, keyFile, 2)
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Eventually(t, func() bool {
+		got, err := serial(insecure)
+		return err == nil && got == 2
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestTLSInvalidCertificate(t *testing.T) {
+	dir := t.TempDir()
+
+	hs := httpsrv.Server{
+		Logger:     zap.NewNop(),
+		AuthConfig: serverAuthConfig,
+		Listen:     freeAddress(t),
+		TLS: &httpsrv.TLSConfig{
+			CertFile: filepath.Join(dir, "missing.crt"),
+			KeyFile:  filepath.Join(dir, "missing.key"),
+		},
+	}
+
+	assert.ErrorIs(t, hs.Run(context.Background()), httpsrv.ErrInvalidTLSConfig)
+}
+
+// newTestClientCert returns a client certificate for the common name, signed
+// by the CA when one is given and self-signed otherwise. It's returned as
+// both a tls.Certificate and its parsed form, along with its key.
+func newTestClientCert(t *testing.T, cn string, ca *x509.Certificate, caKey *ecdsa.PrivateKey) (tls.Certificate, *x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  ca == nil,
+	}
+
+	parent, parentKey := template, key
+	if ca != nil {
+		parent, parentKey = ca, caKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert, key
+}
+
+func TestTLSClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	caFile := filepath.Join(dir, "ca.crt")
+
+	writeTestCert(t, certFile, keyFile, 1)
+
+	_, ca, caKey := newTestClientCert(t, "test-ca", nil, nil)
+
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	trusted, _, _ := newTestClientCert(t, "trusted", ca, caKey)
+	untrusted, _, _ := newTestClientCert(t, "untrusted", nil, nil)
+
+	addr := freeAddress(t)
+
+	hs := httpsrv.Server{
+		Logger:     zap.NewNop(),
+		AuthConfig: serverAuthConfig,
+		Listen:     addr,
+		TLS:        &httpsrv.TLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	runErr := make(chan error, 1)
+
+	go func() {
+		runErr <- hs.Run(ctx)
+	}()
+
+	defer func() {
+		cancel()
+		assert.NoError(t, <-runErr)
+	}()
+
+	// get presents the certificate, when one is given, even if it isn't
+	// signed by a CA the server asks for
+	get := func(cert *tls.Certificate) (int, error) {
+		config := &tls.Config{InsecureSkipVerify: true} //nolint:gosec // the test certificate is self-signed
+
+		if cert != nil {
+			config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return cert, nil
+			}
+		}
+
+		client := &http.Client{
+			Timeout:   5 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: config, DisableKeepAlives: true},
+		}
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, "https://"+addr+"/healthz/liveness", nil)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+
+		resp.Body.Close()
+
+		return resp.StatusCode, nil
+	}
+
+	// Client certificates are optional
+	assert.Eventually(t, func() bool {
+		code, err := get(nil)
+		return err == nil && code == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+
+	code, err := get(&trusted)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, code)
+
+	// A certificate which can't be verified against the client CA is refused
+	_, err = get(&untrusted)
+	assert.Error(t, err)
+}
+
+func TestTLSInvalidClientCA(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	caFile := filepath.Join(dir, "ca.crt")
+
+	writeTestCert(t, certFile, keyFile, 1)
+
+	if err := os.WriteFile(caFile, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	hs := httpsrv.Server{
+		Logger:     zap.NewNop(),
+		AuthConfig: serverAuthConfig,
+		Listen:     freeAddress(t),
+		TLS:        &httpsrv.TLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile},
+	}
+
+	assert.ErrorIs(t, hs.Run(context.Background()), httpsrv.ErrInvalidTLSConfig)
+}
@@ -0,0 +1,117 @@
+package httpsrv
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+// ErrInvalidServerTimeout is returned when a server timeout isn't a positive
+// duration, or would cut off routes still within their own timeout
+var ErrInvalidServerTimeout = errors.New("invalid server timeout")
+
+// DefaultServerTimeouts are the server timeouts used when none are configured.
+// The idle and header timeouts match the read timeout, which is what the
+// standard library falls back to when they aren't set.
+var DefaultServerTimeouts = ServerTimeouts{
+	Read:       10 * time.Second,
+	Write:      20 * time.Second,
+	Idle:       10 * time.Second,
+	ReadHeader: 10 * time.Second,
+}
+
+// ServerTimeouts are the timeouts applied by the HTTP servers to every
+// connection, unlike the route timeouts, which limit how long a handler runs.
+// A zero timeout uses the default.
+type ServerTimeouts struct {
+	// Read limits reading a whole request, including its body
+	Read time.Duration
+
+	// Write limits writing a response, from the end of reading the request's
+	// headers
+	Write time.Duration
+
+	// Idle limits how long a keep-alive connection waits for the next request
+	Idle time.Duration
+
+	// ReadHeader limits reading a request's headers
+	ReadHeader time.Duration
+}
+
+// Validate checks every timeout is a positive duration, and that the write
+// timeout doesn't cut off responses from routes which are still within their
+// route timeout
+func (t ServerTimeouts) Validate(routes v1api.RouteTimeouts) error {
+	for _, timeout := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"read", t.Read},
+		{"write", t.Write},
+		{"idle", t.Idle},
+		{"read header", t.ReadHeader},
+	} {
+		if timeout.value <= 0 {
+			return fmt.Errorf("%w: the %s timeout must be positive, got %s", ErrInvalidServerTimeout, timeout.name, timeout.value)
+		}
+	}
+
+	for _, route := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"read", routes.Read},
+		{"write", routes.Write},
+		{"admin", routes.Admin},
+	} {
+		if route.value > t.Write {
+			return fmt.Errorf("%w: the write timeout %s is shorter than the %s route timeout %s", ErrInvalidServerTimeout, t.Write, route.name, route.value)
+		}
+	}
+
+	return nil
+}
+
+// withDefaults returns the timeouts, with the unset ones replaced by their
+// defaults
+func (t ServerTimeouts) withDefaults() ServerTimeouts {
+	if t.Read == 0 {
+		t.Read = DefaultServerTimeouts.Read
+	}
+
+	if t.Write == 0 {
+		t.Write = DefaultServerTimeouts.Write
+	}
+
+	if t.Idle == 0 {
+		t.Idle = DefaultServerTimeouts.Idle
+	}
+
+	if t.ReadHeader == 0 {
+		t.ReadHeader = DefaultServerTimeouts.ReadHeader
+	}
+
+	return t
+}
+
+// apply sets the timeouts on srv
+func (t ServerTimeouts) apply(srv *http.Server) {
+	t = t.withDefaults()
+
+	srv.ReadTimeout = t.Read
+	srv.WriteTimeout = t.Write
+	srv.IdleTimeout = t.Idle
+	srv.ReadHeaderTimeout = t.ReadHeader
+}
+
+// applyAdmin sets the timeouts on the admin server's srv: the same, but never
+// timing out writes, as CPU profiles and traces are written for the duration
+// requested by the caller. It's the only server without a write timeout.
+func (t ServerTimeouts) applyAdmin(srv *http.Server) {
+	t.apply(srv)
+
+	srv.WriteTimeout = 0
+}
@@ -0,0 +1,77 @@
+package httpsrv_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/httpsrv"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func TestServerTimeoutsValidate(t *testing.T) {
+	routes := v1api.RouteTimeouts{Read: 5 * time.Second, Write: 20 * time.Second}
+
+	assert.NoError(t, httpsrv.DefaultServerTimeouts.Validate(routes))
+	assert.NoError(t, httpsrv.ServerTimeouts{Read: time.Second, Write: time.Minute, Idle: time.Second, ReadHeader: time.Second}.Validate(routes))
+
+	for _, timeouts := range []httpsrv.ServerTimeouts{
+		{},
+		{Read: time.Second, Write: time.Minute, Idle: time.Second},
+		{Read: time.Second, Write: -time.Second, Idle: time.Second, ReadHeader: time.Second},
+		{Read: time.Second, Write: 10 * time.Second, Idle: time.Second, ReadHeader: time.Second},
+	} {
+		assert.ErrorIs(t, timeouts.Validate(routes), httpsrv.ErrInvalidServerTimeout, timeouts)
+	}
+
+	// An admin route timeout longer than the write timeout would be cut off
+	assert.ErrorIs(t, httpsrv.DefaultServerTimeouts.Validate(v1api.RouteTimeouts{Admin: 5 * time.Minute}), httpsrv.ErrInvalidServerTimeout)
+}
+
+func TestServerTimeouts(t *testing.T) {
+	hs := httpsrv.Server{
+		Logger:         zap.NewNop(),
+		AuthConfig:     serverAuthConfig,
+		ServerTimeouts: httpsrv.ServerTimeouts{Read: time.Minute, Idle: 2 * time.Minute},
+	}
+
+	srv := hs.NewServer()
+
+	assert.Equal(t, time.Minute, srv.ReadTimeout)
+	assert.Equal(t, httpsrv.DefaultServerTimeouts.Write, srv.WriteTimeout)
+	assert.Equal(t, 2*time.Minute, srv.IdleTimeout)
+	assert.Equal(t, httpsrv.DefaultServerTimeouts.ReadHeader, srv.ReadHeaderTimeout)
+
+	// The admin server never times out writes, as profiles are written for as
+	// long as the caller asks
+	hs.ServerTimeouts.Write = 5 * time.Minute
+	admin := hs.NewAdminServer()
+
+	assert.Equal(t, time.Minute, admin.ReadTimeout)
+	assert.Zero(t, admin.WriteTimeout)
+}
+
+func TestServerTimeoutsDefaults(t *testing.T) {
+	hs := httpsrv.Server{
+		Logger:     zap.NewNop(),
+		AuthConfig: serverAuthConfig,
+	}
+
+	// The instance-facing server always times out connections, so slow
+	// clients can't hold them open
+	srv := hs.NewServer()
+
+	assert.Equal(t, 10*time.Second, srv.ReadTimeout)
+	assert.Equal(t, 20*time.Second, srv.WriteTimeout)
+	assert.Equal(t, 10*time.Second, srv.IdleTimeout)
+	assert.Equal(t, 10*time.Second, srv.ReadHeaderTimeout)
+
+	// While the admin server only leaves writes unlimited
+	admin := hs.NewAdminServer()
+
+	assert.Equal(t, 10*time.Second, admin.ReadTimeout)
+	assert.Zero(t, admin.WriteTimeout)
+	assert.Equal(t, 10*time.Second, admin.ReadHeaderTimeout)
+}
@@ -0,0 +1,214 @@
+package httpsrv
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// ErrInvalidTLSConfig is returned when the TLS config can't be used
+var ErrInvalidTLSConfig = errors.New("invalid tls config")
+
+// tlsVersions are the minimum TLS versions which can be configured
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSConfig configures the server to terminate TLS itself
+type TLSConfig struct {
+	// CertFile and KeyFile are the paths to the PEM-encoded certificate (and
+	// any intermediates) and its private key. They're read again on SIGHUP.
+	CertFile string
+	KeyFile  string
+
+	// MinVersion is the minimum TLS version accepted, TLS 1.2 when unset
+	MinVersion uint16
+
+	// CipherSuites limits the cipher suites offered for TLS 1.2 connections.
+	// The TLS 1.3 cipher suites aren't configurable. Go's defaults are used
+	// when unset.
+	CipherSuites []uint16
+
+	// ClientCAFile is the path to the PEM-encoded CA certificates client
+	// certificates are verified against. When set, clients may present a
+	// certificate, and connections presenting one which can't be verified
+	// are refused. It's only read at startup.
+	ClientCAFile string
+}
+
+// ParseTLSVersion parses a configured minimum TLS version, like "1.2". An
+// empty string results in the default (TLS 1.2).
+func ParseTLSVersion(version string) (uint16, error) {
+	if version == "" {
+		return tls.VersionTLS12, nil
+	}
+
+	v, ok := tlsVersions[version]
+	if !ok {
+		return 0, fmt.Errorf("%w: unsupported minimum tls version %q, must be 1.2 or 1.3", ErrInvalidTLSConfig, version)
+	}
+
+	return v, nil
+}
+
+// ParseCipherSuites parses a list of configured cipher suite names, like
+// "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256". Only the cipher suites Go considers
+// secure are accepted.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	suites := make([]uint16, 0, len(names))
+
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown or insecure cipher suite %q", ErrInvalidTLSConfig, name)
+		}
+
+		suites = append(suites, id)
+	}
+
+	return suites, nil
+}
+
+// certReloader serves the most recently loaded certificate, so it can be
+// replaced for new connections without restarting the server. Connections
+// already established aren't affected.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// newCertReloader loads the certificate, returning an error if it can't be
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// reload loads the certificate again. If it can't be loaded, the previous
+// certificate is kept.
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidTLSConfig, err.Error())
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.mu.Unlock()
+
+	return nil
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.cert, nil
+}
+
+// reloadOnSIGHUP reloads the certificate whenever the process receives a
+// SIGHUP, until the returned function is called.
+func (r *certReloader) reloadOnSIGHUP(logger *zap.Logger) func() {
+	hup := make(chan os.Signal, 1)
+	done := make(chan struct{})
+
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for {
+			select {
+			case <-hup:
+				if err := r.reload(); err != nil {
+					logger.Error("failed to reload tls certificate, keeping the previous one", zap.Error(err))
+					continue
+				}
+
+				logger.Info("reloaded tls certificate", zap.String("cert_file", r.certFile))
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(hup)
+		close(done)
+	}
+}
+
+// loadClientCAs loads the CA certificates client certificates are verified
+// against
+func loadClientCAs(caFile string) (*x509.CertPool, error) {
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidTLSConfig, err.Error())
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("%w: no client ca certificates found in %s", ErrInvalidTLSConfig, caFile)
+	}
+
+	return pool, nil
+}
+
+// config returns the TLS config for the server, serving the certificate
+// loaded by certs. Client certificates are verified against clientCAs, when
+// given.
+func (c *TLSConfig) config(certs *certReloader, clientCAs *x509.CertPool) *tls.Config {
+	minVersion := c.MinVersion
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
+
+	config := &tls.Config{
+		MinVersion:     minVersion,
+		CipherSuites:   c.CipherSuites,
+		GetCertificate: certs.getCertificate,
+	}
+
+	// Client certificates are optional at the TLS layer, so routes which
+	// don't identify instances by them are still served without one
+	if clientCAs != nil {
+		config.ClientCAs = clientCAs
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return config
+}
+
+// clientCertSubject returns the subject of the verified client certificate
+// the request was made with, for logging
+func clientCertSubject(c *gin.Context) string {
+	state := c.Request.TLS
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+
+	return state.VerifiedChains[0][0].Subject.String()
+}
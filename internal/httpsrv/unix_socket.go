@@ -0,0 +1,100 @@
+package httpsrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+// DefaultUnixSocketMode is the permissions the unix socket is created with
+// when none are configured, allowing the owner and group to connect
+const DefaultUnixSocketMode fs.FileMode = 0o660
+
+// ErrInvalidUnixSocket is returned when the unix socket can't be listened on
+// as configured
+var ErrInvalidUnixSocket = errors.New("invalid unix socket")
+
+// UnixSocketConfig configures a unix socket the service is served on as well as
+// its TCP address, for host-local agents
+type UnixSocketConfig struct {
+	// Path is where the socket is created. A socket left there by a previous
+	// run is replaced, but anything else at the path fails startup.
+	Path string
+
+	// Mode is the permissions the socket is created with,
+	// DefaultUnixSocketMode when unset
+	Mode fs.FileMode
+
+	// Identity is how the instance making an instance-facing request over
+	// the socket is identified, as there's no source IP to resolve
+	Identity v1api.UnixSocketIdentity
+}
+
+// ParseUnixSocketMode parses octal permissions, like "0660"
+func ParseUnixSocketMode(mode string) (fs.FileMode, error) {
+	parsed, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || parsed == 0 || parsed > 0o777 {
+		return 0, fmt.Errorf("%w: %q isn't an octal file mode", ErrInvalidUnixSocket, mode)
+	}
+
+	return fs.FileMode(parsed), nil
+}
+
+// listen creates the socket and listens on it
+func (cfg *UnixSocketConfig) listen() (net.Listener, error) {
+	info, err := os.Lstat(cfg.Path)
+
+	switch {
+	case err == nil && info.Mode()&fs.ModeSocket == 0:
+		return nil, fmt.Errorf("%w: %s exists and isn't a socket", ErrInvalidUnixSocket, cfg.Path)
+	case err == nil:
+		if err := os.Remove(cfg.Path); err != nil {
+			return nil, err
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	mode := cfg.Mode
+	if mode == 0 {
+		mode = DefaultUnixSocketMode
+	}
+
+	if err := os.Chmod(cfg.Path, mode); err != nil {
+		listener.Close()
+
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+// remove removes the socket, if it's still there
+func (cfg *UnixSocketConfig) remove() error {
+	if err := os.Remove(cfg.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// connContext marks the connections accepted on the unix socket, so their
+// requests are identified by the socket's configured identity
+func connContext(ctx context.Context, conn net.Conn) context.Context {
+	if _, ok := conn.(*net.UnixConn); ok {
+		return v1api.WithUnixSocket(ctx)
+	}
+
+	return ctx
+}
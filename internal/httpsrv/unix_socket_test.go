@@ -0,0 +1,152 @@
+package httpsrv_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/httpsrv"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+// unixSocketClient returns a client making every request over the unix socket
+func unixSocketClient(path string) *http.Client {
+	return &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+}
+
+func TestParseUnixSocketMode(t *testing.T) {
+	mode, err := httpsrv.ParseUnixSocketMode("0600")
+
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), mode)
+
+	for _, mode := range []string{"", "rw", "0", "0999", "01777"} {
+		_, err := httpsrv.ParseUnixSocketMode(mode)
+		assert.ErrorIs(t, err, httpsrv.ErrInvalidUnixSocket, mode)
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	db, _ := sqlx.Open("postgres", "localhost:12341")
+	path := filepath.Join(t.TempDir(), "metadata.sock")
+
+	// A socket left behind by a previous run is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	hs := httpsrv.Server{
+		Logger:     zap.NewNop(),
+		AuthConfig: serverAuthConfig,
+		DB:         db,
+		UnixSocket: &httpsrv.UnixSocketConfig{
+			Path:     path,
+			Mode:     0o600,
+			Identity: v1api.UnixSocketIdentity{InstanceIDHeader: "X-Instance-ID"},
+		},
+	}
+
+	addr := freeAddress(t)
+	hs.Listen = addr
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	runErr := make(chan error, 1)
+
+	go func() {
+		runErr <- hs.Run(ctx)
+	}()
+
+	client := unixSocketClient(path)
+
+	get := func(path string, header http.Header) int {
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, "http://metadata"+path, nil)
+
+		for name, values := range header {
+			req.Header[name] = values
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0
+		}
+
+		resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	assert.Eventually(t, func() bool {
+		return get("/healthz/liveness", nil) == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+
+	info, err := os.Stat(path)
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	}
+
+	// Without a selected instance there's no instance to serve
+	assert.Equal(t, http.StatusUnauthorized, get(v1api.GetMetadataPath(), nil))
+	assert.Equal(t, http.StatusBadRequest, get(v1api.GetMetadataPath(), http.Header{"X-Instance-ID": {"not-an-id"}}))
+
+	// A selected instance is looked up in the database, which is unreachable
+	assert.Equal(t, http.StatusInternalServerError, get(v1api.GetMetadataPath(), http.Header{"X-Instance-ID": {"6bd001dd-0523-4002-93e9-36a98607638a"}}))
+
+	// The TCP listener is served too, where instances are identified by
+	// source IP and the header is ignored
+	code, err := getStatus("http://" + addr + "/healthz/liveness")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, code)
+
+	cancel()
+
+	assert.NoError(t, <-runErr)
+
+	// The socket is removed on shutdown
+	_, err = os.Stat(path)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestUnixSocketPathInUse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metadata.sock")
+
+	if err := os.WriteFile(path, []byte("not a socket"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	hs := httpsrv.Server{
+		Logger:     zap.NewNop(),
+		AuthConfig: serverAuthConfig,
+		Listen:     freeAddress(t),
+		UnixSocket: &httpsrv.UnixSocketConfig{Path: path},
+	}
+
+	assert.ErrorIs(t, hs.Run(context.Background()), httpsrv.ErrInvalidUnixSocket)
+
+	// The file isn't touched
+	contents, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "not a socket", string(contents))
+}
@@ -0,0 +1,4 @@
+// Package idempotency stores the responses to upserts made with an
+// Idempotency-Key header for a limited time, so a client retrying the same
+// request gets the same response without the upsert being made again.
+package idempotency // import go.hollow.sh/metadataservice/internal/idempotency
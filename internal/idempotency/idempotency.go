@@ -0,0 +1,238 @@
+package idempotency
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/periodic"
+	"go.hollow.sh/metadataservice/internal/readonly"
+)
+
+const (
+	// DefaultTTL is how long a response is kept when no TTL is given
+	DefaultTTL = 24 * time.Hour
+
+	// DefaultPruneInterval is how often expired responses are removed when no
+	// interval is given
+	DefaultPruneInterval = 10 * time.Minute
+
+	// MaxKeyLength is the longest Idempotency-Key accepted
+	MaxKeyLength = 255
+
+	// ClaimTTL is how long a key stays claimed by a request whose upsert is
+	// still being made. Should the service stop before the response is
+	// stored, the key can be used again once it expires.
+	ClaimTTL = 5 * time.Minute
+
+	pruneTimeout = time.Minute
+
+	getQuery = `SELECT subject, idempotency_key, request_hash, response_status, response_content_type, response_body, created_at, expires_at
+FROM idempotency_keys WHERE subject = $1 AND idempotency_key = $2 AND expires_at > $3`
+
+	// claimQuery stores a pending response for a key which has none, or
+	// replaces an expired one which hasn't been pruned yet. Nothing is
+	// affected when an unexpired response, pending or not, is stored.
+	claimQuery = `INSERT INTO idempotency_keys (subject, idempotency_key, request_hash, response_status, response_content_type, response_body, created_at, expires_at)
+VALUES ($1, $2, $3, 0, '', '', $4, $5)
+ON CONFLICT (subject, idempotency_key) DO UPDATE SET
+request_hash = excluded.request_hash, response_status = excluded.response_status, response_content_type = excluded.response_content_type,
+response_body = excluded.response_body, created_at = excluded.created_at, expires_at = excluded.expires_at
+WHERE idempotency_keys.expires_at <= excluded.created_at`
+
+	// completeQuery and releaseQuery only touch the claim made by the same
+	// request, and not one made after it expired
+	completeQuery = `UPDATE idempotency_keys SET response_status = $1, response_content_type = $2, response_body = $3, expires_at = $4
+WHERE subject = $5 AND idempotency_key = $6 AND created_at = $7 AND response_status = 0`
+
+	releaseQuery = `DELETE FROM idempotency_keys WHERE subject = $1 AND idempotency_key = $2 AND created_at = $3 AND response_status = 0`
+
+	pruneQuery = `DELETE FROM idempotency_keys WHERE expires_at <= $1`
+)
+
+// Response is the response stored for a caller's Idempotency-Key
+type Response struct {
+	Subject     string    `db:"subject"`
+	Key         string    `db:"idempotency_key"`
+	RequestHash string    `db:"request_hash"`
+	Status      int       `db:"response_status"`
+	ContentType string    `db:"response_content_type"`
+	Body        []byte    `db:"response_body"`
+	CreatedAt   time.Time `db:"created_at"`
+	ExpiresAt   time.Time `db:"expires_at"`
+}
+
+// HashRequest returns the hash identifying a request, from its method, route,
+// query string and body. A key reused for a request with a different hash is
+// a conflict.
+func HashRequest(method, route, query string, body []byte) string {
+	h := sha256.New()
+
+	for _, part := range []string{method, route, query} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+
+	h.Write(body)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Pending returns whether the upsert the response is for is still being made
+func (r *Response) Pending() bool {
+	return r.Status == 0
+}
+
+// Get returns the unexpired response stored for the subject's key, or nil when
+// there isn't one.
+func Get(ctx context.Context, db *sqlx.DB, subject, key string) (*Response, error) {
+	response := &Response{}
+
+	err := db.GetContext(ctx, response, getQuery, subject, key, time.Now().UTC())
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+// Claim atomically stores a pending response for the response's subject, key
+// and request hash, for ClaimTTL, so only one request with the key makes the
+// upsert. It returns false, without storing anything, when an unexpired
+// response, pending or not, is already stored for the key. The response's
+// CreatedAt is set to identify the claim to Complete and Release.
+func Claim(ctx context.Context, db *sqlx.DB, response *Response) (bool, error) {
+	// Truncated to the database's precision, so the claim can be matched by
+	// its creation time
+	now := time.Now().UTC().Truncate(time.Microsecond)
+
+	result, err := db.ExecContext(ctx, claimQuery, response.Subject, response.Key, response.RequestHash, now, now.Add(ClaimTTL))
+	if err != nil {
+		return false, err
+	}
+
+	claimed, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	if claimed == 0 {
+		return false, nil
+	}
+
+	response.CreatedAt = now
+
+	return true, nil
+}
+
+// Complete stores the response to the upsert for the key claimed by Claim, for
+// ttl (or DefaultTTL, if ttl is 0). Nothing is stored when the claim has
+// expired in the meantime.
+func Complete(ctx context.Context, db *sqlx.DB, response *Response, ttl time.Duration) error {
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+
+	expiresAt := time.Now().UTC().Add(ttl)
+
+	_, err := db.ExecContext(ctx, completeQuery, response.Status, response.ContentType, response.Body, expiresAt, response.Subject, response.Key, response.CreatedAt)
+
+	return err
+}
+
+// Release removes the pending response stored for the key claimed by Claim,
+// so the request can be retried with the same key.
+func Release(ctx context.Context, db *sqlx.DB, response *Response) error {
+	_, err := db.ExecContext(ctx, releaseQuery, response.Subject, response.Key, response.CreatedAt)
+
+	return err
+}
+
+// Prune removes the expired responses, and returns the number removed.
+func Prune(ctx context.Context, db *sqlx.DB) (int64, error) {
+	result, err := db.ExecContext(ctx, pruneQuery, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// Pruner periodically removes the expired responses in the background. A nil
+// *Pruner is valid, and removes nothing.
+type Pruner struct {
+	db       *sqlx.DB
+	logger   *zap.Logger
+	readOnly *readonly.Mode
+
+	runner *periodic.Runner
+}
+
+// NewPruner returns a Pruner which removes expired responses every interval
+// (or DefaultPruneInterval, if interval is 0). Runs are skipped while readOnly
+// is enabled, which can be nil.
+func NewPruner(db *sqlx.DB, logger *zap.Logger, readOnly *readonly.Mode, interval time.Duration) *Pruner {
+	if interval <= 0 {
+		interval = DefaultPruneInterval
+	}
+
+	p := &Pruner{
+		db:       db,
+		logger:   logger,
+		readOnly: readOnly,
+	}
+
+	p.runner = periodic.New(interval, p.pruneWithTimeout)
+
+	return p
+}
+
+// Start begins periodically pruning expired responses in the background,
+// until Stop is called or the context is cancelled.
+func (p *Pruner) Start(ctx context.Context) {
+	if p == nil {
+		return
+	}
+
+	p.runner.Start(ctx)
+}
+
+// Stop stops the background pruning started by Start
+func (p *Pruner) Stop() {
+	if p == nil {
+		return
+	}
+
+	p.runner.Stop()
+}
+
+func (p *Pruner) pruneWithTimeout(ctx context.Context) {
+	// Nothing is written while the database is being worked on
+	if p.readOnly.Enabled() {
+		p.logger.Debug("skipping idempotency key pruning in read-only mode")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, pruneTimeout)
+	defer cancel()
+
+	removed, err := Prune(ctx, p.db)
+	if err != nil {
+		p.logger.Warn("failed to prune idempotency keys", zap.Error(err))
+		return
+	}
+
+	if removed > 0 {
+		p.logger.Info("pruned idempotency keys", zap.Int64("removed", removed))
+	}
+}
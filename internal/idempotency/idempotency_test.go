@@ -0,0 +1,192 @@
+package idempotency_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	"go.hollow.sh/metadataservice/internal/idempotency"
+	"go.hollow.sh/metadataservice/internal/readonly"
+)
+
+func TestNilPruner(t *testing.T) {
+	var pruner *idempotency.Pruner
+
+	// None of these should panic
+	pruner.Start(context.TODO())
+	pruner.Stop()
+}
+
+func TestHashRequest(t *testing.T) {
+	hash := idempotency.HashRequest("POST", "/api/v1/device-metadata", "", []byte(`{"id":"a"}`))
+
+	assert.Equal(t, hash, idempotency.HashRequest("POST", "/api/v1/device-metadata", "", []byte(`{"id":"a"}`)))
+	assert.NotEqual(t, hash, idempotency.HashRequest("POST", "/api/v1/device-metadata", "", []byte(`{"id":"b"}`)))
+	assert.NotEqual(t, hash, idempotency.HashRequest("POST", "/api/v1/device-userdata", "", []byte(`{"id":"a"}`)))
+	assert.NotEqual(t, hash, idempotency.HashRequest("POST", "/api/v1/device-metadata", "dry_run=true", []byte(`{"id":"a"}`)))
+}
+
+func TestClaimAndComplete(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	stored, err := idempotency.Get(context.TODO(), testDB, "subject-1", "missing")
+	assert.NoError(t, err)
+	assert.Nil(t, stored)
+
+	response := &idempotency.Response{Subject: "subject-1", Key: "key-1", RequestHash: "hash-1"}
+
+	claimed, err := idempotency.Claim(context.TODO(), testDB, response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, claimed)
+
+	// The key is pending until the response is stored, and can't be claimed
+	// again in the meantime
+	stored, err = idempotency.Get(context.TODO(), testDB, "subject-1", "key-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, stored.Pending())
+
+	claimed, err = idempotency.Claim(context.TODO(), testDB, &idempotency.Response{Subject: "subject-1", Key: "key-1", RequestHash: "hash-2"})
+	assert.NoError(t, err)
+	assert.False(t, claimed)
+
+	// Other subjects have keys of their own
+	claimed, err = idempotency.Claim(context.TODO(), testDB, &idempotency.Response{Subject: "subject-2", Key: "key-1", RequestHash: "hash-2"})
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+
+	response.Status = 200
+	response.ContentType = "application/json; charset=utf-8"
+	response.Body = []byte(`{"id":"a"}`)
+
+	if err := idempotency.Complete(context.TODO(), testDB, response, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err = idempotency.Get(context.TODO(), testDB, "subject-1", "key-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.False(t, stored.Pending())
+	assert.Equal(t, "hash-1", stored.RequestHash)
+	assert.Equal(t, 200, stored.Status)
+	assert.Equal(t, "application/json; charset=utf-8", stored.ContentType)
+	assert.Equal(t, []byte(`{"id":"a"}`), stored.Body)
+
+	stored, err = idempotency.Get(context.TODO(), testDB, "subject-2", "key-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "hash-2", stored.RequestHash)
+	assert.True(t, stored.Pending())
+}
+
+func TestRelease(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	response := &idempotency.Response{Subject: "subject-1", Key: "key-1", RequestHash: "hash-1"}
+
+	if _, err := idempotency.Claim(context.TODO(), testDB, response); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := idempotency.Release(context.TODO(), testDB, response); err != nil {
+		t.Fatal(err)
+	}
+
+	// A released key can be claimed again
+	claimed, err := idempotency.Claim(context.TODO(), testDB, &idempotency.Response{Subject: "subject-1", Key: "key-1", RequestHash: "hash-1"})
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+}
+
+func TestExpiry(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	_, err := testDB.ExecContext(context.TODO(), `INSERT INTO idempotency_keys (subject, idempotency_key, request_hash, response_status, response_body, created_at, expires_at)
+VALUES ('subject-1', 'expired', 'hash-1', 200, '', now() - INTERVAL '2 hours', now() - INTERVAL '1 hour')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Expired responses aren't returned
+	stored, err := idempotency.Get(context.TODO(), testDB, "subject-1", "expired")
+	assert.NoError(t, err)
+	assert.Nil(t, stored)
+
+	// And are replaced by the next claim on the key
+	response := &idempotency.Response{Subject: "subject-1", Key: "expired", RequestHash: "hash-2"}
+
+	claimed, err := idempotency.Claim(context.TODO(), testDB, response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, claimed)
+
+	response.Status = 200
+	response.Body = []byte(`{}`)
+
+	if err := idempotency.Complete(context.TODO(), testDB, response, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err = idempotency.Get(context.TODO(), testDB, "subject-1", "expired")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "hash-2", stored.RequestHash)
+
+	_, err = testDB.ExecContext(context.TODO(), `UPDATE idempotency_keys SET expires_at = now() - INTERVAL '1 minute' WHERE idempotency_key = 'expired'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := idempotency.Prune(context.TODO(), testDB)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), removed)
+}
+
+func TestPrunerReadOnly(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	_, err := testDB.ExecContext(context.TODO(), `INSERT INTO idempotency_keys (subject, idempotency_key, request_hash, response_status, response_body, created_at, expires_at)
+VALUES ('subject-1', 'expired', 'hash-1', 200, '', now() - INTERVAL '2 hours', now() - INTERVAL '1 hour')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storedKeys := func() int {
+		var count int
+
+		if err := testDB.GetContext(context.TODO(), &count, `SELECT count(*) FROM idempotency_keys`); err != nil {
+			t.Fatal(err)
+		}
+
+		return count
+	}
+
+	mode := readonly.New(true)
+	pruner := idempotency.NewPruner(testDB, zap.NewNop(), mode, time.Hour)
+
+	// Nothing is pruned while the service is read-only
+	idempotency.PruneWithTimeout(pruner, context.TODO())
+	assert.Equal(t, 1, storedKeys())
+
+	mode.Set(false)
+
+	idempotency.PruneWithTimeout(pruner, context.TODO())
+	assert.Equal(t, 0, storedKeys())
+}
@@ -0,0 +1,3 @@
+// Package ignition recognizes and validates the Ignition configs CoreOS and
+// Flatcar instances fetch at boot, which are stored as their userdata.
+package ignition // import go.hollow.sh/metadataservice/internal/ignition
@@ -0,0 +1,73 @@
+package ignition
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ContentType is the content type Ignition configs are served with
+const ContentType = "application/json"
+
+// SupportedVersions are the Ignition config spec versions a config can be
+// validated against
+var SupportedVersions = []string{
+	"2.0.0", "2.1.0", "2.2.0", "2.3.0",
+	"3.0.0", "3.1.0", "3.2.0", "3.3.0", "3.4.0", "3.5.0",
+}
+
+// ErrInvalidConfig is returned when an Ignition config isn't valid, or uses a
+// spec version which isn't supported
+var ErrInvalidConfig = errors.New("invalid ignition config")
+
+// config is the part of an Ignition config which identifies it as one
+type config struct {
+	Ignition *struct {
+		Version *string `json:"version"`
+	} `json:"ignition"`
+}
+
+// IsConfig reports whether the userdata is an Ignition config: a JSON object
+// with an "ignition" section. The section's contents aren't checked, see
+// Validate.
+func IsConfig(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || data[0] != '{' {
+		return false
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return false
+	}
+
+	_, ok := fields["ignition"]
+
+	return ok
+}
+
+// Validate checks the Ignition config declares a supported spec version. The
+// rest of the config is left for Ignition itself to check.
+func Validate(data []byte) error {
+	var cfg config
+
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidConfig, err.Error())
+	}
+
+	switch {
+	case cfg.Ignition == nil:
+		return fmt.Errorf("%w: no ignition section", ErrInvalidConfig)
+	case cfg.Ignition.Version == nil || *cfg.Ignition.Version == "":
+		return fmt.Errorf("%w: no ignition.version", ErrInvalidConfig)
+	}
+
+	for _, version := range SupportedVersions {
+		if *cfg.Ignition.Version == version {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: spec version %q isn't supported", ErrInvalidConfig, *cfg.Ignition.Version)
+}
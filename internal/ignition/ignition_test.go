@@ -0,0 +1,50 @@
+package ignition_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/ignition"
+)
+
+func TestIsConfig(t *testing.T) {
+	testCases := []struct {
+		testName string
+		data     string
+		expected bool
+	}{
+		{"ignition v3", `{"ignition":{"version":"3.4.0"},"storage":{}}`, true},
+		{"leading whitespace", "\n  {\"ignition\":{\"version\":\"2.3.0\"}}", true},
+		{"no version", `{"ignition":{}}`, true},
+		{"other json", `{"hostname":"instance-a"}`, false},
+		{"json list", `[{"ignition":{}}]`, false},
+		{"cloud-config", "#cloud-config\nhostname: instance-a\n", false},
+		{"invalid json", `{"ignition":`, false},
+		{"empty", "", false},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			assert.Equal(t, testcase.expected, ignition.IsConfig([]byte(testcase.data)))
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, version := range ignition.SupportedVersions {
+		assert.NoError(t, ignition.Validate([]byte(`{"ignition":{"version":"`+version+`"}}`)), version)
+	}
+
+	for _, data := range []string{
+		`{"ignition":{"version":"3.9.0"}}`,
+		`{"ignition":{"version":"1.0.0"}}`,
+		`{"ignition":{"version":""}}`,
+		`{"ignition":{}}`,
+		`{"ignition":{"version":3}}`,
+		`{"storage":{}}`,
+		`nope`,
+	} {
+		assert.ErrorIs(t, ignition.Validate([]byte(data)), ignition.ErrInvalidConfig, data)
+	}
+}
@@ -0,0 +1,3 @@
+// Package instancetags stores the key/value tags attached to each instance,
+// like its environment, team or role, separately from its metadata.
+package instancetags // import go.hollow.sh/metadataservice/internal/instancetags
@@ -0,0 +1,151 @@
+package instancetags
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/volatiletech/sqlboiler/v4/boil"
+)
+
+const (
+	// MaxTags is the most tags an instance can have
+	MaxTags = 50
+
+	// MaxKeyLength is the longest a tag key can be, in bytes
+	MaxKeyLength = 128
+
+	// MaxValueLength is the longest a tag value can be, in bytes
+	MaxValueLength = 256
+
+	deleteQuery = `DELETE FROM instance_tags WHERE instance_id = $1`
+
+	insertQuery = `INSERT INTO instance_tags (instance_id, tag_key, tag_value, updated_at) VALUES ($1, $2, $3, $4)`
+
+	listQuery = `SELECT tag_key, tag_value, updated_at FROM instance_tags WHERE instance_id = $1`
+)
+
+// ErrInvalidTag is returned when a tag's key or value can't be stored
+var ErrInvalidTag = errors.New("invalid tag")
+
+// keyPattern is what a tag key can be made of. Keys can't contain ":", as
+// tags are looked up in "key:value" form.
+var keyPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]*$`)
+
+// Validate checks there are at most MaxTags tags, and that each key and value
+// is within its length limit. Keys must start with a letter or digit, followed
+// by letters, digits, ".", "_", "/" or "-". Values can be empty, but must be
+// valid UTF-8 without control characters.
+func Validate(tags map[string]string) error {
+	if len(tags) > MaxTags {
+		return fmt.Errorf("%w: at most %d tags can be given", ErrInvalidTag, MaxTags)
+	}
+
+	// Checked in order, so the same tags always get the same error
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if len(key) > MaxKeyLength {
+			return fmt.Errorf("%w: key %q is longer than %d bytes", ErrInvalidTag, key, MaxKeyLength)
+		}
+
+		if !keyPattern.MatchString(key) {
+			return fmt.Errorf("%w: key %q must start with a letter or digit, followed by letters, digits, '.', '_', '/' or '-'", ErrInvalidTag, key)
+		}
+
+		value := tags[key]
+
+		if len(value) > MaxValueLength {
+			return fmt.Errorf("%w: the value of %q is longer than %d bytes", ErrInvalidTag, key, MaxValueLength)
+		}
+
+		if !utf8.ValidString(value) || strings.IndexFunc(value, unicode.IsControl) >= 0 {
+			return fmt.Errorf("%w: the value of %q must be UTF-8 without control characters", ErrInvalidTag, key)
+		}
+	}
+
+	return nil
+}
+
+// Replace stores the tags for the instance, replacing any tags already stored
+// for it. An empty map removes the instance's tags. It's meant to be called in
+// the same transaction as the metadata upsert when the tags are given with
+// it. The tags should already have been validated.
+func Replace(ctx context.Context, exec boil.ContextExecutor, instanceID string, tags map[string]string) error {
+	if _, err := exec.ExecContext(ctx, deleteQuery, instanceID); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+
+	for key, value := range tags {
+		if _, err := exec.ExecContext(ctx, insertQuery, instanceID, key, value, now); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete removes the tags stored for the instance, and returns the number of
+// tags removed. It's meant to be called in the same transaction as the rest of
+// the instance's records are deleted.
+func Delete(ctx context.Context, exec boil.ContextExecutor, instanceID string) (int64, error) {
+	result, err := exec.ExecContext(ctx, deleteQuery, instanceID)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// List returns the tags stored for the instance, and when they were stored.
+// An instance without tags has an empty map, and the zero time.
+func List(ctx context.Context, db sqlx.QueryerContext, instanceID string) (map[string]string, time.Time, error) {
+	var rows []struct {
+		Key       string    `db:"tag_key"`
+		Value     string    `db:"tag_value"`
+		UpdatedAt time.Time `db:"updated_at"`
+	}
+
+	if err := sqlx.SelectContext(ctx, db, &rows, listQuery, instanceID); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	tags := make(map[string]string, len(rows))
+
+	var updated time.Time
+
+	for _, row := range rows {
+		tags[row.Key] = row.Value
+
+		if row.UpdatedAt.After(updated) {
+			updated = row.UpdatedAt
+		}
+	}
+
+	return tags, updated, nil
+}
+
+// ParseFilter splits a tag filter in "key:value" form. It reports false when
+// the filter isn't in that form.
+func ParseFilter(filter string) (string, string, bool) {
+	key, value, ok := strings.Cut(filter, ":")
+	if !ok || !keyPattern.MatchString(key) {
+		return "", "", false
+	}
+
+	return key, value, true
+}
@@ -0,0 +1,103 @@
+package instancetags_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	"go.hollow.sh/metadataservice/internal/instancetags"
+)
+
+func TestValidate(t *testing.T) {
+	tooMany := map[string]string{}
+	for i := 0; i <= instancetags.MaxTags; i++ {
+		tooMany["tag-"+strings.Repeat("x", i)] = "value"
+	}
+
+	testCases := []struct {
+		testName string
+		tags     map[string]string
+		valid    bool
+	}{
+		{"no tags", nil, true},
+		{"valid tags", map[string]string{"environment": "production", "team": "metal", "k8s.io/role": "worker-1"}, true},
+		{"empty value", map[string]string{"canary": ""}, true},
+		{"longest key and value", map[string]string{strings.Repeat("k", instancetags.MaxKeyLength): strings.Repeat("v", instancetags.MaxValueLength)}, true},
+		{"empty key", map[string]string{"": "value"}, false},
+		{"key with a colon", map[string]string{"env:prod": "value"}, false},
+		{"key with a space", map[string]string{"my env": "value"}, false},
+		{"key starting with a dash", map[string]string{"-env": "value"}, false},
+		{"key too long", map[string]string{strings.Repeat("k", instancetags.MaxKeyLength+1): "value"}, false},
+		{"value too long", map[string]string{"environment": strings.Repeat("v", instancetags.MaxValueLength+1)}, false},
+		{"value with a newline", map[string]string{"environment": "prod\nuction"}, false},
+		{"value which isn't UTF-8", map[string]string{"environment": "\xff"}, false},
+		{"too many tags", tooMany, false},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			err := instancetags.Validate(testcase.tags)
+
+			if testcase.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, instancetags.ErrInvalidTag)
+			}
+		})
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	key, value, ok := instancetags.ParseFilter("environment:production")
+	assert.True(t, ok)
+	assert.Equal(t, "environment", key)
+	assert.Equal(t, "production", value)
+
+	// Only the first colon separates the key from the value
+	key, value, ok = instancetags.ParseFilter("url:https://example.com")
+	assert.True(t, ok)
+	assert.Equal(t, "url", key)
+	assert.Equal(t, "https://example.com", value)
+
+	_, _, ok = instancetags.ParseFilter("worker")
+	assert.False(t, ok)
+
+	_, _, ok = instancetags.ParseFilter(":production")
+	assert.False(t, ok)
+}
+
+func TestReplaceAndList(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+	instanceID := dbtools.FixtureInstanceA.InstanceID
+
+	tags, updated, err := instancetags.List(context.TODO(), testDB, instanceID)
+	assert.NoError(t, err)
+	assert.Empty(t, tags)
+	assert.True(t, updated.IsZero())
+
+	err = instancetags.Replace(context.TODO(), testDB, instanceID, map[string]string{"environment": "production", "team": "metal"})
+	assert.NoError(t, err)
+
+	tags, updated, err = instancetags.List(context.TODO(), testDB, instanceID)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"environment": "production", "team": "metal"}, tags)
+	assert.False(t, updated.IsZero())
+
+	// Tags left out of a replacement are removed
+	err = instancetags.Replace(context.TODO(), testDB, instanceID, map[string]string{"environment": "staging"})
+	assert.NoError(t, err)
+
+	tags, _, err = instancetags.List(context.TODO(), testDB, instanceID)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"environment": "staging"}, tags)
+
+	err = instancetags.Replace(context.TODO(), testDB, instanceID, nil)
+	assert.NoError(t, err)
+
+	tags, _, err = instancetags.List(context.TODO(), testDB, instanceID)
+	assert.NoError(t, err)
+	assert.Empty(t, tags)
+}
@@ -0,0 +1,4 @@
+// Package inventory periodically counts the instances and IP associations
+// stored by the service, publishing the counts as Prometheus gauges for
+// capacity planning.
+package inventory // import go.hollow.sh/metadataservice/internal/inventory
@@ -0,0 +1,125 @@
+package inventory
+
+import (
+	"context"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/periodic"
+)
+
+const (
+	// DefaultInterval is how often the counts are refreshed when no interval
+	// is given
+	DefaultInterval = time.Minute
+
+	countTimeout = 10 * time.Second
+
+	countMetadataQuery    = `SELECT count(*) FROM instance_metadata`
+	countUserdataQuery    = `SELECT count(*) FROM instance_userdata`
+	countIPAddressesQuery = `SELECT count(*) FROM instance_ip_addresses`
+)
+
+var (
+	// MetricInstances is the number of instances with metadata stored
+	MetricInstances = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "metadata_instances",
+		Help: "Number of instances with metadata stored.",
+	})
+
+	// MetricUserdataInstances is the number of instances with userdata stored
+	MetricUserdataInstances = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "metadata_userdata_instances",
+		Help: "Number of instances with userdata stored.",
+	})
+
+	// MetricIPAssociations is the number of IP addresses associated to
+	// instances
+	MetricIPAssociations = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "metadata_ip_associations",
+		Help: "Number of IP addresses associated to instances.",
+	})
+)
+
+// Collector periodically refreshes the inventory gauges in the background. A
+// nil *Collector is valid, and collects nothing.
+type Collector struct {
+	db     *sqlx.DB
+	logger *zap.Logger
+
+	runner *periodic.Runner
+}
+
+// NewCollector returns a Collector which refreshes the inventory gauges every
+// interval (or DefaultInterval, if interval is 0).
+func NewCollector(db *sqlx.DB, logger *zap.Logger, interval time.Duration) *Collector {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+
+	c := &Collector{
+		db:     db,
+		logger: logger,
+	}
+
+	c.runner = periodic.NewImmediate(interval, c.collectWithTimeout)
+
+	return c
+}
+
+// Start refreshes the gauges, then keeps refreshing them in the background
+// until Stop is called or the context is cancelled.
+func (c *Collector) Start(ctx context.Context) {
+	if c == nil {
+		return
+	}
+
+	c.runner.Start(ctx)
+}
+
+// Stop stops the background collection started by Start
+func (c *Collector) Stop() {
+	if c == nil {
+		return
+	}
+
+	c.runner.Stop()
+}
+
+// Collect counts the stored instances and IP associations, and updates the
+// gauges. A gauge is left at its previous value if its count fails.
+func (c *Collector) Collect(ctx context.Context) error {
+	gauges := []struct {
+		query string
+		gauge prometheus.Gauge
+	}{
+		{countMetadataQuery, MetricInstances},
+		{countUserdataQuery, MetricUserdataInstances},
+		{countIPAddressesQuery, MetricIPAssociations},
+	}
+
+	for _, g := range gauges {
+		var count int64
+
+		if err := c.db.GetContext(ctx, &count, g.query); err != nil {
+			return err
+		}
+
+		g.gauge.Set(float64(count))
+	}
+
+	return nil
+}
+
+func (c *Collector) collectWithTimeout(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, countTimeout)
+	defer cancel()
+
+	if err := c.Collect(ctx); err != nil {
+		c.logger.Warn("failed to count instances for the inventory metrics", zap.Error(err))
+	}
+}
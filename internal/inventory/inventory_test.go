@@ -0,0 +1,49 @@
+package inventory_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	"go.hollow.sh/metadataservice/internal/inventory"
+	"go.hollow.sh/metadataservice/internal/models"
+)
+
+func TestNilCollector(t *testing.T) {
+	var collector *inventory.Collector
+
+	// None of these should panic
+	collector.Start(context.TODO())
+	collector.Stop()
+}
+
+func TestCollect(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	metadata, err := models.InstanceMetadata().Count(context.TODO(), testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userdata, err := models.InstanceUserdata().Count(context.TODO(), testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ipAddresses, err := models.InstanceIPAddresses().Count(context.TODO(), testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	collector := inventory.NewCollector(testDB, zap.NewNop(), time.Hour)
+
+	assert.NoError(t, collector.Collect(context.TODO()))
+	assert.Equal(t, float64(metadata), testutil.ToFloat64(inventory.MetricInstances))
+	assert.Equal(t, float64(userdata), testutil.ToFloat64(inventory.MetricUserdataInstances))
+	assert.Equal(t, float64(ipAddresses), testutil.ToFloat64(inventory.MetricIPAssociations))
+}
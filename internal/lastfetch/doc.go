@@ -0,0 +1,3 @@
+// Package lastfetch provides a recorder used to keep track of the source IP
+// and time of the most recent successful metadata fetch for each instance.
+package lastfetch // import go.hollow.sh/metadataservice/internal/lastfetch
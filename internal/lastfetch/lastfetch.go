@@ -0,0 +1,204 @@
+package lastfetch
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/periodic"
+)
+
+const (
+	// DefaultFlushInterval is how often recorded fetches are written to the
+	// database when no interval is given
+	DefaultFlushInterval = 10 * time.Second
+
+	flushTimeout = 10 * time.Second
+
+	upsertQuery = `INSERT INTO instance_last_fetches (instance_id, source_ip, fetched_at) VALUES ($1, $2, $3)
+ON CONFLICT (instance_id) DO UPDATE SET source_ip = excluded.source_ip, fetched_at = excluded.fetched_at
+WHERE instance_last_fetches.fetched_at < excluded.fetched_at`
+
+	selectQuery = `SELECT instance_id, source_ip, fetched_at FROM instance_last_fetches WHERE instance_id = $1`
+)
+
+// Fetch describes the most recent successful metadata fetch for an instance
+type Fetch struct {
+	InstanceID string    `db:"instance_id" json:"-"`
+	SourceIP   string    `db:"source_ip" json:"source_ip"`
+	FetchedAt  time.Time `db:"fetched_at" json:"fetched_at"`
+}
+
+// Recorder keeps the most recent fetch for each instance in memory, and
+// periodically writes them to the database in a batch, so that recording a
+// fetch never adds a database write to the read path. A nil *Recorder is
+// valid, and records nothing.
+type Recorder struct {
+	db     *sqlx.DB
+	logger *zap.Logger
+
+	mu      sync.Mutex
+	pending map[string]Fetch
+
+	runner *periodic.Runner
+}
+
+// NewRecorder returns a Recorder which flushes recorded fetches to the
+// database every interval (or DefaultFlushInterval, if interval is 0).
+func NewRecorder(db *sqlx.DB, logger *zap.Logger, interval time.Duration) *Recorder {
+	if interval <= 0 {
+		interval = DefaultFlushInterval
+	}
+
+	r := &Recorder{
+		db:      db,
+		logger:  logger,
+		pending: make(map[string]Fetch),
+	}
+
+	r.runner = periodic.New(interval, r.flushWithTimeout)
+
+	return r
+}
+
+// Record notes a successful metadata fetch for the instance from the given
+// source IP. Only the most recent fetch per instance is kept until the next
+// flush.
+func (r *Recorder) Record(instanceID, sourceIP string) {
+	if r == nil || instanceID == "" || sourceIP == "" {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pending[instanceID] = Fetch{
+		InstanceID: instanceID,
+		SourceIP:   sourceIP,
+		FetchedAt:  time.Now().UTC(),
+	}
+}
+
+// Start begins periodically flushing recorded fetches in the background,
+// until Stop is called or the context is cancelled.
+func (r *Recorder) Start(ctx context.Context) {
+	if r == nil {
+		return
+	}
+
+	r.runner.Start(ctx)
+}
+
+// Stop stops the background flushing started by Start, and writes any
+// fetches recorded since the last flush.
+func (r *Recorder) Stop() {
+	if r == nil || !r.runner.Stop() {
+		return
+	}
+
+	// The runs' context is cancelled by now, so the last flush gets its own
+	r.flushWithTimeout(context.Background())
+}
+
+func (r *Recorder) flushWithTimeout(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, flushTimeout)
+	defer cancel()
+
+	if err := r.Flush(ctx); err != nil {
+		r.logger.Warn("failed to record last metadata fetches", zap.Error(err))
+	}
+}
+
+// Flush writes all fetches recorded since the last flush to the database.
+// If the write fails, the fetches are kept so they can be retried on the next
+// flush (unless a newer fetch for the instance was recorded in the meantime).
+func (r *Recorder) Flush(ctx context.Context) error {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	batch := r.pending
+	r.pending = make(map[string]Fetch, len(batch))
+	r.mu.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	err := r.write(ctx, batch)
+	if err != nil {
+		r.mu.Lock()
+		for id, fetch := range batch {
+			if _, ok := r.pending[id]; !ok {
+				r.pending[id] = fetch
+			}
+		}
+		r.mu.Unlock()
+	}
+
+	return err
+}
+
+func (r *Recorder) write(ctx context.Context, batch map[string]Fetch) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, fetch := range batch {
+		if _, err := tx.ExecContext(ctx, upsertQuery, fetch.InstanceID, fetch.SourceIP, fetch.FetchedAt); err != nil {
+			_ = tx.Rollback()
+
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Last returns the most recent fetch for the instance, including a fetch
+// recorded by this Recorder which hasn't been flushed yet, or nil if no fetch
+// has been recorded.
+func (r *Recorder) Last(ctx context.Context, instanceID string) (*Fetch, error) {
+	if r == nil {
+		return nil, nil
+	}
+
+	stored, err := Get(ctx, r.db, instanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	pending, ok := r.pending[instanceID]
+	r.mu.Unlock()
+
+	if ok && (stored == nil || pending.FetchedAt.After(stored.FetchedAt)) {
+		return &pending, nil
+	}
+
+	return stored, nil
+}
+
+// Get returns the most recently flushed fetch for the instance, or nil if no
+// fetch has been recorded.
+func Get(ctx context.Context, db *sqlx.DB, instanceID string) (*Fetch, error) {
+	fetch := &Fetch{}
+
+	err := db.GetContext(ctx, fetch, selectQuery, instanceID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return fetch, nil
+}
@@ -0,0 +1,82 @@
+package lastfetch_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	"go.hollow.sh/metadataservice/internal/lastfetch"
+)
+
+func TestNilRecorder(t *testing.T) {
+	var recorder *lastfetch.Recorder
+
+	// None of these should panic
+	recorder.Record("22bc79fc-3834-40b8-b734-30bef9634939", "1.2.3.4")
+	recorder.Start(context.TODO())
+	recorder.Stop()
+
+	assert.NoError(t, recorder.Flush(context.TODO()))
+
+	fetch, err := recorder.Last(context.TODO(), "22bc79fc-3834-40b8-b734-30bef9634939")
+	assert.NoError(t, err)
+	assert.Nil(t, fetch)
+}
+
+func TestRecorderFlush(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+	instanceID := dbtools.FixtureInstanceA.InstanceID
+
+	recorder := lastfetch.NewRecorder(testDB, zap.NewNop(), 0)
+
+	fetch, err := lastfetch.Get(context.TODO(), testDB, instanceID)
+	assert.NoError(t, err)
+	assert.Nil(t, fetch)
+
+	// Only the most recent fetch before a flush should be kept
+	recorder.Record(instanceID, "139.178.82.3")
+	recorder.Record(instanceID, "10.70.17.9")
+
+	assert.NoError(t, recorder.Flush(context.TODO()))
+
+	fetch, err = lastfetch.Get(context.TODO(), testDB, instanceID)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.70.17.9", fetch.SourceIP)
+
+	// A subsequent fetch replaces it
+	recorder.Record(instanceID, "139.178.82.3")
+
+	assert.NoError(t, recorder.Flush(context.TODO()))
+
+	updated, err := lastfetch.Get(context.TODO(), testDB, instanceID)
+	assert.NoError(t, err)
+	assert.Equal(t, "139.178.82.3", updated.SourceIP)
+	assert.True(t, updated.FetchedAt.After(fetch.FetchedAt))
+}
+
+func TestRecorderLast(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+	instanceID := dbtools.FixtureInstanceA.InstanceID
+
+	recorder := lastfetch.NewRecorder(testDB, zap.NewNop(), 0)
+
+	fetch, err := recorder.Last(context.TODO(), instanceID)
+	assert.NoError(t, err)
+	assert.Nil(t, fetch)
+
+	// Fetches which haven't been flushed yet are included
+	recorder.Record(instanceID, "139.178.82.3")
+
+	fetch, err = recorder.Last(context.TODO(), instanceID)
+	assert.NoError(t, err)
+	assert.Equal(t, "139.178.82.3", fetch.SourceIP)
+
+	assert.NoError(t, recorder.Flush(context.TODO()))
+
+	fetch, err = recorder.Last(context.TODO(), instanceID)
+	assert.NoError(t, err)
+	assert.Equal(t, "139.178.82.3", fetch.SourceIP)
+}
@@ -0,0 +1,3 @@
+// Package metadatahistory keeps the previous versions of each instance's
+// metadata, so that what an instance was served can be audited over time.
+package metadatahistory // import go.hollow.sh/metadataservice/internal/metadatahistory
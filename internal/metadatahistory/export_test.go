@@ -0,0 +1,4 @@
+package metadatahistory
+
+// PruneWithTimeout exposes pruneWithTimeout to the tests
+var PruneWithTimeout = (*Pruner).pruneWithTimeout
@@ -0,0 +1,193 @@
+package metadatahistory
+
+import (
+	"context"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/volatiletech/sqlboiler/v4/boil"
+	"github.com/volatiletech/sqlboiler/v4/types"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/periodic"
+	"go.hollow.sh/metadataservice/internal/readonly"
+)
+
+const (
+	// DefaultPruneInterval is how often history beyond the retention limits
+	// is removed when no interval is given
+	DefaultPruneInterval = time.Hour
+
+	pruneTimeout = time.Minute
+
+	// recordQuery copies the currently stored metadata for an instance into
+	// the history, unless it's the same as the metadata replacing it
+	recordQuery = `INSERT INTO instance_metadata_history (instance_id, metadata, updated_at, replaced_at, replaced_by)
+SELECT id, metadata, updated_at, $2, $3 FROM instance_metadata WHERE id = $1 AND metadata <> $4::JSONB`
+
+	listQuery = `SELECT id, instance_id, metadata, updated_at, replaced_at, replaced_by FROM instance_metadata_history
+WHERE instance_id = $1 ORDER BY replaced_at DESC, id LIMIT $2 OFFSET $3`
+
+	pruneVersionsQuery = `DELETE FROM instance_metadata_history WHERE id IN (
+SELECT id FROM (
+SELECT id, row_number() OVER (PARTITION BY instance_id ORDER BY replaced_at DESC, id) AS version FROM instance_metadata_history
+) AS versions WHERE version > $1)`
+
+	pruneAgeQuery = `DELETE FROM instance_metadata_history WHERE replaced_at < $1`
+)
+
+// Version is a previous version of an instance's metadata
+type Version struct {
+	ID         string     `db:"id" json:"id"`
+	InstanceID string     `db:"instance_id" json:"-"`
+	Metadata   types.JSON `db:"metadata" json:"metadata"`
+	UpdatedAt  time.Time  `db:"updated_at" json:"updated_at"`
+	ReplacedAt time.Time  `db:"replaced_at" json:"replaced_at"`
+	ReplacedBy string     `db:"replaced_by" json:"replaced_by,omitempty"`
+}
+
+// Retention limits how much history is kept for each instance. A zero value
+// for either limit leaves it unlimited.
+type Retention struct {
+	// MaxVersions is the number of previous versions kept for each instance
+	MaxVersions int
+
+	// MaxAge is how long a version is kept after it was replaced
+	MaxAge time.Duration
+}
+
+// Limited reports whether any retention limit is set
+func (r Retention) Limited() bool {
+	return r.MaxVersions > 0 || r.MaxAge > 0
+}
+
+// Record adds the metadata currently stored for the instance to its history,
+// as replaced at the given time by the given subject. It's meant to be called
+// in the same transaction as the upsert replacing it, before the upsert is
+// made. Nothing is recorded when no metadata is stored for the instance yet,
+// or when the stored metadata is the same as newMetadata.
+func Record(ctx context.Context, exec boil.ContextExecutor, instanceID string, newMetadata []byte, subject string, at time.Time) error {
+	_, err := exec.ExecContext(ctx, recordQuery, instanceID, at, subject, string(newMetadata))
+
+	return err
+}
+
+// List returns the previous versions of the instance's metadata, most
+// recently replaced first, skipping the first offset versions and returning
+// at most limit.
+func List(ctx context.Context, db *sqlx.DB, instanceID string, limit, offset int) ([]Version, error) {
+	versions := []Version{}
+
+	if err := db.SelectContext(ctx, &versions, listQuery, instanceID, limit, offset); err != nil {
+		return nil, err
+	}
+
+	return versions, nil
+}
+
+// Prune removes the history beyond the retention limits, and returns the
+// number of versions removed.
+func Prune(ctx context.Context, db *sqlx.DB, retention Retention) (int64, error) {
+	var removed int64
+
+	if retention.MaxVersions > 0 {
+		result, err := db.ExecContext(ctx, pruneVersionsQuery, retention.MaxVersions)
+		if err != nil {
+			return removed, err
+		}
+
+		count, err := result.RowsAffected()
+		if err != nil {
+			return removed, err
+		}
+
+		removed += count
+	}
+
+	if retention.MaxAge > 0 {
+		result, err := db.ExecContext(ctx, pruneAgeQuery, time.Now().UTC().Add(-retention.MaxAge))
+		if err != nil {
+			return removed, err
+		}
+
+		count, err := result.RowsAffected()
+		if err != nil {
+			return removed, err
+		}
+
+		removed += count
+	}
+
+	return removed, nil
+}
+
+// Pruner periodically removes the history beyond the retention limits in the
+// background. A nil *Pruner is valid, and removes nothing.
+type Pruner struct {
+	db        *sqlx.DB
+	logger    *zap.Logger
+	readOnly  *readonly.Mode
+	retention Retention
+
+	runner *periodic.Runner
+}
+
+// NewPruner returns a Pruner which removes history beyond the retention
+// limits every interval (or DefaultPruneInterval, if interval is 0). Runs are
+// skipped while readOnly is enabled, which can be nil.
+func NewPruner(db *sqlx.DB, logger *zap.Logger, readOnly *readonly.Mode, retention Retention, interval time.Duration) *Pruner {
+	if interval <= 0 {
+		interval = DefaultPruneInterval
+	}
+
+	p := &Pruner{
+		db:        db,
+		logger:    logger,
+		readOnly:  readOnly,
+		retention: retention,
+	}
+
+	p.runner = periodic.New(interval, p.pruneWithTimeout)
+
+	return p
+}
+
+// Start begins periodically pruning history in the background, until Stop is
+// called or the context is cancelled.
+func (p *Pruner) Start(ctx context.Context) {
+	if p == nil {
+		return
+	}
+
+	p.runner.Start(ctx)
+}
+
+// Stop stops the background pruning started by Start
+func (p *Pruner) Stop() {
+	if p == nil {
+		return
+	}
+
+	p.runner.Stop()
+}
+
+func (p *Pruner) pruneWithTimeout(ctx context.Context) {
+	// Nothing is written while the database is being worked on
+	if p.readOnly.Enabled() {
+		p.logger.Debug("skipping metadata history pruning in read-only mode")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, pruneTimeout)
+	defer cancel()
+
+	removed, err := Prune(ctx, p.db, p.retention)
+	if err != nil {
+		p.logger.Warn("failed to prune metadata history", zap.Error(err))
+		return
+	}
+
+	if removed > 0 {
+		p.logger.Info("pruned metadata history", zap.Int64("removed", removed))
+	}
+}
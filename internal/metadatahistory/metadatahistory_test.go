@@ -0,0 +1,129 @@
+package metadatahistory_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	"go.hollow.sh/metadataservice/internal/metadatahistory"
+	"go.hollow.sh/metadataservice/internal/readonly"
+)
+
+func TestNilPruner(t *testing.T) {
+	var pruner *metadatahistory.Pruner
+
+	// None of these should panic
+	pruner.Start(context.TODO())
+	pruner.Stop()
+}
+
+// replaceMetadata records the stored metadata for the instance in its history,
+// then stores the given metadata, like an upsert does
+func replaceMetadata(t *testing.T, instanceID, metadata string, at time.Time) {
+	testDB := dbtools.TestDB()
+
+	if err := metadatahistory.Record(context.TODO(), testDB, instanceID, []byte(metadata), "test-subject", at); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := testDB.ExecContext(context.TODO(), `UPDATE instance_metadata SET metadata = $2, updated_at = $3 WHERE id = $1`, instanceID, metadata, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecordAndList(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+	instanceID := dbtools.FixtureInstanceA.InstanceID
+	original := dbtools.FixtureInstanceA.InstanceMetadata.Metadata
+
+	now := time.Now().UTC()
+
+	replaceMetadata(t, instanceID, `{"version":1}`, now.Add(-2*time.Minute))
+	// Unchanged metadata doesn't add a version
+	replaceMetadata(t, instanceID, `{"version":1}`, now.Add(-time.Minute))
+	replaceMetadata(t, instanceID, `{"version":2}`, now)
+
+	versions, err := metadatahistory.List(context.TODO(), testDB, instanceID, 10, 0)
+	assert.NoError(t, err)
+	assert.Len(t, versions, 2)
+
+	assert.JSONEq(t, `{"version":1}`, string(versions[0].Metadata))
+	assert.Equal(t, "test-subject", versions[0].ReplacedBy)
+	assert.JSONEq(t, string(original), string(versions[1].Metadata))
+
+	versions, err = metadatahistory.List(context.TODO(), testDB, instanceID, 10, 1)
+	assert.NoError(t, err)
+	assert.Len(t, versions, 1)
+	assert.JSONEq(t, string(original), string(versions[0].Metadata))
+
+	// Nothing is recorded for an instance without metadata
+	otherID := "b5f6bbd6-8a5a-4bdb-8f95-4ba7e7f4b8a3"
+
+	err = metadatahistory.Record(context.TODO(), testDB, otherID, []byte(`{}`), "test-subject", now)
+	assert.NoError(t, err)
+
+	versions, err = metadatahistory.List(context.TODO(), testDB, otherID, 10, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, versions)
+}
+
+func TestPrune(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+	instanceID := dbtools.FixtureInstanceA.InstanceID
+
+	now := time.Now().UTC()
+
+	for i, metadata := range []string{`{"version":1}`, `{"version":2}`, `{"version":3}`, `{"version":4}`} {
+		replaceMetadata(t, instanceID, metadata, now.Add(time.Duration(i-3)*time.Hour))
+	}
+
+	// Only the most recent versions are kept
+	removed, err := metadatahistory.Prune(context.TODO(), testDB, metadatahistory.Retention{MaxVersions: 3})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), removed)
+
+	// Then only those replaced recently enough
+	removed, err = metadatahistory.Prune(context.TODO(), testDB, metadatahistory.Retention{MaxAge: 90 * time.Minute})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), removed)
+
+	versions, err := metadatahistory.List(context.TODO(), testDB, instanceID, 10, 0)
+	assert.NoError(t, err)
+	assert.Len(t, versions, 2)
+	assert.JSONEq(t, `{"version":3}`, string(versions[0].Metadata))
+	assert.JSONEq(t, `{"version":2}`, string(versions[1].Metadata))
+}
+
+func TestPrunerReadOnly(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+	instanceID := dbtools.FixtureInstanceA.InstanceID
+
+	now := time.Now().UTC()
+
+	for i, metadata := range []string{`{"version":1}`, `{"version":2}`} {
+		replaceMetadata(t, instanceID, metadata, now.Add(time.Duration(i-1)*time.Hour))
+	}
+
+	mode := readonly.New(true)
+	pruner := metadatahistory.NewPruner(testDB, zap.NewNop(), mode, metadatahistory.Retention{MaxVersions: 1}, time.Hour)
+
+	// Nothing is pruned while the service is read-only
+	metadatahistory.PruneWithTimeout(pruner, context.TODO())
+
+	versions, err := metadatahistory.List(context.TODO(), testDB, instanceID, 10, 0)
+	assert.NoError(t, err)
+	assert.Len(t, versions, 2)
+
+	mode.Set(false)
+
+	metadatahistory.PruneWithTimeout(pruner, context.TODO())
+
+	versions, err = metadatahistory.List(context.TODO(), testDB, instanceID, 10, 0)
+	assert.NoError(t, err)
+	assert.Len(t, versions, 1)
+}
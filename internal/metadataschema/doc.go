@@ -0,0 +1,4 @@
+// Package metadataschema validates the metadata written to the service against
+// a JSON Schema, so metadata which instances couldn't be looked up by is
+// rejected before it's stored.
+package metadataschema // import go.hollow.sh/metadataservice/internal/metadataschema
@@ -0,0 +1,187 @@
+package metadataschema
+
+import (
+	"bytes"
+	_ "embed" // for the default schema
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// schemaURL is the URL the schema is compiled under. It's only used to name
+// the schema in errors, it's never fetched.
+const schemaURL = "metadata.schema.json"
+
+var (
+	// DefaultSchema is the schema used when no schema is configured. It checks
+	// the network.addresses[].address structure instances are looked up by,
+	// when the metadata has one, and allows any other fields. Whether metadata
+	// needs any addresses at all is left to the IP-less instance policy.
+	//
+	//go:embed default.json
+	DefaultSchema []byte
+
+	// ErrInvalidSchema is returned when a schema can't be loaded
+	ErrInvalidSchema = errors.New("invalid metadata schema")
+
+	// ErrInvalidMetadata is returned when metadata doesn't match the schema
+	ErrInvalidMetadata = errors.New("metadata doesn't match the schema")
+)
+
+// ValidationError is returned when metadata doesn't match the schema. It lists
+// each failing field.
+type ValidationError struct {
+	// Fields describes each part of the metadata which failed validation,
+	// like "network.addresses[0]: missing properties: 'address'"
+	Fields []string
+}
+
+// Error implements the error interface
+func (e *ValidationError) Error() string {
+	return ErrInvalidMetadata.Error() + ": " + strings.Join(e.Fields, "; ")
+}
+
+// Unwrap allows the error to be matched with ErrInvalidMetadata
+func (e *ValidationError) Unwrap() error {
+	return ErrInvalidMetadata
+}
+
+// Validator validates metadata against a JSON Schema. A nil *Validator is
+// valid, and accepts any metadata.
+type Validator struct {
+	schema *jsonschema.Schema
+}
+
+// New returns a Validator for the given JSON Schema
+func New(schema []byte) (*Validator, error) {
+	compiler := jsonschema.NewCompiler()
+
+	if err := compiler.AddResource(schemaURL, bytes.NewReader(schema)); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSchema, err.Error())
+	}
+
+	compiled, err := compiler.Compile(schemaURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSchema, err.Error())
+	}
+
+	return &Validator{schema: compiled}, nil
+}
+
+// Load returns a Validator for the JSON Schema at the path, or for the
+// DefaultSchema when the path is empty.
+func Load(path string) (*Validator, error) {
+	if path == "" {
+		return New(DefaultSchema)
+	}
+
+	schema, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSchema, err.Error())
+	}
+
+	return New(schema)
+}
+
+// Validate checks the metadata against the schema. When it doesn't match, a
+// *ValidationError listing the failing fields is returned.
+func (v *Validator) Validate(metadata []byte) error {
+	if v == nil {
+		return nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(metadata))
+	decoder.UseNumber()
+
+	var doc interface{}
+
+	if err := decoder.Decode(&doc); err != nil {
+		return &ValidationError{Fields: []string{"metadata: " + err.Error()}}
+	}
+
+	err := v.schema.Validate(doc)
+
+	var validationErr *jsonschema.ValidationError
+
+	if errors.As(err, &validationErr) {
+		return &ValidationError{Fields: failingFields(validationErr)}
+	}
+
+	return err
+}
+
+// failingFields describes the fields which failed validation, from the most
+// specific causes of the error
+func failingFields(err *jsonschema.ValidationError) []string {
+	seen := map[string]bool{}
+	fields := []string{}
+
+	var walk func(*jsonschema.ValidationError)
+
+	walk = func(err *jsonschema.ValidationError) {
+		if len(err.Causes) > 0 {
+			for _, cause := range err.Causes {
+				walk(cause)
+			}
+
+			return
+		}
+
+		field := fieldName(err.InstanceLocation) + ": " + err.Message
+		if !seen[field] {
+			seen[field] = true
+			fields = append(fields, field)
+		}
+	}
+
+	walk(err)
+	sort.Strings(fields)
+
+	return fields
+}
+
+// fieldName converts the JSON pointer to a value in the metadata into a field
+// name, like "network.addresses[0].address" for /network/addresses/0/address
+func fieldName(pointer string) string {
+	if pointer == "" {
+		return "metadata"
+	}
+
+	var name strings.Builder
+
+	for _, token := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+		token = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+
+		if isIndex(token) {
+			name.WriteString("[" + token + "]")
+			continue
+		}
+
+		if name.Len() > 0 {
+			name.WriteString(".")
+		}
+
+		name.WriteString(token)
+	}
+
+	return name.String()
+}
+
+func isIndex(token string) bool {
+	if token == "" {
+		return false
+	}
+
+	for _, ch := range token {
+		if ch < '0' || ch > '9' {
+			return false
+		}
+	}
+
+	return true
+}
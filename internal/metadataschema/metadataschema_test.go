@@ -0,0 +1,90 @@
+package metadataschema_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/metadataschema"
+)
+
+func TestDefaultSchema(t *testing.T) {
+	validator, err := metadataschema.Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		testName string
+		metadata string
+		fields   []string
+	}{
+		{"valid", `{"hostname":"a","network":{"addresses":[{"address":"10.0.0.1","public":false}]}}`, nil},
+		{"no addresses", `{"network":{"addresses":[]}}`, nil},
+		// Whether addresses are needed is up to the IP-less instance policy
+		{"no network", `{"hostname":"a"}`, nil},
+		{"no addresses list", `{"network":{"bonding":{}}}`, nil},
+		{"network not an object", `{"network":"10.0.0.1"}`, []string{"network: expected object, but got string"}},
+		{"addresses not a list", `{"network":{"addresses":"10.0.0.1"}}`, []string{"network.addresses: expected array, but got string"}},
+		{
+			"malformed addresses",
+			`{"network":{"addresses":[{"address":"10.0.0.1"},{"cidr":29},{"address":1}]}}`,
+			[]string{"network.addresses[1]: missing properties: 'address'", "network.addresses[2].address: expected string, but got number"},
+		},
+		{"not an object", `[]`, []string{"metadata: expected object, but got array"}},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			err := validator.Validate([]byte(testcase.metadata))
+
+			if testcase.fields == nil {
+				assert.NoError(t, err)
+				return
+			}
+
+			assert.ErrorIs(t, err, metadataschema.ErrInvalidMetadata)
+
+			var validationErr *metadataschema.ValidationError
+			if assert.True(t, errors.As(err, &validationErr)) {
+				assert.Equal(t, testcase.fields, validationErr.Fields)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+
+	schemaPath := filepath.Join(dir, "schema.json")
+	if err := os.WriteFile(schemaPath, []byte(`{"type":"object","required":["hostname"]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	validator, err := metadataschema.Load(schemaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NoError(t, validator.Validate([]byte(`{"hostname":"a"}`)))
+	assert.ErrorIs(t, validator.Validate([]byte(`{"network":{"addresses":[]}}`)), metadataschema.ErrInvalidMetadata)
+
+	invalidPath := filepath.Join(dir, "invalid.json")
+	if err := os.WriteFile(invalidPath, []byte(`{"type":"nope"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{invalidPath, filepath.Join(dir, "missing.json")} {
+		_, err := metadataschema.Load(path)
+		assert.ErrorIs(t, err, metadataschema.ErrInvalidSchema, path)
+	}
+}
+
+func TestNilValidator(t *testing.T) {
+	var validator *metadataschema.Validator
+
+	assert.NoError(t, validator.Validate([]byte(`[]`)))
+}
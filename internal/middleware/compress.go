@@ -0,0 +1,241 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultCompressionMinSize is the smallest response body compressed by
+// default, in bytes. Smaller bodies gain little, and can grow.
+const DefaultCompressionMinSize = 1024
+
+const (
+	encodingGzip    = "gzip"
+	encodingDeflate = "deflate"
+)
+
+// Compress compresses responses of at least minSize bytes with gzip or
+// deflate, when the client accepts one of them in its Accept-Encoding header.
+// Responses are buffered so their size is known before deciding, and sent
+// uncompressed as soon as a handler flushes, so streamed responses are
+// unaffected. Handlers compute ETags from the uncompressed body, so a
+// compressed response's ETag is marked weak, which conditional requests
+// still match.
+func Compress(minSize int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method != http.MethodGet {
+			c.Next()
+			return
+		}
+
+		w := &compressWriter{
+			ResponseWriter: c.Writer,
+			encoding:       acceptedEncoding(c.GetHeader("Accept-Encoding")),
+			minSize:        minSize,
+		}
+
+		c.Writer = w
+
+		defer func() {
+			c.Writer = w.ResponseWriter
+
+			w.finish()
+		}()
+
+		c.Next()
+	}
+}
+
+// acceptedEncoding returns the compression the client prefers out of those
+// supported, or an empty string when it doesn't accept either. A "*" only
+// accepts the encodings which aren't listed on their own, so "gzip;q=0, *"
+// refuses gzip.
+func acceptedEncoding(acceptEncoding string) string {
+	accepted := map[string]bool{}
+
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+
+		q := 1.0
+
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+
+		accepted[strings.ToLower(strings.TrimSpace(name))] = q > 0
+	}
+
+	accepts := func(encoding string) bool {
+		if ok, listed := accepted[encoding]; listed {
+			return ok
+		}
+
+		return accepted["*"]
+	}
+
+	switch {
+	case accepts(encodingGzip):
+		return encodingGzip
+	case accepts(encodingDeflate):
+		return encodingDeflate
+	default:
+		return ""
+	}
+}
+
+// compressWriter buffers a response, so it can be compressed once it's
+// complete. It stops buffering, passing the response straight through, as
+// soon as the headers have to be sent before the body is complete.
+type compressWriter struct {
+	gin.ResponseWriter
+
+	encoding string
+	minSize  int
+
+	buf         bytes.Buffer
+	status      int
+	wrote       bool
+	passthrough bool
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if w.passthrough {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	w.status = code
+}
+
+func (w *compressWriter) WriteHeaderNow() {
+	w.startPassthrough()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *compressWriter) Write(data []byte) (int, error) {
+	if w.passthrough {
+		return w.ResponseWriter.Write(data)
+	}
+
+	w.wrote = true
+
+	return w.buf.Write(data)
+}
+
+func (w *compressWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *compressWriter) Flush() {
+	w.startPassthrough()
+	w.ResponseWriter.Flush()
+}
+
+func (w *compressWriter) Status() int {
+	if w.passthrough || w.status == 0 {
+		return w.ResponseWriter.Status()
+	}
+
+	return w.status
+}
+
+func (w *compressWriter) Size() int {
+	if w.passthrough || !w.wrote {
+		return w.ResponseWriter.Size()
+	}
+
+	return w.buf.Len()
+}
+
+func (w *compressWriter) Written() bool {
+	return w.wrote || w.ResponseWriter.Written()
+}
+
+// startPassthrough sends the buffered response as it is, and passes anything
+// written afterwards straight through
+func (w *compressWriter) startPassthrough() {
+	if w.passthrough {
+		return
+	}
+
+	w.passthrough = true
+
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+
+	if w.buf.Len() > 0 {
+		_, _ = w.ResponseWriter.Write(w.buf.Bytes())
+	}
+}
+
+// finish sends the buffered response, compressed when it's eligible
+func (w *compressWriter) finish() {
+	if w.passthrough {
+		return
+	}
+
+	header := w.Header()
+
+	if !w.compressible() {
+		w.startPassthrough()
+		return
+	}
+
+	// Whether the response is compressed depends on the request's
+	// Accept-Encoding, whether or not it was this time
+	header.Add("Vary", "Accept-Encoding")
+
+	if w.encoding == "" {
+		w.startPassthrough()
+		return
+	}
+
+	var compressed bytes.Buffer
+
+	var encoder io.WriteCloser
+
+	if w.encoding == encodingGzip {
+		encoder = gzip.NewWriter(&compressed)
+	} else {
+		encoder = zlib.NewWriter(&compressed)
+	}
+
+	if _, err := encoder.Write(w.buf.Bytes()); err != nil {
+		w.startPassthrough()
+		return
+	}
+
+	if err := encoder.Close(); err != nil {
+		w.startPassthrough()
+		return
+	}
+
+	header.Set("Content-Encoding", w.encoding)
+	header.Del("Content-Length")
+
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+
+	w.buf = compressed
+	w.startPassthrough()
+}
+
+// compressible reports whether the buffered response is worth compressing
+func (w *compressWriter) compressible() bool {
+	status := w.Status()
+
+	return status >= http.StatusOK && status < http.StatusMultipleChoices && status != http.StatusNoContent &&
+		w.buf.Len() >= w.minSize &&
+		w.Header().Get("Content-Encoding") == ""
+}
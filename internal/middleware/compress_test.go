@@ -0,0 +1,144 @@
+package middleware_test
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/middleware"
+)
+
+func compressRouter(body string) *gin.Engine {
+	r := gin.New()
+	r.Use(middleware.Compress(16))
+
+	r.GET("/", func(c *gin.Context) {
+		c.Header("ETag", `"abc"`)
+
+		if c.GetHeader("If-None-Match") == `W/"abc"` {
+			c.AbortWithStatus(http.StatusNotModified)
+			return
+		}
+
+		c.Data(http.StatusOK, "text/plain", []byte(body))
+	})
+
+	r.GET("/stream", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+		_, _ = c.Writer.WriteString(body)
+		c.Writer.Flush()
+		_, _ = c.Writer.WriteString(body)
+	})
+
+	return r
+}
+
+func getWithEncoding(r http.Handler, path, acceptEncoding string, header ...string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, path, nil)
+
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+
+	r.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestCompress(t *testing.T) {
+	body := strings.Repeat("#cloud-config\n", 10)
+
+	testCases := []struct {
+		testName         string
+		acceptEncoding   string
+		expectedEncoding string
+	}{
+		{"gzip", "gzip", "gzip"},
+		{"deflate", "deflate", "deflate"},
+		{"gzip preferred", "deflate, gzip", "gzip"},
+		{"any", "*", "gzip"},
+		{"gzip refused", "gzip;q=0, deflate", "deflate"},
+		{"any but gzip", "gzip;q=0, *", "deflate"},
+		{"nothing but identity", "gzip;q=0, deflate;q=0, *", ""},
+		{"identity", "identity", ""},
+		{"not sent", "", ""},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := getWithEncoding(compressRouter(body), "/", testcase.acceptEncoding)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, testcase.expectedEncoding, w.Header().Get("Content-Encoding"))
+			assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+
+			var reader io.Reader = w.Body
+
+			switch testcase.expectedEncoding {
+			case "gzip":
+				gz, err := gzip.NewReader(w.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				reader = gz
+
+				assert.Equal(t, `W/"abc"`, w.Header().Get("ETag"))
+			case "deflate":
+				zr, err := zlib.NewReader(w.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				reader = zr
+
+				assert.Equal(t, `W/"abc"`, w.Header().Get("ETag"))
+			default:
+				assert.Equal(t, `"abc"`, w.Header().Get("ETag"))
+			}
+
+			decoded, err := io.ReadAll(reader)
+			assert.NoError(t, err)
+			assert.Equal(t, body, string(decoded))
+		})
+	}
+
+	t.Run("below minimum size", func(t *testing.T) {
+		w := getWithEncoding(compressRouter("small"), "/", "gzip")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, w.Header().Get("Content-Encoding"))
+		assert.Empty(t, w.Header().Get("Vary"))
+		assert.Equal(t, "small", w.Body.String())
+	})
+
+	t.Run("not modified", func(t *testing.T) {
+		// The weakened ETag from a compressed response is sent back
+		w := getWithEncoding(compressRouter(body), "/", "gzip", "If-None-Match", `W/"abc"`)
+
+		assert.Equal(t, http.StatusNotModified, w.Code)
+		assert.Empty(t, w.Header().Get("Content-Encoding"))
+		assert.Empty(t, w.Body.String())
+	})
+
+	t.Run("streamed", func(t *testing.T) {
+		w := getWithEncoding(compressRouter(body), "/stream", "gzip")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, w.Header().Get("Content-Encoding"))
+		assert.Equal(t, body+body, w.Body.String())
+	})
+}
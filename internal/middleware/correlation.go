@@ -0,0 +1,32 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"go.hollow.sh/metadataservice/internal/correlation"
+)
+
+// ContextKeyCorrelationID is the magic string set in the gin.Context key/value
+// store used for storing the correlation ID of the request.
+const ContextKeyCorrelationID = "correlation-id"
+
+// HeaderRequestID is the request and response header carrying the request ID.
+// A caller-provided ID is used as the correlation ID when the request isn't
+// being traced. The correlation ID is always returned in the response.
+const HeaderRequestID = "X-Request-ID"
+
+// CorrelationID assigns every request a correlation ID, and stores it in both
+// the gin.Context and the request's context, so it's available to anything
+// handling the request, like the upserter. It must be used after the tracing
+// middleware, so the trace ID can be used when there is one.
+func CorrelationID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := correlation.ID(c.Request.Context(), c.GetHeader(HeaderRequestID))
+
+		c.Set(ContextKeyCorrelationID, id)
+		c.Request = c.Request.WithContext(correlation.NewContext(c.Request.Context(), id))
+		c.Header(HeaderRequestID, id)
+
+		c.Next()
+	}
+}
@@ -0,0 +1,142 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ForwardedForPolicy controls what happens to instance-facing requests whose
+// X-Forwarded-For chain looks spoofed.
+type ForwardedForPolicy string
+
+const (
+	// ForwardedForIgnore doesn't check the X-Forwarded-For chain. This is the
+	// default.
+	ForwardedForIgnore ForwardedForPolicy = "ignore"
+
+	// ForwardedForWarn logs requests with a suspicious chain, but still serves
+	// them.
+	ForwardedForWarn ForwardedForPolicy = "warn"
+
+	// ForwardedForReject logs requests with a suspicious chain, and rejects
+	// them with a 403.
+	ForwardedForReject ForwardedForPolicy = "reject"
+
+	headerForwardedFor = "X-Forwarded-For"
+)
+
+var (
+	// ErrInvalidForwardedForPolicy is returned when an unknown policy is
+	// provided.
+	ErrInvalidForwardedForPolicy = errors.New("invalid x-forwarded-for policy")
+
+	// ErrInvalidTrustedProxy is returned when a trusted proxy isn't an IP
+	// address or CIDR.
+	ErrInvalidTrustedProxy = errors.New("invalid trusted proxy")
+)
+
+// ParseForwardedForPolicy parses a configured policy. An empty string results
+// in the default (ForwardedForIgnore).
+func ParseForwardedForPolicy(policy string) (ForwardedForPolicy, error) {
+	switch ForwardedForPolicy(policy) {
+	case "", ForwardedForIgnore:
+		return ForwardedForIgnore, nil
+	case ForwardedForWarn, ForwardedForReject:
+		return ForwardedForPolicy(policy), nil
+	default:
+		return "", fmt.Errorf("%w: %q", ErrInvalidForwardedForPolicy, policy)
+	}
+}
+
+// ParseTrustedProxies parses the trusted proxies given to gin, which may be IP
+// addresses or CIDRs.
+func ParseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	cidrs := make([]*net.IPNet, 0, len(proxies))
+
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("%w: %q", ErrInvalidTrustedProxy, proxy)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+
+			cidrs = append(cidrs, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+
+			continue
+		}
+
+		_, cidr, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidTrustedProxy, proxy)
+		}
+
+		cidrs = append(cidrs, cidr)
+	}
+
+	return cidrs, nil
+}
+
+// spoofedForwardedFor checks whether the X-Forwarded-For chain of a request
+// looks spoofed, returning the reason if it does. Each trusted proxy appends
+// the address it received the request from, so reading the chain from the
+// right, every entry up to and including the client's address was added by a
+// trusted proxy. Anything else in the chain can only have come from the
+// client itself. Without any trusted proxies (when gin trusts every address)
+// only malformed chains can be detected.
+func spoofedForwardedFor(remoteAddr string, header string, trusted []*net.IPNet) string {
+	if header == "" {
+		return ""
+	}
+
+	entries := strings.Split(header, ",")
+
+	for _, entry := range entries {
+		if net.ParseIP(strings.TrimSpace(entry)) == nil {
+			return "malformed X-Forwarded-For entry"
+		}
+	}
+
+	if len(trusted) == 0 {
+		return ""
+	}
+
+	if !trustedIP(net.ParseIP(remoteAddr), trusted) {
+		return "X-Forwarded-For sent by an untrusted client"
+	}
+
+	for i := len(entries) - 1; i >= 0; i-- {
+		if trustedIP(net.ParseIP(strings.TrimSpace(entries[i])), trusted) {
+			continue
+		}
+
+		if i > 0 {
+			return "X-Forwarded-For has entries before the client address"
+		}
+
+		return ""
+	}
+
+	return "X-Forwarded-For only contains trusted proxies"
+}
+
+func trustedIP(ip net.IP, trusted []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, cidr := range trusted {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,16 +1,25 @@
 package middleware
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"net"
 	"net/http"
+	"net/netip"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jmoiron/sqlx"
+	"github.com/volatiletech/sqlboiler/v4/boil"
 	"github.com/volatiletech/sqlboiler/v4/queries/qm"
 	"go.uber.org/zap"
 
+	"go.hollow.sh/metadataservice/internal/apierror"
+	"go.hollow.sh/metadataservice/internal/coalesce"
 	"go.hollow.sh/metadataservice/internal/models"
+	"go.hollow.sh/metadataservice/internal/readcache"
+	"go.hollow.sh/metadataservice/internal/stalecache"
 )
 
 // ContextKeyInstanceID is the magic string set in the gin.Context key/value
@@ -23,6 +32,14 @@ const ContextKeyInstanceID = "instance-id"
 // metadata or userdata.
 const ContextKeyRequestorIP = "requestor-ip-address"
 
+// IPAddressCacheKeyPrefix prefixes the request address in the keys used to
+// cache instance_ip_addresses lookups.
+const IPAddressCacheKeyPrefix = "ip:"
+
+// HeaderResolvedSourceIP is the debug response header used to report the
+// effective client IP the service used to identify the instance.
+const HeaderResolvedSourceIP = "X-Resolved-Source-IP"
+
 // When a request comes in to the /metadata or /userdata endpoints (or the 2009-04-04/* variants)
 // we need to identify the instance making the request.
 // There's 2 ways to do this:
@@ -39,11 +56,47 @@ const ContextKeyRequestorIP = "requestor-ip-address"
 // table. If there's no rows matching the request IP, we'll know we need to
 // fetch it from an external system.
 
+// IdentifyConfig holds the optional settings used by the instance
+// identification middleware.
+type IdentifyConfig struct {
+	// Coalescer, when set and enabled, collapses concurrent lookups for the
+	// same request IP into a single database query.
+	Coalescer *coalesce.Group
+
+	// ResolvedSourceIPHeader, when true, reports the effective client IP
+	// used for the lookup (after any trusted proxy resolution) in the
+	// X-Resolved-Source-IP response header.
+	ResolvedSourceIPHeader bool
+
+	// ForwardedFor is the policy for requests whose X-Forwarded-For chain
+	// looks spoofed, judged against the TrustedProxies.
+	ForwardedFor ForwardedForPolicy
+
+	// TrustedProxies are the proxies gin has been configured to trust the
+	// X-Forwarded-For header from.
+	TrustedProxies []*net.IPNet
+
+	// StaleCache, when set, is used to keep identifying instances from the
+	// addresses they were last identified by while the database can't be
+	// read.
+	StaleCache *stalecache.Cache
+
+	// ReadCache, when set, serves recent lookups for the same request IP
+	// without querying the database.
+	ReadCache *readcache.Cache
+}
+
 // IdentifyInstanceByIP is used to determine the ID of the instance making the
 // request by looking at the request IP.
 // If a row in the instance_ip_addresses table is found with a matching IP
 // address, we set the instance ID in the context.
 func IdentifyInstanceByIP(logger *zap.Logger, db *sqlx.DB) gin.HandlerFunc {
+	return IdentifyInstanceByIPWithConfig(logger, db, IdentifyConfig{})
+}
+
+// IdentifyInstanceByIPWithConfig behaves like IdentifyInstanceByIP, but
+// allows the caller to supply additional settings.
+func IdentifyInstanceByIPWithConfig(logger *zap.Logger, db *sqlx.DB, config IdentifyConfig) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var (
 			address           string
@@ -61,15 +114,53 @@ func IdentifyInstanceByIP(logger *zap.Logger, db *sqlx.DB) gin.HandlerFunc {
 		// Use the `gin-trusted-proxies` flag
 		// (or METADATASERVICE_GIN_TRUSTED_PROXIES envvar) when starting the server
 		// to provide the list of trusted proxy IP's to use.
+		if config.ForwardedFor == ForwardedForWarn || config.ForwardedFor == ForwardedForReject {
+			header := c.GetHeader(headerForwardedFor)
+
+			if reason := spoofedForwardedFor(c.RemoteIP(), header, config.TrustedProxies); reason != "" {
+				logger.Warn("possibly spoofed X-Forwarded-For",
+					zap.String("reason", reason),
+					zap.String("remote_ip", c.RemoteIP()),
+					zap.String("x_forwarded_for", header),
+					zap.String("policy", string(config.ForwardedFor)),
+				)
+
+				if config.ForwardedFor == ForwardedForReject {
+					apierror.Abort(c, http.StatusForbidden, apierror.CodeInvalidForwardedFor, "invalid X-Forwarded-For header")
+					return
+				}
+			}
+		}
+
 		address = c.ClientIP()
 
+		// Look up (and cache) the address in its canonical form, so the same
+		// IPv6 address written differently by a proxy is treated the same
+		if ip, err := netip.ParseAddr(address); err == nil {
+			address = ip.Unmap().String()
+		}
+
 		c.Set(ContextKeyRequestorIP, address)
 
-		instanceIPAddress, err = models.InstanceIPAddresses(qm.Where("address >>= ?::inet", address)).One(c, db)
+		if config.ResolvedSourceIPHeader {
+			c.Header(HeaderResolvedSourceIP, address)
+		}
+
+		instanceIPAddress, err = findInstanceIPAddress(c, db, config, address)
+		if errors.Is(err, stalecache.ErrTooStale) {
+			logger.Error("error looking up instance address, and the cached address is too stale to use", zap.Error(err))
+
+			apierror.Abort(c, http.StatusServiceUnavailable, apierror.CodeServiceUnavailable, "service unavailable")
+
+			return
+		}
+
 		if err != nil && !errors.Is(err, sql.ErrNoRows) {
 			logger.Error("error looking up instance address", zap.Error(err))
 
-			c.AbortWithStatus(http.StatusInternalServerError)
+			apierror.Abort(c, http.StatusInternalServerError, apierror.CodeInternal, "internal server error")
+
+			return
 		}
 
 		if instanceIPAddress != nil {
@@ -78,3 +169,72 @@ func IdentifyInstanceByIP(logger *zap.Logger, db *sqlx.DB) gin.HandlerFunc {
 		}
 	}
 }
+
+// findInstanceIPAddress looks up the instance_ip_addresses row matching the
+// given address, coalescing concurrent lookups for the same address when the
+// coalescer is enabled. Recent lookups are served from the read cache, if
+// there is one. When the database can't be read, the address the instance was
+// last identified by is used from the stale cache, if there is one.
+func findInstanceIPAddress(c *gin.Context, db *sqlx.DB, config IdentifyConfig, address string) (*models.InstanceIPAddress, error) {
+	key := IPAddressCacheKeyPrefix + address
+
+	if v, ok := config.ReadCache.Get(key); ok {
+		return v.(*models.InstanceIPAddress), nil
+	}
+
+	cache := config.StaleCache
+
+	v, err, shared := config.Coalescer.Do(c.Request.Context(), key, func(ctx context.Context) (interface{}, error) {
+		return FindInstanceIPAddress(ctx, db, address)
+	})
+
+	if shared {
+		MetricReadsCoalesced.Inc()
+	}
+
+	switch {
+	case err == nil:
+		cache.Store(key, v)
+		config.ReadCache.Add(key, v)
+	case errors.Is(err, sql.ErrNoRows):
+		cache.Forget(key)
+	default:
+		v, err = cache.Fallback(key, err)
+	}
+
+	instanceIPAddress, _ := v.(*models.InstanceIPAddress)
+
+	return instanceIPAddress, err
+}
+
+// EvictIPAddressLookups evicts the cached lookups which identified an instance
+// by one of the instance_ip_addresses rows with the given ids, after they were
+// removed, and returns the number evicted.
+func EvictIPAddressLookups(cache *readcache.Cache, ids []string) int {
+	if cache == nil || len(ids) == 0 {
+		return 0
+	}
+
+	removed := make(map[string]bool, len(ids))
+
+	for _, id := range ids {
+		removed[id] = true
+	}
+
+	return cache.RemoveFunc(func(key string, value interface{}) bool {
+		instanceIP, ok := value.(*models.InstanceIPAddress)
+
+		return ok && strings.HasPrefix(key, IPAddressCacheKeyPrefix) && removed[instanceIP.ID]
+	})
+}
+
+// FindInstanceIPAddress returns the instance_ip_addresses row an instance
+// making a request from the address is identified by: an exact match for the
+// address, or otherwise the most specific associated network containing it.
+// sql.ErrNoRows is returned when the address isn't associated to any instance.
+func FindInstanceIPAddress(ctx context.Context, exec boil.ContextExecutor, address string) (*models.InstanceIPAddress, error) {
+	return models.InstanceIPAddresses(
+		qm.Where("address >>= ?::inet", address),
+		qm.OrderBy("masklen(address) DESC"),
+	).One(ctx, exec)
+}
@@ -2,18 +2,24 @@ package middleware_test
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
 
+	"go.hollow.sh/metadataservice/internal/apierror"
 	"go.hollow.sh/metadataservice/internal/dbtools"
 	"go.hollow.sh/metadataservice/internal/middleware"
+	"go.hollow.sh/metadataservice/internal/models"
+	"go.hollow.sh/metadataservice/internal/readcache"
 )
 
 func TestIdentifyInstanceByIP(t *testing.T) {
@@ -101,6 +107,40 @@ func TestIdentifyInstanceByIP(t *testing.T) {
 	}
 }
 
+func TestIdentifyInstanceByNonCanonicalIPv6(t *testing.T) {
+	testdb := dbtools.DatabaseTest(t)
+
+	proxyIP := "1.2.3.4"
+
+	logger := zap.NewNop()
+	r := gin.New()
+
+	if err := r.SetTrustedProxies([]string{proxyIP}); err != nil {
+		t.Fatal(err)
+	}
+
+	r.Use(middleware.IdentifyInstanceByIP(logger, testdb))
+	r.GET("/", func(c *gin.Context) {
+		instanceIDValue, found := c.Get(middleware.ContextKeyInstanceID)
+
+		assert.True(t, found)
+		assert.Equal(t, dbtools.FixtureInstanceA.InstanceID, instanceIDValue)
+		assert.Equal(t, "2604:1380:4641:1f00::9", c.GetString(middleware.ContextKeyRequestorIP))
+
+		c.Status(http.StatusOK)
+	})
+
+	for _, address := range []string{"2604:1380:4641:1f00:0:0:0:9", "2604:1380:4641:1F00:0000:0000:0000:0009"} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequestWithContext(context.TODO(), "GET", "http://test/", nil)
+		req.RemoteAddr = net.JoinHostPort(proxyIP, "0")
+		req.Header.Add("X-Forwarded-For", address)
+		r.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code, address)
+	}
+}
+
 func TestIdentifyInstanceByIPWithTrustedProxies(t *testing.T) {
 	testdb := dbtools.DatabaseTest(t)
 
@@ -133,3 +173,176 @@ func TestIdentifyInstanceByIPWithTrustedProxies(t *testing.T) {
 	req.Header.Add("X-Forwarded-For", hostAIP)
 	r.ServeHTTP(w, req)
 }
+
+func TestIdentifyInstanceByIPResolvedSourceIPHeader(t *testing.T) {
+	testdb := dbtools.DatabaseTest(t)
+
+	proxyIP := "1.2.3.4"
+	hostAIP := dbtools.FixtureInstanceA.HostIPs[0]
+
+	type testCase struct {
+		testName       string
+		enabled        bool
+		expectedHeader string
+	}
+
+	testCases := []testCase{
+		{
+			"header disabled",
+			false,
+			"",
+		},
+		{
+			"header enabled",
+			true,
+			hostAIP,
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			r := gin.New()
+
+			if err := r.SetTrustedProxies([]string{proxyIP}); err != nil {
+				t.Fatal(err)
+			}
+
+			r.Use(middleware.IdentifyInstanceByIPWithConfig(zap.NewNop(), testdb, middleware.IdentifyConfig{ResolvedSourceIPHeader: testcase.enabled}))
+			r.GET("/", func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequestWithContext(context.TODO(), "GET", "http://test/", nil)
+			req.RemoteAddr = net.JoinHostPort(proxyIP, "0")
+			req.Header.Add("X-Forwarded-For", hostAIP)
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedHeader, w.Header().Get(middleware.HeaderResolvedSourceIP))
+		})
+	}
+}
+
+func TestIdentifyInstanceByIPSpoofedForwardedFor(t *testing.T) {
+	testdb := dbtools.DatabaseTest(t)
+
+	proxies := []string{"1.2.3.4", "10.0.0.0/24"}
+	hostAIP := dbtools.FixtureInstanceA.HostIPs[0]
+
+	trustedProxies, err := middleware.ParseTrustedProxies(proxies)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type testCase struct {
+		testName       string
+		policy         middleware.ForwardedForPolicy
+		remoteIP       string
+		forwardedFor   string
+		expectedStatus int
+	}
+
+	testCases := []testCase{
+		{"consistent chain", middleware.ForwardedForReject, "1.2.3.4", hostAIP, http.StatusOK},
+		{"consistent multi-proxy chain", middleware.ForwardedForReject, "1.2.3.4", hostAIP + ", 10.0.0.5", http.StatusOK},
+		{"no header", middleware.ForwardedForReject, hostAIP, "", http.StatusOK},
+		{"injected entry", middleware.ForwardedForReject, "1.2.3.4", "5.6.7.8, " + hostAIP, http.StatusForbidden},
+		{"malformed entry", middleware.ForwardedForReject, "1.2.3.4", "not-an-ip", http.StatusForbidden},
+		{"untrusted client", middleware.ForwardedForReject, hostAIP, "5.6.7.8", http.StatusForbidden},
+		{"only trusted proxies", middleware.ForwardedForReject, "1.2.3.4", "10.0.0.5", http.StatusForbidden},
+		{"injected entry only warned about", middleware.ForwardedForWarn, "1.2.3.4", "5.6.7.8, " + hostAIP, http.StatusOK},
+		{"injected entry ignored", middleware.ForwardedForIgnore, "1.2.3.4", "5.6.7.8, " + hostAIP, http.StatusOK},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			r := gin.New()
+
+			if err := r.SetTrustedProxies(proxies); err != nil {
+				t.Fatal(err)
+			}
+
+			r.Use(middleware.IdentifyInstanceByIPWithConfig(zap.NewNop(), testdb, middleware.IdentifyConfig{
+				ForwardedFor:   testcase.policy,
+				TrustedProxies: trustedProxies,
+			}))
+			r.GET("/", func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequestWithContext(context.TODO(), "GET", "http://test/", nil)
+			req.RemoteAddr = net.JoinHostPort(testcase.remoteIP, "0")
+
+			if testcase.forwardedFor != "" {
+				req.Header.Add("X-Forwarded-For", testcase.forwardedFor)
+			}
+
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+		})
+	}
+}
+
+// Test that a failed lookup gets the same JSON error body as the handlers
+func TestIdentifyInstanceByIPDatabaseError(t *testing.T) {
+	db, err := sqlx.Open("postgres", "postgres://root@127.0.0.1:1/metadataservice?sslmode=disable&connect_timeout=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	r := gin.New()
+	r.Use(middleware.IdentifyInstanceByIP(zap.NewNop(), db))
+	r.GET("/", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequestWithContext(context.TODO(), "GET", "http://test/", nil)
+	req.RemoteAddr = net.JoinHostPort("1.2.3.4", "0")
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	var resp apierror.Response
+
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, apierror.CodeInternal, resp.Error.Code)
+}
+
+func TestParseForwardedForPolicy(t *testing.T) {
+	policy, err := middleware.ParseForwardedForPolicy("")
+	assert.NoError(t, err)
+	assert.Equal(t, middleware.ForwardedForIgnore, policy)
+
+	_, err = middleware.ParseForwardedForPolicy("sometimes")
+	assert.ErrorIs(t, err, middleware.ErrInvalidForwardedForPolicy)
+
+	_, err = middleware.ParseTrustedProxies([]string{"not-a-proxy"})
+	assert.ErrorIs(t, err, middleware.ErrInvalidTrustedProxy)
+}
+
+func TestEvictIPAddressLookups(t *testing.T) {
+	cache := readcache.New(10, time.Minute)
+
+	cache.Add(middleware.IPAddressCacheKeyPrefix+"10.0.0.1", &models.InstanceIPAddress{ID: "removed", Address: "10.0.0.1"})
+	cache.Add(middleware.IPAddressCacheKeyPrefix+"10.1.0.5", &models.InstanceIPAddress{ID: "removed-network", Address: "10.1.0.0/24"})
+	cache.Add(middleware.IPAddressCacheKeyPrefix+"10.0.0.2", &models.InstanceIPAddress{ID: "kept", Address: "10.0.0.2"})
+	cache.Add("metadata:removed", &models.InstanceMetadatum{ID: "removed"})
+
+	assert.Equal(t, 2, middleware.EvictIPAddressLookups(cache, []string{"removed", "removed-network"}))
+	assert.Equal(t, 2, cache.Len())
+
+	_, ok := cache.Get(middleware.IPAddressCacheKeyPrefix + "10.0.0.2")
+	assert.True(t, ok)
+
+	// A nil cache, or nothing removed, evicts nothing
+	assert.Zero(t, middleware.EvictIPAddressLookups(nil, []string{"kept"}))
+	assert.Zero(t, middleware.EvictIPAddressLookups(cache, nil))
+}
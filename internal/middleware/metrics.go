@@ -83,4 +83,16 @@ var (
 		Name: "metadata_userdata_store_error_total",
 		Help: "Number of errors produced while saving or updating userdata to the database.",
 	})
+
+	// MetricReadsCoalesced total number of reads that shared the result of an identical in-flight read
+	MetricReadsCoalesced = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "metadata_reads_coalesced_total",
+		Help: "Number of reads that were served by sharing the result of an identical, concurrent database query.",
+	})
+
+	// MetricDefaultMetadataResponses total number of requests from unknown instances served the default metadata
+	MetricDefaultMetadataResponses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "metadata_default_responses_total",
+		Help: "Number of metadata requests from unknown instances which were served the default metadata rather than a 404.",
+	})
 )
@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"go.hollow.sh/metadataservice/internal/apierror"
+)
+
+// Timeout limits how long the rest of the handlers have to handle a request,
+// by setting a deadline on the request's context. Handlers only observe the
+// deadline through the request's context. When the deadline passes before
+// anything has been written, a 504 is sent. A timeout of 0 or less sets no
+// deadline.
+func Timeout(timeout time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if timeout <= 0 {
+			c.Next()
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
+
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) && !c.Writer.Written() {
+			apierror.Abort(c, http.StatusGatewayTimeout, apierror.CodeRequestTimeout, "request timed out")
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package middleware_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/middleware"
+)
+
+func TestTimeout(t *testing.T) {
+	testCases := []struct {
+		testName       string
+		timeout        time.Duration
+		expectedStatus int
+	}{
+		{"no timeout", 0, http.StatusOK},
+		{"long enough", time.Minute, http.StatusOK},
+		{"too short", time.Millisecond, http.StatusGatewayTimeout},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			r := gin.New()
+			r.GET("/", middleware.Timeout(testcase.timeout), func(c *gin.Context) {
+				// Stands in for a database call, which gives up at the deadline
+				select {
+				case <-c.Request.Context().Done():
+				case <-time.After(50 * time.Millisecond):
+					c.Status(http.StatusOK)
+				}
+			})
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, "/", nil)
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+		})
+	}
+}
@@ -0,0 +1,4 @@
+// Package orphanedips periodically removes the IP associations of instances
+// which have nothing else stored, like those left behind by crashed upserts or
+// out-of-band deletes.
+package orphanedips // import go.hollow.sh/metadataservice/internal/orphanedips
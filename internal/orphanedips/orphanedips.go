@@ -0,0 +1,235 @@
+package orphanedips
+
+import (
+	"context"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/middleware"
+	"go.hollow.sh/metadataservice/internal/periodic"
+	"go.hollow.sh/metadataservice/internal/readcache"
+	"go.hollow.sh/metadataservice/internal/readonly"
+)
+
+const (
+	// DefaultInterval is how often orphaned IP associations are removed when
+	// no interval is given
+	DefaultInterval = time.Hour
+
+	// DefaultBatchSize is the number of IP associations checked in each
+	// transaction when no batch size is given
+	DefaultBatchSize = 100
+
+	// DefaultMinAge is how long an IP association is left alone after it was
+	// last updated, so associations pre-loaded ahead of their instance's
+	// metadata aren't removed before it arrives
+	DefaultMinAge = 24 * time.Hour
+
+	runTimeout = 5 * time.Minute
+
+	// firstID sorts before any other instance_ip_addresses id, so the first
+	// batch starts from the beginning of the table
+	firstID = "00000000-0000-0000-0000-000000000000"
+
+	selectBatchQuery = `SELECT id FROM instance_ip_addresses WHERE id > $1 ORDER BY id LIMIT $2`
+
+	// deleteOrphansQuery removes the orphaned associations with ids in the
+	// batch's range, returning their ids. Associations added within the range
+	// since the batch was selected are too recent to be removed. Instances
+	// with public keys or tags stored are known to the service, even without
+	// metadata or userdata, so their associations are kept.
+	deleteOrphansQuery = `DELETE FROM instance_ip_addresses
+WHERE id > $1 AND id <= $2 AND updated_at < $3
+AND NOT EXISTS (SELECT 1 FROM instance_metadata WHERE instance_metadata.id = instance_ip_addresses.instance_id)
+AND NOT EXISTS (SELECT 1 FROM instance_userdata WHERE instance_userdata.id = instance_ip_addresses.instance_id)
+AND NOT EXISTS (SELECT 1 FROM instance_public_keys WHERE instance_public_keys.instance_id = instance_ip_addresses.instance_id)
+AND NOT EXISTS (SELECT 1 FROM instance_tags WHERE instance_tags.instance_id = instance_ip_addresses.instance_id)
+RETURNING id`
+)
+
+// MetricRemoved is the number of orphaned IP associations removed
+var MetricRemoved = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "metadata_orphaned_ip_addresses_removed_total",
+	Help: "Number of IP associations removed because nothing else was stored for their instance.",
+})
+
+// Result summarizes a run of Reconcile
+type Result struct {
+	// Scanned is the number of IP associations checked
+	Scanned int64
+
+	// Removed is the number of orphaned IP associations removed
+	Removed int64
+
+	// RemovedIDs are the ids of the orphaned IP associations removed
+	RemovedIDs []string
+}
+
+// Reconcile removes the IP associations, last updated more than minAge ago,
+// of instances with nothing else stored: no metadata, userdata, public keys
+// or tags. The associations
+// are checked batchSize at a time, each batch removed in its own short
+// transaction, so live upserts are only ever held up by one batch. An upsert
+// storing an instance's metadata at the same time as its associations are
+// removed conflicts with the removal, and one of them is retried. The result
+// covers the batches made before any error.
+func Reconcile(ctx context.Context, db *sqlx.DB, batchSize int, minAge time.Duration) (Result, error) {
+	var result Result
+
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+
+	cutoff := time.Now().Add(-minAge).UTC()
+	cursor := firstID
+
+	for {
+		var ids []string
+
+		if err := db.SelectContext(ctx, &ids, selectBatchQuery, cursor, batchSize); err != nil {
+			return result, err
+		}
+
+		if len(ids) == 0 {
+			return result, nil
+		}
+
+		result.Scanned += int64(len(ids))
+
+		last := ids[len(ids)-1]
+
+		removed, err := removeBatch(ctx, db, cursor, last, cutoff)
+		if err != nil {
+			return result, err
+		}
+
+		result.Removed += int64(len(removed))
+		result.RemovedIDs = append(result.RemovedIDs, removed...)
+		MetricRemoved.Add(float64(len(removed)))
+
+		if len(ids) < batchSize {
+			return result, nil
+		}
+
+		cursor = last
+	}
+}
+
+// removeBatch removes the orphaned associations with ids after from, up to
+// and including to, in a transaction of their own, and returns their ids
+func removeBatch(ctx context.Context, db *sqlx.DB, from string, to string, cutoff time.Time) ([]string, error) {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+
+	if err := tx.SelectContext(ctx, &removed, deleteOrphansQuery, from, to, cutoff); err != nil {
+		_ = tx.Rollback()
+
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return removed, nil
+}
+
+// Reconciler periodically removes orphaned IP associations in the background.
+// A nil *Reconciler is valid, and removes nothing.
+type Reconciler struct {
+	db        *sqlx.DB
+	logger    *zap.Logger
+	readOnly  *readonly.Mode
+	readCache *readcache.Cache
+	batchSize int
+	minAge    time.Duration
+
+	runner *periodic.Runner
+}
+
+// NewReconciler returns a Reconciler which removes the orphaned IP
+// associations older than minAge every interval (or DefaultInterval, if
+// interval is 0), batchSize (or DefaultBatchSize, if batchSize is 0) at a time.
+// Runs are skipped while readOnly is enabled, and the cached lookups of the
+// removed associations are evicted from readCache. Either can be nil.
+func NewReconciler(db *sqlx.DB, logger *zap.Logger, readOnly *readonly.Mode, readCache *readcache.Cache, interval time.Duration, batchSize int, minAge time.Duration) *Reconciler {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+
+	r := &Reconciler{
+		db:        db,
+		logger:    logger,
+		readOnly:  readOnly,
+		readCache: readCache,
+		batchSize: batchSize,
+		minAge:    minAge,
+	}
+
+	r.runner = periodic.New(interval, r.reconcileWithTimeout)
+
+	return r
+}
+
+// Start begins periodically removing orphaned IP associations in the
+// background, until Stop is called or the context is cancelled.
+func (r *Reconciler) Start(ctx context.Context) {
+	if r == nil {
+		return
+	}
+
+	r.runner.Start(ctx)
+}
+
+// Stop stops the background removal started by Start
+func (r *Reconciler) Stop() {
+	if r == nil {
+		return
+	}
+
+	r.runner.Stop()
+}
+
+func (r *Reconciler) reconcileWithTimeout(ctx context.Context) {
+	// Nothing is written while the database is being worked on
+	if r.readOnly.Enabled() {
+		r.logger.Debug("skipping orphaned IP address removal in read-only mode")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, runTimeout)
+	defer cancel()
+
+	start := time.Now()
+
+	result, err := Reconcile(ctx, r.db, r.batchSize, r.minAge)
+
+	// Instances mustn't go on being identified by the removed associations
+	// from the cache, even when a later batch failed
+	middleware.EvictIPAddressLookups(r.readCache, result.RemovedIDs)
+
+	fields := []zap.Field{
+		zap.Int64("scanned", result.Scanned),
+		zap.Int64("removed", result.Removed),
+		zap.Duration("duration", time.Since(start)),
+	}
+
+	if err != nil {
+		r.logger.Warn("failed to remove orphaned IP addresses", append(fields, zap.Error(err))...)
+		return
+	}
+
+	r.logger.Info("removed orphaned IP addresses", fields...)
+}
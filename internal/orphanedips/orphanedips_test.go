@@ -0,0 +1,90 @@
+package orphanedips_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/volatiletech/sqlboiler/v4/boil"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	"go.hollow.sh/metadataservice/internal/models"
+	"go.hollow.sh/metadataservice/internal/orphanedips"
+)
+
+func TestNilReconciler(t *testing.T) {
+	var reconciler *orphanedips.Reconciler
+
+	// None of these should panic
+	reconciler.Start(context.TODO())
+	reconciler.Stop()
+}
+
+func TestReconcile(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	orphaned := &models.InstanceIPAddress{
+		InstanceID: "7a1e43bf-4a4a-4e0a-9a4c-0a3f0e2b6a11",
+		Address:    "10.99.0.1",
+		UpdatedAt:  time.Now().Add(-48 * time.Hour),
+	}
+
+	// Recently pre-loaded, so it's kept until the instance's metadata arrives
+	preloaded := &models.InstanceIPAddress{
+		InstanceID: "b6f0c3d2-8d0e-4f8f-8c0f-5d7a7c3e9b22",
+		Address:    "10.99.0.2",
+	}
+
+	// Instances with public keys or tags stored are kept too
+	withKeys := &models.InstanceIPAddress{
+		InstanceID: "c3a1d7e2-5b9f-4c1e-8a2d-6f4b3e7c9d33",
+		Address:    "10.99.0.3",
+		UpdatedAt:  time.Now().Add(-48 * time.Hour),
+	}
+
+	withTags := &models.InstanceIPAddress{
+		InstanceID: "d4b2e8f3-6c0a-4d2f-9b3e-7a5c4f8d0e44",
+		Address:    "10.99.0.4",
+		UpdatedAt:  time.Now().Add(-48 * time.Hour),
+	}
+
+	for _, ip := range []*models.InstanceIPAddress{orphaned, preloaded, withKeys, withTags} {
+		if err := ip.Insert(context.TODO(), testDB, boil.Infer()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := testDB.ExecContext(context.TODO(), `INSERT INTO instance_public_keys (instance_id, key_index, public_key, updated_at) VALUES ($1, 0, 'ssh-ed25519 AAAA', now())`, withKeys.InstanceID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := testDB.ExecContext(context.TODO(), `INSERT INTO instance_tags (instance_id, tag_key, tag_value, updated_at) VALUES ($1, 'team', 'metal', now())`, withTags.InstanceID); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := models.InstanceIPAddresses().Count(context.TODO(), testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A small batch size makes sure every batch is covered
+	result, err := orphanedips.Reconcile(context.TODO(), testDB, 2, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, before, result.Scanned)
+	assert.Equal(t, int64(1), result.Removed)
+	assert.Equal(t, []string{orphaned.ID}, result.RemovedIDs)
+
+	exists, err := models.InstanceIPAddressExists(context.TODO(), testDB, orphaned.ID)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	exists, err = models.InstanceIPAddressExists(context.TODO(), testDB, preloaded.ID)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	// The associations of instances with metadata or userdata are kept
+	after, err := models.InstanceIPAddresses().Count(context.TODO(), testDB)
+	assert.NoError(t, err)
+	assert.Equal(t, before-1, after)
+}
@@ -0,0 +1,4 @@
+// Package periodic runs a job at a fixed interval in the background, for the
+// service's housekeeping, like pruning and flushing, which happens between
+// requests.
+package periodic // import go.hollow.sh/metadataservice/internal/periodic
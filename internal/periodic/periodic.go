@@ -0,0 +1,78 @@
+package periodic
+
+import (
+	"context"
+	"time"
+)
+
+// Runner calls a function every interval in the background, from when it's
+// started until it's stopped. Runs never overlap: a run which takes longer
+// than the interval delays the next one. A nil *Runner is valid, and runs
+// nothing.
+type Runner struct {
+	interval  time.Duration
+	run       func(context.Context)
+	immediate bool
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// New returns a Runner calling run every interval, starting an interval after
+// it's started. Each run is passed a context which is cancelled when the
+// Runner is stopped.
+func New(interval time.Duration, run func(context.Context)) *Runner {
+	return &Runner{interval: interval, run: run}
+}
+
+// NewImmediate returns a Runner calling run as soon as it's started, then
+// every interval after that, like New.
+func NewImmediate(interval time.Duration, run func(context.Context)) *Runner {
+	return &Runner{interval: interval, run: run, immediate: true}
+}
+
+// Start begins calling the function in the background, until Stop is called
+// or the context is cancelled. The runs are passed a context derived from
+// ctx.
+func (r *Runner) Start(ctx context.Context) {
+	if r == nil {
+		return
+	}
+
+	ctx, r.cancel = context.WithCancel(ctx)
+	r.done = make(chan struct{})
+
+	go func() {
+		defer close(r.done)
+
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+
+		if r.immediate {
+			r.run(ctx)
+		}
+
+		for {
+			select {
+			case <-ticker.C:
+				r.run(ctx)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the background runs started by Start, cancelling the context of
+// a run in progress and waiting for it to return. It reports whether the
+// Runner had been started.
+func (r *Runner) Stop() bool {
+	if r == nil || r.cancel == nil {
+		return false
+	}
+
+	r.cancel()
+	<-r.done
+
+	return true
+}
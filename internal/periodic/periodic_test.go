@@ -0,0 +1,99 @@
+package periodic_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/periodic"
+)
+
+func TestNilRunner(t *testing.T) {
+	var runner *periodic.Runner
+
+	// None of these should panic
+	runner.Start(context.TODO())
+	assert.False(t, runner.Stop())
+}
+
+func TestRunner(t *testing.T) {
+	var runs int32
+
+	runner := periodic.New(10*time.Millisecond, func(context.Context) { atomic.AddInt32(&runs, 1) })
+
+	// A runner which was never started has nothing to stop
+	assert.False(t, runner.Stop())
+
+	runner.Start(context.TODO())
+
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&runs) >= 2 }, time.Second, time.Millisecond)
+	assert.True(t, runner.Stop())
+
+	// Nothing runs once it's stopped
+	stopped := atomic.LoadInt32(&runs)
+
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, stopped, atomic.LoadInt32(&runs))
+}
+
+func TestRunnerImmediate(t *testing.T) {
+	ran := make(chan struct{}, 1)
+
+	// The first run doesn't wait for the interval
+	runner := periodic.NewImmediate(time.Hour, func(context.Context) { ran <- struct{}{} })
+	runner.Start(context.TODO())
+
+	select {
+	case <-ran:
+	case <-time.After(time.Second):
+		t.Fatal("the runner didn't run when started")
+	}
+
+	assert.True(t, runner.Stop())
+}
+
+func TestRunnerContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+
+	runner := periodic.New(time.Hour, func(context.Context) {})
+	runner.Start(ctx)
+
+	cancel()
+
+	// Stop returns once the background runs have ended
+	assert.True(t, runner.Stop())
+}
+
+func TestRunnerStopCancelsRun(t *testing.T) {
+	started := make(chan struct{})
+	cancelled := make(chan error, 1)
+
+	// A run in progress is passed a context which is cancelled on Stop
+	runner := periodic.NewImmediate(time.Hour, func(ctx context.Context) {
+		close(started)
+		<-ctx.Done()
+		cancelled <- ctx.Err()
+	})
+	runner.Start(context.TODO())
+
+	<-started
+
+	assert.True(t, runner.Stop())
+	assert.ErrorIs(t, <-cancelled, context.Canceled)
+}
+
+func TestRunnerStartContext(t *testing.T) {
+	type key struct{}
+
+	values := make(chan interface{}, 1)
+
+	// The runs' context is derived from the one it was started with
+	runner := periodic.NewImmediate(time.Hour, func(ctx context.Context) { values <- ctx.Value(key{}) })
+	runner.Start(context.WithValue(context.TODO(), key{}, "started"))
+
+	assert.Equal(t, "started", <-values)
+	assert.True(t, runner.Stop())
+}
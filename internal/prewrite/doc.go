@@ -0,0 +1,4 @@
+// Package prewrite provides the client used to ask an external policy service
+// via HTTP whether a proposed metadata, userdata or IP address change may be
+// written.
+package prewrite // import go.hollow.sh/metadataservice/internal/prewrite
@@ -0,0 +1,152 @@
+package prewrite
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"go.hollow.sh/toolbox/version"
+)
+
+const (
+	// KindMetadata is the kind of change made when metadata is upserted
+	KindMetadata = "metadata"
+
+	// KindUserdata is the kind of change made when userdata is upserted
+	KindUserdata = "userdata"
+
+	// KindIPAddresses is the kind of change made when IP addresses are
+	// pre-loaded for an instance
+	KindIPAddresses = "ip-addresses"
+
+	// DefaultTimeout is how long the policy service is given to answer, when
+	// no other value has been configured
+	DefaultTimeout = 2 * time.Second
+
+	// maxResponseSize is the largest response body read from the policy
+	// service
+	maxResponseSize = 64 * 1024
+)
+
+var (
+	// ErrRejected is returned when the policy service doesn't approve a change
+	ErrRejected = errors.New("change rejected by pre-write hook")
+
+	// ErrUnavailable is returned when the policy service can't be reached, or
+	// doesn't answer in time or in the expected format. Changes aren't written
+	// when this happens.
+	ErrUnavailable = errors.New("pre-write hook unavailable")
+
+	errInvalidURL   = errors.New("invalid pre-write hook URL")
+	userAgentString = fmt.Sprintf("go-hollow-metadataservice-prewrite-client (%s)", version.String())
+)
+
+// Change describes a proposed change, as sent to the policy service
+type Change struct {
+	Kind        string          `json:"kind"`
+	ID          string          `json:"id"`
+	IPAddresses []string        `json:"ipAddresses"`
+	Metadata    json.RawMessage `json:"metadata,omitempty"`
+}
+
+// Decision represents the response we expect to receive from the policy
+// service. A change is only written when Allowed is true.
+type Decision struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// Hook POSTs proposed changes to a policy service before they're written. A
+// nil *Hook is valid, and approves every change.
+type Hook struct {
+	url     string
+	timeout time.Duration
+	client  *http.Client
+}
+
+// NewHook builds a new hook calling the policy service at hookURL. Each call
+// is given up to timeout to complete, or DefaultTimeout when timeout is 0.
+func NewHook(hookURL string, timeout time.Duration, httpClient *http.Client) (*Hook, error) {
+	parsedURL, err := url.Parse(hookURL)
+	if err != nil || parsedURL.Host == "" || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") {
+		return nil, fmt.Errorf("%w: %q", errInvalidURL, hookURL)
+	}
+
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	h := &Hook{
+		url:     parsedURL.String(),
+		timeout: timeout,
+		client:  httpClient,
+	}
+
+	return h, nil
+}
+
+// Check asks the policy service whether the change may be written. It returns
+// nil when the change is approved, an error wrapping ErrRejected when it's
+// denied, and an error wrapping ErrUnavailable when no decision could be
+// made.
+//
+// Check should be called before any database transaction is started for the
+// change, so a slow policy service doesn't hold any locks.
+func (h *Hook) Check(ctx context.Context, change Change) error {
+	if h == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	body, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgentString)
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrUnavailable, err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusForbidden {
+		return fmt.Errorf("%w: unexpected status code %d", ErrUnavailable, resp.StatusCode)
+	}
+
+	decision := Decision{}
+
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&decision); err != nil {
+		return fmt.Errorf("%w: invalid response: %s", ErrUnavailable, err)
+	}
+
+	if resp.StatusCode != http.StatusOK || !decision.Allowed {
+		if decision.Reason == "" {
+			return ErrRejected
+		}
+
+		return fmt.Errorf("%w: %s", ErrRejected, decision.Reason)
+	}
+
+	return nil
+}
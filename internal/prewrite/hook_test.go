@@ -0,0 +1,136 @@
+package prewrite_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/prewrite"
+)
+
+func policyServerMock(status int, body string, received *prewrite.Change) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if received != nil {
+			_ = json.NewDecoder(r.Body).Decode(received)
+		}
+
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+}
+
+func TestNewHook(t *testing.T) {
+	for _, hookURL := range []string{"", "not a url", "ftp://policy.example.com/check", "/check"} {
+		_, err := prewrite.NewHook(hookURL, 0, nil)
+		assert.Error(t, err, hookURL)
+	}
+
+	_, err := prewrite.NewHook("https://policy.example.com/check", 0, nil)
+	assert.NoError(t, err)
+}
+
+func TestCheck(t *testing.T) {
+	testCases := []struct {
+		testName    string
+		status      int
+		body        string
+		expectedErr error
+	}{
+		{
+			"approved",
+			http.StatusOK,
+			`{"allowed": true}`,
+			nil,
+		},
+		{
+			"denied",
+			http.StatusOK,
+			`{"allowed": false, "reason": "1.2.3.4 belongs to another project"}`,
+			prewrite.ErrRejected,
+		},
+		{
+			"forbidden",
+			http.StatusForbidden,
+			`{"allowed": false}`,
+			prewrite.ErrRejected,
+		},
+		{
+			"ok without a decision",
+			http.StatusOK,
+			`{}`,
+			prewrite.ErrRejected,
+		},
+		{
+			"invalid response",
+			http.StatusOK,
+			`allowed`,
+			prewrite.ErrUnavailable,
+		},
+		{
+			"server error",
+			http.StatusInternalServerError,
+			`{"allowed": true}`,
+			prewrite.ErrUnavailable,
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			received := prewrite.Change{}
+
+			server := policyServerMock(testcase.status, testcase.body, &received)
+			defer server.Close()
+
+			hook, err := prewrite.NewHook(server.URL, 0, server.Client())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			change := prewrite.Change{
+				Kind:        prewrite.KindMetadata,
+				ID:          "22bc79fc-3834-40b8-b734-30bef9634939",
+				IPAddresses: []string{"1.2.3.4"},
+				Metadata:    json.RawMessage(`{"hostname":"instance-a"}`),
+			}
+
+			err = hook.Check(context.TODO(), change)
+			if testcase.expectedErr == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, testcase.expectedErr)
+			}
+
+			assert.Equal(t, change, received)
+		})
+	}
+}
+
+func TestCheckTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer server.Close()
+
+	hook, err := prewrite.NewHook(server.URL, 10*time.Millisecond, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = hook.Check(context.TODO(), prewrite.Change{Kind: prewrite.KindUserdata})
+	assert.ErrorIs(t, err, prewrite.ErrUnavailable)
+}
+
+func TestCheckNilHook(t *testing.T) {
+	var hook *prewrite.Hook
+
+	assert.NoError(t, hook.Check(context.TODO(), prewrite.Change{Kind: prewrite.KindMetadata}))
+}
@@ -0,0 +1,3 @@
+// Package publickeys stores the SSH public keys served to each instance under
+// the ec2-style public-keys/ metadata items, separately from its metadata.
+package publickeys // import go.hollow.sh/metadataservice/internal/publickeys
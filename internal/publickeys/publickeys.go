@@ -0,0 +1,136 @@
+package publickeys
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/volatiletech/sqlboiler/v4/boil"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	deleteQuery = `DELETE FROM instance_public_keys WHERE instance_id = $1`
+
+	insertQuery = `INSERT INTO instance_public_keys (instance_id, key_index, key_name, public_key, updated_at) VALUES ($1, $2, $3, $4, $5)`
+
+	listQuery = `SELECT key_name, public_key, updated_at FROM instance_public_keys WHERE instance_id = $1 ORDER BY key_index`
+)
+
+// ErrInvalidKey is returned when a key isn't a valid SSH public key, or can't
+// be served under the given name
+var ErrInvalidKey = errors.New("invalid ssh public key")
+
+// Key is an SSH public key stored for an instance. Keys are served in the
+// order they were stored in, at their index in the list.
+type Key struct {
+	// Name is the name the key is listed with under public-keys/, like
+	// "0=name". The key's comment is used when it's empty.
+	Name string `db:"key_name" json:"name,omitempty"`
+
+	// PublicKey is the key in authorized_keys format, like
+	// "ssh-ed25519 AAAA... user@host"
+	PublicKey string `db:"public_key" json:"public_key"`
+
+	// UpdatedAt is when the instance's keys were last stored
+	UpdatedAt time.Time `db:"updated_at" json:"updated_at"`
+}
+
+// Validate checks that each key parses as a single SSH public key, and has a
+// name which can be listed under public-keys/
+func Validate(keys []Key) error {
+	for i, key := range keys {
+		_, _, _, rest, err := ssh.ParseAuthorizedKey([]byte(key.PublicKey))
+		if err != nil {
+			return fmt.Errorf("%w: key %d: %s", ErrInvalidKey, i, err.Error())
+		}
+
+		if len(bytes.TrimSpace(rest)) > 0 {
+			return fmt.Errorf("%w: key %d: only one key can be given", ErrInvalidKey, i)
+		}
+
+		if strings.ContainsAny(key.Name, "\r\n/") {
+			return fmt.Errorf("%w: key %d: the name can't contain newlines or slashes", ErrInvalidKey, i)
+		}
+	}
+
+	return nil
+}
+
+// Replace stores the keys for the instance, in order, replacing any keys
+// already stored for it. An empty list removes the instance's keys. It's meant
+// to be called in the same transaction as the metadata upsert when the keys
+// are given with it. The keys should already have been validated.
+func Replace(ctx context.Context, exec boil.ContextExecutor, instanceID string, keys []Key) error {
+	if _, err := exec.ExecContext(ctx, deleteQuery, instanceID); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+
+	for i, key := range keys {
+		name := key.Name
+		if name == "" {
+			name = comment(key.PublicKey)
+		}
+
+		if _, err := exec.ExecContext(ctx, insertQuery, instanceID, i, name, strings.TrimSpace(key.PublicKey), now); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete removes the keys stored for the instance, and returns the number of
+// keys removed. It's meant to be called in the same transaction as the rest of
+// the instance's records are deleted.
+func Delete(ctx context.Context, exec boil.ContextExecutor, instanceID string) (int64, error) {
+	result, err := exec.ExecContext(ctx, deleteQuery, instanceID)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// comment returns the comment of a valid key, used as its name when it isn't
+// given one
+func comment(publicKey string) string {
+	_, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(publicKey))
+	if err != nil || strings.ContainsAny(comment, "\r\n/") {
+		return ""
+	}
+
+	return comment
+}
+
+// List returns the keys stored for the instance, in order. An instance
+// without keys has an empty list.
+func List(ctx context.Context, db sqlx.QueryerContext, instanceID string) ([]Key, error) {
+	keys := []Key{}
+
+	if err := sqlx.SelectContext(ctx, db, &keys, listQuery, instanceID); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// LastUpdated returns when the keys in the list were stored, or the zero time
+// for an empty list
+func LastUpdated(keys []Key) time.Time {
+	var updated time.Time
+
+	for _, key := range keys {
+		if key.UpdatedAt.After(updated) {
+			updated = key.UpdatedAt
+		}
+	}
+
+	return updated
+}
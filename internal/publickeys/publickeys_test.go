@@ -0,0 +1,86 @@
+package publickeys_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	"go.hollow.sh/metadataservice/internal/publickeys"
+)
+
+const (
+	testKeyAlice = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIId4BdAdnHq+4t7NfTXRiJoSNi4fg/LiYkS5qEFyDixg alice@example.com"
+	testKeyBob   = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIPYcFtQ+Xh3oShMOplJTsTFzmaqNhE3xGnUPa2p7t91I bob"
+)
+
+func TestValidate(t *testing.T) {
+	testCases := []struct {
+		testName string
+		keys     []publickeys.Key
+		valid    bool
+	}{
+		{"no keys", nil, true},
+		{"valid keys", []publickeys.Key{{PublicKey: testKeyAlice}, {Name: "deploy", PublicKey: testKeyBob}}, true},
+		{"trailing newline", []publickeys.Key{{PublicKey: testKeyAlice + "\n"}}, true},
+		{"not a key", []publickeys.Key{{PublicKey: "ssh-ed25519 not-a-key"}}, false},
+		{"empty key", []publickeys.Key{{Name: "empty"}}, false},
+		{"several keys", []publickeys.Key{{PublicKey: testKeyAlice + "\n" + testKeyBob}}, false},
+		{"name with a slash", []publickeys.Key{{Name: "a/b", PublicKey: testKeyAlice}}, false},
+		{"name with a newline", []publickeys.Key{{Name: "a\nb", PublicKey: testKeyAlice}}, false},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			err := publickeys.Validate(testcase.keys)
+
+			if testcase.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, publickeys.ErrInvalidKey)
+			}
+		})
+	}
+}
+
+func TestReplaceAndList(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+	instanceID := dbtools.FixtureInstanceA.InstanceID
+
+	keys, err := publickeys.List(context.TODO(), testDB, instanceID)
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+
+	err = publickeys.Replace(context.TODO(), testDB, instanceID, []publickeys.Key{{Name: "deploy", PublicKey: testKeyBob}, {PublicKey: testKeyAlice + "\n"}})
+	assert.NoError(t, err)
+
+	keys, err = publickeys.List(context.TODO(), testDB, instanceID)
+	assert.NoError(t, err)
+
+	if assert.Len(t, keys, 2) {
+		assert.Equal(t, "deploy", keys[0].Name)
+		assert.Equal(t, testKeyBob, keys[0].PublicKey)
+
+		// Unnamed keys are named after their comment
+		assert.Equal(t, "alice@example.com", keys[1].Name)
+		assert.Equal(t, testKeyAlice, keys[1].PublicKey)
+
+		assert.False(t, publickeys.LastUpdated(keys).IsZero())
+	}
+
+	// Replacing the keys removes those which aren't given again
+	err = publickeys.Replace(context.TODO(), testDB, instanceID, []publickeys.Key{{PublicKey: testKeyAlice}})
+	assert.NoError(t, err)
+
+	keys, err = publickeys.List(context.TODO(), testDB, instanceID)
+	assert.NoError(t, err)
+	assert.Len(t, keys, 1)
+
+	err = publickeys.Replace(context.TODO(), testDB, instanceID, []publickeys.Key{})
+	assert.NoError(t, err)
+
+	keys, err = publickeys.List(context.TODO(), testDB, instanceID)
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+}
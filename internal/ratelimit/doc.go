@@ -0,0 +1,4 @@
+// Package ratelimit provides an in-memory, per-key token bucket rate limiter,
+// used to keep a single instance polling in a tight loop from degrading reads
+// for everyone else.
+package ratelimit // import go.hollow.sh/metadataservice/internal/ratelimit
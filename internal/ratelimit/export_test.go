@@ -0,0 +1,13 @@
+package ratelimit
+
+import "time"
+
+// AllowAt exposes allowAt to the tests
+func (l *Limiter) AllowAt(key string, now time.Time) (bool, time.Duration) {
+	return l.allowAt(key, now)
+}
+
+// CleanupAt exposes cleanupAt to the tests
+func (l *Limiter) CleanupAt(now time.Time) {
+	l.cleanupAt(now)
+}
@@ -0,0 +1,171 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"go.hollow.sh/metadataservice/internal/periodic"
+)
+
+const (
+	// DefaultBurst is the default number of requests a key can make at once,
+	// before being limited to the rate
+	DefaultBurst = 20
+
+	// DefaultIdleTimeout is how long a key's bucket is kept after its last
+	// request when no timeout is given. An idle bucket refills completely
+	// well before then at any sensible rate, so dropping it changes nothing.
+	DefaultIdleTimeout = 10 * time.Minute
+)
+
+// MetricThrottled counts the requests rejected for exceeding the rate limit,
+// by route.
+var MetricThrottled = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "metadata_read_requests_throttled_total",
+	Help: "Number of instance read requests rejected with a 429 for exceeding the per-instance rate limit.",
+}, []string{"route"})
+
+type bucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// Limiter limits the rate of requests made for each key with a token bucket:
+// each key can make up to burst requests at once, refilled at rate requests
+// per second. Buckets which haven't been used for the idle timeout are
+// dropped by the cleanup started with Start. A nil *Limiter is valid, and
+// allows everything.
+type Limiter struct {
+	rate        float64
+	burst       float64
+	idleTimeout time.Duration
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+
+	runner *periodic.Runner
+}
+
+// New returns a Limiter allowing rate requests per second for each key, with
+// bursts of up to burst requests (DefaultBurst when burst isn't positive).
+// Idle buckets are dropped after idleTimeout (DefaultIdleTimeout when it
+// isn't positive). It returns nil, allowing everything, when rate isn't
+// positive.
+func New(rate float64, burst int, idleTimeout time.Duration) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	if burst <= 0 {
+		burst = DefaultBurst
+	}
+
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultIdleTimeout
+	}
+
+	l := &Limiter{
+		rate:        rate,
+		burst:       float64(burst),
+		idleTimeout: idleTimeout,
+		buckets:     make(map[string]*bucket),
+	}
+
+	l.runner = periodic.New(idleTimeout, func(context.Context) { l.Cleanup() })
+
+	return l
+}
+
+// Allow takes a token from the key's bucket, reporting whether the request
+// can go ahead. When it can't, it returns how long until a token is
+// available.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	return l.allowAt(key, time.Now())
+}
+
+func (l *Limiter) allowAt(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, lastSeen: now}
+		l.buckets[key] = b
+	}
+
+	if elapsed := now.Sub(b.lastSeen).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(l.burst, b.tokens+elapsed*l.rate)
+	}
+
+	b.lastSeen = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+
+		return true, 0
+	}
+
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+
+	return false, wait
+}
+
+// Cleanup drops the buckets which haven't been used for the idle timeout.
+func (l *Limiter) Cleanup() {
+	if l == nil {
+		return
+	}
+
+	l.cleanupAt(time.Now())
+}
+
+func (l *Limiter) cleanupAt(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, b := range l.buckets {
+		if now.Sub(b.lastSeen) >= l.idleTimeout {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Len returns the number of buckets currently kept.
+func (l *Limiter) Len() int {
+	if l == nil {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.buckets)
+}
+
+// Start begins periodically dropping idle buckets in the background, until
+// Stop is called or the context is cancelled.
+func (l *Limiter) Start(ctx context.Context) {
+	if l == nil {
+		return
+	}
+
+	l.runner.Start(ctx)
+}
+
+// Stop stops the background cleanup started by Start.
+func (l *Limiter) Stop() {
+	if l == nil {
+		return
+	}
+
+	l.runner.Stop()
+}
@@ -0,0 +1,73 @@
+package ratelimit_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/ratelimit"
+)
+
+func TestNilLimiter(t *testing.T) {
+	var limiter *ratelimit.Limiter
+
+	// None of these should panic
+	allowed, _ := limiter.Allow("key")
+	assert.True(t, allowed)
+
+	limiter.Cleanup()
+	assert.Zero(t, limiter.Len())
+
+	assert.Nil(t, ratelimit.New(0, 10, 0))
+}
+
+func TestLimiter(t *testing.T) {
+	limiter := ratelimit.New(2, 3, time.Minute)
+	now := time.Now()
+
+	// The burst is allowed straight away
+	for i := 0; i < 3; i++ {
+		allowed, _ := limiter.AllowAt("a", now)
+		assert.True(t, allowed, i)
+	}
+
+	allowed, wait := limiter.AllowAt("a", now)
+	assert.False(t, allowed)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	// Other keys have their own bucket
+	allowed, _ = limiter.AllowAt("b", now)
+	assert.True(t, allowed)
+
+	// The bucket refills at the rate
+	allowed, _ = limiter.AllowAt("a", now.Add(500*time.Millisecond))
+	assert.True(t, allowed)
+
+	allowed, _ = limiter.AllowAt("a", now.Add(500*time.Millisecond))
+	assert.False(t, allowed)
+
+	// But never beyond the burst
+	for i := 0; i < 3; i++ {
+		allowed, _ := limiter.AllowAt("a", now.Add(time.Hour))
+		assert.True(t, allowed, i)
+	}
+
+	allowed, _ = limiter.AllowAt("a", now.Add(time.Hour))
+	assert.False(t, allowed)
+}
+
+func TestLimiterCleanup(t *testing.T) {
+	limiter := ratelimit.New(1, 1, time.Minute)
+	now := time.Now()
+
+	limiter.AllowAt("a", now)
+	limiter.AllowAt("b", now.Add(30*time.Second))
+	assert.Equal(t, 2, limiter.Len())
+
+	limiter.CleanupAt(now.Add(time.Minute))
+	assert.Equal(t, 1, limiter.Len())
+
+	limiter.CleanupAt(now.Add(2 * time.Minute))
+	assert.Zero(t, limiter.Len())
+}
@@ -0,0 +1,4 @@
+// Package readcache keeps recently read metadata, userdata and IP address
+// lookups in a size-bounded, in-memory LRU cache, so repeated reads for an
+// instance don't all have to hit the database.
+package readcache // import go.hollow.sh/metadataservice/internal/readcache
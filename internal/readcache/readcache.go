@@ -0,0 +1,179 @@
+package readcache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// DefaultSize is the default maximum number of entries kept in the cache
+	DefaultSize = 10000
+
+	// DefaultTTL is the default time entries are served from the cache for
+	DefaultTTL = 30 * time.Second
+
+	resultHit  = "hit"
+	resultMiss = "miss"
+)
+
+// MetricLookups counts the lookups made in the cache, by whether they were
+// served from it or had to be read from the database.
+var MetricLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "metadata_read_cache_lookups_total",
+	Help: "Number of reads served from the in-memory read cache (hit), or which had to be read from the db (miss).",
+}, []string{"result"})
+
+type entry struct {
+	key      string
+	value    interface{}
+	storedAt time.Time
+}
+
+// Cache is an LRU cache of values read from the database, each served for up
+// to the cache's TTL. A nil *Cache is valid, and caches nothing.
+type Cache struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// New returns a Cache holding up to size entries (DefaultSize when size isn't
+// positive), each served for up to ttl (DefaultTTL when ttl isn't positive).
+func New(size int, ttl time.Duration) *Cache {
+	if size <= 0 {
+		size = DefaultSize
+	}
+
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+
+	return &Cache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Get returns the cached value for the key, if there's one which is younger
+// than the cache's TTL. Callers must treat the value as read-only.
+func (c *Cache) Get(key string) (interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if ok && time.Since(elem.Value.(*entry).storedAt) > c.ttl {
+		c.remove(elem)
+
+		ok = false
+	}
+
+	if !ok {
+		MetricLookups.WithLabelValues(resultMiss).Inc()
+		return nil, false
+	}
+
+	MetricLookups.WithLabelValues(resultHit).Inc()
+
+	c.order.MoveToFront(elem)
+
+	return elem.Value.(*entry).value, true
+}
+
+// Add caches a value freshly read from the database, evicting the least
+// recently used entry when the cache is full. Callers must treat the value as
+// read-only from then on.
+func (c *Cache) Add(key string, value interface{}) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = &entry{key: key, value: value, storedAt: time.Now()}
+		c.order.MoveToFront(elem)
+
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&entry{key: key, value: value, storedAt: time.Now()})
+
+	if c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+// Remove evicts the key from the cache, and reports whether it was cached.
+func (c *Cache) Remove(key string) bool {
+	if c == nil {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if ok {
+		c.remove(elem)
+	}
+
+	return ok
+}
+
+// RemoveFunc evicts every entry for which match returns true, and returns the
+// number evicted.
+func (c *Cache) RemoveFunc(match func(key string, value interface{}) bool) int {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := 0
+
+	for elem := c.order.Front(); elem != nil; {
+		next := elem.Next()
+
+		if e := elem.Value.(*entry); match(e.key, e.value) {
+			c.remove(elem)
+			removed++
+		}
+
+		elem = next
+	}
+
+	return removed
+}
+
+// Len returns the number of entries in the cache, including any which have
+// outlived the TTL but haven't been evicted yet.
+func (c *Cache) Len() int {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
+
+func (c *Cache) remove(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.entries, elem.Value.(*entry).key)
+}
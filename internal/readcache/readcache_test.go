@@ -0,0 +1,106 @@
+package readcache_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/readcache"
+)
+
+func TestNilCache(t *testing.T) {
+	var cache *readcache.Cache
+
+	// None of these should panic
+	cache.Add("key", "value")
+	cache.Remove("key")
+	cache.RemoveFunc(func(string, interface{}) bool { return true })
+
+	_, ok := cache.Get("key")
+	assert.False(t, ok)
+	assert.Equal(t, 0, cache.Len())
+}
+
+func TestGetAndRemove(t *testing.T) {
+	cache := readcache.New(10, time.Minute)
+
+	_, ok := cache.Get("key")
+	assert.False(t, ok)
+
+	cache.Add("key", "value")
+
+	v, ok := cache.Get("key")
+	assert.True(t, ok)
+	assert.Equal(t, "value", v)
+
+	cache.Add("key", "newer value")
+
+	v, _ = cache.Get("key")
+	assert.Equal(t, "newer value", v)
+
+	assert.True(t, cache.Remove("key"))
+
+	_, ok = cache.Get("key")
+	assert.False(t, ok)
+
+	// Removing a key which isn't cached reports nothing was evicted
+	assert.False(t, cache.Remove("key"))
+}
+
+func TestEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := readcache.New(2, time.Minute)
+
+	cache.Add("a", 1)
+	cache.Add("b", 2)
+
+	// Reading a makes b the least recently used entry
+	_, _ = cache.Get("a")
+
+	cache.Add("c", 3)
+
+	assert.Equal(t, 2, cache.Len())
+
+	_, ok := cache.Get("b")
+	assert.False(t, ok)
+
+	for _, key := range []string{"a", "c"} {
+		_, ok := cache.Get(key)
+		assert.True(t, ok, key)
+	}
+}
+
+func TestExpiresAfterTTL(t *testing.T) {
+	cache := readcache.New(10, 10*time.Millisecond)
+
+	cache.Add("key", "value")
+
+	time.Sleep(20 * time.Millisecond)
+
+	_, ok := cache.Get("key")
+	assert.False(t, ok)
+	assert.Equal(t, 0, cache.Len())
+}
+
+func TestRemoveFunc(t *testing.T) {
+	cache := readcache.New(10, time.Minute)
+
+	cache.Add("ip:10.0.0.1", "a")
+	cache.Add("ip:10.0.0.2", "b")
+	cache.Add("metadata:a", "a")
+
+	removed := cache.RemoveFunc(func(key string, value interface{}) bool {
+		return strings.HasPrefix(key, "ip:") && value == "a"
+	})
+
+	assert.Equal(t, 1, removed)
+
+	_, ok := cache.Get("ip:10.0.0.1")
+	assert.False(t, ok)
+
+	for _, key := range []string{"ip:10.0.0.2", "metadata:a"} {
+		_, ok := cache.Get(key)
+		assert.True(t, ok, key)
+	}
+}
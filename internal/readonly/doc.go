@@ -0,0 +1,4 @@
+// Package readonly holds the service's read-only (maintenance) mode, which
+// can be switched on at runtime so writes are rejected cleanly while the
+// database is being worked on, and reads carry on being served.
+package readonly // import go.hollow.sh/metadataservice/internal/readonly
@@ -0,0 +1,52 @@
+package readonly
+
+import (
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// MetricReadOnly is 1 while the service is in read-only mode, and 0 otherwise
+var MetricReadOnly = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "metadata_read_only_mode",
+	Help: "Whether the service is in read-only mode (1), rejecting writes, or not (0).",
+})
+
+// Mode is whether the service is in read-only mode. It's safe to use from
+// multiple goroutines. A nil *Mode is valid, and is never read-only.
+type Mode struct {
+	enabled atomic.Bool
+}
+
+// New returns a Mode, starting out read-only when enabled is true
+func New(enabled bool) *Mode {
+	m := &Mode{}
+	m.Set(enabled)
+
+	return m
+}
+
+// Enabled reports whether the service is in read-only mode
+func (m *Mode) Enabled() bool {
+	if m == nil {
+		return false
+	}
+
+	return m.enabled.Load()
+}
+
+// Set switches read-only mode on or off
+func (m *Mode) Set(enabled bool) {
+	if m == nil {
+		return
+	}
+
+	m.enabled.Store(enabled)
+
+	if enabled {
+		MetricReadOnly.Set(1)
+	} else {
+		MetricReadOnly.Set(0)
+	}
+}
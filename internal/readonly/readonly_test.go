@@ -0,0 +1,30 @@
+package readonly_test
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/readonly"
+)
+
+func TestNilMode(t *testing.T) {
+	var mode *readonly.Mode
+
+	// Setting a nil mode doesn't panic, and it's never read-only
+	mode.Set(true)
+	assert.False(t, mode.Enabled())
+}
+
+func TestMode(t *testing.T) {
+	mode := readonly.New(true)
+
+	assert.True(t, mode.Enabled())
+	assert.Equal(t, float64(1), testutil.ToFloat64(readonly.MetricReadOnly))
+
+	mode.Set(false)
+
+	assert.False(t, mode.Enabled())
+	assert.Equal(t, float64(0), testutil.ToFloat64(readonly.MetricReadOnly))
+}
@@ -0,0 +1,5 @@
+// Package sessiontoken mints and verifies the short-lived, IMDSv2-style
+// session tokens instances can present when reading their data. Tokens are
+// HMAC-signed and bound to the address they were issued to, so nothing needs
+// to be stored.
+package sessiontoken // import go.hollow.sh/metadataservice/internal/sessiontoken
@@ -0,0 +1,82 @@
+package sessiontoken_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/sessiontoken"
+)
+
+var testKey = []byte(strings.Repeat("k", 32))
+
+func TestNewIssuer(t *testing.T) {
+	_, err := sessiontoken.NewIssuer([]byte("short"), 0)
+	assert.ErrorIs(t, err, sessiontoken.ErrInvalidKey)
+
+	_, err = sessiontoken.NewIssuer(testKey, 0)
+	assert.NoError(t, err)
+}
+
+func TestIssueAndVerify(t *testing.T) {
+	issuer, err := sessiontoken.NewIssuer(testKey, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, ttl, err := issuer.Issue("10.1.2.3", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, time.Minute, ttl)
+
+	assert.NoError(t, issuer.Verify(token, "10.1.2.3"))
+	assert.ErrorIs(t, issuer.Verify(token, "10.1.2.4"), sessiontoken.ErrAddressMismatch)
+
+	// Tokens signed with another key, or tampered with, are rejected
+	other, err := sessiontoken.NewIssuer([]byte(strings.Repeat("o", 32)), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.ErrorIs(t, other.Verify(token, "10.1.2.3"), sessiontoken.ErrInvalidToken)
+
+	for _, invalid := range []string{"", "garbage", token + "x", "x" + token} {
+		assert.ErrorIs(t, issuer.Verify(invalid, "10.1.2.3"), sessiontoken.ErrInvalidToken, invalid)
+	}
+}
+
+func TestIssueTTL(t *testing.T) {
+	issuer, err := sessiontoken.NewIssuer(testKey, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = issuer.Issue("10.1.2.3", 0)
+	assert.ErrorIs(t, err, sessiontoken.ErrInvalidTTL)
+
+	// TTLs above the max are clamped
+	_, ttl, err := issuer.Issue("10.1.2.3", 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, time.Hour, ttl)
+}
+
+func TestVerifyExpired(t *testing.T) {
+	issuer, err := sessiontoken.NewIssuer(testKey, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, _, err := issuer.Issue("10.1.2.3", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+
+	assert.ErrorIs(t, issuer.Verify(token, "10.1.2.3"), sessiontoken.ErrExpired)
+}
@@ -0,0 +1,4 @@
+// Package stalecache keeps the last data successfully read from the database,
+// so instances can still be served while the database is unavailable, for as
+// long as the data isn't too stale.
+package stalecache // import go.hollow.sh/metadataservice/internal/stalecache
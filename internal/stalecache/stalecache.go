@@ -0,0 +1,110 @@
+package stalecache
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	resultFresh    = "fresh"
+	resultStale    = "stale"
+	resultTooStale = "too_stale"
+)
+
+// ErrTooStale is returned when the database couldn't be read, and the cached
+// data is older than the maximum staleness, so it can't be served either.
+var ErrTooStale = errors.New("cached data is too stale to serve")
+
+// MetricReads counts the reads made through the cache, by whether they were
+// served fresh from the database, served stale from the cache, or rejected as
+// too stale.
+var MetricReads = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "metadata_stale_cache_reads_total",
+	Help: "Number of reads served fresh from the db, served stale from the cache during a db error, or rejected because the cached data was too stale.",
+}, []string{"result"})
+
+type entry struct {
+	value    interface{}
+	storedAt time.Time
+}
+
+// Cache keeps the most recent value read from the database for each key. A
+// nil *Cache is valid, and caches nothing.
+type Cache struct {
+	maxStaleness time.Duration
+
+	mu      sync.RWMutex
+	entries map[string]entry
+}
+
+// New returns a Cache whose entries can be served for up to maxStaleness after
+// they were read from the database. A maxStaleness of 0 means no limit.
+func New(maxStaleness time.Duration) *Cache {
+	return &Cache{
+		maxStaleness: maxStaleness,
+		entries:      make(map[string]entry),
+	}
+}
+
+// Store records a value freshly read from the database. Callers must treat
+// the value as read-only from then on.
+func (c *Cache) Store(key string, value interface{}) {
+	if c == nil {
+		return
+	}
+
+	MetricReads.WithLabelValues(resultFresh).Inc()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[key] = entry{value: value, storedAt: time.Now()}
+}
+
+// Fallback is called when reading the key from the database failed with err.
+// It returns the cached value if there's one within the maximum staleness, an
+// error wrapping ErrTooStale if the cached value is older than that, or err if
+// nothing has been cached.
+func (c *Cache) Fallback(key string, err error) (interface{}, error) {
+	if c == nil {
+		return nil, err
+	}
+
+	c.mu.RLock()
+	e, ok := c.entries[key]
+	c.mu.RUnlock()
+
+	if !ok {
+		return nil, err
+	}
+
+	age := time.Since(e.storedAt)
+
+	if c.maxStaleness > 0 && age > c.maxStaleness {
+		MetricReads.WithLabelValues(resultTooStale).Inc()
+
+		return nil, fmt.Errorf("%w: cached %s ago, after %s", ErrTooStale, age.Round(time.Second), err.Error())
+	}
+
+	MetricReads.WithLabelValues(resultStale).Inc()
+
+	return e.value, nil
+}
+
+// Forget removes the key from the cache, so data which has been deleted is
+// never served from it.
+func (c *Cache) Forget(key string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, key)
+}
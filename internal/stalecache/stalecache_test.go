@@ -0,0 +1,68 @@
+package stalecache_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/stalecache"
+)
+
+var errDB = errors.New("db unavailable")
+
+func TestNilCache(t *testing.T) {
+	var cache *stalecache.Cache
+
+	// None of these should panic
+	cache.Store("key", "value")
+	cache.Forget("key")
+
+	v, err := cache.Fallback("key", errDB)
+	assert.Nil(t, v)
+	assert.ErrorIs(t, err, errDB)
+}
+
+func TestFallback(t *testing.T) {
+	cache := stalecache.New(0)
+
+	// Nothing cached, so the original error is returned
+	_, err := cache.Fallback("key", errDB)
+	assert.ErrorIs(t, err, errDB)
+
+	cache.Store("key", "value")
+
+	v, err := cache.Fallback("key", errDB)
+	assert.NoError(t, err)
+	assert.Equal(t, "value", v)
+
+	// Forgotten data is never served
+	cache.Forget("key")
+
+	_, err = cache.Fallback("key", errDB)
+	assert.ErrorIs(t, err, errDB)
+}
+
+func TestFallbackTooStale(t *testing.T) {
+	cache := stalecache.New(10 * time.Millisecond)
+
+	cache.Store("key", "value")
+
+	v, err := cache.Fallback("key", errDB)
+	assert.NoError(t, err)
+	assert.Equal(t, "value", v)
+
+	time.Sleep(20 * time.Millisecond)
+
+	v, err = cache.Fallback("key", errDB)
+	assert.Nil(t, v)
+	assert.ErrorIs(t, err, stalecache.ErrTooStale)
+
+	// A fresh read makes the data servable again
+	cache.Store("key", "newer value")
+
+	v, err = cache.Fallback("key", errDB)
+	assert.NoError(t, err)
+	assert.Equal(t, "newer value", v)
+}
@@ -0,0 +1,134 @@
+package upserter
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// defaultRetryInitialInterval is the longest wait before the first retry when
+// crdb.retry_initial_interval isn't set
+const defaultRetryInitialInterval = 50 * time.Millisecond
+
+// Backoff determines how long to wait before each retry of a failed upsert.
+type Backoff interface {
+	// Delay returns how long to wait before the given retry attempt, where the
+	// first retry is attempt 1.
+	Delay(attempt int) time.Duration
+}
+
+// BackoffFunc adapts a plain function to the Backoff interface.
+type BackoffFunc func(attempt int) time.Duration
+
+// Delay calls f(attempt).
+func (f BackoffFunc) Delay(attempt int) time.Duration {
+	return f(attempt)
+}
+
+// JitterBackoff waits a random duration of up to maxInterval before each
+// retry.
+func JitterBackoff(maxInterval time.Duration) Backoff {
+	return BackoffFunc(func(int) time.Duration {
+		if maxInterval <= 0 {
+			return 0
+		}
+
+		return time.Duration(rand.Int63n(int64(maxInterval)))
+	})
+}
+
+// ExponentialBackoff waits a random duration before each retry ("full
+// jitter"), of up to initialInterval before the first retry, doubling with
+// each retry after that until it reaches maxInterval. This is the default
+// strategy, using crdb.retry_initial_interval and crdb.retry_interval.
+func ExponentialBackoff(initialInterval, maxInterval time.Duration) Backoff {
+	return BackoffFunc(func(attempt int) time.Duration {
+		if initialInterval <= 0 || maxInterval <= 0 {
+			return 0
+		}
+
+		interval := initialInterval
+
+		for i := 1; i < attempt && interval < maxInterval; i++ {
+			interval *= 2
+		}
+
+		if interval > maxInterval {
+			interval = maxInterval
+		}
+
+		return time.Duration(rand.Int63n(int64(interval)))
+	})
+}
+
+// ConstantBackoff waits the same interval before each retry, which makes the
+// retry path deterministic (for example, in tests).
+func ConstantBackoff(interval time.Duration) Backoff {
+	return BackoffFunc(func(int) time.Duration {
+		return interval
+	})
+}
+
+var (
+	backoffMu       sync.RWMutex
+	backoffOverride Backoff
+)
+
+// SetBackoff overrides the strategy used to wait between upsert retries.
+// Passing nil restores the default exponential backoff.
+func SetBackoff(b Backoff) {
+	backoffMu.Lock()
+	defer backoffMu.Unlock()
+
+	backoffOverride = b
+}
+
+// currentBackoff returns the configured backoff strategy, falling back to an
+// exponential backoff capped at crdb.retry_interval.
+func currentBackoff() Backoff {
+	backoffMu.RLock()
+	defer backoffMu.RUnlock()
+
+	if backoffOverride != nil {
+		return backoffOverride
+	}
+
+	initialInterval := viper.GetDuration("crdb.retry_initial_interval")
+	if initialInterval <= 0 {
+		initialInterval = defaultRetryInitialInterval
+	}
+
+	return ExponentialBackoff(initialInterval, viper.GetDuration("crdb.retry_interval"))
+}
+
+// retryDeadline returns when retrying an upsert started at start has to stop
+// by: the deadline of the context, or the end of the total time budget when
+// it's sooner. The zero time is returned when there's neither.
+func retryDeadline(ctx context.Context, start time.Time, maxRetryDuration time.Duration) time.Time {
+	deadline, _ := ctx.Deadline()
+
+	if maxRetryDuration > 0 {
+		if budget := start.Add(maxRetryDuration); deadline.IsZero() || budget.Before(deadline) {
+			deadline = budget
+		}
+	}
+
+	return deadline
+}
+
+// waitToRetry waits for the delay before the next retry, returning the
+// context's error straight away if it's canceled in the meantime.
+func waitToRetry(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
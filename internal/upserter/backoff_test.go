@@ -0,0 +1,105 @@
+package upserter_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/volatiletech/sqlboiler/v4/types"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/models"
+	"go.hollow.sh/metadataservice/internal/upserter"
+)
+
+func TestJitterBackoff(t *testing.T) {
+	backoff := upserter.JitterBackoff(10 * time.Millisecond)
+
+	for i := 1; i <= 100; i++ {
+		delay := backoff.Delay(i)
+
+		assert.GreaterOrEqual(t, delay, time.Duration(0))
+		assert.Less(t, delay, 10*time.Millisecond)
+	}
+
+	// A zero interval shouldn't panic, and never waits
+	assert.Equal(t, time.Duration(0), upserter.JitterBackoff(0).Delay(1))
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	backoff := upserter.ExponentialBackoff(10*time.Millisecond, 50*time.Millisecond)
+
+	// The longest possible wait doubles with each retry, up to the max
+	limits := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 50 * time.Millisecond, 50 * time.Millisecond}
+
+	for i, limit := range limits {
+		for j := 0; j < 100; j++ {
+			delay := backoff.Delay(i + 1)
+
+			assert.GreaterOrEqual(t, delay, time.Duration(0))
+			assert.Less(t, delay, limit)
+		}
+	}
+
+	// Large attempt numbers don't overflow
+	assert.Less(t, backoff.Delay(1000), 50*time.Millisecond)
+
+	// A zero interval shouldn't panic, and never waits
+	assert.Equal(t, time.Duration(0), upserter.ExponentialBackoff(0, time.Second).Delay(1))
+	assert.Equal(t, time.Duration(0), upserter.ExponentialBackoff(time.Second, 0).Delay(1))
+}
+
+func TestConstantBackoff(t *testing.T) {
+	backoff := upserter.ConstantBackoff(5 * time.Millisecond)
+
+	for i := 1; i <= 5; i++ {
+		assert.Equal(t, 5*time.Millisecond, backoff.Delay(i))
+	}
+}
+
+// retryUpsertConfig makes every upsert attempt fail in a retryable way, and
+// wait a long time before each retry
+func retryUpsertConfig(t *testing.T) {
+	viper.Set("crdb.max_retries", 5)
+	viper.Set("crdb.tx_timeout", time.Nanosecond)
+	upserter.SetBackoff(upserter.ConstantBackoff(time.Hour))
+
+	t.Cleanup(func() {
+		viper.Set("crdb.tx_timeout", 15*time.Second)
+		upserter.SetBackoff(nil)
+	})
+}
+
+// Test that an upsert stops waiting to retry as soon as its context is
+// canceled, returning the context's error
+func TestUpsertRetryCanceled(t *testing.T) {
+	retryUpsertConfig(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	err := upserter.UpsertMetadata(ctx, unreachableDB(t), zap.NewNop(), instanceID, instanceIPs, &models.InstanceMetadatum{ID: instanceID, Metadata: types.JSON(instanceMetadata0)})
+
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+// Test that an upsert doesn't wait to retry past its context's deadline
+func TestUpsertRetryStopsAtContextDeadline(t *testing.T) {
+	retryUpsertConfig(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	start := time.Now()
+	err := upserter.UpsertMetadata(ctx, unreachableDB(t), zap.NewNop(), instanceID, instanceIPs, &models.InstanceMetadatum{ID: instanceID, Metadata: types.JSON(instanceMetadata0)})
+
+	// The last attempt's error is returned, rather than waiting for the
+	// deadline
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.NoError(t, ctx.Err())
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
@@ -0,0 +1,254 @@
+package upserter
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/spf13/viper"
+	"github.com/volatiletech/sqlboiler/v4/boil"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/correlation"
+	"go.hollow.sh/metadataservice/internal/models"
+	"go.hollow.sh/metadataservice/internal/publickeys"
+)
+
+// batchTransactionSize is the maximum number of instances UpsertBatch writes
+// in a single transaction
+const batchTransactionSize = 50
+
+const (
+	savepointQuery         = `SAVEPOINT batch_item`
+	rollbackSavepointQuery = `ROLLBACK TO SAVEPOINT batch_item`
+	releaseSavepointQuery  = `RELEASE SAVEPOINT batch_item`
+)
+
+// BatchItem is a single instance to upsert with UpsertBatch. Its metadata and
+// userdata are each only upserted when set.
+type BatchItem struct {
+	ID               string
+	IPAddresses      []string
+	Metadata         *models.InstanceMetadatum
+	Userdata         *models.InstanceUserdatum
+	UserdataEncoding string
+
+	// PublicKeys, when not nil, replaces the instance's stored SSH public keys
+	// along with its metadata
+	PublicKeys []publickeys.Key
+
+	// Tags, when not nil, replaces the instance's stored tags along with its
+	// metadata
+	Tags map[string]string
+}
+
+// BatchResult is the outcome of upserting a single BatchItem. Err is set when
+// nothing was written for the item.
+type BatchResult struct {
+	Changes *IPAddressChanges
+	Err     error
+}
+
+// UpsertBatch upserts the metadata and/or userdata of several instances, using
+// the same IP address handling as UpsertMetadata and UpsertUserdata. Rather
+// than a transaction per instance, items are written in transactions of up to
+// batchTransactionSize instances. Items are written in the order given, so if
+// two items claim the same address the latter wins.
+//
+// The items in a transaction don't depend on each other, one being refused
+// (for example, because of a rejected IP conflict) doesn't stop the others
+// from being written. A transaction which fails as a whole is retried like an
+// upsert, and if it still fails, so do all of its items. One result is
+// returned per item, in order.
+func UpsertBatch(ctx context.Context, db *sqlx.DB, logger *zap.Logger, items []BatchItem, opts UpsertOptions) []BatchResult {
+	logger = correlation.Logger(ctx, logger)
+
+	results := make([]BatchResult, len(items))
+
+	ctx, span := startBatchSpan(ctx, len(items))
+	defer endBatchSpan(span, results)
+
+	for _, item := range items {
+		if item.Metadata != nil {
+			warnIPAddressDiscrepancy(logger, upsertKindBatch, item.ID, item.IPAddresses, ExtractIPAddressesFromMetadata(item.Metadata))
+		}
+	}
+
+	for start := 0; start < len(items); start += batchTransactionSize {
+		end := min(start+batchTransactionSize, len(items))
+
+		chunkResults, err := upsertBatchChunkWithRetries(ctx, db, logger, items[start:end], opts)
+		if err != nil {
+			for i := start; i < end; i++ {
+				results[i] = BatchResult{Err: err}
+			}
+
+			continue
+		}
+
+		copy(results[start:end], chunkResults)
+
+		for i, result := range chunkResults {
+			if result.Err == nil {
+				item := items[start+i]
+				publishChangeEvent(ctx, opts.Events, item.ID, item.Metadata != nil, item.Userdata != nil, result.Changes)
+			}
+		}
+	}
+
+	return results
+}
+
+// upsertBatchChunkWithRetries writes a chunk of UpsertBatch items in a single
+// transaction, retrying it with the same limits and backoff as upserts (see
+// withRetries).
+func upsertBatchChunkWithRetries(ctx context.Context, db *sqlx.DB, logger *zap.Logger, items []BatchItem, opts UpsertOptions) ([]BatchResult, error) {
+	start := time.Now()
+
+	var (
+		results  []BatchResult
+		err      error
+		attempts int
+	)
+
+	defer func() {
+		observeUpsertResult(upsertKindBatch, attempts, err)
+
+		fields := []zap.Field{
+			zap.Int("instances", len(items)),
+			zap.Duration("duration", time.Since(start)),
+			zap.Int("attempts", attempts),
+		}
+
+		if err != nil {
+			logger.Error("batch upsert transaction failed", append(fields, zap.Error(err))...)
+			return
+		}
+
+		failed := 0
+
+		for _, result := range results {
+			if result.Err != nil {
+				failed++
+			}
+		}
+
+		logger.Info("batch upsert transaction finished", append(fields, zap.Int("failed", failed))...)
+	}()
+
+	attempts, _, err = withRetries(ctx, upsertKindBatch, func() error {
+		var attemptErr error
+
+		attemptStart := time.Now()
+		results, attemptErr = doUpsertBatchChunk(ctx, db, logger, items, opts)
+
+		observeTransaction(upsertKindBatch, attemptStart)
+
+		return attemptErr
+	})
+	if err != nil {
+		results = nil
+
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// doUpsertBatchChunk runs a single attempt of upsertBatchChunkWithRetries.
+// Each item is written behind a savepoint, so an item which fails can be
+// rolled back on its own. An error is only returned when the transaction as a
+// whole failed, in which case it wraps context.DeadlineExceeded if it timed
+// out.
+func doUpsertBatchChunk(ctx context.Context, db *sqlx.DB, logger *zap.Logger, items []BatchItem, opts UpsertOptions) (_ []BatchResult, err error) {
+	ctx = boil.WithDebug(ctx, true)
+
+	ctxWithTimeout, cancel := context.WithTimeout(ctx, viper.GetDuration("crdb.tx_timeout"))
+	defer cancel()
+
+	// The driver doesn't always report a timeout as one, so check the context
+	defer func() {
+		if err != nil && !errors.Is(err, context.DeadlineExceeded) && errors.Is(ctxWithTimeout.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("%w: %s", context.DeadlineExceeded, err.Error())
+		}
+	}()
+
+	tx, err := db.BeginTx(ctxWithTimeout, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	committed := false
+
+	defer func() {
+		if !committed {
+			if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+				logger.Error("could not roll back batch upsert transaction", zap.Error(err))
+			}
+		}
+	}()
+
+	results := make([]BatchResult, len(items))
+
+	for i, item := range items {
+		if _, err := tx.ExecContext(ctxWithTimeout, savepointQuery); err != nil {
+			return nil, err
+		}
+
+		itemOpts := opts
+		itemOpts.UserdataEncoding = item.UserdataEncoding
+		itemOpts.PublicKeys = item.PublicKeys
+		itemOpts.Tags = item.Tags
+
+		changes, err := upsertInTx(ctxWithTimeout, tx, logger, item.ID, item.IPAddresses, batchItemUpserter(item, itemOpts), itemOpts)
+		if err != nil {
+			// If the transaction itself can't continue, this fails too and the
+			// whole transaction is retried
+			if _, rollbackErr := tx.ExecContext(ctxWithTimeout, rollbackSavepointQuery); rollbackErr != nil {
+				return nil, err
+			}
+
+			results[i] = BatchResult{Err: err}
+
+			continue
+		}
+
+		if _, err := tx.ExecContext(ctxWithTimeout, releaseSavepointQuery); err != nil {
+			return nil, err
+		}
+
+		results[i] = BatchResult{Changes: changes}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	committed = true
+
+	return results, nil
+}
+
+// batchItemUpserter upserts the records given in a batch item
+func batchItemUpserter(item BatchItem, opts UpsertOptions) RecordUpserter {
+	return func(c context.Context, exec boil.ContextExecutor) error {
+		if item.Metadata != nil {
+			if err := upsertMetadataRecord(c, exec, item.Metadata, opts); err != nil {
+				return err
+			}
+		}
+
+		if item.Userdata != nil {
+			if err := item.Userdata.Upsert(c, exec, true, []string{"id"}, boil.Whitelist("userdata", "updated_at"), boil.Infer()); err != nil {
+				return err
+			}
+
+			return SetUserdataEncoding(c, exec, item.ID, item.UserdataEncoding)
+		}
+
+		return nil
+	}
+}
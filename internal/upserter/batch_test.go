@@ -0,0 +1,174 @@
+package upserter_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/volatiletech/null/v8"
+	"github.com/volatiletech/sqlboiler/v4/types"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	"go.hollow.sh/metadataservice/internal/models"
+	"go.hollow.sh/metadataservice/internal/upserter"
+)
+
+// Test that a batch upserts the metadata and userdata given for each
+// instance, and associates their IP addresses
+func TestUpsertBatch(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	metadataID := "4b3b2f8c-17a7-4c1f-9d39-5f83b8c2c0d1"
+	userdataID := "9e0d0f3a-7a1b-4d8e-a1a5-0c2b1bd2b4f7"
+
+	results := upserter.UpsertBatch(context.TODO(), testDB, zap.NewNop(), []upserter.BatchItem{
+		{
+			ID:          instanceID,
+			IPAddresses: instanceIPs,
+			Metadata:    &models.InstanceMetadatum{ID: instanceID, Metadata: types.JSON(instanceMetadata0)},
+			Userdata:    &models.InstanceUserdatum{ID: instanceID, Userdata: null.BytesFrom([]byte(instanceUserdata0))},
+		},
+		{
+			ID:          metadataID,
+			IPAddresses: []string{"10.1.1.1"},
+			Metadata:    &models.InstanceMetadatum{ID: metadataID, Metadata: types.JSON(instanceMetadata1)},
+		},
+		{
+			ID:          userdataID,
+			IPAddresses: []string{"10.1.1.2"},
+			Userdata:    &models.InstanceUserdatum{ID: userdataID, Userdata: null.BytesFrom([]byte(instanceUserdata1))},
+		},
+	}, upserter.UpsertOptions{})
+
+	assert.Len(t, results, 3)
+
+	for _, result := range results {
+		assert.Nil(t, result.Err)
+	}
+
+	assert.ElementsMatch(t, []string{"1.2.3.4", "1f00:1f00:1f00:1f00::9/127"}, results[0].Changes.Added)
+
+	for id, expected := range map[string][2]bool{instanceID: {true, true}, metadataID: {true, false}, userdataID: {false, true}} {
+		metadataExists, err := models.InstanceMetadatumExists(context.TODO(), testDB, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		userdataExists, err := models.InstanceUserdatumExists(context.TODO(), testDB, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, expected[0], metadataExists, id)
+		assert.Equal(t, expected[1], userdataExists, id)
+	}
+}
+
+// Test that when conflicts are rejected, a conflicting item fails on its own
+// while the rest of the batch is written, and that a later item in a batch
+// wins an address claimed by an earlier one when conflicts are allowed
+func TestUpsertBatchConflicts(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	otherID := "2c1cbbd6-0f5c-4b5e-8d35-8d2a4b9a0f6e"
+
+	err := upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), otherID, []string{"1.2.3.4"}, &models.InstanceMetadatum{ID: otherID, Metadata: types.JSON(instanceMetadata0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newID := "6f1d5c0e-2a7b-4e55-9c1e-3b8f0a9d7c21"
+
+	results := upserter.UpsertBatch(context.TODO(), testDB, zap.NewNop(), []upserter.BatchItem{
+		{
+			ID:          instanceID,
+			IPAddresses: []string{"1.2.3.4"},
+			Metadata:    &models.InstanceMetadatum{ID: instanceID, Metadata: types.JSON(instanceMetadata0)},
+		},
+		{
+			ID:          newID,
+			IPAddresses: []string{"10.1.1.1"},
+			Metadata:    &models.InstanceMetadatum{ID: newID, Metadata: types.JSON(instanceMetadata0)},
+		},
+	}, upserter.UpsertOptions{RejectConflicts: true})
+
+	assert.True(t, errors.Is(results[0].Err, upserter.ErrIPConflict))
+	assert.Nil(t, results[1].Err)
+
+	metadataExists, err := models.InstanceMetadatumExists(context.TODO(), testDB, instanceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.False(t, metadataExists)
+
+	metadataExists, err = models.InstanceMetadatumExists(context.TODO(), testDB, newID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, metadataExists)
+
+	// Without rejecting conflicts, the last item claiming an address gets it
+	results = upserter.UpsertBatch(context.TODO(), testDB, zap.NewNop(), []upserter.BatchItem{
+		{
+			ID:          instanceID,
+			IPAddresses: []string{"1.2.3.4"},
+			Metadata:    &models.InstanceMetadatum{ID: instanceID, Metadata: types.JSON(instanceMetadata0)},
+		},
+		{
+			ID:          newID,
+			IPAddresses: []string{"1.2.3.4", "10.1.1.1"},
+			Metadata:    &models.InstanceMetadatum{ID: newID, Metadata: types.JSON(instanceMetadata1)},
+		},
+	}, upserter.UpsertOptions{})
+
+	for _, result := range results {
+		assert.Nil(t, result.Err)
+	}
+
+	owner, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.Address.EQ("1.2.3.4")).One(context.TODO(), testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, newID, owner.InstanceID)
+}
+
+// Test that batches larger than a single transaction are written in full
+func TestUpsertBatchSpansTransactions(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	var items []upserter.BatchItem
+
+	for i := 0; i < 120; i++ {
+		id := uuid.NewString()
+
+		items = append(items, upserter.BatchItem{
+			ID:          id,
+			IPAddresses: []string{fmt.Sprintf("10.2.%d.%d", i/256, i%256)},
+			Metadata:    &models.InstanceMetadatum{ID: id, Metadata: types.JSON(instanceMetadata0)},
+		})
+	}
+
+	results := upserter.UpsertBatch(context.TODO(), testDB, zap.NewNop(), items, upserter.UpsertOptions{})
+
+	assert.Len(t, results, len(items))
+
+	for _, result := range results {
+		assert.Nil(t, result.Err)
+	}
+
+	for _, item := range items {
+		count, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(item.ID)).Count(context.TODO(), testDB)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, int64(1), count, item.ID)
+	}
+}
@@ -0,0 +1,107 @@
+package upserter
+
+import (
+	"context"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/volatiletech/sqlboiler/v4/queries/qm"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/models"
+)
+
+// duplicateAddressesQuery finds the addresses with more than one
+// instance_ip_addresses row
+const duplicateAddressesQuery = `SELECT address::STRING FROM instance_ip_addresses GROUP BY address HAVING count(*) > 1`
+
+// DuplicateIPResolution describes how an address with several
+// instance_ip_addresses rows was resolved to a single owner.
+type DuplicateIPResolution struct {
+	Address    string       `json:"address"`
+	InstanceID string       `json:"instance_id"`
+	Removed    []IPConflict `json:"removed"`
+}
+
+// CompactDuplicateIPs finds addresses associated to more than one instance (or
+// to the same instance more than once), which the unique_address constraint
+// would otherwise refuse, and resolves each to the row which was most recently
+// updated. Each address is resolved in its own transaction, with its rows
+// locked. With dryRun, the transactions are rolled back rather than
+// committed, so the resolutions are only reported.
+func CompactDuplicateIPs(ctx context.Context, db *sqlx.DB, logger *zap.Logger, dryRun bool) ([]DuplicateIPResolution, error) {
+	addresses := []string{}
+
+	if err := db.SelectContext(ctx, &addresses, duplicateAddressesQuery); err != nil {
+		return nil, err
+	}
+
+	logger.Sugar().Info("Found ", len(addresses), " IP addresses with duplicate rows")
+
+	resolutions := make([]DuplicateIPResolution, 0, len(addresses))
+
+	for _, address := range addresses {
+		resolution, err := compactDuplicateIP(ctx, db, address, dryRun)
+		if err != nil {
+			logger.Sugar().Error("Unable to resolve duplicate rows for IP address: ", address, " Error: ", err)
+			return resolutions, err
+		}
+
+		if resolution != nil {
+			resolutions = append(resolutions, *resolution)
+		}
+	}
+
+	return resolutions, nil
+}
+
+// compactDuplicateIP resolves the rows for a single address, or returns nil if
+// they've been resolved (by an upsert, for example) since they were found.
+func compactDuplicateIP(ctx context.Context, db *sqlx.DB, address string, dryRun bool) (*DuplicateIPResolution, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Dry runs, and anything which fails, are rolled back. Rolling back after
+	// a commit does nothing.
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	rows, err := models.InstanceIPAddresses(
+		qm.Where("address = ?::inet", address),
+		qm.OrderBy(models.InstanceIPAddressColumns.UpdatedAt+" DESC, "+models.InstanceIPAddressColumns.CreatedAt+" DESC"),
+		qm.For("UPDATE"),
+	).All(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rows) < 2 {
+		return nil, nil
+	}
+
+	resolution := &DuplicateIPResolution{
+		Address:    address,
+		InstanceID: rows[0].InstanceID,
+		Removed:    make([]IPConflict, 0, len(rows)-1),
+	}
+
+	for _, row := range rows[1:] {
+		resolution.Removed = append(resolution.Removed, IPConflict{Address: row.Address, InstanceID: row.InstanceID})
+	}
+
+	if dryRun {
+		return resolution, nil
+	}
+
+	if _, err := rows[1:].DeleteAll(ctx, tx); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return resolution, nil
+}
@@ -0,0 +1,37 @@
+package upserter_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	"go.hollow.sh/metadataservice/internal/models"
+	"go.hollow.sh/metadataservice/internal/upserter"
+)
+
+// The unique_address constraint keeps new duplicates out, so a database which
+// has it has nothing to compact, and compacting must leave it untouched
+func TestCompactDuplicateIPsWithoutDuplicates(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	before, err := models.InstanceIPAddresses().Count(context.TODO(), testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dryRun := range []bool{true, false} {
+		resolutions, err := upserter.CompactDuplicateIPs(context.TODO(), testDB, zap.NewNop(), dryRun)
+		assert.NoError(t, err)
+		assert.Empty(t, resolutions)
+	}
+
+	after, err := models.InstanceIPAddresses().Count(context.TODO(), testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, before, after)
+}
@@ -0,0 +1,72 @@
+package upserter
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/volatiletech/sqlboiler/v4/queries/qm"
+
+	"go.hollow.sh/metadataservice/internal/models"
+)
+
+// overlappingNetworkClause matches the stored networks (rather than single
+// addresses) which overlap the given network
+const overlappingNetworkClause = "(address && ?::inet AND masklen(address) < CASE WHEN family(address) = 4 THEN 32 ELSE 128 END)"
+
+// ErrIPConflict is returned when an upsert would take IP addresses from other
+// instances, and the caller asked for conflicts to be rejected.
+var ErrIPConflict = errors.New("ip addresses are associated to other instances")
+
+// IPConflict describes an IP address in an upsert which is currently
+// associated to a different instance.
+type IPConflict struct {
+	Address    string `json:"address"`
+	InstanceID string `json:"instance_id"`
+}
+
+// ConflictError is returned (wrapping ErrIPConflict) when an upsert is rejected
+// because of conflicting IP addresses. It lists each conflicting address and
+// the instance it's currently associated to.
+type ConflictError struct {
+	Conflicts []IPConflict
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s: %d conflicting", ErrIPConflict, len(e.Conflicts))
+}
+
+// Unwrap allows errors.Is to match ErrIPConflict
+func (e *ConflictError) Unwrap() error {
+	return ErrIPConflict
+}
+
+func newConflictError(conflicts models.InstanceIPAddressSlice) *ConflictError {
+	e := &ConflictError{Conflicts: make([]IPConflict, 0, len(conflicts))}
+
+	for _, conflict := range conflicts {
+		e.Conflicts = append(e.Conflicts, IPConflict{Address: conflict.Address, InstanceID: conflict.InstanceID})
+	}
+
+	return e
+}
+
+// conflictingIPsMods returns the query mods selecting the IP associations of
+// other instances which conflict with the canonical addresses: the same
+// addresses, and networks overlapping any of the networks in the list. A
+// single address within another instance's network doesn't conflict, since
+// exact matches take precedence when identifying instances.
+func conflictingIPsMods(id string, ipAddresses []string) []qm.QueryMod {
+	matches := []qm.QueryMod{models.InstanceIPAddressWhere.Address.IN(ipAddresses)}
+
+	for _, address := range ipAddresses {
+		if strings.Contains(address, "/") {
+			matches = append(matches, qm.Or(overlappingNetworkClause, address))
+		}
+	}
+
+	return []qm.QueryMod{
+		models.InstanceIPAddressWhere.InstanceID.NEQ(id),
+		qm.Expr(matches...),
+	}
+}
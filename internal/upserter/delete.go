@@ -0,0 +1,164 @@
+package upserter
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/spf13/viper"
+	"github.com/volatiletech/sqlboiler/v4/boil"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/bootstraptoken"
+	"go.hollow.sh/metadataservice/internal/correlation"
+	"go.hollow.sh/metadataservice/internal/instancetags"
+	"go.hollow.sh/metadataservice/internal/models"
+	"go.hollow.sh/metadataservice/internal/publickeys"
+)
+
+// ErrInstanceNotFound is returned by DeleteInstance when there's no metadata,
+// userdata, public key, tag or IP address stored for the instance.
+var ErrInstanceNotFound = errors.New("instance not found")
+
+// DeleteInstance removes everything stored for an instance (see
+// deleteInstanceRecords), along with all of its instance_ip_addresses rows, in
+// a single transaction, so its IP addresses can immediately be associated to
+// another instance. Attempts which fail with a retryable error are retried
+// with the same limits and backoff as upserts. It returns the changes made to
+// the associations, or ErrInstanceNotFound if nothing was stored for the
+// instance.
+func DeleteInstance(ctx context.Context, db *sqlx.DB, logger *zap.Logger, id string) (*IPAddressChanges, error) {
+	logger = correlation.Logger(ctx, logger)
+
+	start := time.Now()
+
+	var (
+		changes  *IPAddressChanges
+		err      error
+		attempts int
+	)
+
+	attempts, _, err = withRetries(ctx, upsertKindDelete, func() error {
+		var attemptErr error
+
+		changes, attemptErr = doDeleteInstance(ctx, db, id)
+
+		return attemptErr
+	})
+
+	switch {
+	case err == nil:
+		logger.Info("instance deleted", zap.String("instance_id", id), zap.Int("removed_ips", len(changes.Removed)), zap.Int("attempts", attempts), zap.Duration("duration", time.Since(start)))
+
+		return changes, nil
+	case !errors.Is(err, ErrInstanceNotFound):
+		logger.Error("instance delete failed", zap.String("instance_id", id), zap.Int("attempts", attempts), zap.Duration("duration", time.Since(start)), zap.Error(err))
+	}
+
+	return nil, err
+}
+
+// doDeleteInstance runs a single attempt of DeleteInstance
+func doDeleteInstance(ctx context.Context, db *sqlx.DB, id string) (*IPAddressChanges, error) {
+	ctxWithTimeout, cancel := context.WithTimeout(ctx, viper.GetDuration("crdb.tx_timeout"))
+	defer cancel()
+
+	tx, err := db.BeginTx(ctxWithTimeout, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	committed := false
+
+	defer func() {
+		if !committed {
+			_ = tx.Rollback()
+		}
+	}()
+
+	instanceIPAddresses, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(id)).All(ctxWithTimeout, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	deleted, err := deleteInstanceRecords(ctxWithTimeout, tx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if !deleted.any() && len(instanceIPAddresses) == 0 {
+		return nil, ErrInstanceNotFound
+	}
+
+	if _, err := instanceIPAddresses.DeleteAll(ctxWithTimeout, tx); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	committed = true
+
+	return ipAddressChanges(nil, instanceIPAddresses, nil), nil
+}
+
+// deletedRecords reports which of an instance's records deleteInstanceRecords
+// removed
+type deletedRecords struct {
+	metadata   bool
+	userdata   bool
+	publicKeys bool
+	tags       bool
+}
+
+// any reports whether anything was stored for the instance
+func (d deletedRecords) any() bool {
+	return d.metadata || d.userdata || d.publicKeys || d.tags
+}
+
+// deleteInstanceRecords removes everything stored for an instance apart from
+// its IP address associations: its instance_metadata and instance_userdata
+// records, userdata encoding, public keys, tags and bootstrap token. Its
+// metadata history is kept for audits, until the history pruner removes it.
+// It's meant to be called in the same transaction as the instance's
+// associations are removed, or after they've been reassigned.
+func deleteInstanceRecords(ctx context.Context, exec boil.ContextExecutor, id string) (deletedRecords, error) {
+	var deleted deletedRecords
+
+	deletedMetadata, err := models.InstanceMetadata(models.InstanceMetadatumWhere.ID.EQ(id)).DeleteAll(ctx, exec)
+	if err != nil {
+		return deleted, err
+	}
+
+	deletedUserdata, err := models.InstanceUserdata(models.InstanceUserdatumWhere.ID.EQ(id)).DeleteAll(ctx, exec)
+	if err != nil {
+		return deleted, err
+	}
+
+	if err := SetUserdataEncoding(ctx, exec, id, ""); err != nil {
+		return deleted, err
+	}
+
+	deletedKeys, err := publickeys.Delete(ctx, exec, id)
+	if err != nil {
+		return deleted, err
+	}
+
+	deletedTags, err := instancetags.Delete(ctx, exec, id)
+	if err != nil {
+		return deleted, err
+	}
+
+	if _, err := bootstraptoken.Delete(ctx, exec, id); err != nil {
+		return deleted, err
+	}
+
+	deleted.metadata = deletedMetadata > 0
+	deleted.userdata = deletedUserdata > 0
+	deleted.publicKeys = deletedKeys > 0
+	deleted.tags = deletedTags > 0
+
+	return deleted, nil
+}
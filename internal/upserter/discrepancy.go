@@ -0,0 +1,94 @@
+package upserter
+
+import (
+	"net/netip"
+
+	"go.uber.org/zap"
+)
+
+// warnIPAddressDiscrepancy logs a warning, and counts it in
+// MetricIPAddressDiscrepancies, when the addresses in the metadata's
+// network.addresses don't line up with the addresses the instance is being
+// associated to. That's usually a provisioning bug, where the metadata says
+// one thing but lookups are keyed on another.
+func warnIPAddressDiscrepancy(logger *zap.Logger, kind string, id string, ipAddresses []string, metadataIPs []string) {
+	unassociated, unreferenced := ipAddressDiscrepancy(ipAddresses, metadataIPs)
+	if len(unassociated) == 0 && len(unreferenced) == 0 {
+		return
+	}
+
+	MetricIPAddressDiscrepancies.WithLabelValues(kind).Inc()
+
+	logger.Warn("metadata ip addresses differ from the associated ip addresses",
+		zap.String("kind", kind),
+		zap.String("instance_id", id),
+		zap.Strings("unassociated_metadata_ips", unassociated),
+		zap.Strings("unreferenced_ip_addresses", unreferenced),
+	)
+}
+
+// ipAddressDiscrepancy compares the addresses in the metadata against the
+// addresses the instance is being associated to. It returns the metadata
+// addresses which aren't covered by any association, and the associations
+// which don't cover any metadata address. An address is covered by an
+// association to the same address, or to a CIDR containing it.
+//
+// When either list is empty there's nothing to compare: the upsert isn't
+// changing the associations, or the metadata doesn't list any addresses.
+func ipAddressDiscrepancy(ipAddresses []string, metadataIPs []string) ([]string, []string) {
+	if len(ipAddresses) == 0 || len(metadataIPs) == 0 {
+		return nil, nil
+	}
+
+	ipAddresses, _ = dedupeIPAddresses(ipAddresses)
+	metadataIPs, _ = dedupeIPAddresses(metadataIPs)
+
+	referenced := make([]bool, len(ipAddresses))
+
+	var unassociated []string
+
+	for _, metadataIP := range metadataIPs {
+		associated := false
+
+		for i, address := range ipAddresses {
+			if ipAddressCovers(address, metadataIP) {
+				associated = true
+				referenced[i] = true
+			}
+		}
+
+		if !associated {
+			unassociated = append(unassociated, metadataIP)
+		}
+	}
+
+	var unreferenced []string
+
+	for i, address := range ipAddresses {
+		if !referenced[i] {
+			unreferenced = append(unreferenced, address)
+		}
+	}
+
+	return unassociated, unreferenced
+}
+
+// ipAddressCovers reports whether the association, an address or CIDR in its
+// canonical form, covers the canonical address
+func ipAddressCovers(association string, address string) bool {
+	if association == address {
+		return true
+	}
+
+	prefix, err := netip.ParsePrefix(association)
+	if err != nil {
+		return false
+	}
+
+	ip, err := netip.ParseAddr(address)
+	if err != nil {
+		return false
+	}
+
+	return prefix.Contains(ip)
+}
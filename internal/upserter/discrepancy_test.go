@@ -0,0 +1,116 @@
+package upserter_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/volatiletech/sqlboiler/v4/types"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"go.hollow.sh/metadataservice/internal/models"
+	"go.hollow.sh/metadataservice/internal/upserter"
+)
+
+func TestIPAddressDiscrepancy(t *testing.T) {
+	testCases := []struct {
+		testName             string
+		ipAddresses          []string
+		metadataIPs          []string
+		expectedUnassociated []string
+		expectedUnreferenced []string
+	}{
+		{
+			"matching addresses",
+			[]string{"10.0.0.1", "2001:db8::1"},
+			[]string{"2001:0DB8::0001", "10.0.0.1"},
+			nil,
+			nil,
+		},
+		{
+			"metadata addresses within an associated cidr",
+			[]string{"10.0.0.0/29", "10.0.1.1/32"},
+			[]string{"10.0.0.3", "10.0.0.5", "10.0.1.1"},
+			nil,
+			nil,
+		},
+		{
+			"metadata address which isn't associated",
+			[]string{"10.0.0.1"},
+			[]string{"10.0.0.1", "192.168.1.1"},
+			[]string{"192.168.1.1"},
+			nil,
+		},
+		{
+			"association the metadata doesn't list",
+			[]string{"10.0.0.1", "10.0.8.0/24"},
+			[]string{"10.0.0.1"},
+			nil,
+			[]string{"10.0.8.0/24"},
+		},
+		{
+			"no associations given",
+			nil,
+			[]string{"10.0.0.1"},
+			nil,
+			nil,
+		},
+		{
+			"no metadata addresses",
+			[]string{"10.0.0.1"},
+			nil,
+			nil,
+			nil,
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			unassociated, unreferenced := upserter.IPAddressDiscrepancy(testcase.ipAddresses, testcase.metadataIPs)
+
+			assert.Equal(t, testcase.expectedUnassociated, unassociated)
+			assert.Equal(t, testcase.expectedUnreferenced, unreferenced)
+		})
+	}
+}
+
+// Test that an upsert whose metadata lists different addresses than it
+// associates is logged and counted, whether or not it succeeds
+func TestUpsertIPAddressDiscrepancyWarning(t *testing.T) {
+	viper.Set("crdb.max_retries", 0)
+	viper.Set("crdb.tx_timeout", time.Nanosecond)
+
+	t.Cleanup(func() {
+		viper.Set("crdb.max_retries", 5)
+		viper.Set("crdb.tx_timeout", 15*time.Second)
+	})
+
+	core, logs := observer.New(zapcore.WarnLevel)
+	discrepancies := testutil.ToFloat64(upserter.MetricIPAddressDiscrepancies.WithLabelValues("metadata"))
+
+	metadata := &models.InstanceMetadatum{ID: instanceID, Metadata: types.JSON(`{"network":{"addresses":[{"address":"1.2.3.4"},{"address":"5.6.7.8"}]}}`)}
+
+	_ = upserter.UpsertMetadata(context.TODO(), unreachableDB(t), zap.New(core), instanceID, instanceIPs, metadata)
+
+	assert.Equal(t, discrepancies+1, testutil.ToFloat64(upserter.MetricIPAddressDiscrepancies.WithLabelValues("metadata")))
+
+	warnings := logs.FilterMessage("metadata ip addresses differ from the associated ip addresses").All()
+	if assert.Len(t, warnings, 1) {
+		fields := warnings[0].ContextMap()
+		assert.Equal(t, instanceID, fields["instance_id"])
+		assert.Equal(t, []interface{}{"5.6.7.8"}, fields["unassociated_metadata_ips"])
+		assert.Equal(t, []interface{}{"1f00:1f00:1f00:1f00::9/127"}, fields["unreferenced_ip_addresses"])
+	}
+
+	// Metadata which lines up with the associations isn't counted
+	metadata.Metadata = types.JSON(`{"network":{"addresses":[{"address":"1.2.3.4"},{"address":"1f00:1f00:1f00:1f00::9"}]}}`)
+
+	_ = upserter.UpsertMetadata(context.TODO(), unreachableDB(t), zap.New(core), instanceID, instanceIPs, metadata)
+
+	assert.Equal(t, discrepancies+1, testutil.ToFloat64(upserter.MetricIPAddressDiscrepancies.WithLabelValues("metadata")))
+}
@@ -0,0 +1,44 @@
+package upserter
+
+import (
+	"context"
+	"time"
+
+	"go.hollow.sh/metadataservice/internal/correlation"
+	"go.hollow.sh/metadataservice/internal/events"
+)
+
+// publishUpsertEvent publishes the change event for a committed metadata or
+// userdata upsert. IP address reassociations on their own aren't published.
+func publishUpsertEvent(ctx context.Context, publisher *events.Publisher, kind string, id string, changes *IPAddressChanges) {
+	if kind != upsertKindMetadata && kind != upsertKindUserdata {
+		return
+	}
+
+	publishChangeEvent(ctx, publisher, id, kind == upsertKindMetadata, kind == upsertKindUserdata, changes)
+}
+
+// publishChangeEvent publishes the change event for a committed write of an
+// instance's metadata and/or userdata, carrying the correlation ID of ctx.
+func publishChangeEvent(ctx context.Context, publisher *events.Publisher, id string, metadata bool, userdata bool, changes *IPAddressChanges) {
+	if publisher == nil {
+		return
+	}
+
+	event := events.Event{
+		InstanceID:    id,
+		Metadata:      metadata,
+		Userdata:      userdata,
+		AddedIPs:      []string{},
+		RemovedIPs:    []string{},
+		Timestamp:     time.Now().UTC(),
+		CorrelationID: correlation.FromContext(ctx),
+	}
+
+	if changes != nil {
+		event.AddedIPs = changes.Added
+		event.RemovedIPs = changes.Removed
+	}
+
+	publisher.Publish(event)
+}
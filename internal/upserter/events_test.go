@@ -0,0 +1,81 @@
+package upserter_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/volatiletech/null/v8"
+	"github.com/volatiletech/sqlboiler/v4/types"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/correlation"
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	"go.hollow.sh/metadataservice/internal/events"
+	"go.hollow.sh/metadataservice/internal/models"
+	"go.hollow.sh/metadataservice/internal/upserter"
+)
+
+type recordingConn struct {
+	published []events.Event
+}
+
+func (r *recordingConn) Publish(_ string, data []byte) error {
+	event := events.Event{}
+	if err := json.Unmarshal(data, &event); err != nil {
+		return err
+	}
+
+	r.published = append(r.published, event)
+
+	return nil
+}
+
+// Test that committed upserts publish an event, while rejected ones don't
+func TestUpsertPublishesEvents(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	conn := &recordingConn{}
+	opts := upserter.UpsertOptions{Events: events.NewPublisher(conn, events.DefaultSubject, zap.NewNop())}
+
+	metadata := models.InstanceMetadatum{ID: instanceID, Metadata: types.JSON(instanceMetadata0)}
+
+	ctx := correlation.NewContext(context.TODO(), "upsert-events")
+
+	_, err := upserter.UpsertMetadataWithOptions(ctx, testDB, zap.NewNop(), instanceID, instanceIPs, &metadata, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userdata := models.InstanceUserdatum{ID: instanceID, Userdata: null.NewBytes([]byte(instanceUserdata0), true)}
+
+	_, err = upserter.UpsertUserdataWithOptions(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs[:1], &userdata, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if assert.Len(t, conn.published, 2) {
+		assert.Equal(t, instanceID, conn.published[0].InstanceID)
+		assert.True(t, conn.published[0].Metadata)
+		assert.False(t, conn.published[0].Userdata)
+		assert.Len(t, conn.published[0].AddedIPs, len(instanceIPs))
+		assert.Empty(t, conn.published[0].RemovedIPs)
+		assert.False(t, conn.published[0].Timestamp.IsZero())
+		assert.Equal(t, "upsert-events", conn.published[0].CorrelationID)
+
+		assert.False(t, conn.published[1].Metadata)
+		assert.True(t, conn.published[1].Userdata)
+		assert.Empty(t, conn.published[1].AddedIPs)
+		assert.Len(t, conn.published[1].RemovedIPs, 1)
+		assert.Empty(t, conn.published[1].CorrelationID)
+	}
+
+	// An upsert which never commits publishes nothing
+	opts.RejectConflicts = true
+	other := models.InstanceMetadatum{ID: "0f0c0e5e-4d6b-4b8e-9d55-3c1e7f0a9b21", Metadata: types.JSON(instanceMetadata0)}
+
+	_, err = upserter.UpsertMetadataWithOptions(context.TODO(), testDB, zap.NewNop(), other.ID, instanceIPs, &other, opts)
+	assert.ErrorIs(t, err, upserter.ErrIPConflict)
+	assert.Len(t, conn.published, 2)
+}
@@ -0,0 +1,10 @@
+package upserter
+
+// IsRetryable exposes isRetryable to the tests
+var IsRetryable = isRetryable
+
+// IPAddressDiscrepancy exposes ipAddressDiscrepancy to the tests
+var IPAddressDiscrepancy = ipAddressDiscrepancy
+
+// WithRetries exposes withRetries to the tests
+var WithRetries = withRetries
@@ -0,0 +1,163 @@
+package upserter
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/spf13/viper"
+	"github.com/volatiletech/sqlboiler/v4/boil"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/correlation"
+	"go.hollow.sh/metadataservice/internal/models"
+)
+
+// AddIPs associates the given IP addresses to an instance, on top of those
+// already associated to it. Addresses associated to other instances are
+// reassigned, or rejected with a *ConflictError when opts.RejectConflicts is
+// set, like they are by an upsert. The instance's metadata and userdata are
+// left untouched, and needn't be stored, though when the orphaned IP cleanup
+// is enabled, the associations of an instance with nothing else stored are
+// removed once they're older than its minimum age. It returns the changes
+// made to the associations, along with every IP address associated to the
+// instance afterwards.
+func AddIPs(ctx context.Context, db *sqlx.DB, logger *zap.Logger, id string, ipAddresses []string, opts UpsertOptions) (*IPAddressChanges, []string, error) {
+	logger = correlation.Logger(ctx, logger)
+
+	opts.KeepStaleIPs = true
+
+	var associated []string
+
+	// The associations are read back at the end of the transaction, once the
+	// new addresses have been inserted
+	listAssociated := func(c context.Context, exec boil.ContextExecutor) error {
+		var err error
+
+		associated, err = associatedIPs(c, exec, id)
+
+		return err
+	}
+
+	logger.Info("starting upsert", zap.String("kind", upsertKindIPAddresses), zap.String("instance_id", id), zap.Strings("ip_addresses", ipAddresses))
+
+	changes, err := doUpsertWithRetries(ctx, db, logger, upsertKindIPAddresses, id, ipAddresses, listAssociated, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return changes, associated, nil
+}
+
+// RemoveIPs disassociates the given IP addresses from an instance, leaving its
+// other associations, metadata and userdata untouched. Addresses which aren't
+// associated to the instance are ignored. Failed attempts are retried with the
+// same limits and backoff as upserts. It returns the changes made to the
+// associations, along with every IP address still associated to the instance.
+func RemoveIPs(ctx context.Context, db *sqlx.DB, logger *zap.Logger, id string, ipAddresses []string) (*IPAddressChanges, []string, error) {
+	logger = correlation.Logger(ctx, logger)
+
+	ipAddresses, _ = dedupeIPAddresses(ipAddresses)
+	if err := ValidateIPAddresses(ipAddresses); err != nil {
+		return nil, nil, err
+	}
+
+	start := time.Now()
+
+	var (
+		changes    *IPAddressChanges
+		associated []string
+		err        error
+		attempts   int
+	)
+
+	attempts, _, err = withRetries(ctx, upsertKindIPAddresses, func() error {
+		var attemptErr error
+
+		changes, associated, attemptErr = doRemoveIPs(ctx, db, id, ipAddresses)
+
+		return attemptErr
+	})
+	if err != nil {
+		logger.Error("ip address disassociation failed", zap.String("instance_id", id), zap.Int("attempts", attempts), zap.Duration("duration", time.Since(start)), zap.Error(err))
+
+		return nil, nil, err
+	}
+
+	logger.Info("ip addresses disassociated", zap.String("instance_id", id), zap.Strings("removed_ips", changes.Removed), zap.Int("attempts", attempts), zap.Duration("duration", time.Since(start)))
+
+	return changes, associated, nil
+}
+
+// doRemoveIPs runs a single attempt of RemoveIPs
+func doRemoveIPs(ctx context.Context, db *sqlx.DB, id string, ipAddresses []string) (*IPAddressChanges, []string, error) {
+	ctxWithTimeout, cancel := context.WithTimeout(ctx, viper.GetDuration("crdb.tx_timeout"))
+	defer cancel()
+
+	tx, err := db.BeginTx(ctxWithTimeout, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	committed := false
+
+	defer func() {
+		if !committed {
+			_ = tx.Rollback()
+		}
+	}()
+
+	instanceIPAddresses, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(id)).All(ctxWithTimeout, tx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	remove := make(map[string]bool, len(ipAddresses))
+	for _, address := range ipAddresses {
+		remove[address] = true
+	}
+
+	var removed models.InstanceIPAddressSlice
+
+	associated := []string{}
+
+	for _, instanceIP := range instanceIPAddresses {
+		if remove[canonicalIPAddress(instanceIP.Address)] {
+			removed = append(removed, instanceIP)
+		} else {
+			associated = append(associated, instanceIP.Address)
+		}
+	}
+
+	if _, err := removed.DeleteAll(ctxWithTimeout, tx); err != nil {
+		return nil, nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+
+	committed = true
+
+	sort.Strings(associated)
+
+	return ipAddressChanges(nil, removed, nil), associated, nil
+}
+
+// associatedIPs lists the IP addresses associated to an instance, in order
+func associatedIPs(ctx context.Context, exec boil.ContextExecutor, id string) ([]string, error) {
+	instanceIPAddresses, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(id)).All(ctx, exec)
+	if err != nil {
+		return nil, err
+	}
+
+	associated := make([]string, 0, len(instanceIPAddresses))
+	for _, instanceIP := range instanceIPAddresses {
+		associated = append(associated, instanceIP.Address)
+	}
+
+	sort.Strings(associated)
+
+	return associated, nil
+}
@@ -0,0 +1,90 @@
+package upserter
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// upsertKindBatch labels the metrics for batch upsert transactions
+	upsertKindBatch = "batch"
+
+	failureSerialization = "serialization"
+	failureTimeout       = "timeout"
+	failureOther         = "other"
+)
+
+var (
+	// MetricUpsertAttempts observes the number of attempts made by each
+	// successful upsert
+	MetricUpsertAttempts = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "metadata_upsert_attempts",
+		Help:    "Number of attempts made by each successful upsert.",
+		Buckets: []float64{1, 2, 3, 4, 5, 10},
+	}, []string{"kind"})
+
+	// MetricUpsertRetries counts the upsert attempts which were retried
+	MetricUpsertRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "metadata_upsert_retries_total",
+		Help: "Number of times an upsert was retried after a failed attempt.",
+	}, []string{"kind"})
+
+	// MetricUpsertFailures counts the upserts which failed after their final
+	// attempt, by the class of the last error. Upserts rejected because of IP
+	// conflicts aren't counted.
+	MetricUpsertFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "metadata_upsert_failures_total",
+		Help: "Number of upserts which failed after their final attempt, by the reason for the last failure (serialization, timeout or other).",
+	}, []string{"kind", "reason"})
+
+	// MetricUpsertTransactionDuration observes how long each upsert
+	// transaction attempt took, whether or not it succeeded
+	MetricUpsertTransactionDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "metadata_upsert_transaction_duration_seconds",
+		Help:    "How long each upsert transaction attempt took, in seconds.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"kind"})
+
+	// MetricIPAddressDiscrepancies counts the metadata upserts whose metadata
+	// lists addresses the instance isn't being associated to, or which
+	// associate it to addresses the metadata doesn't list
+	MetricIPAddressDiscrepancies = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "metadata_ip_address_discrepancies_total",
+		Help: "Number of metadata upserts whose metadata network.addresses differ from the IP addresses the instance is associated to.",
+	}, []string{"kind"})
+)
+
+// failureReason classifies the error which failed an upsert for
+// MetricUpsertFailures
+func failureReason(err error) string {
+	switch {
+	case sqlState(err) == sqlStateSerializationFailure:
+		return failureSerialization
+	case errors.Is(err, context.DeadlineExceeded):
+		return failureTimeout
+	default:
+		return failureOther
+	}
+}
+
+// observeTransaction records how long a single upsert transaction attempt took
+func observeTransaction(kind string, start time.Time) {
+	MetricUpsertTransactionDuration.WithLabelValues(kind).Observe(time.Since(start).Seconds())
+}
+
+// observeUpsertResult records the outcome of an upsert once it's finished
+// retrying
+func observeUpsertResult(kind string, attempts int, err error) {
+	switch {
+	case err == nil:
+		MetricUpsertAttempts.WithLabelValues(kind).Observe(float64(attempts))
+	case errors.Is(err, ErrIPConflict), errors.Is(err, ErrPreconditionFailed):
+		// Rejected rather than failed
+	default:
+		MetricUpsertFailures.WithLabelValues(kind, failureReason(err)).Inc()
+	}
+}
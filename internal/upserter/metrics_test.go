@@ -0,0 +1,94 @@
+package upserter_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/volatiletech/sqlboiler/v4/types"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/models"
+	"go.hollow.sh/metadataservice/internal/upserter"
+)
+
+// unreachableDB returns a database handle every query against fails on,
+// without needing a database to be running
+func unreachableDB(t *testing.T) *sqlx.DB {
+	db, err := sqlx.Open("postgres", "postgres://root@127.0.0.1:1/metadataservice?sslmode=disable&connect_timeout=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+// Test that each retry of a failed upsert is counted, and the final failure is
+// counted by its reason
+func TestUpsertRetryMetrics(t *testing.T) {
+	viper.Set("crdb.max_retries", 2)
+	viper.Set("crdb.tx_timeout", time.Nanosecond)
+	upserter.SetBackoff(upserter.ConstantBackoff(0))
+
+	t.Cleanup(func() {
+		viper.Set("crdb.max_retries", 5)
+		viper.Set("crdb.tx_timeout", 15*time.Second)
+		upserter.SetBackoff(nil)
+	})
+
+	retries := testutil.ToFloat64(upserter.MetricUpsertRetries.WithLabelValues("metadata"))
+	failures := testutil.ToFloat64(upserter.MetricUpsertFailures.WithLabelValues("metadata", "timeout"))
+
+	// Running out of time is retryable, so every attempt is made
+	err := upserter.UpsertMetadata(context.TODO(), unreachableDB(t), zap.NewNop(), instanceID, instanceIPs, &models.InstanceMetadatum{ID: instanceID, Metadata: types.JSON(instanceMetadata0)})
+	assert.Error(t, err)
+
+	assert.Equal(t, retries+2, testutil.ToFloat64(upserter.MetricUpsertRetries.WithLabelValues("metadata")))
+	assert.Equal(t, failures+1, testutil.ToFloat64(upserter.MetricUpsertFailures.WithLabelValues("metadata", "timeout")))
+}
+
+// Test that an upsert which failed with an error retrying won't fix isn't
+// retried
+func TestUpsertNonRetryableMetrics(t *testing.T) {
+	viper.Set("crdb.max_retries", 2)
+	viper.Set("crdb.tx_timeout", 15*time.Second)
+	upserter.SetBackoff(upserter.ConstantBackoff(0))
+
+	t.Cleanup(func() {
+		viper.Set("crdb.max_retries", 5)
+		upserter.SetBackoff(nil)
+	})
+
+	retries := testutil.ToFloat64(upserter.MetricUpsertRetries.WithLabelValues("metadata"))
+	failures := testutil.ToFloat64(upserter.MetricUpsertFailures.WithLabelValues("metadata", "other"))
+
+	err := upserter.UpsertMetadata(context.TODO(), unreachableDB(t), zap.NewNop(), instanceID, instanceIPs, &models.InstanceMetadatum{ID: instanceID, Metadata: types.JSON(instanceMetadata0)})
+	assert.Error(t, err)
+
+	assert.Equal(t, retries, testutil.ToFloat64(upserter.MetricUpsertRetries.WithLabelValues("metadata")))
+	assert.Equal(t, failures+1, testutil.ToFloat64(upserter.MetricUpsertFailures.WithLabelValues("metadata", "other")))
+}
+
+// Test that an upsert which ran out of time is counted as a timeout
+func TestUpsertTimeoutMetrics(t *testing.T) {
+	viper.Set("crdb.max_retries", 0)
+	viper.Set("crdb.tx_timeout", time.Nanosecond)
+
+	t.Cleanup(func() {
+		viper.Set("crdb.max_retries", 5)
+		viper.Set("crdb.tx_timeout", 15*time.Second)
+	})
+
+	timeouts := testutil.ToFloat64(upserter.MetricUpsertFailures.WithLabelValues("userdata", "timeout"))
+
+	err := upserter.UpsertUserdata(context.TODO(), unreachableDB(t), zap.NewNop(), instanceID, instanceIPs, &models.InstanceUserdatum{ID: instanceID})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	assert.Equal(t, timeouts+1, testutil.ToFloat64(upserter.MetricUpsertFailures.WithLabelValues("userdata", "timeout")))
+}
@@ -0,0 +1,58 @@
+package upserter
+
+import (
+	"context"
+
+	"github.com/spf13/viper"
+	"github.com/volatiletech/sqlboiler/v4/boil"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/models"
+)
+
+// deleteOrphanedInstances removes everything stored for the instances which
+// lost their last IP address to this upsert (see deleteInstanceRecords), when
+// ip_conflicts.delete_orphans is set. It's run after the conflicting IP
+// addresses have been deleted, in the same transaction, so an instance left
+// without any address can't be served stale data under an ID nobody can
+// reach it by. Nothing is removed by default.
+func deleteOrphanedInstances(ctx context.Context, exec boil.ContextExecutor, logger *zap.Logger, id string, conflicts models.InstanceIPAddressSlice) error {
+	if !viper.GetBool("ip_conflicts.delete_orphans") {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+
+	for _, conflict := range conflicts {
+		previousID := conflict.InstanceID
+
+		if seen[previousID] {
+			continue
+		}
+
+		seen[previousID] = true
+
+		remaining, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(previousID)).Count(ctx, exec)
+		if err != nil {
+			return err
+		}
+
+		if remaining > 0 {
+			continue
+		}
+
+		deleted, err := deleteInstanceRecords(ctx, exec, previousID)
+		if err != nil {
+			return err
+		}
+
+		logger.Info("deleted orphaned instance",
+			zap.String("instance_id", id),
+			zap.String("orphaned_instance_id", previousID),
+			zap.Bool("metadata", deleted.metadata),
+			zap.Bool("userdata", deleted.userdata),
+		)
+	}
+
+	return nil
+}
@@ -0,0 +1,133 @@
+package upserter_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/volatiletech/null/v8"
+	"github.com/volatiletech/sqlboiler/v4/types"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	"go.hollow.sh/metadataservice/internal/metadatahistory"
+	"go.hollow.sh/metadataservice/internal/models"
+	"go.hollow.sh/metadataservice/internal/upserter"
+)
+
+// storeOldInstance stores metadata and userdata for an instance which is about
+// to lose IP addresses to another
+func storeOldInstance(t *testing.T, testDB *sqlx.DB, id string, ipAddresses []string) {
+	err := upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), id, ipAddresses, &models.InstanceMetadatum{ID: id, Metadata: types.JSON(`{"old":"metadata"}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = upserter.UpsertUserdata(context.TODO(), testDB, zap.NewNop(), id, ipAddresses, &models.InstanceUserdatum{ID: id, Userdata: null.NewBytes([]byte(instanceUserdata0), true)})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func deleteOrphans(t *testing.T, enabled bool) {
+	viper.Set("ip_conflicts.delete_orphans", enabled)
+
+	t.Cleanup(func() {
+		viper.Set("ip_conflicts.delete_orphans", false)
+	})
+}
+
+// Test that an instance losing its last IP address has its records removed
+// when configured
+func TestUpsertDeletesOrphanedInstance(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	oldID := "1f36c15b-b3ef-45da-b7e8-f434287e2f03"
+	storeOldInstance(t, testDB, oldID, instanceIPs[:1])
+
+	deleteOrphans(t, true)
+
+	err := upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &models.InstanceMetadatum{ID: instanceID, Metadata: types.JSON(instanceMetadata0)})
+	assert.NoError(t, err)
+
+	exists, err := models.InstanceMetadatumExists(context.TODO(), testDB, oldID)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	exists, err = models.InstanceUserdatumExists(context.TODO(), testDB, oldID)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	// The new owner is left alone
+	exists, err = models.InstanceMetadatumExists(context.TODO(), testDB, instanceID)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+}
+
+// Test that an orphaned instance's metadata history is kept for audits when
+// the rest of its records are removed
+func TestUpsertKeepsOrphanedInstanceHistory(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	oldID := "1f36c15b-b3ef-45da-b7e8-f434287e2f03"
+	storeOldInstance(t, testDB, oldID, instanceIPs[:1])
+
+	if err := metadatahistory.Record(context.TODO(), testDB, oldID, []byte(`{"new":"metadata"}`), "test", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	deleteOrphans(t, true)
+
+	err := upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &models.InstanceMetadatum{ID: instanceID, Metadata: types.JSON(instanceMetadata0)})
+	assert.NoError(t, err)
+
+	exists, err := models.InstanceMetadatumExists(context.TODO(), testDB, oldID)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	versions, err := metadatahistory.List(context.TODO(), testDB, oldID, 10, 0)
+	assert.NoError(t, err)
+
+	if assert.Len(t, versions, 1) {
+		assert.JSONEq(t, `{"old":"metadata"}`, string(versions[0].Metadata))
+	}
+}
+
+// Test that an instance keeping other IP addresses keeps its records
+func TestUpsertKeepsInstanceWithRemainingIPs(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	oldID := "1f36c15b-b3ef-45da-b7e8-f434287e2f03"
+	storeOldInstance(t, testDB, oldID, []string{instanceIPs[0], "10.0.0.1"})
+
+	deleteOrphans(t, true)
+
+	err := upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &models.InstanceMetadatum{ID: instanceID, Metadata: types.JSON(instanceMetadata0)})
+	assert.NoError(t, err)
+
+	exists, err := models.InstanceMetadatumExists(context.TODO(), testDB, oldID)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	exists, err = models.InstanceUserdatumExists(context.TODO(), testDB, oldID)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+}
+
+// Test that orphaned instances are kept by default
+func TestUpsertKeepsOrphanedInstanceByDefault(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	oldID := "1f36c15b-b3ef-45da-b7e8-f434287e2f03"
+	storeOldInstance(t, testDB, oldID, instanceIPs[:1])
+
+	err := upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &models.InstanceMetadatum{ID: instanceID, Metadata: types.JSON(instanceMetadata0)})
+	assert.NoError(t, err)
+
+	exists, err := models.InstanceMetadatumExists(context.TODO(), testDB, oldID)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+}
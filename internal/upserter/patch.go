@@ -0,0 +1,150 @@
+package upserter
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/volatiletech/sqlboiler/v4/boil"
+	"github.com/volatiletech/sqlboiler/v4/types"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/correlation"
+	"go.hollow.sh/metadataservice/internal/models"
+)
+
+const selectMetadataForUpdateQuery = `SELECT metadata FROM instance_metadata WHERE id = $1 FOR UPDATE`
+
+var (
+	// ErrInvalidMergePatch is returned when a metadata patch isn't a JSON
+	// object
+	ErrInvalidMergePatch = errors.New("invalid merge patch")
+
+	// ErrMetadataNotFound is returned when patching an instance which has no
+	// metadata stored
+	ErrMetadataNotFound = errors.New("no metadata is stored for the instance")
+)
+
+// metadataPatch is the merge patch applied by PatchMetadataWithOptions. It's
+// applied to the stored metadata at the start of each attempt's transaction,
+// so the patched metadata and its IP addresses are worked out from what's
+// stored when the row is locked, rather than when the request arrived.
+type metadataPatch struct {
+	patch    []byte
+	validate func([]byte) error
+	metadata *models.InstanceMetadatum
+}
+
+// apply locks and patches the instance's stored metadata, setting the record
+// to be upserted, and returns the IP addresses listed in the patched metadata
+func (p *metadataPatch) apply(ctx context.Context, exec boil.ContextExecutor) ([]string, error) {
+	var stored []byte
+
+	err := exec.QueryRowContext(ctx, selectMetadataForUpdateQuery, p.metadata.ID).Scan(&stored)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrMetadataNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	patched, err := MergePatch(stored, p.patch)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.validate != nil {
+		if err := p.validate(patched); err != nil {
+			return nil, err
+		}
+	}
+
+	p.metadata.Metadata = types.JSON(patched)
+
+	return ExtractIPAddressesFromMetadata(p.metadata), nil
+}
+
+// MergePatch applies an RFC 7386 JSON merge patch to the document: the
+// patch's fields replace the document's, fields set to null are removed, and
+// objects are merged recursively. The patch must be a JSON object.
+func MergePatch(document, patch []byte) ([]byte, error) {
+	var patchValue interface{}
+
+	if err := decodeJSON(patch, &patchValue); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidMergePatch, err.Error())
+	}
+
+	if _, ok := patchValue.(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("%w: the patch must be a JSON object", ErrInvalidMergePatch)
+	}
+
+	var documentValue interface{}
+
+	if len(document) > 0 {
+		if err := decodeJSON(document, &documentValue); err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(mergePatchValue(documentValue, patchValue))
+}
+
+func mergePatchValue(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+			continue
+		}
+
+		targetObject[key] = mergePatchValue(targetObject[key], value)
+	}
+
+	return targetObject
+}
+
+// decodeJSON decodes numbers as json.Number, so they're written back exactly
+// as they were stored
+func decodeJSON(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	return decoder.Decode(v)
+}
+
+// PatchMetadataWithOptions applies an RFC 7386 JSON merge patch to the
+// instance's stored metadata, in the same transaction as the IP address
+// reconciliation. The IP addresses associated to the instance are those in
+// network.addresses of the patched metadata, handled like a metadata upsert
+// with those addresses, and it's reported as one. validate, when not nil, is
+// given the patched metadata, and an error it returns fails the patch. It
+// returns ErrMetadataNotFound when the instance has no metadata to patch.
+func PatchMetadataWithOptions(ctx context.Context, db *sqlx.DB, logger *zap.Logger, id string, patch []byte, validate func([]byte) error, opts UpsertOptions) (*IPAddressChanges, error) {
+	logger = correlation.Logger(ctx, logger)
+
+	metadata := &models.InstanceMetadatum{ID: id}
+	opts.patch = &metadataPatch{patch: patch, validate: validate, metadata: metadata}
+	opts.unmodifiedQuery = selectMetadataUpdatedAtForUpdateQuery
+
+	metadataUpserter := func(c context.Context, exec boil.ContextExecutor) error {
+		return upsertMetadataRecord(c, exec, metadata, opts)
+	}
+
+	logger.Info("starting upsert", zap.String("kind", upsertKindMetadata), zap.String("instance_id", id), zap.Bool("patch", true))
+
+	return doUpsertWithRetries(ctx, db, logger, upsertKindMetadata, id, nil, metadataUpserter, opts)
+}
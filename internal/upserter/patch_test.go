@@ -0,0 +1,118 @@
+package upserter_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/volatiletech/sqlboiler/v4/types"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	"go.hollow.sh/metadataservice/internal/models"
+	"go.hollow.sh/metadataservice/internal/upserter"
+)
+
+func TestMergePatch(t *testing.T) {
+	testCases := []struct {
+		testName string
+		document string
+		patch    string
+		expected string
+	}{
+		{"adds fields", `{"a":1}`, `{"b":2}`, `{"a":1,"b":2}`},
+		{"replaces fields", `{"a":1,"b":2}`, `{"a":3}`, `{"a":3,"b":2}`},
+		{"removes null fields", `{"a":1,"b":2}`, `{"a":null}`, `{"b":2}`},
+		{"merges objects", `{"network":{"bonding":{"mode":4},"interfaces":[]}}`, `{"network":{"bonding":{"mode":1}}}`, `{"network":{"bonding":{"mode":1},"interfaces":[]}}`},
+		{"replaces arrays", `{"tags":["a","b"]}`, `{"tags":["c"]}`, `{"tags":["c"]}`},
+		{"replaces values with objects", `{"a":"b"}`, `{"a":{"c":"d"}}`, `{"a":{"c":"d"}}`},
+		{"keeps large numbers", `{"a":12345678901234567890}`, `{"b":1}`, `{"a":12345678901234567890,"b":1}`},
+		{"patches an empty document", ``, `{"a":1}`, `{"a":1}`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.testName, func(t *testing.T) {
+			patched, err := upserter.MergePatch([]byte(tc.document), []byte(tc.patch))
+
+			assert.NoError(t, err)
+			assert.JSONEq(t, tc.expected, string(patched))
+		})
+	}
+}
+
+func TestMergePatchInvalid(t *testing.T) {
+	for _, patch := range []string{`not json`, `["a"]`, `"a"`, `null`} {
+		_, err := upserter.MergePatch([]byte(`{"a":1}`), []byte(patch))
+		assert.ErrorIs(t, err, upserter.ErrInvalidMergePatch, patch)
+	}
+}
+
+func TestPatchMetadataReconcilesIPs(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	id := "5c1f4b2e-8d3a-4e6f-9b7c-2a1d0e9f8c7b"
+
+	err := upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), id, []string{"10.10.0.1"}, &models.InstanceMetadatum{
+		ID:       id,
+		Metadata: types.JSON(`{"hostname":"patch-me","network":{"addresses":[{"address":"10.10.0.1"}]}}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patch := `{"tags":["new"],"network":{"addresses":[{"address":"10.10.0.2"}]}}`
+
+	changes, err := upserter.PatchMetadataWithOptions(context.TODO(), testDB, zap.NewNop(), id, []byte(patch), nil, upserter.UpsertOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"10.10.0.2"}, changes.Added)
+	assert.Equal(t, []string{"10.10.0.1"}, changes.Removed)
+
+	metadata, err := models.FindInstanceMetadatum(context.TODO(), testDB, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.JSONEq(t, `{"hostname":"patch-me","tags":["new"],"network":{"addresses":[{"address":"10.10.0.2"}]}}`, string(metadata.Metadata))
+
+	addresses, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(id)).All(context.TODO(), testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Len(t, addresses, 1)
+	assert.Equal(t, "10.10.0.2", addresses[0].Address)
+}
+
+func TestPatchMetadataValidation(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	id := "5c1f4b2e-8d3a-4e6f-9b7c-2a1d0e9f8c7b"
+
+	err := upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), id, nil, &models.InstanceMetadatum{ID: id, Metadata: types.JSON(`{"hostname":"patch-me"}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errInvalid := errors.New("invalid")
+
+	_, err = upserter.PatchMetadataWithOptions(context.TODO(), testDB, zap.NewNop(), id, []byte(`{"hostname":"changed"}`), func([]byte) error { return errInvalid }, upserter.UpsertOptions{})
+	assert.ErrorIs(t, err, errInvalid)
+
+	metadata, err := models.FindInstanceMetadatum(context.TODO(), testDB, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.JSONEq(t, `{"hostname":"patch-me"}`, string(metadata.Metadata))
+}
+
+func TestPatchMetadataNotFound(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	_, err := upserter.PatchMetadataWithOptions(context.TODO(), testDB, zap.NewNop(), "5c1f4b2e-8d3a-4e6f-9b7c-2a1d0e9f8c7b", []byte(`{}`), nil, upserter.UpsertOptions{})
+	assert.ErrorIs(t, err, upserter.ErrMetadataNotFound)
+}
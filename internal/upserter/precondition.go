@@ -0,0 +1,43 @@
+package upserter
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/volatiletech/sqlboiler/v4/boil"
+)
+
+const (
+	selectMetadataUpdatedAtForUpdateQuery = `SELECT updated_at FROM instance_metadata WHERE id = $1 FOR UPDATE`
+	selectUserdataUpdatedAtForUpdateQuery = `SELECT updated_at FROM instance_userdata WHERE id = $1 FOR UPDATE`
+)
+
+// ErrPreconditionFailed is returned when an upsert expected an earlier version
+// of the record than the one stored, or expected one to be stored when it
+// isn't, because something else wrote it in the meantime
+var ErrPreconditionFailed = errors.New("the stored record has changed since the expected version")
+
+// checkUnmodified locks the instance's record selected by query, and checks it
+// hasn't been updated since expected. Locking it first means nothing else can
+// write it between the check and the upsert.
+func checkUnmodified(ctx context.Context, exec boil.ContextExecutor, query string, id string, expected time.Time) error {
+	var updatedAt time.Time
+
+	err := exec.QueryRowContext(ctx, query, id).Scan(&updatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: no record is stored", ErrPreconditionFailed)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if updatedAt.After(expected) {
+		return fmt.Errorf("%w: it was updated at %s", ErrPreconditionFailed, updatedAt.UTC().Format(time.RFC3339Nano))
+	}
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package upserter_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/volatiletech/null/v8"
+	"github.com/volatiletech/sqlboiler/v4/types"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	"go.hollow.sh/metadataservice/internal/models"
+	"go.hollow.sh/metadataservice/internal/upserter"
+)
+
+// Test that an upsert expecting the stored version of the metadata only
+// succeeds while nothing else has written it
+func TestUpsertMetadataExpectedUpdatedAt(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	upsert := func(metadata string, expected *time.Time) error {
+		_, err := upserter.UpsertMetadataWithOptions(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs,
+			&models.InstanceMetadatum{ID: instanceID, Metadata: types.JSON(metadata)}, upserter.UpsertOptions{ExpectedUpdatedAt: expected})
+
+		return err
+	}
+
+	// Nothing is stored yet
+	now := time.Now()
+	assert.ErrorIs(t, upsert(instanceMetadata0, &now), upserter.ErrPreconditionFailed)
+
+	if err := upsert(instanceMetadata0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := models.FindInstanceMetadatum(context.TODO(), testDB, instanceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Expecting the stored version succeeds, once
+	assert.NoError(t, upsert(instanceMetadata1, &stored.UpdatedAt))
+	assert.ErrorIs(t, upsert(instanceMetadata0, &stored.UpdatedAt), upserter.ErrPreconditionFailed)
+
+	// The metadata is left as the successful upsert stored it
+	stored, err = models.FindInstanceMetadatum(context.TODO(), testDB, instanceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.JSONEq(t, instanceMetadata1, string(stored.Metadata))
+}
+
+// Test that an upsert expecting an earlier version of the userdata is rejected
+func TestUpsertUserdataExpectedUpdatedAt(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	userdata := &models.InstanceUserdatum{ID: instanceID, Userdata: null.NewBytes([]byte(instanceUserdata0), true)}
+
+	if err := upserter.UpsertUserdata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, userdata); err != nil {
+		t.Fatal(err)
+	}
+
+	earlier := time.Now().Add(-time.Hour)
+	userdata = &models.InstanceUserdatum{ID: instanceID, Userdata: null.NewBytes([]byte(instanceUserdata1), true)}
+
+	_, err := upserter.UpsertUserdataWithOptions(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, userdata, upserter.UpsertOptions{ExpectedUpdatedAt: &earlier})
+	assert.ErrorIs(t, err, upserter.ErrPreconditionFailed)
+}
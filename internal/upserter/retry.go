@@ -0,0 +1,54 @@
+package upserter
+
+import (
+	"context"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// withRetries makes attempts at a write until one succeeds, one fails with an
+// error which won't succeed when tried again (see isRetryable), or the caller
+// gives up. Retries are bounded by the configured number of retries, the
+// deadline of the context and (when set) the total time budget for all
+// attempts, whichever is reached first. The wait between attempts is
+// determined by the configured Backoff, and if the context is canceled while
+// waiting, its error is returned straight away. Every retry is counted in
+// MetricUpsertRetries under kind. It returns the number of attempts made, the
+// outcome of the last one, and its error.
+func withRetries(ctx context.Context, kind string, attempt func() error) (int, string, error) {
+	maxRetries := viper.GetInt("crdb.max_retries")
+	backoff := currentBackoff()
+	deadline := retryDeadline(ctx, time.Now(), viper.GetDuration("crdb.max_retry_duration"))
+
+	var err error
+
+	for i := 0; ; i++ {
+		err = attempt()
+
+		switch {
+		case err == nil:
+			return i + 1, upsertOutcomeSuccess, nil
+		case ctx.Err() != nil:
+			// The caller has already given up
+			return i + 1, upsertOutcomeCanceled, ctx.Err()
+		case !isRetryable(err), i >= maxRetries:
+			// Trying again would fail the same way, or has been tried enough
+			return i + 1, upsertOutcomeFailed, err
+		}
+
+		delay := backoff.Delay(i + 1)
+
+		// Don't start another attempt if waiting for it would take us past
+		// the deadline, just return the last error we got.
+		if !deadline.IsZero() && !time.Now().Add(delay).Before(deadline) {
+			return i + 1, upsertOutcomeRetryBudgetExhausted, err
+		}
+
+		MetricUpsertRetries.WithLabelValues(kind).Inc()
+
+		if waitErr := waitToRetry(ctx, delay); waitErr != nil {
+			return i + 1, upsertOutcomeCanceled, waitErr
+		}
+	}
+}
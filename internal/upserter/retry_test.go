@@ -0,0 +1,100 @@
+package upserter_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/upserter"
+)
+
+func TestWithRetries(t *testing.T) {
+	viper.Set("crdb.max_retries", 2)
+	upserter.SetBackoff(upserter.ConstantBackoff(0))
+
+	t.Cleanup(func() {
+		viper.Set("crdb.max_retries", 5)
+		upserter.SetBackoff(nil)
+	})
+
+	serializationFailure := &pq.Error{Code: "40001"}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	testCases := []struct {
+		testName string
+		ctx      context.Context
+		errs     []error
+		attempts int
+		outcome  string
+		err      error
+	}{
+		{"success", context.Background(), nil, 1, "success", nil},
+		{"retried until it succeeds", context.Background(), []error{serializationFailure, serializationFailure}, 3, "success", nil},
+		{"too many retries", context.Background(), []error{serializationFailure, serializationFailure, serializationFailure}, 3, "failed", serializationFailure},
+		{"not retryable", context.Background(), []error{upserter.ErrInstanceNotFound}, 1, "failed", upserter.ErrInstanceNotFound},
+		{"caller gave up", canceled, []error{serializationFailure}, 1, "canceled", context.Canceled},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			calls := 0
+
+			attempts, outcome, err := upserter.WithRetries(testcase.ctx, "test", func() error {
+				calls++
+
+				if calls <= len(testcase.errs) {
+					return testcase.errs[calls-1]
+				}
+
+				return nil
+			})
+
+			assert.Equal(t, testcase.attempts, attempts)
+			assert.Equal(t, testcase.attempts, calls)
+			assert.Equal(t, testcase.outcome, outcome)
+
+			if testcase.err == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, testcase.err)
+			}
+		})
+	}
+}
+
+// Test that a delete which failed with an error retrying won't fix isn't
+// retried, while one which ran out of time is
+func TestDeleteInstanceRetries(t *testing.T) {
+	viper.Set("crdb.max_retries", 2)
+	upserter.SetBackoff(upserter.ConstantBackoff(0))
+
+	t.Cleanup(func() {
+		viper.Set("crdb.max_retries", 5)
+		viper.Set("crdb.tx_timeout", 15*time.Second)
+		upserter.SetBackoff(nil)
+	})
+
+	retries := testutil.ToFloat64(upserter.MetricUpsertRetries.WithLabelValues("delete"))
+
+	// The database can't be reached
+	viper.Set("crdb.tx_timeout", 15*time.Second)
+
+	_, err := upserter.DeleteInstance(context.TODO(), unreachableDB(t), zap.NewNop(), instanceID)
+	assert.Error(t, err)
+	assert.Equal(t, retries, testutil.ToFloat64(upserter.MetricUpsertRetries.WithLabelValues("delete")))
+
+	// Running out of time is retryable, so every attempt is made
+	viper.Set("crdb.tx_timeout", time.Nanosecond)
+
+	_, err = upserter.DeleteInstance(context.TODO(), unreachableDB(t), zap.NewNop(), instanceID)
+	assert.Error(t, err)
+	assert.Equal(t, retries+2, testutil.ToFloat64(upserter.MetricUpsertRetries.WithLabelValues("delete")))
+}
@@ -0,0 +1,52 @@
+package upserter
+
+import (
+	"context"
+	"errors"
+)
+
+// SQLSTATE codes CockroachDB reports when a transaction should be retried
+const (
+	// sqlStateSerializationFailure is reported when a transaction couldn't be
+	// serialized with a concurrent one, so has to be retried
+	sqlStateSerializationFailure = "40001"
+
+	// sqlStateStatementCompletionUnknown is reported when it isn't known
+	// whether a statement was committed, like when a node failed mid-commit
+	sqlStateStatementCompletionUnknown = "40003"
+
+	// sqlStateRetryHint is reported by CockroachDB when it asks the client to
+	// retry the transaction
+	sqlStateRetryHint = "CR000"
+)
+
+// sqlStateError is implemented by the errors of both lib/pq and pgconn
+type sqlStateError interface {
+	SQLState() string
+}
+
+// sqlState returns the SQLSTATE code of the database error wrapped by err,
+// or an empty string if there isn't one
+func sqlState(err error) string {
+	var stateErr sqlStateError
+
+	if errors.As(err, &stateErr) {
+		return stateErr.SQLState()
+	}
+
+	return ""
+}
+
+// isRetryable reports whether an upsert which failed with the error may
+// succeed if it's tried again. That's the case for transactions CockroachDB
+// asks to be retried, usually because of contention, and for transactions
+// which ran out of time. Anything else, like a constraint violation or
+// invalid input, fails the same way every time.
+func isRetryable(err error) bool {
+	switch sqlState(err) {
+	case sqlStateSerializationFailure, sqlStateStatementCompletionUnknown, sqlStateRetryHint:
+		return true
+	}
+
+	return errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,38 @@
+package upserter_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/upserter"
+)
+
+func TestIsRetryable(t *testing.T) {
+	testCases := []struct {
+		testName  string
+		err       error
+		retryable bool
+	}{
+		{"serialization failure", &pq.Error{Code: "40001"}, true},
+		{"statement completion unknown", &pq.Error{Code: "40003"}, true},
+		{"cockroachdb retry hint", &pq.Error{Code: "CR000"}, true},
+		{"wrapped serialization failure", fmt.Errorf("committing transaction: %w", &pq.Error{Code: "40001"}), true},
+		{"transaction timeout", fmt.Errorf("inserting metadata: %w", context.DeadlineExceeded), true},
+		{"unique violation", &pq.Error{Code: "23505"}, false},
+		{"invalid text representation", &pq.Error{Code: "22P02"}, false},
+		{"ip conflict", upserter.ErrIPConflict, false},
+		{"canceled", context.Canceled, false},
+		{"other error", errors.New("connection refused"), false},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			assert.Equal(t, testcase.retryable, upserter.IsRetryable(testcase.err))
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package upserter
+
+import (
+	"errors"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	upsertKindMetadata    = "metadata"
+	upsertKindUserdata    = "userdata"
+	upsertKindIPAddresses = "ip-addresses"
+	upsertKindPlan        = "plan"
+	upsertKindDelete      = "delete"
+
+	upsertOutcomeSuccess              = "success"
+	upsertOutcomeConflict             = "conflict_rejected"
+	upsertOutcomePreconditionFailed   = "precondition_failed"
+	upsertOutcomeRetryBudgetExhausted = "retry_budget_exhausted"
+	upsertOutcomeFailed               = "failed"
+	upsertOutcomeCanceled             = "canceled"
+)
+
+// logUpsertSummary emits one log line summarizing an upsert, using typed
+// fields so it can be indexed. The IP address counts are only known when the
+// upsert succeeded, or was rejected because of conflicts.
+func logUpsertSummary(logger *zap.Logger, kind string, id string, changes *IPAddressChanges, duration time.Duration, attempts int, outcome string, err error) {
+	fields := []zap.Field{
+		zap.String("kind", kind),
+		zap.String("instance_id", id),
+		zap.String("outcome", outcome),
+		zap.Duration("duration", duration),
+		zap.Int("attempts", attempts),
+		zap.Int("retries", attempts-1),
+	}
+
+	if changes != nil {
+		fields = append(fields,
+			zap.Int("new_ips", len(changes.Added)),
+			zap.Int("stale_ips", len(changes.Removed)),
+			zap.Int("conflict_ips", len(changes.Reassigned)),
+		)
+	}
+
+	var conflictErr *ConflictError
+	if errors.As(err, &conflictErr) {
+		logger.Warn("upsert finished", append(fields, zap.Int("conflict_ips", len(conflictErr.Conflicts)), zap.Error(err))...)
+		return
+	}
+
+	if errors.Is(err, ErrPreconditionFailed) {
+		logger.Warn("upsert finished", append(fields, zap.Error(err))...)
+		return
+	}
+
+	if err != nil {
+		logger.Error("upsert finished", append(fields, zap.Error(err))...)
+		return
+	}
+
+	logger.Info("upsert finished", fields...)
+}
@@ -0,0 +1,53 @@
+package upserter_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/volatiletech/sqlboiler/v4/types"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	"go.hollow.sh/metadataservice/internal/models"
+	"go.hollow.sh/metadataservice/internal/upserter"
+)
+
+// Test that each upsert is summarized in a single structured log line
+func TestUpsertMetadataLogsSummary(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	metadata := models.InstanceMetadatum{
+		ID:       instanceID,
+		Metadata: types.JSON(instanceMetadata0),
+	}
+
+	err := upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	core, logs := observer.New(zapcore.InfoLevel)
+
+	// One address is kept, one is stale, and one is new
+	err = upserter.UpsertMetadata(context.TODO(), testDB, zap.New(core), instanceID, []string{instanceIPs[0], "10.9.8.7"}, &metadata)
+	assert.Nil(t, err)
+
+	summaries := logs.FilterMessage("upsert finished").All()
+	assert.Len(t, summaries, 1)
+
+	fields := summaries[0].ContextMap()
+
+	assert.Equal(t, "metadata", fields["kind"])
+	assert.Equal(t, instanceID, fields["instance_id"])
+	assert.Equal(t, "success", fields["outcome"])
+	assert.Equal(t, int64(1), fields["attempts"])
+	assert.Equal(t, int64(0), fields["retries"])
+	assert.Equal(t, int64(1), fields["new_ips"])
+	assert.Equal(t, int64(1), fields["stale_ips"])
+	assert.Equal(t, int64(0), fields["conflict_ips"])
+	assert.IsType(t, time.Duration(0), fields["duration"])
+}
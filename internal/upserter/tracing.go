@@ -0,0 +1,101 @@
+package upserter
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName = "go.hollow.sh/metadataservice/internal/upserter"
+
+	attributeInstanceID  = "instance.id"
+	attributeKind        = "upsert.kind"
+	attributeIPCount     = "upsert.ip_addresses"
+	attributeAttempts    = "upsert.attempts"
+	attributeOutcome     = "upsert.outcome"
+	attributeAddedIPs    = "upsert.ip_addresses.added"
+	attributeRemovedIPs  = "upsert.ip_addresses.removed"
+	attributeReassigned  = "upsert.ip_addresses.reassigned"
+	attributeBatchSize   = "upsert.batch.size"
+	attributeBatchFailed = "upsert.batch.failed"
+)
+
+// tracer creates the spans for the upsert path. It uses the global tracer
+// provider, which doesn't record anything unless tracing has been set up.
+var tracer = otel.Tracer(tracerName)
+
+// startStep starts the span covering a single step of an upsert for the
+// instance
+func startStep(ctx context.Context, step string, id string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "upsert."+step, trace.WithAttributes(attribute.String(attributeInstanceID, id)))
+}
+
+// endSpan ends the span, marking it as failed if there's an error
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// setChangeAttributes records the number of IP addresses added, removed and
+// reassigned by an upsert on the span
+func setChangeAttributes(span trace.Span, changes *IPAddressChanges) {
+	if changes == nil {
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int(attributeAddedIPs, len(changes.Added)),
+		attribute.Int(attributeRemovedIPs, len(changes.Removed)),
+		attribute.Int(attributeReassigned, len(changes.Reassigned)),
+	)
+}
+
+// startUpsertSpan starts the span covering an upsert for the instance,
+// including all of its attempts
+func startUpsertSpan(ctx context.Context, kind string, id string, ipAddresses []string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "upsert", trace.WithAttributes(
+		attribute.String(attributeInstanceID, id),
+		attribute.String(attributeKind, kind),
+		attribute.Int(attributeIPCount, len(ipAddresses)),
+	))
+}
+
+// endUpsertSpan records the outcome of an upsert on its span, and ends it
+func endUpsertSpan(span trace.Span, attempts int, outcome string, changes *IPAddressChanges, err error) {
+	span.SetAttributes(
+		attribute.Int(attributeAttempts, attempts),
+		attribute.String(attributeOutcome, outcome),
+	)
+
+	setChangeAttributes(span, changes)
+	endSpan(span, err)
+}
+
+// startBatchSpan starts the span covering a batch upsert of the given number
+// of instances
+func startBatchSpan(ctx context.Context, size int) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "upsert.batch", trace.WithAttributes(attribute.Int(attributeBatchSize, size)))
+}
+
+// endBatchSpan records the number of instances which failed to be written in
+// a batch upsert on its span, and ends it
+func endBatchSpan(span trace.Span, results []BatchResult) {
+	failed := 0
+
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+		}
+	}
+
+	span.SetAttributes(attribute.Int(attributeBatchFailed, failed))
+	span.End()
+}
@@ -0,0 +1,53 @@
+package upserter_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/volatiletech/sqlboiler/v4/types"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	"go.hollow.sh/metadataservice/internal/models"
+	"go.hollow.sh/metadataservice/internal/upserter"
+)
+
+// Test that an upsert is traced, with a span for each step under a span for
+// the whole upsert
+func TestUpsertSpans(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	err := upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &models.InstanceMetadatum{ID: instanceID, Metadata: types.JSON(instanceMetadata0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+
+	upsert, ok := spans["upsert"]
+	if !ok {
+		t.Fatal("upsert span not recorded")
+	}
+
+	assert.Contains(t, upsert.Attributes(), attribute.String("instance.id", instanceID))
+	assert.Contains(t, upsert.Attributes(), attribute.Int("upsert.ip_addresses.added", 2))
+	assert.Contains(t, upsert.Attributes(), attribute.Int("upsert.ip_addresses.removed", 0))
+
+	for _, step := range []string{"select_instance_ips", "select_conflicts", "delete_conflicts", "delete_stale_ips", "insert_new_ips", "upsert_record", "commit"} {
+		span, ok := spans["upsert."+step]
+		if assert.True(t, ok, step) {
+			assert.Equal(t, upsert.SpanContext().SpanID(), span.Parent().SpanID(), step)
+		}
+	}
+}
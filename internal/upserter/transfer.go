@@ -0,0 +1,94 @@
+package upserter
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/spf13/viper"
+	"github.com/volatiletech/sqlboiler/v4/boil"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/models"
+)
+
+const (
+	// TransferSnapshotNone doesn't record anything about the instance an IP
+	// address is taken from, beyond the usual logs. This is the default.
+	TransferSnapshotNone = "none"
+
+	// TransferSnapshotHash records the ID of the instance an IP address is
+	// taken from, along with a hash of its metadata at the time.
+	TransferSnapshotHash = "hash"
+
+	// TransferSnapshotFull records the ID of the instance an IP address is
+	// taken from, along with its full metadata at the time.
+	TransferSnapshotFull = "full"
+)
+
+// ErrInvalidTransferSnapshot is returned when an unknown transfer snapshot
+// mode is provided.
+var ErrInvalidTransferSnapshot = errors.New("invalid ip transfer snapshot mode")
+
+// ValidateTransferSnapshot checks a configured transfer snapshot mode. An
+// empty string is the default (TransferSnapshotNone).
+func ValidateTransferSnapshot(mode string) error {
+	switch mode {
+	case "", TransferSnapshotNone, TransferSnapshotHash, TransferSnapshotFull:
+		return nil
+	default:
+		return fmt.Errorf("%w: %q", ErrInvalidTransferSnapshot, mode)
+	}
+}
+
+// logOwnershipTransfers records, for forensics, what the instances losing IP
+// addresses to this upsert looked like before they lost them. Depending on
+// ip_transfer.snapshot, each previous owner's ID is logged with a hash of its
+// metadata, or with the metadata itself. Nothing is logged by default, as the
+// metadata may be sensitive.
+func logOwnershipTransfers(ctx context.Context, exec boil.ContextExecutor, logger *zap.Logger, id string, conflicts models.InstanceIPAddressSlice) error {
+	mode := viper.GetString("ip_transfer.snapshot")
+	if mode != TransferSnapshotHash && mode != TransferSnapshotFull {
+		return nil
+	}
+
+	addresses := make(map[string][]string)
+	owners := []string{}
+
+	for _, conflict := range conflicts {
+		if _, ok := addresses[conflict.InstanceID]; !ok {
+			owners = append(owners, conflict.InstanceID)
+		}
+
+		addresses[conflict.InstanceID] = append(addresses[conflict.InstanceID], conflict.Address)
+	}
+
+	for _, owner := range owners {
+		fields := []zap.Field{
+			zap.String("previous_instance_id", owner),
+			zap.String("instance_id", id),
+			zap.Strings("addresses", addresses[owner]),
+		}
+
+		metadata, err := models.FindInstanceMetadatum(ctx, exec, owner)
+
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			fields = append(fields, zap.Bool("previous_metadata_found", false))
+		case err != nil:
+			return err
+		case mode == TransferSnapshotFull:
+			fields = append(fields, zap.Bool("previous_metadata_found", true), zap.ByteString("previous_metadata", metadata.Metadata))
+		default:
+			sum := sha256.Sum256(metadata.Metadata)
+			fields = append(fields, zap.Bool("previous_metadata_found", true), zap.String("previous_metadata_sha256", hex.EncodeToString(sum[:])))
+		}
+
+		logger.Warn("IP address ownership transferred", fields...)
+	}
+
+	return nil
+}
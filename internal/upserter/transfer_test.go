@@ -0,0 +1,76 @@
+package upserter_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/volatiletech/sqlboiler/v4/types"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	"go.hollow.sh/metadataservice/internal/models"
+	"go.hollow.sh/metadataservice/internal/upserter"
+)
+
+// Test that the previous owner of a stolen IP address is snapshotted when
+// configured
+func TestUpsertMetadataSnapshotsPreviousOwner(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	oldID := "1f36c15b-b3ef-45da-b7e8-f434287e2f03"
+	oldMetadata := models.InstanceMetadatum{
+		ID:       oldID,
+		Metadata: types.JSON(`{"old":"metadata"}`),
+	}
+
+	err := upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), oldID, instanceIPs, &oldMetadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	viper.Set("ip_transfer.snapshot", upserter.TransferSnapshotHash)
+
+	t.Cleanup(func() {
+		viper.Set("ip_transfer.snapshot", upserter.TransferSnapshotNone)
+	})
+
+	core, logs := observer.New(zapcore.WarnLevel)
+
+	newMetadata := models.InstanceMetadatum{
+		ID:       instanceID,
+		Metadata: types.JSON(instanceMetadata0),
+	}
+
+	err = upserter.UpsertMetadata(context.TODO(), testDB, zap.New(core), instanceID, instanceIPs, &newMetadata)
+	assert.Nil(t, err)
+
+	transfers := logs.FilterMessage("IP address ownership transferred").All()
+	assert.Len(t, transfers, 1)
+
+	// The metadata itself isn't logged, only a hash of it as stored
+	stored, err := models.FindInstanceMetadatum(context.TODO(), testDB, oldID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256(stored.Metadata)
+	fields := transfers[0].ContextMap()
+
+	assert.Equal(t, oldID, fields["previous_instance_id"])
+	assert.Equal(t, hex.EncodeToString(sum[:]), fields["previous_metadata_sha256"])
+	assert.NotContains(t, fields, "previous_metadata")
+}
+
+func TestValidateTransferSnapshot(t *testing.T) {
+	for _, mode := range []string{"", upserter.TransferSnapshotNone, upserter.TransferSnapshotHash, upserter.TransferSnapshotFull} {
+		assert.NoError(t, upserter.ValidateTransferSnapshot(mode))
+	}
+
+	assert.ErrorIs(t, upserter.ValidateTransferSnapshot("everything"), upserter.ErrInvalidTransferSnapshot)
+}
@@ -2,8 +2,12 @@ package upserter
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
-	"math/rand"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
 	"strings"
 	"time"
 
@@ -12,7 +16,19 @@ import (
 	"github.com/volatiletech/sqlboiler/v4/boil"
 	"go.uber.org/zap"
 
+	"go.hollow.sh/metadataservice/internal/correlation"
+	"go.hollow.sh/metadataservice/internal/events"
+	"go.hollow.sh/metadataservice/internal/instancetags"
+	"go.hollow.sh/metadataservice/internal/metadatahistory"
 	"go.hollow.sh/metadataservice/internal/models"
+	"go.hollow.sh/metadataservice/internal/publickeys"
+	"go.hollow.sh/metadataservice/internal/userdata"
+)
+
+const (
+	upsertUserdataEncodingQuery = `INSERT INTO instance_userdata_encodings (instance_id, encoding) VALUES ($1, $2)
+ON CONFLICT (instance_id) DO UPDATE SET encoding = excluded.encoding`
+	deleteUserdataEncodingQuery = `DELETE FROM instance_userdata_encodings WHERE instance_id = $1`
 )
 
 // RecordUpserter is a function defined in by each metadata or userdata upsert
@@ -42,6 +58,157 @@ type MetadataContent struct {
 	Network Network `json:"network"`
 }
 
+// IPAddressChanges describes the changes made to the instance_ip_addresses
+// associations for an instance during an upsert.
+type IPAddressChanges struct {
+	Added      []string       `json:"added"`
+	Removed    []string       `json:"removed"`
+	Reassigned []ReassignedIP `json:"reassigned"`
+}
+
+// ReassignedIP describes an IP address which was previously associated to a
+// different instance, and was reassigned during an upsert.
+type ReassignedIP struct {
+	Address            string `json:"address"`
+	PreviousInstanceID string `json:"previous_instance_id"`
+}
+
+// UpsertOptions holds the optional settings for an upsert
+type UpsertOptions struct {
+	// KeepStaleIPs leaves any IP addresses already associated to the instance
+	// in place, even when they aren't included in the upsert, so associations
+	// pre-loaded ahead of the metadata aren't disturbed. Conflicting
+	// associations to other instances are still reassigned.
+	KeepStaleIPs bool
+
+	// UserdataEncoding records how the userdata being upserted is encoded, so
+	// it can be decoded before it's served. Userdata is stored raw when empty.
+	// Ignored for metadata upserts.
+	UserdataEncoding string
+
+	// RejectConflicts fails the upsert with a *ConflictError, rather than
+	// reassigning them, when any of the IP addresses are associated to other
+	// instances.
+	RejectConflicts bool
+
+	// Events, when set, publishes an event once a metadata or userdata upsert
+	// has been committed.
+	Events *events.Publisher
+
+	// RecordHistory adds the metadata being replaced by a metadata upsert to
+	// the instance's metadata history, as changed by ChangedBy. Ignored for
+	// userdata upserts.
+	RecordHistory bool
+
+	// ChangedBy identifies who made the change, recorded in the metadata
+	// history
+	ChangedBy string
+
+	// PublicKeys, when not nil, replaces the instance's stored SSH public keys
+	// in the same transaction as a metadata upsert. An empty list removes
+	// them. Ignored for userdata upserts.
+	PublicKeys []publickeys.Key
+
+	// Tags, when not nil, replaces the instance's stored tags in the same
+	// transaction as a metadata upsert. An empty map removes them. Ignored
+	// for userdata upserts.
+	Tags map[string]string
+
+	// ExpectedUpdatedAt, when set, makes the upsert optimistic: it fails with
+	// ErrPreconditionFailed when the metadata or userdata being upserted was
+	// stored after it, or isn't stored at all. Without it, the last writer
+	// wins. Ignored for changes to the IP addresses alone, and for plans.
+	ExpectedUpdatedAt *time.Time
+
+	// unmodifiedQuery selects and locks the updated_at of the record being
+	// upserted, for checking ExpectedUpdatedAt. It's set by the metadata and
+	// userdata upserts.
+	unmodifiedQuery string
+
+	// patch, when set, merges a patch into the stored metadata at the start
+	// of each attempt, replacing the IP addresses given to the upsert with
+	// those in the patched metadata. It's set by PatchMetadataWithOptions.
+	patch *metadataPatch
+
+	// dryRun stops the upsert once the changes to the IP address
+	// associations have been worked out, and rolls back the transaction
+	// rather than committing it. It's set by PlanUpsert.
+	dryRun bool
+}
+
+// ErrInvalidIPAddress is returned when an upsert includes something which
+// isn't an IP address or CIDR
+var ErrInvalidIPAddress = errors.New("invalid ip address")
+
+// dedupeIPAddresses converts the addresses in the list to their canonical
+// form, then removes repeated addresses, keeping the first occurrence of each,
+// and returns the number removed. So "10.0.0.1", "10.0.0.1/32", and
+// differently cased or zero-compressed IPv6 addresses are considered the same.
+func dedupeIPAddresses(ipAddresses []string) ([]string, int) {
+	result := make([]string, 0, len(ipAddresses))
+	seen := make(map[string]bool, len(ipAddresses))
+
+	for _, address := range ipAddresses {
+		key := canonicalIPAddress(address)
+		if seen[key] {
+			continue
+		}
+
+		seen[key] = true
+
+		result = append(result, key)
+	}
+
+	return result, len(ipAddresses) - len(result)
+}
+
+// ipv4MappedPrefixBits is the length of the "::ffff:0:0/96" prefix IPv4-mapped
+// IPv6 addresses share
+const ipv4MappedPrefixBits = 96
+
+// canonicalIPAddress returns the canonical form of an IP address or CIDR, or
+// the lowercased input if it's neither. IPv6 addresses are zero-compressed
+// and lowercased (so "2001:0DB8:0000::0001" becomes "2001:db8::1"), IPv4-mapped
+// IPv6 addresses become plain IPv4 addresses, and single-host CIDRs become
+// plain addresses.
+func canonicalIPAddress(address string) string {
+	if ip, err := netip.ParseAddr(address); err == nil {
+		return ip.Unmap().String()
+	}
+
+	if prefix, err := netip.ParsePrefix(address); err == nil {
+		ip, bits := prefix.Addr(), prefix.Bits()
+
+		if ip.Is4In6() && bits >= ipv4MappedPrefixBits {
+			ip, bits = ip.Unmap(), bits-ipv4MappedPrefixBits
+		}
+
+		if bits == ip.BitLen() {
+			return ip.String()
+		}
+
+		return ip.String() + "/" + strconv.Itoa(bits)
+	}
+
+	return strings.ToLower(address)
+}
+
+// ValidateIPAddresses checks each address is an IP address or CIDR, returning
+// ErrInvalidIPAddress for the first which isn't
+func ValidateIPAddresses(ipAddresses []string) error {
+	for _, address := range ipAddresses {
+		if _, err := netip.ParseAddr(address); err == nil {
+			continue
+		}
+
+		if _, err := netip.ParsePrefix(address); err != nil {
+			return fmt.Errorf("%w: %q", ErrInvalidIPAddress, address)
+		}
+	}
+
+	return nil
+}
+
 // ExtractIPAddressesFromMetadata is a helper function used to extract IP addresses
 // from the metadata JSON. We only use this for logging purposes, so it can fail silently.
 func ExtractIPAddressesFromMetadata(metadata *models.InstanceMetadatum) []string {
@@ -77,72 +244,204 @@ func ExtractIPAddressesFromMetadata(metadata *models.InstanceMetadatum) []string
 // record, along with managing inserting new instance_ip_addresses rows and
 // removing conflicting or stale instance_ip_addresses rows.
 func UpsertMetadata(ctx context.Context, db *sqlx.DB, logger *zap.Logger, id string, ipAddresses []string, metadata *models.InstanceMetadatum) error {
+	_, err := UpsertMetadataWithOptions(ctx, db, logger, id, ipAddresses, metadata, UpsertOptions{})
+
+	return err
+}
+
+// UpsertMetadataWithOptions behaves like UpsertMetadata, but allows the caller
+// to supply additional settings. It returns the changes made to the
+// instance's IP address associations.
+func UpsertMetadataWithOptions(ctx context.Context, db *sqlx.DB, logger *zap.Logger, id string, ipAddresses []string, metadata *models.InstanceMetadatum, opts UpsertOptions) (*IPAddressChanges, error) {
+	logger = correlation.Logger(ctx, logger)
+
+	opts.unmodifiedQuery = selectMetadataUpdatedAtForUpdateQuery
+
 	metadataUpserter := func(c context.Context, exec boil.ContextExecutor) error {
-		return metadata.Upsert(c, exec, true, []string{"id"}, boil.Whitelist("metadata", "updated_at"), boil.Infer())
+		return upsertMetadataRecord(c, exec, metadata, opts)
 	}
 
 	// Extract all IP addresses from the metadata body - note that this is different from
-	// the ipAddresses list, which doesn't include IPv6 addresses, as it only includes
-	// addresses that the metadata service would conceivably perform lookups based on.
+	// the ipAddresses list, which only includes addresses that the metadata service
+	// would conceivably perform lookups based on.
 	allIPs := ExtractIPAddressesFromMetadata(metadata)
-	logger.Sugar().Info("Starting metadata upsert for uuid: ", id, " where metadata contains IPs: ", allIPs)
+	logger.Info("starting upsert", zap.String("kind", upsertKindMetadata), zap.String("instance_id", id), zap.Strings("metadata_ips", allIPs))
 
-	return doUpsertWithRetries(ctx, db, logger, id, ipAddresses, metadataUpserter)
+	warnIPAddressDiscrepancy(logger, upsertKindMetadata, id, ipAddresses, allIPs)
+
+	return doUpsertWithRetries(ctx, db, logger, upsertKindMetadata, id, ipAddresses, metadataUpserter, opts)
+}
+
+// upsertMetadataRecord upserts the instance_metadata record, first adding the
+// metadata it replaces to the instance's history when that's enabled, and
+// replacing the instance's public keys and tags when they're given.
+func upsertMetadataRecord(ctx context.Context, exec boil.ContextExecutor, metadata *models.InstanceMetadatum, opts UpsertOptions) error {
+	if opts.RecordHistory {
+		if err := metadatahistory.Record(ctx, exec, metadata.ID, metadata.Metadata, opts.ChangedBy, time.Now().UTC()); err != nil {
+			return err
+		}
+	}
+
+	if err := metadata.Upsert(ctx, exec, true, []string{"id"}, boil.Whitelist("metadata", "updated_at"), boil.Infer()); err != nil {
+		return err
+	}
+
+	if opts.PublicKeys != nil {
+		if err := publickeys.Replace(ctx, exec, metadata.ID, opts.PublicKeys); err != nil {
+			return err
+		}
+	}
+
+	if opts.Tags == nil {
+		return nil
+	}
+
+	return instancetags.Replace(ctx, exec, metadata.ID, opts.Tags)
 }
 
 // UpsertUserdata is used to upsert (update or insert) an instance_userdata
 // record, along with managing inserting new instance_ip_addresses rows and
 // removing conflicting or stale instance_ip_addresses rows.
 func UpsertUserdata(ctx context.Context, db *sqlx.DB, logger *zap.Logger, id string, ipAddresses []string, userdata *models.InstanceUserdatum) error {
+	_, err := UpsertUserdataWithOptions(ctx, db, logger, id, ipAddresses, userdata, UpsertOptions{})
+
+	return err
+}
+
+// UpsertUserdataWithOptions behaves like UpsertUserdata, but allows the caller
+// to supply additional settings. It returns the changes made to the
+// instance's IP address associations.
+func UpsertUserdataWithOptions(ctx context.Context, db *sqlx.DB, logger *zap.Logger, id string, ipAddresses []string, userdata *models.InstanceUserdatum, opts UpsertOptions) (*IPAddressChanges, error) {
+	logger = correlation.Logger(ctx, logger)
+
+	opts.unmodifiedQuery = selectUserdataUpdatedAtForUpdateQuery
+
 	userdataUpserter := func(c context.Context, exec boil.ContextExecutor) error {
-		return userdata.Upsert(c, exec, true, []string{"id"}, boil.Whitelist("userdata", "updated_at"), boil.Infer())
+		if err := userdata.Upsert(c, exec, true, []string{"id"}, boil.Whitelist("userdata", "updated_at"), boil.Infer()); err != nil {
+			return err
+		}
+
+		return SetUserdataEncoding(c, exec, id, opts.UserdataEncoding)
 	}
 
-	logger.Sugar().Info("Starting userdata upsert for uuid: ", id)
+	logger.Info("starting upsert", zap.String("kind", upsertKindUserdata), zap.String("instance_id", id))
 
-	return doUpsertWithRetries(ctx, db, logger, id, ipAddresses, userdataUpserter)
+	return doUpsertWithRetries(ctx, db, logger, upsertKindUserdata, id, ipAddresses, userdataUpserter, opts)
 }
 
-// doUpsertWithRetries is just a wrapper function that invokes doUpsert(), but handles the retry logic
-func doUpsertWithRetries(ctx context.Context, db *sqlx.DB, logger *zap.Logger, id string, ipAddresses []string, upsertRecordFunc RecordUpserter) error {
-	upsertSuccess := false
-	maxUpsertRetries := viper.GetInt("crdb.max_retries")
-	dbRetryInterval := viper.GetDuration("crdb.retry_interval")
+// SetUserdataEncoding records how an instance's stored userdata is encoded.
+// Nothing is recorded for raw (or empty) encodings, as that's the default.
+func SetUserdataEncoding(ctx context.Context, exec boil.ContextExecutor, id string, encoding string) error {
+	if encoding == "" || encoding == userdata.EncodingRaw {
+		_, err := exec.ExecContext(ctx, deleteUserdataEncodingQuery, id)
 
-	var err error
+		return err
+	}
 
-	for i := 0; i <= maxUpsertRetries && !upsertSuccess; i++ {
-		err = doUpsert(ctx, db, logger, id, ipAddresses, upsertRecordFunc)
-		if err == nil {
-			upsertSuccess = true
+	_, err := exec.ExecContext(ctx, upsertUserdataEncodingQuery, id, encoding)
 
-			if i > 0 {
-				logger.Sugar().Info("Upsert operation for instance: ", id, " successful on retry attempt #", i)
-			} else {
-				logger.Sugar().Info("Upsert operation for instance: ", id, " successful on first attempt")
-			}
-		} else {
-			// Exponential backoff would be overkill here, but adding a bit of jitter
-			// to sleep a short time is reasonable
-			jitter := time.Duration(rand.Int63n(int64(dbRetryInterval)))
-			time.Sleep(jitter)
-		}
+	return err
+}
+
+// ReassociateIPs reconciles the instance_ip_addresses rows for an instance
+// against the given list of IP addresses, using the same conflict and stale
+// IP handling as an upsert, while leaving the instance's metadata and
+// userdata untouched. It returns the changes made to the associations.
+func ReassociateIPs(ctx context.Context, db *sqlx.DB, logger *zap.Logger, id string, ipAddresses []string) (*IPAddressChanges, error) {
+	return ReassociateIPsWithOptions(ctx, db, logger, id, ipAddresses, UpsertOptions{})
+}
+
+// ReassociateIPsWithOptions behaves like ReassociateIPs, but allows the caller
+// to supply additional settings. The instance doesn't need to have metadata
+// or userdata stored, so this can be used to pre-load associations.
+func ReassociateIPsWithOptions(ctx context.Context, db *sqlx.DB, logger *zap.Logger, id string, ipAddresses []string, opts UpsertOptions) (*IPAddressChanges, error) {
+	logger = correlation.Logger(ctx, logger)
+
+	noopUpserter := func(c context.Context, exec boil.ContextExecutor) error {
+		return nil
 	}
 
-	if !upsertSuccess {
-		logger.Sugar().Error("Upsert operation failed for instance: ", id, " even after ", maxUpsertRetries, " attempts")
-		return err
+	logger.Info("starting upsert", zap.String("kind", upsertKindIPAddresses), zap.String("instance_id", id), zap.Strings("ip_addresses", ipAddresses))
+
+	return doUpsertWithRetries(ctx, db, logger, upsertKindIPAddresses, id, ipAddresses, noopUpserter, opts)
+}
+
+// PlanUpsert works out the changes an upsert of the given IP addresses would
+// make to the instance's associations, with the same settings, without making
+// any of them: the conflicting, stale and new IP addresses are found as they
+// would be for the upsert, then the transaction is rolled back. When
+// opts.RejectConflicts is set and there are conflicts, a *ConflictError is
+// returned, as the upsert would. The plan is the same for a metadata or a
+// userdata upsert, and no event is published.
+func PlanUpsert(ctx context.Context, db *sqlx.DB, logger *zap.Logger, id string, ipAddresses []string, opts UpsertOptions) (*IPAddressChanges, error) {
+	logger = correlation.Logger(ctx, logger)
+
+	opts.dryRun = true
+	opts.Events = nil
+
+	noopUpserter := func(context.Context, boil.ContextExecutor) error {
+		return nil
 	}
 
-	return nil
+	return doUpsertWithRetries(ctx, db, logger, upsertKindPlan, id, ipAddresses, noopUpserter, opts)
+}
+
+// doUpsertWithRetries is just a wrapper function that invokes doUpsert(), but
+// handles the retry logic, with the limits and backoff of withRetries. Once
+// it's done, a single structured log line summarizing the upsert is emitted.
+func doUpsertWithRetries(ctx context.Context, db *sqlx.DB, logger *zap.Logger, kind string, id string, ipAddresses []string, upsertRecordFunc RecordUpserter, opts UpsertOptions) (*IPAddressChanges, error) {
+	start := time.Now()
+
+	var (
+		changes  *IPAddressChanges
+		err      error
+		attempts int
+		outcome  = upsertOutcomeFailed
+	)
+
+	ctx, span := startUpsertSpan(ctx, kind, id, ipAddresses)
+
+	defer func() {
+		endUpsertSpan(span, attempts, outcome, changes, err)
+		logUpsertSummary(logger, kind, id, changes, time.Since(start), attempts, outcome, err)
+		observeUpsertResult(kind, attempts, err)
+	}()
+
+	attempts, outcome, err = withRetries(ctx, kind, func() error {
+		var attemptErr error
+
+		attemptStart := time.Now()
+		changes, attemptErr = doUpsert(ctx, db, logger, id, ipAddresses, upsertRecordFunc, opts)
+
+		observeTransaction(kind, attemptStart)
+
+		return attemptErr
+	})
+
+	switch {
+	case err == nil:
+		publishUpsertEvent(ctx, opts.Events, kind, id, changes)
+
+		return changes, nil
+	case errors.Is(err, ErrIPConflict):
+		// Retrying won't resolve the conflict
+		outcome = upsertOutcomeConflict
+	case errors.Is(err, ErrPreconditionFailed):
+		// The record will only get newer
+		outcome = upsertOutcomePreconditionFailed
+	}
+
+	changes = nil
+
+	return nil, err
 }
 
 // doUpsert handles the functionality common to inserting or updating both
 // metadata and userdata records. Namely, handling conflicting or stale
-// (in the case of an update) IP address associations.
-func doUpsert(ctx context.Context, db *sqlx.DB, logger *zap.Logger, id string, ipAddresses []string, upsertRecordFunc RecordUpserter) error {
-	logger.Sugar().Info("doUpsert starting for id: ", id, " - upserting lookupable IPs ", ipAddresses)
-
+// (in the case of an update) IP address associations. If the transaction
+// times out, the returned error wraps context.DeadlineExceeded, whichever
+// database call noticed it.
+func doUpsert(ctx context.Context, db *sqlx.DB, logger *zap.Logger, id string, ipAddresses []string, upsertRecordFunc RecordUpserter, opts UpsertOptions) (_ *IPAddressChanges, err error) {
 	ctx = boil.WithDebug(ctx, true)
 
 	// Start a DB transaction
@@ -151,57 +450,154 @@ func doUpsert(ctx context.Context, db *sqlx.DB, logger *zap.Logger, id string, i
 	ctxWithTimeout, cancel := context.WithTimeout(ctx, viper.GetDuration("crdb.tx_timeout"))
 	defer cancel()
 
+	// The driver doesn't always report a timeout as one, so check the context
+	defer func() {
+		if err != nil && !errors.Is(err, context.DeadlineExceeded) && errors.Is(ctxWithTimeout.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("%w: %s", context.DeadlineExceeded, err.Error())
+		}
+	}()
+
 	tx, err := db.BeginTx(ctxWithTimeout, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// If there's an error, we'll want to roll back the transaction.
 	defer func() {
 		if txErr {
-			logger.Sugar().Warn("Rolling back doUpsert transaction for instance: ", id, " with ipAddresses: ", ipAddresses)
+			logger.Warn("rolling back upsert transaction", zap.String("instance_id", id), zap.Strings("ip_addresses", ipAddresses))
 
 			err := tx.Rollback()
 			if err != nil {
-				logger.Sugar().Error("Could not roll back doUpsert transaction for instance: ", id, "Error: ", err)
+				logger.Error("could not roll back upsert transaction", zap.String("instance_id", id), zap.Error(err))
 			}
 		}
 	}()
 
+	changes, err := upsertInTx(ctxWithTimeout, tx, logger, id, ipAddresses, upsertRecordFunc, opts)
+	if err != nil {
+		txErr = true
+
+		return nil, err
+	}
+
+	// Nothing was changed by a dry run, but it's rolled back to release any
+	// locks it took
+	if opts.dryRun {
+		if err := tx.Rollback(); err != nil {
+			return nil, err
+		}
+
+		return changes, nil
+	}
+
+	// Step 7
+	// Commit our transaction
+	_, span := startStep(ctxWithTimeout, "commit", id)
+	err = tx.Commit()
+
+	endSpan(span, err)
+
+	if err != nil {
+		txErr = true
+
+		logger.Warn("unable to commit upsert transaction", zap.String("instance_id", id), zap.Error(err))
+
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+// upsertInTx runs steps 1 through 6 of doUpsert in the given transaction,
+// leaving it to the caller to commit it (or roll it back, if an error is
+// returned).
+func upsertInTx(ctx context.Context, tx *sql.Tx, logger *zap.Logger, id string, ipAddresses []string, upsertRecordFunc RecordUpserter, opts UpsertOptions) (*IPAddressChanges, error) {
+	// The record is locked and checked before anything else, so it can't be
+	// written between the check and the upsert
+	if opts.ExpectedUpdatedAt != nil && opts.unmodifiedQuery != "" && !opts.dryRun {
+		if err := checkUnmodified(ctx, tx, opts.unmodifiedQuery, id, *opts.ExpectedUpdatedAt); err != nil {
+			return nil, err
+		}
+	}
+
+	// A patch is applied to the metadata as it's stored now, and the IP
+	// addresses are reconciled against the patched metadata
+	if opts.patch != nil {
+		patchedIPs, err := opts.patch.apply(ctx, tx)
+		if err != nil {
+			return nil, err
+		}
+
+		ipAddresses = patchedIPs
+	}
+
+	// Each address can only be inserted once per transaction, so repeats in the
+	// request have to be dropped before working out what's new. Addresses are
+	// stored and compared in their canonical form from here on.
+	ipAddresses, duplicates := dedupeIPAddresses(ipAddresses)
+	if duplicates > 0 {
+		logger.Warn("ignoring duplicate IP addresses", zap.String("instance_id", id), zap.Int("duplicate_ips", duplicates))
+	}
+
+	if err := ValidateIPAddresses(ipAddresses); err != nil {
+		return nil, err
+	}
+
+	logger.Debug("upsert attempt starting", zap.String("instance_id", id), zap.Strings("ip_addresses", ipAddresses))
+
 	// Step 1
 	// Select and lock the ip address rows that may be updated or deleted by this operation, to prevent race conditions
 	// This includes:
 	// * ip addresses that already exist for this instance id (instanceIPAddresses)
 	// * ip addresses included in this update request, but are associated with a different instance id (conflictIPs)
-	instanceIPAddresses, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(id)).All(ctxWithTimeout, db)
+	// * networks overlapping a network included in this update request, associated with a different instance id (also conflictIPs)
+	stepCtx, span := startStep(ctx, "select_instance_ips", id)
+	instanceIPAddresses, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(id)).All(stepCtx, tx)
+
+	endSpan(span, err)
+
 	if err != nil {
-		logger.Sugar().Error("doUpsert DB error when selecting instanceIPAddresses for update: ", err)
-		return err
+		logger.Error("upsert db error selecting the instance's IP addresses", zap.String("instance_id", id), zap.Error(err))
+		return nil, err
 	}
 
-	conflictIPs, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.Address.IN(ipAddresses), models.InstanceIPAddressWhere.InstanceID.NEQ(id)).All(ctxWithTimeout, db)
+	stepCtx, span = startStep(ctx, "select_conflicts", id)
+	conflictIPs, err := models.InstanceIPAddresses(conflictingIPsMods(id, ipAddresses)...).All(stepCtx, tx)
+
+	endSpan(span, err)
+
 	if err != nil {
-		logger.Sugar().Error("doUpsert DB error when selecting conflictIPs for update: ", err)
-		return err
+		logger.Error("upsert db error selecting conflicting IP addresses", zap.String("instance_id", id), zap.Error(err))
+		return nil, err
+	}
+
+	// When asked to, leave conflicting IP addresses alone and let the caller
+	// reconcile them instead
+	if opts.RejectConflicts && len(conflictIPs) > 0 {
+		logger.Warn("rejecting upsert with IP addresses associated to other instances", zap.String("instance_id", id), zap.Int("conflict_ips", len(conflictIPs)))
+
+		return nil, newConflictError(conflictIPs)
 	}
 
 	// Step 2.a
 	// Find "stale" InstanceIPAddress rows for this instance. That is, select
 	// rows from the instanceIPAddresses result which don't have a corresponding
-	// entry in the list of IP Addresses supplied in the call.
+	// entry in the list of IP Addresses supplied in the call. When the caller
+	// asked to keep them, there aren't any.
 	var staleInstanceIPAddresses models.InstanceIPAddressSlice
 
 	for _, instanceIP := range instanceIPAddresses {
 		found := false
 
 		for _, IP := range ipAddresses {
-			if strings.EqualFold(instanceIP.Address, IP) {
+			if canonicalIPAddress(instanceIP.Address) == IP {
 				found = true
 				break
 			}
 		}
 
-		if !found {
+		if !found && !opts.KeepStaleIPs {
 			staleInstanceIPAddresses = append(staleInstanceIPAddresses, instanceIP)
 		}
 	}
@@ -215,7 +611,7 @@ func doUpsert(ctx context.Context, db *sqlx.DB, logger *zap.Logger, id string, i
 		found := false
 
 		for _, instanceIP := range instanceIPAddresses {
-			if strings.EqualFold(IP, instanceIP.Address) {
+			if IP == canonicalIPAddress(instanceIP.Address) {
 				found = true
 				break
 			}
@@ -230,49 +626,32 @@ func doUpsert(ctx context.Context, db *sqlx.DB, logger *zap.Logger, id string, i
 		}
 	}
 
+	// A dry run stops here, reporting what the remaining steps would do
+	if opts.dryRun {
+		return ipAddressChanges(newInstanceIPAddresses, staleInstanceIPAddresses, conflictIPs), nil
+	}
+
 	// Step 3
 	// Remove any instance_ip_address rows for the specified IP addresses that
-	// are currently associated to a *different* instance ID
-	for _, conflictingIP := range conflictIPs {
-		// TODO: Maybe remove instance_metadata and instance_userdata records for the "old" instance ID(s)?
-		// Potentially after checking to see if this IP was the *last* IP address associated to the
-		// "old" instance ID?
-		_, err := conflictingIP.Delete(ctxWithTimeout, tx)
-		if err != nil {
-			txErr = true
-
-			logger.Sugar().Error("doUpsert DB error when deleting conflictIPs: ", err)
-
-			return err
-		}
+	// are currently associated to a *different* instance ID, after taking a
+	// snapshot of those instances (when configured). Instances losing their
+	// last IP address have their records removed too (when configured).
+	if err := deleteConflictingIPs(ctx, tx, logger, id, conflictIPs); err != nil {
+		return nil, err
 	}
 
 	// Step 4
 	// Remove any "stale" instance_ip_addresses rows associated to the provided
 	// instnace_id but were not specified in the call.
-	for _, staleIP := range staleInstanceIPAddresses {
-		_, err := staleIP.Delete(ctxWithTimeout, tx)
-		if err != nil {
-			txErr = true
-
-			logger.Sugar().Error("doUpsert DB error when deleting staleIPs: ", err)
-
-			return err
-		}
+	if err := deleteStaleIPs(ctx, tx, logger, id, staleInstanceIPAddresses); err != nil {
+		return nil, err
 	}
 
 	// Step 5
 	// Create instance_ip_addresses rows for any IP addresses specified in the
 	// call that aren't already associated to the provided instance_id
-	for _, newInstanceIP := range newInstanceIPAddresses {
-		err := newInstanceIP.Insert(ctxWithTimeout, tx, boil.Infer())
-		if err != nil {
-			txErr = true
-
-			logger.Sugar().Error("doUpsert DB error when inserting newInstanceIPs: ", err)
-
-			return err
-		}
+	if err := insertNewIPs(ctx, tx, logger, id, newInstanceIPAddresses); err != nil {
+		return nil, err
 	}
 
 	// Step 6
@@ -281,24 +660,108 @@ func doUpsert(ctx context.Context, db *sqlx.DB, logger *zap.Logger, id string, i
 	// is no current row for instance_id. If there is an existing row matching on
 	// instance_id, instead this will just update the metadata or userdata column
 	// value.
-	if err := upsertRecordFunc(ctxWithTimeout, tx); err != nil {
-		txErr = true
+	stepCtx, span = startStep(ctx, "upsert_record", id)
+	err = upsertRecordFunc(stepCtx, tx)
+
+	endSpan(span, err)
+
+	if err != nil {
+		logger.Error("upsert db error upserting the instance_metadata or instance_userdata record", zap.String("instance_id", id), zap.Error(err))
+
+		return nil, err
+	}
 
-		logger.Sugar().Error("doUpsert DB error when upserting the instance_metadata or instance_userdata table: ", err)
+	return ipAddressChanges(newInstanceIPAddresses, staleInstanceIPAddresses, conflictIPs), nil
+}
+
+// deleteConflictingIPs runs step 3 of doUpsert, removing the IP addresses
+// associated to other instances after snapshotting their previous owners, then
+// removing the records of any previous owner left without an IP address (when
+// configured)
+func deleteConflictingIPs(ctx context.Context, tx *sql.Tx, logger *zap.Logger, id string, conflictIPs models.InstanceIPAddressSlice) (err error) {
+	ctx, span := startStep(ctx, "delete_conflicts", id)
+	defer func() { endSpan(span, err) }()
+
+	if err := logOwnershipTransfers(ctx, tx, logger, id, conflictIPs); err != nil {
+		logger.Error("upsert db error snapshotting the previous owners of conflicting IP addresses", zap.String("instance_id", id), zap.Error(err))
 
 		return err
 	}
 
-	// Step 7
-	// Commit our transaction
-	err = tx.Commit()
-	if err != nil {
-		txErr = true
+	for _, conflictingIP := range conflictIPs {
+		_, err := conflictingIP.Delete(ctx, tx)
+		if err != nil {
+			logger.Error("upsert db error deleting conflicting IP addresses", zap.String("instance_id", id), zap.Error(err))
 
-		logger.Sugar().Warn("Unable to commit db upsert transaction for instance: ", id, "Error: ", err)
+			return err
+		}
+	}
+
+	if err := deleteOrphanedInstances(ctx, tx, logger, id, conflictIPs); err != nil {
+		logger.Error("upsert db error deleting orphaned instances", zap.String("instance_id", id), zap.Error(err))
 
 		return err
 	}
 
 	return nil
 }
+
+// deleteStaleIPs runs step 4 of doUpsert, removing the instance's IP
+// addresses which weren't included in the upsert
+func deleteStaleIPs(ctx context.Context, tx *sql.Tx, logger *zap.Logger, id string, staleIPs models.InstanceIPAddressSlice) (err error) {
+	ctx, span := startStep(ctx, "delete_stale_ips", id)
+	defer func() { endSpan(span, err) }()
+
+	for _, staleIP := range staleIPs {
+		_, err := staleIP.Delete(ctx, tx)
+		if err != nil {
+			logger.Error("upsert db error deleting stale IP addresses", zap.String("instance_id", id), zap.Error(err))
+
+			return err
+		}
+	}
+
+	return nil
+}
+
+// insertNewIPs runs step 5 of doUpsert, associating the IP addresses which
+// weren't already associated to the instance
+func insertNewIPs(ctx context.Context, tx *sql.Tx, logger *zap.Logger, id string, newIPs models.InstanceIPAddressSlice) (err error) {
+	ctx, span := startStep(ctx, "insert_new_ips", id)
+	defer func() { endSpan(span, err) }()
+
+	for _, newInstanceIP := range newIPs {
+		err := newInstanceIP.Insert(ctx, tx, boil.Infer())
+		if err != nil {
+			logger.Error("upsert db error inserting new IP addresses", zap.String("instance_id", id), zap.Error(err))
+
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ipAddressChanges builds the summary of the IP association changes made by
+// doUpsert
+func ipAddressChanges(added, stale, conflicts models.InstanceIPAddressSlice) *IPAddressChanges {
+	changes := &IPAddressChanges{
+		Added:      []string{},
+		Removed:    []string{},
+		Reassigned: []ReassignedIP{},
+	}
+
+	for _, ip := range added {
+		changes.Added = append(changes.Added, ip.Address)
+	}
+
+	for _, ip := range stale {
+		changes.Removed = append(changes.Removed, ip.Address)
+	}
+
+	for _, ip := range conflicts {
+		changes.Reassigned = append(changes.Reassigned, ReassignedIP{Address: ip.Address, PreviousInstanceID: ip.InstanceID})
+	}
+
+	return changes
+}
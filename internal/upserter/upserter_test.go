@@ -112,6 +112,98 @@ func TestUpsertMetadataAddsInstanceIPAddressesRows(t *testing.T) {
 	assert.Equal(t, instanceIPAddressesCount+2, newInstanceIPAddressesCount)
 }
 
+// Test that an address repeated in the request is only associated once
+func TestUpsertMetadataWithDuplicateIPAddresses(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+	metadata := models.InstanceMetadatum{
+		ID:       instanceID,
+		Metadata: types.JSON(instanceMetadata0),
+	}
+
+	duplicateIPs := []string{"1.2.3.4", "1.2.3.4", "1.2.3.4/32", "1f00:1f00:1f00:1f00::9/127", "1F00:1F00:1F00:1F00::9/127"}
+
+	instanceIPAddressesCount, err := models.InstanceIPAddresses().Count(context.TODO(), testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), instanceID, duplicateIPs, &metadata)
+	assert.Nil(t, err)
+
+	newInstanceIPAddressesCount, err := models.InstanceIPAddresses().Count(context.TODO(), testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, instanceIPAddressesCount+2, newInstanceIPAddressesCount)
+}
+
+// Test that an instance can have both IPv4 and IPv6 addresses, and that
+// they're stored in their canonical form
+func TestUpsertMetadataWithMixedIPAddressFamilies(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+	metadata := models.InstanceMetadatum{
+		ID:       instanceID,
+		Metadata: types.JSON(instanceMetadata0),
+	}
+
+	mixedIPs := []string{"1.2.3.4", "2001:0DB8:0000:0000:0000:0000:0000:0001", "10.1.2.3/31", "2001:db8:0:1::/64", "::ffff:1.2.3.5"}
+
+	err := upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), instanceID, mixedIPs, &metadata)
+	assert.Nil(t, err)
+
+	instanceIPAddresses, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(instanceID)).All(context.TODO(), testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var addresses []string
+	for _, instanceIP := range instanceIPAddresses {
+		addresses = append(addresses, instanceIP.Address)
+	}
+
+	assert.ElementsMatch(t, []string{"1.2.3.4", "2001:db8::1", "10.1.2.3/31", "2001:db8:0:1::/64", "1.2.3.5"}, addresses)
+}
+
+// Test that an IPv6 address written differently (zero-compressed, with
+// leading zeros, or in a different case) in a later upsert is recognized as
+// the address already associated to the instance, rather than as a stale
+// address and a new one
+func TestUpsertMetadataMatchesZeroCompressedIPv6Addresses(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+	metadata := models.InstanceMetadatum{
+		ID:       instanceID,
+		Metadata: types.JSON(instanceMetadata0),
+	}
+
+	err := upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), instanceID, []string{"1.2.3.4", "2001:db8::1", "2001:db8:0:0:1::/80"}, &metadata)
+	assert.Nil(t, err)
+
+	instanceIPAddresses, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(instanceID)).All(context.TODO(), testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 3, len(instanceIPAddresses))
+
+	for _, ips := range [][]string{
+		{"1.2.3.4", "2001:0db8:0000::0001", "2001:DB8::1:0:0:0/80"},
+		{"1.2.3.4/32", "2001:0DB8:0:0:0:0:0:1/128", "2001:0db8:0000:0000:0001:0000:0000:0000/80"},
+	} {
+		changes, err := upserter.ReassociateIPs(context.TODO(), testDB, zap.NewNop(), instanceID, ips)
+		assert.Nil(t, err)
+		assert.Empty(t, changes.Added, ips)
+		assert.Empty(t, changes.Removed, ips)
+	}
+
+	// The IPv6 address can be removed however it's written, while the
+	// remaining addresses are kept
+	changes, err := upserter.ReassociateIPs(context.TODO(), testDB, zap.NewNop(), instanceID, []string{"1.2.3.4", "2001:0db8::1"})
+	assert.Nil(t, err)
+	assert.Empty(t, changes.Added)
+	assert.Equal(t, 1, len(changes.Removed))
+}
+
 // Test that upsert metadata updates the instance_metadata row and removes any
 // "stale" instance_ip_addresses rows. "Stale" IPs are addresses that were
 // previously associated to the instance, but weren't included in a subsequent
@@ -422,3 +514,197 @@ func TestUpsertUserdataRemovesConflictingIPAddressesRows(t *testing.T) {
 
 	assert.Equal(t, 0, len(oldInstanceIPAddresses))
 }
+
+// Test that the upsert retry loop stops once the total retry time budget has
+// been exhausted, even if there are retries remaining
+func TestUpsertMetadataStopsAtRetryTimeBudget(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	viper.Set("crdb.max_retries", 100)
+	viper.Set("crdb.retry_interval", 100*time.Millisecond)
+	viper.Set("crdb.tx_timeout", time.Nanosecond)
+	viper.Set("crdb.max_retry_duration", 500*time.Millisecond)
+
+	t.Cleanup(func() {
+		viper.Set("crdb.max_retries", 5)
+		viper.Set("crdb.retry_interval", 1*time.Second)
+		viper.Set("crdb.tx_timeout", 15*time.Second)
+		viper.Set("crdb.max_retry_duration", 0)
+	})
+
+	metadata := models.InstanceMetadatum{
+		ID:       instanceID,
+		Metadata: types.JSON(instanceMetadata0),
+	}
+
+	// Every attempt runs out of time, which is retryable
+	start := time.Now()
+	err := upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &metadata)
+
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+// Test that a failed upsert is retried using the configured backoff, waiting
+// before each retry but not after the final attempt
+func TestUpsertMetadataRetriesUseBackoff(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.Set("crdb.tx_timeout", time.Nanosecond)
+
+	var attempts []int
+
+	upserter.SetBackoff(upserter.BackoffFunc(func(attempt int) time.Duration {
+		attempts = append(attempts, attempt)
+		return 0
+	}))
+
+	t.Cleanup(func() {
+		viper.Set("crdb.tx_timeout", 15*time.Second)
+		upserter.SetBackoff(nil)
+	})
+
+	metadata := models.InstanceMetadatum{
+		ID:       instanceID,
+		Metadata: types.JSON(instanceMetadata0),
+	}
+
+	// Every attempt runs out of time, which is retryable
+	err := upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, &metadata)
+
+	assert.Error(t, err)
+	assert.Equal(t, []int{1, 2, 3, 4, 5}, attempts)
+}
+
+// Test that an upsert which fails with an error retrying won't fix is only
+// attempted once
+func TestUpsertMetadataNonRetryableErrorNotRetried(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	var attempts []int
+
+	upserter.SetBackoff(upserter.BackoffFunc(func(attempt int) time.Duration {
+		attempts = append(attempts, attempt)
+		return 0
+	}))
+
+	t.Cleanup(func() {
+		upserter.SetBackoff(nil)
+	})
+
+	metadata := models.InstanceMetadatum{
+		ID:       instanceID,
+		Metadata: types.JSON(instanceMetadata0),
+	}
+
+	// An invalid IP address fails the same way every time
+	err := upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), instanceID, []string{"not-an-ip"}, &metadata)
+
+	assert.ErrorIs(t, err, upserter.ErrInvalidIPAddress)
+	assert.Empty(t, attempts)
+}
+
+// Test that networks overlapping a network associated to another instance
+// conflict, but single addresses within it don't
+func TestUpsertMetadataOverlappingNetworks(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	otherID := "0dd4ee1d-ff58-4d73-8d4e-2c6f35e6e348"
+	opts := upserter.UpsertOptions{RejectConflicts: true}
+
+	metadata := func(id string) *models.InstanceMetadatum {
+		return &models.InstanceMetadatum{ID: id, Metadata: types.JSON(instanceMetadata0)}
+	}
+
+	_, err := upserter.UpsertMetadataWithOptions(context.TODO(), testDB, zap.NewNop(), instanceID, []string{"10.50.0.0/29"}, metadata(instanceID), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A larger network containing it conflicts
+	_, err = upserter.UpsertMetadataWithOptions(context.TODO(), testDB, zap.NewNop(), otherID, []string{"10.50.0.0/28"}, metadata(otherID), opts)
+
+	var conflictErr *upserter.ConflictError
+
+	assert.ErrorAs(t, err, &conflictErr)
+	assert.Equal(t, []upserter.IPConflict{{Address: "10.50.0.0/29", InstanceID: instanceID}}, conflictErr.Conflicts)
+
+	// So does the same network written with its host bits set
+	_, err = upserter.UpsertMetadataWithOptions(context.TODO(), testDB, zap.NewNop(), otherID, []string{"10.50.0.3/29"}, metadata(otherID), opts)
+	assert.ErrorIs(t, err, upserter.ErrIPConflict)
+
+	// A single address within it doesn't, and is associated alongside it
+	_, err = upserter.UpsertMetadataWithOptions(context.TODO(), testDB, zap.NewNop(), otherID, []string{"10.50.0.3"}, metadata(otherID), opts)
+	assert.NoError(t, err)
+
+	count, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(instanceID)).Count(context.TODO(), testDB)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+
+	// Without rejecting conflicts, the overlapping network is taken over
+	err = upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), otherID, []string{"10.50.0.0/28"}, metadata(otherID))
+	assert.NoError(t, err)
+
+	count, err = models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(instanceID)).Count(context.TODO(), testDB)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), count)
+}
+
+func TestPlanUpsert(t *testing.T) {
+	testDB := dbtools.DatabaseTest(t)
+
+	oldID := "1f36c15b-b3ef-45da-b7e8-f434287e2f03"
+
+	err := upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), oldID, instanceIPs[:1], &models.InstanceMetadatum{ID: oldID, Metadata: types.JSON(`{"old":"metadata"}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = upserter.UpsertMetadata(context.TODO(), testDB, zap.NewNop(), instanceID, []string{"10.0.0.1"}, &models.InstanceMetadatum{ID: instanceID, Metadata: types.JSON(instanceMetadata0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := upserter.PlanUpsert(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, upserter.UpsertOptions{})
+	assert.NoError(t, err)
+
+	if assert.NotNil(t, changes) {
+		assert.ElementsMatch(t, instanceIPs, changes.Added)
+		assert.Equal(t, []string{"10.0.0.1"}, changes.Removed)
+		assert.Equal(t, []upserter.ReassignedIP{{Address: instanceIPs[0], PreviousInstanceID: oldID}}, changes.Reassigned)
+	}
+
+	// Nothing was changed
+	oldIPs, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(oldID)).All(context.TODO(), testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Len(t, oldIPs, 1)
+
+	newIPs, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(instanceID)).All(context.TODO(), testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if assert.Len(t, newIPs, 1) {
+		assert.Equal(t, "10.0.0.1", newIPs[0].Address)
+	}
+
+	// Keeping stale IPs leaves them out of the plan
+	changes, err = upserter.PlanUpsert(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, upserter.UpsertOptions{KeepStaleIPs: true})
+	assert.NoError(t, err)
+
+	if assert.NotNil(t, changes) {
+		assert.Empty(t, changes.Removed)
+	}
+
+	// Rejected conflicts are reported as the upsert would
+	_, err = upserter.PlanUpsert(context.TODO(), testDB, zap.NewNop(), instanceID, instanceIPs, upserter.UpsertOptions{RejectConflicts: true})
+	assert.ErrorIs(t, err, upserter.ErrIPConflict)
+}
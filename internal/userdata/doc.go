@@ -0,0 +1,3 @@
+// Package userdata provides helpers for inspecting and transforming instance
+// userdata before it is served to an instance.
+package userdata // import go.hollow.sh/metadataservice/internal/userdata
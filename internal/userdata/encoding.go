@@ -0,0 +1,52 @@
+package userdata
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"unicode"
+)
+
+const (
+	// EncodingRaw is used for userdata stored exactly as it's served. This is
+	// the default.
+	EncodingRaw = "raw"
+
+	// EncodingBase64 is used for userdata stored base64-encoded, which is
+	// decoded before it's served.
+	EncodingBase64 = "base64"
+)
+
+// ErrInvalidEncoding is returned when an unknown userdata encoding is provided,
+// or the userdata can't be decoded with the encoding.
+var ErrInvalidEncoding = errors.New("invalid userdata encoding")
+
+// Decode returns the userdata as it should be served, given how it was stored.
+// An empty encoding is the default (EncodingRaw). Line breaks and other
+// whitespace in base64-encoded userdata are ignored.
+func Decode(data []byte, encoding string) ([]byte, error) {
+	switch encoding {
+	case "", EncodingRaw:
+		return data, nil
+	case EncodingBase64:
+		stripped := bytes.Map(func(r rune) rune {
+			if unicode.IsSpace(r) {
+				return -1
+			}
+
+			return r
+		}, data)
+
+		decoded := make([]byte, base64.StdEncoding.DecodedLen(len(stripped)))
+
+		n, err := base64.StdEncoding.Decode(decoded, stripped)
+		if err != nil {
+			return nil, fmt.Errorf("%w: userdata isn't valid base64: %s", ErrInvalidEncoding, err)
+		}
+
+		return decoded[:n], nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrInvalidEncoding, encoding)
+	}
+}
@@ -0,0 +1,71 @@
+package userdata_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/userdata"
+)
+
+func TestDecode(t *testing.T) {
+	testCases := []struct {
+		testName    string
+		data        []byte
+		encoding    string
+		expected    []byte
+		expectedErr error
+	}{
+		{
+			"default",
+			[]byte("#cloud-config"),
+			"",
+			[]byte("#cloud-config"),
+			nil,
+		},
+		{
+			"raw",
+			[]byte("I2Nsb3VkLWNvbmZpZw=="),
+			userdata.EncodingRaw,
+			[]byte("I2Nsb3VkLWNvbmZpZw=="),
+			nil,
+		},
+		{
+			"base64",
+			[]byte("I2Nsb3VkLWNvbmZpZw=="),
+			userdata.EncodingBase64,
+			[]byte("#cloud-config"),
+			nil,
+		},
+		{
+			"base64 with line breaks",
+			[]byte("I2Nsb3Vk\nLWNvbmZp\r\nZw==\n"),
+			userdata.EncodingBase64,
+			[]byte("#cloud-config"),
+			nil,
+		},
+		{
+			"invalid base64",
+			[]byte("#cloud-config"),
+			userdata.EncodingBase64,
+			nil,
+			userdata.ErrInvalidEncoding,
+		},
+		{
+			"unknown encoding",
+			[]byte("#cloud-config"),
+			"gzip",
+			nil,
+			userdata.ErrInvalidEncoding,
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			decoded, err := userdata.Decode(testcase.data, testcase.encoding)
+
+			assert.ErrorIs(t, err, testcase.expectedErr)
+			assert.Equal(t, testcase.expected, decoded)
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package userdata
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+)
+
+const (
+	// ContentTypeCloudConfig is the content type for #cloud-config userdata
+	ContentTypeCloudConfig = "text/cloud-config"
+
+	// ContentTypeShellScript is the content type for userdata scripts starting
+	// with a shebang line
+	ContentTypeShellScript = "text/x-shellscript"
+
+	// ContentTypeCloudBoothook is the content type for #cloud-boothook userdata
+	ContentTypeCloudBoothook = "text/cloud-boothook"
+
+	// ContentTypeIncludeURL is the content type for #include userdata
+	ContentTypeIncludeURL = "text/x-include-url"
+
+	// ContentTypeMultipart is the content type for MIME multipart userdata
+	ContentTypeMultipart = "multipart/mixed"
+
+	// ContentTypeGzip is the content type for gzip-compressed userdata
+	ContentTypeGzip = "application/gzip"
+
+	// ContentTypePlain is the content type used when the userdata format could
+	// not be detected
+	ContentTypePlain = "text/plain"
+)
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// DetectContentType inspects the beginning of the userdata and returns the
+// content type cloud-init would treat it as.
+func DetectContentType(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, gzipMagic):
+		return ContentTypeGzip
+	case bytes.HasPrefix(data, []byte("#cloud-config")):
+		return ContentTypeCloudConfig
+	case bytes.HasPrefix(data, []byte("#cloud-boothook")):
+		return ContentTypeCloudBoothook
+	case bytes.HasPrefix(data, []byte("#include")):
+		return ContentTypeIncludeURL
+	case bytes.HasPrefix(data, []byte("#!")):
+		return ContentTypeShellScript
+	case isMultipart(data):
+		return ContentTypeMultipart
+	default:
+		return ContentTypePlain
+	}
+}
+
+// isMultipart reports whether the userdata looks like a MIME multipart
+// document, by checking for a multipart Content-Type header before the first
+// blank line.
+func isMultipart(data []byte) bool {
+	headerEnd := bytes.Index(data, []byte("\n\n"))
+	if headerEnd < 0 {
+		headerEnd = bytes.Index(data, []byte("\r\n\r\n"))
+	}
+
+	if headerEnd < 0 {
+		headerEnd = len(data)
+	}
+
+	headers := bytes.ToLower(data[:headerEnd])
+
+	return bytes.Contains(headers, []byte("content-type: multipart/"))
+}
+
+// Transformer applies optional transformations to userdata at read time.
+// The zero value performs no transformations.
+type Transformer struct {
+	// NormalizeLineEndings converts CRLF line endings to LF for text-based
+	// userdata.
+	NormalizeLineEndings bool
+
+	// DefaultShebang, if set, is prepended as the first line of userdata whose
+	// format could not be detected, so that it is executed as a script.
+	DefaultShebang string
+
+	// VendorData, if set, is combined with the userdata into a single MIME
+	// multipart document (see Combine).
+	VendorData []byte
+}
+
+// Enabled reports whether the transformer will change any userdata.
+func (t Transformer) Enabled() bool {
+	return t.NormalizeLineEndings || t.DefaultShebang != "" || len(t.VendorData) > 0
+}
+
+// Transform returns the userdata with the configured transformations applied.
+// Binary formats (gzip) and MIME multipart documents are always returned
+// unchanged, since rewriting them could corrupt their contents.
+func (t Transformer) Transform(data []byte) []byte {
+	if !t.Enabled() || len(data) == 0 {
+		return data
+	}
+
+	contentType := DetectContentType(data)
+
+	if contentType == ContentTypeGzip || contentType == ContentTypeMultipart {
+		return Combine(t.VendorData, data)
+	}
+
+	result := data
+
+	if t.NormalizeLineEndings {
+		result = bytes.ReplaceAll(result, []byte("\r\n"), []byte("\n"))
+	}
+
+	if t.DefaultShebang != "" && contentType == ContentTypePlain {
+		shebang := t.DefaultShebang
+		if !bytes.HasPrefix([]byte(shebang), []byte("#!")) {
+			shebang = "#!" + shebang
+		}
+
+		result = append([]byte(shebang+"\n"), result...)
+	}
+
+	return Combine(t.VendorData, result)
+}
+
+// Combine builds a MIME multipart document containing the vendor-data
+// followed by the userdata, so cloud-init processes both from a single fetch
+// (with the userdata taking precedence where they overlap). The boundary is
+// derived from the contents, so the same inputs always produce the same
+// document.
+// The userdata is returned unchanged if there's no vendor-data, or if either
+// is gzip-compressed or already a multipart document.
+func Combine(vendorData, data []byte) []byte {
+	if len(vendorData) == 0 || len(data) == 0 {
+		return data
+	}
+
+	for _, part := range [][]byte{vendorData, data} {
+		if contentType := DetectContentType(part); contentType == ContentTypeGzip || contentType == ContentTypeMultipart {
+			return data
+		}
+	}
+
+	hash := sha256.New()
+	hash.Write(vendorData)
+	hash.Write(data)
+
+	boundary := "==" + hex.EncodeToString(hash.Sum(nil)) + "=="
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "Content-Type: %s; boundary=\"%s\"\r\nMIME-Version: 1.0\r\n\r\n", ContentTypeMultipart, boundary)
+
+	writer := multipart.NewWriter(buf)
+
+	// The boundary is always valid (hex characters and '='), so this can't fail
+	_ = writer.SetBoundary(boundary)
+
+	parts := []struct {
+		filename string
+		content  []byte
+	}{
+		{"vendor-data", vendorData},
+		{"user-data", data},
+	}
+
+	for _, part := range parts {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", DetectContentType(part.content)+`; charset="utf-8"`)
+		header.Set("MIME-Version", "1.0")
+		header.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, part.filename))
+
+		w, _ := writer.CreatePart(header)
+		_, _ = w.Write(part.content)
+	}
+
+	_ = writer.Close()
+
+	return buf.Bytes()
+}
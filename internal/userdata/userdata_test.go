@@ -0,0 +1,169 @@
+package userdata_test
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/userdata"
+)
+
+func TestDetectContentType(t *testing.T) {
+	testCases := []struct {
+		testName string
+		data     []byte
+		expected string
+	}{
+		{"cloud-config", []byte("#cloud-config\npackages:\n  - nginx\n"), userdata.ContentTypeCloudConfig},
+		{"shell script", []byte("#!/bin/bash\necho hi\n"), userdata.ContentTypeShellScript},
+		{"boothook", []byte("#cloud-boothook\necho hi\n"), userdata.ContentTypeCloudBoothook},
+		{"include", []byte("#include\nhttps://example.com/userdata\n"), userdata.ContentTypeIncludeURL},
+		{"gzip", []byte{0x1f, 0x8b, 0x08, 0x00}, userdata.ContentTypeGzip},
+		{"multipart", []byte("Content-Type: multipart/mixed; boundary=\"abc\"\nMIME-Version: 1.0\n\n--abc\n"), userdata.ContentTypeMultipart},
+		{"plain", []byte("echo hi\n"), userdata.ContentTypePlain},
+		{"empty", []byte{}, userdata.ContentTypePlain},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			assert.Equal(t, testcase.expected, userdata.DetectContentType(testcase.data))
+		})
+	}
+}
+
+func TestTransform(t *testing.T) {
+	testCases := []struct {
+		testName    string
+		transformer userdata.Transformer
+		data        string
+		expected    string
+	}{
+		{
+			"zero value is a no-op",
+			userdata.Transformer{},
+			"echo hi\r\n",
+			"echo hi\r\n",
+		},
+		{
+			"normalize line endings on script",
+			userdata.Transformer{NormalizeLineEndings: true},
+			"#!/bin/bash\r\necho hi\r\n",
+			"#!/bin/bash\necho hi\n",
+		},
+		{
+			"default shebang added to undetected content",
+			userdata.Transformer{DefaultShebang: "#!/bin/sh"},
+			"echo hi\n",
+			"#!/bin/sh\necho hi\n",
+		},
+		{
+			"default shebang without prefix",
+			userdata.Transformer{DefaultShebang: "/bin/sh"},
+			"echo hi\n",
+			"#!/bin/sh\necho hi\n",
+		},
+		{
+			"default shebang not added to cloud-config",
+			userdata.Transformer{DefaultShebang: "#!/bin/sh"},
+			"#cloud-config\npackages: []\n",
+			"#cloud-config\npackages: []\n",
+		},
+		{
+			"default shebang not added to existing script",
+			userdata.Transformer{DefaultShebang: "#!/bin/sh"},
+			"#!/bin/bash\necho hi\n",
+			"#!/bin/bash\necho hi\n",
+		},
+		{
+			"multipart is left untouched",
+			userdata.Transformer{NormalizeLineEndings: true, DefaultShebang: "#!/bin/sh"},
+			"Content-Type: multipart/mixed; boundary=\"abc\"\r\n\r\n--abc\r\n",
+			"Content-Type: multipart/mixed; boundary=\"abc\"\r\n\r\n--abc\r\n",
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			assert.Equal(t, testcase.expected, string(testcase.transformer.Transform([]byte(testcase.data))))
+		})
+	}
+}
+
+func TestCombine(t *testing.T) {
+	vendorData := []byte("#cloud-config\npackages:\n  - htop\n")
+	userData := []byte("#!/bin/sh\necho hi\n")
+
+	combined := userdata.Combine(vendorData, userData)
+
+	assert.Equal(t, userdata.ContentTypeMultipart, userdata.DetectContentType(combined))
+
+	// The document should be the same every time it's built
+	assert.Equal(t, combined, userdata.Combine(vendorData, userData))
+
+	msg, err := mail.ReadMessage(bytes.NewReader(combined))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, userdata.ContentTypeMultipart, mediaType)
+
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+
+	expectedParts := []struct {
+		filename    string
+		contentType string
+		content     []byte
+	}{
+		{"vendor-data", userdata.ContentTypeCloudConfig, vendorData},
+		{"user-data", userdata.ContentTypeShellScript, userData},
+	}
+
+	for _, expected := range expectedParts {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		content, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, expected.filename, part.FileName())
+		assert.Contains(t, part.Header.Get("Content-Type"), expected.contentType)
+		assert.Equal(t, expected.content, content)
+	}
+
+	_, err = reader.NextPart()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestCombineUnchanged(t *testing.T) {
+	vendorData := []byte("#cloud-config\npackages:\n  - htop\n")
+
+	testCases := []struct {
+		testName   string
+		vendorData []byte
+		data       []byte
+	}{
+		{"no vendor-data", nil, []byte("#!/bin/sh\necho hi\n")},
+		{"gzip userdata", vendorData, []byte{0x1f, 0x8b, 0x08, 0x00}},
+		{"multipart userdata", vendorData, []byte("Content-Type: multipart/mixed; boundary=\"abc\"\n\n--abc--\n")},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			assert.Equal(t, testcase.data, userdata.Combine(testcase.vendorData, testcase.data))
+		})
+	}
+}
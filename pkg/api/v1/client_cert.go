@@ -0,0 +1,297 @@
+package metadataservice
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/apierror"
+	"go.hollow.sh/metadataservice/internal/middleware"
+)
+
+// InstanceAuthMode controls how the instance making a request to an
+// instance-facing route is identified.
+type InstanceAuthMode string
+
+const (
+	// InstanceAuthSourceIP identifies the instance by the address the request
+	// came from. This is the default.
+	InstanceAuthSourceIP InstanceAuthMode = "source-ip"
+
+	// InstanceAuthClientCert identifies the instance by its verified client
+	// certificate. Requests without one are rejected with a 401.
+	InstanceAuthClientCert InstanceAuthMode = "client-cert"
+
+	// InstanceAuthClientCertOrSourceIP identifies the instance by its verified
+	// client certificate when it presents one, and by the address the request
+	// came from otherwise.
+	InstanceAuthClientCertOrSourceIP InstanceAuthMode = "client-cert-or-source-ip"
+)
+
+// The instance-facing routes the instance auth mode can be set for
+const (
+	// InstanceAuthRouteMetadata covers the native metadata routes, including
+	// the network interface and provisioning routes
+	InstanceAuthRouteMetadata = "metadata"
+
+	// InstanceAuthRouteUserdata covers the native userdata route
+	InstanceAuthRouteUserdata = "userdata"
+
+	// InstanceAuthRouteBootConfig covers the boot-config route
+	InstanceAuthRouteBootConfig = "boot-config"
+
+	// InstanceAuthRouteInstanceData covers the cloud-init instance-data routes
+	InstanceAuthRouteInstanceData = "instance-data"
+
+	// InstanceAuthRouteEc2Metadata covers the ec2-style metadata routes
+	InstanceAuthRouteEc2Metadata = "ec2-metadata"
+
+	// InstanceAuthRouteEc2Userdata covers the ec2-style userdata route
+	InstanceAuthRouteEc2Userdata = "ec2-userdata"
+
+	// InstanceAuthRouteOpenstackMetadata covers the OpenStack-style metadata
+	// route
+	InstanceAuthRouteOpenstackMetadata = "openstack-metadata"
+
+	// InstanceAuthRouteIgnition covers the Ignition config route
+	InstanceAuthRouteIgnition = "ignition"
+)
+
+// ClientCertIdentity is the part of a client certificate the instance ID is
+// read from.
+type ClientCertIdentity string
+
+const (
+	// ClientCertIdentityCN reads the instance ID from the certificate's
+	// subject common name. This is the default.
+	ClientCertIdentityCN ClientCertIdentity = "cn"
+
+	// ClientCertIdentityDNSSAN reads the instance ID from the first DNS name
+	// in the certificate's subject alternative names which is a valid
+	// instance ID.
+	ClientCertIdentityDNSSAN ClientCertIdentity = "dns-san"
+
+	// ClientCertIdentityURISAN reads the instance ID from the last path
+	// segment of the first URI in the certificate's subject alternative names
+	// which ends in a valid instance ID, like a SPIFFE ID of
+	// spiffe://example.com/instance/<id>.
+	ClientCertIdentityURISAN ClientCertIdentity = "uri-san"
+)
+
+var (
+	// ErrInvalidInstanceAuth is returned when an unknown instance auth mode,
+	// route or client certificate identity is provided.
+	ErrInvalidInstanceAuth = errors.New("invalid instance auth config")
+
+	// errNoClientCert is returned when a request wasn't made with a verified
+	// client certificate
+	errNoClientCert = errors.New("no verified client certificate was presented")
+
+	// errNoClientCertIdentity is returned when a verified client certificate
+	// doesn't contain a valid instance ID
+	errNoClientCertIdentity = errors.New("the client certificate doesn't identify an instance")
+)
+
+// instanceAuthRoutes are the routes the instance auth mode can be set for
+var instanceAuthRoutes = []string{
+	InstanceAuthRouteMetadata,
+	InstanceAuthRouteUserdata,
+	InstanceAuthRouteBootConfig,
+	InstanceAuthRouteInstanceData,
+	InstanceAuthRouteEc2Metadata,
+	InstanceAuthRouteEc2Userdata,
+	InstanceAuthRouteOpenstackMetadata,
+	InstanceAuthRouteIgnition,
+}
+
+// InstanceAuthConfig configures how instances are identified on each of the
+// instance-facing routes. The zero value identifies them all by source IP.
+type InstanceAuthConfig struct {
+	// Default is the mode used for routes without one set in Routes
+	Default InstanceAuthMode
+
+	// Routes sets the mode for individual routes, keyed by the
+	// InstanceAuthRoute names
+	Routes map[string]InstanceAuthMode
+
+	// Identity is the part of the client certificate the instance ID is read
+	// from
+	Identity ClientCertIdentity
+}
+
+// Mode returns the mode used to identify instances on the named route
+func (a InstanceAuthConfig) Mode(route string) InstanceAuthMode {
+	if mode, ok := a.Routes[route]; ok && mode != "" {
+		return mode
+	}
+
+	if a.Default == "" {
+		return InstanceAuthSourceIP
+	}
+
+	return a.Default
+}
+
+// UsesClientCerts reports whether any route identifies instances by client
+// certificate
+func (a InstanceAuthConfig) UsesClientCerts() bool {
+	for _, route := range instanceAuthRoutes {
+		if a.Mode(route) != InstanceAuthSourceIP {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseInstanceAuthMode parses a configured instance auth mode. An empty
+// string results in the default (InstanceAuthSourceIP).
+func ParseInstanceAuthMode(mode string) (InstanceAuthMode, error) {
+	switch InstanceAuthMode(mode) {
+	case "", InstanceAuthSourceIP:
+		return InstanceAuthSourceIP, nil
+	case InstanceAuthClientCert, InstanceAuthClientCertOrSourceIP:
+		return InstanceAuthMode(mode), nil
+	default:
+		return "", fmt.Errorf("%w: unknown mode %q", ErrInvalidInstanceAuth, mode)
+	}
+}
+
+// ParseInstanceAuthRoutes parses the configured instance auth modes for
+// individual routes, keyed by the InstanceAuthRoute names.
+func ParseInstanceAuthRoutes(routes map[string]string) (map[string]InstanceAuthMode, error) {
+	modes := make(map[string]InstanceAuthMode, len(routes))
+
+	for route, mode := range routes {
+		if !validInstanceAuthRoute(route) {
+			return nil, fmt.Errorf("%w: unknown route %q, must be one of %s", ErrInvalidInstanceAuth, route, strings.Join(instanceAuthRoutes, ", "))
+		}
+
+		parsed, err := ParseInstanceAuthMode(mode)
+		if err != nil {
+			return nil, err
+		}
+
+		modes[route] = parsed
+	}
+
+	return modes, nil
+}
+
+// ParseClientCertIdentity parses a configured client certificate identity. An
+// empty string results in the default (ClientCertIdentityCN).
+func ParseClientCertIdentity(identity string) (ClientCertIdentity, error) {
+	switch ClientCertIdentity(identity) {
+	case "", ClientCertIdentityCN:
+		return ClientCertIdentityCN, nil
+	case ClientCertIdentityDNSSAN, ClientCertIdentityURISAN:
+		return ClientCertIdentity(identity), nil
+	default:
+		return "", fmt.Errorf("%w: unknown client certificate identity %q", ErrInvalidInstanceAuth, identity)
+	}
+}
+
+func validInstanceAuthRoute(route string) bool {
+	for _, known := range instanceAuthRoutes {
+		if route == known {
+			return true
+		}
+	}
+
+	return false
+}
+
+// identifyInstance returns the middleware used to identify the instance
+// making a request to the named route, configured with the router's settings.
+func (r *Router) identifyInstance(route string) gin.HandlerFunc {
+	bySourceIP := middleware.IdentifyInstanceByIPWithConfig(r.Logger, r.DB, middleware.IdentifyConfig{
+		Coalescer:              r.Coalescer,
+		ResolvedSourceIPHeader: r.SourceIPDebugHeader,
+		ForwardedFor:           r.ForwardedForPolicy,
+		TrustedProxies:         r.TrustedProxies,
+		StaleCache:             r.StaleCache,
+		ReadCache:              r.ReadCache,
+	})
+
+	mode := r.InstanceAuth.Mode(route)
+	if mode == InstanceAuthSourceIP {
+		return r.limitReads(r.identifyUnixSocket(bySourceIP))
+	}
+
+	return r.limitReads(r.identifyUnixSocket(func(c *gin.Context) {
+		instanceID, err := r.clientCertInstanceID(c)
+
+		switch {
+		case errors.Is(err, errNoClientCert) && mode == InstanceAuthClientCertOrSourceIP:
+			bySourceIP(c)
+			return
+		case err != nil:
+			apierror.Abort(c, http.StatusUnauthorized, ErrorCodeUnauthorized, err.Error())
+			return
+		}
+
+		// The requestor's address is still noted, for auditing fetches
+		address := c.ClientIP()
+		if ip, err := netip.ParseAddr(address); err == nil {
+			address = ip.Unmap().String()
+		}
+
+		c.Set(middleware.ContextKeyRequestorIP, address)
+		c.Set(middleware.ContextKeyInstanceID, instanceID)
+		c.Set(contextKeyClientCertIdentified, true)
+	}))
+}
+
+// clientCertInstanceID returns the ID of the instance identified by the
+// verified client certificate the request was made with
+func (r *Router) clientCertInstanceID(c *gin.Context) (string, error) {
+	state := c.Request.TLS
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", errNoClientCert
+	}
+
+	cert := state.VerifiedChains[0][0]
+
+	if instanceID, ok := r.certInstanceID(cert); ok {
+		return instanceID, nil
+	}
+
+	r.Logger.Warn("verified client certificate doesn't identify an instance",
+		zap.String("subject", cert.Subject.String()),
+		zap.String("identity", string(r.InstanceAuth.Identity)),
+	)
+
+	return "", errNoClientCertIdentity
+}
+
+// certInstanceID reads the instance ID from the part of the certificate given
+// by the configured identity, if it holds a valid one
+func (r *Router) certInstanceID(cert *x509.Certificate) (string, bool) {
+	var candidates []string
+
+	switch r.InstanceAuth.Identity {
+	case ClientCertIdentityDNSSAN:
+		candidates = cert.DNSNames
+	case ClientCertIdentityURISAN:
+		for _, uri := range cert.URIs {
+			candidates = append(candidates, path.Base(uri.Path))
+		}
+	default:
+		candidates = []string{cert.Subject.CommonName}
+	}
+
+	for _, candidate := range candidates {
+		if r.InstanceIDFormat.Valid(candidate) {
+			return candidate, true
+		}
+	}
+
+	return "", false
+}
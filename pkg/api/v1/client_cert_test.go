@@ -0,0 +1,152 @@
+package metadataservice_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+// clientCertState returns the TLS state of a connection made with a verified
+// client certificate for the given subject common name, DNS names and URIs
+func clientCertState(cn string, dnsNames []string, uris ...string) *tls.ConnectionState {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn}, DNSNames: dnsNames}
+
+	for _, uri := range uris {
+		parsed, _ := url.Parse(uri)
+		cert.URIs = append(cert.URIs, parsed)
+	}
+
+	return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+}
+
+// getAsInstance makes a request as an instance from the remote IP, over a
+// connection with the given TLS state
+func getAsInstance(router http.Handler, path string, state *tls.ConnectionState, remoteIP string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, path, nil)
+	req.RemoteAddr = net.JoinHostPort(remoteIP, "0")
+	req.TLS = state
+	router.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestInstanceAuthByClientCert(t *testing.T) {
+	t.Run("source ip ignores the certificate", func(t *testing.T) {
+		router := *testHTTPServer(t)
+
+		w := getAsInstance(router, v1api.GetMetadataPath(), clientCertState(dbtools.FixtureInstanceA.InstanceID, nil), "1.2.3.4")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	identities := []struct {
+		testName string
+		identity v1api.ClientCertIdentity
+		state    func() *tls.ConnectionState
+	}{
+		{"common name", v1api.ClientCertIdentityCN, func() *tls.ConnectionState {
+			return clientCertState(dbtools.FixtureInstanceA.InstanceID, nil)
+		}},
+		{"dns name", v1api.ClientCertIdentityDNSSAN, func() *tls.ConnectionState {
+			return clientCertState("instance", []string{"instance.example.com", dbtools.FixtureInstanceA.InstanceID})
+		}},
+		{"uri", v1api.ClientCertIdentityURISAN, func() *tls.ConnectionState {
+			return clientCertState("instance", nil, "spiffe://example.com/instance/"+dbtools.FixtureInstanceA.InstanceID)
+		}},
+	}
+
+	for _, testcase := range identities {
+		t.Run("instance identified by "+testcase.testName, func(t *testing.T) {
+			router := *testHTTPServerWithConfig(t, TestServerConfig{InstanceAuth: v1api.InstanceAuthConfig{
+				Default:  v1api.InstanceAuthClientCert,
+				Identity: testcase.identity,
+			}})
+
+			w := getAsInstance(router, v1api.GetMetadataPath(), testcase.state(), "1.2.3.4")
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.JSONEq(t, dbtools.FixtureInstanceA.InstanceMetadata.Metadata.String(), w.Body.String())
+		})
+	}
+
+	t.Run("certificate required", func(t *testing.T) {
+		router := *testHTTPServerWithConfig(t, TestServerConfig{InstanceAuth: v1api.InstanceAuthConfig{Default: v1api.InstanceAuthClientCert}})
+
+		w := getAsInstance(router, v1api.GetMetadataPath(), nil, dbtools.FixtureInstanceB.HostIPs[0])
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("certificate or source ip", func(t *testing.T) {
+		router := *testHTTPServerWithConfig(t, TestServerConfig{InstanceAuth: v1api.InstanceAuthConfig{Default: v1api.InstanceAuthClientCertOrSourceIP}})
+
+		// The certificate takes precedence over the source address
+		w := getAsInstance(router, v1api.GetMetadataPath(), clientCertState(dbtools.FixtureInstanceA.InstanceID, nil), dbtools.FixtureInstanceB.HostIPs[0])
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, dbtools.FixtureInstanceA.InstanceMetadata.Metadata.String(), w.Body.String())
+
+		w = getAsInstance(router, v1api.GetMetadataPath(), nil, dbtools.FixtureInstanceB.HostIPs[0])
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, dbtools.FixtureInstanceB.InstanceMetadata.Metadata.String(), w.Body.String())
+
+		// A certificate which doesn't identify an instance isn't ignored
+		w = getAsInstance(router, v1api.GetMetadataPath(), clientCertState("instance.example.com", nil), dbtools.FixtureInstanceB.HostIPs[0])
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("route uses its own mode", func(t *testing.T) {
+		router := *testHTTPServerWithConfig(t, TestServerConfig{InstanceAuth: v1api.InstanceAuthConfig{
+			Default: v1api.InstanceAuthClientCert,
+			Routes:  map[string]v1api.InstanceAuthMode{v1api.InstanceAuthRouteEc2Metadata: v1api.InstanceAuthSourceIP},
+		}})
+
+		w := getAsInstance(router, v1api.GetEc2MetadataItemPath("hostname"), nil, dbtools.FixtureInstanceB.HostIPs[0])
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		w = getAsInstance(router, v1api.GetUserdataPath(), nil, dbtools.FixtureInstanceB.HostIPs[0])
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+}
+
+func TestParseInstanceAuth(t *testing.T) {
+	mode, err := v1api.ParseInstanceAuthMode("")
+	assert.NoError(t, err)
+	assert.Equal(t, v1api.InstanceAuthSourceIP, mode)
+
+	_, err = v1api.ParseInstanceAuthMode("jwt")
+	assert.ErrorIs(t, err, v1api.ErrInvalidInstanceAuth)
+
+	routes, err := v1api.ParseInstanceAuthRoutes(map[string]string{"metadata": "client-cert", "ec2-userdata": "client-cert-or-source-ip"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]v1api.InstanceAuthMode{
+		v1api.InstanceAuthRouteMetadata:    v1api.InstanceAuthClientCert,
+		v1api.InstanceAuthRouteEc2Userdata: v1api.InstanceAuthClientCertOrSourceIP,
+	}, routes)
+
+	_, err = v1api.ParseInstanceAuthRoutes(map[string]string{"internal": "client-cert"})
+	assert.ErrorIs(t, err, v1api.ErrInvalidInstanceAuth)
+
+	_, err = v1api.ParseInstanceAuthRoutes(map[string]string{"metadata": "nope"})
+	assert.ErrorIs(t, err, v1api.ErrInvalidInstanceAuth)
+
+	identity, err := v1api.ParseClientCertIdentity("")
+	assert.NoError(t, err)
+	assert.Equal(t, v1api.ClientCertIdentityCN, identity)
+
+	_, err = v1api.ParseClientCertIdentity("email")
+	assert.ErrorIs(t, err, v1api.ErrInvalidInstanceAuth)
+
+	// Client certificates are only used when some route asks for them
+	assert.False(t, v1api.InstanceAuthConfig{}.UsesClientCerts())
+	assert.True(t, v1api.InstanceAuthConfig{Routes: map[string]v1api.InstanceAuthMode{"userdata": v1api.InstanceAuthClientCert}}.UsesClientCerts())
+}
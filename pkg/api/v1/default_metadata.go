@@ -0,0 +1,107 @@
+package metadataservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"text/template"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/middleware"
+)
+
+const (
+	// DefaultMetadataTemplate is the template for the default metadata served
+	// to unknown instances when no other template is configured. It only
+	// echoes back the address the request came from.
+	DefaultMetadataTemplate = `{"source_ip":{{json .SourceIP}}}`
+
+	// HeaderDefaultMetadata is the response header set on the default
+	// metadata, so it can't be mistaken for an instance's own metadata
+	HeaderDefaultMetadata = "X-Default-Metadata"
+
+	// defaultMetadataSampleIP is the address the template is checked with
+	// when it's parsed
+	defaultMetadataSampleIP = "192.0.2.1"
+)
+
+// ErrInvalidDefaultMetadata is returned when the default metadata template
+// can't be parsed, or doesn't render a JSON object
+var ErrInvalidDefaultMetadata = errors.New("invalid default metadata template")
+
+// DefaultMetadata is served in place of a 404 to instances the service can't
+// identify, so generic images don't fail to boot
+type DefaultMetadata struct {
+	template *template.Template
+}
+
+// ParseDefaultMetadata parses the default metadata template, checking it
+// renders a JSON object. It's rendered with the TemplateData of an instance
+// the service doesn't know, and can use the json function to quote values,
+// like {{json .SourceIP}}. DefaultMetadataTemplate is used when text is empty.
+func ParseDefaultMetadata(text string) (*DefaultMetadata, error) {
+	if text == "" {
+		text = DefaultMetadataTemplate
+	}
+
+	tmpl, err := NewTemplate("default-metadata").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidDefaultMetadata, err.Error())
+	}
+
+	defaultMetadata := &DefaultMetadata{template: tmpl}
+
+	if _, err := defaultMetadata.render(defaultMetadataSampleIP); err != nil {
+		return nil, err
+	}
+
+	return defaultMetadata, nil
+}
+
+// render renders the default metadata for a request from sourceIP
+func (d *DefaultMetadata) render(sourceIP string) ([]byte, error) {
+	var buf bytes.Buffer
+
+	if err := d.template.Execute(&buf, newTemplateData("", sourceIP, nil)); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidDefaultMetadata, err.Error())
+	}
+
+	var doc map[string]json.RawMessage
+
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil || doc == nil {
+		return nil, fmt.Errorf("%w: it doesn't render a JSON object", ErrInvalidDefaultMetadata)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// defaultMetadataOrNotFound serves the default metadata, when it's enabled, to
+// a request which couldn't be matched to an instance. Instances the service
+// knows about, but has no metadata for, still get a 404.
+func (r *Router) defaultMetadataOrNotFound(c *gin.Context) {
+	if r.DefaultMetadata == nil || c.GetString(middleware.ContextKeyInstanceID) != "" {
+		notFoundResponse(c)
+		return
+	}
+
+	sourceIP := c.GetString(middleware.ContextKeyRequestorIP)
+
+	body, err := r.DefaultMetadata.render(sourceIP)
+	if err != nil {
+		r.Logger.Warn("unable to render the default metadata", zap.String("source_ip", sourceIP), zap.Error(err))
+
+		notFoundResponse(c)
+
+		return
+	}
+
+	middleware.MetricDefaultMetadataResponses.Inc()
+
+	c.Header(HeaderDefaultMetadata, "true")
+	c.Data(http.StatusOK, contentTypeJSON, body)
+	c.Abort()
+}
@@ -0,0 +1,85 @@
+package metadataservice_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func TestParseDefaultMetadata(t *testing.T) {
+	testCases := []struct {
+		testName string
+		template string
+		valid    bool
+	}{
+		{"default template", "", true},
+		{"source ip", `{"hostname":"unknown","source_ip":{{json .SourceIP}}}`, true},
+		{"static", `{"hostname":"unknown"}`, true},
+		{"unparsable", `{"source_ip":{{json .SourceIP}`, false},
+		{"named field unknown instances don't have", `{"id":{{json .InstanceID}}}`, true},
+		{"unknown field", `{"source_ip":{{json .plan}}}`, false},
+		{"unquoted value", `{"source_ip":{{.SourceIP}}}`, false},
+		{"json list", `[{{json .SourceIP}}]`, false},
+		{"json null", `null`, false},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			_, err := v1api.ParseDefaultMetadata(testcase.template)
+
+			if testcase.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, v1api.ErrInvalidDefaultMetadata)
+			}
+		})
+	}
+}
+
+func TestGetDefaultMetadata(t *testing.T) {
+	defaultMetadata, err := v1api.ParseDefaultMetadata(`{"hostname":"unknown","source_ip":{{json .SourceIP}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := *testHTTPServerWithConfig(t, TestServerConfig{DefaultMetadata: defaultMetadata})
+
+	// Unknown instances get the default metadata
+	w := getAsInstance(router, v1api.GetMetadataPath(), nil, "192.168.100.1")
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "true", w.Header().Get(v1api.HeaderDefaultMetadata))
+	assert.JSONEq(t, `{"hostname":"unknown","source_ip":"192.168.100.1"}`, w.Body.String())
+
+	// Known instances still get their own metadata
+	w = getAsInstance(router, v1api.GetMetadataPath(), nil, dbtools.FixtureInstanceA.HostIPs[0])
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get(v1api.HeaderDefaultMetadata))
+	assert.Contains(t, w.Body.String(), `"hostname":"instance-a"`)
+
+	// The ec2-style routes still 404
+	w = httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, "/2009-04-04/meta-data/hostname", nil)
+	req.RemoteAddr = net.JoinHostPort("192.168.100.1", "0")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestGetDefaultMetadataDisabled(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	w := getAsInstance(router, v1api.GetMetadataPath(), nil, "192.168.100.1")
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Empty(t, w.Header().Get(v1api.HeaderDefaultMetadata))
+}
@@ -0,0 +1,115 @@
+package metadataservice
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"go.hollow.sh/metadataservice/internal/ignition"
+)
+
+const (
+	// DiscoveryURI is the path to the unauthenticated discovery endpoint, which
+	// can be used by clients (like cloud-init) to cheaply determine whether the
+	// metadata service is present, and which datasources it supports.
+	DiscoveryURI = "/latest"
+
+	// DatasourceNative is the name of the native (v1) JSON datasource
+	DatasourceNative = "native"
+
+	// DatasourceEc2 is the name of the ec2-style datasource
+	DatasourceEc2 = "ec2"
+
+	// DatasourceOpenstack is the name of the OpenStack-style datasource
+	DatasourceOpenstack = "openstack"
+
+	// DatasourceIgnition is the name of the datasource serving Ignition
+	// configs
+	DatasourceIgnition = "ignition"
+
+	discoveryServiceName = "metadata-service"
+)
+
+// DatasourceConfig controls which datasources have their instance-facing
+// routes mounted, keyed by datasource name. Datasources not present in the
+// map are enabled.
+type DatasourceConfig map[string]bool
+
+// Enabled returns whether the named datasource should be served
+func (d DatasourceConfig) Enabled(name string) bool {
+	enabled, ok := d[name]
+
+	return !ok || enabled
+}
+
+// DiscoveryResponse is returned by the discovery endpoint. It must never
+// contain any instance-specific data.
+type DiscoveryResponse struct {
+	Service     string                `json:"service"`
+	APIVersions []string              `json:"api_versions"`
+	Datasources []DiscoveryDatasource `json:"datasources"`
+}
+
+// DiscoveryDatasource describes a datasource supported by the service, and
+// the path prefixes it is served under.
+type DiscoveryDatasource struct {
+	Name     string   `json:"name"`
+	Versions []string `json:"versions"`
+	Paths    []string `json:"paths"`
+}
+
+// DiscoveryRoutes will add the discovery routes to a router group. These
+// routes don't require the requesting instance to be identified.
+func (r *Router) DiscoveryRoutes(rg *gin.RouterGroup) {
+	rg.GET(DiscoveryURI, r.discoveryGet)
+	rg.GET(DiscoveryURI+"/", r.discoveryGet)
+}
+
+func (r *Router) discoveryGet(c *gin.Context) {
+	resp := &DiscoveryResponse{
+		Service:     discoveryServiceName,
+		APIVersions: []string{"v1"},
+		Datasources: []DiscoveryDatasource{},
+	}
+
+	if r.Datasources.Enabled(DatasourceNative) {
+		resp.Datasources = append(resp.Datasources, DiscoveryDatasource{
+			Name:     DatasourceNative,
+			Versions: []string{"v1"},
+			Paths:    []string{V1URI, "/"},
+		})
+	}
+
+	if r.Datasources.Enabled(DatasourceEc2) {
+		resp.Datasources = append(resp.Datasources, DiscoveryDatasource{
+			Name:     DatasourceEc2,
+			Versions: []string{strings.TrimPrefix(V20090404URI, "/")},
+			Paths:    []string{V20090404URI},
+		})
+	}
+
+	if r.Datasources.Enabled(DatasourceOpenstack) {
+		resp.Datasources = append(resp.Datasources, DiscoveryDatasource{
+			Name:     DatasourceOpenstack,
+			Versions: []string{"latest"},
+			Paths:    []string{OpenstackURI},
+		})
+	}
+
+	if r.Datasources.Enabled(DatasourceIgnition) {
+		resp.Datasources = append(resp.Datasources, DiscoveryDatasource{
+			Name:     DatasourceIgnition,
+			Versions: ignition.SupportedVersions,
+			Paths:    []string{IgnitionURI},
+		})
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// GetDiscoveryPath returns the path used to discover whether the metadata
+// service is present, and which datasources it supports
+func GetDiscoveryPath() string {
+	return DiscoveryURI
+}
@@ -0,0 +1,91 @@
+package metadataservice_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func TestDiscovery(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	for _, path := range []string{v1api.GetDiscoveryPath(), v1api.GetDiscoveryPath() + "/"} {
+		t.Run(path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			// The discovery response doesn't depend on the requesting instance
+			// being known to the service
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, path, nil)
+			req.RemoteAddr = net.JoinHostPort("1.2.3.4", "0")
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+
+			var resp v1api.DiscoveryResponse
+
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, "metadata-service", resp.Service)
+			assert.Contains(t, resp.APIVersions, "v1")
+
+			var names []string
+			for _, ds := range resp.Datasources {
+				names = append(names, ds.Name)
+			}
+
+			assert.ElementsMatch(t, []string{v1api.DatasourceNative, v1api.DatasourceEc2, v1api.DatasourceOpenstack, v1api.DatasourceIgnition}, names)
+		})
+	}
+}
+
+func TestDisabledDatasource(t *testing.T) {
+	router := *testHTTPServerWithConfig(t, TestServerConfig{
+		Datasources: v1api.DatasourceConfig{v1api.DatasourceEc2: false},
+	})
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetEc2MetadataPath(), nil)
+	req.RemoteAddr = net.JoinHostPort(dbtools.FixtureInstanceA.HostIPs[0], "0")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// The native datasource should still be served
+	w = httptest.NewRecorder()
+
+	req, _ = http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetMetadataPath(), nil)
+	req.RemoteAddr = net.JoinHostPort(dbtools.FixtureInstanceA.HostIPs[0], "0")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// And discovery should only advertise the enabled datasources
+	w = httptest.NewRecorder()
+
+	req, _ = http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetDiscoveryPath(), nil)
+	router.ServeHTTP(w, req)
+
+	var resp v1api.DiscoveryResponse
+
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, ds := range resp.Datasources {
+		names = append(names, ds.Name)
+	}
+
+	assert.ElementsMatch(t, []string{v1api.DatasourceNative, v1api.DatasourceOpenstack, v1api.DatasourceIgnition}, names)
+}
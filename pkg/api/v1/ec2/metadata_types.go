@@ -1,6 +1,7 @@
 package ec2
 
 import (
+	"strconv"
 	"strings"
 )
 
@@ -24,6 +25,17 @@ type Metadata struct {
 	SSHKeys         []string         `json:"ssh_keys"`
 	Spot            *Spot            `json:"spot"`
 	Network         *Network         `json:"network"`
+
+	// PublicKeys are the keys stored for the instance separately from its
+	// metadata. When there are any, they're served under public-keys/
+	// instead of SSHKeys.
+	PublicKeys []PublicKey `json:"-"`
+}
+
+// PublicKey is an SSH public key served under public-keys/
+type PublicKey struct {
+	Name       string
+	OpenSSHKey string
 }
 
 // ItemNames returns the list of top-level metadata keys that can be
@@ -87,7 +99,9 @@ func (metadata *Metadata) GetItem(itemPath string) ([]string, bool) {
 	case trimmed == "tags":
 		return metadata.Tags, true
 	case trimmed == "public-keys":
-		return metadata.SSHKeys, true
+		return metadata.publicKeyNames(), true
+	case strings.HasPrefix(trimmed, "public-keys/"):
+		return metadata.getPublicKey(strings.TrimPrefix(trimmed, "public-keys/"))
 	case trimmed == "public-ipv4" || trimmed == "public-ipv6" || trimmed == "local-ipv4":
 		return metadata.Network.GetItem(trimmed)
 	// Now handle the potentially-nested items
@@ -100,6 +114,62 @@ func (metadata *Metadata) GetItem(itemPath string) ([]string, bool) {
 	}
 }
 
+// publicKeyNames returns the listing of the "public-keys" item. Stored keys
+// are listed as "<index>=<name>", like EC2 does. The metadata's ssh_keys are
+// listed as they are.
+func (metadata *Metadata) publicKeyNames() []string {
+	if len(metadata.PublicKeys) == 0 {
+		return metadata.SSHKeys
+	}
+
+	names := make([]string, len(metadata.PublicKeys))
+
+	for i, key := range metadata.PublicKeys {
+		names[i] = strconv.Itoa(i) + "=" + key.Name
+	}
+
+	return names
+}
+
+// openSSHKeys returns the keys served under public-keys/, the stored keys if
+// there are any, otherwise the metadata's ssh_keys
+func (metadata *Metadata) openSSHKeys() []string {
+	if len(metadata.PublicKeys) == 0 {
+		return metadata.SSHKeys
+	}
+
+	keys := make([]string, len(metadata.PublicKeys))
+
+	for i, key := range metadata.PublicKeys {
+		keys[i] = key.OpenSSHKey
+	}
+
+	return keys
+}
+
+// getPublicKey returns the value for an EC2-style "public-keys/<index>" item
+// path (without the "public-keys/" prefix). "<index>" lists the key formats
+// available, and "<index>/openssh-key" is the key itself.
+func (metadata *Metadata) getPublicKey(itemPath string) ([]string, bool) {
+	rawIndex, format, _ := strings.Cut(strings.Trim(itemPath, "/"), "/")
+
+	keys := metadata.openSSHKeys()
+
+	index, err := strconv.Atoi(rawIndex)
+	if err != nil || index < 0 || index >= len(keys) {
+		return []string{}, false
+	}
+
+	switch format {
+	case "":
+		return []string{"openssh-key"}, true
+	case "openssh-key":
+		return []string{keys[index]}, true
+	default:
+		return []string{}, false
+	}
+}
+
 // Network represents the network-related fields in the metadata
 type Network struct {
 	Addresses  []NetworkAddress   `json:"addresses"`
@@ -0,0 +1,102 @@
+package ec2
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// GetTreeItem walks the raw metadata JSON along an item path like
+// "/network/bonding/mode", for items which aren't otherwise mapped by
+// Metadata.GetItem. Each path segment names an object key (with any hyphens
+// also matching underscores, so "link-aggregation" finds "link_aggregation")
+// or an array index.
+// Objects and arrays are returned as directory-style listings of their keys
+// or indices, with those which are themselves objects or arrays suffixed with
+// a "/". Strings are returned as-is, and other values as their JSON encoding.
+// If the path doesn't exist in the metadata, it returns an empty slice and
+// false.
+func GetTreeItem(rawMetadata []byte, itemPath string) ([]string, bool) {
+	var node interface{}
+
+	if err := json.Unmarshal(rawMetadata, &node); err != nil {
+		return []string{}, false
+	}
+
+	trimmed := strings.Trim(itemPath, "/")
+
+	if trimmed != "" {
+		for _, segment := range strings.Split(trimmed, "/") {
+			var ok bool
+
+			if node, ok = treeChild(node, segment); !ok {
+				return []string{}, false
+			}
+		}
+	}
+
+	return treeValue(node), true
+}
+
+func treeChild(node interface{}, segment string) (interface{}, bool) {
+	switch typed := node.(type) {
+	case map[string]interface{}:
+		if child, ok := typed[segment]; ok {
+			return child, true
+		}
+
+		child, ok := typed[strings.ReplaceAll(segment, "-", "_")]
+
+		return child, ok
+	case []interface{}:
+		index, err := strconv.Atoi(segment)
+		if err != nil || index < 0 || index >= len(typed) {
+			return nil, false
+		}
+
+		return typed[index], true
+	default:
+		return nil, false
+	}
+}
+
+func treeValue(node interface{}) []string {
+	switch typed := node.(type) {
+	case map[string]interface{}:
+		items := make([]string, 0, len(typed))
+
+		for key, child := range typed {
+			items = append(items, treeItemName(key, child))
+		}
+
+		sort.Strings(items)
+
+		return items
+	case []interface{}:
+		items := make([]string, 0, len(typed))
+
+		for index, child := range typed {
+			items = append(items, treeItemName(strconv.Itoa(index), child))
+		}
+
+		return items
+	case string:
+		return []string{typed}
+	case nil:
+		return []string{}
+	default:
+		encoded, _ := json.Marshal(typed)
+
+		return []string{string(encoded)}
+	}
+}
+
+func treeItemName(name string, child interface{}) string {
+	switch child.(type) {
+	case map[string]interface{}, []interface{}:
+		return name + "/"
+	default:
+		return name
+	}
+}
@@ -24,15 +24,31 @@ const (
 
 	// Ec2UserdataURI is the path to the ec2-style userdata endpoint
 	Ec2UserdataURI = "/user-data"
+
+	// Ec2LatestUserdataURI is the path to the ec2-style endpoint serving the
+	// raw userdata, with a content type matching its format. Like on AWS, it's
+	// only served at the root.
+	Ec2LatestUserdataURI = "/latest/user-data"
 )
 
 // Ec2Routes will add the routes for the EC2-style API to a router group
 func (r *Router) Ec2Routes(rg *gin.RouterGroup) {
 	// GET /2009-04-04/meta-data/:item-name
 	// GET /2009-04-04/user-data
-	rg.GET(Ec2MetadataURI, middleware.IdentifyInstanceByIP(r.Logger, r.DB), r.instanceEc2MetadataGet)
-	rg.GET(Ec2MetadataItemURI, middleware.IdentifyInstanceByIP(r.Logger, r.DB), r.instanceEc2MetadataItemGet)
-	rg.GET(Ec2UserdataURI, middleware.IdentifyInstanceByIP(r.Logger, r.DB), r.instanceEc2UserdataGet)
+	reads := rg.Group("", middleware.Timeout(r.Timeouts.Read), r.requireSessionToken())
+
+	reads.GET(Ec2MetadataURI, r.identifyInstance(InstanceAuthRouteEc2Metadata), r.requireBootstrapToken(), r.instanceEc2MetadataGet)
+	reads.GET(Ec2MetadataItemURI, r.identifyInstance(InstanceAuthRouteEc2Metadata), r.requireBootstrapToken(), r.instanceEc2MetadataItemGet)
+	reads.GET(Ec2UserdataURI, r.identifyInstance(InstanceAuthRouteEc2Userdata), r.requireBootstrapToken(), r.instanceEc2UserdataGet)
+}
+
+// Ec2LatestRoutes will add the ec2-style routes served under /latest to a
+// router group
+func (r *Router) Ec2LatestRoutes(rg *gin.RouterGroup) {
+	// GET /latest/user-data
+	reads := rg.Group("", middleware.Timeout(r.Timeouts.Read), r.requireSessionToken())
+
+	reads.GET(Ec2LatestUserdataURI, r.identifyInstance(InstanceAuthRouteEc2Userdata), r.requireBootstrapToken(), r.instanceEc2LatestUserdataGet)
 }
 
 // GetEc2MetadataPath returns the path used to fetch a list of the ec2-style
@@ -54,3 +70,9 @@ func GetEc2MetadataItemPath(itemPath string) string {
 func GetEc2UserdataPath() string {
 	return path.Join(V20090404URI, Ec2UserdataURI)
 }
+
+// GetEc2LatestUserdataPath returns the path used to fetch the raw ec2-style
+// userdata
+func GetEc2LatestUserdataPath() string {
+	return Ec2LatestUserdataURI
+}
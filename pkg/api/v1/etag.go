@@ -0,0 +1,141 @@
+package metadataservice
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// etagResourceMetadata and etagResourceUserdata name the independently
+	// versioned resources an ETag can be computed for
+	etagResourceMetadata = "metadata"
+	etagResourceUserdata = "userdata"
+
+	// etagResourceBootConfig names the combined boot-config document, which
+	// is versioned as a whole
+	etagResourceBootConfig = "boot-config"
+
+	// etagResourceInstanceData and etagResourceInstanceDataSensitive name the
+	// two cloud-init instance-data documents
+	etagResourceInstanceData          = "instance-data"
+	etagResourceInstanceDataSensitive = "instance-data-sensitive"
+
+	// etagLength is the number of hex characters of the content hash used in
+	// an ETag
+	etagLength = 32
+
+	contentTypeJSON = "application/json; charset=utf-8"
+	contentTypeText = "text/plain; charset=utf-8"
+)
+
+// resourceETag computes a strong ETag for the response body of a single
+// resource. Only the resource's own content is hashed, so metadata and userdata
+// are versioned independently: a change to an instance's userdata never
+// changes the ETag of its metadata, and vice versa. The resource name is
+// included so identical content served as metadata and as userdata still gets
+// distinct ETags.
+func resourceETag(resource string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(resource))
+	h.Write([]byte{0})
+	h.Write(body)
+
+	return `"` + hex.EncodeToString(h.Sum(nil))[:etagLength] + `"`
+}
+
+// projectedResource names the projection of a resource to the given fields,
+// so its ETag never matches that of the full resource, or of another
+// projection
+func projectedResource(resource string, fields []string) string {
+	return resource + "?fields=" + strings.Join(fields, ",")
+}
+
+// etagMatches reports whether the If-None-Match request header matches the
+// given ETag
+func etagMatches(c *gin.Context, etag string) bool {
+	ifNoneMatch := c.GetHeader("If-None-Match")
+	if ifNoneMatch == "" {
+		return false
+	}
+
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// notModified reports whether the client already has the current version of a
+// resource. The If-None-Match request header is checked against the ETag, and
+// only when it isn't sent, the If-Modified-Since header is checked against
+// when the resource was last modified (if that's known).
+func notModified(c *gin.Context, etag string, modified time.Time) bool {
+	if c.GetHeader("If-None-Match") != "" {
+		return etagMatches(c, etag)
+	}
+
+	if modified.IsZero() {
+		return false
+	}
+
+	since, err := http.ParseTime(c.GetHeader("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+
+	// HTTP dates only have second precision
+	return !modified.Truncate(time.Second).After(since)
+}
+
+// resourceResponse writes a 200 response for a resource. When ETags are
+// enabled, the response carries the resource's ETag and the time it was last
+// modified, and a 304 with no body is sent instead if the client already has
+// the current version. A zero modified time is left out.
+func (r *Router) resourceResponse(c *gin.Context, resource string, contentType string, body []byte, modified time.Time) {
+	if r.ETags {
+		etagResponse(c, resource, contentType, body, modified)
+		return
+	}
+
+	c.Data(http.StatusOK, contentType, body)
+}
+
+// etagResponse writes a 200 response for a resource carrying its ETag and the
+// time it was last modified, or a 304 with no body if the client already has
+// the current version
+func etagResponse(c *gin.Context, resource string, contentType string, body []byte, modified time.Time) {
+	etag := resourceETag(resource, body)
+	c.Header("ETag", etag)
+
+	if !modified.IsZero() {
+		c.Header("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+
+	if notModified(c, etag, modified) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	c.Data(http.StatusOK, contentType, body)
+}
+
+// resourceJSONResponse behaves like resourceResponse, for a resource which is
+// rendered as JSON
+func (r *Router) resourceJSONResponse(c *gin.Context, resource string, obj interface{}, modified time.Time) {
+	body, err := json.Marshal(obj)
+	if err != nil {
+		internalErrorResponse(c)
+		return
+	}
+
+	r.resourceResponse(c, resource, contentTypeJSON, body, modified)
+}
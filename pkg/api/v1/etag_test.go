@@ -0,0 +1,173 @@
+package metadataservice_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func TestETagsDisabled(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetMetadataPath(), nil)
+	req.RemoteAddr = net.JoinHostPort(dbtools.FixtureInstanceA.HostIPs[0], "0")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("ETag"))
+}
+
+func TestETagsNotModified(t *testing.T) {
+	router := *testHTTPServerWithConfig(t, TestServerConfig{ETags: true})
+
+	for _, path := range []string{v1api.GetMetadataPath(), v1api.GetUserdataPath(), "/2009-04-04/meta-data/hostname", "/2009-04-04/user-data"} {
+		t.Run(path, func(t *testing.T) {
+			etag, body := getWithETag(t, router, path, "")
+
+			assert.NotEmpty(t, etag)
+
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, path, nil)
+			req.RemoteAddr = net.JoinHostPort(dbtools.FixtureInstanceA.HostIPs[0], "0")
+			req.Header.Set("If-None-Match", etag)
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusNotModified, w.Code)
+			assert.Empty(t, w.Body.String())
+			assert.Equal(t, etag, w.Header().Get("ETag"))
+
+			// A stale ETag gets the full response
+			staleETag, staleBody := getWithETag(t, router, path, `"stale"`)
+			assert.Equal(t, etag, staleETag)
+			assert.Equal(t, body, staleBody)
+		})
+	}
+}
+
+func TestETagsIndependentlyVersioned(t *testing.T) {
+	router := *testHTTPServerWithConfig(t, TestServerConfig{ETags: true})
+
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	metadataETag, _ := getWithETag(t, router, v1api.GetMetadataPath(), "")
+	userdataETag, _ := getWithETag(t, router, v1api.GetUserdataPath(), "")
+
+	assert.NotEqual(t, metadataETag, userdataETag)
+
+	// Changing the userdata changes only the userdata ETag
+	upsert(t, router, v1api.GetInternalUserdataPath(), &v1api.UpsertUserdataRequest{
+		ID:          dbtools.FixtureInstanceA.InstanceID,
+		Userdata:    []byte("#!/bin/sh\necho changed\n"),
+		IPAddresses: dbtools.FixtureInstanceA.HostIPs,
+	})
+
+	newMetadataETag, _ := getWithETag(t, router, v1api.GetMetadataPath(), "")
+	newUserdataETag, _ := getWithETag(t, router, v1api.GetUserdataPath(), "")
+
+	assert.Equal(t, metadataETag, newMetadataETag)
+	assert.NotEqual(t, userdataETag, newUserdataETag)
+
+	// Changing the metadata changes only the metadata ETag
+	upsert(t, router, v1api.GetInternalMetadataPath(), &v1api.UpsertMetadataRequest{
+		ID:          dbtools.FixtureInstanceA.InstanceID,
+		Metadata:    `{"hostname": "changed"}`,
+		IPAddresses: dbtools.FixtureInstanceA.HostIPs,
+	})
+
+	finalMetadataETag, _ := getWithETag(t, router, v1api.GetMetadataPath(), "")
+	finalUserdataETag, _ := getWithETag(t, router, v1api.GetUserdataPath(), "")
+
+	assert.NotEqual(t, newMetadataETag, finalMetadataETag)
+	assert.Equal(t, newUserdataETag, finalUserdataETag)
+}
+
+func TestLastModified(t *testing.T) {
+	router := *testHTTPServerWithConfig(t, TestServerConfig{ETags: true})
+
+	get := func(path string, headers map[string]string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, path, nil)
+		req.RemoteAddr = net.JoinHostPort(dbtools.FixtureInstanceA.HostIPs[0], "0")
+
+		for header, value := range headers {
+			req.Header.Set(header, value)
+		}
+
+		router.ServeHTTP(w, req)
+
+		return w
+	}
+
+	for _, path := range []string{v1api.GetMetadataPath(), v1api.GetUserdataPath()} {
+		t.Run(path, func(t *testing.T) {
+			w := get(path, nil)
+			lastModified := w.Header().Get("Last-Modified")
+
+			modified, err := http.ParseTime(lastModified)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w = get(path, map[string]string{"If-Modified-Since": lastModified})
+			assert.Equal(t, http.StatusNotModified, w.Code)
+			assert.Empty(t, w.Body.String())
+
+			w = get(path, map[string]string{"If-Modified-Since": modified.Add(-time.Hour).Format(http.TimeFormat)})
+			assert.Equal(t, http.StatusOK, w.Code)
+
+			// If-None-Match takes precedence over If-Modified-Since
+			w = get(path, map[string]string{"If-Modified-Since": lastModified, "If-None-Match": `"stale"`})
+			assert.Equal(t, http.StatusOK, w.Code)
+		})
+	}
+}
+
+// getWithETag fetches the path as instance A, returning the response ETag and
+// body
+func getWithETag(t *testing.T, router http.Handler, path string, ifNoneMatch string) (string, string) {
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, path, nil)
+	req.RemoteAddr = net.JoinHostPort(dbtools.FixtureInstanceA.HostIPs[0], "0")
+
+	if ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", ifNoneMatch)
+	}
+
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	return w.Header().Get("ETag"), w.Body.String()
+}
+
+func upsert(t *testing.T, router http.Handler, path string, request interface{}) {
+	reqBody, err := json.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, path, bytes.NewReader(reqBody))
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+}
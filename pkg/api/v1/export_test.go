@@ -0,0 +1,4 @@
+package metadataservice
+
+// UserdataContentType exposes userdataContentType to the tests
+var UserdataContentType = userdataContentType
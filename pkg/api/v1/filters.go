@@ -0,0 +1,124 @@
+package metadataservice
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/volatiletech/sqlboiler/v4/queries/qm"
+
+	"go.hollow.sh/metadataservice/internal/instancetags"
+	"go.hollow.sh/metadataservice/internal/models"
+)
+
+var (
+	// ErrInvalidFilter is returned when a query string filter can't be parsed
+	ErrInvalidFilter = errors.New("invalid filter")
+)
+
+// instanceFilter holds the filters which can be applied to the internal
+// endpoints operating on many instances at once. All filters that are set
+// must match for an instance to be included.
+type instanceFilter struct {
+	// UpdatedSince only includes instances whose metadata was updated at or
+	// after the given time
+	UpdatedSince *time.Time
+
+	// Tag only includes instances whose metadata "tags" list contains the
+	// given tag, or, for a tag in "key:value" form, which have that tag
+	// attached
+	Tag string
+
+	// Subnet only includes instances with at least one associated IP address
+	// within the given network
+	Subnet *net.IPNet
+}
+
+// parseInstanceFilter reads the supported filters from the request query
+// string:
+//   - updated_since: an RFC3339 timestamp
+//   - tag: a single tag, or an attached tag as "key:value"
+//   - subnet: an IP address or CIDR
+func parseInstanceFilter(c *gin.Context) (*instanceFilter, error) {
+	filter := &instanceFilter{
+		Tag: c.Query("tag"),
+	}
+
+	if updatedSince := c.Query("updated_since"); updatedSince != "" {
+		t, err := time.Parse(time.RFC3339, updatedSince)
+		if err != nil {
+			return nil, fmt.Errorf("%w: updated_since must be an RFC3339 timestamp", ErrInvalidFilter)
+		}
+
+		filter.UpdatedSince = &t
+	}
+
+	if subnet := c.Query("subnet"); subnet != "" {
+		network, err := parseSubnet(subnet)
+		if err != nil {
+			return nil, err
+		}
+
+		filter.Subnet = network
+	}
+
+	return filter, nil
+}
+
+// parseSubnet parses a CIDR, or a single IP address as a host network
+func parseSubnet(subnet string) (*net.IPNet, error) {
+	if _, network, err := net.ParseCIDR(subnet); err == nil {
+		return network, nil
+	}
+
+	ip := net.ParseIP(subnet)
+	if ip == nil {
+		return nil, fmt.Errorf("%w: subnet must be an IP address or CIDR", ErrInvalidFilter)
+	}
+
+	hostMask := "/128"
+	if ip.To4() != nil {
+		hostMask = "/32"
+	}
+
+	_, network, err := net.ParseCIDR(ip.String() + hostMask)
+
+	return network, err
+}
+
+// queryMods returns the query mods for the filter, to be applied to a query
+// against the instance_metadata table
+func (f *instanceFilter) queryMods() []qm.QueryMod {
+	mods := []qm.QueryMod{}
+
+	if f.UpdatedSince != nil {
+		mods = append(mods, models.InstanceMetadatumWhere.UpdatedAt.GTE(*f.UpdatedSince))
+	}
+
+	if f.Tag != "" {
+		tags, _ := json.Marshal([]string{f.Tag})
+
+		listed := "instance_metadata.metadata->'tags' @> ?::jsonb"
+
+		if key, value, ok := instancetags.ParseFilter(f.Tag); ok {
+			mods = append(mods, qm.Where(
+				"("+listed+" OR EXISTS (SELECT 1 FROM instance_tags WHERE instance_tags.instance_id = instance_metadata.id AND instance_tags.tag_key = ? AND instance_tags.tag_value = ?))",
+				string(tags), key, value,
+			))
+		} else {
+			mods = append(mods, qm.Where(listed, string(tags)))
+		}
+	}
+
+	if f.Subnet != nil {
+		mods = append(mods, qm.Where(
+			"EXISTS (SELECT 1 FROM instance_ip_addresses WHERE instance_ip_addresses.instance_id = instance_metadata.id AND instance_ip_addresses.address <<= ?::inet)",
+			f.Subnet.String(),
+		))
+	}
+
+	return mods
+}
@@ -0,0 +1,166 @@
+package metadataservice
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/toolbox/ginjwt"
+
+	"go.hollow.sh/metadataservice/internal/apierror"
+	"go.hollow.sh/metadataservice/internal/idempotency"
+)
+
+const (
+	// HeaderIdempotencyKey is the request header an upsert's idempotency key
+	// is sent in
+	HeaderIdempotencyKey = "Idempotency-Key"
+
+	// HeaderIdempotentReplayed is set to "true" on responses replayed for a
+	// repeated idempotency key, rather than made by running the upsert
+	HeaderIdempotentReplayed = "Idempotent-Replayed"
+
+	// idempotencyRetryAfter is the Retry-After, in seconds, sent to requests
+	// repeating a key whose upsert is still being made
+	idempotencyRetryAfter = 1
+)
+
+var errInvalidIdempotencyKey = errors.New("invalid idempotency key")
+
+// idempotent makes the upsert it's added in front of idempotent for requests
+// with an Idempotency-Key header. Keys are scoped to the caller's JWT subject.
+// The first request with a key claims it before the upsert is made, and its
+// response is stored, so requests repeating the key with the same route,
+// query and body get the stored response without the upsert being run again.
+// Repeats made while the first request's upsert is still running get a 409
+// with a Retry-After, as does reusing a key for a different request. Server
+// errors and 429s aren't stored, and release the key, so those requests can
+// be retried with it. Requests without the header, or when idempotency keys
+// are disabled, are handled as normal. The body is read with the upsert's body
+// size limit.
+func (r *Router) idempotent(bodyLimit int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(HeaderIdempotencyKey)
+		if !r.IdempotencyKeys || key == "" {
+			c.Next()
+			return
+		}
+
+		if len(key) > idempotency.MaxKeyLength {
+			err := fmt.Errorf("%w: can't be longer than %d characters", errInvalidIdempotencyKey, idempotency.MaxKeyLength)
+			badRequestResponse(c, err.Error(), err)
+			return
+		}
+
+		limitRequestBody(c, bodyLimit)
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			requestBodyErrorResponse(c, err)
+			return
+		}
+
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		response := &idempotency.Response{
+			Subject:     ginjwt.GetSubject(c),
+			Key:         key,
+			RequestHash: idempotency.HashRequest(c.Request.Method, c.FullPath(), c.Request.URL.RawQuery, body),
+		}
+
+		claimed, err := idempotency.Claim(c.Request.Context(), r.DB, response)
+		if err != nil {
+			r.Logger.Error("unable to claim idempotency key", zap.Error(err))
+			apierror.Abort(c, http.StatusInternalServerError, ErrorCodeInternal, "internal server error")
+
+			return
+		}
+
+		if !claimed {
+			r.replayIdempotentResponse(c, response)
+			return
+		}
+
+		writer := &teeWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+
+		c.Next()
+
+		// The upsert has already been made, so the response is sent even when
+		// it can't be stored, and it's stored even when the client has gone
+		ctx := context.WithoutCancel(c.Request.Context())
+
+		status := writer.Status()
+		if status >= http.StatusInternalServerError || status == http.StatusTooManyRequests {
+			if err := idempotency.Release(ctx, r.DB, response); err != nil {
+				r.Logger.Warn("unable to release idempotency key", zap.Error(err))
+			}
+
+			return
+		}
+
+		response.Status = status
+		response.ContentType = writer.Header().Get("Content-Type")
+		response.Body = writer.body.Bytes()
+
+		if err := idempotency.Complete(ctx, r.DB, response, r.IdempotencyTTL); err != nil {
+			r.Logger.Warn("unable to store idempotency key", zap.Error(err))
+		}
+	}
+}
+
+// replayIdempotentResponse answers a request with a key another request has
+// already claimed, with the response stored for it
+func (r *Router) replayIdempotentResponse(c *gin.Context, request *idempotency.Response) {
+	stored, err := idempotency.Get(c.Request.Context(), r.DB, request.Subject, request.Key)
+	if err != nil {
+		r.Logger.Error("unable to look up idempotency key", zap.Error(err))
+		apierror.Abort(c, http.StatusInternalServerError, ErrorCodeInternal, "internal server error")
+
+		return
+	}
+
+	if stored != nil && stored.RequestHash != request.RequestHash {
+		apierror.Abort(c, http.StatusConflict, ErrorCodeIdempotencyKeyReused, "idempotency key has already been used for a different request")
+		return
+	}
+
+	// The claim can also have been released, or expired, since this request
+	// tried to make its own
+	if stored == nil || stored.Pending() {
+		c.Header("Retry-After", strconv.Itoa(idempotencyRetryAfter))
+		apierror.Abort(c, http.StatusConflict, ErrorCodeIdempotencyRequestInProgress, "a request with this idempotency key is still being handled, try again later")
+
+		return
+	}
+
+	c.Header(HeaderIdempotentReplayed, "true")
+	c.Data(stored.Status, stored.ContentType, stored.Body)
+	c.Abort()
+}
+
+// teeWriter keeps a copy of the response body written through it
+type teeWriter struct {
+	gin.ResponseWriter
+
+	body bytes.Buffer
+}
+
+func (w *teeWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *teeWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+
+	return w.ResponseWriter.WriteString(s)
+}
@@ -0,0 +1,159 @@
+package metadataservice_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	"go.hollow.sh/metadataservice/internal/idempotency"
+	"go.hollow.sh/metadataservice/internal/models"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func postMetadataWithKey(t *testing.T, router http.Handler, key string, body *v1api.UpsertMetadataRequest) *httptest.ResponseRecorder {
+	t.Helper()
+
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalMetadataPath(), bytes.NewReader(reqBody))
+	req.Header.Set(v1api.HeaderIdempotencyKey, key)
+	router.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestIdempotencyKeyReplaysResponse(t *testing.T) {
+	router := *testHTTPServerWithConfig(t, TestServerConfig{IdempotencyKeys: true})
+	testDB := dbtools.TestDB()
+
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	request := &v1api.UpsertMetadataRequest{
+		ID:          "7d3f6c1a-4b8e-4d2a-9c6f-1e2b3a4c5d6e",
+		Metadata:    `{"hostname": "first"}`,
+		IPAddresses: []string{"192.168.10.1"},
+	}
+
+	first := postMetadataWithKey(t, router, "retry-1", request)
+	assert.Equal(t, http.StatusOK, first.Code)
+	assert.Empty(t, first.Header().Get(v1api.HeaderIdempotentReplayed))
+
+	// Change the stored metadata behind the service's back, so a repeated
+	// upsert would be noticed
+	_, err := testDB.ExecContext(context.TODO(), `UPDATE instance_metadata SET metadata = '{"hostname": "changed"}' WHERE id = $1`, request.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repeat := postMetadataWithKey(t, router, "retry-1", request)
+	assert.Equal(t, http.StatusOK, repeat.Code)
+	assert.Equal(t, "true", repeat.Header().Get(v1api.HeaderIdempotentReplayed))
+	assert.Equal(t, first.Body.String(), repeat.Body.String())
+	assert.Equal(t, first.Header().Get("Content-Type"), repeat.Header().Get("Content-Type"))
+
+	metadata, err := models.FindInstanceMetadatum(context.TODO(), testDB, request.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.JSONEq(t, `{"hostname": "changed"}`, string(metadata.Metadata))
+
+	// Reusing the key for a different request is a conflict
+	request.Metadata = `{"hostname": "second"}`
+
+	conflict := postMetadataWithKey(t, router, "retry-1", request)
+	assert.Equal(t, http.StatusConflict, conflict.Code)
+
+	// While a new key makes the upsert
+	fresh := postMetadataWithKey(t, router, "retry-2", request)
+	assert.Equal(t, http.StatusOK, fresh.Code)
+	assert.Empty(t, fresh.Header().Get(v1api.HeaderIdempotentReplayed))
+}
+
+func TestIdempotencyKeyInProgress(t *testing.T) {
+	router := *testHTTPServerWithConfig(t, TestServerConfig{IdempotencyKeys: true})
+	testDB := dbtools.TestDB()
+
+	request := &v1api.UpsertMetadataRequest{
+		ID:       "7d3f6c1a-4b8e-4d2a-9c6f-1e2b3a4c5d6e",
+		Metadata: `{"hostname": "first"}`,
+	}
+
+	reqBody, err := json.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another request with the key has claimed it, and is still making its
+	// upsert
+	_, err = testDB.ExecContext(context.TODO(), `INSERT INTO idempotency_keys (subject, idempotency_key, request_hash, response_status, response_body, created_at, expires_at)
+VALUES ('', 'retry-1', $1, 0, '', now(), now() + INTERVAL '5 minutes')`, idempotency.HashRequest(http.MethodPost, v1api.GetInternalMetadataPath(), "", reqBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := postMetadataWithKey(t, router, "retry-1", request)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), string(v1api.ErrorCodeIdempotencyRequestInProgress))
+
+	_, err = models.FindInstanceMetadatum(context.TODO(), testDB, request.ID)
+	assert.Error(t, err)
+}
+
+func TestIdempotencyKeyInvalid(t *testing.T) {
+	router := *testHTTPServerWithConfig(t, TestServerConfig{IdempotencyKeys: true})
+
+	w := postMetadataWithKey(t, router, strings.Repeat("k", 256), &v1api.UpsertMetadataRequest{
+		ID:       "7d3f6c1a-4b8e-4d2a-9c6f-1e2b3a4c5d6e",
+		Metadata: `{}`,
+	})
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestIdempotencyKeyIgnoredWhenDisabled(t *testing.T) {
+	router := *testHTTPServer(t)
+	testDB := dbtools.TestDB()
+
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	request := &v1api.UpsertMetadataRequest{
+		ID:       "7d3f6c1a-4b8e-4d2a-9c6f-1e2b3a4c5d6e",
+		Metadata: `{"hostname": "first"}`,
+	}
+
+	assert.Equal(t, http.StatusOK, postMetadataWithKey(t, router, "retry-1", request).Code)
+
+	request.Metadata = `{"hostname": "second"}`
+
+	w := postMetadataWithKey(t, router, "retry-1", request)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get(v1api.HeaderIdempotentReplayed))
+
+	var stored int
+
+	if err := testDB.GetContext(context.TODO(), &stored, `SELECT count(*) FROM idempotency_keys`); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Zero(t, stored)
+}
@@ -0,0 +1,31 @@
+package metadataservice
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"go.hollow.sh/metadataservice/internal/middleware"
+)
+
+const (
+	// IgnitionURI is the path prefix for the Ignition datasource
+	IgnitionURI = "/ignition"
+
+	// IgnitionConfigURI is the path to the endpoint serving the instance's
+	// Ignition config
+	IgnitionConfigURI = "/config.ign"
+)
+
+// IgnitionRoutes will add the routes for the Ignition datasource to a router
+// group
+func (r *Router) IgnitionRoutes(rg *gin.RouterGroup) {
+	// GET /ignition/config.ign
+	reads := rg.Group("", middleware.Timeout(r.Timeouts.Read), r.requireSessionToken())
+
+	reads.GET(IgnitionConfigURI, r.identifyInstance(InstanceAuthRouteIgnition), r.requireBootstrapToken(), r.instanceIgnitionConfigGet)
+}
+
+// GetIgnitionConfigPath returns the path used to fetch the Ignition config for
+// the instance
+func GetIgnitionConfigPath() string {
+	return IgnitionURI + IgnitionConfigURI
+}
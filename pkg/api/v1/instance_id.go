@@ -0,0 +1,164 @@
+package metadataservice
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/volatiletech/sqlboiler/v4/types"
+
+	"go.hollow.sh/metadataservice/internal/middleware"
+	"go.hollow.sh/metadataservice/internal/models"
+)
+
+const (
+	// InstanceIDFormatUUID accepts UUIDs as instance IDs. This is the default.
+	InstanceIDFormatUUID = "uuid"
+
+	// InstanceIDFormatRegex accepts the UUIDs matching a configured regular
+	// expression as instance IDs. The instance ID columns are UUIDs, so IDs
+	// which aren't can't be stored whatever the pattern allows.
+	InstanceIDFormatRegex = "regex"
+
+	// instanceIDValidationTag is the validator tag used to validate instance
+	// IDs in request bodies against the configured format
+	instanceIDValidationTag = "instance_id"
+)
+
+// sourceIPInstanceIDNamespace is the namespace of the name-based UUIDs served
+// as the instance-id when it's derived from the request's source IP
+var sourceIPInstanceIDNamespace = uuid.MustParse("b58e252f-728f-45fc-9239-eb4f5425e5ec")
+
+// ErrInvalidInstanceIDFormat is returned when an unknown instance ID format, a
+// format whose IDs can't be stored, or an invalid regular expression, is
+// provided.
+var ErrInvalidInstanceIDFormat = errors.New("invalid instance id format")
+
+// InstanceIDFormat validates the format of the instance IDs provided in
+// request paths and bodies. A nil *InstanceIDFormat validates UUIDs.
+type InstanceIDFormat struct {
+	name    string
+	pattern *regexp.Regexp
+}
+
+// ParseInstanceIDFormat returns the InstanceIDFormat for a configured format
+// name. The pattern is required for, and only used by, the regex format. The
+// pattern must match the whole ID. An empty format results in the default
+// (InstanceIDFormatUUID).
+func ParseInstanceIDFormat(format string, pattern string) (*InstanceIDFormat, error) {
+	switch strings.ToLower(format) {
+	case "", InstanceIDFormatUUID:
+		return &InstanceIDFormat{name: InstanceIDFormatUUID}, nil
+	case "ulid":
+		return nil, fmt.Errorf("%w: ulids can't be stored, instance ids are stored as uuids", ErrInvalidInstanceIDFormat)
+	case InstanceIDFormatRegex:
+		if pattern == "" {
+			return nil, fmt.Errorf("%w: the regex format requires a pattern", ErrInvalidInstanceIDFormat)
+		}
+
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidInstanceIDFormat, err.Error())
+		}
+
+		return &InstanceIDFormat{name: InstanceIDFormatRegex, pattern: re}, nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrInvalidInstanceIDFormat, format)
+	}
+}
+
+// Name returns the name of the format
+func (f *InstanceIDFormat) Name() string {
+	if f == nil {
+		return InstanceIDFormatUUID
+	}
+
+	return f.name
+}
+
+// Valid reports whether the id is in the format. Every format only accepts
+// UUIDs, as that's how instance IDs are stored.
+func (f *InstanceIDFormat) Valid(id string) bool {
+	if _, err := uuid.Parse(id); err != nil {
+		return false
+	}
+
+	return f.Name() != InstanceIDFormatRegex || f.pattern.MatchString(id)
+}
+
+// servedMetadata returns the stored metadata as it should be served to the
+// instance making the request. When StableInstanceID is enabled, the "id"
+// field is set to the stable instance ID, so the instance-id a client sees
+// only changes when the record (or, with StableIDBySourceIP, the address) it's
+// served from does, regardless of what the metadata itself contains. The
+// metadata templates are then rendered into it, and the sensitive paths the
+// instance may not see are removed.
+func (r *Router) servedMetadata(c *gin.Context, metadata *models.InstanceMetadatum) types.JSON {
+	return r.visibleMetadata(c, r.renderMetadataTemplates(metadata.ID, c.GetString(middleware.ContextKeyRequestorIP), r.stableMetadataID(c, metadata)))
+}
+
+// servedInstanceID returns the instance-id served to the instance making the
+// request, whose record has recordID. With StableInstanceID and
+// StableIDBySourceIP enabled, it's a name-based UUID of the request's source
+// IP, so it stays the same when the address moves to a different record.
+// Otherwise it's the record's ID.
+func (r *Router) servedInstanceID(c *gin.Context, recordID string) string {
+	if !r.StableInstanceID || !r.StableIDBySourceIP {
+		return recordID
+	}
+
+	sourceIP, err := netip.ParseAddr(c.GetString(middleware.ContextKeyRequestorIP))
+	if err != nil {
+		return recordID
+	}
+
+	return uuid.NewSHA1(sourceIPInstanceIDNamespace, []byte(sourceIP.Unmap().String())).String()
+}
+
+// stableMetadataID returns the stored metadata with the "id" field set to the
+// served instance ID, when StableInstanceID is enabled
+func (r *Router) stableMetadataID(c *gin.Context, metadata *models.InstanceMetadatum) types.JSON {
+	if !r.StableInstanceID {
+		return metadata.Metadata
+	}
+
+	// Only the id is replaced, every other field is served exactly as stored
+	var doc map[string]json.RawMessage
+
+	if err := json.Unmarshal(metadata.Metadata, &doc); err != nil || doc == nil {
+		return metadata.Metadata
+	}
+
+	id, err := json.Marshal(r.servedInstanceID(c, metadata.ID))
+	if err != nil {
+		return metadata.Metadata
+	}
+
+	doc["id"] = id
+
+	stable, err := json.Marshal(doc)
+	if err != nil {
+		return metadata.Metadata
+	}
+
+	return stable
+}
+
+// metadataIDMismatch returns the "id" field of the metadata document, and
+// whether it's set to something other than the instance ID
+func metadataIDMismatch(instanceID string, metadata string) (string, bool) {
+	var doc struct {
+		ID *string `json:"id"`
+	}
+
+	if err := json.Unmarshal([]byte(metadata), &doc); err != nil || doc.ID == nil {
+		return "", false
+	}
+
+	return *doc.ID, *doc.ID != instanceID
+}
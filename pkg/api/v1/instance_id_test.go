@@ -0,0 +1,199 @@
+package metadataservice_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func TestParseInstanceIDFormat(t *testing.T) {
+	testCases := []struct {
+		testName string
+		format   string
+		pattern  string
+		valid    []string
+		invalid  []string
+	}{
+		{
+			"default",
+			"",
+			"",
+			[]string{"b9b24320-304e-4bfb-b46a-db75901c2f46"},
+			[]string{"", "abc123", "01ARZ3NDEKTSV4RRFFQ69G5FAV"},
+		},
+		{
+			"uuid",
+			v1api.InstanceIDFormatUUID,
+			"",
+			[]string{"b9b24320-304e-4bfb-b46a-db75901c2f46"},
+			[]string{"abc123", "01ARZ3NDEKTSV4RRFFQ69G5FAV"},
+		},
+		{
+			"regex",
+			v1api.InstanceIDFormatRegex,
+			`[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-.*`,
+			[]string{"b9b24320-304e-4bfb-b46a-db75901c2f46"},
+			[]string{"", "b9b24320-304e-1bfb-b46a-db75901c2f46", "b9b24320-304e-4bfb-b46a", "01ARZ3NDEKTSV4RRFFQ69G5FAV"},
+		},
+		{
+			"regex only matching ids which aren't uuids",
+			v1api.InstanceIDFormatRegex,
+			`srv-[0-9]+`,
+			nil,
+			[]string{"srv-1", "b9b24320-304e-4bfb-b46a-db75901c2f46"},
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			format, err := v1api.ParseInstanceIDFormat(testcase.format, testcase.pattern)
+			assert.NoError(t, err)
+
+			for _, id := range testcase.valid {
+				assert.True(t, format.Valid(id), id)
+			}
+
+			for _, id := range testcase.invalid {
+				assert.False(t, format.Valid(id), id)
+			}
+		})
+	}
+}
+
+func TestParseInstanceIDFormatInvalid(t *testing.T) {
+	for _, testcase := range []struct{ format, pattern string }{
+		{"snowflake", ""},
+		{"ulid", ""},
+		{v1api.InstanceIDFormatRegex, ""},
+		{v1api.InstanceIDFormatRegex, "srv-[0-9"},
+	} {
+		_, err := v1api.ParseInstanceIDFormat(testcase.format, testcase.pattern)
+		assert.ErrorIs(t, err, v1api.ErrInvalidInstanceIDFormat)
+	}
+}
+
+func TestNilInstanceIDFormat(t *testing.T) {
+	var format *v1api.InstanceIDFormat
+
+	assert.Equal(t, v1api.InstanceIDFormatUUID, format.Name())
+	assert.True(t, format.Valid("b9b24320-304e-4bfb-b46a-db75901c2f46"))
+	assert.False(t, format.Valid("abc123"))
+}
+
+func TestStableInstanceID(t *testing.T) {
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	for _, stable := range []bool{false, true} {
+		router := *testHTTPServerWithConfig(t, TestServerConfig{StableInstanceID: stable})
+
+		instanceID := dbtools.FixtureInstanceA.InstanceID
+		instanceIP := dbtools.FixtureInstanceA.HostIPs[0]
+
+		// The stored metadata has an id which doesn't match the instance
+		upsert(t, router, v1api.GetInternalMetadataPath(), &v1api.UpsertMetadataRequest{
+			ID:          instanceID,
+			Metadata:    `{"id": "something-else", "hostname": "instance-a", "plan": 12345678901234567890}`,
+			IPAddresses: dbtools.FixtureInstanceA.HostIPs,
+		})
+
+		expectedID := "something-else"
+		if stable {
+			expectedID = instanceID
+		}
+
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetMetadataPath(), nil)
+		req.RemoteAddr = net.JoinHostPort(instanceIP, "0")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var resp map[string]json.RawMessage
+
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+
+		assert.JSONEq(t, `"`+expectedID+`"`, string(resp["id"]))
+		assert.JSONEq(t, `"instance-a"`, string(resp["hostname"]))
+
+		w = httptest.NewRecorder()
+
+		req, _ = http.NewRequestWithContext(context.TODO(), http.MethodGet, "/2009-04-04/meta-data/instance-id", nil)
+		req.RemoteAddr = net.JoinHostPort(instanceIP, "0")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, expectedID, w.Body.String())
+	}
+}
+
+func TestStableInstanceIDBySourceIP(t *testing.T) {
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	router := *testHTTPServerWithConfig(t, TestServerConfig{StableInstanceID: true, StableBySourceIP: true})
+
+	instanceIP := dbtools.FixtureInstanceA.HostIPs[0]
+
+	servedID := func() string {
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, "/2009-04-04/meta-data/instance-id", nil)
+		req.RemoteAddr = net.JoinHostPort(instanceIP, "0")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		return w.Body.String()
+	}
+
+	upsert(t, router, v1api.GetInternalMetadataPath(), &v1api.UpsertMetadataRequest{
+		ID:          dbtools.FixtureInstanceA.InstanceID,
+		Metadata:    `{"hostname": "instance-a"}`,
+		IPAddresses: []string{instanceIP},
+	})
+
+	firstID := servedID()
+	assert.NotEqual(t, dbtools.FixtureInstanceA.InstanceID, firstID)
+
+	// The address moves to a different instance record
+	upsert(t, router, v1api.GetInternalMetadataPath(), &v1api.UpsertMetadataRequest{
+		ID:          dbtools.FixtureInstanceB.InstanceID,
+		Metadata:    `{"hostname": "instance-b"}`,
+		IPAddresses: []string{instanceIP},
+	})
+
+	assert.Equal(t, firstID, servedID())
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetMetadataPath(), nil)
+	req.RemoteAddr = net.JoinHostPort(instanceIP, "0")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var resp map[string]json.RawMessage
+
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.JSONEq(t, `"`+firstID+`"`, string(resp["id"]))
+	assert.JSONEq(t, `"instance-b"`, string(resp["hostname"]))
+}
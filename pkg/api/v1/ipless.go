@@ -0,0 +1,85 @@
+package metadataservice
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"go.hollow.sh/metadataservice/internal/apierror"
+	"go.hollow.sh/metadataservice/internal/models"
+	"go.hollow.sh/metadataservice/internal/upserter"
+)
+
+// IPlessPolicy controls what happens to metadata upserts which wouldn't leave
+// the instance associated to any IP address, so it could only be reached by
+// its ID rather than looked up by IP.
+type IPlessPolicy string
+
+const (
+	// IPlessAllow stores IP-less metadata like any other. This is the default.
+	IPlessAllow IPlessPolicy = "allow"
+
+	// IPlessWarn stores IP-less metadata, logging a warning.
+	IPlessWarn IPlessPolicy = "warn"
+
+	// IPlessReject rejects IP-less metadata with a 400.
+	IPlessReject IPlessPolicy = "reject"
+)
+
+// ErrInvalidIPlessPolicy is returned when an unknown IP-less policy is provided.
+var ErrInvalidIPlessPolicy = errors.New("invalid ip-less metadata policy")
+
+// ParseIPlessPolicy parses a configured IP-less policy. An empty string results
+// in the default (IPlessAllow).
+func ParseIPlessPolicy(policy string) (IPlessPolicy, error) {
+	switch IPlessPolicy(policy) {
+	case "", IPlessAllow:
+		return IPlessAllow, nil
+	case IPlessWarn, IPlessReject:
+		return IPlessPolicy(policy), nil
+	default:
+		return "", fmt.Errorf("%w: %q", ErrInvalidIPlessPolicy, policy)
+	}
+}
+
+// errIPlessMetadata is returned when the IP-less policy rejects an upsert
+var errIPlessMetadata = errors.New("no ipAddresses were given, and the metadata has no network.addresses, so the instance couldn't be looked up by IP")
+
+// iplessRejected applies the IP-less policy to a metadata upsert which gives
+// neither ipAddresses nor any network.addresses in the metadata. If the upsert
+// should be rejected, it responds with a 400 and returns true.
+//
+// Upserts which don't prune the instance's associations are never IP-less, as
+// the instance may already have pre-loaded associations.
+func (r *Router) iplessRejected(c *gin.Context, ipAddresses []string, metadata *models.InstanceMetadatum, prune bool) bool {
+	if err := r.checkIPless(ipAddresses, metadata, prune); err != nil {
+		apierror.Abort(c, http.StatusBadRequest, ErrorCodeIPlessInstance, "invalid request", err.Error())
+
+		return true
+	}
+
+	return false
+}
+
+// checkIPless applies the IP-less policy like iplessRejected, returning
+// errIPlessMetadata if the upsert should be rejected.
+func (r *Router) checkIPless(ipAddresses []string, metadata *models.InstanceMetadatum, prune bool) error {
+	if r.IPlessPolicy == "" || r.IPlessPolicy == IPlessAllow || !prune {
+		return nil
+	}
+
+	if len(ipAddresses) > 0 || len(upserter.ExtractIPAddressesFromMetadata(metadata)) > 0 {
+		return nil
+	}
+
+	if r.IPlessPolicy == IPlessWarn {
+		r.Logger.Sugar().Warn("Metadata for instance ", metadata.ID, " has no IP addresses, it can only be fetched by id")
+		return nil
+	}
+
+	r.Logger.Sugar().Warn("Rejecting metadata for instance ", metadata.ID, " without any IP addresses")
+
+	return errIPlessMetadata
+}
@@ -0,0 +1,43 @@
+package metadataservice
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"go.hollow.sh/metadataservice/internal/apierror"
+	"go.hollow.sh/metadataservice/internal/metadataschema"
+)
+
+// metadataSchemaRejected validates the metadata against the configured JSON
+// Schema. If it doesn't match, it responds with a 422 listing the failing
+// fields and returns true. Any metadata is accepted when validation is
+// disabled.
+func (r *Router) metadataSchemaRejected(c *gin.Context, metadata string) bool {
+	err := r.MetadataSchema.Validate([]byte(metadata))
+	if err == nil {
+		return false
+	}
+
+	r.metadataSchemaErrorResponse(c, err)
+
+	return true
+}
+
+// metadataSchemaErrorResponse responds to an error validating metadata against
+// the schema: a 422 listing the failing fields when the metadata didn't match,
+// or a 500 when it couldn't be validated at all.
+func (r *Router) metadataSchemaErrorResponse(c *gin.Context, err error) {
+	var validationErr *metadataschema.ValidationError
+
+	if !errors.As(err, &validationErr) {
+		r.Logger.Sugar().Error("Unable to validate metadata against the schema: ", err)
+
+		apierror.Abort(c, http.StatusInternalServerError, ErrorCodeInternal, "internal server error")
+
+		return
+	}
+
+	apierror.Abort(c, http.StatusUnprocessableEntity, ErrorCodeInvalidMetadata, metadataschema.ErrInvalidMetadata.Error(), validationErr.Fields...)
+}
@@ -0,0 +1,125 @@
+package metadataservice_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	"go.hollow.sh/metadataservice/internal/metadataschema"
+	"go.hollow.sh/metadataservice/internal/models"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func defaultMetadataSchema(t *testing.T) *metadataschema.Validator {
+	validator, err := metadataschema.Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return validator
+}
+
+func TestMetadataSchemaValidation(t *testing.T) {
+	router := *testHTTPServerWithConfig(t, TestServerConfig{MetadataSchema: defaultMetadataSchema(t)})
+	testDB := dbtools.TestDB()
+
+	instanceID := "3c8d4a8e-9f6b-4b1e-8c2d-5e7f9a0b1c2d"
+
+	post := func(metadata string) *httptest.ResponseRecorder {
+		reqBody, err := json.Marshal(v1api.UpsertMetadataRequest{ID: instanceID, Metadata: metadata, IPAddresses: []string{"10.97.1.1"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalMetadataPath(), bytes.NewReader(reqBody))
+		router.ServeHTTP(w, req)
+
+		return w
+	}
+
+	w := post(`{"hostname":"invalid","network":{"addresses":[{"cidr":29}]}}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	var resp v1api.ErrorResponse
+
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"network.addresses[0]: missing properties: 'address'"}, resp.Error.Details)
+	assert.Equal(t, v1api.ErrorCodeInvalidMetadata, resp.Error.Code)
+
+	exists, err := models.InstanceMetadatumExists(context.TODO(), testDB, instanceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.False(t, exists)
+
+	w = post(`{"hostname":"valid","network":{"addresses":[{"address":"10.97.1.1"}]}}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+// Test that, with the default schema and IP-less policy the service starts
+// with, metadata without a network block is still accepted, whether or not the
+// upsert gives its IP addresses
+func TestMetadataSchemaDefaultConfig(t *testing.T) {
+	router := *testHTTPServerWithConfig(t, TestServerConfig{MetadataSchema: defaultMetadataSchema(t), IPlessPolicy: v1api.IPlessAllow})
+
+	for _, request := range []v1api.UpsertMetadataRequest{
+		{ID: "7a2b8e2c-3d0f-4f5c-8a6b-9c1d3e4f5a6b", Metadata: `{"hostname":"no-network"}`, IPAddresses: []string{"10.97.3.1"}},
+		{ID: "8b3c9f3d-4e1a-4a6d-9b7c-0d2e4f5a6b7c", Metadata: `{"hostname":"ip-less"}`},
+	} {
+		reqBody, err := json.Marshal(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalMetadataPath(), bytes.NewReader(reqBody))
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code, request.ID)
+	}
+}
+
+func TestMetadataSchemaValidationDisabled(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	reqBody, err := json.Marshal(v1api.UpsertMetadataRequest{ID: "3c8d4a8e-9f6b-4b1e-8c2d-5e7f9a0b1c2d", Metadata: `{"hostname":"no-network"}`, IPAddresses: []string{"10.97.1.2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalMetadataPath(), bytes.NewReader(reqBody))
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestBatchUpsertMetadataSchemaValidation(t *testing.T) {
+	router := *testHTTPServerWithConfig(t, TestServerConfig{MetadataSchema: defaultMetadataSchema(t)})
+
+	resp := postBatch(t, router, []v1api.BatchUpsertRequest{
+		{ID: "4d9e5b9f-0a7c-4c2f-9d3e-6f8a0b1c2d3e", IPAddresses: []string{"10.97.2.1"}, Metadata: `{"network":{"addresses":"10.97.2.1"}}`},
+		{ID: "5e0f6c0a-1b8d-4d3a-8e4f-7a9b1c2d3e4f", IPAddresses: []string{"10.97.2.2"}, Metadata: `{"network":{"addresses":[{"address":"10.97.2.2"}]}}`},
+		// Userdata alone isn't validated
+		{ID: "6f1a7d1b-2c9e-4e4b-9f5a-8b0c2d3e4f5a", IPAddresses: []string{"10.97.2.3"}, Userdata: []byte("#!/bin/sh")},
+	})
+
+	assert.Len(t, resp.Results, 3)
+	assert.Contains(t, resp.Results[0].Error, "network.addresses: expected array, but got string")
+	assert.Empty(t, resp.Results[1].Error)
+	assert.Empty(t, resp.Results[2].Error)
+}
@@ -0,0 +1,99 @@
+package metadataservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"text/template"
+
+	"github.com/volatiletech/sqlboiler/v4/types"
+	"go.uber.org/zap"
+)
+
+// ErrInvalidMetadataTemplate is returned when a metadata template can't be
+// parsed
+var ErrInvalidMetadataTemplate = errors.New("invalid metadata template")
+
+// ParseMetadataTemplates parses the metadata templates, keyed by the
+// top-level field they're served as. They're rendered with TemplateData.
+// Referring to a metadata field which isn't set fails rendering, rather than
+// serving "<no value>".
+func ParseMetadataTemplates(templates map[string]string) (map[string]template.Template, error) {
+	parsed := make(map[string]template.Template, len(templates))
+
+	for field, text := range templates {
+		if field == "" {
+			return nil, fmt.Errorf("%w: a metadata template needs a field name", ErrInvalidMetadataTemplate)
+		}
+
+		tmpl, err := NewTemplate(field).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("%w: field %q: %s", ErrInvalidMetadataTemplate, field, err.Error())
+		}
+
+		parsed[field] = *tmpl
+	}
+
+	return parsed, nil
+}
+
+// renderMetadataTemplates sets the fields with a configured template to the
+// template rendered for the instance, replacing whatever is stored in them, so
+// a naming convention can be changed without upserting every instance again.
+// A template which fails to render leaves its field as stored.
+func (r *Router) renderMetadataTemplates(instanceID string, sourceIP string, metadata types.JSON) types.JSON {
+	if len(r.MetadataTemplates) == 0 {
+		return metadata
+	}
+
+	var doc map[string]json.RawMessage
+
+	if err := json.Unmarshal(metadata, &doc); err != nil || doc == nil {
+		return metadata
+	}
+
+	var decoded map[string]interface{}
+
+	decoder := json.NewDecoder(bytes.NewReader(metadata))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(&decoded); err != nil {
+		return metadata
+	}
+
+	data := newTemplateData(instanceID, sourceIP, decoded)
+
+	fields := make([]string, 0, len(r.MetadataTemplates))
+	for field := range r.MetadataTemplates {
+		fields = append(fields, field)
+	}
+
+	sort.Strings(fields)
+
+	for _, field := range fields {
+		tmpl := r.MetadataTemplates[field]
+
+		var buf bytes.Buffer
+
+		if err := tmpl.Execute(&buf, data); err != nil {
+			r.Logger.Warn("unable to render metadata template, serving the stored value", zap.String("instance_id", instanceID), zap.String("field", field), zap.Error(err))
+			continue
+		}
+
+		rendered, err := json.Marshal(buf.String())
+		if err != nil {
+			continue
+		}
+
+		doc[field] = rendered
+	}
+
+	served, err := json.Marshal(doc)
+	if err != nil {
+		return metadata
+	}
+
+	return served
+}
@@ -0,0 +1,116 @@
+package metadataservice_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func TestParseMetadataTemplates(t *testing.T) {
+	templates, err := v1api.ParseMetadataTemplates(map[string]string{"hostname": "{{.InstanceID}}.{{.Metro}}.internal"})
+
+	assert.NoError(t, err)
+	assert.Contains(t, templates, "hostname")
+
+	_, err = v1api.ParseMetadataTemplates(map[string]string{"hostname": "{{.InstanceID"})
+	assert.ErrorIs(t, err, v1api.ErrInvalidMetadataTemplate)
+
+	_, err = v1api.ParseMetadataTemplates(map[string]string{"": "{{.InstanceID}}"})
+	assert.ErrorIs(t, err, v1api.ErrInvalidMetadataTemplate)
+}
+
+func TestMetadataTemplates(t *testing.T) {
+	templates, err := v1api.ParseMetadataTemplates(map[string]string{
+		"hostname":       "{{.InstanceID}}.{{.Metro}}.internal",
+		"local-hostname": "{{.Hostname}}.{{.Facility}}",
+		"broken":         "{{.Metadata.missing}}",
+		"plan":           "{{.Metadata.missing}}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := *testHTTPServerWithConfig(t, TestServerConfig{FieldTemplates: templates})
+
+	instanceID := dbtools.FixtureInstanceA.InstanceID
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetMetadataPath(), nil)
+	req.RemoteAddr = net.JoinHostPort(dbtools.FixtureInstanceA.HostIPs[0], "0")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var resp map[string]interface{}
+
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	// The fixture's stored hostname is replaced
+	assert.Equal(t, instanceID+".da.internal", resp["hostname"])
+	assert.Equal(t, "instance-a.da11", resp["local-hostname"])
+
+	// Templates which fail to render serve the stored value, or nothing
+	assert.Equal(t, "c3.medium.x86", resp["plan"])
+	assert.NotContains(t, resp, "broken")
+
+	// The templates are also rendered on the EC2-style routes
+	w = httptest.NewRecorder()
+
+	req, _ = http.NewRequestWithContext(context.TODO(), http.MethodGet, "/2009-04-04/meta-data/hostname", nil)
+	req.RemoteAddr = net.JoinHostPort(dbtools.FixtureInstanceA.HostIPs[0], "0")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, instanceID+".da.internal", w.Body.String())
+}
+
+// Test that the template fields are rendered with the same data and
+// functions as the metadata field templates
+func TestTemplateFieldsTemplateData(t *testing.T) {
+	apiURL, err := v1api.NewTemplate("apiURL").Parse("https://{{.Metro}}.metadata/{{.InstanceID}}?plan={{.plan}}&from={{.SourceIP}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fieldTemplates, err := v1api.ParseMetadataTemplates(map[string]string{"source": "{{json .SourceIP}}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := *testHTTPServerWithConfig(t, TestServerConfig{
+		TemplateFields: map[string]template.Template{"api_url": *apiURL},
+		FieldTemplates: fieldTemplates,
+	})
+
+	instanceID := dbtools.FixtureInstanceA.InstanceID
+	instanceIP := dbtools.FixtureInstanceA.HostIPs[0]
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetMetadataPath(), nil)
+	req.RemoteAddr = net.JoinHostPort(instanceIP, "0")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var resp map[string]interface{}
+
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "https://da.metadata/"+instanceID+"?plan=c3.medium.x86&from="+instanceIP, resp["api_url"])
+	assert.Equal(t, `"`+instanceIP+`"`, resp["source"])
+}
@@ -0,0 +1,3 @@
+// Package openstack provides for converting metadata json to the format of the
+// OpenStack datasource's meta_data.json
+package openstack
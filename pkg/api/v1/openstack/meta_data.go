@@ -0,0 +1,124 @@
+package openstack
+
+import (
+	"strconv"
+
+	"go.hollow.sh/metadataservice/pkg/api/v1/ec2"
+)
+
+const (
+	// NetworkTypeIPv4 is the type of a network with an IPv4 address
+	NetworkTypeIPv4 = "ipv4"
+
+	// NetworkTypeIPv6 is the type of a network with an IPv6 address
+	NetworkTypeIPv6 = "ipv6"
+)
+
+// MetaData is the OpenStack meta_data.json document served for an instance.
+// Fields which aren't in the stored metadata are left out, rather than served
+// as nulls.
+type MetaData struct {
+	UUID             string            `json:"uuid"`
+	Name             string            `json:"name,omitempty"`
+	Hostname         string            `json:"hostname,omitempty"`
+	AvailabilityZone string            `json:"availability_zone,omitempty"`
+	PublicKeys       map[string]string `json:"public_keys,omitempty"`
+	NetworkConfig    *NetworkConfig    `json:"network_config,omitempty"`
+}
+
+// NetworkConfig describes the instance's addresses, in the form of the
+// networks listed by the OpenStack network_data.json
+type NetworkConfig struct {
+	Networks []Network `json:"networks"`
+}
+
+// Network is one of the instance's addresses
+type Network struct {
+	ID        string `json:"id,omitempty"`
+	Type      string `json:"type"`
+	IPAddress string `json:"ip_address"`
+	Netmask   string `json:"netmask,omitempty"`
+	Public    bool   `json:"public"`
+}
+
+// NewMetaData converts the instance's metadata to the OpenStack format. The
+// uuid is the metadata's id, or instanceID when it doesn't have one. The
+// hostname is also served as the instance's name, and the facility as its
+// availability zone.
+func NewMetaData(instanceID string, metadata *ec2.Metadata) *MetaData {
+	result := &MetaData{
+		UUID:             metadata.ID,
+		Name:             metadata.Hostname,
+		Hostname:         metadata.Hostname,
+		AvailabilityZone: metadata.Facility,
+		PublicKeys:       publicKeys(metadata),
+		NetworkConfig:    networkConfig(metadata.Network),
+	}
+
+	if result.UUID == "" {
+		result.UUID = instanceID
+	}
+
+	return result
+}
+
+// publicKeys returns the instance's SSH public keys keyed by name. The keys
+// stored for the instance are served when there are any, otherwise the
+// metadata's ssh_keys. Keys without a name, or with the name of a key listed
+// before them, are named "key-<index>".
+func publicKeys(metadata *ec2.Metadata) map[string]string {
+	var keys []ec2.PublicKey
+
+	if len(metadata.PublicKeys) > 0 {
+		keys = metadata.PublicKeys
+	} else {
+		for _, key := range metadata.SSHKeys {
+			keys = append(keys, ec2.PublicKey{OpenSSHKey: key})
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	result := make(map[string]string, len(keys))
+
+	for i, key := range keys {
+		name := key.Name
+
+		if _, taken := result[name]; name == "" || taken {
+			name = "key-" + strconv.Itoa(i)
+		}
+
+		result[name] = key.OpenSSHKey
+	}
+
+	return result
+}
+
+// networkConfig lists the instance's addresses, or returns nil when there
+// aren't any
+func networkConfig(network *ec2.Network) *NetworkConfig {
+	if network == nil || len(network.Addresses) == 0 {
+		return nil
+	}
+
+	config := &NetworkConfig{Networks: []Network{}}
+
+	for _, address := range network.Addresses {
+		networkType := NetworkTypeIPv4
+		if address.AddressFamily == 6 {
+			networkType = NetworkTypeIPv6
+		}
+
+		config.Networks = append(config.Networks, Network{
+			ID:        address.ID,
+			Type:      networkType,
+			IPAddress: address.Address,
+			Netmask:   address.Netmask,
+			Public:    address.Public,
+		})
+	}
+
+	return config
+}
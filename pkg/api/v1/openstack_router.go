@@ -0,0 +1,31 @@
+package metadataservice
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"go.hollow.sh/metadataservice/internal/middleware"
+)
+
+const (
+	// OpenstackURI is the path prefix for the OpenStack-style format
+	OpenstackURI = "/openstack"
+
+	// OpenstackMetadataURI is the path to the OpenStack-style metadata
+	// endpoint, serving the instance's meta_data.json
+	OpenstackMetadataURI = "/latest/meta_data.json"
+)
+
+// OpenstackRoutes will add the routes for the OpenStack-style API to a router
+// group
+func (r *Router) OpenstackRoutes(rg *gin.RouterGroup) {
+	// GET /openstack/latest/meta_data.json
+	reads := rg.Group("", middleware.Timeout(r.Timeouts.Read), r.requireSessionToken())
+
+	reads.GET(OpenstackMetadataURI, r.identifyInstance(InstanceAuthRouteOpenstackMetadata), r.requireBootstrapToken(), r.instanceOpenstackMetadataGet)
+}
+
+// GetOpenstackMetadataPath returns the path used to fetch the OpenStack-style
+// meta_data.json for the instance
+func GetOpenstackMetadataPath() string {
+	return OpenstackURI + OpenstackMetadataURI
+}
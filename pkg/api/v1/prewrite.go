@@ -0,0 +1,39 @@
+package metadataservice
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"go.hollow.sh/metadataservice/internal/apierror"
+	"go.hollow.sh/metadataservice/internal/prewrite"
+)
+
+// preWriteRejected asks the configured pre-write hook whether the change may be
+// written. If it may not, it responds with a 403 (or a 503 when the hook
+// couldn't make a decision) and returns true. Every change is allowed when no
+// hook is configured.
+//
+// The check is made before the upsert begins, so no database locks are held
+// while waiting on the hook.
+func (r *Router) preWriteRejected(c *gin.Context, change prewrite.Change) bool {
+	err := r.PreWriteHook.Check(c.Request.Context(), change)
+	if err == nil {
+		return false
+	}
+
+	if errors.Is(err, prewrite.ErrRejected) {
+		r.Logger.Sugar().Warn("Pre-write hook rejected ", change.Kind, " change for instance ", change.ID, ": ", err)
+
+		apierror.Abort(c, http.StatusForbidden, ErrorCodeChangeRejected, "change rejected by pre-write hook", err.Error())
+
+		return true
+	}
+
+	r.Logger.Sugar().Error("Pre-write hook failed for ", change.Kind, " change for instance ", change.ID, ": ", err)
+
+	apierror.Abort(c, http.StatusServiceUnavailable, ErrorCodeServiceUnavailable, "service unavailable")
+
+	return true
+}
@@ -0,0 +1,82 @@
+package metadataservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"go.hollow.sh/metadataservice/internal/apierror"
+)
+
+const (
+	// instanceExistsQuery checks whether any data is stored for an instance
+	instanceExistsQuery = `SELECT EXISTS (SELECT 1 FROM instance_metadata WHERE id = $1) OR EXISTS (SELECT 1 FROM instance_userdata WHERE id = $1)`
+
+	// instanceCountQuery counts the instances with any data stored. Both
+	// counts are served from the primary key indexes.
+	instanceCountQuery = `SELECT count(*) FROM (SELECT id FROM instance_metadata UNION SELECT id FROM instance_userdata)`
+)
+
+// errInstanceQuotaExceeded is returned when storing data for an instance
+// would create a new instance beyond the configured maximum
+var errInstanceQuotaExceeded = errors.New("instance quota exceeded")
+
+// instanceQuotaExceeded checks whether storing data for the instance would
+// create a new instance beyond the configured maximum number of instances. If
+// it would, it responds with a 403 and returns true. Updates to instances
+// which already have data stored are always allowed.
+//
+// The check is made before the upsert begins, so concurrent creates may
+// briefly exceed the limit.
+func (r *Router) instanceQuotaExceeded(c *gin.Context, instanceID string) bool {
+	_, err := r.checkInstanceQuota(c.Request.Context(), instanceID, 0)
+
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, errInstanceQuotaExceeded):
+		apierror.Abort(c, http.StatusForbidden, ErrorCodeInstanceQuotaExceeded, "instance quota exceeded",
+			fmt.Sprintf("the maximum of %d instances has been reached", r.MaxInstances))
+	default:
+		dbErrorResponse(r.Logger, c, err)
+	}
+
+	return true
+}
+
+// checkInstanceQuota returns errInstanceQuotaExceeded if storing data for the
+// instance would create a new instance beyond the configured maximum, also
+// counting the given number of pending new instances which are about to be
+// created. It reports whether the instance would be a new one.
+func (r *Router) checkInstanceQuota(ctx context.Context, instanceID string, pending int64) (bool, error) {
+	if r.MaxInstances <= 0 {
+		return false, nil
+	}
+
+	var exists bool
+
+	if err := r.DB.GetContext(ctx, &exists, instanceExistsQuery, instanceID); err != nil {
+		return false, err
+	}
+
+	if exists {
+		return false, nil
+	}
+
+	var count int64
+
+	if err := r.DB.GetContext(ctx, &count, instanceCountQuery); err != nil {
+		return true, err
+	}
+
+	if count+pending >= r.MaxInstances {
+		r.Logger.Sugar().Warn("Refusing to create instance ", instanceID, ", the maximum of ", r.MaxInstances, " instances has been reached")
+
+		return true, errInstanceQuotaExceeded
+	}
+
+	return true, nil
+}
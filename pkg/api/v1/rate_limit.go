@@ -0,0 +1,52 @@
+package metadataservice
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"go.hollow.sh/metadataservice/internal/apierror"
+	"go.hollow.sh/metadataservice/internal/middleware"
+	"go.hollow.sh/metadataservice/internal/ratelimit"
+)
+
+const (
+	rateLimitKeyInstance = "instance:"
+	rateLimitKeyIP       = "ip:"
+)
+
+// limitReads wraps the handler identifying the instance making a read, so that
+// once it's identified, the read is rejected with a 429 when the instance has
+// exceeded the read rate limit. Requests from addresses which don't identify an
+// instance are limited by address instead. Nothing is limited when there's no
+// ReadRateLimiter.
+func (r *Router) limitReads(identify gin.HandlerFunc) gin.HandlerFunc {
+	if r.ReadRateLimiter == nil {
+		return identify
+	}
+
+	return func(c *gin.Context) {
+		identify(c)
+
+		if c.IsAborted() {
+			return
+		}
+
+		key := rateLimitKeyIP + c.GetString(middleware.ContextKeyRequestorIP)
+		if instanceID := c.GetString(middleware.ContextKeyInstanceID); instanceID != "" {
+			key = rateLimitKeyInstance + instanceID
+		}
+
+		allowed, retryAfter := r.ReadRateLimiter.Allow(key)
+		if allowed {
+			return
+		}
+
+		ratelimit.MetricThrottled.WithLabelValues(c.FullPath()).Inc()
+
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		apierror.Abort(c, http.StatusTooManyRequests, ErrorCodeRateLimited, "too many requests")
+	}
+}
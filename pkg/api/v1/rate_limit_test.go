@@ -0,0 +1,42 @@
+package metadataservice_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	"go.hollow.sh/metadataservice/internal/ratelimit"
+)
+
+func TestReadRateLimit(t *testing.T) {
+	router := *testHTTPServerWithConfig(t, TestServerConfig{ReadRateLimiter: ratelimit.New(0.001, 2, time.Minute)})
+
+	// Both of instance A's addresses share its bucket
+	for _, instanceIP := range dbtools.FixtureInstanceA.HostIPs[:2] {
+		w := getMetadataFrom(router, instanceIP)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	w := getMetadataFrom(router, dbtools.FixtureInstanceA.HostIPs[0])
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+
+	// Other instances aren't limited by it
+	w = getMetadataFrom(router, dbtools.FixtureInstanceB.HostIPs[0])
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Nor are unknown addresses, which are limited by address instead
+	for i := 0; i < 2; i++ {
+		w = getMetadataFrom(router, "1.2.3.4")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	}
+
+	w = getMetadataFrom(router, "1.2.3.4")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	w = getMetadataFrom(router, "1.2.3.5")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
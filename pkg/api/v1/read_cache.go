@@ -0,0 +1,62 @@
+package metadataservice
+
+import (
+	"net"
+	"strings"
+
+	"go.hollow.sh/metadataservice/internal/middleware"
+	"go.hollow.sh/metadataservice/internal/models"
+)
+
+// invalidateReadCache evicts everything the read cache holds for an instance
+// after its data or IP addresses were written: its metadata, userdata and tags, the
+// addresses it was identified by, and any cached address covered by one of
+// the given addresses (which may have just been taken from another instance).
+// Only this replica's cache is invalidated, others serve their entries until
+// they expire. It returns the number of entries evicted.
+func (r *Router) invalidateReadCache(instanceID string, ipAddresses []string) int {
+	if r.ReadCache == nil {
+		return 0
+	}
+
+	evicted := 0
+
+	for _, key := range []string{"metadata:" + instanceID, "userdata:" + instanceID, "tags:" + instanceID} {
+		if r.ReadCache.Remove(key) {
+			evicted++
+		}
+	}
+
+	var networks []*net.IPNet
+
+	for _, address := range ipAddresses {
+		if _, network, err := net.ParseCIDR(address); err == nil {
+			networks = append(networks, network)
+		} else if ip := net.ParseIP(address); ip != nil {
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+		}
+	}
+
+	evicted += r.ReadCache.RemoveFunc(func(key string, value interface{}) bool {
+		address, ok := strings.CutPrefix(key, middleware.IPAddressCacheKeyPrefix)
+		if !ok {
+			return false
+		}
+
+		if instanceIP, ok := value.(*models.InstanceIPAddress); ok && instanceIP.InstanceID == instanceID {
+			return true
+		}
+
+		ip := net.ParseIP(address)
+
+		for _, network := range networks {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+		}
+
+		return false
+	})
+
+	return evicted
+}
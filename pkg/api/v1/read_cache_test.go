@@ -0,0 +1,154 @@
+package metadataservice_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/volatiletech/sqlboiler/v4/boil"
+	"github.com/volatiletech/sqlboiler/v4/types"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	"go.hollow.sh/metadataservice/internal/readcache"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func getMetadataFrom(router http.Handler, instanceIP string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetMetadataPath()+"?fields=hostname", nil)
+	req.RemoteAddr = net.JoinHostPort(instanceIP, "0")
+	router.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestReadCache(t *testing.T) {
+	router := *testHTTPServerWithConfig(t, TestServerConfig{ReadCache: readcache.New(100, time.Minute)})
+	testDB := dbtools.TestDB()
+	instanceIP := dbtools.FixtureInstanceA.HostIPs[0]
+
+	w := getMetadataFrom(router, instanceIP)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"hostname":"instance-a"}`, w.Body.String())
+
+	// Writes which don't go through the service are only seen once the cached
+	// entry expires
+	metadata := *dbtools.FixtureInstanceA.InstanceMetadata
+	metadata.Metadata = types.JSON(`{"hostname": "changed-behind-the-cache"}`)
+
+	if _, err := metadata.Update(context.TODO(), testDB, boil.Infer()); err != nil {
+		t.Fatal(err)
+	}
+
+	w = getMetadataFrom(router, instanceIP)
+	assert.JSONEq(t, `{"hostname":"instance-a"}`, w.Body.String())
+
+	// Upserts through the service invalidate the cache
+	upsert(t, router, v1api.GetInternalMetadataPath()+"?prune=false", v1api.UpsertMetadataRequest{
+		ID:       dbtools.FixtureInstanceA.InstanceID,
+		Metadata: `{"hostname": "upserted"}`,
+	})
+
+	w = getMetadataFrom(router, instanceIP)
+	assert.JSONEq(t, `{"hostname":"upserted"}`, w.Body.String())
+
+	// An address taken over by another instance is served that instance's data
+	upsert(t, router, v1api.GetInternalMetadataPath(), v1api.UpsertMetadataRequest{
+		ID:          "8f1c9d4e-2b7a-4e3f-9c6d-1a2b3c4d5e6f",
+		Metadata:    `{"hostname": "new-owner"}`,
+		IPAddresses: []string{instanceIP},
+	})
+
+	w = getMetadataFrom(router, instanceIP)
+	assert.JSONEq(t, `{"hostname":"new-owner"}`, w.Body.String())
+}
+
+func TestReadCacheTags(t *testing.T) {
+	router := *testHTTPServerWithConfig(t, TestServerConfig{ReadCache: readcache.New(100, time.Minute)})
+	testDB := dbtools.TestDB()
+	instanceIP := dbtools.FixtureInstanceA.HostIPs[0]
+
+	w := getMetadataFrom(router, instanceIP)
+	assert.JSONEq(t, `{"hostname":"instance-a"}`, w.Body.String())
+
+	// The tags are cached along with the metadata, so ones attached behind
+	// the service's back aren't seen until the cached entry expires
+	_, err := testDB.ExecContext(context.TODO(), `INSERT INTO instance_tags (instance_id, tag_key, tag_value, updated_at) VALUES ($1, 'team', 'metal', now())`, dbtools.FixtureInstanceA.InstanceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = getMetadataFrom(router, instanceIP)
+	assert.JSONEq(t, `{"hostname":"instance-a"}`, w.Body.String())
+
+	// Tags stored through the service invalidate the cache
+	w = postJSON(t, router, v1api.GetInternalTagsPath(dbtools.FixtureInstanceA.InstanceID), v1api.UpsertTagsRequest{
+		Tags: map[string]string{"environment": "production"},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = getMetadataFrom(router, instanceIP)
+	assert.JSONEq(t, `{"hostname":"instance-a","instance_tags":{"environment":"production"}}`, w.Body.String())
+}
+
+func invalidateCache(t *testing.T, router http.Handler, instanceID string) v1api.CacheInvalidateResponse {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalCacheInvalidatePath(instanceID), nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	resp := v1api.CacheInvalidateResponse{}
+
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, instanceID, resp.ID)
+
+	return resp
+}
+
+func TestReadCacheInvalidate(t *testing.T) {
+	router := *testHTTPServerWithConfig(t, TestServerConfig{ReadCache: readcache.New(100, time.Minute)})
+	testDB := dbtools.TestDB()
+	instanceIP := dbtools.FixtureInstanceA.HostIPs[0]
+
+	w := getMetadataFrom(router, instanceIP)
+	assert.JSONEq(t, `{"hostname":"instance-a"}`, w.Body.String())
+
+	metadata := *dbtools.FixtureInstanceA.InstanceMetadata
+	metadata.Metadata = types.JSON(`{"hostname": "changed-behind-the-cache"}`)
+
+	if _, err := metadata.Update(context.TODO(), testDB, boil.Infer()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The instance's metadata, its tags and the lookup of the address it was
+	// read from are evicted
+	resp := invalidateCache(t, router, dbtools.FixtureInstanceA.InstanceID)
+	assert.Equal(t, 3, resp.Evicted)
+
+	w = getMetadataFrom(router, instanceIP)
+	assert.JSONEq(t, `{"hostname":"changed-behind-the-cache"}`, w.Body.String())
+
+	// Nothing is left to evict for an instance which hasn't been read since
+	resp = invalidateCache(t, router, dbtools.FixtureInstanceB.InstanceID)
+	assert.Equal(t, 0, resp.Evicted)
+}
+
+func TestReadCacheInvalidateDisabled(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	resp := invalidateCache(t, router, dbtools.FixtureInstanceA.InstanceID)
+	assert.Equal(t, 0, resp.Evicted)
+}
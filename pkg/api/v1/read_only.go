@@ -0,0 +1,23 @@
+package metadataservice
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"go.hollow.sh/metadataservice/internal/apierror"
+)
+
+// rejectInReadOnly returns the middleware rejecting upserts and deletes with a
+// 503 while the service is in read-only mode. The mode is checked on every
+// request, so it takes effect as soon as it's switched.
+func (r *Router) rejectInReadOnly() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if r.ReadOnly.Enabled() {
+			apierror.Abort(c, http.StatusServiceUnavailable, ErrorCodeReadOnly, "service in read-only mode")
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -0,0 +1,72 @@
+package metadataservice
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HeaderRecordVersion carries the version of an instance's stored metadata or
+// userdata record. The internal reads return it, along with an ETag of the
+// same version, and a write sending either back, in X-Record-Version or
+// If-Match, is rejected if the record has changed since.
+const HeaderRecordVersion = "X-Record-Version"
+
+// ErrInvalidRecordVersion is returned when the If-Match or X-Record-Version
+// header isn't a version of the record being written
+var ErrInvalidRecordVersion = errors.New("invalid record version")
+
+// recordVersion returns the version of a record last updated at updatedAt
+func recordVersion(updatedAt time.Time) string {
+	return updatedAt.UTC().Format(time.RFC3339Nano)
+}
+
+// setRecordVersionHeader sets the X-Record-Version header, and the ETag, to
+// the version of a record last updated at updatedAt, so either can be sent
+// back with a write
+func setRecordVersionHeader(c *gin.Context, updatedAt time.Time) {
+	version := recordVersion(updatedAt)
+
+	c.Header(HeaderRecordVersion, version)
+	c.Header("ETag", `"`+version+`"`)
+}
+
+// getRecordVersionHeader reads the If-Match header, or the X-Record-Version
+// header, which make a write optimistic: they carry the version of the stored
+// record the write expects to replace, as returned by the internal reads in
+// the ETag and X-Record-Version headers. If-Match takes a single entity tag,
+// and a weak one (like the ETag of a compressed read) is accepted too. It's
+// nil when neither header is sent, and the last writer wins.
+func getRecordVersionHeader(c *gin.Context) (*time.Time, error) {
+	ifMatch := strings.TrimSpace(c.GetHeader("If-Match"))
+	header := strings.TrimSpace(c.GetHeader(HeaderRecordVersion))
+
+	if ifMatch == "*" {
+		// Any stored record would match, which can't be checked as a version
+		return nil, fmt.Errorf("%w: If-Match must name the record's version, not *", ErrInvalidRecordVersion)
+	}
+
+	if ifMatch != "" {
+		version := strings.Trim(strings.TrimPrefix(ifMatch, "W/"), `"`)
+
+		if header != "" && header != version {
+			return nil, fmt.Errorf("%w: the If-Match and %s headers name different versions", ErrInvalidRecordVersion, HeaderRecordVersion)
+		}
+
+		header = version
+	}
+
+	if header == "" {
+		return nil, nil
+	}
+
+	expected, err := time.Parse(time.RFC3339Nano, header)
+	if err != nil {
+		return nil, fmt.Errorf("%w: it must be a version returned in the ETag or %s header of a read", ErrInvalidRecordVersion, HeaderRecordVersion)
+	}
+
+	return &expected, nil
+}
@@ -0,0 +1,152 @@
+package metadataservice_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+// getMetadataVersion reads the version of the instance's stored metadata, as
+// a client making an optimistic write would
+func getMetadataVersion(t *testing.T, router http.Handler, instanceID string) string {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetInternalMetadataByIDPath(instanceID), nil)
+	router.ServeHTTP(w, req)
+
+	version := w.Header().Get(v1api.HeaderRecordVersion)
+	if version == "" {
+		t.Fatal("no metadata version was returned")
+	}
+
+	return version
+}
+
+func upsertMetadataVersion(t *testing.T, router http.Handler, version string, hostname string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	reqBody, err := json.Marshal(v1api.UpsertMetadataRequest{
+		ID:          dbtools.FixtureInstanceA.InstanceID,
+		Metadata:    `{"hostname":"` + hostname + `"}`,
+		IPAddresses: dbtools.FixtureInstanceA.HostIPs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalMetadataPath(), bytes.NewReader(reqBody))
+	req.Header.Set(v1api.HeaderRecordVersion, version)
+	router.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestUpsertMetadataRecordVersion(t *testing.T) {
+	router := *testHTTPServer(t)
+	instanceID := dbtools.FixtureInstanceA.InstanceID
+
+	version := getMetadataVersion(t, router, instanceID)
+
+	// The current version is accepted once
+	w := upsertMetadataVersion(t, router, version, "first")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = upsertMetadataVersion(t, router, version, "second")
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	assert.Contains(t, w.Body.String(), string(v1api.ErrorCodePreconditionFailed))
+
+	// The next write expecting the new version succeeds
+	w = upsertMetadataVersion(t, router, getMetadataVersion(t, router, instanceID), "second")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Without a version, the last writer wins
+	w = upsertMetadataVersion(t, router, "", "third")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = upsertMetadataVersion(t, router, "yesterday", "fourth")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+// Test that the ETag of an internal read can be sent back in If-Match as the
+// expected version
+func TestUpsertMetadataIfMatch(t *testing.T) {
+	router := *testHTTPServer(t)
+	instanceID := dbtools.FixtureInstanceA.InstanceID
+
+	upsert := func(ifMatch string) int {
+		reqBody, err := json.Marshal(v1api.UpsertMetadataRequest{
+			ID:          instanceID,
+			Metadata:    `{"hostname":"if-match"}`,
+			IPAddresses: dbtools.FixtureInstanceA.HostIPs,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalMetadataPath(), bytes.NewReader(reqBody))
+		req.Header.Set("If-Match", ifMatch)
+		router.ServeHTTP(w, req)
+
+		return w.Code
+	}
+
+	// The ETag is the quoted record version
+	etag := getMetadataETag(t, router, instanceID)
+	assert.Equal(t, `"`+getMetadataVersion(t, router, instanceID)+`"`, etag)
+
+	assert.Equal(t, http.StatusOK, upsert(etag))
+	assert.Equal(t, http.StatusPreconditionFailed, upsert(etag))
+
+	// A weakened ETag names the same version
+	assert.Equal(t, http.StatusOK, upsert("W/"+getMetadataETag(t, router, instanceID)))
+
+	assert.Equal(t, http.StatusBadRequest, upsert(`"0123456789abcdef0123456789abcdef"`))
+	assert.Equal(t, http.StatusBadRequest, upsert("*"))
+}
+
+// getMetadataETag reads the ETag of the instance's stored metadata
+func getMetadataETag(t *testing.T, router http.Handler, instanceID string) string {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetInternalMetadataByIDPath(instanceID), nil)
+	router.ServeHTTP(w, req)
+
+	return w.Header().Get("ETag")
+}
+
+func TestPatchMetadataRecordVersion(t *testing.T) {
+	router := *testHTTPServer(t)
+	instanceID := dbtools.FixtureInstanceA.InstanceID
+
+	patch := func(version string) int {
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPatch, v1api.GetInternalMetadataByIDPath(instanceID), bytes.NewReader([]byte(`{"hostname":"patched"}`)))
+		req.Header.Set("Content-Type", v1api.ContentTypeMergePatch)
+		req.Header.Set(v1api.HeaderRecordVersion, version)
+		router.ServeHTTP(w, req)
+
+		return w.Code
+	}
+
+	version := getMetadataVersion(t, router, instanceID)
+
+	assert.Equal(t, http.StatusOK, patch(version))
+	assert.Equal(t, http.StatusPreconditionFailed, patch(version))
+}
@@ -1,25 +1,41 @@
 package metadataservice
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"net"
+	"net/http"
 	"path"
 	"reflect"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
-	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
 	"go.uber.org/zap"
 
 	"go.hollow.sh/toolbox/ginjwt"
 
+	"go.hollow.sh/metadataservice/internal/coalesce"
+	"go.hollow.sh/metadataservice/internal/events"
+	"go.hollow.sh/metadataservice/internal/instancetags"
+	"go.hollow.sh/metadataservice/internal/lastfetch"
 	"go.hollow.sh/metadataservice/internal/lookup"
+	"go.hollow.sh/metadataservice/internal/metadataschema"
 	"go.hollow.sh/metadataservice/internal/middleware"
 	"go.hollow.sh/metadataservice/internal/models"
+	"go.hollow.sh/metadataservice/internal/prewrite"
+	"go.hollow.sh/metadataservice/internal/ratelimit"
+	"go.hollow.sh/metadataservice/internal/readcache"
+	"go.hollow.sh/metadataservice/internal/readonly"
+	"go.hollow.sh/metadataservice/internal/sessiontoken"
+	"go.hollow.sh/metadataservice/internal/stalecache"
+	"go.hollow.sh/metadataservice/internal/userdata"
 )
 
 const (
@@ -30,14 +46,36 @@ const (
 	// instances themselves to retrieve their metadata.
 	MetadataURI = "/metadata"
 
+	// MetadataNetworkInterfaceURI is the path to the endpoint called by
+	// instances to retrieve the network metadata scoped to the interface
+	// owning the IP address the request was made from.
+	MetadataNetworkInterfaceURI = "/metadata/network-interface"
+
+	// MetadataProvisioningURI is the path to the endpoint called by instances
+	// to retrieve their metadata, which responds with a 200 and a marker
+	// rather than a 404 when the metadata hasn't been provisioned yet.
+	MetadataProvisioningURI = "/metadata/provisioning"
+
+	// MetadataInstanceIDURI is the path to the endpoint called by instances to
+	// retrieve only their instance ID, as plain text.
+	MetadataInstanceIDURI = "/metadata/instance-id"
+
 	// UserdataURI is the path to the regular userdata endpoint, called by the
 	// instances themselves to retrieve their userdata.
 	UserdataURI = "/userdata"
 
+	// BootConfigURI is the path to the endpoint used by an instance to fetch
+	// its metadata, userdata and network config in a single request
+	BootConfigURI = "/device/boot-config"
+
 	// InternalMetadataURI is the path to the internal (authenticated) endpoint
 	// used for updating & retrieving metadata for any instance
 	InternalMetadataURI = "/device-metadata"
 
+	// InternalMetadataValidateURI is the path to the internal (authenticated)
+	// endpoint used to check a metadata upsert request without storing it
+	InternalMetadataValidateURI = "/device-metadata/validate"
+
 	// InternalUserdataURI is the path to the internal (authenticated) endpoint
 	// used for updating & retrieving metadata for any instance
 	InternalUserdataURI = "/device-userdata"
@@ -50,17 +88,124 @@ const (
 	// endpoint used for retrieving the stored metadata for an instance
 	InternalUserdataWithIDURI = "/device-userdata/:instance-id"
 
+	// InternalInstanceWithIDURI is the path to the internal (authenticated)
+	// endpoint used to delete everything stored for an instance
+	InternalInstanceWithIDURI = "/device/:instance-id"
+
+	// InternalInstanceStatusURI is the path to the internal (authenticated)
+	// endpoint used to check whether the data for an instance has been stored
+	InternalInstanceStatusURI = "/device/:instance-id/status"
+
+	// InternalInstancesURI is the path to the internal (authenticated)
+	// endpoint used to page through the instances with stored metadata
+	InternalInstancesURI = "/instances"
+
+	// InternalExportURI is the path to the internal (authenticated) endpoint
+	// used to stream a bulk export of the stored instance data
+	InternalExportURI = "/device-metadata/export"
+
+	// InternalReassociateIPsURI is the path to the internal (authenticated)
+	// endpoint used to re-derive the IP address associations for all instances
+	// from their stored metadata
+	InternalReassociateIPsURI = "/device-metadata/reassociate-ips"
+
+	// InternalReassociateIPsWithIDURI is the path to the internal
+	// (authenticated) endpoint used to re-derive the IP address associations
+	// for a single instance from its stored metadata
+	InternalReassociateIPsWithIDURI = "/device-metadata/:instance-id/reassociate-ips"
+
+	// InternalInstanceIPAddressesURI is the path to the internal
+	// (authenticated) endpoint used to add IP addresses to, or remove them
+	// from, a single instance's associations, without touching its metadata
+	InternalInstanceIPAddressesURI = "/device-metadata/:instance-id/ip-addresses"
+
+	// InternalBatchURI is the path to the internal (authenticated) endpoint
+	// used to upsert the metadata and/or userdata of a batch of instances
+	InternalBatchURI = "/device-metadata/batch"
+
+	// InternalIPAddressesURI is the path to the internal (authenticated)
+	// endpoint used to bulk-load IP address associations for instances,
+	// separately from their metadata
+	InternalIPAddressesURI = "/device-ip-addresses"
+
+	// InternalInstanceByIPURI is the path to the internal (authenticated)
+	// endpoint used by operators to look up which instance an IP address is
+	// associated to
+	InternalInstanceByIPURI = "/device-ip-addresses/:ip-address"
+
+	// InternalBootstrapTokenURI is the path to the internal (authenticated)
+	// endpoint used to issue, or rotate, the bootstrap token for an instance
+	InternalBootstrapTokenURI = "/device-metadata/:instance-id/bootstrap-token"
+
+	// InternalMetadataHistoryURI is the path to the internal (authenticated)
+	// endpoint used to fetch the previous versions of an instance's metadata
+	InternalMetadataHistoryURI = "/device-metadata/:instance-id/history"
+
+	// InternalPublicKeysURI is the path to the internal (authenticated)
+	// endpoint used to fetch or replace the SSH public keys served to an
+	// instance under the ec2-style public-keys/ items
+	InternalPublicKeysURI = "/device-metadata/:instance-id/public-keys"
+
+	// InternalTagsURI is the path to the internal (authenticated) endpoint
+	// used to fetch or replace the key/value tags attached to an instance
+	InternalTagsURI = "/device-metadata/:instance-id/tags"
+
+	// InternalCacheInvalidateURI is the path to the internal (authenticated)
+	// endpoint used to evict everything the read cache holds for an instance
+	InternalCacheInvalidateURI = "/device-metadata/:instance-id/cache/invalidate"
+
 	scopePrefix = "metadata"
+
+	// pruneParam is the query param used to control whether an upsert removes
+	// IP address associations which weren't included in the request
+	pruneParam = "prune"
+
+	// dryRunParam is the query param used to ask an upsert for the changes it
+	// would make to the IP address associations, without making them
+	dryRunParam = "dry_run"
+
+	// unlessFetchedWithinParam is the query param used to make a delete
+	// conditional on the instance's metadata not having been fetched recently
+	unlessFetchedWithinParam = "unless_fetched_within"
+
+	// fieldsParam is the query param used to request only some of the
+	// top-level metadata fields
+	fieldsParam = "fields"
 )
 
 var (
-	validate *validator.Validate
-
 	// errNotFound wraps the two sorts of "not found" errors we might encounter
 	// - the item wasn't found in the DB
 	// - the item wasn't found in the upstream lookup service
 	errNotFound = errors.New("not found")
 
+	// errInvalidDeleteCondition is returned when the conditions given for a
+	// delete request can't be used
+	errInvalidDeleteCondition = errors.New("invalid delete condition")
+
+	// errBatchTooLarge is returned when a bulk request contains too many items
+	errBatchTooLarge = errors.New("batch too large")
+
+	// errEmptyBatchItem is returned when an item in a batch upsert has
+	// neither metadata nor userdata
+	errEmptyBatchItem = errors.New("one of metadata or userdata is required")
+
+	// errPublicKeysWithoutMetadata is returned when an item in a batch upsert
+	// has public keys, but no metadata to store them with
+	errPublicKeysWithoutMetadata = errors.New("public keys can only be given with metadata")
+
+	// errTagsWithoutMetadata is returned when an item in a batch upsert has
+	// tags, but no metadata to store them with
+	errTagsWithoutMetadata = errors.New("tags can only be given with metadata")
+
+	// errBatchItemInternal and errBatchItemUnavailable are reported for items
+	// in a bulk request which couldn't be written, without leaking the cause
+	errBatchItemInternal    = errors.New("internal server error")
+	errBatchItemUnavailable = errors.New("service unavailable")
+
+	// ErrInvalidParam is returned when a query param can't be parsed
+	ErrInvalidParam = errors.New("invalid query param")
+
 	// ErrUUIDNotFound is returned when an expected uuid is not provided.
 	ErrUUIDNotFound = errors.New("uuid not found")
 
@@ -68,37 +213,269 @@ var (
 	ErrInvalidUUID = errors.New("invalid uuid")
 )
 
+// RouteTimeouts are how long each class of route has to handle a request. A
+// timeout of 0 sets no limit beyond the server's own.
+type RouteTimeouts struct {
+	// Read is for the instance-facing routes, and the internal routes which
+	// read a single instance's data
+	Read time.Duration `json:"read"`
+
+	// Write is for the internal routes which create, update or delete data
+	Write time.Duration `json:"write"`
+
+	// Admin is for the long-running internal routes which work on every
+	// instance, like exports, or on large batches of them
+	Admin time.Duration `json:"admin"`
+}
+
 // Router provides a router for the v1 API
 type Router struct {
-	AuthMW         *ginjwt.Middleware
-	DB             *sqlx.DB
-	Logger         *zap.Logger
-	LookupEnabled  bool
-	LookupClient   lookup.Client
-	TemplateFields map[string]template.Template
+	AuthMW              *ginjwt.Middleware
+	DB                  *sqlx.DB
+	Logger              *zap.Logger
+	LookupEnabled       bool
+	LookupClient        lookup.Client
+	TemplateFields      map[string]template.Template
+	MetadataTemplates   map[string]template.Template
+	SensitivePaths      []SensitivePath
+	Coalescer           *coalesce.Group
+	UserdataTransformer userdata.Transformer
+	Datasources         DatasourceConfig
+	SourceIPDebugHeader bool
+	Ec2NotFoundBody     NotFoundBody
+	MaxMetadataBodySize int64
+	MaxUserdataBodySize int64
+	MaxBatchBodySize    int64
+	FetchRecorder       *lastfetch.Recorder
+	ETags               bool
+	InstanceIDFormat    *InstanceIDFormat
+	MaxInstances        int64
+	StableInstanceID    bool
+	StableIDBySourceIP  bool
+	BootstrapTokens     bool
+	MetadataHistory     bool
+	MetadataSchema      *metadataschema.Validator
+	UpsertRetryAfter    time.Duration
+	ForwardedForPolicy  middleware.ForwardedForPolicy
+	TrustedProxies      []*net.IPNet
+	StaleCache          *stalecache.Cache
+	ReadCache           *readcache.Cache
+	ReadRateLimiter     *ratelimit.Limiter
+	Events              *events.Publisher
+	PreWriteHook        *prewrite.Hook
+	RejectIPConflicts   bool
+	IPlessPolicy        IPlessPolicy
+	ProvisioningMarker  bool
+	ReadOnly            *readonly.Mode
+	SessionTokens       *sessiontoken.Issuer
+	RequireSessionToken bool
+	Timeouts            RouteTimeouts
+	InstanceAuth        InstanceAuthConfig
+	UnixSocket          UnixSocketIdentity
+	IdempotencyKeys     bool
+	IdempotencyTTL      time.Duration
+	ValidateIgnition    bool
+	DefaultMetadata     *DefaultMetadata
+
+	// InstanceDataPublicFields are the top-level metadata fields included
+	// unredacted in instance-data.json. When nil,
+	// DefaultInstanceDataPublicFields is used.
+	InstanceDataPublicFields []string
+
+	// validate validates request bodies, checking instance IDs against the
+	// InstanceIDFormat. It's set up by Routes.
+	validate *validator.Validate
 }
 
 // Routes will add the routes for this API version to a router group
 func (r *Router) Routes(rg *gin.RouterGroup) {
-	setupValidator()
+	r.validate = newValidator(r.InstanceIDFormat)
+
+	reads := rg.Group("", middleware.Timeout(r.Timeouts.Read))
+	writes := rg.Group("", middleware.Timeout(r.Timeouts.Write), r.rejectInReadOnly())
+	admin := rg.Group("", middleware.Timeout(r.Timeouts.Admin))
 
-	rg.GET(MetadataURI, middleware.IdentifyInstanceByIP(r.Logger, r.DB), r.instanceMetadataGet)
-	rg.GET(UserdataURI, middleware.IdentifyInstanceByIP(r.Logger, r.DB), r.instanceUserdataGet)
+	// The internal (authenticated) routes below are always mounted, only the
+	// instance-facing routes are part of the native datasource
+	if r.Datasources.Enabled(DatasourceNative) {
+		instance := reads.Group("", r.requireSessionToken())
+
+		instance.GET(MetadataURI, r.identifyInstance(InstanceAuthRouteMetadata), r.requireBootstrapToken(), r.instanceMetadataGet)
+		instance.GET(MetadataNetworkInterfaceURI, r.identifyInstance(InstanceAuthRouteMetadata), r.requireBootstrapToken(), r.instanceNetworkInterfaceGet)
+		instance.GET(MetadataInstanceIDURI, r.identifyInstance(InstanceAuthRouteMetadata), r.requireBootstrapToken(), r.instanceIDGet)
+
+		if r.ProvisioningMarker {
+			instance.GET(MetadataProvisioningURI, r.identifyInstance(InstanceAuthRouteMetadata), r.requireBootstrapToken(), r.instanceMetadataProvisioningGet)
+		}
+
+		instance.GET(UserdataURI, r.identifyInstance(InstanceAuthRouteUserdata), r.requireBootstrapToken(), r.instanceUserdataGet)
+		instance.GET(BootConfigURI, r.identifyInstance(InstanceAuthRouteBootConfig), r.requireBootstrapToken(), r.instanceBootConfigGet)
+		instance.GET(InstanceDataURI, r.identifyInstance(InstanceAuthRouteInstanceData), r.requireBootstrapToken(), r.instanceDataGet(false))
+		instance.GET(InstanceDataSensitiveURI, r.identifyInstance(InstanceAuthRouteInstanceData), r.requireBootstrapToken(), r.instanceDataGet(true))
+	}
 
 	authMw := r.AuthMW
-	rg.POST(InternalMetadataURI, authMw.AuthRequired(), authMw.RequiredScopes(upsertScopes("metadata")), r.instanceMetadataSet)
-	rg.POST(InternalUserdataURI, authMw.AuthRequired(), authMw.RequiredScopes(upsertScopes("userdata")), r.instanceUserdataSet)
+	writes.POST(InternalMetadataURI, authMw.AuthRequired(), authMw.RequiredScopes(upsertScopes("metadata")), r.idempotent(r.MaxMetadataBodySize), r.instanceMetadataSet)
+	// Validation doesn't store anything, so it's still served in read-only mode
+	reads.POST(InternalMetadataValidateURI, authMw.AuthRequired(), authMw.RequiredScopes(upsertScopes("metadata")), r.instanceMetadataValidate)
+	writes.POST(InternalUserdataURI, authMw.AuthRequired(), authMw.RequiredScopes(upsertScopes("userdata")), r.idempotent(r.MaxUserdataBodySize), r.instanceUserdataSet)
+
+	reads.HEAD(InternalMetadataWithIDURI, authMw.AuthRequired(), authMw.RequiredScopes(readScopes("metadata")), r.instanceMetadataExistsInternal)
+	reads.HEAD(InternalUserdataWithIDURI, authMw.AuthRequired(), authMw.RequiredScopes(readScopes("userdata")), r.instanceUserdataExistsInternal)
+
+	reads.GET(InternalMetadataWithIDURI, authMw.AuthRequired(), authMw.RequiredScopes(readScopes("metadata")), r.instanceMetadataGetInternal)
+	reads.GET(InternalUserdataWithIDURI, authMw.AuthRequired(), authMw.RequiredScopes(readScopes("userdata")), r.instanceUserdataGetInternal)
+	writes.PATCH(InternalMetadataWithIDURI, authMw.AuthRequired(), authMw.RequiredScopes(upsertScopes("metadata")), r.idempotent(r.MaxMetadataBodySize), r.instanceMetadataPatch)
+	writes.DELETE(InternalMetadataWithIDURI, authMw.AuthRequired(), authMw.RequiredScopes(deleteScopes("metadata")), r.instanceMetadataDelete)
+	writes.DELETE(InternalUserdataWithIDURI, authMw.AuthRequired(), authMw.RequiredScopes(deleteScopes("userdata")), r.instanceUserdataDelete)
+	writes.DELETE(InternalInstanceWithIDURI, authMw.AuthRequired(), authMw.RequiredScopes(deleteScopes("metadata")), authMw.RequiredScopes(deleteScopes("userdata")), r.instanceDelete)
+
+	reads.GET(InternalInstanceStatusURI, authMw.AuthRequired(), authMw.RequiredScopes(readScopes("metadata")), r.instanceStatusGet)
+	admin.GET(InternalInstancesURI, authMw.AuthRequired(), authMw.RequiredScopes([]string{instanceListScope}), r.instanceList)
+	admin.GET(InternalExportURI, authMw.AuthRequired(), authMw.RequiredScopes(readScopes("metadata")), authMw.RequiredScopes(readScopes("userdata")), r.instanceExport)
+
+	admin.POST(InternalReassociateIPsURI, authMw.AuthRequired(), authMw.RequiredScopes(upsertScopes("metadata")), r.rejectInReadOnly(), r.reassociateIPsAll)
+	writes.POST(InternalReassociateIPsWithIDURI, authMw.AuthRequired(), authMw.RequiredScopes(upsertScopes("metadata")), r.reassociateIPs)
+
+	writes.POST(InternalInstanceIPAddressesURI, authMw.AuthRequired(), authMw.RequiredScopes(upsertScopes("ip-addresses")), r.instanceIPAddressesAdd)
+	writes.DELETE(InternalInstanceIPAddressesURI, authMw.AuthRequired(), authMw.RequiredScopes(deleteScopes("ip-addresses")), r.instanceIPAddressesRemove)
+
+	admin.POST(InternalCacheInvalidateURI, authMw.AuthRequired(), authMw.RequiredScopes(upsertScopes("metadata")), r.instanceCacheInvalidate)
+
+	admin.POST(InternalBatchURI, authMw.AuthRequired(), authMw.RequiredScopes(upsertScopes("metadata")), authMw.RequiredScopes(upsertScopes("userdata")), r.rejectInReadOnly(), r.idempotent(r.MaxBatchBodySize), r.instanceBatchSet)
+	writes.POST(InternalIPAddressesURI, authMw.AuthRequired(), authMw.RequiredScopes(upsertScopes("ip-addresses")), r.instanceIPAddressesSet)
+	reads.GET(InternalInstanceByIPURI, authMw.AuthRequired(), authMw.RequiredScopes([]string{ipLookupScope}), r.instanceByIPGet)
+	reads.GET(InternalPublicKeysURI, authMw.AuthRequired(), authMw.RequiredScopes(readScopes("metadata")), r.instancePublicKeysGet)
+	writes.POST(InternalPublicKeysURI, authMw.AuthRequired(), authMw.RequiredScopes(upsertScopes("metadata")), r.instancePublicKeysSet)
+	reads.GET(InternalTagsURI, authMw.AuthRequired(), authMw.RequiredScopes(readScopes("metadata")), r.instanceTagsGet)
+	writes.POST(InternalTagsURI, authMw.AuthRequired(), authMw.RequiredScopes(upsertScopes("metadata")), r.instanceTagsSet)
+
+	if r.MetadataHistory {
+		reads.GET(InternalMetadataHistoryURI, authMw.AuthRequired(), authMw.RequiredScopes(readScopes("metadata")), r.instanceMetadataHistoryGet)
+	}
+
+	if r.BootstrapTokens {
+		writes.POST(InternalBootstrapTokenURI, authMw.AuthRequired(), authMw.RequiredScopes(upsertScopes("bootstrap-token")), r.instanceBootstrapTokenSet)
+	}
+}
+
+// findMetadata fetches the instance_metadata row for the given instance ID,
+// serving recent reads from the read cache and coalescing concurrent reads for
+// the same ID when enabled.
+func (r *Router) findMetadata(c *gin.Context, instanceID string) (*models.InstanceMetadatum, error) {
+	key := "metadata:" + instanceID
+
+	if v, ok := r.ReadCache.Get(key); ok {
+		return v.(*models.InstanceMetadatum), nil
+	}
+
+	v, err, shared := r.Coalescer.Do(c.Request.Context(), key, func(ctx context.Context) (interface{}, error) {
+		return models.FindInstanceMetadatum(ctx, r.DB, instanceID)
+	})
+
+	if shared {
+		middleware.MetricReadsCoalesced.Inc()
+	}
+
+	if err == nil {
+		r.ReadCache.Add(key, v)
+	}
+
+	v, err = r.staleFallback(key, v, err)
+
+	metadata, _ := v.(*models.InstanceMetadatum)
+
+	return metadata, err
+}
+
+// findUserdata fetches the instance_userdata row for the given instance ID,
+// serving recent reads from the read cache and coalescing concurrent reads for
+// the same ID when enabled.
+func (r *Router) findUserdata(c *gin.Context, instanceID string) (*models.InstanceUserdatum, error) {
+	key := "userdata:" + instanceID
+
+	if v, ok := r.ReadCache.Get(key); ok {
+		return v.(*models.InstanceUserdatum), nil
+	}
+
+	v, err, shared := r.Coalescer.Do(c.Request.Context(), key, func(ctx context.Context) (interface{}, error) {
+		return r.findDecodedUserdata(ctx, instanceID)
+	})
+
+	if shared {
+		middleware.MetricReadsCoalesced.Inc()
+	}
+
+	if err == nil {
+		r.ReadCache.Add(key, v)
+	}
+
+	v, err = r.staleFallback(key, v, err)
+
+	userdata, _ := v.(*models.InstanceUserdatum)
+
+	return userdata, err
+}
+
+// findTags fetches the tags attached to the given instance ID, serving recent
+// reads from the read cache and coalescing concurrent reads for the same ID
+// when enabled, like its metadata.
+func (r *Router) findTags(c *gin.Context, instanceID string) (*instanceTags, error) {
+	key := "tags:" + instanceID
+
+	if v, ok := r.ReadCache.Get(key); ok {
+		return v.(*instanceTags), nil
+	}
+
+	v, err, shared := r.Coalescer.Do(c.Request.Context(), key, func(ctx context.Context) (interface{}, error) {
+		tags, updated, err := instancetags.List(ctx, r.DB, instanceID)
+		if err != nil {
+			return nil, err
+		}
 
-	rg.HEAD(InternalMetadataWithIDURI, authMw.AuthRequired(), authMw.RequiredScopes(readScopes("metadata")), r.instanceMetadataExistsInternal)
-	rg.HEAD(InternalUserdataWithIDURI, authMw.AuthRequired(), authMw.RequiredScopes(readScopes("userdata")), r.instanceUserdataExistsInternal)
+		return &instanceTags{Tags: tags, UpdatedAt: updated}, nil
+	})
+
+	if shared {
+		middleware.MetricReadsCoalesced.Inc()
+	}
+
+	if err == nil {
+		r.ReadCache.Add(key, v)
+	}
+
+	v, err = r.staleFallback(key, v, err)
+
+	tags, _ := v.(*instanceTags)
+
+	return tags, err
+}
+
+// staleFallback keeps the stale cache up to date with the result of a database
+// read, and serves the cached value instead when the read failed. Data which
+// no longer exists is removed from the cache.
+func (r *Router) staleFallback(key string, v interface{}, err error) (interface{}, error) {
+	switch {
+	case err == nil:
+		r.StaleCache.Store(key, v)
+	case errors.Is(err, sql.ErrNoRows):
+		r.StaleCache.Forget(key)
+	default:
+		return r.StaleCache.Fallback(key, err)
+	}
 
-	rg.GET(InternalMetadataWithIDURI, authMw.AuthRequired(), authMw.RequiredScopes(readScopes("metadata")), r.instanceMetadataGetInternal)
-	rg.GET(InternalUserdataWithIDURI, authMw.AuthRequired(), authMw.RequiredScopes(readScopes("userdata")), r.instanceUserdataGetInternal)
-	rg.DELETE(InternalMetadataWithIDURI, authMw.AuthRequired(), authMw.RequiredScopes(deleteScopes("metadata")), r.instanceMetadataDelete)
-	rg.DELETE(InternalUserdataWithIDURI, authMw.AuthRequired(), authMw.RequiredScopes(deleteScopes("userdata")), r.instanceUserdataDelete)
+	return v, err
 }
 
-func (r *Router) getMetadata(c *gin.Context) (*models.InstanceMetadatum, error) {
+func (r *Router) getMetadata(c *gin.Context) (metadata *models.InstanceMetadatum, err error) {
+	// Note the successful fetches, when enabled, for auditing which host
+	// fetched which instance's metadata.
+	defer func() {
+		if err == nil && metadata != nil {
+			r.FetchRecorder.Record(metadata.ID, c.GetString(middleware.ContextKeyRequestorIP))
+		}
+	}()
+
 	instanceID := c.GetString(middleware.ContextKeyInstanceID)
 
 	if instanceID == "" {
@@ -122,7 +499,7 @@ func (r *Router) getMetadata(c *gin.Context) (*models.InstanceMetadatum, error)
 
 	// We got an instance ID from the middleware, either because we could match
 	// the request IP to an ID, or the request itself provided the instance ID.
-	metadata, err := models.FindInstanceMetadatum(c.Request.Context(), r.DB, instanceID)
+	metadata, err = r.findMetadata(c, instanceID)
 
 	if err != nil && errors.Is(err, sql.ErrNoRows) {
 		// We couldn't find an instance_metadata row for this instance ID. Try
@@ -170,7 +547,7 @@ func (r *Router) getUserdata(c *gin.Context) (*models.InstanceUserdatum, error)
 
 	// We got an instance ID from the middleware, either because we could match
 	// the request IP to an ID, or the request itself provided the instance ID.
-	userdata, err := models.FindInstanceUserdatum(c.Request.Context(), r.DB, instanceID)
+	userdata, err := r.findUserdata(c, instanceID)
 
 	if err != nil && errors.Is(err, sql.ErrNoRows) {
 		// We couldn't find an instance_metadata row for this instance ID. Try
@@ -197,17 +574,59 @@ func GetMetadataPath() string {
 	return path.Join(V1URI, MetadataURI)
 }
 
+// GetMetadataProvisioningPath returns the path used by an instance to fetch
+// Metadata, or a marker if it hasn't been provisioned yet
+func GetMetadataProvisioningPath() string {
+	return path.Join(V1URI, MetadataProvisioningURI)
+}
+
+// GetMetadataInstanceIDPath returns the path used by an instance to fetch only
+// its instance ID
+func GetMetadataInstanceIDPath() string {
+	return path.Join(V1URI, MetadataInstanceIDURI)
+}
+
+// GetMetadataNetworkInterfacePath returns the path used by an instance to fetch
+// the network metadata for the interface it made the request from
+func GetMetadataNetworkInterfacePath() string {
+	return path.Join(V1URI, MetadataNetworkInterfaceURI)
+}
+
 // GetUserdataPath returns the path used by an instance to fetch Userdata
 func GetUserdataPath() string {
 	return path.Join(V1URI, UserdataURI)
 }
 
+// GetBootConfigPath returns the path used by an instance to fetch its
+// consolidated boot-config document
+func GetBootConfigPath() string {
+	return path.Join(V1URI, BootConfigURI)
+}
+
+// GetInstanceDataPath returns the path used by an instance to fetch its
+// instance-data.json document
+func GetInstanceDataPath() string {
+	return path.Join(V1URI, InstanceDataURI)
+}
+
+// GetInstanceDataSensitivePath returns the path used by an instance to fetch
+// its instance-data-sensitive.json document
+func GetInstanceDataSensitivePath() string {
+	return path.Join(V1URI, InstanceDataSensitiveURI)
+}
+
 // GetInternalMetadataPath returns the path used by an internal, authenticated
 // system or used to update or retrieve metadata.
 func GetInternalMetadataPath() string {
 	return path.Join(V1URI, InternalMetadataURI)
 }
 
+// GetInternalMetadataValidatePath returns the path used by an internal,
+// authenticated system or user to check metadata without storing it.
+func GetInternalMetadataValidatePath() string {
+	return path.Join(V1URI, InternalMetadataValidateURI)
+}
+
 // GetInternalMetadataByIDPath returns the path used by an internal,
 // authenticated system or user to retrieve the metadata for a specific
 // instance.
@@ -228,6 +647,104 @@ func GetInternalUserdataByIDPath(id string) string {
 	return path.Join(V1URI, InternalUserdataURI, id)
 }
 
+// GetInternalInstanceByIDPath returns the path used by an internal,
+// authenticated system or user to delete everything stored for a specific
+// instance.
+func GetInternalInstanceByIDPath(id string) string {
+	return path.Join(V1URI, "device", id)
+}
+
+// GetInternalInstanceStatusPath returns the path used by an internal,
+// authenticated system or user to check whether the data for a specific
+// instance has been stored.
+func GetInternalInstanceStatusPath(id string) string {
+	return path.Join(V1URI, "device", id, "status")
+}
+
+// GetInternalInstancesPath returns the path used by an internal,
+// authenticated operator to page through the instances with stored metadata.
+func GetInternalInstancesPath() string {
+	return path.Join(V1URI, InternalInstancesURI)
+}
+
+// GetInternalExportPath returns the path used by an internal, authenticated
+// system or user to stream a bulk export of the stored instance data.
+func GetInternalExportPath() string {
+	return path.Join(V1URI, InternalExportURI)
+}
+
+// GetInternalReassociateIPsPath returns the path used by an internal,
+// authenticated system or user to re-derive the IP address associations for
+// all instances from their stored metadata.
+func GetInternalReassociateIPsPath() string {
+	return path.Join(V1URI, InternalReassociateIPsURI)
+}
+
+// GetInternalReassociateIPsByIDPath returns the path used by an internal,
+// authenticated system or user to re-derive the IP address associations for
+// a specific instance from its stored metadata.
+func GetInternalReassociateIPsByIDPath(id string) string {
+	return path.Join(V1URI, InternalMetadataURI, id, "reassociate-ips")
+}
+
+// GetInternalBatchPath returns the path used by an internal, authenticated
+// system to upsert the metadata and/or userdata of a batch of instances
+func GetInternalBatchPath() string {
+	return path.Join(V1URI, InternalBatchURI)
+}
+
+// GetInternalInstanceIPAddressesPath returns the path used by an internal,
+// authenticated user to add IP addresses to, or remove them from, a single
+// instance
+func GetInternalInstanceIPAddressesPath(id string) string {
+	return path.Join(V1URI, InternalMetadataURI, id, "ip-addresses")
+}
+
+// GetInternalIPAddressesPath returns the path used by an internal,
+// authenticated system to bulk-load IP address associations
+func GetInternalIPAddressesPath() string {
+	return path.Join(V1URI, InternalIPAddressesURI)
+}
+
+// GetInternalInstanceByIPPath returns the path used by an internal,
+// authenticated operator to look up which instance an IP address is
+// associated to
+func GetInternalInstanceByIPPath(ip string) string {
+	return path.Join(V1URI, InternalIPAddressesURI, ip)
+}
+
+// GetInternalBootstrapTokenPath returns the path used by an internal,
+// authenticated system to issue or rotate the bootstrap token for an instance
+func GetInternalBootstrapTokenPath(id string) string {
+	return path.Join(V1URI, InternalMetadataURI, id, "bootstrap-token")
+}
+
+// GetInternalMetadataHistoryPath returns the path used by an internal,
+// authenticated system to fetch the previous versions of an instance's metadata
+func GetInternalMetadataHistoryPath(id string) string {
+	return path.Join(V1URI, InternalMetadataURI, id, "history")
+}
+
+// GetInternalPublicKeysPath returns the path used by an internal,
+// authenticated system to fetch or replace the SSH public keys stored for an
+// instance
+func GetInternalPublicKeysPath(id string) string {
+	return path.Join(V1URI, InternalMetadataURI, id, "public-keys")
+}
+
+// GetInternalTagsPath returns the path used by an internal, authenticated
+// system to fetch or replace the tags attached to an instance
+func GetInternalTagsPath(id string) string {
+	return path.Join(V1URI, InternalMetadataURI, id, "tags")
+}
+
+// GetInternalCacheInvalidatePath returns the path used by an internal,
+// authenticated operator to evict everything the read cache holds for an
+// instance
+func GetInternalCacheInvalidatePath(id string) string {
+	return path.Join(V1URI, InternalMetadataURI, id, "cache", "invalidate")
+}
+
 func upsertScopes(items ...string) []string {
 	s := []string{"write", "create", "update"}
 	for _, i := range items {
@@ -241,6 +758,61 @@ func upsertScopes(items ...string) []string {
 	return s
 }
 
+// getPruneParam reads the prune query param, which defaults to true
+func getPruneParam(c *gin.Context) (bool, error) {
+	return getBoolParam(c, pruneParam, true)
+}
+
+// getPatchPruneParam reads the prune query param of a metadata patch, which
+// defaults to false, so a patch which doesn't touch network.addresses leaves
+// the instance's other IP address associations alone
+func getPatchPruneParam(c *gin.Context) (bool, error) {
+	return getBoolParam(c, pruneParam, false)
+}
+
+// getDryRunParam reads the dry_run query param, which defaults to false
+func getDryRunParam(c *gin.Context) (bool, error) {
+	return getBoolParam(c, dryRunParam, false)
+}
+
+// getBoolParam reads a boolean query param, returning def when it isn't given
+func getBoolParam(c *gin.Context, name string, def bool) (bool, error) {
+	param := c.Query(name)
+	if param == "" {
+		return def, nil
+	}
+
+	value, err := strconv.ParseBool(param)
+	if err != nil {
+		return false, fmt.Errorf("%w: %s must be true or false", ErrInvalidParam, name)
+	}
+
+	return value, nil
+}
+
+// getFieldsParam returns the top-level metadata fields requested with the
+// fields param, or nil when the full document should be served.
+func getFieldsParam(c *gin.Context) []string {
+	var fields []string
+
+	for _, field := range strings.Split(c.Query(fieldsParam), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+
+	return fields
+}
+
+// limitRequestBody caps the number of bytes which will be read from the
+// request body, so an oversized body is rejected while it's being read rather
+// than after it has been fully buffered. A limit of 0 disables the cap.
+func limitRequestBody(c *gin.Context, limit int64) {
+	if limit > 0 {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+	}
+}
+
 func readScopes(items ...string) []string {
 	s := []string{"read"}
 	for _, i := range items {
@@ -259,8 +831,22 @@ func deleteScopes(items ...string) []string {
 	return s
 }
 
-func setupValidator() {
-	validate = validator.New()
+// newValidator returns the validator for request bodies, with instance IDs
+// checked against idFormat
+func newValidator(idFormat *InstanceIDFormat) *validator.Validate {
+	validate := validator.New()
+
+	// Instance IDs are validated against the configured format. The tag is an
+	// alias, so a failure reports the format the ID didn't match.
+	if idFormat.Name() == InstanceIDFormatRegex {
+		_ = validate.RegisterValidation(InstanceIDFormatRegex, func(fl validator.FieldLevel) bool {
+			return idFormat.pattern.MatchString(fl.Field().String())
+		})
+
+		validate.RegisterAlias(instanceIDValidationTag, InstanceIDFormatUUID+","+InstanceIDFormatRegex)
+	} else {
+		validate.RegisterAlias(instanceIDValidationTag, InstanceIDFormatUUID)
+	}
 
 	splitSliceNum := 2
 
@@ -272,17 +858,20 @@ func setupValidator() {
 		}
 		return name
 	})
+
+	return validate
 }
 
-// getUUIDParam parses and validates a UUID from the request params if the param is found
-func getUUIDParam(c *gin.Context, name string) (string, error) {
+// getInstanceIDParam validates an instance ID from the request params, against
+// the configured instance ID format, if the param is found
+func (r *Router) getInstanceIDParam(c *gin.Context, name string) (string, error) {
 	id, ok := c.Params.Get(name)
 
 	if !ok || id == "" {
 		return "", ErrUUIDNotFound
 	}
 
-	if _, err := uuid.Parse(id); err != nil {
+	if !r.InstanceIDFormat.Valid(id) {
 		return "", ErrInvalidUUID
 	}
 
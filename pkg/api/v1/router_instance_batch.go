@@ -0,0 +1,280 @@
+package metadataservice
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/volatiletech/null/v8"
+	"github.com/volatiletech/sqlboiler/v4/types"
+	"go.hollow.sh/toolbox/ginjwt"
+
+	"go.hollow.sh/metadataservice/internal/instancetags"
+	"go.hollow.sh/metadataservice/internal/models"
+	"go.hollow.sh/metadataservice/internal/prewrite"
+	"go.hollow.sh/metadataservice/internal/publickeys"
+	"go.hollow.sh/metadataservice/internal/upserter"
+	"go.hollow.sh/metadataservice/internal/userdata"
+)
+
+// maxUpsertBatchSize is the maximum number of instances which can be upserted
+// in a single batch request
+const maxUpsertBatchSize = 500
+
+// BatchUpsertRequest contains the data to upsert for a single instance in a
+// batch request. Metadata and userdata use the same formats as in
+// UpsertMetadataRequest and UpsertUserdataRequest, and are each only upserted
+// when given.
+type BatchUpsertRequest struct {
+	ID          string   `json:"id" validate:"required,instance_id"`
+	IPAddresses []string `json:"ipAddresses" validate:"dive,ip_addr|cidr"`
+	Metadata    string   `json:"metadata,omitempty" validate:"omitempty,json"`
+	Userdata    []byte   `json:"userdata,omitempty"`
+	Encoding    string   `json:"encoding,omitempty" validate:"omitempty,oneof=raw base64"`
+
+	// PublicKeys, when given, replaces the instance's SSH public keys along
+	// with its metadata, as in UpsertMetadataRequest
+	PublicKeys []publickeys.Key `json:"public_keys,omitempty"`
+
+	// Tags, when given, replaces the instance's tags along with its metadata,
+	// as in UpsertMetadataRequest
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+func (request *BatchUpsertRequest) validate(v *validator.Validate) error {
+	if err := v.Struct(request); err != nil {
+		return err
+	}
+
+	if request.Metadata == "" && request.Userdata == nil {
+		return errEmptyBatchItem
+	}
+
+	if request.PublicKeys != nil && request.Metadata == "" {
+		return errPublicKeysWithoutMetadata
+	}
+
+	if request.Tags != nil && request.Metadata == "" {
+		return errTagsWithoutMetadata
+	}
+
+	if err := publickeys.Validate(request.PublicKeys); err != nil {
+		return err
+	}
+
+	if err := instancetags.Validate(request.Tags); err != nil {
+		return err
+	}
+
+	if request.Userdata == nil {
+		return nil
+	}
+
+	// Make sure stored userdata can always be decoded when it's served
+	_, err := userdata.Decode(request.Userdata, request.Encoding)
+
+	return err
+}
+
+// BatchUpsertResponse is returned by the batch upsert endpoint, and describes
+// the outcome for each instance in the request, in order.
+type BatchUpsertResponse struct {
+	Results []BatchUpsertResult `json:"results"`
+}
+
+// BatchUpsertResult describes the outcome of upserting a single instance in a
+// batch request. Error is set when nothing was written for the instance.
+type BatchUpsertResult struct {
+	ID        string                     `json:"id"`
+	Changes   *upserter.IPAddressChanges `json:"changes,omitempty"`
+	Error     string                     `json:"error,omitempty"`
+	Conflicts []upserter.IPConflict      `json:"conflicts,omitempty"`
+}
+
+// instanceBatchSet upserts the metadata and/or userdata for a batch of
+// instances. Each instance goes through the same checks as a single upsert
+// (instance quota, pre-write hook and IP-less policy), and the instances
+// passing them are written in a bounded number of transactions rather than
+// one per instance, in the order given. One instance failing doesn't stop the
+// others from being written, the response reports the outcome for each one.
+//
+// By default each instance's associations are replaced by the addresses in the
+// request. With prune=false, addresses are only added.
+func (r *Router) instanceBatchSet(c *gin.Context) {
+	prune, err := getPruneParam(c)
+	if err != nil {
+		badRequestResponse(c, err.Error(), err)
+		return
+	}
+
+	params := []BatchUpsertRequest{}
+
+	limitRequestBody(c, r.MaxBatchBodySize)
+
+	if err := c.ShouldBindJSON(&params); err != nil {
+		requestBodyErrorResponse(c, err)
+		return
+	}
+
+	if len(params) > maxUpsertBatchSize {
+		err := fmt.Errorf("%w: at most %d instances can be upserted at once", errBatchTooLarge, maxUpsertBatchSize)
+		badRequestResponse(c, err.Error(), err)
+
+		return
+	}
+
+	for i := range params {
+		if err := params[i].validate(r.validate); err != nil {
+			badRequestResponse(c, "invalid request", err)
+			return
+		}
+
+		if err := r.validateIgnitionUserdata(params[i].Userdata, params[i].Encoding); err != nil {
+			badRequestResponse(c, "invalid request", err)
+			return
+		}
+	}
+
+	resp := &BatchUpsertResponse{Results: make([]BatchUpsertResult, len(params))}
+
+	var (
+		items        []upserter.BatchItem
+		itemResults  []int
+		newInstances int64
+	)
+
+	for i, param := range params {
+		resp.Results[i].ID = param.ID
+
+		item, isNew, err := r.batchItem(c, param, prune, newInstances)
+		if err != nil {
+			resp.Results[i].Error = err.Error()
+			continue
+		}
+
+		if isNew {
+			newInstances++
+		}
+
+		items = append(items, item)
+		itemResults = append(itemResults, i)
+	}
+
+	results := upserter.UpsertBatch(c.Request.Context(), r.DB, r.Logger, items, upserter.UpsertOptions{KeepStaleIPs: !prune, RejectConflicts: r.RejectIPConflicts, Events: r.Events, RecordHistory: r.MetadataHistory, ChangedBy: ginjwt.GetSubject(c)})
+
+	for i, result := range results {
+		item := items[i]
+		resp.Results[itemResults[i]] = r.batchUpsertResult(item, result)
+
+		ipAddresses := item.IPAddresses
+		if item.Metadata != nil {
+			ipAddresses = append(ipAddresses, upserter.ExtractIPAddressesFromMetadata(item.Metadata)...)
+		}
+
+		r.invalidateReadCache(item.ID, ipAddresses)
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// batchItem runs the checks made before a single upsert for an instance in a
+// batch request, and returns the item to upsert. pending is the number of new
+// instances already accepted from the batch, which count towards the instance
+// quota. It reports whether the instance would be a new one.
+func (r *Router) batchItem(c *gin.Context, param BatchUpsertRequest, prune bool, pending int64) (upserter.BatchItem, bool, error) {
+	item := upserter.BatchItem{
+		ID:               param.ID,
+		IPAddresses:      param.IPAddresses,
+		UserdataEncoding: param.Encoding,
+		PublicKeys:       param.PublicKeys,
+		Tags:             param.Tags,
+	}
+
+	if param.Metadata != "" {
+		if err := r.MetadataSchema.Validate([]byte(param.Metadata)); err != nil {
+			return item, false, err
+		}
+	}
+
+	isNew, err := r.checkInstanceQuota(c.Request.Context(), param.ID, pending)
+
+	switch {
+	case errors.Is(err, errInstanceQuotaExceeded):
+		return item, false, fmt.Errorf("%w: the maximum of %d instances has been reached", err, r.MaxInstances)
+	case err != nil:
+		r.Logger.Sugar().Warn("Unable to check the instance quota for instance: ", param.ID, " Error: ", err)
+
+		return item, false, errBatchItemInternal
+	}
+
+	var changes []prewrite.Change
+
+	if param.Metadata != "" {
+		if r.StableInstanceID {
+			if metadataID, mismatch := metadataIDMismatch(param.ID, param.Metadata); mismatch {
+				r.Logger.Sugar().Warn("Metadata for instance ", param.ID, " has an id of ", metadataID, ", the instance id will be served instead")
+			}
+		}
+
+		item.Metadata = &models.InstanceMetadatum{
+			ID:       param.ID,
+			Metadata: types.JSON(param.Metadata),
+		}
+
+		changes = append(changes, prewrite.Change{Kind: prewrite.KindMetadata, ID: param.ID, IPAddresses: param.IPAddresses, Metadata: json.RawMessage(param.Metadata)})
+	}
+
+	if param.Userdata != nil {
+		item.Userdata = &models.InstanceUserdatum{
+			ID:       param.ID,
+			Userdata: null.NewBytes(param.Userdata, true),
+		}
+
+		changes = append(changes, prewrite.Change{Kind: prewrite.KindUserdata, ID: param.ID, IPAddresses: param.IPAddresses})
+	}
+
+	for _, change := range changes {
+		if err := r.PreWriteHook.Check(c.Request.Context(), change); err != nil {
+			r.Logger.Sugar().Warn("Pre-write hook didn't approve ", change.Kind, " change for instance: ", param.ID, " Error: ", err)
+
+			if errors.Is(err, prewrite.ErrRejected) {
+				return item, false, err
+			}
+
+			return item, false, errBatchItemUnavailable
+		}
+	}
+
+	if item.Metadata != nil {
+		if err := r.checkIPless(param.IPAddresses, item.Metadata, prune); err != nil {
+			return item, false, err
+		}
+	}
+
+	return item, isNew, nil
+}
+
+// batchUpsertResult converts the outcome of upserting a batch item into its
+// result in the response
+func (r *Router) batchUpsertResult(item upserter.BatchItem, result upserter.BatchResult) BatchUpsertResult {
+	resp := BatchUpsertResult{ID: item.ID}
+
+	var conflictErr *upserter.ConflictError
+
+	switch {
+	case errors.As(result.Err, &conflictErr):
+		resp.Error = "ip addresses are associated to other instances"
+		resp.Conflicts = conflictErr.Conflicts
+	case result.Err != nil:
+		r.Logger.Sugar().Warn("Unable to upsert batch item for instance: ", item.ID, " Error: ", result.Err)
+
+		resp.Error = errBatchItemInternal.Error()
+	default:
+		resp.Changes = result.Changes
+	}
+
+	return resp
+}
@@ -0,0 +1,143 @@
+package metadataservice_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	"go.hollow.sh/metadataservice/internal/models"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func postBatch(t *testing.T, router http.Handler, request []v1api.BatchUpsertRequest) *v1api.BatchUpsertResponse {
+	reqBody, err := json.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalBatchPath(), bytes.NewReader(reqBody))
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var resp v1api.BatchUpsertResponse
+
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	return &resp
+}
+
+func TestBatchUpsert(t *testing.T) {
+	router := *testHTTPServer(t)
+	testDB := dbtools.TestDB()
+
+	bothID := "0f3f4c4e-5d7e-4b8b-9b1f-4d2a6c1e8a10"
+	metadataID := "1e8b5c2a-3f4d-4a6e-8c7b-9d0e1f2a3b40"
+
+	resp := postBatch(t, router, []v1api.BatchUpsertRequest{
+		{ID: bothID, IPAddresses: []string{"10.98.1.1"}, Metadata: `{"hostname":"both"}`, Userdata: []byte("#!/bin/sh")},
+		{ID: metadataID, IPAddresses: []string{"10.98.1.2"}, Metadata: `{"hostname":"metadata-only"}`},
+		// Claims the address of the first instance, which is allowed as
+		// conflicts aren't rejected
+		{ID: dbtools.FixtureInstanceA.InstanceID, IPAddresses: []string{"10.98.1.1"}, Userdata: []byte("#cloud-config")},
+	})
+
+	assert.Len(t, resp.Results, 3)
+
+	for i, result := range resp.Results {
+		assert.Empty(t, result.Error, i)
+	}
+
+	assert.Equal(t, []string{"10.98.1.1"}, resp.Results[0].Changes.Added)
+	assert.Equal(t, "10.98.1.1", resp.Results[2].Changes.Reassigned[0].Address)
+	assert.Equal(t, bothID, resp.Results[2].Changes.Reassigned[0].PreviousInstanceID)
+
+	userdata, err := models.FindInstanceUserdatum(context.TODO(), testDB, bothID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "#!/bin/sh", string(userdata.Userdata.Bytes))
+
+	exists, err := models.InstanceUserdatumExists(context.TODO(), testDB, metadataID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.False(t, exists)
+}
+
+func TestBatchUpsertRejectedItems(t *testing.T) {
+	router := *testHTTPServerWithConfig(t, TestServerConfig{RejectConflicts: true, IPlessPolicy: v1api.IPlessReject})
+	testDB := dbtools.TestDB()
+
+	newID := "5a1f0b8e-6c2d-4e3f-9a7b-8c9d0e1f2a35"
+	iplessID := "7b2e1c9f-8d3e-4f5a-a6b7-c8d9e0f1a2b4"
+
+	resp := postBatch(t, router, []v1api.BatchUpsertRequest{
+		{ID: newID, IPAddresses: []string{dbtools.FixtureInstanceA.HostIPs[0]}, Metadata: `{"hostname":"conflict"}`},
+		{ID: iplessID, Metadata: `{"hostname":"ipless"}`},
+		{ID: dbtools.FixtureInstanceB.InstanceID, IPAddresses: []string{"10.98.2.1"}, Metadata: `{"hostname":"updated"}`},
+	})
+
+	assert.Len(t, resp.Results, 3)
+
+	assert.NotEmpty(t, resp.Results[0].Error)
+	assert.Equal(t, dbtools.FixtureInstanceA.InstanceID, resp.Results[0].Conflicts[0].InstanceID)
+	assert.NotEmpty(t, resp.Results[1].Error)
+	assert.Empty(t, resp.Results[2].Error)
+
+	for _, id := range []string{newID, iplessID} {
+		exists, err := models.InstanceMetadatumExists(context.TODO(), testDB, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.False(t, exists, id)
+	}
+}
+
+func TestBatchUpsertInvalidRequest(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	items := make([]string, 501)
+	for i := range items {
+		items[i] = fmt.Sprintf(`{"id":"27f7a3c5-0a3b-44e8-8a3e-6b1fa1a3f0d2","metadata":"{}","ipAddresses":["10.0.%d.%d"]}`, i/256, i%256)
+	}
+
+	testCases := []struct {
+		testName string
+		path     string
+		body     string
+	}{
+		{"invalid prune param", v1api.GetInternalBatchPath() + "?prune=maybe", `[]`},
+		{"invalid instance ID", v1api.GetInternalBatchPath(), `[{"id":"not-a-uuid","metadata":"{}"}]`},
+		{"invalid metadata", v1api.GetInternalBatchPath(), `[{"id":"27f7a3c5-0a3b-44e8-8a3e-6b1fa1a3f0d2","metadata":"nope"}]`},
+		{"no metadata or userdata", v1api.GetInternalBatchPath(), `[{"id":"27f7a3c5-0a3b-44e8-8a3e-6b1fa1a3f0d2","ipAddresses":["10.0.0.1"]}]`},
+		{"too many instances", v1api.GetInternalBatchPath(), "[" + strings.Join(items, ",") + "]"},
+		{"not a list", v1api.GetInternalBatchPath(), `{}`},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, testcase.path, bytes.NewReader([]byte(testcase.body)))
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+		})
+	}
+}
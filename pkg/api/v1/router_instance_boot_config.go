@@ -0,0 +1,84 @@
+package metadataservice
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/gin-gonic/gin"
+
+	"go.hollow.sh/metadataservice/internal/middleware"
+)
+
+// BootConfigResponse is the consolidated boot-config document, containing
+// everything an instance needs to bootstrap itself from a single request.
+type BootConfigResponse struct {
+	// Metadata is the instance metadata, as returned from the metadata
+	// endpoint
+	Metadata json.RawMessage `json:"metadata"`
+
+	// Userdata is the instance userdata, as returned from the userdata
+	// endpoint. It's omitted when the instance has no userdata.
+	Userdata []byte `json:"userdata,omitempty"`
+
+	// Network is the network config for the interface the request was made
+	// from, as returned from the network-interface endpoint. It's omitted when
+	// the interface can't be determined from the metadata.
+	Network *NetworkInterfaceResponse `json:"network,omitempty"`
+}
+
+// instanceBootConfigGet returns the metadata, userdata and network config for
+// the instance making the request in a single response, for clients which
+// would rather not make a request for each. The response always carries an
+// ETag covering all three, and is last modified when either the metadata or
+// userdata was.
+func (r *Router) instanceBootConfigGet(c *gin.Context) {
+	metadata, err := r.getMetadata(c)
+	if err != nil {
+		if errors.Is(err, errNotFound) {
+			notFoundResponse(c)
+		} else {
+			dbErrorResponse(r.Logger, c, err)
+		}
+
+		return
+	}
+
+	servedMetadata := r.servedMetadata(c, metadata)
+	resp := BootConfigResponse{Metadata: json.RawMessage(servedMetadata)}
+
+	if augmentedMetadata, err := r.withTemplateFields(servedMetadata, metadata.ID, c.GetString(middleware.ContextKeyRequestorIP)); err == nil {
+		if augmented, err := json.Marshal(augmentedMetadata); err == nil {
+			resp.Metadata = augmented
+		}
+	}
+
+	userdata, err := r.getUserdata(c)
+	if err != nil && !errors.Is(err, errNotFound) {
+		dbErrorResponse(r.Logger, c, err)
+		return
+	}
+
+	modified := metadata.UpdatedAt
+
+	if userdata != nil {
+		resp.Userdata = r.UserdataTransformer.Transform(userdata.Userdata.Bytes)
+
+		if userdata.UpdatedAt.After(modified) {
+			modified = userdata.UpdatedAt
+		}
+	}
+
+	var doc map[string]interface{}
+
+	if err := json.Unmarshal(r.visibleMetadata(c, metadata.Metadata), &doc); err == nil {
+		resp.Network, _ = networkInterfaceForAddress(doc, c.GetString(middleware.ContextKeyRequestorIP))
+	}
+
+	body, err := json.Marshal(resp)
+	if err != nil {
+		internalErrorResponse(c)
+		return
+	}
+
+	etagResponse(c, etagResourceBootConfig, contentTypeJSON, body, modified)
+}
@@ -0,0 +1,102 @@
+package metadataservice_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func TestGetBootConfigByIP(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	type testCase struct {
+		testName         string
+		instanceIP       string
+		expectedStatus   int
+		expectedMetadata string
+		expectedUserdata []byte
+		expectNetwork    bool
+	}
+
+	testCases := []testCase{
+		{
+			"unknown IPv4 address",
+			"1.2.3.4",
+			http.StatusNotFound,
+			"",
+			nil,
+			false,
+		},
+		{
+			"Instance A",
+			"139.178.82.3",
+			http.StatusOK,
+			dbtools.FixtureInstanceA.InstanceMetadata.Metadata.String(),
+			dbtools.FixtureInstanceA.InstanceUserdata.Userdata.Bytes,
+			true,
+		},
+		{
+			"Instance B, without userdata",
+			dbtools.FixtureInstanceB.HostIPs[0],
+			http.StatusOK,
+			dbtools.FixtureInstanceB.InstanceMetadata.Metadata.String(),
+			nil,
+			true,
+		},
+		{
+			"Instance E, without metadata",
+			dbtools.FixtureInstanceE.HostIPs[0],
+			http.StatusNotFound,
+			"",
+			nil,
+			false,
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetBootConfigPath(), nil)
+			req.RemoteAddr = net.JoinHostPort(testcase.instanceIP, "0")
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+
+			if testcase.expectedStatus != http.StatusOK {
+				return
+			}
+
+			var resp v1api.BootConfigResponse
+
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+
+			assert.JSONEq(t, testcase.expectedMetadata, string(resp.Metadata))
+			assert.Equal(t, testcase.expectedUserdata, resp.Userdata)
+			assert.Equal(t, testcase.expectNetwork, resp.Network != nil)
+
+			// The ETag covers the whole document
+			etag := w.Header().Get("ETag")
+			assert.NotEmpty(t, etag)
+
+			w = httptest.NewRecorder()
+
+			req, _ = http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetBootConfigPath(), nil)
+			req.RemoteAddr = net.JoinHostPort(testcase.instanceIP, "0")
+			req.Header.Set("If-None-Match", etag)
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusNotModified, w.Code)
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package metadataservice
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"go.hollow.sh/metadataservice/internal/apierror"
+	"go.hollow.sh/metadataservice/internal/bootstraptoken"
+	"go.hollow.sh/metadataservice/internal/middleware"
+)
+
+// HeaderBootstrapToken is the request header an instance uses to present its
+// bootstrap token
+const HeaderBootstrapToken = "X-Metadata-Bootstrap-Token"
+
+// instanceBootstrapTokenSet issues a new bootstrap token for an instance,
+// invalidating any token issued before it. The token is only ever returned in
+// this response.
+func (r *Router) instanceBootstrapTokenSet(c *gin.Context) {
+	instanceID, err := r.getInstanceIDParam(c, "instance-id")
+	if err != nil {
+		invalidUUIDResponse(c, err)
+		return
+	}
+
+	token, err := bootstraptoken.Issue(c.Request.Context(), r.DB, instanceID)
+	if err != nil {
+		dbErrorResponse(r.Logger, c, err)
+		return
+	}
+
+	r.Logger.Sugar().Info("Issued bootstrap token for instance: ", instanceID)
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, token)
+}
+
+// requireBootstrapToken returns the middleware used to make sure an instance
+// which has been issued a bootstrap token presents it before being served its
+// data. Instances without a token are unaffected. It must run after the
+// instance has been identified.
+func (r *Router) requireBootstrapToken() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		instanceID := c.GetString(middleware.ContextKeyInstanceID)
+
+		if !r.BootstrapTokens || instanceID == "" {
+			c.Next()
+			return
+		}
+
+		required, valid, err := bootstraptoken.Verify(c.Request.Context(), r.DB, instanceID, c.GetHeader(HeaderBootstrapToken))
+		if err != nil {
+			r.Logger.Sugar().Error("Unable to verify bootstrap token for instance: ", instanceID, " Error: ", err)
+
+			apierror.Abort(c, http.StatusInternalServerError, ErrorCodeInternal, "internal server error")
+
+			return
+		}
+
+		if required && !valid {
+			apierror.Abort(c, http.StatusUnauthorized, ErrorCodeBootstrapTokenRequired, "a valid bootstrap token is required")
+			return
+		}
+
+		c.Next()
+	}
+}
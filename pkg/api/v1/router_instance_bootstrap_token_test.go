@@ -0,0 +1,83 @@
+package metadataservice_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/bootstraptoken"
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func TestBootstrapTokenRequired(t *testing.T) {
+	router := *testHTTPServerWithConfig(t, TestServerConfig{BootstrapTokens: true})
+	instanceID := dbtools.FixtureInstanceA.InstanceID
+
+	getMetadata := func(token string) int {
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetMetadataPath(), nil)
+		req.RemoteAddr = net.JoinHostPort(dbtools.FixtureInstanceA.HostIPs[0], "0")
+
+		if token != "" {
+			req.Header.Set(v1api.HeaderBootstrapToken, token)
+		}
+
+		router.ServeHTTP(w, req)
+
+		return w.Code
+	}
+
+	issueToken := func() string {
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalBootstrapTokenPath(instanceID), nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+
+		var token bootstraptoken.Token
+
+		if err := json.Unmarshal(w.Body.Bytes(), &token); err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, instanceID, token.InstanceID)
+		assert.NotEmpty(t, token.Token)
+
+		return token.Token
+	}
+
+	// Until a token has been issued, none is needed
+	assert.Equal(t, http.StatusOK, getMetadata(""))
+
+	first := issueToken()
+
+	assert.Equal(t, http.StatusUnauthorized, getMetadata(""))
+	assert.Equal(t, http.StatusUnauthorized, getMetadata("not-the-token"))
+	assert.Equal(t, http.StatusOK, getMetadata(first))
+
+	// Rotating the token invalidates the old one
+	second := issueToken()
+
+	assert.Equal(t, http.StatusUnauthorized, getMetadata(first))
+	assert.Equal(t, http.StatusOK, getMetadata(second))
+}
+
+func TestBootstrapTokenDisabled(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalBootstrapTokenPath(dbtools.FixtureInstanceA.InstanceID), nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,55 @@
+package metadataservice
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/models"
+)
+
+// CacheInvalidateResponse is returned by the cache invalidation endpoint
+type CacheInvalidateResponse struct {
+	ID      string `json:"id"`
+	Evicted int    `json:"evicted"`
+}
+
+// instanceCacheInvalidate evicts everything the read cache holds for an
+// instance, for operators who've changed its data directly in the database
+// and don't want to wait for the cached entries to expire. That's its
+// metadata and userdata, and the lookups of the addresses it's associated to
+// now or was cached under. Only this replica's cache is invalidated. It's a
+// no-op when the read cache is disabled.
+func (r *Router) instanceCacheInvalidate(c *gin.Context) {
+	instanceID, err := r.getInstanceIDParam(c, "instance-id")
+	if err != nil {
+		invalidUUIDResponse(c, err)
+		return
+	}
+
+	if r.ReadCache == nil {
+		c.JSON(http.StatusOK, &CacheInvalidateResponse{ID: instanceID})
+		return
+	}
+
+	// The addresses are read from the database, as the cached lookups of
+	// addresses moved to the instance out of band still name their previous
+	// owner
+	addresses, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(instanceID)).All(c.Request.Context(), r.DB)
+	if err != nil {
+		dbErrorResponse(r.Logger, c, err)
+		return
+	}
+
+	ipAddresses := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		ipAddresses = append(ipAddresses, address.Address)
+	}
+
+	evicted := r.invalidateReadCache(instanceID, ipAddresses)
+
+	r.Logger.Info("invalidated read cache", zap.String("instance_id", instanceID), zap.Int("evicted", evicted))
+
+	c.JSON(http.StatusOK, &CacheInvalidateResponse{ID: instanceID, Evicted: evicted})
+}
@@ -0,0 +1,174 @@
+package metadataservice
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+
+	"go.hollow.sh/metadataservice/internal/middleware"
+)
+
+const (
+	// InstanceDataURI is the path to the endpoint serving an instance its
+	// metadata as a cloud-init instance-data.json document, with the sensitive
+	// fields redacted.
+	InstanceDataURI = "/instance-data.json"
+
+	// InstanceDataSensitiveURI is the path to the endpoint serving an instance
+	// its metadata as a cloud-init instance-data-sensitive.json document,
+	// including the sensitive fields.
+	InstanceDataSensitiveURI = "/instance-data-sensitive.json"
+
+	// instanceDataRedacted is the value cloud-init replaces sensitive values
+	// with in instance-data.json
+	instanceDataRedacted = "redacted for non-root user"
+
+	instanceDataCloudName = "metadataservice"
+
+	// instanceDataMetadataKey is the path to the metadata within the document,
+	// as used in the sensitive_keys list
+	instanceDataMetadataKey = "ds/meta_data/"
+)
+
+// DefaultInstanceDataPublicFields are the top-level metadata fields which are
+// included in instance-data.json when no other classification is configured.
+// Every other field is considered sensitive.
+var DefaultInstanceDataPublicFields = []string{
+	"id",
+	"hostname",
+	"iqn",
+	"plan",
+	"class",
+	"facility",
+	"metro",
+	"operating_system",
+	"network",
+	"tags",
+	"specs",
+	"ssh_keys",
+}
+
+// InstanceData is a cloud-init compatible instance-data document.
+type InstanceData struct {
+	Base64EncodedKeys []string             `json:"base64_encoded_keys"`
+	SensitiveKeys     []string             `json:"sensitive_keys"`
+	DS                InstanceDataDS       `json:"ds"`
+	V1                InstanceDataStandard `json:"v1"`
+}
+
+// InstanceDataDS holds the datasource specific data of an instance-data
+// document, which for us is the (augmented) metadata.
+type InstanceDataDS struct {
+	MetaData map[string]interface{} `json:"meta_data"`
+}
+
+// InstanceDataStandard holds the standardized, datasource independent keys of
+// an instance-data document. They're only ever derived from public fields.
+type InstanceDataStandard struct {
+	CloudName        string      `json:"cloud_name"`
+	Platform         string      `json:"platform"`
+	InstanceID       interface{} `json:"instance_id"`
+	LocalHostname    interface{} `json:"local_hostname"`
+	Region           interface{} `json:"region"`
+	AvailabilityZone interface{} `json:"availability_zone"`
+	PublicSSHKeys    interface{} `json:"public_ssh_keys"`
+}
+
+// instanceDataPublicFields returns the set of top-level metadata fields
+// classified as public
+func (r *Router) instanceDataPublicFields() map[string]bool {
+	fields := r.InstanceDataPublicFields
+	if fields == nil {
+		fields = DefaultInstanceDataPublicFields
+	}
+
+	public := make(map[string]bool, len(fields))
+
+	for _, field := range fields {
+		public[field] = true
+	}
+
+	return public
+}
+
+// instanceData builds the instance-data document for the metadata. Fields not
+// classified as public are listed in sensitive_keys, and unless sensitive is
+// true, their values are redacted.
+func (r *Router) instanceData(metadata map[string]interface{}, sensitive bool) *InstanceData {
+	public := r.instanceDataPublicFields()
+
+	doc := &InstanceData{
+		Base64EncodedKeys: []string{},
+		SensitiveKeys:     []string{},
+		DS:                InstanceDataDS{MetaData: make(map[string]interface{}, len(metadata))},
+		V1: InstanceDataStandard{
+			CloudName: instanceDataCloudName,
+			Platform:  instanceDataCloudName,
+		},
+	}
+
+	for field, value := range metadata {
+		if !public[field] {
+			doc.SensitiveKeys = append(doc.SensitiveKeys, instanceDataMetadataKey+field)
+
+			if !sensitive {
+				value = instanceDataRedacted
+			}
+		}
+
+		doc.DS.MetaData[field] = value
+	}
+
+	sort.Strings(doc.SensitiveKeys)
+
+	publicValue := func(field string) interface{} {
+		if !public[field] {
+			return nil
+		}
+
+		return metadata[field]
+	}
+
+	doc.V1.InstanceID = publicValue("id")
+	doc.V1.LocalHostname = publicValue("hostname")
+	doc.V1.Region = publicValue("metro")
+	doc.V1.AvailabilityZone = publicValue("facility")
+	doc.V1.PublicSSHKeys = publicValue("ssh_keys")
+
+	return doc
+}
+
+// instanceDataGet returns the handler serving the instance-data document for
+// the instance making the request, either with or without its sensitive
+// fields. Both documents are served to the instance, it's up to the client to
+// store them with the appropriate permissions, as cloud-init does.
+func (r *Router) instanceDataGet(sensitive bool) gin.HandlerFunc {
+	resource := etagResourceInstanceData
+	if sensitive {
+		resource = etagResourceInstanceDataSensitive
+	}
+
+	return func(c *gin.Context) {
+		metadata, err := r.getMetadata(c)
+		if err != nil {
+			if errors.Is(err, errNotFound) {
+				notFoundResponse(c)
+			} else {
+				dbErrorResponse(r.Logger, c, err)
+			}
+
+			return
+		}
+
+		servedMetadata := r.servedMetadata(c, metadata)
+
+		augmentedMetadata, err := r.withTemplateFields(servedMetadata, metadata.ID, c.GetString(middleware.ContextKeyRequestorIP))
+		if err != nil {
+			internalErrorResponse(c)
+			return
+		}
+
+		r.resourceJSONResponse(c, resource, r.instanceData(augmentedMetadata, sensitive), metadata.UpdatedAt)
+	}
+}
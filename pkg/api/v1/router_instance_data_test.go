@@ -0,0 +1,68 @@
+package metadataservice_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func TestGetInstanceData(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	getInstanceData := func(path string) v1api.InstanceData {
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, path, nil)
+		req.RemoteAddr = net.JoinHostPort(dbtools.FixtureInstanceA.HostIPs[0], "0")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var doc v1api.InstanceData
+
+		if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+			t.Fatal(err)
+		}
+
+		return doc
+	}
+
+	public := getInstanceData(v1api.GetInstanceDataPath())
+	sensitive := getInstanceData(v1api.GetInstanceDataSensitivePath())
+
+	// Unknown fields are treated as sensitive
+	for _, doc := range []v1api.InstanceData{public, sensitive} {
+		assert.Contains(t, doc.SensitiveKeys, "ds/meta_data/customdata")
+		assert.NotContains(t, doc.SensitiveKeys, "ds/meta_data/hostname")
+		assert.Equal(t, "instance-a", doc.V1.LocalHostname)
+		assert.Equal(t, dbtools.FixtureInstanceA.InstanceID, doc.V1.InstanceID)
+		assert.Equal(t, "da", doc.V1.Region)
+	}
+
+	assert.Equal(t, "instance-a", public.DS.MetaData["hostname"])
+	assert.Equal(t, "redacted for non-root user", public.DS.MetaData["customdata"])
+	assert.NotEqual(t, "redacted for non-root user", sensitive.DS.MetaData["customdata"])
+	assert.Equal(t, len(public.DS.MetaData), len(sensitive.DS.MetaData))
+}
+
+func TestGetInstanceDataNotFound(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	for _, path := range []string{v1api.GetInstanceDataPath(), v1api.GetInstanceDataSensitivePath()} {
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, path, nil)
+		req.RemoteAddr = net.JoinHostPort("1.2.3.4", "0")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	}
+}
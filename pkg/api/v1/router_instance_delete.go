@@ -0,0 +1,50 @@
+package metadataservice
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"go.hollow.sh/metadataservice/internal/middleware"
+	"go.hollow.sh/metadataservice/internal/upserter"
+)
+
+// instanceDelete removes everything stored for an instance being
+// decommissioned: its metadata, userdata, public keys, tags, bootstrap token,
+// metadata history and all of its IP address associations, in a single
+// transaction. Its IP addresses can be associated to another instance as soon
+// as this returns a 204. A 404 is returned if nothing was stored for the
+// instance.
+func (r *Router) instanceDelete(c *gin.Context) {
+	instanceID, err := r.getInstanceIDParam(c, "instance-id")
+
+	if err != nil {
+		invalidUUIDResponse(c, err)
+
+		return
+	}
+
+	if r.deleteBlockedByRecentFetch(c, instanceID) {
+		return
+	}
+
+	changes, err := upserter.DeleteInstance(c.Request.Context(), r.DB, r.Logger, instanceID)
+
+	switch {
+	case errors.Is(err, upserter.ErrInstanceNotFound):
+		notFoundResponse(c)
+
+		return
+	case err != nil:
+		r.upsertErrorResponse(c, err)
+
+		return
+	}
+
+	r.invalidateReadCache(instanceID, changes.Removed)
+
+	middleware.MetricDeletionsCount.Inc()
+
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,164 @@
+package metadataservice_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	"go.hollow.sh/metadataservice/internal/models"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func TestDeleteInstance(t *testing.T) {
+	router := *testHTTPServer(t)
+	testDB := dbtools.TestDB()
+
+	type testCase struct {
+		testName       string
+		instanceID     string
+		expectedStatus int
+	}
+
+	testCases := []testCase{
+		{
+			"unknown ID",
+			"99c53a90-61c8-472d-95dc-9abeaeb646c9",
+			http.StatusNotFound,
+		},
+		// Instance A has metadata, userdata and IP addresses
+		{
+			"Instance A",
+			dbtools.FixtureInstanceA.InstanceID,
+			http.StatusNoContent,
+		},
+		// Instance B has metadata and IP addresses, but no userdata
+		{
+			"Instance B",
+			dbtools.FixtureInstanceB.InstanceID,
+			http.StatusNoContent,
+		},
+		// Instance E has userdata and IP addresses, but no metadata
+		{
+			"Instance E",
+			dbtools.FixtureInstanceE.InstanceID,
+			http.StatusNoContent,
+		},
+		// Instance A was already deleted above
+		{
+			"Instance A again",
+			dbtools.FixtureInstanceA.InstanceID,
+			http.StatusNotFound,
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodDelete, v1api.GetInternalInstanceByIDPath(testcase.instanceID), nil)
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+
+			metadataExists, err := models.InstanceMetadatumExists(context.TODO(), testDB, testcase.instanceID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			userdataExists, err := models.InstanceUserdatumExists(context.TODO(), testDB, testcase.instanceID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ipCount, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(testcase.instanceID)).Count(context.TODO(), testDB)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.False(t, metadataExists)
+			assert.False(t, userdataExists)
+			assert.Equal(t, int64(0), ipCount)
+		})
+	}
+}
+
+// Test that a deleted instance's IP addresses can be associated to a new
+// instance straight away, even when conflicts are rejected
+func TestDeleteInstanceFreesIPAddresses(t *testing.T) {
+	router := *testHTTPServerWithConfig(t, TestServerConfig{RejectConflicts: true})
+
+	newInstanceID := "7c4fb9c5-9a2a-4f7e-8e3b-3a1ad4a1a6d3"
+	ipAddresses := []string{dbtools.FixtureInstanceA.HostIPs[0]}
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodDelete, v1api.GetInternalInstanceByIDPath(dbtools.FixtureInstanceA.InstanceID), nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	upsert(t, router, v1api.GetInternalMetadataPath(), &v1api.UpsertMetadataRequest{
+		ID:          newInstanceID,
+		Metadata:    `{"some":"metadata"}`,
+		IPAddresses: ipAddresses,
+	})
+
+	ipCount, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(newInstanceID)).Count(context.TODO(), dbtools.TestDB())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, int64(1), ipCount)
+}
+
+// Test that an instance with only public keys or tags stored can be deleted,
+// that its bootstrap token goes with it, and that its metadata history is kept
+func TestDeleteInstanceWithoutMetadata(t *testing.T) {
+	router := *testHTTPServer(t)
+	testDB := dbtools.TestDB()
+
+	instanceID := "2b0a3f4e-6d1c-4c8e-9f55-5c1d2e3f4a5b"
+
+	for _, query := range []string{
+		`INSERT INTO instance_tags (instance_id, tag_key, tag_value, updated_at) VALUES ($1, 'role', 'web', now())`,
+		`INSERT INTO instance_bootstrap_tokens (instance_id, token_hash, created_at) VALUES ($1, 'hash', now())`,
+		`INSERT INTO instance_metadata_history (instance_id, metadata, updated_at, replaced_at) VALUES ($1, '{}', now(), now())`,
+	} {
+		if _, err := testDB.Exec(query, instanceID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodDelete, v1api.GetInternalInstanceByIDPath(instanceID), nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	for _, table := range []string{"instance_tags", "instance_bootstrap_tokens", "instance_metadata_history"} {
+		var count int
+
+		if err := testDB.Get(&count, `SELECT count(*) FROM `+table+` WHERE instance_id = $1`, instanceID); err != nil {
+			t.Fatal(err)
+		}
+
+		if table == "instance_metadata_history" {
+			assert.Equal(t, 1, count, table)
+		} else {
+			assert.Equal(t, 0, count, table)
+		}
+	}
+
+	// Nothing is left to delete
+	w = httptest.NewRecorder()
+
+	req, _ = http.NewRequestWithContext(context.TODO(), http.MethodDelete, v1api.GetInternalInstanceByIDPath(instanceID), nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,93 @@
+package metadataservice
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"mime"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// userdataFormats maps the first line cloud-init recognizes a userdata format
+// by to the content type it's served with
+var userdataFormats = []struct {
+	prefix      string
+	contentType string
+}{
+	{"#cloud-config", "text/cloud-config"},
+	{"#cloud-boothook", "text/cloud-boothook"},
+	{"#include", "text/x-include-url"},
+	{"#part-handler", "text/part-handler"},
+	{"#!", "text/x-shellscript"},
+}
+
+// gzipMagic starts every gzip-compressed stream
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// instanceEc2LatestUserdataGet serves the instance's userdata as it is, with a
+// content type detected from its format. Unlike the other ec2-style routes, a
+// 404 always has an empty body.
+func (r *Router) instanceEc2LatestUserdataGet(c *gin.Context) {
+	userdata, err := r.getUserdata(c)
+	if err != nil {
+		if errors.Is(err, errNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+		} else {
+			dbErrorResponse(r.Logger, c, err)
+		}
+
+		return
+	}
+
+	body := r.UserdataTransformer.Transform(userdata.Userdata.Bytes)
+
+	r.resourceResponse(c, etagResourceUserdata, userdataContentType(body), body, userdata.UpdatedAt)
+}
+
+// userdataContentType detects the content type of userdata: the cloud-init
+// formats, MIME multipart archives (keeping their boundary) and gzip
+// compressed userdata. Anything else is served as plain text, unless it looks
+// like some other type.
+func userdataContentType(userdata []byte) string {
+	if bytes.HasPrefix(userdata, gzipMagic) {
+		return "application/gzip"
+	}
+
+	for _, format := range userdataFormats {
+		if bytes.HasPrefix(userdata, []byte(format.prefix)) {
+			return format.contentType
+		}
+	}
+
+	if contentType := multipartContentType(userdata); contentType != "" {
+		return contentType
+	}
+
+	if contentType := http.DetectContentType(userdata); !strings.HasPrefix(contentType, "text/") {
+		return contentType
+	}
+
+	return contentTypeText
+}
+
+// multipartContentType returns the Content-Type header of userdata which is a
+// MIME multipart archive, or an empty string when it isn't one
+func multipartContentType(userdata []byte) string {
+	header, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(userdata))).ReadMIMEHeader()
+	if err != nil {
+		return ""
+	}
+
+	contentType := header.Get("Content-Type")
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return ""
+	}
+
+	return contentType
+}
@@ -0,0 +1,92 @@
+package metadataservice_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func TestGetEc2LatestUserdataByIP(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	testCases := []struct {
+		testName            string
+		instanceIP          string
+		expectedStatus      int
+		expectedBody        string
+		expectedContentType string
+	}{
+		{
+			"unknown IP address",
+			"1.2.3.4",
+			http.StatusNotFound,
+			"",
+			"",
+		},
+		{
+			"shell script",
+			dbtools.FixtureInstanceA.HostIPs[0],
+			http.StatusOK,
+			string(dbtools.FixtureInstanceA.InstanceUserdata.Userdata.Bytes),
+			"text/x-shellscript",
+		},
+		{
+			"no userdata",
+			dbtools.FixtureInstanceB.HostIPs[0],
+			http.StatusNotFound,
+			"",
+			"",
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetEc2LatestUserdataPath(), nil)
+			req.RemoteAddr = net.JoinHostPort(testcase.instanceIP, "0")
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+			assert.Equal(t, testcase.expectedBody, w.Body.String())
+
+			if testcase.expectedStatus == http.StatusOK {
+				assert.Equal(t, testcase.expectedContentType, w.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestUserdataContentType(t *testing.T) {
+	testCases := []struct {
+		testName string
+		userdata string
+		expected string
+	}{
+		{"cloud-config", "#cloud-config\npackages: [nginx]\n", "text/cloud-config"},
+		{"shell script", "#!/bin/bash\necho hello\n", "text/x-shellscript"},
+		{"include", "#include\nhttps://example.com/userdata\n", "text/x-include-url"},
+		{"boothook", "#cloud-boothook\necho hello\n", "text/cloud-boothook"},
+		{
+			"multipart",
+			"Content-Type: multipart/mixed; boundary=\"BOUNDARY\"\nMIME-Version: 1.0\n\n--BOUNDARY\n",
+			"multipart/mixed; boundary=\"BOUNDARY\"",
+		},
+		{"gzip", "\x1f\x8b\x08\x00\x00\x00\x00\x00", "application/gzip"},
+		{"plain text", "hello", "text/plain; charset=utf-8"},
+		{"binary", "\x00\x01\x02\x03", "application/octet-stream"},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			assert.Equal(t, testcase.expected, v1api.UserdataContentType([]byte(testcase.userdata)))
+		})
+	}
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 
+	"go.hollow.sh/metadataservice/internal/apierror"
 	"go.hollow.sh/metadataservice/pkg/api/v1/ec2"
 )
 
@@ -43,7 +44,7 @@ func (r *Router) instanceEc2MetadataGet(c *gin.Context) {
 
 	if err != nil {
 		if errors.Is(err, errNotFound) {
-			notFoundResponse(c)
+			r.ec2NotFoundResponse(c)
 		} else {
 			dbErrorResponse(r.Logger, c, err)
 		}
@@ -53,22 +54,30 @@ func (r *Router) instanceEc2MetadataGet(c *gin.Context) {
 
 	var metadata = ec2.Metadata{}
 
-	err = json.Unmarshal([]byte(instanceMetadata.Metadata), &metadata)
+	err = json.Unmarshal(r.servedMetadata(c, instanceMetadata), &metadata)
 
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, &ErrorResponse{Errors: []string{"Invalid metadata for instance"}})
+		apierror.Abort(c, http.StatusInternalServerError, ErrorCodeInternal, "invalid metadata for instance")
 		return
 	}
 
-	c.String(http.StatusOK, strings.Join(metadata.ItemNames(), "\n"))
+	r.resourceResponse(c, etagResourceMetadata, contentTypeText, []byte(strings.Join(metadata.ItemNames(), "\n")), instanceMetadata.UpdatedAt)
 }
 
 func (r *Router) instanceEc2MetadataItemGet(c *gin.Context) {
+	// With stable instance IDs, the instance-id item is the ID of the instance
+	// record rather than anything in the metadata, so it's served without
+	// loading the metadata at all.
+	if r.StableInstanceID && c.Param("subpath") == "/instance-id" {
+		r.serveInstanceID(c, r.ec2NotFoundResponse)
+		return
+	}
+
 	instanceMetadata, err := r.getMetadata(c)
 
 	if err != nil {
 		if errors.Is(err, errNotFound) {
-			notFoundResponse(c)
+			r.ec2NotFoundResponse(c)
 		} else {
 			dbErrorResponse(r.Logger, c, err)
 		}
@@ -83,10 +92,10 @@ func (r *Router) instanceEc2MetadataItemGet(c *gin.Context) {
 
 	var metadata = ec2.Metadata{}
 
-	err = json.Unmarshal([]byte(instanceMetadata.Metadata), &metadata)
+	err = json.Unmarshal(r.servedMetadata(c, instanceMetadata), &metadata)
 
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, &ErrorResponse{Errors: []string{"Invalid metadata for instance"}})
+		apierror.Abort(c, http.StatusInternalServerError, ErrorCodeInternal, "invalid metadata for instance")
 		return
 	}
 
@@ -95,12 +104,36 @@ func (r *Router) instanceEc2MetadataItemGet(c *gin.Context) {
 		// with a trailing slash, so return the ItemNames as we would in
 		// instanceEc2MetadataGet()
 		if subPath == "/" {
-			c.String(http.StatusOK, strings.Join(metadata.ItemNames(), "\n"))
+			r.resourceResponse(c, etagResourceMetadata, contentTypeText, []byte(strings.Join(metadata.ItemNames(), "\n")), instanceMetadata.UpdatedAt)
 			return
 		}
 
+		modified := instanceMetadata.UpdatedAt
+
+		// Keys stored separately from the metadata take its place
+		if isPublicKeysItem(subPath) {
+			keys, keysUpdated, err := r.ec2PublicKeys(c.Request.Context(), instanceMetadata.ID)
+			if err != nil {
+				dbErrorResponse(r.Logger, c, err)
+				return
+			}
+
+			metadata.PublicKeys = keys
+
+			if keysUpdated.After(modified) {
+				modified = keysUpdated
+			}
+		}
+
 		if result, ok := metadata.GetItem(subPath); ok {
-			c.String(http.StatusOK, strings.Join(result, "\n"))
+			r.resourceResponse(c, etagResourceMetadata, contentTypeText, []byte(strings.Join(result, "\n")), modified)
+			return
+		}
+
+		// Anything else in the stored metadata can still be reached by
+		// walking its JSON structure
+		if result, ok := ec2.GetTreeItem(r.servedMetadata(c, instanceMetadata), subPath); ok {
+			r.resourceResponse(c, etagResourceMetadata, contentTypeText, []byte(strings.Join(result, "\n")), instanceMetadata.UpdatedAt)
 			return
 		}
 	}
@@ -108,14 +141,14 @@ func (r *Router) instanceEc2MetadataItemGet(c *gin.Context) {
 	// If we're here, that means that either there wasn't a subpath item, or we
 	// couldn't find the item in the metadata for the instance. In that case,
 	// just return a 404.
-	notFoundResponse(c)
+	r.ec2NotFoundResponse(c)
 }
 
 func (r *Router) instanceEc2UserdataGet(c *gin.Context) {
 	userdata, err := r.getUserdata(c)
 	if err != nil {
 		if errors.Is(err, errNotFound) {
-			notFoundResponse(c)
+			r.ec2NotFoundResponse(c)
 		} else {
 			dbErrorResponse(r.Logger, c, err)
 		}
@@ -123,5 +156,5 @@ func (r *Router) instanceEc2UserdataGet(c *gin.Context) {
 		return
 	}
 
-	c.String(http.StatusOK, string(userdata.Userdata.Bytes))
+	r.resourceResponse(c, etagResourceUserdata, contentTypeText, r.UserdataTransformer.Transform(userdata.Userdata.Bytes), userdata.UpdatedAt)
 }
@@ -441,3 +441,144 @@ func TestGetEc2MetadataItemByIP(t *testing.T) {
 		}
 	})
 }
+
+func TestGetEc2MetadataItemNotFoundBody(t *testing.T) {
+	type testCase struct {
+		testName     string
+		style        v1api.NotFoundBody
+		expectedBody string
+	}
+
+	testCases := []testCase{
+		{
+			"default",
+			"",
+			"",
+		},
+		{
+			"empty",
+			v1api.NotFoundBodyEmpty,
+			"",
+		},
+		{
+			"text",
+			v1api.NotFoundBodyText,
+			"Not Found",
+		},
+		{
+			"json",
+			v1api.NotFoundBodyJSON,
+			`{"error":{"code":"not_found","message":"resource not found","request_id":"ec2-not-found"}}`,
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			router := *testHTTPServerWithConfig(t, TestServerConfig{Ec2NotFound: testcase.style})
+
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetEc2MetadataItemPath("not-a-real-item"), nil)
+			req.RemoteAddr = net.JoinHostPort(dbtools.FixtureInstanceA.HostIPs[0], "0")
+			req.Header.Set("X-Request-ID", "ec2-not-found")
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusNotFound, w.Code)
+			assert.Equal(t, testcase.expectedBody, w.Body.String())
+		})
+	}
+}
+
+func TestGetEc2MetadataNestedItemByIP(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	testCases := []struct {
+		testName       string
+		itemPath       string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			"public key index",
+			"public-keys/0",
+			http.StatusOK,
+			"openssh-key",
+		},
+		{
+			"public key",
+			"public-keys/1/openssh-key",
+			http.StatusOK,
+			"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIDPgTv1yUmNCGUcnCuFr94SQ0YqpuMwKSC022Fp2Q3TF test@user.local",
+		},
+		{
+			"public key out of range",
+			"public-keys/2/openssh-key",
+			http.StatusNotFound,
+			"",
+		},
+		{
+			"public key unknown format",
+			"public-keys/0/x509",
+			http.StatusNotFound,
+			"",
+		},
+		{
+			"directory listing",
+			"network/bonding",
+			http.StatusOK,
+			"link_aggregation\nmac\nmode",
+		},
+		{
+			"directory listing with trailing slash",
+			"network/interfaces/0/",
+			http.StatusOK,
+			"bond\nmac\nname",
+		},
+		{
+			"directory listing marks subdirectories",
+			"network/interfaces",
+			http.StatusOK,
+			"0/\n1/",
+		},
+		{
+			"string leaf with hyphenated name",
+			"network/bonding/link-aggregation",
+			http.StatusOK,
+			"mlag_ha",
+		},
+		{
+			"number leaf",
+			"network/bonding/mode",
+			http.StatusOK,
+			"4",
+		},
+		{
+			"array index out of range",
+			"network/interfaces/9/name",
+			http.StatusNotFound,
+			"",
+		},
+		{
+			"unknown path",
+			"network/bonding/mode/speed",
+			http.StatusNotFound,
+			"",
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, getEc2MetadataItemPathWithoutTrim(testcase.itemPath), nil)
+			req.RemoteAddr = net.JoinHostPort(dbtools.FixtureInstanceA.HostIPs[0], "0")
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+
+			if testcase.expectedStatus == http.StatusOK {
+				assert.Equal(t, testcase.expectedBody, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package metadataservice
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/volatiletech/sqlboiler/v4/queries/qm"
+
+	"go.hollow.sh/metadataservice/internal/models"
+)
+
+const (
+	// exportBatchSize is the number of instances read from the database and
+	// written to the response at a time while exporting
+	exportBatchSize = 100
+
+	exportContentType = "application/x-ndjson"
+)
+
+// ExportRecord is a single instance in the bulk export. The id, metadata,
+// userdata and ipAddresses fields use the same format as the upsert
+// requests, so an exported record can be used to restore the instance.
+type ExportRecord struct {
+	ID          string    `json:"id"`
+	Metadata    string    `json:"metadata"`
+	Userdata    []byte    `json:"userdata,omitempty"`
+	IPAddresses []string  `json:"ipAddresses"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// instanceExport streams every instance with stored metadata matching the
+// request filters as newline-delimited JSON. Instances are read from the
+// database in batches, so the full dataset is never held in memory.
+func (r *Router) instanceExport(c *gin.Context) {
+	filter, err := parseInstanceFilter(c)
+	if err != nil {
+		badRequestResponse(c, err.Error(), err)
+		return
+	}
+
+	c.Header("Content-Type", exportContentType)
+	c.Status(http.StatusOK)
+
+	encoder := json.NewEncoder(c.Writer)
+	lastID := ""
+
+	for {
+		mods := filter.queryMods()
+		mods = append(mods, qm.OrderBy(models.InstanceMetadatumColumns.ID), qm.Limit(exportBatchSize))
+
+		if lastID != "" {
+			mods = append(mods, models.InstanceMetadatumWhere.ID.GT(lastID))
+		}
+
+		batch, err := models.InstanceMetadata(mods...).All(c.Request.Context(), r.DB)
+		if err != nil {
+			// We've already started streaming the response, so the best we can do
+			// is stop and let the client notice the truncated export.
+			r.Logger.Sugar().Error("Error reading instance metadata for export: ", err)
+			return
+		}
+
+		records, err := r.exportRecords(c, batch)
+		if err != nil {
+			r.Logger.Sugar().Error("Error reading instance data for export: ", err)
+			return
+		}
+
+		for _, record := range records {
+			if err := encoder.Encode(record); err != nil {
+				return
+			}
+		}
+
+		c.Writer.Flush()
+
+		if len(batch) < exportBatchSize {
+			return
+		}
+
+		lastID = batch[len(batch)-1].ID
+	}
+}
+
+// exportRecords fills in the userdata and IP addresses for a batch of
+// instance metadata
+func (r *Router) exportRecords(c *gin.Context, batch models.InstanceMetadatumSlice) ([]ExportRecord, error) {
+	ids := make([]interface{}, 0, len(batch))
+	for _, metadata := range batch {
+		ids = append(ids, metadata.ID)
+	}
+
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	userdata, err := models.InstanceUserdata(qm.WhereIn(models.InstanceUserdatumColumns.ID+" IN ?", ids...)).All(c.Request.Context(), r.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	userdataByID := make(map[string][]byte, len(userdata))
+	for _, u := range userdata {
+		userdataByID[u.ID] = u.Userdata.Bytes
+	}
+
+	ips, err := models.InstanceIPAddresses(qm.WhereIn(models.InstanceIPAddressColumns.InstanceID+" IN ?", ids...)).All(c.Request.Context(), r.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	ipsByID := make(map[string][]string)
+	for _, ip := range ips {
+		ipsByID[ip.InstanceID] = append(ipsByID[ip.InstanceID], ip.Address)
+	}
+
+	records := make([]ExportRecord, 0, len(batch))
+
+	for _, metadata := range batch {
+		ipAddresses := ipsByID[metadata.ID]
+		if ipAddresses == nil {
+			ipAddresses = []string{}
+		}
+
+		records = append(records, ExportRecord{
+			ID:          metadata.ID,
+			Metadata:    string(metadata.Metadata),
+			Userdata:    userdataByID[metadata.ID],
+			IPAddresses: ipAddresses,
+			UpdatedAt:   metadata.UpdatedAt,
+		})
+	}
+
+	return records, nil
+}
@@ -0,0 +1,114 @@
+package metadataservice_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func TestInstanceExport(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	type testCase struct {
+		testName       string
+		query          url.Values
+		expectedStatus int
+		expectedIDs    []string
+	}
+
+	testCases := []testCase{
+		{
+			"no filters",
+			url.Values{},
+			http.StatusOK,
+			[]string{
+				dbtools.FixtureInstanceA.InstanceID,
+				dbtools.FixtureInstanceA1.InstanceID,
+				dbtools.FixtureInstanceA2.InstanceID,
+				dbtools.FixtureInstanceB.InstanceID,
+				dbtools.FixtureInstanceC.InstanceID,
+				dbtools.FixtureInstanceD.InstanceID,
+			},
+		},
+		{
+			"subnet filter",
+			url.Values{"subnet": []string{"10.70.17.0/24"}},
+			http.StatusOK,
+			[]string{
+				dbtools.FixtureInstanceA.InstanceID,
+				dbtools.FixtureInstanceA1.InstanceID,
+				dbtools.FixtureInstanceA2.InstanceID,
+			},
+		},
+		{
+			"subnet filter with a single address",
+			url.Values{"subnet": []string{"145.40.77.21"}},
+			http.StatusOK,
+			[]string{dbtools.FixtureInstanceB.InstanceID},
+		},
+		{
+			"updated since in the future",
+			url.Values{"updated_since": []string{"2999-01-01T00:00:00Z"}},
+			http.StatusOK,
+			[]string{},
+		},
+		{
+			"unknown tag",
+			url.Values{"tag": []string{"not-a-tag"}},
+			http.StatusOK,
+			[]string{},
+		},
+		{
+			"invalid updated since",
+			url.Values{"updated_since": []string{"yesterday"}},
+			http.StatusBadRequest,
+			nil,
+		},
+		{
+			"invalid subnet",
+			url.Values{"subnet": []string{"not-a-subnet"}},
+			http.StatusBadRequest,
+			nil,
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetInternalExportPath()+"?"+testcase.query.Encode(), nil)
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+
+			if testcase.expectedStatus != http.StatusOK {
+				return
+			}
+
+			ids := []string{}
+			scanner := bufio.NewScanner(w.Body)
+			scanner.Buffer(nil, 1024*1024)
+
+			for scanner.Scan() {
+				var record v1api.ExportRecord
+
+				if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+					t.Fatal(err)
+				}
+
+				ids = append(ids, record.ID)
+			}
+
+			assert.ElementsMatch(t, testcase.expectedIDs, ids)
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package metadataservice
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"go.hollow.sh/metadataservice/internal/middleware"
+)
+
+// instanceIDGet responds with just the ID of the instance making the request,
+// as plain text. An instance the service already knows about is answered from
+// the ID the request was identified as, without loading (or parsing) its
+// metadata. Otherwise the metadata is fetched as usual, which gives the
+// upstream lookup service (when enabled) a chance to sync it first.
+func (r *Router) instanceIDGet(c *gin.Context) {
+	r.serveInstanceID(c, notFoundResponse)
+}
+
+// serveInstanceID writes the ID of the instance making the request, derived
+// from its source IP when StableIDBySourceIP is enabled, calling notFound when
+// no instance matches it.
+func (r *Router) serveInstanceID(c *gin.Context, notFound func(*gin.Context)) {
+	instanceID := c.GetString(middleware.ContextKeyInstanceID)
+
+	if instanceID == "" {
+		metadata, err := r.getMetadata(c)
+		if err != nil {
+			if errors.Is(err, errNotFound) {
+				notFound(c)
+			} else {
+				dbErrorResponse(r.Logger, c, err)
+			}
+
+			return
+		}
+
+		instanceID = metadata.ID
+	}
+
+	c.Data(http.StatusOK, contentTypeText, []byte(r.servedInstanceID(c, instanceID)))
+}
@@ -0,0 +1,90 @@
+package metadataservice_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func TestGetInstanceID(t *testing.T) {
+	routers := map[bool]http.Handler{
+		false: *testHTTPServer(t),
+		true:  *testHTTPServerWithConfig(t, TestServerConfig{StableInstanceID: true}),
+	}
+
+	testCases := []struct {
+		testName     string
+		stableID     bool
+		path         string
+		instanceIP   string
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			"known instance",
+			false,
+			v1api.GetMetadataInstanceIDPath(),
+			dbtools.FixtureInstanceA.HostIPs[0],
+			http.StatusOK,
+			dbtools.FixtureInstanceA.InstanceID,
+		},
+		{
+			"unknown instance",
+			false,
+			v1api.GetMetadataInstanceIDPath(),
+			"192.168.100.1",
+			http.StatusNotFound,
+			"",
+		},
+		{
+			"ec2 known instance",
+			false,
+			"/2009-04-04/meta-data/instance-id",
+			dbtools.FixtureInstanceA.HostIPs[0],
+			http.StatusOK,
+			dbtools.FixtureInstanceA.InstanceID,
+		},
+		{
+			"ec2 known instance with stable IDs",
+			true,
+			"/2009-04-04/meta-data/instance-id",
+			dbtools.FixtureInstanceA.HostIPs[0],
+			http.StatusOK,
+			dbtools.FixtureInstanceA.InstanceID,
+		},
+		{
+			"ec2 unknown instance with stable IDs",
+			true,
+			"/2009-04-04/meta-data/instance-id",
+			"192.168.100.1",
+			http.StatusNotFound,
+			"",
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			router := routers[testcase.stableID]
+
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, testcase.path, nil)
+			req.RemoteAddr = net.JoinHostPort(testcase.instanceIP, "0")
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedCode, w.Code)
+
+			if testcase.expectedCode == http.StatusOK {
+				assert.Equal(t, testcase.expectedBody, w.Body.String())
+				assert.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
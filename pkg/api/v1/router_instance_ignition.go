@@ -0,0 +1,54 @@
+package metadataservice
+
+import (
+	"errors"
+
+	"github.com/gin-gonic/gin"
+
+	"go.hollow.sh/metadataservice/internal/ignition"
+	"go.hollow.sh/metadataservice/internal/userdata"
+)
+
+// instanceIgnitionConfigGet serves the Ignition config stored as the
+// instance's userdata, as it is, for CoreOS and Flatcar instances fetching it
+// at boot. Userdata which isn't an Ignition config, like cloud-config, is
+// treated as missing, so Ignition never tries to apply it.
+func (r *Router) instanceIgnitionConfigGet(c *gin.Context) {
+	instanceUserdata, err := r.getUserdata(c)
+	if err != nil {
+		if errors.Is(err, errNotFound) {
+			notFoundResponse(c)
+		} else {
+			dbErrorResponse(r.Logger, c, err)
+		}
+
+		return
+	}
+
+	if !ignition.IsConfig(instanceUserdata.Userdata.Bytes) {
+		notFoundResponse(c)
+		return
+	}
+
+	r.resourceResponse(c, etagResourceUserdata, ignition.ContentType, instanceUserdata.Userdata.Bytes, instanceUserdata.UpdatedAt)
+}
+
+// validateIgnitionUserdata checks userdata which is an Ignition config uses a
+// supported spec version, when Ignition configs are validated. Any other
+// userdata is left alone.
+func (r *Router) validateIgnitionUserdata(data []byte, encoding string) error {
+	if !r.ValidateIgnition || data == nil {
+		return nil
+	}
+
+	decoded, err := userdata.Decode(data, encoding)
+	if err != nil {
+		return err
+	}
+
+	if !ignition.IsConfig(decoded) {
+		return nil
+	}
+
+	return ignition.Validate(decoded)
+}
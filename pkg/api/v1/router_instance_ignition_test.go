@@ -0,0 +1,90 @@
+package metadataservice_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+const ignitionConfig = `{"ignition":{"version":"3.4.0"},"storage":{"files":[{"path":"/etc/hostname","contents":{"source":"data:,instance-a"}}]}}`
+
+func getIgnitionConfig(router http.Handler, instanceIP string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetIgnitionConfigPath(), nil)
+	req.RemoteAddr = net.JoinHostPort(instanceIP, "0")
+	router.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestGetIgnitionConfig(t *testing.T) {
+	router := *testHTTPServer(t)
+	instanceIP := dbtools.FixtureInstanceA.HostIPs[0]
+
+	// Userdata which isn't an Ignition config is never served as one
+	w := getIgnitionConfig(router, instanceIP)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = getIgnitionConfig(router, "1.2.3.4")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	upsert(t, router, v1api.GetInternalUserdataPath(), v1api.UpsertUserdataRequest{
+		ID:          dbtools.FixtureInstanceA.InstanceID,
+		Userdata:    []byte(ignitionConfig),
+		IPAddresses: dbtools.FixtureInstanceA.HostIPs,
+	})
+
+	w = getIgnitionConfig(router, instanceIP)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t, ignitionConfig, w.Body.String())
+}
+
+func TestIgnitionConfigValidation(t *testing.T) {
+	unsupported := []byte(`{"ignition":{"version":"9.0.0"}}`)
+
+	testCases := []struct {
+		testName     string
+		validate     bool
+		userdata     []byte
+		expectedCode int
+	}{
+		{"unsupported version without validation", false, unsupported, http.StatusOK},
+		{"unsupported version", true, unsupported, http.StatusBadRequest},
+		{"supported version", true, []byte(ignitionConfig), http.StatusOK},
+		{"not an ignition config", true, []byte("#cloud-config\n"), http.StatusOK},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			router := *testHTTPServerWithConfig(t, TestServerConfig{ValidateIgnition: testcase.validate})
+
+			reqBody, err := json.Marshal(v1api.UpsertUserdataRequest{
+				ID:          dbtools.FixtureInstanceA.InstanceID,
+				Userdata:    testcase.userdata,
+				IPAddresses: dbtools.FixtureInstanceA.HostIPs,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalUserdataPath(), bytes.NewReader(reqBody))
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedCode, w.Code)
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package metadataservice
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+
+	"go.hollow.sh/metadataservice/internal/prewrite"
+	"go.hollow.sh/metadataservice/internal/upserter"
+)
+
+// maxIPAddressesBatchSize is the maximum number of instances which can have
+// their IP address associations loaded in a single request
+const maxIPAddressesBatchSize = 1000
+
+// InstanceIPAddressesRequest contains the IP addresses to associate to an
+// instance, which doesn't need to have any metadata or userdata stored.
+type InstanceIPAddressesRequest struct {
+	ID          string   `json:"id" validate:"required,instance_id"`
+	IPAddresses []string `json:"ipAddresses" validate:"dive,ip_addr|cidr"`
+}
+
+func (request *InstanceIPAddressesRequest) validate(v *validator.Validate) error {
+	return v.Struct(request)
+}
+
+// InstanceIPAddressesResponse is returned by the bulk IP address association
+// endpoint, and describes the changes made for each instance in the request.
+type InstanceIPAddressesResponse struct {
+	Results []InstanceIPAddressesResult `json:"results"`
+}
+
+// InstanceIPAddressesResult describes the outcome of loading the IP address
+// associations for a single instance.
+type InstanceIPAddressesResult struct {
+	ID        string                     `json:"id"`
+	Changes   *upserter.IPAddressChanges `json:"changes,omitempty"`
+	Error     string                     `json:"error,omitempty"`
+	Conflicts []upserter.IPConflict      `json:"conflicts,omitempty"`
+}
+
+// instanceIPAddressesSet bulk-loads the instance_ip_addresses associations for
+// a batch of instances, without touching their metadata or userdata. This
+// lets instances be identified by their IP address before their metadata is
+// available. The same conflict resolution as an upsert is used, and instances
+// are processed in the order given, so if two instances in the request claim
+// the same address the latter wins.
+//
+// By default each instance's associations are replaced by the addresses in the
+// request. With prune=false, addresses are only added.
+func (r *Router) instanceIPAddressesSet(c *gin.Context) {
+	prune, err := getPruneParam(c)
+	if err != nil {
+		badRequestResponse(c, err.Error(), err)
+		return
+	}
+
+	params := []InstanceIPAddressesRequest{}
+
+	limitRequestBody(c, r.MaxMetadataBodySize)
+
+	if err := c.ShouldBindJSON(&params); err != nil {
+		requestBodyErrorResponse(c, err)
+		return
+	}
+
+	if len(params) > maxIPAddressesBatchSize {
+		err := fmt.Errorf("%w: at most %d instances can be loaded at once", errBatchTooLarge, maxIPAddressesBatchSize)
+		badRequestResponse(c, err.Error(), err)
+
+		return
+	}
+
+	for i := range params {
+		if err := params[i].validate(r.validate); err != nil {
+			badRequestResponse(c, "invalid request", err)
+			return
+		}
+	}
+
+	resp := &InstanceIPAddressesResponse{Results: []InstanceIPAddressesResult{}}
+
+	for _, param := range params {
+		result := InstanceIPAddressesResult{ID: param.ID}
+
+		err := r.PreWriteHook.Check(c.Request.Context(), prewrite.Change{Kind: prewrite.KindIPAddresses, ID: param.ID, IPAddresses: param.IPAddresses})
+		if err != nil {
+			r.Logger.Sugar().Warn("Pre-write hook didn't approve IP addresses for instance: ", param.ID, " Error: ", err)
+
+			if errors.Is(err, prewrite.ErrRejected) {
+				result.Error = err.Error()
+			} else {
+				result.Error = "service unavailable"
+			}
+
+			resp.Results = append(resp.Results, result)
+
+			continue
+		}
+
+		changes, err := upserter.ReassociateIPsWithOptions(c.Request.Context(), r.DB, r.Logger, param.ID, param.IPAddresses, upserter.UpsertOptions{KeepStaleIPs: !prune, RejectConflicts: r.RejectIPConflicts})
+
+		r.invalidateReadCache(param.ID, param.IPAddresses)
+
+		var conflictErr *upserter.ConflictError
+
+		switch {
+		case errors.As(err, &conflictErr):
+			result.Error = "ip addresses are associated to other instances"
+			result.Conflicts = conflictErr.Conflicts
+		case err != nil:
+			r.Logger.Sugar().Warn("Unable to load IP addresses for instance: ", param.ID, " Error: ", err)
+
+			result.Error = "internal server error"
+		default:
+			result.Changes = changes
+		}
+
+		resp.Results = append(resp.Results, result)
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
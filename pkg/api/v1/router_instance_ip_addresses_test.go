@@ -0,0 +1,111 @@
+package metadataservice_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	"go.hollow.sh/metadataservice/internal/models"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func TestSetIPAddressesThenMetadata(t *testing.T) {
+	router := *testHTTPServer(t)
+	testDB := dbtools.TestDB()
+
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	instanceID := "27f7a3c5-0a3b-44e8-8a3e-6b1fa1a3f0d2"
+	preloadedIPs := []string{"10.99.1.1", "10.99.1.2"}
+
+	reqBody, err := json.Marshal([]v1api.InstanceIPAddressesRequest{{ID: instanceID, IPAddresses: preloadedIPs}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalIPAddressesPath(), bytes.NewReader(reqBody))
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var resp v1api.InstanceIPAddressesResponse
+
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Len(t, resp.Results, 1)
+	assert.Empty(t, resp.Results[0].Error)
+	assert.ElementsMatch(t, preloadedIPs, resp.Results[0].Changes.Added)
+
+	// The instance can be identified by its IP before it has any metadata
+	exists, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(instanceID)).Exists(context.TODO(), testDB)
+	assert.Nil(t, err)
+	assert.True(t, exists)
+
+	// Upserting metadata with prune=false leaves the pre-loaded addresses alone
+	upsert(t, router, v1api.GetInternalMetadataPath()+"?prune=false", v1api.UpsertMetadataRequest{
+		ID:          instanceID,
+		Metadata:    `{"id":"` + instanceID + `"}`,
+		IPAddresses: []string{"10.99.1.3"},
+	})
+
+	addresses, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(instanceID)).All(context.TODO(), testDB)
+	assert.Nil(t, err)
+
+	found := []string{}
+	for _, address := range addresses {
+		found = append(found, address.Address)
+	}
+
+	assert.ElementsMatch(t, []string{"10.99.1.1", "10.99.1.2", "10.99.1.3"}, found)
+
+	// Without prune=false, the stale associations are removed
+	upsert(t, router, v1api.GetInternalMetadataPath(), v1api.UpsertMetadataRequest{
+		ID:          instanceID,
+		Metadata:    `{"id":"` + instanceID + `"}`,
+		IPAddresses: []string{"10.99.1.3"},
+	})
+
+	count, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(instanceID)).Count(context.TODO(), testDB)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), count)
+}
+
+func TestSetIPAddressesInvalidRequest(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	testCases := []struct {
+		testName string
+		path     string
+		body     string
+	}{
+		{"invalid prune param", v1api.GetInternalIPAddressesPath() + "?prune=maybe", `[]`},
+		{"invalid instance ID", v1api.GetInternalIPAddressesPath(), `[{"id":"not-a-uuid","ipAddresses":["10.0.0.1"]}]`},
+		{"invalid IP address", v1api.GetInternalIPAddressesPath(), `[{"id":"27f7a3c5-0a3b-44e8-8a3e-6b1fa1a3f0d2","ipAddresses":["nope"]}]`},
+		{"not a list", v1api.GetInternalIPAddressesPath(), `{}`},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, testcase.path, bytes.NewReader([]byte(testcase.body)))
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package metadataservice
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+
+	"go.hollow.sh/metadataservice/internal/prewrite"
+	"go.hollow.sh/metadataservice/internal/upserter"
+)
+
+// InstanceIPAddressChangeRequest contains the IP addresses to add to, or
+// remove from, a single instance's associations
+type InstanceIPAddressChangeRequest struct {
+	IPAddresses []string `json:"ipAddresses" validate:"required,min=1,dive,ip_addr|cidr"`
+}
+
+func (request *InstanceIPAddressChangeRequest) validate(v *validator.Validate) error {
+	return v.Struct(request)
+}
+
+// InstanceIPAddressChangeResponse is returned when IP addresses are added to,
+// or removed from, an instance. It describes the changes made, along with
+// every IP address associated to the instance afterwards.
+type InstanceIPAddressChangeResponse struct {
+	ID          string                     `json:"id"`
+	IPAddresses []string                   `json:"ip_addresses"`
+	Changes     *upserter.IPAddressChanges `json:"changes"`
+}
+
+// instanceIPAddressesAdd associates additional IP addresses to an instance,
+// without touching its metadata or userdata, like when a running instance is
+// given a new floating IP. Addresses associated to other instances are
+// reassigned, or rejected with a 409 when conflicts are rejected, as they are
+// by an upsert.
+func (r *Router) instanceIPAddressesAdd(c *gin.Context) {
+	instanceID, params, ok := r.instanceIPAddressChangeParams(c)
+	if !ok {
+		return
+	}
+
+	if r.preWriteRejected(c, prewrite.Change{Kind: prewrite.KindIPAddresses, ID: instanceID, IPAddresses: params.IPAddresses}) {
+		return
+	}
+
+	changes, associated, err := upserter.AddIPs(c.Request.Context(), r.DB, r.Logger, instanceID, params.IPAddresses, upserter.UpsertOptions{RejectConflicts: r.RejectIPConflicts})
+
+	r.invalidateReadCache(instanceID, params.IPAddresses)
+
+	if err != nil {
+		r.upsertErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, &InstanceIPAddressChangeResponse{ID: instanceID, IPAddresses: associated, Changes: changes})
+}
+
+// instanceIPAddressesRemove disassociates specific IP addresses from an
+// instance, without touching its metadata, userdata or other associations.
+// Addresses which aren't associated to the instance are ignored.
+func (r *Router) instanceIPAddressesRemove(c *gin.Context) {
+	instanceID, params, ok := r.instanceIPAddressChangeParams(c)
+	if !ok {
+		return
+	}
+
+	changes, associated, err := upserter.RemoveIPs(c.Request.Context(), r.DB, r.Logger, instanceID, params.IPAddresses)
+
+	r.invalidateReadCache(instanceID, params.IPAddresses)
+
+	if err != nil {
+		r.upsertErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, &InstanceIPAddressChangeResponse{ID: instanceID, IPAddresses: associated, Changes: changes})
+}
+
+// instanceIPAddressChangeParams reads the instance ID and the IP addresses to
+// add or remove from the request, responding with a 400 and returning false
+// when either is invalid
+func (r *Router) instanceIPAddressChangeParams(c *gin.Context) (string, InstanceIPAddressChangeRequest, bool) {
+	params := InstanceIPAddressChangeRequest{}
+
+	instanceID, err := r.getInstanceIDParam(c, "instance-id")
+	if err != nil {
+		invalidUUIDResponse(c, err)
+		return "", params, false
+	}
+
+	limitRequestBody(c, r.MaxMetadataBodySize)
+
+	if err := c.ShouldBindJSON(&params); err != nil {
+		requestBodyErrorResponse(c, err)
+		return "", params, false
+	}
+
+	if err := params.validate(r.validate); err != nil {
+		badRequestResponse(c, "Invalid request", err)
+		return "", params, false
+	}
+
+	return instanceID, params, true
+}
@@ -0,0 +1,136 @@
+package metadataservice_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	"go.hollow.sh/metadataservice/internal/models"
+	"go.hollow.sh/metadataservice/internal/upserter"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func changeInstanceIPAddresses(t *testing.T, router http.Handler, method string, id string, ipAddresses []string) (int, v1api.InstanceIPAddressChangeResponse) {
+	t.Helper()
+
+	reqBody, err := json.Marshal(v1api.InstanceIPAddressChangeRequest{IPAddresses: ipAddresses})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), method, v1api.GetInternalInstanceIPAddressesPath(id), bytes.NewReader(reqBody))
+	router.ServeHTTP(w, req)
+
+	var resp v1api.InstanceIPAddressChangeResponse
+
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return w.Code, resp
+}
+
+func TestInstanceIPAddressesAddRemove(t *testing.T) {
+	router := *testHTTPServer(t)
+	testDB := dbtools.TestDB()
+
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	instanceID := dbtools.FixtureInstanceA.InstanceID
+	stolenIP := dbtools.FixtureInstanceB.InstanceIPAddresses[0].Address
+
+	original := []string{}
+	for _, address := range dbtools.FixtureInstanceA.InstanceIPAddresses {
+		original = append(original, address.Address)
+	}
+
+	// Adding keeps the existing associations, and takes the address from the
+	// instance it was associated to
+	code, resp := changeInstanceIPAddresses(t, router, http.MethodPost, instanceID, []string{"10.123.0.1", stolenIP})
+
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, instanceID, resp.ID)
+	assert.ElementsMatch(t, append(append([]string{}, original...), "10.123.0.1", stolenIP), resp.IPAddresses)
+	assert.ElementsMatch(t, []string{"10.123.0.1", stolenIP}, resp.Changes.Added)
+	assert.Empty(t, resp.Changes.Removed)
+	assert.Equal(t, []upserter.ReassignedIP{{Address: stolenIP, PreviousInstanceID: dbtools.FixtureInstanceB.InstanceID}}, resp.Changes.Reassigned)
+
+	stolen, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(dbtools.FixtureInstanceB.InstanceID), models.InstanceIPAddressWhere.Address.EQ(stolenIP)).Exists(context.TODO(), testDB)
+	assert.Nil(t, err)
+	assert.False(t, stolen)
+
+	// Adding an address again changes nothing
+	code, resp = changeInstanceIPAddresses(t, router, http.MethodPost, instanceID, []string{"10.123.0.1"})
+
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, resp.Changes.Added)
+
+	// Removing only drops the given addresses, ignoring those which aren't
+	// associated to the instance
+	code, resp = changeInstanceIPAddresses(t, router, http.MethodDelete, instanceID, []string{"10.123.0.1", stolenIP, "10.123.0.2"})
+
+	assert.Equal(t, http.StatusOK, code)
+	assert.ElementsMatch(t, original, resp.IPAddresses)
+	assert.ElementsMatch(t, []string{"10.123.0.1", stolenIP}, resp.Changes.Removed)
+	assert.Empty(t, resp.Changes.Added)
+
+	// The metadata and userdata are never touched
+	metadata, err := models.FindInstanceMetadatum(context.TODO(), testDB, instanceID)
+	assert.Nil(t, err)
+	assert.JSONEq(t, string(dbtools.FixtureInstanceA.InstanceMetadata.Metadata), string(metadata.Metadata))
+
+	userdata, err := models.FindInstanceUserdatum(context.TODO(), testDB, instanceID)
+	assert.Nil(t, err)
+	assert.Equal(t, dbtools.FixtureInstanceA.InstanceUserdata.Userdata, userdata.Userdata)
+}
+
+func TestInstanceIPAddressesAddRejectConflicts(t *testing.T) {
+	router := *testHTTPServerWithConfig(t, TestServerConfig{RejectConflicts: true})
+
+	code, _ := changeInstanceIPAddresses(t, router, http.MethodPost, dbtools.FixtureInstanceA.InstanceID, []string{dbtools.FixtureInstanceB.InstanceIPAddresses[0].Address})
+
+	assert.Equal(t, http.StatusConflict, code)
+}
+
+func TestInstanceIPAddressesInvalidRequest(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	testCases := []struct {
+		testName     string
+		id           string
+		body         string
+		expectedCode int
+	}{
+		{"invalid instance ID", "not-a-uuid", `{"ipAddresses":["10.0.0.1"]}`, http.StatusNotFound},
+		{"no IP addresses", "27f7a3c5-0a3b-44e8-8a3e-6b1fa1a3f0d2", `{"ipAddresses":[]}`, http.StatusBadRequest},
+		{"invalid IP address", "27f7a3c5-0a3b-44e8-8a3e-6b1fa1a3f0d2", `{"ipAddresses":["nope"]}`, http.StatusBadRequest},
+		{"not an object", "27f7a3c5-0a3b-44e8-8a3e-6b1fa1a3f0d2", `[]`, http.StatusBadRequest},
+	}
+
+	for _, testcase := range testCases {
+		for _, method := range []string{http.MethodPost, http.MethodDelete} {
+			t.Run(testcase.testName+" "+method, func(t *testing.T) {
+				w := httptest.NewRecorder()
+
+				req, _ := http.NewRequestWithContext(context.TODO(), method, v1api.GetInternalInstanceIPAddressesPath(testcase.id), bytes.NewReader([]byte(testcase.body)))
+				router.ServeHTTP(w, req)
+
+				assert.Equal(t, testcase.expectedCode, w.Code)
+			})
+		}
+	}
+}
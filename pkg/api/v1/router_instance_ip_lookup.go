@@ -0,0 +1,63 @@
+package metadataservice
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/netip"
+
+	"github.com/gin-gonic/gin"
+
+	"go.hollow.sh/metadataservice/internal/middleware"
+)
+
+// ipLookupScope is the only scope allowed to look up instances by IP address.
+// The generic read scope isn't enough, since the lookup reveals which instance
+// owns an address.
+const ipLookupScope = scopePrefix + ":read:ip-addresses"
+
+// InstanceByIPResponse reports which instance an IP address is associated to,
+// and whether metadata and userdata are stored for it.
+type InstanceByIPResponse struct {
+	ID string `json:"id"`
+
+	// IPAddress is the associated address the looked up IP matched, which may
+	// be a network containing it
+	IPAddress string `json:"ip_address"`
+
+	Metadata RecordStatus `json:"metadata"`
+	Userdata RecordStatus `json:"userdata"`
+}
+
+// instanceByIPGet looks up the instance an IP address is associated to, the
+// same way an instance making a request from that address would be
+// identified, for operators debugging an instance. It always reads from the
+// database, bypassing the caches used by the instance-facing routes.
+func (r *Router) instanceByIPGet(c *gin.Context) {
+	ip, err := netip.ParseAddr(c.Param("ip-address"))
+	if err != nil {
+		badRequestResponse(c, "invalid ip address", err)
+		return
+	}
+
+	ipAddress, err := middleware.FindInstanceIPAddress(c.Request.Context(), r.DB, ip.Unmap().String())
+
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		notFoundResponse(c)
+		return
+	case err != nil:
+		dbErrorResponse(r.Logger, c, err)
+		return
+	}
+
+	resp := &InstanceByIPResponse{ID: ipAddress.InstanceID, IPAddress: ipAddress.Address}
+
+	resp.Metadata, resp.Userdata, err = r.recordStatuses(c, ipAddress.InstanceID)
+	if err != nil {
+		dbErrorResponse(r.Logger, c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
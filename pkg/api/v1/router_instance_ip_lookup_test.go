@@ -0,0 +1,127 @@
+package metadataservice_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	"go.hollow.sh/metadataservice/internal/upserter"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func TestInstanceByIP(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	type testCase struct {
+		testName       string
+		ip             func() string
+		expectedStatus int
+		expected       v1api.InstanceByIPResponse
+	}
+
+	testCases := []testCase{
+		{
+			"invalid IP",
+			func() string { return "not-an-ip" },
+			http.StatusBadRequest,
+			v1api.InstanceByIPResponse{},
+		},
+		{
+			"unknown IP",
+			func() string { return "203.0.113.10" },
+			http.StatusNotFound,
+			v1api.InstanceByIPResponse{},
+		},
+		{
+			"Instance A",
+			func() string { return dbtools.FixtureInstanceA.HostIPs[0] },
+			http.StatusOK,
+			v1api.InstanceByIPResponse{
+				ID:       dbtools.FixtureInstanceA.InstanceID,
+				Metadata: v1api.RecordStatus{Exists: true},
+				Userdata: v1api.RecordStatus{Exists: true},
+			},
+		},
+		// Instance E only has userdata stored
+		{
+			"Instance E",
+			func() string { return dbtools.FixtureInstanceE.HostIPs[0] },
+			http.StatusOK,
+			v1api.InstanceByIPResponse{
+				ID:       dbtools.FixtureInstanceE.InstanceID,
+				Userdata: v1api.RecordStatus{Exists: true},
+			},
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetInternalInstanceByIPPath(testcase.ip()), nil)
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+
+			if testcase.expectedStatus != http.StatusOK {
+				return
+			}
+
+			var resp v1api.InstanceByIPResponse
+
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, testcase.expected.ID, resp.ID)
+			assert.NotEmpty(t, resp.IPAddress)
+			assert.Equal(t, testcase.expected.Metadata.Exists, resp.Metadata.Exists)
+			assert.Equal(t, testcase.expected.Userdata.Exists, resp.Userdata.Exists)
+		})
+	}
+}
+
+// Test that an address associated to an instance is resolved to it, rather
+// than to another instance associated to a network containing it
+func TestInstanceByIPPrefersExactMatch(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	// Instance D has no IP addresses of its own
+	network := "139.178.82.0/24"
+
+	_, err := upserter.ReassociateIPs(context.TODO(), dbtools.TestDB(), zap.NewNop(), dbtools.FixtureInstanceD.InstanceID, []string{network})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lookup := func(ip string) v1api.InstanceByIPResponse {
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetInternalInstanceByIPPath(ip), nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var resp v1api.InstanceByIPResponse
+
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+
+		return resp
+	}
+
+	resp := lookup("139.178.82.3")
+	assert.Equal(t, dbtools.FixtureInstanceA.InstanceID, resp.ID)
+	assert.Equal(t, "139.178.82.3", resp.IPAddress)
+
+	resp = lookup("139.178.82.4")
+	assert.Equal(t, dbtools.FixtureInstanceD.InstanceID, resp.ID)
+	assert.Equal(t, network, resp.IPAddress)
+}
@@ -0,0 +1,164 @@
+package metadataservice
+
+import (
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/volatiletech/sqlboiler/v4/queries/qm"
+
+	"go.hollow.sh/metadataservice/internal/models"
+	"go.hollow.sh/metadataservice/internal/prewrite"
+	"go.hollow.sh/metadataservice/internal/upserter"
+)
+
+// ReassociateIPsResponse is returned by the IP re-association endpoints, and
+// describes the changes made to the IP address associations for each
+// instance processed.
+type ReassociateIPsResponse struct {
+	Results []ReassociateIPsResult `json:"results"`
+}
+
+// ReassociateIPsResult describes the outcome of re-associating the IP
+// addresses for a single instance.
+type ReassociateIPsResult struct {
+	ID          string                     `json:"id"`
+	IPAddresses []string                   `json:"ip_addresses"`
+	Changes     *upserter.IPAddressChanges `json:"changes,omitempty"`
+	Skipped     bool                       `json:"skipped,omitempty"`
+	Error       string                     `json:"error,omitempty"`
+}
+
+// reassociateIPs re-derives the instance_ip_addresses rows for a single
+// instance from the IP addresses found in its stored metadata. The metadata
+// itself is left unchanged.
+func (r *Router) reassociateIPs(c *gin.Context) {
+	instanceID, err := r.getInstanceIDParam(c, "instance-id")
+
+	if err != nil {
+		invalidUUIDResponse(c, err)
+		return
+	}
+
+	metadata, err := models.FindInstanceMetadatum(c.Request.Context(), r.DB, instanceID)
+
+	if err != nil {
+		dbErrorResponse(r.Logger, c, err)
+		return
+	}
+
+	result := newReassociateIPsResult(metadata)
+
+	if !result.Skipped && r.preWriteRejected(c, prewrite.Change{Kind: prewrite.KindIPAddresses, ID: metadata.ID, IPAddresses: result.IPAddresses}) {
+		return
+	}
+
+	result = r.reassociateInstanceIPs(c, result)
+	if result.Error != "" {
+		c.JSON(http.StatusInternalServerError, &ReassociateIPsResponse{Results: []ReassociateIPsResult{result}})
+		return
+	}
+
+	c.JSON(http.StatusOK, &ReassociateIPsResponse{Results: []ReassociateIPsResult{result}})
+}
+
+// reassociateIPsAll re-derives the instance_ip_addresses rows for every
+// instance with stored metadata. A failure for one instance, including the
+// pre-write hook not approving its addresses, is recorded in its result and
+// does not stop the remaining instances from being processed.
+func (r *Router) reassociateIPsAll(c *gin.Context) {
+	allMetadata, err := models.InstanceMetadata(qm.OrderBy(models.InstanceMetadatumColumns.ID)).All(c.Request.Context(), r.DB)
+
+	if err != nil {
+		dbErrorResponse(r.Logger, c, err)
+		return
+	}
+
+	resp := &ReassociateIPsResponse{Results: []ReassociateIPsResult{}}
+
+	for _, metadata := range allMetadata {
+		result := newReassociateIPsResult(metadata)
+
+		if !result.Skipped {
+			err := r.PreWriteHook.Check(c.Request.Context(), prewrite.Change{Kind: prewrite.KindIPAddresses, ID: metadata.ID, IPAddresses: result.IPAddresses})
+			if err != nil {
+				r.Logger.Sugar().Warn("Pre-write hook didn't approve IP addresses for instance: ", metadata.ID, " Error: ", err)
+
+				if errors.Is(err, prewrite.ErrRejected) {
+					result.Error = err.Error()
+				} else {
+					result.Error = "service unavailable"
+				}
+
+				resp.Results = append(resp.Results, result)
+
+				continue
+			}
+		}
+
+		resp.Results = append(resp.Results, r.reassociateInstanceIPs(c, result))
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// newReassociateIPsResult returns the result of re-associating the addresses
+// found in metadata, before anything is written. If we couldn't find any
+// addresses in the metadata, reconciling against an empty list would just
+// drop every existing association for the instance, which is never what a
+// backfill should do, so the instance is skipped.
+func newReassociateIPsResult(metadata *models.InstanceMetadatum) ReassociateIPsResult {
+	result := ReassociateIPsResult{
+		ID:          metadata.ID,
+		IPAddresses: reassociationIPAddresses(upserter.ExtractIPAddressesFromMetadata(metadata)),
+	}
+
+	result.Skipped = len(result.IPAddresses) == 0
+
+	return result
+}
+
+// reassociateInstanceIPs stores the associations for the addresses in result,
+// unless the instance is skipped. The pre-write hook must already have
+// approved them.
+func (r *Router) reassociateInstanceIPs(c *gin.Context, result ReassociateIPsResult) ReassociateIPsResult {
+	if result.Skipped {
+		return result
+	}
+
+	changes, err := upserter.ReassociateIPs(c.Request.Context(), r.DB, r.Logger, result.ID, result.IPAddresses)
+
+	r.invalidateReadCache(result.ID, result.IPAddresses)
+
+	if err != nil {
+		r.Logger.Sugar().Warn("Unable to re-associate IPs for instance: ", result.ID, " Error: ", err)
+
+		result.Error = "internal server error"
+
+		return result
+	}
+
+	result.Changes = changes
+
+	return result
+}
+
+// reassociationIPAddresses filters the addresses extracted from metadata down
+// to the unique, valid IP addresses that can be stored in instance_ip_addresses
+func reassociationIPAddresses(addresses []string) []string {
+	result := []string{}
+	seen := make(map[string]bool)
+
+	for _, address := range addresses {
+		if net.ParseIP(address) == nil || seen[address] {
+			continue
+		}
+
+		seen[address] = true
+
+		result = append(result, address)
+	}
+
+	return result
+}
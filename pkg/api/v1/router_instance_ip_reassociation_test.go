@@ -0,0 +1,207 @@
+package metadataservice_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	"go.hollow.sh/metadataservice/internal/models"
+	"go.hollow.sh/metadataservice/internal/prewrite"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func TestReassociateIPs(t *testing.T) {
+	router := *testHTTPServer(t)
+	testDB := dbtools.TestDB()
+
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	type testCase struct {
+		testName       string
+		instanceID     string
+		expectedStatus int
+		expectedIPs    []string
+		skipped        bool
+	}
+
+	testCases := []testCase{
+		{
+			"unknown ID",
+			"99c53a90-61c8-472d-95dc-9abeaeb646c9",
+			http.StatusNotFound,
+			nil,
+			false,
+		},
+		{
+			"Instance A",
+			dbtools.FixtureInstanceA.InstanceID,
+			http.StatusOK,
+			[]string{"139.178.82.3", "2604:1380:4641:1f00::9", "10.70.17.9"},
+			false,
+		},
+		// Instance D has no addresses in its metadata, so nothing should change
+		{
+			"Instance D",
+			dbtools.FixtureInstanceD.InstanceID,
+			http.StatusOK,
+			[]string{},
+			true,
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalReassociateIPsByIDPath(testcase.instanceID), nil)
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+
+			if testcase.expectedStatus != http.StatusOK {
+				return
+			}
+
+			var resp v1api.ReassociateIPsResponse
+
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Len(t, resp.Results, 1)
+			assert.Equal(t, testcase.skipped, resp.Results[0].Skipped)
+			assert.ElementsMatch(t, testcase.expectedIPs, resp.Results[0].IPAddresses)
+
+			if testcase.skipped {
+				return
+			}
+
+			ips, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(testcase.instanceID)).All(context.TODO(), testDB)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var addresses []string
+			for _, ip := range ips {
+				addresses = append(addresses, ip.Address)
+			}
+
+			assert.ElementsMatch(t, testcase.expectedIPs, addresses)
+		})
+	}
+}
+
+func TestReassociateIPsAll(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalReassociateIPsPath(), nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var resp v1api.ReassociateIPsResponse
+
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every instance with stored metadata should be reported on
+	ids := []string{}
+	for _, result := range resp.Results {
+		ids = append(ids, result.ID)
+		assert.Empty(t, result.Error)
+	}
+
+	assert.Contains(t, ids, dbtools.FixtureInstanceA.InstanceID)
+	assert.Contains(t, ids, dbtools.FixtureInstanceD.InstanceID)
+	assert.NotContains(t, ids, dbtools.FixtureInstanceE.InstanceID)
+}
+
+func TestReassociateIPsPreWriteHook(t *testing.T) {
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	var received []prewrite.Change
+
+	policyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var change prewrite.Change
+
+		_ = json.NewDecoder(r.Body).Decode(&change)
+		received = append(received, change)
+
+		fmt.Fprint(w, `{"allowed": false, "reason": "not your ip"}`)
+	}))
+	defer policyServer.Close()
+
+	hook, err := prewrite.NewHook(policyServer.URL, 0, policyServer.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := *testHTTPServerWithConfig(t, TestServerConfig{PreWriteHook: hook})
+
+	before, err := models.InstanceIPAddresses().Count(context.TODO(), dbtools.TestDB())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalReassociateIPsByIDPath(dbtools.FixtureInstanceA.InstanceID), nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	if assert.Len(t, received, 1) {
+		assert.Equal(t, prewrite.KindIPAddresses, received[0].Kind)
+		assert.Equal(t, dbtools.FixtureInstanceA.InstanceID, received[0].ID)
+		assert.ElementsMatch(t, []string{"139.178.82.3", "2604:1380:4641:1f00::9", "10.70.17.9"}, received[0].IPAddresses)
+	}
+
+	w = httptest.NewRecorder()
+
+	req, _ = http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalReassociateIPsPath(), nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var resp v1api.ReassociateIPsResponse
+
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every instance with addresses is rejected, while those without any are
+	// skipped without asking the hook
+	for _, result := range resp.Results {
+		if result.Skipped {
+			assert.Empty(t, result.Error)
+		} else {
+			assert.Contains(t, result.Error, "not your ip")
+		}
+	}
+
+	after, err := models.InstanceIPAddresses().Count(context.TODO(), dbtools.TestDB())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, before, after)
+}
@@ -0,0 +1,174 @@
+package metadataservice
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/volatiletech/sqlboiler/v4/queries/qm"
+
+	"go.hollow.sh/metadataservice/internal/models"
+)
+
+const (
+	// defaultInstanceListLimit is the number of instances returned per page
+	// when no limit is given
+	defaultInstanceListLimit = 100
+
+	// maxInstanceListLimit is the most instances returned per page
+	maxInstanceListLimit = 1000
+
+	// instanceListScope is the only scope allowed to list instances. The
+	// generic read scope isn't enough, since the listing enumerates every
+	// instance the service knows about.
+	instanceListScope = scopePrefix + ":read:instances"
+)
+
+// InstanceListResponse contains a page of the instances with stored metadata,
+// least recently updated first. NextCursor is set when there are more
+// instances to fetch.
+type InstanceListResponse struct {
+	Instances  []InstanceListItem `json:"instances"`
+	NextCursor string             `json:"next_cursor,omitempty"`
+}
+
+// InstanceListItem is a single instance in the listing
+type InstanceListItem struct {
+	ID             string    `json:"id"`
+	IPAddressCount int       `json:"ip_address_count"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// instanceListCursor is the position in the listing a page continues from:
+// the last instance of the previous page. It's handed to clients encoded, so
+// they treat it as opaque.
+type instanceListCursor struct {
+	UpdatedAt time.Time `json:"updated_at"`
+	ID        string    `json:"id"`
+}
+
+// encode returns the cursor in the form returned to clients
+func (cur instanceListCursor) encode() string {
+	b, _ := json.Marshal(cur)
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// parseInstanceListCursor reads the cursor query param, returning nil when
+// the first page is requested
+func parseInstanceListCursor(c *gin.Context) (*instanceListCursor, error) {
+	param := c.Query("cursor")
+	if param == "" {
+		return nil, nil
+	}
+
+	cur := &instanceListCursor{}
+
+	b, err := base64.RawURLEncoding.DecodeString(param)
+	if err == nil {
+		err = json.Unmarshal(b, cur)
+	}
+
+	if err != nil || cur.ID == "" {
+		return nil, fmt.Errorf("%w: cursor must be a next_cursor returned by a previous request", ErrInvalidParam)
+	}
+
+	return cur, nil
+}
+
+// instanceList returns a page of the instances with stored metadata matching
+// the request filters, along with how many IP addresses are associated to each
+// and when its metadata was last updated, so external systems can reconcile
+// what the service knows about. Pages are ordered by update time, then ID,
+// and continue from the cursor returned by the previous page, so instances
+// aren't skipped or repeated when others are added between requests.
+func (r *Router) instanceList(c *gin.Context) {
+	filter, err := parseInstanceFilter(c)
+	if err != nil {
+		badRequestResponse(c, err.Error(), err)
+		return
+	}
+
+	limit, err := getIntParam(c, "limit", defaultInstanceListLimit, 1, maxInstanceListLimit)
+	if err != nil {
+		badRequestResponse(c, err.Error(), err)
+		return
+	}
+
+	cur, err := parseInstanceListCursor(c)
+	if err != nil {
+		badRequestResponse(c, err.Error(), err)
+		return
+	}
+
+	mods := filter.queryMods()
+	mods = append(mods,
+		qm.Select(models.InstanceMetadatumColumns.ID, models.InstanceMetadatumColumns.UpdatedAt),
+		qm.OrderBy(models.InstanceMetadatumColumns.UpdatedAt+", "+models.InstanceMetadatumColumns.ID),
+		// Fetch one more than the page, to know whether there's another page
+		qm.Limit(limit+1),
+	)
+
+	if cur != nil {
+		mods = append(mods, qm.Where("(instance_metadata.updated_at, instance_metadata.id) > (?, ?)", cur.UpdatedAt, cur.ID))
+	}
+
+	metadata, err := models.InstanceMetadata(mods...).All(c.Request.Context(), r.DB)
+	if err != nil {
+		dbErrorResponse(r.Logger, c, err)
+		return
+	}
+
+	resp := &InstanceListResponse{Instances: []InstanceListItem{}}
+
+	if len(metadata) > limit {
+		metadata = metadata[:limit]
+
+		last := metadata[len(metadata)-1]
+		resp.NextCursor = instanceListCursor{UpdatedAt: last.UpdatedAt, ID: last.ID}.encode()
+	}
+
+	counts, err := r.ipAddressCounts(c, metadata)
+	if err != nil {
+		dbErrorResponse(r.Logger, c, err)
+		return
+	}
+
+	for _, m := range metadata {
+		resp.Instances = append(resp.Instances, InstanceListItem{ID: m.ID, IPAddressCount: counts[m.ID], UpdatedAt: m.UpdatedAt})
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// ipAddressCounts returns the number of IP addresses associated to each of
+// the instances, by instance ID
+func (r *Router) ipAddressCounts(c *gin.Context, metadata models.InstanceMetadatumSlice) (map[string]int, error) {
+	counts := make(map[string]int, len(metadata))
+
+	ids := make([]interface{}, 0, len(metadata))
+	for _, m := range metadata {
+		ids = append(ids, m.ID)
+	}
+
+	if len(ids) == 0 {
+		return counts, nil
+	}
+
+	ips, err := models.InstanceIPAddresses(
+		qm.Select(models.InstanceIPAddressColumns.InstanceID),
+		qm.WhereIn(models.InstanceIPAddressColumns.InstanceID+" IN ?", ids...),
+	).All(c.Request.Context(), r.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ip := range ips {
+		counts[ip.InstanceID]++
+	}
+
+	return counts, nil
+}
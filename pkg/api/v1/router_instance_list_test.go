@@ -0,0 +1,106 @@
+package metadataservice_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+// listInstances requests a page of the instance listing
+func listInstances(t *testing.T, router http.Handler, query url.Values) (int, v1api.InstanceListResponse) {
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetInternalInstancesPath()+"?"+query.Encode(), nil)
+	router.ServeHTTP(w, req)
+
+	var resp v1api.InstanceListResponse
+
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return w.Code, resp
+}
+
+func TestInstanceList(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	// Instances E and F have no metadata stored, so aren't listed
+	expectedCounts := map[string]int{
+		dbtools.FixtureInstanceA.InstanceID:  len(dbtools.FixtureInstanceA.InstanceIPAddresses),
+		dbtools.FixtureInstanceA1.InstanceID: len(dbtools.FixtureInstanceA1.InstanceIPAddresses),
+		dbtools.FixtureInstanceA2.InstanceID: len(dbtools.FixtureInstanceA2.InstanceIPAddresses),
+		dbtools.FixtureInstanceB.InstanceID:  len(dbtools.FixtureInstanceB.InstanceIPAddresses),
+		dbtools.FixtureInstanceC.InstanceID:  len(dbtools.FixtureInstanceC.InstanceIPAddresses),
+		dbtools.FixtureInstanceD.InstanceID:  len(dbtools.FixtureInstanceD.InstanceIPAddresses),
+	}
+
+	t.Run("pages through every instance", func(t *testing.T) {
+		counts := map[string]int{}
+		query := url.Values{"limit": []string{"4"}}
+		pages := 0
+
+		for {
+			status, resp := listInstances(t, router, query)
+			assert.Equal(t, http.StatusOK, status)
+
+			pages++
+
+			for i, instance := range resp.Instances {
+				_, seen := counts[instance.ID]
+				assert.False(t, seen, "instance %s listed twice", instance.ID)
+				assert.False(t, instance.UpdatedAt.IsZero())
+
+				if i > 0 {
+					assert.False(t, instance.UpdatedAt.Before(resp.Instances[i-1].UpdatedAt))
+				}
+
+				counts[instance.ID] = instance.IPAddressCount
+			}
+
+			if resp.NextCursor == "" {
+				break
+			}
+
+			query.Set("cursor", resp.NextCursor)
+		}
+
+		assert.Equal(t, 2, pages)
+		assert.Equal(t, expectedCounts, counts)
+	})
+
+	t.Run("filters", func(t *testing.T) {
+		status, resp := listInstances(t, router, url.Values{"subnet": []string{"145.40.77.21"}})
+		assert.Equal(t, http.StatusOK, status)
+		assert.Len(t, resp.Instances, 1)
+		assert.Empty(t, resp.NextCursor)
+
+		status, resp = listInstances(t, router, url.Values{"updated_since": []string{"2999-01-01T00:00:00Z"}})
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, []v1api.InstanceListItem{}, resp.Instances)
+	})
+
+	invalid := []url.Values{
+		{"limit": []string{"0"}},
+		{"limit": []string{"1001"}},
+		{"cursor": []string{"not-a-cursor"}},
+		{"updated_since": []string{"yesterday"}},
+	}
+
+	for _, query := range invalid {
+		t.Run("invalid "+query.Encode(), func(t *testing.T) {
+			status, _ := listInstances(t, router, query)
+			assert.Equal(t, http.StatusBadRequest, status)
+		})
+	}
+}
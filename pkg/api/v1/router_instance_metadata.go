@@ -5,31 +5,55 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"math/rand"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
 	"github.com/spf13/viper"
 	"github.com/volatiletech/null/v8"
 	"github.com/volatiletech/sqlboiler/v4/types"
+	"go.hollow.sh/toolbox/ginjwt"
 
+	"go.hollow.sh/metadataservice/internal/apierror"
+	"go.hollow.sh/metadataservice/internal/instancetags"
 	"go.hollow.sh/metadataservice/internal/middleware"
 	"go.hollow.sh/metadataservice/internal/models"
+	"go.hollow.sh/metadataservice/internal/prewrite"
+	"go.hollow.sh/metadataservice/internal/publickeys"
 	"go.hollow.sh/metadataservice/internal/upserter"
+	"go.hollow.sh/metadataservice/internal/userdata"
 )
 
 // UpsertMetadataRequest contains the fields for inserting or updating an
 // instances metadata.
 type UpsertMetadataRequest struct {
-	ID          string   `json:"id" validate:"required,uuid"`
+	ID          string   `json:"id" validate:"required,instance_id"`
 	Metadata    string   `json:"metadata" validate:"required,json"`
 	IPAddresses []string `json:"ipAddresses" validate:"dive,ip_addr|cidr"`
+
+	// PublicKeys, when given, replaces the SSH public keys served to the
+	// instance under public-keys/, along with the metadata
+	PublicKeys []publickeys.Key `json:"public_keys,omitempty"`
+
+	// Tags, when given, replaces the key/value tags attached to the instance,
+	// along with the metadata
+	Tags map[string]string `json:"tags,omitempty"`
 }
 
-func (upsertRequest *UpsertMetadataRequest) validate() error {
-	return validate.Struct(upsertRequest)
+func (upsertRequest *UpsertMetadataRequest) validate(v *validator.Validate) error {
+	if err := v.Struct(upsertRequest); err != nil {
+		return err
+	}
+
+	if err := publickeys.Validate(upsertRequest.PublicKeys); err != nil {
+		return err
+	}
+
+	return instancetags.Validate(upsertRequest.Tags)
 }
 
 func (upsertRequest UpsertMetadataRequest) getID() string {
@@ -43,13 +67,24 @@ func (upsertRequest UpsertMetadataRequest) getIPAddresses() []string {
 // UpsertUserdataRequest contains the fields for inserting or updating an
 // instances userdata.
 type UpsertUserdataRequest struct {
-	ID          string   `json:"id" validate:"required,uuid"`
+	ID          string   `json:"id" validate:"required,instance_id"`
 	Userdata    []byte   `json:"userdata"`
 	IPAddresses []string `json:"ipAddresses" validate:"dive,ip_addr|cidr"`
+
+	// Encoding is how the userdata is encoded, when it's already encoded by
+	// the client. It's decoded before it's served to the instance.
+	Encoding string `json:"encoding,omitempty" validate:"omitempty,oneof=raw base64"`
 }
 
-func (upsertRequest *UpsertUserdataRequest) validate() error {
-	return validate.Struct(upsertRequest)
+func (upsertRequest *UpsertUserdataRequest) validate(v *validator.Validate) error {
+	if err := v.Struct(upsertRequest); err != nil {
+		return err
+	}
+
+	// Make sure stored userdata can always be decoded when it's served
+	_, err := userdata.Decode(upsertRequest.Userdata, upsertRequest.Encoding)
+
+	return err
 }
 
 func (upsertRequest UpsertUserdataRequest) getID() string {
@@ -61,6 +96,12 @@ func (upsertRequest UpsertUserdataRequest) getIPAddresses() []string {
 }
 
 func (r *Router) instanceMetadataGet(c *gin.Context) {
+	r.serveInstanceMetadata(c, r.defaultMetadataOrNotFound)
+}
+
+// serveInstanceMetadata serves the metadata for the instance making the
+// request, calling notFound when there's none to serve.
+func (r *Router) serveInstanceMetadata(c *gin.Context, notFound gin.HandlerFunc) {
 	metadata, err := r.getMetadata(c)
 
 	// If we got an error trying to retrieve metadata for the caller, and the
@@ -72,28 +113,39 @@ func (r *Router) instanceMetadataGet(c *gin.Context) {
 	}
 
 	if metadata != nil {
-		augmentedMetadata, err := addTemplateFields(metadata.Metadata, r.TemplateFields)
+		servedMetadata, modified := r.withInstanceTags(c, metadata, r.servedMetadata(c, metadata))
+
+		augmentedMetadata, err := r.withTemplateFields(servedMetadata, metadata.ID, c.GetString(middleware.ContextKeyRequestorIP))
 		if err != nil {
-			r.Logger.Sugar().Warnf("Error adding additional templated fields to metadata for instance %s", metadata.ID, "error", err)
+			// The metadata isn't an object, so it can only be returned as-is
+			r.resourceJSONResponse(c, etagResourceMetadata, servedMetadata, modified)
+
+			return
+		}
 
-			// Since we couldn't add the templated fields, just return the metadata as-is
-			c.JSON(http.StatusOK, metadata.Metadata)
+		if fields := getFieldsParam(c); fields != nil {
+			// Only the requested fields (templated ones included) are served.
+			// Shared caches mustn't store the projection, which could then be
+			// served in place of the full document.
+			c.Header("Cache-Control", "private")
+			r.resourceJSONResponse(c, projectedResource(etagResourceMetadata, fields), projectMetadata(augmentedMetadata, fields), modified)
 		} else {
-			c.JSON(http.StatusOK, augmentedMetadata)
+			r.resourceJSONResponse(c, etagResourceMetadata, augmentedMetadata, modified)
 		}
 	} else {
-		notFoundResponse(c)
+		notFound(c)
 	}
 }
 
 // instanceMetadataGetInternal retrieves the requested instance ID from the
 // path and looks to see if the database has metadata recorded for that ID.
-// If so, it returns a copy of the stored metadata. If not, it will just return
-// a 404. This can be used by an authenticated external system to determine
-// which instances the metadata service already knows about, and which
-// instances may still need their metadata pushed to the service.
+// If so, it returns a copy of the stored metadata, with its version in the
+// ETag and X-Record-Version headers. If not, it will just return a 404. This
+// can be used by an authenticated external system to determine which
+// instances the metadata service already knows about, and which instances may
+// still need their metadata pushed to the service.
 func (r *Router) instanceMetadataGetInternal(c *gin.Context) {
-	instanceID, err := getUUIDParam(c, "instance-id")
+	instanceID, err := r.getInstanceIDParam(c, "instance-id")
 
 	if err != nil {
 		invalidUUIDResponse(c, err)
@@ -110,11 +162,11 @@ func (r *Router) instanceMetadataGetInternal(c *gin.Context) {
 		return
 	}
 
-	augmentedMetadata, err := addTemplateFields(metadata.Metadata, r.TemplateFields)
-	if err != nil {
-		r.Logger.Sugar().Warnf("Error adding additional templated fields to metadata for instance %s", metadata.ID, "error", err)
+	setRecordVersionHeader(c, metadata.UpdatedAt)
 
-		// Since we couldn't add the templated fields, just return the metadata as-is
+	augmentedMetadata, err := r.withTemplateFields(metadata.Metadata, metadata.ID, "")
+	if err != nil {
+		// The metadata isn't an object, so it can only be returned as-is
 		c.JSON(http.StatusOK, metadata.Metadata)
 	} else {
 		c.JSON(http.StatusOK, augmentedMetadata)
@@ -127,7 +179,7 @@ func (r *Router) instanceMetadataGetInternal(c *gin.Context) {
 // authenticated external system to determine which instances the metadata
 // service already knows about with minimal network overhead.
 func (r *Router) instanceMetadataExistsInternal(c *gin.Context) {
-	instanceID, err := getUUIDParam(c, "instance-id")
+	instanceID, err := r.getInstanceIDParam(c, "instance-id")
 
 	if err != nil {
 		invalidUUIDResponse(c, err)
@@ -151,6 +203,7 @@ func (r *Router) instanceMetadataExistsInternal(c *gin.Context) {
 		return
 	}
 
+	setRecordVersionHeader(c, metadata.UpdatedAt)
 	c.Writer.Header().Set("Content-Length", strconv.Itoa(len(bytes)))
 	c.Status(http.StatusOK)
 }
@@ -167,7 +220,7 @@ func (r *Router) instanceUserdataGet(c *gin.Context) {
 	}
 
 	if userdata != nil {
-		c.String(http.StatusOK, string(userdata.Userdata.Bytes))
+		r.resourceResponse(c, etagResourceUserdata, contentTypeText, r.UserdataTransformer.Transform(userdata.Userdata.Bytes), userdata.UpdatedAt)
 	} else {
 		notFoundResponse(c)
 	}
@@ -175,12 +228,13 @@ func (r *Router) instanceUserdataGet(c *gin.Context) {
 
 // instanceUserdataGetInternal retrieves the requested instance ID from the
 // path and looks to see if the database has userdata recorded for that ID.
-// If so, it returns a copy of the stored userdata. If not, it will just return
-// a 404. This can be used by an authenticated external system to determine
-// which instances the userdata service already knows about, and which
-// instances may still need their userdata pushed to the service.
+// If so, it returns a copy of the stored userdata, with its version in the
+// ETag and X-Record-Version headers. If not, it will just return a 404. This
+// can be used by an authenticated external system to determine which
+// instances the userdata service already knows about, and which instances may
+// still need their userdata pushed to the service.
 func (r *Router) instanceUserdataGetInternal(c *gin.Context) {
-	instanceID, err := getUUIDParam(c, "instance-id")
+	instanceID, err := r.getInstanceIDParam(c, "instance-id")
 
 	if err != nil {
 		invalidUUIDResponse(c, err)
@@ -197,6 +251,7 @@ func (r *Router) instanceUserdataGetInternal(c *gin.Context) {
 		return
 	}
 
+	setRecordVersionHeader(c, userdata.UpdatedAt)
 	c.String(http.StatusOK, string(userdata.Userdata.Bytes))
 }
 
@@ -206,7 +261,7 @@ func (r *Router) instanceUserdataGetInternal(c *gin.Context) {
 // by an authenticated external system to determine which instances the userdata
 // service already knows about with minimal network overhead.
 func (r *Router) instanceUserdataExistsInternal(c *gin.Context) {
-	instanceID, err := getUUIDParam(c, "instance-id")
+	instanceID, err := r.getInstanceIDParam(c, "instance-id")
 
 	if err != nil {
 		invalidUUIDResponse(c, err)
@@ -222,6 +277,7 @@ func (r *Router) instanceUserdataExistsInternal(c *gin.Context) {
 
 	// HEAD request responses still set the Content-Length header to what it
 	// would be if we were returning the userdata
+	setRecordVersionHeader(c, userdata.UpdatedAt)
 	c.Writer.Header().Set("Content-Length", strconv.Itoa(len(userdata.Userdata.Bytes)))
 	c.Status(http.StatusOK)
 }
@@ -250,63 +306,173 @@ func (r *Router) instanceUserdataExistsInternal(c *gin.Context) {
 func (r *Router) instanceMetadataSet(c *gin.Context) {
 	params := UpsertMetadataRequest{}
 
+	prune, err := getPruneParam(c)
+	if err != nil {
+		badRequestResponse(c, err.Error(), err)
+		return
+	}
+
+	dryRun, err := getDryRunParam(c)
+	if err != nil {
+		badRequestResponse(c, err.Error(), err)
+		return
+	}
+
+	expectedUpdatedAt, err := getRecordVersionHeader(c)
+	if err != nil {
+		badRequestResponse(c, err.Error(), err)
+		return
+	}
+
+	limitRequestBody(c, r.MaxMetadataBodySize)
+
 	// Step 0
 	// Validate the request body
-	if err := c.BindJSON(&params); err != nil {
-		badRequestResponse(c, "invalid request body", err)
+	if err := c.ShouldBindJSON(&params); err != nil {
+		requestBodyErrorResponse(c, err)
 		return
 	}
 
-	if err := params.validate(); err != nil {
+	if err := params.validate(r.validate); err != nil {
 		badRequestResponse(c, "Invalid request", err)
 		return
 	}
 
+	if r.metadataSchemaRejected(c, params.Metadata) {
+		return
+	}
+
+	if r.instanceQuotaExceeded(c, params.ID) {
+		return
+	}
+
+	if r.StableInstanceID {
+		if metadataID, mismatch := metadataIDMismatch(params.ID, params.Metadata); mismatch {
+			r.Logger.Sugar().Warn("Metadata for instance ", params.ID, " has an id of ", metadataID, ", the instance id will be served instead")
+		}
+	}
+
+	change := prewrite.Change{
+		Kind:        prewrite.KindMetadata,
+		ID:          params.ID,
+		IPAddresses: params.getIPAddresses(),
+		Metadata:    json.RawMessage(params.Metadata),
+	}
+
+	if r.preWriteRejected(c, change) {
+		return
+	}
+
 	newInstanceMetadata := &models.InstanceMetadatum{
 		ID:       params.getID(),
 		Metadata: types.JSON(params.Metadata),
 	}
 
-	err := upserter.UpsertMetadata(c, r.DB, r.Logger, params.ID, params.getIPAddresses(), newInstanceMetadata)
+	if r.iplessRejected(c, params.getIPAddresses(), newInstanceMetadata, prune) {
+		return
+	}
+
+	opts := upserter.UpsertOptions{KeepStaleIPs: !prune, RejectConflicts: r.RejectIPConflicts, Events: r.Events, RecordHistory: r.MetadataHistory, ChangedBy: ginjwt.GetSubject(c), PublicKeys: params.PublicKeys, Tags: params.Tags, ExpectedUpdatedAt: expectedUpdatedAt}
+
+	if dryRun {
+		r.upsertPlanResponse(c, params.ID, params.getIPAddresses(), opts)
+		return
+	}
+
+	changes, err := upserter.UpsertMetadataWithOptions(c.Request.Context(), r.DB, r.Logger, params.ID, params.getIPAddresses(), newInstanceMetadata, opts)
+
+	r.invalidateReadCache(params.ID, append(params.getIPAddresses(), upserter.ExtractIPAddressesFromMetadata(newInstanceMetadata)...))
+
 	if err != nil {
-		dbErrorResponse(r.Logger, c, err)
+		r.upsertErrorResponse(c, err)
+		return
 	}
 
-	c.Status(http.StatusOK)
+	c.JSON(http.StatusOK, &UpsertResponse{ID: params.ID, Changes: changes})
 }
 
 func (r *Router) instanceUserdataSet(c *gin.Context) {
 	params := UpsertUserdataRequest{}
 
+	prune, err := getPruneParam(c)
+	if err != nil {
+		badRequestResponse(c, err.Error(), err)
+		return
+	}
+
+	dryRun, err := getDryRunParam(c)
+	if err != nil {
+		badRequestResponse(c, err.Error(), err)
+		return
+	}
+
+	expectedUpdatedAt, err := getRecordVersionHeader(c)
+	if err != nil {
+		badRequestResponse(c, err.Error(), err)
+		return
+	}
+
+	limitRequestBody(c, r.MaxUserdataBodySize)
+
 	// Validate the request
-	if err := c.BindJSON(&params); err != nil {
-		badRequestResponse(c, "invalid request body", err)
+	if err := c.ShouldBindJSON(&params); err != nil {
+		requestBodyErrorResponse(c, err)
+		return
+	}
+
+	if err := params.validate(r.validate); err != nil {
+		badRequestResponse(c, "invalid request", err)
 		return
 	}
 
-	if err := params.validate(); err != nil {
+	if err := r.validateIgnitionUserdata(params.Userdata, params.Encoding); err != nil {
 		badRequestResponse(c, "invalid request", err)
 		return
 	}
 
+	if r.instanceQuotaExceeded(c, params.ID) {
+		return
+	}
+
+	change := prewrite.Change{
+		Kind:        prewrite.KindUserdata,
+		ID:          params.ID,
+		IPAddresses: params.getIPAddresses(),
+	}
+
+	if r.preWriteRejected(c, change) {
+		return
+	}
+
 	newInstanceUserdata := &models.InstanceUserdatum{
 		ID:       params.getID(),
 		Userdata: null.NewBytes(params.Userdata, true),
 	}
 
-	err := upserter.UpsertUserdata(c, r.DB, r.Logger, params.ID, params.getIPAddresses(), newInstanceUserdata)
+	opts := upserter.UpsertOptions{KeepStaleIPs: !prune, UserdataEncoding: params.Encoding, RejectConflicts: r.RejectIPConflicts, Events: r.Events, ExpectedUpdatedAt: expectedUpdatedAt}
+
+	if dryRun {
+		r.upsertPlanResponse(c, params.ID, params.getIPAddresses(), opts)
+		return
+	}
+
+	changes, err := upserter.UpsertUserdataWithOptions(c.Request.Context(), r.DB, r.Logger, params.ID, params.getIPAddresses(), newInstanceUserdata, opts)
+
+	r.invalidateReadCache(params.ID, params.getIPAddresses())
+
 	if err != nil {
-		dbErrorResponse(r.Logger, c, err)
+		r.upsertErrorResponse(c, err)
+		return
 	}
 
-	c.Status(http.StatusOK)
+	c.JSON(http.StatusOK, &UpsertResponse{ID: params.ID, Changes: changes})
 }
 
 func (r *Router) instanceMetadataDelete(c *gin.Context) {
 	// When deleting metadata for an instance, we need to check if there is
 	// userdata stored for the instance. If there is not, we should go ahead and
 	// also delete the associated instance_ip_addresses rows.
-	instanceID, err := getUUIDParam(c, "instance-id")
+	instanceID, err := r.getInstanceIDParam(c, "instance-id")
 
 	if err != nil {
 		invalidUUIDResponse(c, err)
@@ -321,6 +487,10 @@ func (r *Router) instanceMetadataDelete(c *gin.Context) {
 		return
 	}
 
+	if r.deleteBlockedByRecentFetch(c, instanceID) {
+		return
+	}
+
 	handleDeleteRequest(c, r, instanceID, metadata, nil)
 }
 
@@ -328,7 +498,7 @@ func (r *Router) instanceUserdataDelete(c *gin.Context) {
 	// When deleting userdata for an instance, we need to check if there is
 	// metadata stored for the instance. If there is not, we should go ahead and
 	// also delete the associated instance_ip_addresses rows.
-	instanceID, err := getUUIDParam(c, "instance-id")
+	instanceID, err := r.getInstanceIDParam(c, "instance-id")
 
 	if err != nil {
 		invalidUUIDResponse(c, err)
@@ -343,15 +513,63 @@ func (r *Router) instanceUserdataDelete(c *gin.Context) {
 		return
 	}
 
+	if r.deleteBlockedByRecentFetch(c, instanceID) {
+		return
+	}
+
 	handleDeleteRequest(c, r, instanceID, nil, userdata)
 }
 
+// deleteBlockedByRecentFetch checks the unless_fetched_within query param of a
+// delete request, which allows the caller to refuse the delete while the
+// instance may still be booting. If the instance's metadata was fetched within
+// the given duration, it responds with a 409 and returns true. Deletes without
+// the param are unconditional.
+func (r *Router) deleteBlockedByRecentFetch(c *gin.Context, instanceID string) bool {
+	param := c.Query(unlessFetchedWithinParam)
+	if param == "" {
+		return false
+	}
+
+	window, err := time.ParseDuration(param)
+	if err != nil || window <= 0 {
+		err = fmt.Errorf("%w: %s must be a positive duration, like 10m", errInvalidDeleteCondition, unlessFetchedWithinParam)
+		badRequestResponse(c, err.Error(), err)
+
+		return true
+	}
+
+	if r.FetchRecorder == nil {
+		err = fmt.Errorf("%w: %s requires last fetch recording to be enabled", errInvalidDeleteCondition, unlessFetchedWithinParam)
+		badRequestResponse(c, err.Error(), err)
+
+		return true
+	}
+
+	fetch, err := r.FetchRecorder.Last(c.Request.Context(), instanceID)
+	if err != nil {
+		dbErrorResponse(r.Logger, c, err)
+		return true
+	}
+
+	if fetch != nil && time.Since(fetch.FetchedAt) < window {
+		apierror.Abort(c, http.StatusConflict, ErrorCodeRecentlyFetched, "instance metadata was fetched recently",
+			fmt.Sprintf("last fetched at %s from %s", fetch.FetchedAt.Format(time.RFC3339), fetch.SourceIP))
+
+		return true
+	}
+
+	return false
+}
+
 func handleDeleteRequest(c *gin.Context, r *Router, instanceID string, metadata *models.InstanceMetadatum, userdata *models.InstanceUserdatum) {
 	var err error
 
 	deleteMetadata := metadata != nil
 	deleteUserdata := userdata != nil
 
+	defer r.invalidateReadCache(instanceID, nil)
+
 	maxDeleteRetries := viper.GetInt("crdb.max_retries")
 	dbRetryInterval := viper.GetDuration("crdb.retry_interval")
 
@@ -479,6 +697,15 @@ func performDeleteTX(c *gin.Context, r *Router, instanceID string, metadata *mod
 
 			return err
 		}
+
+		err = upserter.SetUserdataEncoding(cWithTimeout, tx, instanceID, "")
+		if err != nil {
+			txErr = true
+
+			r.Logger.Sugar().Warn("Something went wrong when removing the userdata encoding for instance: ", instanceID, "Error: ", err)
+
+			return err
+		}
 	}
 
 	// Commit our transaction
@@ -542,3 +769,33 @@ func performIPDeleteTX(c *gin.Context, r *Router, instanceID string) error {
 
 	return nil
 }
+
+// UpsertResponse is returned by a successful metadata or userdata upsert. It
+// describes the changes made to the instance's IP address associations: the
+// addresses added, the stale addresses removed, and the addresses reassigned
+// from other instances.
+type UpsertResponse struct {
+	ID      string                     `json:"id"`
+	Changes *upserter.IPAddressChanges `json:"changes"`
+}
+
+// UpsertPlanResponse is returned by an upsert made with dry_run=true. It
+// describes the changes the upsert would make to the instance's IP address
+// associations, none of which were made.
+type UpsertPlanResponse struct {
+	ID      string                     `json:"id"`
+	DryRun  bool                       `json:"dry_run"`
+	Changes *upserter.IPAddressChanges `json:"changes"`
+}
+
+// upsertPlanResponse responds to a dry run of an upsert with the changes it
+// would make to the instance's IP address associations
+func (r *Router) upsertPlanResponse(c *gin.Context, instanceID string, ipAddresses []string, opts upserter.UpsertOptions) {
+	changes, err := upserter.PlanUpsert(c.Request.Context(), r.DB, r.Logger, instanceID, ipAddresses, opts)
+	if err != nil {
+		r.upsertErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, &UpsertPlanResponse{ID: instanceID, DryRun: true, Changes: changes})
+}
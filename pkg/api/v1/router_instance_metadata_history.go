@@ -0,0 +1,93 @@
+package metadataservice
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"go.hollow.sh/metadataservice/internal/metadatahistory"
+)
+
+const (
+	// defaultMetadataHistoryLimit is the number of versions returned per page
+	// of metadata history when no limit is given
+	defaultMetadataHistoryLimit = 20
+
+	// maxMetadataHistoryLimit is the most versions returned per page of
+	// metadata history
+	maxMetadataHistoryLimit = 100
+)
+
+// MetadataHistoryResponse contains a page of the previous versions of an
+// instance's metadata, most recently replaced first. NextOffset is set when
+// there are more versions to fetch.
+type MetadataHistoryResponse struct {
+	ID         string                    `json:"id"`
+	Versions   []metadatahistory.Version `json:"versions"`
+	NextOffset *int                      `json:"next_offset,omitempty"`
+}
+
+// instanceMetadataHistoryGet returns the previous versions of the metadata
+// for an instance, most recently replaced first. The limit and offset query
+// params page through them. The metadata currently stored isn't included, it's
+// served by instanceMetadataGetInternal.
+func (r *Router) instanceMetadataHistoryGet(c *gin.Context) {
+	instanceID, err := r.getInstanceIDParam(c, "instance-id")
+	if err != nil {
+		invalidUUIDResponse(c, err)
+		return
+	}
+
+	limit, err := getIntParam(c, "limit", defaultMetadataHistoryLimit, 1, maxMetadataHistoryLimit)
+	if err != nil {
+		badRequestResponse(c, err.Error(), err)
+		return
+	}
+
+	offset, err := getIntParam(c, "offset", 0, 0, -1)
+	if err != nil {
+		badRequestResponse(c, err.Error(), err)
+		return
+	}
+
+	// Fetch one more than the page, to know whether there's another page
+	versions, err := metadatahistory.List(c.Request.Context(), r.DB, instanceID, limit+1, offset)
+	if err != nil {
+		dbErrorResponse(r.Logger, c, err)
+		return
+	}
+
+	resp := &MetadataHistoryResponse{ID: instanceID, Versions: versions}
+
+	if len(versions) > limit {
+		resp.Versions = versions[:limit]
+
+		nextOffset := offset + limit
+		resp.NextOffset = &nextOffset
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// getIntParam reads an integer query param, which must be at least minValue,
+// and at most maxValue unless maxValue is negative. def is returned when the
+// param isn't given.
+func getIntParam(c *gin.Context, name string, def, minValue, maxValue int) (int, error) {
+	param := c.Query(name)
+	if param == "" {
+		return def, nil
+	}
+
+	value, err := strconv.Atoi(param)
+
+	switch {
+	case err != nil, value < minValue:
+		return 0, fmt.Errorf("%w: %s must be an integer of at least %d", ErrInvalidParam, name, minValue)
+	case maxValue >= 0 && value > maxValue:
+		return 0, fmt.Errorf("%w: %s must be at most %d", ErrInvalidParam, name, maxValue)
+	}
+
+	return value, nil
+}
@@ -0,0 +1,105 @@
+package metadataservice_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func getMetadataHistory(t *testing.T, router http.Handler, path string) *v1api.MetadataHistoryResponse {
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, path, nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var resp v1api.MetadataHistoryResponse
+
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	return &resp
+}
+
+func TestMetadataHistory(t *testing.T) {
+	router := *testHTTPServerWithConfig(t, TestServerConfig{MetadataHistory: true})
+	instanceID := dbtools.FixtureInstanceA.InstanceID
+
+	for i := 1; i <= 3; i++ {
+		upsert(t, router, v1api.GetInternalMetadataPath(), v1api.UpsertMetadataRequest{
+			ID:          instanceID,
+			Metadata:    fmt.Sprintf(`{"version":%d}`, i),
+			IPAddresses: dbtools.FixtureInstanceA.HostIPs,
+		})
+	}
+
+	resp := getMetadataHistory(t, router, v1api.GetInternalMetadataHistoryPath(instanceID)+"?limit=2")
+
+	assert.Equal(t, instanceID, resp.ID)
+	assert.Len(t, resp.Versions, 2)
+	assert.JSONEq(t, `{"version":2}`, string(resp.Versions[0].Metadata))
+	assert.JSONEq(t, `{"version":1}`, string(resp.Versions[1].Metadata))
+
+	if assert.NotNil(t, resp.NextOffset) {
+		assert.Equal(t, 2, *resp.NextOffset)
+	}
+
+	resp = getMetadataHistory(t, router, fmt.Sprintf("%s?limit=2&offset=%d", v1api.GetInternalMetadataHistoryPath(instanceID), *resp.NextOffset))
+
+	assert.Len(t, resp.Versions, 1)
+	assert.JSONEq(t, string(dbtools.FixtureInstanceA.InstanceMetadata.Metadata), string(resp.Versions[0].Metadata))
+	assert.Nil(t, resp.NextOffset)
+
+	// An instance without history has an empty list
+	resp = getMetadataHistory(t, router, v1api.GetInternalMetadataHistoryPath(dbtools.FixtureInstanceB.InstanceID))
+
+	assert.Empty(t, resp.Versions)
+}
+
+func TestMetadataHistoryInvalidRequest(t *testing.T) {
+	router := *testHTTPServerWithConfig(t, TestServerConfig{MetadataHistory: true})
+	historyPath := v1api.GetInternalMetadataHistoryPath(dbtools.FixtureInstanceA.InstanceID)
+
+	testCases := []struct {
+		testName string
+		path     string
+	}{
+		{"zero limit", historyPath + "?limit=0"},
+		{"limit too large", historyPath + "?limit=101"},
+		{"invalid limit", historyPath + "?limit=ten"},
+		{"negative offset", historyPath + "?offset=-1"},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, testcase.path, nil)
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+		})
+	}
+}
+
+func TestMetadataHistoryDisabled(t *testing.T) {
+	router := *testHTTPServer(t)
+	instanceID := dbtools.FixtureInstanceA.InstanceID
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetInternalMetadataHistoryPath(instanceID), nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,135 @@
+package metadataservice
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/volatiletech/sqlboiler/v4/types"
+	"go.hollow.sh/toolbox/ginjwt"
+
+	"go.hollow.sh/metadataservice/internal/apierror"
+	"go.hollow.sh/metadataservice/internal/metadataschema"
+	"go.hollow.sh/metadataservice/internal/models"
+	"go.hollow.sh/metadataservice/internal/prewrite"
+	"go.hollow.sh/metadataservice/internal/upserter"
+)
+
+// ContentTypeMergePatch is the Content-Type of an RFC 7386 JSON merge patch
+const ContentTypeMergePatch = "application/merge-patch+json"
+
+// instanceMetadataPatch merges an RFC 7386 JSON merge patch into the
+// instance's stored metadata, so systems owning different parts of it don't
+// overwrite each other. The patch is checked against the metadata stored
+// now, like a full upsert, then applied again to the metadata locked in the
+// upsert's transaction, where the IP addresses are reconciled with those in
+// network.addresses of the patched metadata. Unlike a full upsert, the
+// associations missing from there are only removed with prune=true.
+func (r *Router) instanceMetadataPatch(c *gin.Context) {
+	instanceID, err := r.getInstanceIDParam(c, "instance-id")
+	if err != nil {
+		invalidUUIDResponse(c, err)
+		return
+	}
+
+	prune, err := getPatchPruneParam(c)
+	if err != nil {
+		badRequestResponse(c, err.Error(), err)
+		return
+	}
+
+	expectedUpdatedAt, err := getRecordVersionHeader(c)
+	if err != nil {
+		badRequestResponse(c, err.Error(), err)
+		return
+	}
+
+	if contentType := c.ContentType(); contentType != ContentTypeMergePatch && contentType != gin.MIMEJSON {
+		apierror.Abort(c, http.StatusUnsupportedMediaType, ErrorCodeUnsupportedMediaType, "the patch must be sent as "+ContentTypeMergePatch)
+		return
+	}
+
+	limitRequestBody(c, r.MaxMetadataBodySize)
+
+	patch, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		requestBodyErrorResponse(c, err)
+		return
+	}
+
+	stored, err := models.FindInstanceMetadatum(c.Request.Context(), r.DB, instanceID)
+	if err != nil {
+		dbErrorResponse(r.Logger, c, err)
+		return
+	}
+
+	patched, err := upserter.MergePatch(stored.Metadata, patch)
+	if err != nil {
+		badRequestResponseWithCode(c, ErrorCodeInvalidRequestBody, "invalid request body", err)
+		return
+	}
+
+	if r.metadataSchemaRejected(c, string(patched)) {
+		return
+	}
+
+	patchedMetadata := &models.InstanceMetadatum{
+		ID:       instanceID,
+		Metadata: types.JSON(patched),
+	}
+
+	ipAddresses := upserter.ExtractIPAddressesFromMetadata(patchedMetadata)
+
+	if err := upserter.ValidateIPAddresses(ipAddresses); err != nil {
+		badRequestResponseWithCode(c, ErrorCodeInvalidRequestBody, "invalid request body", err)
+		return
+	}
+
+	change := prewrite.Change{
+		Kind:        prewrite.KindMetadata,
+		ID:          instanceID,
+		IPAddresses: ipAddresses,
+		Metadata:    json.RawMessage(patched),
+	}
+
+	if r.preWriteRejected(c, change) {
+		return
+	}
+
+	if r.iplessRejected(c, nil, patchedMetadata, prune) {
+		return
+	}
+
+	opts := upserter.UpsertOptions{KeepStaleIPs: !prune, RejectConflicts: r.RejectIPConflicts, Events: r.Events, RecordHistory: r.MetadataHistory, ChangedBy: ginjwt.GetSubject(c), ExpectedUpdatedAt: expectedUpdatedAt}
+
+	changes, err := upserter.PatchMetadataWithOptions(c.Request.Context(), r.DB, r.Logger, instanceID, patch, r.MetadataSchema.Validate, opts)
+
+	r.invalidateReadCache(instanceID, append(ipAddresses, upserter.ExtractIPAddressesFromMetadata(stored)...))
+
+	if err != nil {
+		r.patchErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, &UpsertResponse{ID: instanceID, Changes: changes})
+}
+
+// patchErrorResponse responds to an error applying a patch in the upsert's
+// transaction, where the stored metadata may have changed since the patch
+// was checked
+func (r *Router) patchErrorResponse(c *gin.Context, err error) {
+	var validationErr *metadataschema.ValidationError
+
+	switch {
+	case errors.Is(err, upserter.ErrMetadataNotFound):
+		notFoundResponse(c)
+	case errors.Is(err, upserter.ErrInvalidMergePatch):
+		badRequestResponseWithCode(c, ErrorCodeInvalidRequestBody, "invalid request body", err)
+	case errors.As(err, &validationErr):
+		r.metadataSchemaErrorResponse(c, err)
+	default:
+		r.upsertErrorResponse(c, err)
+	}
+}
@@ -0,0 +1,100 @@
+package metadataservice_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/volatiletech/sqlboiler/v4/boil"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	"go.hollow.sh/metadataservice/internal/models"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func patchMetadata(t *testing.T, router http.Handler, instanceID, contentType, patch string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPatch, v1api.GetInternalMetadataByIDPath(instanceID), strings.NewReader(patch))
+	req.Header.Set("Content-Type", contentType)
+	router.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestPatchMetadata(t *testing.T) {
+	router := *testHTTPServer(t)
+	testDB := dbtools.TestDB()
+
+	w := patchMetadata(t, router, dbtools.FixtureInstanceA.InstanceID, v1api.ContentTypeMergePatch, `{"hostname":"patched","plan":null}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	instanceMetadata, err := models.FindInstanceMetadatum(context.TODO(), testDB, dbtools.FixtureInstanceA.InstanceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(instanceMetadata.Metadata, &fields); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "patched", fields["hostname"])
+	assert.NotContains(t, fields, "plan")
+
+	// Fields the patch doesn't mention are kept
+	assert.Contains(t, fields, "network")
+}
+
+func TestPatchMetadataKeepsUnlistedIPAddresses(t *testing.T) {
+	router := *testHTTPServer(t)
+	testDB := dbtools.TestDB()
+
+	// An association added on its own, which isn't listed in the metadata
+	added := models.InstanceIPAddress{InstanceID: dbtools.FixtureInstanceA.InstanceID, Address: "198.51.100.7"}
+	if err := added.Insert(context.TODO(), testDB, boil.Infer()); err != nil {
+		t.Fatal(err)
+	}
+
+	w := patchMetadata(t, router, dbtools.FixtureInstanceA.InstanceID, v1api.ContentTypeMergePatch, `{"hostname":"patched"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	exists, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.Address.EQ("198.51.100.7")).Exists(context.TODO(), testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, exists)
+}
+
+func TestPatchMetadataErrors(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	testCases := []struct {
+		testName       string
+		instanceID     string
+		contentType    string
+		patch          string
+		expectedStatus int
+	}{
+		{"unknown instance", "6bd001dd-0523-4002-93e9-36a98607638a", v1api.ContentTypeMergePatch, `{"hostname":"patched"}`, http.StatusNotFound},
+		{"invalid instance id", "not-a-uuid", v1api.ContentTypeMergePatch, `{"hostname":"patched"}`, http.StatusBadRequest},
+		{"unsupported content type", dbtools.FixtureInstanceA.InstanceID, "text/plain", `{"hostname":"patched"}`, http.StatusUnsupportedMediaType},
+		{"patch isn't an object", dbtools.FixtureInstanceA.InstanceID, v1api.ContentTypeMergePatch, `["hostname"]`, http.StatusBadRequest},
+		{"patch isn't json", dbtools.FixtureInstanceA.InstanceID, v1api.ContentTypeMergePatch, `hostname`, http.StatusBadRequest},
+		{"invalid ip address", dbtools.FixtureInstanceA.InstanceID, v1api.ContentTypeMergePatch, `{"network":{"addresses":[{"address":"not-an-ip"}]}}`, http.StatusBadRequest},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := patchMetadata(t, router, testcase.instanceID, testcase.contentType, testcase.patch)
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+		})
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"regexp"
+	"strings"
 	"testing"
 	"text/template"
 	"time"
@@ -18,6 +19,8 @@ import (
 
 	"go.hollow.sh/metadataservice/internal/dbtools"
 	"go.hollow.sh/metadataservice/internal/models"
+	"go.hollow.sh/metadataservice/internal/prewrite"
+	"go.hollow.sh/metadataservice/internal/upserter"
 	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
 )
 
@@ -222,6 +225,19 @@ func TestGetMetadataByIPWithErrorTemplate(t *testing.T) {
 	v, ok := resultMap["missingField"]
 	assert.False(t, ok)
 	assert.Nil(t, v)
+
+	// The other routes serving templated metadata fall back the same way
+	for _, path := range []string{v1api.GetBootConfigPath(), v1api.GetInstanceDataPath(), v1api.GetInternalMetadataByIDPath(dbtools.FixtureInstanceA.InstanceID)} {
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, path, nil)
+		req.RemoteAddr = net.JoinHostPort(dbtools.FixtureInstanceA.HostIPs[0], "0")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code, path)
+		assert.Contains(t, w.Body.String(), dbtools.FixtureInstanceA.InstanceID, path)
+		assert.NotContains(t, w.Body.String(), "missing_field", path)
+	}
 }
 
 // TestSetMetadataRequestValidations tests the different validations performed
@@ -306,6 +322,53 @@ func TestSetMetadataRequestValidations(t *testing.T) {
 	}
 }
 
+func TestSetMetadataRequestBodyTooLarge(t *testing.T) {
+	maxBodySize := int64(1024)
+	router := *testHTTPServerWithConfig(t, TestServerConfig{MaxBodySize: maxBodySize})
+
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	type testCase struct {
+		testName       string
+		metadataSize   int
+		expectedStatus int
+	}
+
+	testCases := []testCase{
+		{
+			"body within the limit",
+			64,
+			http.StatusOK,
+		},
+		{
+			"body over the limit",
+			int(maxBodySize) * 2,
+			http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			reqBody, err := json.Marshal(&v1api.UpsertMetadataRequest{
+				ID:       "b9b24320-304e-4bfb-b46a-db75901c2f46",
+				Metadata: fmt.Sprintf(`{"some": "%s"}`, strings.Repeat("a", testcase.metadataSize)),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalMetadataPath(), bytes.NewReader(reqBody))
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+		})
+	}
+}
+
 // TestSetMetadataIPAddressConflict tests the actions performed when the
 // incoming request specifies an IP address (or multiple IP addresses) that are
 // currently associated to another instance.
@@ -510,6 +573,552 @@ func TestSetMetadataUpsertMetadata(t *testing.T) {
 	assert.Equal(t, requestBody.Metadata, instanceMetadata.Metadata.String())
 }
 
+func TestSetMetadataInstanceQuota(t *testing.T) {
+	// The fixtures already exceed the limit
+	router := *testHTTPServerWithConfig(t, TestServerConfig{MaxInstances: 1})
+
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	type testCase struct {
+		testName       string
+		requestBody    *v1api.UpsertMetadataRequest
+		expectedStatus int
+	}
+
+	testCases := []testCase{
+		{
+			"new instance",
+			&v1api.UpsertMetadataRequest{
+				ID:          "b94fa75b-1fee-45eb-9925-83011c4834b9",
+				Metadata:    `{"some": "json"}`,
+				IPAddresses: []string{"192.168.0.1/25"},
+			},
+			http.StatusForbidden,
+		},
+		{
+			"existing instance",
+			&v1api.UpsertMetadataRequest{
+				ID:          dbtools.FixtureInstanceA.InstanceID,
+				Metadata:    `{"some": "json"}`,
+				IPAddresses: dbtools.FixtureInstanceA.HostIPs,
+			},
+			http.StatusOK,
+		},
+		{
+			"existing instance with only userdata",
+			&v1api.UpsertMetadataRequest{
+				ID:          dbtools.FixtureInstanceE.InstanceID,
+				Metadata:    `{"some": "json"}`,
+				IPAddresses: dbtools.FixtureInstanceE.HostIPs,
+			},
+			http.StatusOK,
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			reqBody, err := json.Marshal(testcase.requestBody)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalMetadataPath(), bytes.NewReader(reqBody))
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+		})
+	}
+}
+
+func TestGetMetadataFields(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	testCases := []struct {
+		testName     string
+		query        string
+		expectedBody string
+	}{
+		{
+			"single field",
+			"?fields=hostname",
+			`{"hostname":"instance-a"}`,
+		},
+		{
+			"several fields with unknown ones ignored",
+			"?fields=hostname,+facility,unknown,",
+			`{"hostname":"instance-a","facility":"da11"}`,
+		},
+		{
+			"only unknown fields",
+			"?fields=unknown",
+			`{}`,
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetMetadataPath()+testcase.query, nil)
+			req.RemoteAddr = net.JoinHostPort(dbtools.FixtureInstanceA.HostIPs[0], "0")
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.JSONEq(t, testcase.expectedBody, w.Body.String())
+			assert.Equal(t, "private", w.Header().Get("Cache-Control"))
+		})
+	}
+
+	// Without the param, or with it empty, the full document is served
+	for _, query := range []string{"", "?fields="} {
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetMetadataPath()+query, nil)
+		req.RemoteAddr = net.JoinHostPort(dbtools.FixtureInstanceA.HostIPs[0], "0")
+		router.ServeHTTP(w, req)
+
+		assert.JSONEq(t, dbtools.FixtureInstanceA.InstanceMetadata.Metadata.String(), w.Body.String())
+		assert.Empty(t, w.Header().Get("Cache-Control"))
+	}
+}
+
+// Test that a projection of the metadata can't be revalidated as the full
+// document
+func TestGetMetadataFieldsETag(t *testing.T) {
+	router := *testHTTPServerWithConfig(t, TestServerConfig{ETags: true})
+
+	get := func(query string, ifNoneMatch string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetMetadataPath()+query, nil)
+		req.RemoteAddr = net.JoinHostPort(dbtools.FixtureInstanceA.HostIPs[0], "0")
+		req.Header.Set("If-None-Match", ifNoneMatch)
+		router.ServeHTTP(w, req)
+
+		return w
+	}
+
+	full := get("", "").Header().Get("ETag")
+	projected := get("?fields=hostname", "").Header().Get("ETag")
+
+	assert.NotEmpty(t, projected)
+	assert.NotEqual(t, full, projected)
+	assert.NotEqual(t, projected, get("?fields=hostname,facility", "").Header().Get("ETag"))
+
+	// Each only revalidates itself
+	assert.Equal(t, http.StatusOK, get("", projected).Code)
+	assert.Equal(t, http.StatusOK, get("?fields=hostname", full).Code)
+	assert.Equal(t, http.StatusNotModified, get("?fields=hostname", projected).Code)
+}
+
+// TestSetMetadataRejectIPConflicts tests that, in reject mode, an upsert which
+// would take IP addresses from other instances is rejected, listing the
+// addresses' current owners.
+func TestSetMetadataRejectIPConflicts(t *testing.T) {
+	router := *testHTTPServerWithConfig(t, TestServerConfig{RejectConflicts: true})
+	testDB := dbtools.TestDB()
+
+	requestBody := &v1api.UpsertMetadataRequest{
+		ID:          "6bd001dd-0523-4002-93e9-36a98607638a",
+		Metadata:    `{"some": "json"}`,
+		IPAddresses: []string{dbtools.FixtureInstanceA.HostIPs[0], dbtools.FixtureInstanceB.HostIPs[0], "10.200.0.1"},
+	}
+
+	reqBody, err := json.Marshal(requestBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalMetadataPath(), bytes.NewReader(reqBody))
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	resp := v1api.IPConflictResponse{}
+
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.ElementsMatch(t, []upserter.IPConflict{
+		{Address: dbtools.FixtureInstanceA.HostIPs[0], InstanceID: dbtools.FixtureInstanceA.InstanceID},
+		{Address: dbtools.FixtureInstanceB.HostIPs[0], InstanceID: dbtools.FixtureInstanceB.InstanceID},
+	}, resp.Error.Conflicts)
+	assert.Equal(t, v1api.ErrorCodeIPAddressConflict, resp.Error.Code)
+
+	// Nothing was written, and the addresses still belong to their owners
+	exists, err := models.InstanceMetadatumExists(context.TODO(), testDB, requestBody.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.False(t, exists)
+
+	owner, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.Address.EQ(dbtools.FixtureInstanceA.HostIPs[0])).One(context.TODO(), testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, dbtools.FixtureInstanceA.InstanceID, owner.InstanceID)
+}
+
+// TestSetMetadataDryRun tests that a dry run reports the changes an upsert
+// would make to the IP address associations, without writing anything.
+func TestSetMetadataDryRun(t *testing.T) {
+	router := *testHTTPServer(t)
+	testDB := dbtools.TestDB()
+
+	requestBody := &v1api.UpsertMetadataRequest{
+		ID:          "6bd001dd-0523-4002-93e9-36a98607638a",
+		Metadata:    `{"some": "json"}`,
+		IPAddresses: []string{dbtools.FixtureInstanceA.HostIPs[0], "10.200.0.1"},
+	}
+
+	for _, path := range []string{v1api.GetInternalMetadataPath(), v1api.GetInternalUserdataPath()} {
+		w := postJSON(t, router, path+"?dry_run=true", requestBody)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		resp := v1api.UpsertPlanResponse{}
+
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, requestBody.ID, resp.ID)
+		assert.True(t, resp.DryRun)
+
+		if assert.NotNil(t, resp.Changes) {
+			assert.ElementsMatch(t, requestBody.IPAddresses, resp.Changes.Added)
+			assert.Empty(t, resp.Changes.Removed)
+			assert.Equal(t, []upserter.ReassignedIP{{Address: dbtools.FixtureInstanceA.HostIPs[0], PreviousInstanceID: dbtools.FixtureInstanceA.InstanceID}}, resp.Changes.Reassigned)
+		}
+	}
+
+	exists, err := models.InstanceMetadatumExists(context.TODO(), testDB, requestBody.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.False(t, exists)
+
+	owner, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.Address.EQ(dbtools.FixtureInstanceA.HostIPs[0])).One(context.TODO(), testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, dbtools.FixtureInstanceA.InstanceID, owner.InstanceID)
+
+	w := postJSON(t, router, v1api.GetInternalMetadataPath()+"?dry_run=maybe", requestBody)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestSetMetadataReturnsChanges(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	requestBody := &v1api.UpsertMetadataRequest{
+		ID:          "6bd001dd-0523-4002-93e9-36a98607638a",
+		Metadata:    `{"some": "json"}`,
+		IPAddresses: []string{dbtools.FixtureInstanceA.HostIPs[0], "10.200.0.1"},
+	}
+
+	getChanges := func(w *httptest.ResponseRecorder) *upserter.IPAddressChanges {
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		resp := v1api.UpsertResponse{}
+
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, requestBody.ID, resp.ID)
+
+		if resp.Changes == nil {
+			t.Fatal("expected the response to include the changes")
+		}
+
+		return resp.Changes
+	}
+
+	changes := getChanges(postJSON(t, router, v1api.GetInternalMetadataPath(), requestBody))
+	assert.ElementsMatch(t, requestBody.IPAddresses, changes.Added)
+	assert.Empty(t, changes.Removed)
+	assert.Equal(t, []upserter.ReassignedIP{{Address: dbtools.FixtureInstanceA.HostIPs[0], PreviousInstanceID: dbtools.FixtureInstanceA.InstanceID}}, changes.Reassigned)
+
+	// Dropping an address from a userdata upsert removes it
+	requestBody.IPAddresses = requestBody.IPAddresses[1:]
+
+	changes = getChanges(postJSON(t, router, v1api.GetInternalUserdataPath(), requestBody))
+	assert.Empty(t, changes.Added)
+	assert.Equal(t, []string{dbtools.FixtureInstanceA.HostIPs[0]}, changes.Removed)
+	assert.Empty(t, changes.Reassigned)
+}
+
+// TestSetMetadataIPless tests the IP-less instances policy for metadata
+// upserts with no ipAddresses and no network block.
+func TestSetMetadataIPless(t *testing.T) {
+	testCases := []struct {
+		testName       string
+		policy         v1api.IPlessPolicy
+		path           string
+		metadata       string
+		ipAddresses    []string
+		expectedStatus int
+	}{
+		{
+			"default allows no network block",
+			"",
+			v1api.GetInternalMetadataPath(),
+			`{"hostname": "ipless"}`,
+			nil,
+			http.StatusOK,
+		},
+		{
+			"warn allows no network block",
+			v1api.IPlessWarn,
+			v1api.GetInternalMetadataPath(),
+			`{"hostname": "ipless"}`,
+			nil,
+			http.StatusOK,
+		},
+		{
+			"reject rejects no network block",
+			v1api.IPlessReject,
+			v1api.GetInternalMetadataPath(),
+			`{"hostname": "ipless"}`,
+			nil,
+			http.StatusBadRequest,
+		},
+		{
+			"reject rejects an empty network block",
+			v1api.IPlessReject,
+			v1api.GetInternalMetadataPath(),
+			`{"hostname": "ipless", "network": {"addresses": []}}`,
+			nil,
+			http.StatusBadRequest,
+		},
+		{
+			"reject allows ipAddresses",
+			v1api.IPlessReject,
+			v1api.GetInternalMetadataPath(),
+			`{"hostname": "ipless"}`,
+			[]string{"10.210.0.1"},
+			http.StatusOK,
+		},
+		{
+			"reject allows network addresses",
+			v1api.IPlessReject,
+			v1api.GetInternalMetadataPath(),
+			`{"hostname": "ipless", "network": {"addresses": [{"address": "10.210.0.2", "cidr": 32}]}}`,
+			nil,
+			http.StatusOK,
+		},
+		{
+			"reject allows upserts which keep existing addresses",
+			v1api.IPlessReject,
+			v1api.GetInternalMetadataPath() + "?prune=false",
+			`{"hostname": "ipless"}`,
+			nil,
+			http.StatusOK,
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			router := *testHTTPServerWithConfig(t, TestServerConfig{IPlessPolicy: testcase.policy})
+			testDB := dbtools.TestDB()
+
+			requestBody := &v1api.UpsertMetadataRequest{
+				ID:          "4c0f1b8e-6a3d-4c6e-9a53-5c8a0e1d2f3b",
+				Metadata:    testcase.metadata,
+				IPAddresses: testcase.ipAddresses,
+			}
+
+			reqBody, err := json.Marshal(requestBody)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, testcase.path, bytes.NewReader(reqBody))
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+
+			exists, err := models.InstanceMetadatumExists(context.TODO(), testDB, requestBody.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, testcase.expectedStatus == http.StatusOK, exists)
+		})
+	}
+}
+
+func TestParseIPlessPolicy(t *testing.T) {
+	testCases := []struct {
+		policy   string
+		expected v1api.IPlessPolicy
+		err      error
+	}{
+		{"", v1api.IPlessAllow, nil},
+		{"allow", v1api.IPlessAllow, nil},
+		{"warn", v1api.IPlessWarn, nil},
+		{"reject", v1api.IPlessReject, nil},
+		{"drop", "", v1api.ErrInvalidIPlessPolicy},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.policy, func(t *testing.T) {
+			policy, err := v1api.ParseIPlessPolicy(testcase.policy)
+			assert.ErrorIs(t, err, testcase.err)
+			assert.Equal(t, testcase.expected, policy)
+		})
+	}
+}
+
+func TestSetDataTimesOut(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	// Every transaction runs out of time before it starts
+	viper.Set("crdb.max_retries", 0)
+	viper.Set("crdb.tx_timeout", time.Nanosecond)
+
+	t.Cleanup(func() {
+		viper.Set("crdb.max_retries", 5)
+		viper.Set("crdb.tx_timeout", 15*time.Second)
+	})
+
+	testCases := []struct {
+		testName    string
+		path        string
+		requestBody interface{}
+	}{
+		{
+			"metadata",
+			v1api.GetInternalMetadataPath(),
+			&v1api.UpsertMetadataRequest{
+				ID:          dbtools.FixtureInstanceA.InstanceID,
+				Metadata:    `{"some": "json"}`,
+				IPAddresses: dbtools.FixtureInstanceA.HostIPs,
+			},
+		},
+		{
+			"userdata",
+			v1api.GetInternalUserdataPath(),
+			&v1api.UpsertUserdataRequest{
+				ID:          dbtools.FixtureInstanceA.InstanceID,
+				Userdata:    []byte("some userdata"),
+				IPAddresses: dbtools.FixtureInstanceA.HostIPs,
+			},
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			reqBody, err := json.Marshal(testcase.requestBody)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, testcase.path, bytes.NewReader(reqBody))
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+			assert.Equal(t, "5", w.Header().Get("Retry-After"))
+		})
+	}
+}
+
+func TestSetDataPreWriteHook(t *testing.T) {
+	testCases := []struct {
+		testName       string
+		status         int
+		body           string
+		expectedStatus int
+	}{
+		{
+			"approved",
+			http.StatusOK,
+			`{"allowed": true}`,
+			http.StatusOK,
+		},
+		{
+			"rejected",
+			http.StatusOK,
+			`{"allowed": false, "reason": "not your ip"}`,
+			http.StatusForbidden,
+		},
+		{
+			"hook unavailable",
+			http.StatusBadGateway,
+			``,
+			http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			var received prewrite.Change
+
+			policyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_ = json.NewDecoder(r.Body).Decode(&received)
+
+				w.WriteHeader(testcase.status)
+				fmt.Fprint(w, testcase.body)
+			}))
+			defer policyServer.Close()
+
+			hook, err := prewrite.NewHook(policyServer.URL, 0, policyServer.Client())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			router := *testHTTPServerWithConfig(t, TestServerConfig{PreWriteHook: hook})
+
+			reqBody, err := json.Marshal(&v1api.UpsertMetadataRequest{
+				ID:          dbtools.FixtureInstanceA.InstanceID,
+				Metadata:    `{"some":"json"}`,
+				IPAddresses: dbtools.FixtureInstanceA.HostIPs,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalMetadataPath(), bytes.NewReader(reqBody))
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+			assert.Equal(t, prewrite.KindMetadata, received.Kind)
+			assert.Equal(t, dbtools.FixtureInstanceA.InstanceID, received.ID)
+			assert.Equal(t, dbtools.FixtureInstanceA.HostIPs, received.IPAddresses)
+
+			// Only approved changes are written
+			metadata, err := models.FindInstanceMetadatum(context.TODO(), dbtools.TestDB(), dbtools.FixtureInstanceA.InstanceID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if testcase.expectedStatus == http.StatusOK {
+				assert.JSONEq(t, `{"some":"json"}`, string(metadata.Metadata))
+			} else {
+				assert.NotContains(t, string(metadata.Metadata), "some")
+			}
+		})
+	}
+}
+
 func TestDeleteMetadata(t *testing.T) {
 	router := *testHTTPServer(t)
 	testDB := dbtools.TestDB()
@@ -609,6 +1218,67 @@ func TestDeleteMetadata(t *testing.T) {
 	}
 }
 
+func TestDeleteMetadataUnlessFetchedWithin(t *testing.T) {
+	router := *testHTTPServerWithConfig(t, TestServerConfig{LastFetch: true})
+
+	viper.SetDefault("crdb.max_retries", 5)
+	viper.SetDefault("crdb.retry_interval", 1*time.Second)
+	viper.SetDefault("crdb.tx_timeout", 15*time.Second)
+
+	deletePath := func(instanceID string, window string) string {
+		return v1api.GetInternalMetadataByIDPath(instanceID) + "?unless_fetched_within=" + window
+	}
+
+	// Instance A fetches its metadata
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetMetadataPath(), nil)
+	req.RemoteAddr = net.JoinHostPort(dbtools.FixtureInstanceA.HostIPs[0], "0")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	type testCase struct {
+		testName       string
+		path           string
+		expectedStatus int
+	}
+
+	testCases := []testCase{
+		{
+			"invalid duration",
+			deletePath(dbtools.FixtureInstanceA.InstanceID, "soon"),
+			http.StatusBadRequest,
+		},
+		{
+			"fetched within the window",
+			deletePath(dbtools.FixtureInstanceA.InstanceID, "1h"),
+			http.StatusConflict,
+		},
+		{
+			"never fetched",
+			deletePath(dbtools.FixtureInstanceB.InstanceID, "1h"),
+			http.StatusOK,
+		},
+		{
+			"unconditional",
+			v1api.GetInternalMetadataByIDPath(dbtools.FixtureInstanceA.InstanceID),
+			http.StatusOK,
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodDelete, testcase.path, nil)
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+		})
+	}
+}
+
 // metadataString is a helper function that ensures the db fixture string is marshaled
 // in a way that we can properly calculate its length for Content-Length comparisons
 func metadataString(metadata interface{}) string {
@@ -0,0 +1,130 @@
+package metadataservice
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/volatiletech/sqlboiler/v4/types"
+
+	"go.hollow.sh/metadataservice/internal/apierror"
+	"go.hollow.sh/metadataservice/internal/instancetags"
+	"go.hollow.sh/metadataservice/internal/metadataschema"
+	"go.hollow.sh/metadataservice/internal/models"
+	"go.hollow.sh/metadataservice/internal/publickeys"
+	"go.hollow.sh/metadataservice/internal/upserter"
+)
+
+// ValidateMetadataResponse is returned for a metadata upsert request which
+// passed validation. It describes what the upsert would store, none of which
+// was stored.
+type ValidateMetadataResponse struct {
+	ID string `json:"id"`
+
+	// IPAddresses are the addresses the instance would be associated to
+	IPAddresses []string `json:"ip_addresses"`
+
+	// MetadataIPAddresses are the addresses found in the metadata's
+	// network.addresses
+	MetadataIPAddresses []string `json:"metadata_ip_addresses"`
+}
+
+// instanceMetadataValidate checks a metadata upsert request against the same
+// rules as instanceMetadataSet, without storing anything or reading from the
+// database. It responds with a 200 describing the request when it's valid, or
+// a 422 listing every rule it broke.
+//
+// The instance quota and the pre-write hook depend on what's already stored,
+// or on another service, so they're only checked by the real upsert.
+func (r *Router) instanceMetadataValidate(c *gin.Context) {
+	params := UpsertMetadataRequest{}
+
+	prune, err := getPruneParam(c)
+	if err != nil {
+		badRequestResponse(c, err.Error(), err)
+		return
+	}
+
+	limitRequestBody(c, r.MaxMetadataBodySize)
+
+	if err := c.ShouldBindJSON(&params); err != nil {
+		requestBodyErrorResponse(c, err)
+		return
+	}
+
+	problems, err := r.metadataProblems(params, prune)
+	if err != nil {
+		r.metadataSchemaErrorResponse(c, err)
+		return
+	}
+
+	if len(problems) > 0 {
+		apierror.Abort(c, http.StatusUnprocessableEntity, ErrorCodeInvalidMetadata, "invalid metadata", problems...)
+		return
+	}
+
+	resp := &ValidateMetadataResponse{
+		ID:                  params.ID,
+		IPAddresses:         params.IPAddresses,
+		MetadataIPAddresses: upserter.ExtractIPAddressesFromMetadata(&models.InstanceMetadatum{ID: params.ID, Metadata: types.JSON(params.Metadata)}),
+	}
+
+	if resp.IPAddresses == nil {
+		resp.IPAddresses = []string{}
+	}
+
+	if resp.MetadataIPAddresses == nil {
+		resp.MetadataIPAddresses = []string{}
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// metadataProblems returns a description of every way the upsert request
+// breaks the rules an upsert is held to. An error is only returned when the
+// request couldn't be checked at all.
+func (r *Router) metadataProblems(params UpsertMetadataRequest, prune bool) ([]string, error) {
+	var problems []string
+
+	if err := r.validate.Struct(&params); err != nil {
+		var validationErrs validator.ValidationErrors
+		if errors.As(err, &validationErrs) {
+			problems = append(problems, getErrorMessagesFromError(validationErrs)...)
+		} else {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if err := publickeys.Validate(params.PublicKeys); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if err := instancetags.Validate(params.Tags); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	// Metadata which isn't JSON has already been reported, and can't be
+	// checked any further
+	if !json.Valid([]byte(params.Metadata)) {
+		return problems, nil
+	}
+
+	if err := r.MetadataSchema.Validate([]byte(params.Metadata)); err != nil {
+		var schemaErr *metadataschema.ValidationError
+		if !errors.As(err, &schemaErr) {
+			return nil, err
+		}
+
+		problems = append(problems, schemaErr.Fields...)
+	}
+
+	metadata := &models.InstanceMetadatum{ID: params.ID, Metadata: types.JSON(params.Metadata)}
+
+	if err := r.checkIPless(params.IPAddresses, metadata, prune); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	return problems, nil
+}
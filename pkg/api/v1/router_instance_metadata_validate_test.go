@@ -0,0 +1,108 @@
+package metadataservice_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	"go.hollow.sh/metadataservice/internal/models"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func TestInstanceMetadataValidate(t *testing.T) {
+	router := *testHTTPServerWithConfig(t, TestServerConfig{MetadataSchema: defaultMetadataSchema(t), IPlessPolicy: v1api.IPlessReject})
+	testDB := dbtools.TestDB()
+
+	instanceID := "5d0c2f53-7a1e-4c3b-9e8d-2f4a6b8c0d1e"
+
+	post := func(body []byte) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalMetadataValidatePath(), bytes.NewReader(body))
+		router.ServeHTTP(w, req)
+
+		return w
+	}
+
+	postRequest := func(request v1api.UpsertMetadataRequest) *httptest.ResponseRecorder {
+		body, err := json.Marshal(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return post(body)
+	}
+
+	errorDetails := func(t *testing.T, w *httptest.ResponseRecorder) []string {
+		var resp v1api.ErrorResponse
+
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, v1api.ErrorCodeInvalidMetadata, resp.Error.Code)
+
+		return resp.Error.Details
+	}
+
+	t.Run("valid metadata", func(t *testing.T) {
+		w := postRequest(v1api.UpsertMetadataRequest{ID: instanceID, Metadata: `{"hostname":"valid","network":{"addresses":[{"address":"10.98.1.1"},{"address":"2001:db8::1"}]}}`, IPAddresses: []string{"10.98.1.1"}})
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var resp v1api.ValidateMetadataResponse
+
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, instanceID, resp.ID)
+		assert.Equal(t, []string{"10.98.1.1"}, resp.IPAddresses)
+		assert.Equal(t, []string{"10.98.1.1", "2001:db8::1"}, resp.MetadataIPAddresses)
+
+		exists, err := models.InstanceMetadatumExists(context.TODO(), testDB, instanceID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.False(t, exists)
+
+		ipCount, err := models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(instanceID)).Count(context.TODO(), testDB)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Zero(t, ipCount)
+	})
+
+	t.Run("every problem is reported", func(t *testing.T) {
+		w := postRequest(v1api.UpsertMetadataRequest{ID: "not-an-id", Metadata: `{"hostname":"invalid","network":{"addresses":[{"cidr":29}]}}`, IPAddresses: []string{"10.98.1.2"}})
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+		details := errorDetails(t, w)
+		assert.Contains(t, details, "validation failed on id, condition: uuid")
+		assert.Contains(t, details, "network.addresses[0]: missing properties: 'address'")
+	})
+
+	t.Run("metadata which isn't JSON", func(t *testing.T) {
+		w := postRequest(v1api.UpsertMetadataRequest{ID: instanceID, Metadata: `{"hostname":`, IPAddresses: []string{"10.98.1.3"}})
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		assert.Equal(t, []string{"validation failed on metadata, condition: json"}, errorDetails(t, w))
+	})
+
+	t.Run("ip-less metadata", func(t *testing.T) {
+		w := postRequest(v1api.UpsertMetadataRequest{ID: instanceID, Metadata: `{"hostname":"ip-less","network":{"addresses":[]}}`})
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		assert.Len(t, errorDetails(t, w), 1)
+	})
+
+	t.Run("malformed request body", func(t *testing.T) {
+		w := post([]byte(`{"id":`))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
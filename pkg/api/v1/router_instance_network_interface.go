@@ -0,0 +1,268 @@
+package metadataservice
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+
+	"github.com/gin-gonic/gin"
+
+	"go.hollow.sh/metadataservice/internal/apierror"
+	"go.hollow.sh/metadataservice/internal/middleware"
+)
+
+var (
+	// errAddressNotInMetadata is returned when the requesting IP address can't
+	// be found in the network addresses listed in the instance metadata.
+	errAddressNotInMetadata = errors.New("requesting address not found in instance metadata")
+
+	// errInterfaceNotFound is returned when we're unable to determine which
+	// network interface owns the requesting IP address.
+	errInterfaceNotFound = errors.New("unable to determine the network interface for the requesting address")
+)
+
+// NetworkInterfaceResponse represents the metadata scoped to the network
+// interface owning the IP address a request was made from.
+type NetworkInterfaceResponse struct {
+	Interface map[string]interface{}   `json:"interface"`
+	Address   map[string]interface{}   `json:"address"`
+	Addresses []map[string]interface{} `json:"addresses"`
+	Routes    []NetworkRoute           `json:"routes"`
+}
+
+// NetworkRoute represents a route derived from an address' gateway.
+type NetworkRoute struct {
+	Destination string `json:"destination"`
+	Gateway     string `json:"gateway"`
+}
+
+// instanceNetworkInterfaceGet returns the network-related metadata for the
+// interface owning the IP address the request was made from, rather than
+// the configuration for every interface on the instance.
+func (r *Router) instanceNetworkInterfaceGet(c *gin.Context) {
+	metadata, err := r.getMetadata(c)
+	if err != nil {
+		if errors.Is(err, errNotFound) {
+			notFoundResponse(c)
+		} else {
+			dbErrorResponse(r.Logger, c, err)
+		}
+
+		return
+	}
+
+	var doc map[string]interface{}
+
+	if err := json.Unmarshal(r.visibleMetadata(c, metadata.Metadata), &doc); err != nil {
+		apierror.Abort(c, http.StatusInternalServerError, ErrorCodeInternal, "invalid metadata for instance")
+		return
+	}
+
+	resp, err := networkInterfaceForAddress(doc, c.GetString(middleware.ContextKeyRequestorIP))
+	if err != nil {
+		apierror.Abort(c, http.StatusNotFound, ErrorCodeNotFound, "resource not found", err.Error())
+		return
+	}
+
+	r.resourceJSONResponse(c, etagResourceMetadata, resp, metadata.UpdatedAt)
+}
+
+// networkInterfaceForAddress finds the address entry in the metadata network
+// block matching the given IP, and the interface owning it.
+//
+// An address can be explicitly associated to an interface by setting an
+// "interface" field on the address, containing either the name or the MAC of
+// an entry in "network.interfaces". If no address is explicitly associated,
+// and all interfaces are members of the same bond, the bond is treated as the
+// owning interface.
+func networkInterfaceForAddress(doc map[string]interface{}, requestorIP string) (*NetworkInterfaceResponse, error) {
+	ip, err := netip.ParseAddr(requestorIP)
+	if err != nil {
+		return nil, err
+	}
+
+	network, _ := doc["network"].(map[string]interface{})
+	addresses := objectSlice(network["addresses"])
+	interfaces := objectSlice(network["interfaces"])
+
+	var address map[string]interface{}
+
+	for _, addr := range addresses {
+		if addressContains(addr, ip) {
+			address = addr
+			break
+		}
+	}
+
+	if address == nil {
+		return nil, errAddressNotInMetadata
+	}
+
+	iface, matches := findOwningInterface(network, interfaces, address)
+	if iface == nil {
+		return nil, errInterfaceNotFound
+	}
+
+	resp := &NetworkInterfaceResponse{
+		Interface: iface,
+		Address:   address,
+		Addresses: []map[string]interface{}{},
+		Routes:    []NetworkRoute{},
+	}
+
+	for _, addr := range addresses {
+		owner, _ := findOwningInterface(network, interfaces, addr)
+		if owner == nil || !matches(owner) {
+			continue
+		}
+
+		resp.Addresses = append(resp.Addresses, addr)
+
+		if route, ok := routeForAddress(addr); ok {
+			resp.Routes = append(resp.Routes, route)
+		}
+	}
+
+	return resp, nil
+}
+
+// findOwningInterface returns the interface owning the address, along with a
+// function which can be used to check if another interface is the same one.
+func findOwningInterface(network map[string]interface{}, interfaces []map[string]interface{}, address map[string]interface{}) (map[string]interface{}, func(map[string]interface{}) bool) {
+	// The names and MACs are compared as strings, as comparing two objects
+	// or arrays from the metadata would panic
+	sameName := func(iface map[string]interface{}) func(map[string]interface{}) bool {
+		name, _ := iface["name"].(string)
+		mac, _ := iface["mac"].(string)
+
+		return func(other map[string]interface{}) bool {
+			otherName, _ := other["name"].(string)
+			otherMAC, _ := other["mac"].(string)
+
+			return otherName == name && otherMAC == mac
+		}
+	}
+
+	if ref, ok := address["interface"].(string); ok && ref != "" {
+		for _, iface := range interfaces {
+			if iface["name"] == ref || iface["mac"] == ref {
+				return iface, sameName(iface)
+			}
+		}
+
+		return nil, nil
+	}
+
+	// No explicit association, so fall back to the bond if every interface
+	// belongs to the same one.
+	bondName := ""
+	members := []string{}
+
+	for _, iface := range interfaces {
+		bond, _ := iface["bond"].(string)
+		if bond == "" || (bondName != "" && bond != bondName) {
+			return nil, nil
+		}
+
+		bondName = bond
+
+		if name, ok := iface["name"].(string); ok {
+			members = append(members, name)
+		}
+	}
+
+	if bondName == "" {
+		return nil, nil
+	}
+
+	bond := map[string]interface{}{
+		"name":    bondName,
+		"members": members,
+	}
+
+	if bonding, ok := network["bonding"].(map[string]interface{}); ok {
+		for k, v := range bonding {
+			bond[k] = v
+		}
+	}
+
+	return bond, sameName(bond)
+}
+
+// addressContains reports whether the given IP is the address described by
+// the metadata address entry, or falls within the entry's subnet.
+func addressContains(address map[string]interface{}, ip netip.Addr) bool {
+	addrStr, _ := address["address"].(string)
+
+	addr, err := netip.ParseAddr(addrStr)
+	if err != nil {
+		return false
+	}
+
+	if addr == ip {
+		return true
+	}
+
+	cidr, ok := address["cidr"].(float64)
+	if !ok {
+		return false
+	}
+
+	prefix, err := addr.Prefix(int(cidr))
+	if err != nil {
+		return false
+	}
+
+	return prefix.Contains(ip)
+}
+
+// routeForAddress derives a route from the gateway of an address. Public
+// addresses get a default route, while private addresses are routed to their
+// parent block.
+func routeForAddress(address map[string]interface{}) (NetworkRoute, bool) {
+	gateway, _ := address["gateway"].(string)
+	if gateway == "" {
+		return NetworkRoute{}, false
+	}
+
+	route := NetworkRoute{Gateway: gateway}
+
+	if public, _ := address["public"].(bool); public {
+		route.Destination = "0.0.0.0/0"
+
+		if family, _ := address["address_family"].(float64); family == 6 { //nolint:gomnd // IPv6 address family
+			route.Destination = "::/0"
+		}
+
+		return route, true
+	}
+
+	parent, _ := address["parent_block"].(map[string]interface{})
+	network, _ := parent["network"].(string)
+	cidr, ok := parent["cidr"].(float64)
+
+	if network == "" || !ok {
+		return NetworkRoute{}, false
+	}
+
+	route.Destination = fmt.Sprintf("%s/%d", network, int(cidr))
+
+	return route, true
+}
+
+// objectSlice converts a decoded JSON array into a slice of JSON objects,
+// skipping any items which aren't objects.
+func objectSlice(v interface{}) []map[string]interface{} {
+	items, _ := v.([]interface{})
+	result := make([]map[string]interface{}, 0, len(items))
+
+	for _, item := range items {
+		if obj, ok := item.(map[string]interface{}); ok {
+			result = append(result, obj)
+		}
+	}
+
+	return result
+}
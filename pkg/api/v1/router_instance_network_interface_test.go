@@ -0,0 +1,129 @@
+package metadataservice_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func TestGetMetadataNetworkInterfaceByIP(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	type testCase struct {
+		testName           string
+		instanceIP         string
+		expectedStatus     int
+		expectedAddress    string
+		expectedInterface  string
+		expectedAddressCnt int
+	}
+
+	testCases := []testCase{
+		{
+			"unknown IPv4 address",
+			"1.2.3.4",
+			http.StatusNotFound,
+			"",
+			"",
+			0,
+		},
+		{
+			"Instance A public IPv4",
+			"139.178.82.3",
+			http.StatusOK,
+			"139.178.82.3",
+			"bond0",
+			3,
+		},
+		{
+			"Instance A private IPv4 within the address subnet",
+			"10.70.17.8",
+			http.StatusOK,
+			"10.70.17.9",
+			"bond0",
+			3,
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetMetadataNetworkInterfacePath(), nil)
+			req.RemoteAddr = net.JoinHostPort(testcase.instanceIP, "0")
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+
+			if testcase.expectedStatus != http.StatusOK {
+				return
+			}
+
+			var resp v1api.NetworkInterfaceResponse
+
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, testcase.expectedAddress, resp.Address["address"])
+			assert.Equal(t, testcase.expectedInterface, resp.Interface["name"])
+			assert.Len(t, resp.Addresses, testcase.expectedAddressCnt)
+			assert.NotEmpty(t, resp.Routes)
+		})
+	}
+
+	// Make sure the interface scoped metadata is available for all of
+	// instance A's IPs
+	for _, hostIP := range dbtools.FixtureInstanceA.HostIPs {
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetMetadataNetworkInterfacePath(), nil)
+		req.RemoteAddr = net.JoinHostPort(hostIP, "0")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code, hostIP)
+	}
+}
+
+func TestGetMetadataNetworkInterfaceObjectNames(t *testing.T) {
+	router := *testHTTPServer(t)
+	instanceID := "3c9e7d41-8f2b-4a5c-b6d0-2e1f9a7c4b83"
+
+	// An interface named with an object, rather than a string, isn't matched
+	// by name, but doesn't break the lookup by MAC
+	upsert(t, router, v1api.GetInternalMetadataPath(), v1api.UpsertMetadataRequest{
+		ID: instanceID,
+		Metadata: `{"network": {
+			"interfaces": [{"name": {"primary": true}, "mac": "40:a6:b7:74:9f:20"}],
+			"addresses": [
+				{"address": "10.80.1.2", "cidr": 31, "gateway": "10.80.1.3", "interface": "40:a6:b7:74:9f:20"},
+				{"address": "10.80.2.2", "cidr": 31, "gateway": "10.80.2.3", "interface": "40:a6:b7:74:9f:20"}
+			]
+		}}`,
+	})
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetMetadataNetworkInterfacePath(), nil)
+	req.RemoteAddr = net.JoinHostPort("10.80.1.2", "0")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var resp v1api.NetworkInterfaceResponse
+
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "40:a6:b7:74:9f:20", resp.Interface["mac"])
+	assert.Len(t, resp.Addresses, 2)
+}
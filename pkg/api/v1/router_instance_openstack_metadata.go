@@ -0,0 +1,51 @@
+package metadataservice
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"go.hollow.sh/metadataservice/internal/apierror"
+	"go.hollow.sh/metadataservice/pkg/api/v1/ec2"
+	"go.hollow.sh/metadataservice/pkg/api/v1/openstack"
+)
+
+// instanceOpenstackMetadataGet returns the instance's metadata in the format
+// of the OpenStack datasource's meta_data.json
+func (r *Router) instanceOpenstackMetadataGet(c *gin.Context) {
+	instanceMetadata, err := r.getMetadata(c)
+	if err != nil {
+		if errors.Is(err, errNotFound) {
+			notFoundResponse(c)
+		} else {
+			dbErrorResponse(r.Logger, c, err)
+		}
+
+		return
+	}
+
+	var metadata = ec2.Metadata{}
+
+	if err := json.Unmarshal(r.servedMetadata(c, instanceMetadata), &metadata); err != nil {
+		apierror.Abort(c, http.StatusInternalServerError, ErrorCodeInternal, "invalid metadata for instance")
+		return
+	}
+
+	// Keys stored separately from the metadata take its place
+	keys, keysUpdated, err := r.ec2PublicKeys(c.Request.Context(), instanceMetadata.ID)
+	if err != nil {
+		dbErrorResponse(r.Logger, c, err)
+		return
+	}
+
+	metadata.PublicKeys = keys
+
+	modified := instanceMetadata.UpdatedAt
+	if keysUpdated.After(modified) {
+		modified = keysUpdated
+	}
+
+	r.resourceJSONResponse(c, etagResourceMetadata, openstack.NewMetaData(instanceMetadata.ID, &metadata), modified)
+}
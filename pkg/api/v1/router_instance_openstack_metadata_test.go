@@ -0,0 +1,63 @@
+package metadataservice_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+	"go.hollow.sh/metadataservice/pkg/api/v1/openstack"
+)
+
+func TestGetOpenstackMetadata(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetOpenstackMetadataPath(), nil)
+	req.RemoteAddr = net.JoinHostPort(dbtools.FixtureInstanceA.HostIPs[0], "0")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var metadata openstack.MetaData
+
+	if err := json.Unmarshal(w.Body.Bytes(), &metadata); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, dbtools.FixtureInstanceA.InstanceID, metadata.UUID)
+	assert.Equal(t, "instance-a", metadata.Hostname)
+	assert.Equal(t, "instance-a", metadata.Name)
+	assert.Equal(t, "da11", metadata.AvailabilityZone)
+	assert.NotEmpty(t, metadata.PublicKeys)
+
+	// Fields which the instance doesn't have are left out, rather than null
+	var fields map[string]interface{}
+
+	if err := json.Unmarshal(w.Body.Bytes(), &fields); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, value := range fields {
+		assert.NotNil(t, value)
+	}
+}
+
+func TestGetOpenstackMetadataUnknownIP(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetOpenstackMetadataPath(), nil)
+	req.RemoteAddr = net.JoinHostPort("1.2.3.4", "0")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,38 @@
+package metadataservice
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// HeaderProvisioningStatus is the response header the provisioning route
+	// sets on its "not provisioned yet" marker, so the marker can't be
+	// mistaken for metadata.
+	HeaderProvisioningStatus = "X-Provisioning-Status"
+
+	// ProvisioningStatusPending is the status reported for instances whose
+	// metadata hasn't been provisioned yet.
+	ProvisioningStatusPending = "pending"
+)
+
+// ProvisioningPendingResponse is the marker served by the provisioning route
+// to instances whose metadata hasn't been provisioned yet.
+type ProvisioningPendingResponse struct {
+	Status string `json:"status"`
+}
+
+// instanceMetadataProvisioningGet serves the metadata for the instance making
+// the request, like instanceMetadataGet. But when there's no metadata for the
+// instance (yet), it responds with a 200 and a pending marker rather than a
+// 404, so agents running on instances which boot before they're provisioned
+// can tell "not yet" apart from a failure. Errors are still reported as such.
+func (r *Router) instanceMetadataProvisioningGet(c *gin.Context) {
+	r.serveInstanceMetadata(c, provisioningPendingResponse)
+}
+
+func provisioningPendingResponse(c *gin.Context) {
+	c.Header(HeaderProvisioningStatus, ProvisioningStatusPending)
+	c.AbortWithStatusJSON(http.StatusOK, &ProvisioningPendingResponse{Status: ProvisioningStatusPending})
+}
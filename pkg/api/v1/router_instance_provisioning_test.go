@@ -0,0 +1,80 @@
+package metadataservice_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func TestGetMetadataProvisioning(t *testing.T) {
+	router := *testHTTPServerWithConfig(t, TestServerConfig{PendingMarker: true})
+
+	testCases := []struct {
+		testName       string
+		instanceIP     string
+		expectedStatus string
+		expectedBody   string
+	}{
+		{
+			"unknown instance is pending",
+			"192.168.100.1",
+			v1api.ProvisioningStatusPending,
+			`{"status":"pending"}`,
+		},
+		{
+			"provisioned instance gets its metadata",
+			dbtools.FixtureInstanceA.HostIPs[0],
+			"",
+			"",
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetMetadataProvisioningPath(), nil)
+			req.RemoteAddr = net.JoinHostPort(testcase.instanceIP, "0")
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, testcase.expectedStatus, w.Header().Get(v1api.HeaderProvisioningStatus))
+
+			if testcase.expectedBody != "" {
+				assert.JSONEq(t, testcase.expectedBody, w.Body.String())
+			} else {
+				assert.Contains(t, w.Body.String(), `"hostname":"instance-a"`)
+			}
+		})
+	}
+
+	// The regular and ec2-style routes still 404
+	for _, path := range []string{v1api.GetMetadataPath(), "/2009-04-04/meta-data/hostname"} {
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, path, nil)
+		req.RemoteAddr = net.JoinHostPort("192.168.100.1", "0")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNotFound, w.Code, path)
+	}
+}
+
+func TestGetMetadataProvisioningNotMounted(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetMetadataProvisioningPath(), nil)
+	req.RemoteAddr = net.JoinHostPort(dbtools.FixtureInstanceA.HostIPs[0], "0")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
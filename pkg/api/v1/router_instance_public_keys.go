@@ -0,0 +1,133 @@
+package metadataservice
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+
+	"go.hollow.sh/metadataservice/internal/publickeys"
+	"go.hollow.sh/metadataservice/pkg/api/v1/ec2"
+)
+
+// PublicKeysResponse lists the SSH public keys stored for an instance, in the
+// order they're served under public-keys/
+type PublicKeysResponse struct {
+	ID         string           `json:"id"`
+	PublicKeys []publickeys.Key `json:"public_keys"`
+}
+
+// UpsertPublicKeysRequest replaces the SSH public keys stored for an
+// instance. An empty list removes them.
+type UpsertPublicKeysRequest struct {
+	PublicKeys []publickeys.Key `json:"public_keys" validate:"required"`
+}
+
+func (upsertRequest *UpsertPublicKeysRequest) validate(v *validator.Validate) error {
+	if err := v.Struct(upsertRequest); err != nil {
+		return err
+	}
+
+	return publickeys.Validate(upsertRequest.PublicKeys)
+}
+
+// instancePublicKeysGet returns the SSH public keys stored for an instance
+func (r *Router) instancePublicKeysGet(c *gin.Context) {
+	instanceID, err := r.getInstanceIDParam(c, "instance-id")
+	if err != nil {
+		invalidUUIDResponse(c, err)
+		return
+	}
+
+	keys, err := publickeys.List(c.Request.Context(), r.DB, instanceID)
+	if err != nil {
+		dbErrorResponse(r.Logger, c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, &PublicKeysResponse{ID: instanceID, PublicKeys: keys})
+}
+
+// instancePublicKeysSet replaces the SSH public keys stored for an instance,
+// returning the keys as they were stored
+func (r *Router) instancePublicKeysSet(c *gin.Context) {
+	instanceID, err := r.getInstanceIDParam(c, "instance-id")
+	if err != nil {
+		invalidUUIDResponse(c, err)
+		return
+	}
+
+	params := UpsertPublicKeysRequest{}
+
+	limitRequestBody(c, r.MaxMetadataBodySize)
+
+	if err := c.ShouldBindJSON(&params); err != nil {
+		requestBodyErrorResponse(c, err)
+		return
+	}
+
+	if err := params.validate(r.validate); err != nil {
+		badRequestResponse(c, "Invalid request", err)
+		return
+	}
+
+	if err := r.replacePublicKeys(c.Request.Context(), instanceID, params.PublicKeys); err != nil {
+		dbErrorResponse(r.Logger, c, err)
+		return
+	}
+
+	r.Logger.Sugar().Info("Stored ", len(params.PublicKeys), " public keys for instance: ", instanceID)
+
+	r.instancePublicKeysGet(c)
+}
+
+// replacePublicKeys replaces the instance's keys in a single transaction, so
+// instances are never served a partial list
+func (r *Router) replacePublicKeys(ctx context.Context, instanceID string, keys []publickeys.Key) error {
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := publickeys.Replace(ctx, tx, instanceID, keys); err != nil {
+		_ = tx.Rollback()
+
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// isPublicKeysItem reports whether an ec2-style metadata item path is one of
+// the public-keys/ items
+func isPublicKeysItem(itemPath string) bool {
+	trimmed := strings.Trim(itemPath, "/")
+
+	return trimmed == "public-keys" || strings.HasPrefix(trimmed, "public-keys/")
+}
+
+// ec2PublicKeys loads the keys stored for an instance, as they're served under
+// the ec2-style public-keys/ items, and when they were stored
+func (r *Router) ec2PublicKeys(ctx context.Context, instanceID string) ([]ec2.PublicKey, time.Time, error) {
+	keys, err := publickeys.List(ctx, r.DB, instanceID)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	result := make([]ec2.PublicKey, len(keys))
+
+	for i, key := range keys {
+		name := key.Name
+		if name == "" {
+			name = "key-" + strconv.Itoa(i)
+		}
+
+		result[i] = ec2.PublicKey{Name: name, OpenSSHKey: key.PublicKey}
+	}
+
+	return result, publickeys.LastUpdated(keys), nil
+}
@@ -0,0 +1,177 @@
+package metadataservice_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	"go.hollow.sh/metadataservice/internal/publickeys"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+const (
+	testKeyAlice = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIId4BdAdnHq+4t7NfTXRiJoSNi4fg/LiYkS5qEFyDixg alice@example.com"
+	testKeyBob   = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIPYcFtQ+Xh3oShMOplJTsTFzmaqNhE3xGnUPa2p7t91I bob"
+)
+
+func postJSON(t *testing.T, router http.Handler, path string, request interface{}) *httptest.ResponseRecorder {
+	reqBody, err := json.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, path, bytes.NewReader(reqBody))
+	router.ServeHTTP(w, req)
+
+	return w
+}
+
+func getPublicKeys(t *testing.T, router http.Handler, instanceID string) []publickeys.Key {
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetInternalPublicKeysPath(instanceID), nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var resp v1api.PublicKeysResponse
+
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, instanceID, resp.ID)
+
+	return resp.PublicKeys
+}
+
+func TestPublicKeys(t *testing.T) {
+	router := *testHTTPServer(t)
+	instanceID := dbtools.FixtureInstanceA.InstanceID
+	instanceIP := dbtools.FixtureInstanceA.HostIPs[0]
+
+	assert.Empty(t, getPublicKeys(t, router, instanceID))
+
+	w := postJSON(t, router, v1api.GetInternalPublicKeysPath(instanceID), v1api.UpsertPublicKeysRequest{
+		PublicKeys: []publickeys.Key{{Name: "deploy", PublicKey: testKeyBob}, {PublicKey: testKeyAlice}},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	keys := getPublicKeys(t, router, instanceID)
+	if assert.Len(t, keys, 2) {
+		assert.Equal(t, "deploy", keys[0].Name)
+		assert.Equal(t, "alice@example.com", keys[1].Name)
+	}
+
+	// The stored keys are served in place of the metadata's ssh_keys
+	testCases := []struct {
+		item     string
+		expected string
+	}{
+		{"public-keys", "0=deploy\n1=alice@example.com"},
+		{"public-keys/", "0=deploy\n1=alice@example.com"},
+		{"public-keys/1", "openssh-key"},
+		{"public-keys/0/openssh-key", testKeyBob},
+		{"public-keys/1/openssh-key", testKeyAlice},
+	}
+
+	for _, testcase := range testCases {
+		w := getAsInstance(router, v1api.GetEc2MetadataItemPath(testcase.item), nil, instanceIP)
+
+		assert.Equal(t, http.StatusOK, w.Code, testcase.item)
+		assert.Equal(t, testcase.expected, w.Body.String(), testcase.item)
+	}
+
+	w = getAsInstance(router, v1api.GetEc2MetadataItemPath("public-keys/2/openssh-key"), nil, instanceIP)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// An empty list removes the keys
+	w = postJSON(t, router, v1api.GetInternalPublicKeysPath(instanceID), v1api.UpsertPublicKeysRequest{PublicKeys: []publickeys.Key{}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, getPublicKeys(t, router, instanceID))
+}
+
+func TestPublicKeysInvalidRequest(t *testing.T) {
+	router := *testHTTPServer(t)
+	keysPath := v1api.GetInternalPublicKeysPath(dbtools.FixtureInstanceA.InstanceID)
+
+	testCases := []struct {
+		testName string
+		body     interface{}
+	}{
+		{"missing keys", map[string]interface{}{}},
+		{"invalid key", v1api.UpsertPublicKeysRequest{PublicKeys: []publickeys.Key{{PublicKey: "ssh-rsa not-a-key"}}}},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := postJSON(t, router, keysPath, testcase.body)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+		})
+	}
+
+	assert.Empty(t, getPublicKeys(t, router, dbtools.FixtureInstanceA.InstanceID))
+}
+
+func TestUpsertMetadataWithPublicKeys(t *testing.T) {
+	router := *testHTTPServer(t)
+	instanceID := dbtools.FixtureInstanceA.InstanceID
+
+	upsert(t, router, v1api.GetInternalMetadataPath(), v1api.UpsertMetadataRequest{
+		ID:          instanceID,
+		Metadata:    string(dbtools.FixtureInstanceA.InstanceMetadata.Metadata),
+		IPAddresses: dbtools.FixtureInstanceA.HostIPs,
+		PublicKeys:  []publickeys.Key{{PublicKey: testKeyAlice}},
+	})
+
+	assert.Len(t, getPublicKeys(t, router, instanceID), 1)
+
+	// Leaving the keys out of an upsert keeps them
+	upsert(t, router, v1api.GetInternalMetadataPath(), v1api.UpsertMetadataRequest{
+		ID:          instanceID,
+		Metadata:    string(dbtools.FixtureInstanceA.InstanceMetadata.Metadata),
+		IPAddresses: dbtools.FixtureInstanceA.HostIPs,
+	})
+
+	assert.Len(t, getPublicKeys(t, router, instanceID), 1)
+
+	// An upsert with an invalid key isn't written
+	w := postJSON(t, router, v1api.GetInternalMetadataPath(), v1api.UpsertMetadataRequest{
+		ID:          instanceID,
+		Metadata:    `{"id":"changed"}`,
+		IPAddresses: dbtools.FixtureInstanceA.HostIPs,
+		PublicKeys:  []publickeys.Key{{PublicKey: "not-a-key"}},
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	keys := getPublicKeys(t, router, instanceID)
+	if assert.Len(t, keys, 1) {
+		assert.Equal(t, testKeyAlice, keys[0].PublicKey)
+	}
+
+	// Batch upserts store the keys with the metadata
+	w = postJSON(t, router, v1api.GetInternalBatchPath(), []v1api.BatchUpsertRequest{{
+		ID:          instanceID,
+		Metadata:    string(dbtools.FixtureInstanceA.InstanceMetadata.Metadata),
+		IPAddresses: dbtools.FixtureInstanceA.HostIPs,
+		PublicKeys:  []publickeys.Key{{PublicKey: testKeyBob}, {PublicKey: testKeyAlice}},
+	}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, getPublicKeys(t, router, instanceID), 2)
+
+	// But not without metadata
+	w = postJSON(t, router, v1api.GetInternalBatchPath(), []v1api.BatchUpsertRequest{{
+		ID:         instanceID,
+		Userdata:   []byte("#cloud-config\n"),
+		PublicKeys: []publickeys.Key{{PublicKey: testKeyBob}},
+	}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
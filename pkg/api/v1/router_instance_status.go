@@ -0,0 +1,107 @@
+package metadataservice
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/volatiletech/sqlboiler/v4/queries/qm"
+
+	"go.hollow.sh/metadataservice/internal/lastfetch"
+	"go.hollow.sh/metadataservice/internal/models"
+)
+
+// InstanceStatusResponse reports whether the metadata service has the data
+// it needs to serve an instance, without returning the data itself.
+type InstanceStatusResponse struct {
+	ID             string       `json:"id"`
+	Ready          bool         `json:"ready"`
+	Metadata       RecordStatus `json:"metadata"`
+	Userdata       RecordStatus `json:"userdata"`
+	IPAddressCount int64        `json:"ip_address_count"`
+
+	// LastFetch is only reported when recording of metadata fetches is enabled
+	LastFetch *lastfetch.Fetch `json:"last_fetch,omitempty"`
+}
+
+// RecordStatus describes whether a metadata or userdata record is stored for
+// an instance, and when it was last updated.
+type RecordStatus struct {
+	Exists    bool       `json:"exists"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// instanceStatusGet returns whether metadata and userdata are stored for an
+// instance, when they were last updated, and how many IP addresses are
+// associated to it. An instance is reported as ready once its metadata is
+// stored and it has at least one IP address it can be identified by. This
+// always returns a 200 for a valid instance ID, so callers can poll it while
+// waiting for an instance's data to be pushed to the service.
+func (r *Router) instanceStatusGet(c *gin.Context) {
+	instanceID, err := r.getInstanceIDParam(c, "instance-id")
+
+	if err != nil {
+		invalidUUIDResponse(c, err)
+		return
+	}
+
+	resp := &InstanceStatusResponse{ID: instanceID}
+
+	resp.Metadata, resp.Userdata, err = r.recordStatuses(c, instanceID)
+	if err != nil {
+		dbErrorResponse(r.Logger, c, err)
+		return
+	}
+
+	resp.IPAddressCount, err = models.InstanceIPAddresses(models.InstanceIPAddressWhere.InstanceID.EQ(instanceID)).Count(c.Request.Context(), r.DB)
+	if err != nil {
+		dbErrorResponse(r.Logger, c, err)
+		return
+	}
+
+	if r.FetchRecorder != nil {
+		resp.LastFetch, err = lastfetch.Get(c.Request.Context(), r.DB, instanceID)
+		if err != nil {
+			dbErrorResponse(r.Logger, c, err)
+			return
+		}
+	}
+
+	resp.Ready = resp.Metadata.Exists && resp.IPAddressCount > 0
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// recordStatuses returns whether metadata and userdata are stored for an
+// instance, and when each was last updated
+func (r *Router) recordStatuses(c *gin.Context, instanceID string) (RecordStatus, RecordStatus, error) {
+	var metadataStatus, userdataStatus RecordStatus
+
+	metadata, err := models.InstanceMetadata(
+		qm.Select(models.InstanceMetadatumColumns.ID, models.InstanceMetadatumColumns.UpdatedAt),
+		models.InstanceMetadatumWhere.ID.EQ(instanceID),
+	).One(c.Request.Context(), r.DB)
+
+	switch {
+	case err == nil:
+		metadataStatus = RecordStatus{Exists: true, UpdatedAt: &metadata.UpdatedAt}
+	case !errors.Is(err, sql.ErrNoRows):
+		return metadataStatus, userdataStatus, err
+	}
+
+	userdata, err := models.InstanceUserdata(
+		qm.Select(models.InstanceUserdatumColumns.ID, models.InstanceUserdatumColumns.UpdatedAt),
+		models.InstanceUserdatumWhere.ID.EQ(instanceID),
+	).One(c.Request.Context(), r.DB)
+
+	switch {
+	case err == nil:
+		userdataStatus = RecordStatus{Exists: true, UpdatedAt: &userdata.UpdatedAt}
+	case !errors.Is(err, sql.ErrNoRows):
+		return metadataStatus, userdataStatus, err
+	}
+
+	return metadataStatus, userdataStatus, nil
+}
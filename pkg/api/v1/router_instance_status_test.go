@@ -0,0 +1,97 @@
+package metadataservice_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func TestInstanceStatus(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	type testCase struct {
+		testName       string
+		instanceID     string
+		expectedStatus int
+		expected       v1api.InstanceStatusResponse
+	}
+
+	testCases := []testCase{
+		{
+			"invalid ID",
+			"abc123",
+			http.StatusNotFound,
+			v1api.InstanceStatusResponse{},
+		},
+		{
+			"unknown ID",
+			"99c53a90-61c8-472d-95dc-9abeaeb646c9",
+			http.StatusOK,
+			v1api.InstanceStatusResponse{},
+		},
+		{
+			"Instance A",
+			dbtools.FixtureInstanceA.InstanceID,
+			http.StatusOK,
+			v1api.InstanceStatusResponse{
+				Ready:          true,
+				Metadata:       v1api.RecordStatus{Exists: true},
+				Userdata:       v1api.RecordStatus{Exists: true},
+				IPAddressCount: int64(len(dbtools.FixtureInstanceA.InstanceIPAddresses)),
+			},
+		},
+		// Instance D has metadata, but no IPs it could be identified by
+		{
+			"Instance D",
+			dbtools.FixtureInstanceD.InstanceID,
+			http.StatusOK,
+			v1api.InstanceStatusResponse{
+				Metadata: v1api.RecordStatus{Exists: true},
+			},
+		},
+		{
+			"Instance E",
+			dbtools.FixtureInstanceE.InstanceID,
+			http.StatusOK,
+			v1api.InstanceStatusResponse{
+				Userdata:       v1api.RecordStatus{Exists: true},
+				IPAddressCount: int64(len(dbtools.FixtureInstanceE.InstanceIPAddresses)),
+			},
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetInternalInstanceStatusPath(testcase.instanceID), nil)
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+
+			if testcase.expectedStatus != http.StatusOK {
+				return
+			}
+
+			var resp v1api.InstanceStatusResponse
+
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, testcase.instanceID, resp.ID)
+			assert.Equal(t, testcase.expected.Ready, resp.Ready)
+			assert.Equal(t, testcase.expected.Metadata.Exists, resp.Metadata.Exists)
+			assert.Equal(t, testcase.expected.Metadata.Exists, resp.Metadata.UpdatedAt != nil)
+			assert.Equal(t, testcase.expected.Userdata.Exists, resp.Userdata.Exists)
+			assert.Equal(t, testcase.expected.IPAddressCount, resp.IPAddressCount)
+		})
+	}
+}
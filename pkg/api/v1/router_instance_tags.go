@@ -0,0 +1,181 @@
+package metadataservice
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/volatiletech/sqlboiler/v4/types"
+
+	"go.hollow.sh/metadataservice/internal/instancetags"
+	"go.hollow.sh/metadataservice/internal/models"
+)
+
+// lockMetadataQuery locks an instance's metadata row while its tags are
+// replaced
+const lockMetadataQuery = `SELECT 1 FROM instance_metadata WHERE id = $1 FOR SHARE`
+
+// TagsResponse lists the key/value tags attached to an instance
+type TagsResponse struct {
+	ID   string            `json:"id"`
+	Tags map[string]string `json:"tags"`
+
+	// UpdatedAt is when the instance's tags were last stored. It's left out
+	// for an instance without tags.
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// UpsertTagsRequest replaces the tags attached to an instance. An empty map
+// removes them.
+type UpsertTagsRequest struct {
+	Tags map[string]string `json:"tags" validate:"required"`
+}
+
+func (upsertRequest *UpsertTagsRequest) validate(v *validator.Validate) error {
+	if err := v.Struct(upsertRequest); err != nil {
+		return err
+	}
+
+	return instancetags.Validate(upsertRequest.Tags)
+}
+
+// instanceTagsGet returns the tags attached to an instance
+func (r *Router) instanceTagsGet(c *gin.Context) {
+	instanceID, err := r.getInstanceIDParam(c, "instance-id")
+	if err != nil {
+		invalidUUIDResponse(c, err)
+		return
+	}
+
+	tags, updated, err := instancetags.List(c.Request.Context(), r.DB, instanceID)
+	if err != nil {
+		dbErrorResponse(r.Logger, c, err)
+		return
+	}
+
+	resp := &TagsResponse{ID: instanceID, Tags: tags}
+
+	if !updated.IsZero() {
+		resp.UpdatedAt = &updated
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// instanceTagsSet replaces the tags attached to an instance, returning the
+// tags as they were stored. Instances without stored metadata get a 404, as
+// there's nothing to serve their tags in.
+func (r *Router) instanceTagsSet(c *gin.Context) {
+	instanceID, err := r.getInstanceIDParam(c, "instance-id")
+	if err != nil {
+		invalidUUIDResponse(c, err)
+		return
+	}
+
+	params := UpsertTagsRequest{}
+
+	limitRequestBody(c, r.MaxMetadataBodySize)
+
+	if err := c.ShouldBindJSON(&params); err != nil {
+		requestBodyErrorResponse(c, err)
+		return
+	}
+
+	if err := params.validate(r.validate); err != nil {
+		badRequestResponse(c, "Invalid request", err)
+		return
+	}
+
+	err = r.replaceTags(c.Request.Context(), instanceID, params.Tags)
+
+	r.invalidateReadCache(instanceID, nil)
+
+	if err != nil {
+		dbErrorResponse(r.Logger, c, err)
+		return
+	}
+
+	r.Logger.Sugar().Info("Stored ", len(params.Tags), " tags for instance: ", instanceID)
+
+	r.instanceTagsGet(c)
+}
+
+// replaceTags replaces the instance's tags in a single transaction, so
+// instances are never served, or looked up by, a partial set. The instance's
+// metadata is locked first, so its tags can't be stored after it's deleted;
+// sql.ErrNoRows is returned when there's none.
+func (r *Router) replaceTags(ctx context.Context, instanceID string, tags map[string]string) error {
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	var locked int
+
+	if err := tx.QueryRowContext(ctx, lockMetadataQuery, instanceID).Scan(&locked); err != nil {
+		_ = tx.Rollback()
+
+		return err
+	}
+
+	if err := instancetags.Replace(ctx, tx, instanceID, tags); err != nil {
+		_ = tx.Rollback()
+
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// instanceTags are the tags attached to an instance, as they're cached for
+// serving in its metadata
+type instanceTags struct {
+	Tags      map[string]string
+	UpdatedAt time.Time
+}
+
+// withInstanceTags returns the metadata served to the instance with its
+// attached tags under "instance_tags", and when the served metadata last
+// changed. The "tags" list in the stored metadata is served as it is, and an
+// "instance_tags" field in it is replaced when the instance has tags. When
+// they can't be loaded, or the metadata isn't a JSON object, the metadata is
+// served without them.
+func (r *Router) withInstanceTags(c *gin.Context, metadata *models.InstanceMetadatum, served types.JSON) (types.JSON, time.Time) {
+	tags, err := r.findTags(c, metadata.ID)
+	if err != nil {
+		r.Logger.Sugar().Warn("Unable to load the tags for instance: ", metadata.ID, " Error: ", err)
+
+		return served, metadata.UpdatedAt
+	}
+
+	if len(tags.Tags) == 0 {
+		return served, metadata.UpdatedAt
+	}
+
+	var fields map[string]json.RawMessage
+
+	if err := json.Unmarshal(served, &fields); err != nil || fields == nil {
+		return served, metadata.UpdatedAt
+	}
+
+	encoded, err := json.Marshal(tags.Tags)
+	if err != nil {
+		return served, metadata.UpdatedAt
+	}
+
+	fields["instance_tags"] = encoded
+
+	tagged, err := json.Marshal(fields)
+	if err != nil {
+		return served, metadata.UpdatedAt
+	}
+
+	if tags.UpdatedAt.After(metadata.UpdatedAt) {
+		return tagged, tags.UpdatedAt
+	}
+
+	return tagged, metadata.UpdatedAt
+}
@@ -0,0 +1,205 @@
+package metadataservice_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func getTags(t *testing.T, router http.Handler, instanceID string) map[string]string {
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetInternalTagsPath(instanceID), nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var resp v1api.TagsResponse
+
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, instanceID, resp.ID)
+
+	return resp.Tags
+}
+
+func TestTags(t *testing.T) {
+	router := *testHTTPServer(t)
+	instanceID := dbtools.FixtureInstanceA.InstanceID
+	instanceIP := dbtools.FixtureInstanceA.HostIPs[0]
+
+	assert.Empty(t, getTags(t, router, instanceID))
+
+	w := postJSON(t, router, v1api.GetInternalTagsPath(instanceID), v1api.UpsertTagsRequest{
+		Tags: map[string]string{"environment": "production", "team": "metal"},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, map[string]string{"environment": "production", "team": "metal"}, getTags(t, router, instanceID))
+
+	// The tags are served in the instance's metadata, next to its tags list
+	w = getAsInstance(router, v1api.GetMetadataPath(), nil, instanceIP)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var metadata struct {
+		ID           string            `json:"id"`
+		Tags         []string          `json:"tags"`
+		InstanceTags map[string]string `json:"instance_tags"`
+	}
+
+	if err := json.Unmarshal(w.Body.Bytes(), &metadata); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, instanceID, metadata.ID)
+	assert.Equal(t, []string{}, metadata.Tags)
+	assert.Equal(t, map[string]string{"environment": "production", "team": "metal"}, metadata.InstanceTags)
+
+	// An empty map removes the tags
+	w = postJSON(t, router, v1api.GetInternalTagsPath(instanceID), v1api.UpsertTagsRequest{Tags: map[string]string{}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, getTags(t, router, instanceID))
+}
+
+func TestTagsInvalidRequest(t *testing.T) {
+	router := *testHTTPServer(t)
+	tagsPath := v1api.GetInternalTagsPath(dbtools.FixtureInstanceA.InstanceID)
+
+	testCases := []struct {
+		testName string
+		body     interface{}
+	}{
+		{"missing tags", map[string]interface{}{}},
+		{"invalid key", v1api.UpsertTagsRequest{Tags: map[string]string{"env:prod": "true"}}},
+		{"invalid value", v1api.UpsertTagsRequest{Tags: map[string]string{"environment": "prod\n"}}},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			w := postJSON(t, router, tagsPath, testcase.body)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+		})
+	}
+
+	assert.Empty(t, getTags(t, router, dbtools.FixtureInstanceA.InstanceID))
+}
+
+func TestUpsertMetadataWithTags(t *testing.T) {
+	router := *testHTTPServer(t)
+	instanceID := dbtools.FixtureInstanceA.InstanceID
+
+	upsert(t, router, v1api.GetInternalMetadataPath(), v1api.UpsertMetadataRequest{
+		ID:          instanceID,
+		Metadata:    string(dbtools.FixtureInstanceA.InstanceMetadata.Metadata),
+		IPAddresses: dbtools.FixtureInstanceA.HostIPs,
+		Tags:        map[string]string{"role": "worker"},
+	})
+
+	assert.Equal(t, map[string]string{"role": "worker"}, getTags(t, router, instanceID))
+
+	// Leaving the tags out of an upsert keeps them
+	upsert(t, router, v1api.GetInternalMetadataPath(), v1api.UpsertMetadataRequest{
+		ID:          instanceID,
+		Metadata:    string(dbtools.FixtureInstanceA.InstanceMetadata.Metadata),
+		IPAddresses: dbtools.FixtureInstanceA.HostIPs,
+	})
+
+	assert.Equal(t, map[string]string{"role": "worker"}, getTags(t, router, instanceID))
+
+	// An upsert with an invalid tag isn't written
+	w := postJSON(t, router, v1api.GetInternalMetadataPath(), v1api.UpsertMetadataRequest{
+		ID:          instanceID,
+		Metadata:    `{"id":"changed"}`,
+		IPAddresses: dbtools.FixtureInstanceA.HostIPs,
+		Tags:        map[string]string{"": "worker"},
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, map[string]string{"role": "worker"}, getTags(t, router, instanceID))
+
+	// Batch upserts store the tags with the metadata
+	w = postJSON(t, router, v1api.GetInternalBatchPath(), []v1api.BatchUpsertRequest{{
+		ID:          instanceID,
+		Metadata:    string(dbtools.FixtureInstanceA.InstanceMetadata.Metadata),
+		IPAddresses: dbtools.FixtureInstanceA.HostIPs,
+		Tags:        map[string]string{"role": "control-plane"},
+	}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, map[string]string{"role": "control-plane"}, getTags(t, router, instanceID))
+
+	// But not without metadata
+	w = postJSON(t, router, v1api.GetInternalBatchPath(), []v1api.BatchUpsertRequest{{
+		ID:       instanceID,
+		Userdata: []byte("#cloud-config\n"),
+		Tags:     map[string]string{"role": "worker"},
+	}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Deleting the instance removes its tags
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodDelete, v1api.GetInternalInstanceByIDPath(instanceID), nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, getTags(t, router, instanceID))
+}
+
+func TestInstanceListTagFilter(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	w := postJSON(t, router, v1api.GetInternalTagsPath(dbtools.FixtureInstanceA.InstanceID), v1api.UpsertTagsRequest{
+		Tags: map[string]string{"environment": "production"},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = postJSON(t, router, v1api.GetInternalTagsPath(dbtools.FixtureInstanceB.InstanceID), v1api.UpsertTagsRequest{
+		Tags: map[string]string{"environment": "staging"},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	listedIDs := func(tag string) []string {
+		status, resp := listInstances(t, router, url.Values{"tag": []string{tag}})
+		assert.Equal(t, http.StatusOK, status)
+
+		ids := []string{}
+		for _, instance := range resp.Instances {
+			ids = append(ids, instance.ID)
+		}
+
+		return ids
+	}
+
+	assert.Equal(t, []string{dbtools.FixtureInstanceA.InstanceID}, listedIDs("environment:production"))
+	assert.Equal(t, []string{dbtools.FixtureInstanceB.InstanceID}, listedIDs("environment:staging"))
+	assert.Empty(t, listedIDs("environment:development"))
+	assert.Empty(t, listedIDs("team:production"))
+
+	// The tags list in the stored metadata is still matched once tags are
+	// attached, as it's still served
+	upsert(t, router, v1api.GetInternalMetadataPath()+"?prune=false", v1api.UpsertMetadataRequest{
+		ID:       dbtools.FixtureInstanceB.InstanceID,
+		Metadata: `{"tags": ["worker"]}`,
+	})
+
+	assert.Equal(t, []string{dbtools.FixtureInstanceB.InstanceID}, listedIDs("worker"))
+}
+
+func TestTagsWithoutMetadata(t *testing.T) {
+	router := *testHTTPServer(t)
+	instanceID := "faa4a7b3-1a70-4a6c-9a68-1e25fd1a89b6"
+
+	// Tags aren't stored for an instance without metadata to serve them in
+	w := postJSON(t, router, v1api.GetInternalTagsPath(instanceID), v1api.UpsertTagsRequest{
+		Tags: map[string]string{"environment": "production"},
+	})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Empty(t, getTags(t, router, instanceID))
+}
@@ -3,6 +3,7 @@ package metadataservice_test
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net"
@@ -355,6 +356,52 @@ func TestSetUserdataCreateUserdata(t *testing.T) {
 	}
 }
 
+// TestSetUserdataRequestBodyTooLarge checks the userdata body limit is
+// enforced independently of the metadata limit, which is smaller here
+func TestSetUserdataRequestBodyTooLarge(t *testing.T) {
+	maxMetadataSize := int64(1024)
+	maxUserdataSize := int64(4096)
+	router := *testHTTPServerWithConfig(t, TestServerConfig{MaxBodySize: maxMetadataSize, MaxUserdataSize: maxUserdataSize})
+
+	type testCase struct {
+		testName       string
+		userdataSize   int
+		expectedStatus int
+	}
+
+	testCases := []testCase{
+		{
+			"body over the metadata limit but within the userdata limit",
+			int(maxMetadataSize) * 2,
+			http.StatusOK,
+		},
+		{
+			"body over the userdata limit",
+			int(maxUserdataSize) * 2,
+			http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			reqBody, err := json.Marshal(&v1api.UpsertUserdataRequest{
+				ID:       "0b6c8a63-7a1c-4d2e-8b9e-6f1a2f3c4d5e",
+				Userdata: bytes.Repeat([]byte("a"), testcase.userdataSize),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalUserdataPath(), bytes.NewReader(reqBody))
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, testcase.expectedStatus, w.Code)
+		})
+	}
+}
+
 // TestSetUserdataUpsertUserdata tests the actions we perform when we receive a
 // request that should update the userdata for an existing instance record.
 func TestSetUserdataUpsertUserdata(t *testing.T) {
@@ -391,6 +438,64 @@ func TestSetUserdataUpsertUserdata(t *testing.T) {
 	assert.Equal(t, requestBody.Userdata, instanceUserdata.Userdata.Bytes)
 }
 
+// TestSetUserdataBase64Encoded tests that userdata stored base64-encoded is
+// decoded before it's served to the instance, and only then.
+func TestSetUserdataBase64Encoded(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	encoded := base64.StdEncoding.EncodeToString([]byte(userdata2))
+
+	upsert := func(t *testing.T, encoding string, userdata string) int {
+		reqBody, err := json.Marshal(&v1api.UpsertUserdataRequest{
+			ID:          dbtools.FixtureInstanceA.InstanceID,
+			Userdata:    []byte(userdata),
+			IPAddresses: dbtools.FixtureInstanceA.HostIPs,
+			Encoding:    encoding,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPost, v1api.GetInternalUserdataPath(), bytes.NewReader(reqBody))
+		router.ServeHTTP(w, req)
+
+		return w.Code
+	}
+
+	served := func(t *testing.T) string {
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetUserdataPath(), nil)
+		req.RemoteAddr = net.JoinHostPort(dbtools.FixtureInstanceA.HostIPs[0], "0")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		return w.Body.String()
+	}
+
+	// Userdata which isn't valid base64 is rejected when flagged as base64
+	assert.Equal(t, http.StatusBadRequest, upsert(t, "base64", userdata2))
+	assert.Equal(t, http.StatusBadRequest, upsert(t, "gzip", encoded))
+
+	assert.Equal(t, http.StatusOK, upsert(t, "base64", encoded))
+	assert.Equal(t, userdata2, served(t))
+
+	// The internal endpoint returns the userdata as it was stored
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetInternalUserdataByIDPath(dbtools.FixtureInstanceA.InstanceID), nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, encoded, w.Body.String())
+
+	// Storing raw userdata again clears the flag
+	assert.Equal(t, http.StatusOK, upsert(t, "", encoded))
+	assert.Equal(t, encoded, served(t))
+}
+
 func TestGetUserdataInternal(t *testing.T) {
 	router := *testHTTPServer(t)
 
@@ -2,40 +2,299 @@ package metadataservice
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
 	"text/template"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
 	"github.com/volatiletech/sqlboiler/v4/types"
 	"go.uber.org/zap"
+
+	"go.hollow.sh/metadataservice/internal/apierror"
+	"go.hollow.sh/metadataservice/internal/correlation"
+	"go.hollow.sh/metadataservice/internal/ignition"
+	"go.hollow.sh/metadataservice/internal/instancetags"
+	"go.hollow.sh/metadataservice/internal/publickeys"
+	"go.hollow.sh/metadataservice/internal/stalecache"
+	"go.hollow.sh/metadataservice/internal/upserter"
+)
+
+// NotFoundBody controls the body sent along with 404 responses from the
+// instance-facing ec2-style routes. Some clients (like cloud-init's EC2
+// datasource) misbehave when a 404 for a meta-data item has a JSON body.
+type NotFoundBody string
+
+const (
+	// NotFoundBodyEmpty sends a 404 with an empty body. This is the default.
+	NotFoundBodyEmpty NotFoundBody = "empty"
+
+	// NotFoundBodyText sends a 404 with a short plain-text body.
+	NotFoundBodyText NotFoundBody = "text"
+
+	// NotFoundBodyJSON sends a 404 with the same JSON error body used by the
+	// API routes.
+	NotFoundBodyJSON NotFoundBody = "json"
 )
 
-// ErrorResponse represents an error response record
-type ErrorResponse struct {
-	Message string   `json:"message,omitempty"`
-	Errors  []string `json:"errors,omitempty"`
+// DefaultUpsertRetryAfter is how long clients are asked to wait before
+// retrying an upsert which timed out, when no other value has been configured
+const DefaultUpsertRetryAfter = 5 * time.Second
+
+// ErrInvalidNotFoundBody is returned when an unknown 404 body style is provided.
+var ErrInvalidNotFoundBody = errors.New("invalid not found body style")
+
+// ParseNotFoundBody parses a configured 404 body style. An empty string
+// results in the default (NotFoundBodyEmpty).
+func ParseNotFoundBody(style string) (NotFoundBody, error) {
+	switch NotFoundBody(style) {
+	case "", NotFoundBodyEmpty:
+		return NotFoundBodyEmpty, nil
+	case NotFoundBodyText, NotFoundBodyJSON:
+		return NotFoundBody(style), nil
+	default:
+		return "", fmt.Errorf("%w: %q", ErrInvalidNotFoundBody, style)
+	}
 }
 
+// ErrorCode is a stable, machine-readable identifier for the kind of error an
+// error response describes. Clients should branch on the code rather than the
+// message, which may change.
+type ErrorCode = apierror.Code
+
+const (
+	// ErrorCodeInvalidRequest is returned for a request with an invalid path,
+	// query param or header
+	ErrorCodeInvalidRequest ErrorCode = "invalid_request"
+
+	// ErrorCodeInvalidRequestBody is returned for a request body which can't
+	// be parsed, or fails validation
+	ErrorCodeInvalidRequestBody ErrorCode = "invalid_request_body"
+
+	// ErrorCodeRequestBodyTooLarge is returned for a request body exceeding
+	// the route's size limit
+	ErrorCodeRequestBodyTooLarge ErrorCode = "request_body_too_large"
+
+	// ErrorCodeUnsupportedMediaType is returned for a request body sent with
+	// a Content-Type the route doesn't accept
+	ErrorCodeUnsupportedMediaType ErrorCode = "unsupported_media_type"
+
+	// ErrorCodeInvalidMetadata is returned for metadata which doesn't match
+	// the configured metadata schema, or which fails validation without being
+	// stored
+	ErrorCodeInvalidMetadata ErrorCode = "invalid_metadata"
+
+	// ErrorCodeIPlessInstance is returned for an upsert which would leave an
+	// instance without IP addresses, when those are rejected
+	ErrorCodeIPlessInstance ErrorCode = "ip_less_instance"
+
+	// ErrorCodeInstanceNotFound is returned when the instance, or the data
+	// requested for it, isn't stored
+	ErrorCodeInstanceNotFound ErrorCode = "instance_not_found"
+
+	// ErrorCodeNotFound is returned when something other than an instance,
+	// like an EC2-style meta-data item or a network interface, isn't found
+	ErrorCodeNotFound ErrorCode = "not_found"
+
+	// ErrorCodeRouteNotFound is returned for a request to a route which
+	// doesn't exist
+	ErrorCodeRouteNotFound ErrorCode = "route_not_found"
+
+	// ErrorCodeUnauthorized is returned when an instance-facing request
+	// couldn't be authenticated, like with a missing client certificate
+	ErrorCodeUnauthorized ErrorCode = "unauthorized"
+
+	// ErrorCodeSessionTokenRequired is returned when an instance-facing
+	// request needs a session token and doesn't have one
+	ErrorCodeSessionTokenRequired ErrorCode = "session_token_required"
+
+	// ErrorCodeInvalidSessionToken is returned for a session token which is
+	// invalid or expired
+	ErrorCodeInvalidSessionToken ErrorCode = "invalid_session_token"
+
+	// ErrorCodeBootstrapTokenRequired is returned when an instance-facing
+	// request is missing the instance's bootstrap token, or has the wrong one
+	ErrorCodeBootstrapTokenRequired ErrorCode = "bootstrap_token_required"
+
+	// ErrorCodeInvalidForwardedFor is returned for an instance-facing request
+	// whose X-Forwarded-For header looks spoofed, when those are rejected
+	ErrorCodeInvalidForwardedFor ErrorCode = apierror.CodeInvalidForwardedFor
+
+	// ErrorCodeInstanceQuotaExceeded is returned for an upsert creating an
+	// instance beyond the maximum number of instances
+	ErrorCodeInstanceQuotaExceeded ErrorCode = "instance_quota_exceeded"
+
+	// ErrorCodeChangeRejected is returned for a change the pre-write hook
+	// rejected
+	ErrorCodeChangeRejected ErrorCode = "change_rejected"
+
+	// ErrorCodeIPAddressConflict is returned for an upsert rejected because
+	// some of its IP addresses are associated to other instances
+	ErrorCodeIPAddressConflict ErrorCode = "ip_address_conflict"
+
+	// ErrorCodeRecentlyFetched is returned for a conditional delete of an
+	// instance whose metadata was fetched too recently
+	ErrorCodeRecentlyFetched ErrorCode = "recently_fetched"
+
+	// ErrorCodeIdempotencyKeyReused is returned when an idempotency key is
+	// reused for a different request
+	ErrorCodeIdempotencyKeyReused ErrorCode = "idempotency_key_reused"
+
+	// ErrorCodeIdempotencyRequestInProgress is returned when a request
+	// repeats an idempotency key whose first request is still being handled
+	ErrorCodeIdempotencyRequestInProgress ErrorCode = "idempotency_request_in_progress"
+
+	// ErrorCodePreconditionFailed is returned for an upsert whose
+	// X-Record-Version header no longer matches the stored record's version
+	ErrorCodePreconditionFailed ErrorCode = "precondition_failed"
+
+	// ErrorCodeRateLimited is returned for an instance-facing read beyond the
+	// instance's rate limit
+	ErrorCodeRateLimited ErrorCode = "rate_limited"
+
+	// ErrorCodeRequestTimeout is returned when a request wasn't handled
+	// within its route's timeout
+	ErrorCodeRequestTimeout ErrorCode = apierror.CodeRequestTimeout
+
+	// ErrorCodeDatabaseTimeout is returned when an upsert's database
+	// transaction timed out, and can be retried after the Retry-After
+	ErrorCodeDatabaseTimeout ErrorCode = "database_timeout"
+
+	// ErrorCodeServiceUnavailable is returned when something the request
+	// depends on, like the database or the pre-write hook, is unavailable
+	ErrorCodeServiceUnavailable ErrorCode = apierror.CodeServiceUnavailable
+
+	// ErrorCodeReadOnly is returned for an upsert or delete while the service
+	// is in read-only mode
+	ErrorCodeReadOnly ErrorCode = "read_only"
+
+	// ErrorCodeInternal is returned for any other error handling the request
+	ErrorCodeInternal ErrorCode = apierror.CodeInternal
+)
+
+// ErrorResponse is the body of every error response:
+//
+//	{"error": {"code": "instance_not_found", "message": "...", "request_id": "..."}}
+type ErrorResponse = apierror.Response
+
+// ErrorDetail describes the error in an ErrorResponse
+type ErrorDetail = apierror.Error
+
+// dbErrorResponse responds to an error reading or writing the database. Errors
+// are logged with the request's correlation ID, so they can be tied to the
+// request.
 func dbErrorResponse(logger *zap.Logger, c *gin.Context, err error) {
+	logger = correlation.Logger(c.Request.Context(), logger)
+
 	if errors.Is(err, sql.ErrNoRows) {
 		notFoundResponse(c)
+	} else if errors.Is(err, stalecache.ErrTooStale) {
+		logger.Error("database error, and the cached data is too stale to serve", zap.Error(err))
+
+		apierror.Abort(c, http.StatusServiceUnavailable, ErrorCodeServiceUnavailable, "service unavailable")
 	} else {
 		logger.Error("database error", zap.Error(err))
 
-		c.JSON(http.StatusInternalServerError, &ErrorResponse{Errors: []string{"internal server error"}})
+		internalErrorResponse(c)
+	}
+}
+
+// internalErrorResponse responds with a 500, without aborting, as
+// dbErrorResponse always has
+func internalErrorResponse(c *gin.Context) {
+	apierror.Respond(c, http.StatusInternalServerError, ErrorCodeInternal, "internal server error")
+}
+
+// IPConflictResponse is the body of a 409 sent when an upsert was rejected
+// because some of its IP addresses are associated to other instances
+type IPConflictResponse struct {
+	Error IPConflictError `json:"error"`
+}
+
+// IPConflictError is an ErrorDetail listing each conflicting address along
+// with the instance it belongs to
+type IPConflictError struct {
+	ErrorDetail
+
+	Conflicts []upserter.IPConflict `json:"conflicts"`
+}
+
+// upsertErrorResponse responds to an error from an upsert. A database
+// transaction which ran out of time gets a 504 with a Retry-After, so clients
+// can tell it apart from a genuine failure and retry. An upsert rejected
+// because of conflicting IP addresses gets a 409 listing their current
+// owners, one whose X-Record-Version no longer matches gets a 412, and one with
+// something other than an IP address or CIDR to associate gets a 400. Anything
+// else is handled like any other database error.
+func (r *Router) upsertErrorResponse(c *gin.Context, err error) {
+	var conflictErr *upserter.ConflictError
+	if errors.As(err, &conflictErr) {
+		c.AbortWithStatusJSON(http.StatusConflict, &IPConflictResponse{
+			Error: IPConflictError{
+				ErrorDetail: apierror.New(c, ErrorCodeIPAddressConflict, "ip addresses are associated to other instances"),
+				Conflicts:   conflictErr.Conflicts,
+			},
+		})
+
+		return
+	}
+
+	if errors.Is(err, upserter.ErrPreconditionFailed) {
+		apierror.Abort(c, http.StatusPreconditionFailed, ErrorCodePreconditionFailed, "the record has changed since the version in If-Match or "+HeaderRecordVersion, err.Error())
+		return
+	}
+
+	if errors.Is(err, upserter.ErrInvalidIPAddress) {
+		badRequestResponseWithCode(c, ErrorCodeInvalidRequestBody, "invalid request body", err)
+		return
+	}
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		dbErrorResponse(r.Logger, c, err)
+		return
+	}
+
+	correlation.Logger(c.Request.Context(), r.Logger).Warn("database transaction timed out", zap.Error(err))
+
+	retryAfter := r.UpsertRetryAfter
+	if retryAfter <= 0 {
+		retryAfter = DefaultUpsertRetryAfter
 	}
+
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	apierror.Abort(c, http.StatusGatewayTimeout, ErrorCodeDatabaseTimeout, "timed out writing to the database, try again later")
 }
 
 func notFoundResponse(c *gin.Context) {
-	c.AbortWithStatusJSON(http.StatusNotFound, &ErrorResponse{Message: "resource not found"})
+	apierror.Abort(c, http.StatusNotFound, ErrorCodeInstanceNotFound, "resource not found")
+}
+
+// ec2NotFoundResponse sends a 404 from an instance-facing ec2-style route,
+// using the configured body style.
+func (r *Router) ec2NotFoundResponse(c *gin.Context) {
+	switch r.Ec2NotFoundBody {
+	case NotFoundBodyJSON:
+		apierror.Abort(c, http.StatusNotFound, ErrorCodeNotFound, "resource not found")
+	case NotFoundBodyText:
+		c.String(http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		c.Abort()
+	default:
+		c.AbortWithStatus(http.StatusNotFound)
+	}
 }
 
 func badRequestResponse(c *gin.Context, message string, err error) {
+	badRequestResponseWithCode(c, ErrorCodeInvalidRequest, message, err)
+}
+
+func badRequestResponseWithCode(c *gin.Context, code ErrorCode, message string, err error) {
 	var errMsgs []string
 	if err != nil {
 		errMsgs = getErrorMessagesFromError(err)
@@ -43,7 +302,22 @@ func badRequestResponse(c *gin.Context, message string, err error) {
 
 	_ = c.Error(err)
 
-	c.AbortWithStatusJSON(http.StatusBadRequest, &ErrorResponse{Message: message, Errors: errMsgs})
+	apierror.Abort(c, http.StatusBadRequest, code, message, errMsgs...)
+}
+
+// requestBodyErrorResponse responds to an error reading or binding the
+// request body, returning a 413 if the body exceeded the configured limit.
+func requestBodyErrorResponse(c *gin.Context, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		_ = c.Error(err)
+
+		apierror.Abort(c, http.StatusRequestEntityTooLarge, ErrorCodeRequestBodyTooLarge, fmt.Sprintf("request body exceeds the limit of %d bytes", maxBytesErr.Limit))
+
+		return
+	}
+
+	badRequestResponseWithCode(c, ErrorCodeInvalidRequestBody, "invalid request body", err)
 }
 
 func invalidUUIDResponse(c *gin.Context, err error) {
@@ -55,7 +329,7 @@ func invalidUUIDResponse(c *gin.Context, err error) {
 		notFoundResponse(c)
 	}
 
-	c.AbortWithStatusJSON(http.StatusInternalServerError, &ErrorResponse{Errors: []string{"internal server error"}})
+	apierror.Abort(c, http.StatusInternalServerError, ErrorCodeInternal, "internal server error")
 }
 
 func getErrorMessagesFromError(err error) []string {
@@ -63,6 +337,12 @@ func getErrorMessagesFromError(err error) []string {
 		return []string{}
 	}
 
+	// Invalid public keys, tags and Ignition configs say what was invalid,
+	// and why
+	if errors.Is(err, publickeys.ErrInvalidKey) || errors.Is(err, instancetags.ErrInvalidTag) || errors.Is(err, ignition.ErrInvalidConfig) {
+		return []string{err.Error()}
+	}
+
 	var errMsgs []string
 
 	if validationErrors, ok := err.(validator.ValidationErrors); ok {
@@ -81,7 +361,14 @@ func getErrorMessageFromError(err error) string {
 
 	var errMsg string
 	if fieldError, ok := err.(validator.FieldError); ok {
-		errMsg = fmt.Sprintf("validation failed on %s, condition: %s", fieldError.Field(), fieldError.Tag())
+		condition := fieldError.Tag()
+
+		// Report which instance ID format the field failed to match
+		if condition == instanceIDValidationTag {
+			condition = fieldError.ActualTag()
+		}
+
+		errMsg = fmt.Sprintf("validation failed on %s, condition: %s", fieldError.Field(), condition)
 	} else {
 		errMsg = ""
 	}
@@ -90,10 +377,12 @@ func getErrorMessageFromError(err error) string {
 }
 
 // addTemplateFields will unmarshal the raw JSON and attempt to augment it with
-// the configured template fields.
+// the configured template fields, rendered with the TemplateData of the
+// instance with the given ID, requesting from sourceIP (which is empty for
+// internal requests).
 // If an error occurs unmarshalling the json, or an error occurs while
 // executing a template, we'll just return nil, err.
-func addTemplateFields(metadata types.JSON, templateFields map[string]template.Template) (map[string]interface{}, error) {
+func addTemplateFields(metadata types.JSON, templateFields map[string]template.Template, instanceID string, sourceIP string) (map[string]interface{}, error) {
 	// Attempt to unmarshal the stored json for the instance.
 	resp := make(map[string]interface{})
 	err := json.Unmarshal(metadata, &resp)
@@ -102,6 +391,8 @@ func addTemplateFields(metadata types.JSON, templateFields map[string]template.T
 		return nil, err
 	}
 
+	data := newTemplateData(instanceID, sourceIP, resp)
+
 	// Now that we've unmarshaled the raw json message, augment it with the templated fields
 	for k, v := range templateFields {
 		// If the metadata already has a field with a matching name, just use what was provided.
@@ -111,7 +402,7 @@ func addTemplateFields(metadata types.JSON, templateFields map[string]template.T
 
 		templateBuf := new(bytes.Buffer)
 
-		err = v.Execute(templateBuf, resp)
+		err = v.Execute(templateBuf, data)
 		if err != nil {
 			return nil, err
 		}
@@ -121,3 +412,39 @@ func addTemplateFields(metadata types.JSON, templateFields map[string]template.T
 
 	return resp, nil
 }
+
+// withTemplateFields returns the metadata with the configured template fields
+// added, as addTemplateFields does. When they can't be added, the failure is
+// logged and the metadata is returned without them, so a broken template
+// never stops an instance's metadata from being served. An error is only
+// returned for metadata which isn't a JSON object.
+func (r *Router) withTemplateFields(metadata types.JSON, instanceID string, sourceIP string) (map[string]interface{}, error) {
+	augmented, err := addTemplateFields(metadata, r.TemplateFields, instanceID, sourceIP)
+	if err == nil {
+		return augmented, nil
+	}
+
+	r.Logger.Warn("unable to add the template fields, serving the metadata without them", zap.String("instance_id", instanceID), zap.Error(err))
+
+	var asStored map[string]interface{}
+
+	if err := json.Unmarshal(metadata, &asStored); err != nil {
+		return nil, err
+	}
+
+	return asStored, nil
+}
+
+// projectMetadata returns only the requested top-level fields of a metadata
+// document. Fields the document doesn't have are ignored.
+func projectMetadata(metadata map[string]interface{}, fields []string) map[string]interface{} {
+	projected := make(map[string]interface{}, len(fields))
+
+	for _, field := range fields {
+		if v, ok := metadata[field]; ok {
+			projected[field] = v
+		}
+	}
+
+	return projected
+}
@@ -11,13 +11,47 @@ import (
 
 	"go.hollow.sh/metadataservice/internal/dbtools"
 	"go.hollow.sh/metadataservice/internal/httpsrv"
+	"go.hollow.sh/metadataservice/internal/lastfetch"
 	"go.hollow.sh/metadataservice/internal/lookup"
+	"go.hollow.sh/metadataservice/internal/metadataschema"
+	"go.hollow.sh/metadataservice/internal/prewrite"
+	"go.hollow.sh/metadataservice/internal/ratelimit"
+	"go.hollow.sh/metadataservice/internal/readcache"
+	"go.hollow.sh/metadataservice/internal/sessiontoken"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
 )
 
 type TestServerConfig struct {
-	LookupEnabled  bool
-	LookupClient   lookup.Client
-	TemplateFields map[string]template.Template
+	LookupEnabled    bool
+	LookupClient     lookup.Client
+	TemplateFields   map[string]template.Template
+	Datasources      v1api.DatasourceConfig
+	Ec2NotFound      v1api.NotFoundBody
+	MaxBodySize      int64
+	MaxUserdataSize  int64
+	ETags            bool
+	LastFetch        bool
+	MaxInstances     int64
+	StableInstanceID bool
+	StableBySourceIP bool
+	BootstrapTokens  bool
+	MetadataHistory  bool
+	PreWriteHook     *prewrite.Hook
+	RejectConflicts  bool
+	IPlessPolicy     v1api.IPlessPolicy
+	PendingMarker    bool
+	SessionTokens    *sessiontoken.Issuer
+	RequireToken     bool
+	ReadCache        *readcache.Cache
+	ReadRateLimiter  *ratelimit.Limiter
+	InstanceAuth     v1api.InstanceAuthConfig
+	MetadataSchema   *metadataschema.Validator
+	IdempotencyKeys  bool
+	FieldTemplates   map[string]template.Template
+	SensitivePaths   []v1api.SensitivePath
+	UnixSocket       *v1api.UnixSocketIdentity
+	ValidateIgnition bool
+	DefaultMetadata  *v1api.DefaultMetadata
 }
 
 func testHTTPServer(t *testing.T) *http.Handler {
@@ -41,6 +75,44 @@ func testHTTPServerWithConfig(t *testing.T, config TestServerConfig) *http.Handl
 	hs.LookupEnabled = config.LookupEnabled
 	hs.LookupClient = config.LookupClient
 	hs.TemplateFields = config.TemplateFields
+	hs.Datasources = config.Datasources
+	hs.Ec2NotFoundBody = config.Ec2NotFound
+	hs.MaxMetadataBodySize = config.MaxBodySize
+	hs.MaxUserdataBodySize = config.MaxBodySize
+
+	if config.MaxUserdataSize > 0 {
+		hs.MaxUserdataBodySize = config.MaxUserdataSize
+	}
+
+	hs.ETags = config.ETags
+	hs.MaxInstances = config.MaxInstances
+	hs.StableInstanceID = config.StableInstanceID
+	hs.StableIDBySourceIP = config.StableBySourceIP
+	hs.BootstrapTokens = config.BootstrapTokens
+	hs.MetadataHistory = config.MetadataHistory
+	hs.PreWriteHook = config.PreWriteHook
+	hs.RejectIPConflicts = config.RejectConflicts
+	hs.IPlessPolicy = config.IPlessPolicy
+	hs.ProvisioningMarker = config.PendingMarker
+	hs.SessionTokens = config.SessionTokens
+	hs.RequireSessionToken = config.RequireToken
+	hs.ReadCache = config.ReadCache
+	hs.ReadRateLimiter = config.ReadRateLimiter
+	hs.InstanceAuth = config.InstanceAuth
+	hs.MetadataSchema = config.MetadataSchema
+	hs.IdempotencyKeys = config.IdempotencyKeys
+	hs.MetadataTemplates = config.FieldTemplates
+	hs.SensitivePaths = config.SensitivePaths
+	hs.ValidateIgnition = config.ValidateIgnition
+	hs.DefaultMetadata = config.DefaultMetadata
+
+	if config.UnixSocket != nil {
+		hs.UnixSocket = &httpsrv.UnixSocketConfig{Identity: *config.UnixSocket}
+	}
+
+	if config.LastFetch {
+		hs.FetchRecorder = lastfetch.NewRecorder(db, zap.NewNop(), 0)
+	}
 
 	s := hs.NewServer()
 
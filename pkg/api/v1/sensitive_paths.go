@@ -0,0 +1,102 @@
+package metadataservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/volatiletech/sqlboiler/v4/types"
+)
+
+// contextKeyClientCertIdentified is set on requests from an instance
+// identified by its verified client certificate, rather than by the address
+// the request came from
+const contextKeyClientCertIdentified = "metadataservice.client-cert-identified"
+
+// ErrInvalidSensitivePath is returned when a sensitive metadata path can't be
+// parsed
+var ErrInvalidSensitivePath = errors.New("invalid sensitive metadata path")
+
+// SensitivePath is a path to a metadata field which isn't served to instances
+// identified only by the address their request came from. Each element is an
+// object key, and a path running through an array applies to each of its
+// elements.
+type SensitivePath []string
+
+// String returns the path in the dot-separated form it's configured in
+func (p SensitivePath) String() string {
+	return strings.Join(p, ".")
+}
+
+// ParseSensitivePaths parses dot-separated metadata paths, like
+// "bootstrap.token", optionally starting with "$."
+func ParseSensitivePaths(paths []string) ([]SensitivePath, error) {
+	parsed := make([]SensitivePath, 0, len(paths))
+
+	for _, path := range paths {
+		keys := strings.Split(strings.TrimPrefix(path, "$."), ".")
+
+		for _, key := range keys {
+			if key == "" {
+				return nil, fmt.Errorf("%w: %q", ErrInvalidSensitivePath, path)
+			}
+		}
+
+		parsed = append(parsed, SensitivePath(keys))
+	}
+
+	return parsed, nil
+}
+
+// visibleMetadata returns the metadata as the instance making the request may
+// see it. Instances identified by a client certificate see all of it, while
+// the sensitive paths are removed for those identified by their address,
+// which anything able to send requests from it can do.
+func (r *Router) visibleMetadata(c *gin.Context, metadata types.JSON) types.JSON {
+	if len(r.SensitivePaths) == 0 || c.GetBool(contextKeyClientCertIdentified) {
+		return metadata
+	}
+
+	var doc interface{}
+
+	// Numbers are decoded as json.Number, so they're served exactly as stored
+	decoder := json.NewDecoder(bytes.NewReader(metadata))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(&doc); err != nil {
+		return metadata
+	}
+
+	for _, path := range r.SensitivePaths {
+		removePath(doc, path)
+	}
+
+	visible, err := json.Marshal(doc)
+	if err != nil {
+		return metadata
+	}
+
+	return visible
+}
+
+// removePath removes the field at the path from the parsed document
+func removePath(doc interface{}, path SensitivePath) {
+	switch value := doc.(type) {
+	case map[string]interface{}:
+		if len(path) == 1 {
+			delete(value, path[0])
+			return
+		}
+
+		if child, ok := value[path[0]]; ok {
+			removePath(child, path[1:])
+		}
+	case []interface{}:
+		for _, element := range value {
+			removePath(element, path)
+		}
+	}
+}
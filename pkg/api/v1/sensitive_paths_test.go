@@ -0,0 +1,108 @@
+package metadataservice_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func TestParseSensitivePaths(t *testing.T) {
+	paths, err := v1api.ParseSensitivePaths([]string{"iqn", "$.operating_system.license_activation"})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []v1api.SensitivePath{{"iqn"}, {"operating_system", "license_activation"}}, paths)
+	assert.Equal(t, "operating_system.license_activation", paths[1].String())
+
+	for _, path := range []string{"", "bootstrap..token", "bootstrap."} {
+		_, err = v1api.ParseSensitivePaths([]string{path})
+		assert.ErrorIs(t, err, v1api.ErrInvalidSensitivePath, path)
+	}
+}
+
+func TestSensitivePaths(t *testing.T) {
+	paths, err := v1api.ParseSensitivePaths([]string{"iqn", "operating_system.license_activation", "specs.cpus.type", "no.such.field"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("stripped for instances identified by address", func(t *testing.T) {
+		router := *testHTTPServerWithConfig(t, TestServerConfig{SensitivePaths: paths})
+		fixture := dbtools.FixtureInstanceA
+
+		var stored map[string]interface{}
+
+		if err := json.Unmarshal(fixture.InstanceMetadata.Metadata, &stored); err != nil {
+			t.Fatal(err)
+		}
+
+		w := getAsInstance(router, v1api.GetMetadataPath(), nil, fixture.HostIPs[0])
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var resp map[string]interface{}
+
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+
+		assert.NotContains(t, resp, "iqn")
+		assert.NotContains(t, resp["operating_system"], "license_activation")
+		assert.Equal(t, "ubuntu_20_04", resp["operating_system"].(map[string]interface{})["slug"])
+
+		// The path is applied to each element of an array
+		for _, cpu := range resp["specs"].(map[string]interface{})["cpus"].([]interface{}) {
+			assert.NotContains(t, cpu, "type")
+			assert.Contains(t, cpu, "count")
+		}
+
+		// Everything else is served as stored
+		assert.Equal(t, stored["hostname"], resp["hostname"])
+		assert.Equal(t, stored["ssh_keys"], resp["ssh_keys"])
+
+		// The EC2-style routes are filtered too
+		w = getAsInstance(router, "/2009-04-04/meta-data/iqn", nil, fixture.HostIPs[0])
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, w.Body.String())
+	})
+
+	t.Run("served to instances identified by client certificate", func(t *testing.T) {
+		router := *testHTTPServerWithConfig(t, TestServerConfig{
+			SensitivePaths: paths,
+			InstanceAuth: v1api.InstanceAuthConfig{
+				Default:  v1api.InstanceAuthClientCertOrSourceIP,
+				Identity: v1api.ClientCertIdentityCN,
+			},
+		})
+		fixture := dbtools.FixtureInstanceA
+
+		w := getAsInstance(router, v1api.GetMetadataPath(), clientCertState(fixture.InstanceID, nil), "1.2.3.4")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, fixture.InstanceMetadata.Metadata.String(), w.Body.String())
+
+		// Without a certificate, the instance is identified by address
+		w = getAsInstance(router, v1api.GetMetadataPath(), nil, fixture.HostIPs[0])
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NotContains(t, w.Body.String(), `"iqn"`)
+	})
+
+	t.Run("served on the internal routes", func(t *testing.T) {
+		router := *testHTTPServerWithConfig(t, TestServerConfig{SensitivePaths: paths})
+		fixture := dbtools.FixtureInstanceA
+
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, v1api.GetInternalMetadataByIDPath(fixture.InstanceID), nil)
+		req.RemoteAddr = net.JoinHostPort(fixture.HostIPs[0], "0")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, fixture.InstanceMetadata.Metadata.String(), w.Body.String())
+	})
+}
@@ -0,0 +1,96 @@
+package metadataservice
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"go.hollow.sh/metadataservice/internal/apierror"
+	"go.hollow.sh/metadataservice/internal/middleware"
+	"go.hollow.sh/metadataservice/internal/sessiontoken"
+)
+
+const (
+	// SessionTokenURI is the path to the IMDSv2-style endpoint instances PUT
+	// to for a session token. Like on AWS, it's only served at the root.
+	SessionTokenURI = "/latest/api/token"
+
+	// HeaderSessionTokenTTL is the request header giving the number of
+	// seconds a session token should be valid for. It's echoed back, with
+	// the TTL the token was actually issued for, when a token is issued.
+	HeaderSessionTokenTTL = "X-aws-ec2-metadata-token-ttl-seconds"
+
+	// HeaderSessionToken is the request header instances present their
+	// session token in
+	HeaderSessionToken = "X-aws-ec2-metadata-token"
+)
+
+// SessionTokenRoutes will add the session token route to a router group, if
+// session tokens are enabled.
+func (r *Router) SessionTokenRoutes(rg *gin.RouterGroup) {
+	if r.SessionTokens == nil {
+		return
+	}
+
+	rg.PUT(SessionTokenURI, middleware.Timeout(r.Timeouts.Read), r.sessionTokenPut)
+}
+
+// sessionTokenPut issues a session token bound to the caller's address, valid
+// for the requested number of seconds (clamped to the configured maximum).
+func (r *Router) sessionTokenPut(c *gin.Context) {
+	seconds, err := strconv.Atoi(c.GetHeader(HeaderSessionTokenTTL))
+	if err != nil || seconds < 1 {
+		apierror.Abort(c, http.StatusBadRequest, ErrorCodeInvalidRequest, "a valid "+HeaderSessionTokenTTL+" header is required")
+		return
+	}
+
+	token, ttl, err := r.SessionTokens.Issue(c.ClientIP(), time.Duration(seconds)*time.Second)
+	if err != nil {
+		badRequestResponse(c, "invalid session token ttl", err)
+		return
+	}
+
+	c.Header(HeaderSessionTokenTTL, strconv.Itoa(int(ttl.Seconds())))
+	c.String(http.StatusOK, token)
+}
+
+// requireSessionToken returns the middleware checking the session token
+// presented on instance-facing reads. A token which is presented must be
+// valid, unexpired and presented from the address it was issued to. Requests
+// without a token are only rejected when tokens are required.
+func (r *Router) requireSessionToken() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if r.SessionTokens == nil {
+			c.Next()
+			return
+		}
+
+		token := c.GetHeader(HeaderSessionToken)
+
+		if token == "" {
+			if r.RequireSessionToken {
+				apierror.Abort(c, http.StatusUnauthorized, ErrorCodeSessionTokenRequired, "a session token is required")
+				return
+			}
+
+			c.Next()
+
+			return
+		}
+
+		if err := r.SessionTokens.Verify(token, c.ClientIP()); err != nil {
+			if !errors.Is(err, sessiontoken.ErrInvalidToken) {
+				r.Logger.Sugar().Info("Rejecting session token presented from ", c.ClientIP(), ": ", err)
+			}
+
+			apierror.Abort(c, http.StatusUnauthorized, ErrorCodeInvalidSessionToken, "invalid session token")
+
+			return
+		}
+
+		c.Next()
+	}
+}
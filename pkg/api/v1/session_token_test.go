@@ -0,0 +1,143 @@
+package metadataservice_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	"go.hollow.sh/metadataservice/internal/sessiontoken"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+func testSessionTokenIssuer(t *testing.T) *sessiontoken.Issuer {
+	issuer, err := sessiontoken.NewIssuer([]byte(strings.Repeat("k", 32)), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return issuer
+}
+
+func putSessionToken(router http.Handler, instanceIP, ttl string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(context.TODO(), http.MethodPut, v1api.SessionTokenURI, nil)
+	req.RemoteAddr = net.JoinHostPort(instanceIP, "0")
+
+	if ttl != "" {
+		req.Header.Set(v1api.HeaderSessionTokenTTL, ttl)
+	}
+
+	router.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestPutSessionToken(t *testing.T) {
+	router := *testHTTPServerWithConfig(t, TestServerConfig{SessionTokens: testSessionTokenIssuer(t)})
+	instanceIP := dbtools.FixtureInstanceA.HostIPs[0]
+
+	for _, ttl := range []string{"", "abc", "0", "-5"} {
+		w := putSessionToken(router, instanceIP, ttl)
+		assert.Equal(t, http.StatusBadRequest, w.Code, ttl)
+	}
+
+	w := putSessionToken(router, instanceIP, "60")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "60", w.Header().Get(v1api.HeaderSessionTokenTTL))
+	assert.NotEmpty(t, w.Body.String())
+
+	// TTLs above the max are clamped
+	w = putSessionToken(router, instanceIP, "86400")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "3600", w.Header().Get(v1api.HeaderSessionTokenTTL))
+}
+
+func TestPutSessionTokenDisabled(t *testing.T) {
+	router := *testHTTPServer(t)
+
+	w := putSessionToken(router, dbtools.FixtureInstanceA.HostIPs[0], "60")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestGetMetadataSessionToken(t *testing.T) {
+	testCases := []struct {
+		testName       string
+		required       bool
+		token          func(router http.Handler, instanceIP string) string
+		expectedStatus int
+	}{
+		{
+			"optional without a token",
+			false,
+			func(router http.Handler, instanceIP string) string { return "" },
+			http.StatusOK,
+		},
+		{
+			"optional with a valid token",
+			false,
+			func(router http.Handler, instanceIP string) string {
+				return putSessionToken(router, instanceIP, "60").Body.String()
+			},
+			http.StatusOK,
+		},
+		{
+			"optional with an invalid token",
+			false,
+			func(router http.Handler, instanceIP string) string { return "not-a-token" },
+			http.StatusUnauthorized,
+		},
+		{
+			"required without a token",
+			true,
+			func(router http.Handler, instanceIP string) string { return "" },
+			http.StatusUnauthorized,
+		},
+		{
+			"required with a valid token",
+			true,
+			func(router http.Handler, instanceIP string) string {
+				return putSessionToken(router, instanceIP, "60").Body.String()
+			},
+			http.StatusOK,
+		},
+		{
+			"required with a token issued to another address",
+			true,
+			func(router http.Handler, instanceIP string) string {
+				return putSessionToken(router, "10.99.0.1", "60").Body.String()
+			},
+			http.StatusUnauthorized,
+		},
+	}
+
+	for _, testcase := range testCases {
+		t.Run(testcase.testName, func(t *testing.T) {
+			router := *testHTTPServerWithConfig(t, TestServerConfig{SessionTokens: testSessionTokenIssuer(t), RequireToken: testcase.required})
+			instanceIP := dbtools.FixtureInstanceA.HostIPs[0]
+			token := testcase.token(router, instanceIP)
+
+			for _, path := range []string{v1api.GetMetadataPath(), v1api.GetUserdataPath(), v1api.GetEc2MetadataItemPath("hostname")} {
+				w := httptest.NewRecorder()
+
+				req, _ := http.NewRequestWithContext(context.TODO(), http.MethodGet, path, nil)
+				req.RemoteAddr = net.JoinHostPort(instanceIP, "0")
+
+				if token != "" {
+					req.Header.Set(v1api.HeaderSessionToken, token)
+				}
+
+				router.ServeHTTP(w, req)
+
+				assert.Equal(t, testcase.expectedStatus, w.Code, path)
+			}
+		})
+	}
+}
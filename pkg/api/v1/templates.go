@@ -0,0 +1,55 @@
+package metadataservice
+
+import (
+	"encoding/json"
+	"text/template"
+)
+
+// TemplateData is what every template the service renders is given: the
+// template fields (like api_url), the metadata field templates and the
+// default metadata. The top-level fields of the instance's metadata can be
+// used directly, like {{.facility}}, or through .Metadata, like
+// {{.Metadata.plan}}. The named fields below are always set, and take the
+// place of any metadata fields of the same name:
+//
+//   - InstanceID is the ID of the instance's record
+//   - Hostname, Facility and Metro are read from the metadata, and are empty
+//     when it doesn't have them
+//   - SourceIP is the address the request came from, after any trusted proxy
+//     resolution, when it was made by the instance
+//   - Metadata is the whole metadata document
+//
+// An instance the service doesn't know has no metadata, and is only given a
+// SourceIP.
+type TemplateData map[string]interface{}
+
+// newTemplateData returns the data the templates are rendered with for a
+// request from sourceIP, by the instance with the given ID and metadata
+func newTemplateData(instanceID string, sourceIP string, metadata map[string]interface{}) TemplateData {
+	data := make(TemplateData, len(metadata))
+
+	for field, value := range metadata {
+		data[field] = value
+	}
+
+	data["InstanceID"] = instanceID
+	data["Hostname"], _ = metadata["hostname"].(string)
+	data["Facility"], _ = metadata["facility"].(string)
+	data["Metro"], _ = metadata["metro"].(string)
+	data["SourceIP"] = sourceIP
+	data["Metadata"] = metadata
+
+	return data
+}
+
+// NewTemplate returns a new, empty template with the functions every template
+// can use: json, which quotes a value as JSON, like {{json .SourceIP}}.
+func NewTemplate(name string) *template.Template {
+	return template.New(name).Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			encoded, err := json.Marshal(v)
+
+			return string(encoded), err
+		},
+	})
+}
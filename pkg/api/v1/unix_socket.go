@@ -0,0 +1,72 @@
+package metadataservice
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"go.hollow.sh/metadataservice/internal/apierror"
+	"go.hollow.sh/metadataservice/internal/middleware"
+)
+
+// unixSocketContextKey marks the context of requests made over the unix socket
+type unixSocketContextKey struct{}
+
+// UnixSocketIdentity controls how the instance making a request over the
+// unix socket is identified, as its requests have no source IP to resolve.
+type UnixSocketIdentity struct {
+	// InstanceIDHeader, when set, names the header a host-local agent selects
+	// the instance with
+	InstanceIDHeader string
+
+	// InstanceID is the instance requests which don't select one are served
+	// for, typically the host the socket is on. When neither is set, requests
+	// over the socket can't identify an instance.
+	InstanceID string
+}
+
+// WithUnixSocket returns the context for a connection accepted on the unix
+// socket, so its requests are identified by the UnixSocketIdentity
+func WithUnixSocket(ctx context.Context) context.Context {
+	return context.WithValue(ctx, unixSocketContextKey{}, true)
+}
+
+// fromUnixSocket reports whether the request was made over the unix socket
+func fromUnixSocket(c *gin.Context) bool {
+	fromSocket, _ := c.Request.Context().Value(unixSocketContextKey{}).(bool)
+
+	return fromSocket
+}
+
+// identifyUnixSocket wraps the handler identifying the instance making a
+// request, identifying the instance by the UnixSocketIdentity instead when
+// the request was made over the unix socket
+func (r *Router) identifyUnixSocket(identify gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !fromUnixSocket(c) {
+			identify(c)
+			return
+		}
+
+		instanceID := r.UnixSocket.InstanceID
+
+		if r.UnixSocket.InstanceIDHeader != "" {
+			if selected := c.GetHeader(r.UnixSocket.InstanceIDHeader); selected != "" {
+				instanceID = selected
+			}
+		}
+
+		if instanceID == "" {
+			apierror.Abort(c, http.StatusUnauthorized, ErrorCodeUnauthorized, "no instance selected for the request over the unix socket")
+			return
+		}
+
+		if !r.InstanceIDFormat.Valid(instanceID) {
+			apierror.Abort(c, http.StatusBadRequest, ErrorCodeInvalidRequest, "invalid instance id selected for the request over the unix socket")
+			return
+		}
+
+		c.Set(middleware.ContextKeyInstanceID, instanceID)
+	}
+}
@@ -0,0 +1,73 @@
+package metadataservice_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hollow.sh/metadataservice/internal/dbtools"
+	v1api "go.hollow.sh/metadataservice/pkg/api/v1"
+)
+
+// getOverUnixSocket makes a request as if it came over the unix socket
+func getOverUnixSocket(router http.Handler, path string, header http.Header) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequestWithContext(v1api.WithUnixSocket(context.TODO()), http.MethodGet, path, nil)
+	req.RemoteAddr = "@"
+
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	router.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestUnixSocketIdentity(t *testing.T) {
+	t.Run("default instance", func(t *testing.T) {
+		// The fixtures are loaded along with the test database
+		dbtools.DatabaseTest(t)
+
+		router := *testHTTPServerWithConfig(t, TestServerConfig{UnixSocket: &v1api.UnixSocketIdentity{
+			InstanceID: dbtools.FixtureInstanceA.InstanceID,
+		}})
+
+		w := getOverUnixSocket(router, v1api.GetMetadataPath(), nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, dbtools.FixtureInstanceA.InstanceMetadata.Metadata.String(), w.Body.String())
+
+		// Without the header configured, it's not read
+		w = getOverUnixSocket(router, v1api.GetMetadataPath(), http.Header{"X-Instance-Id": {dbtools.FixtureInstanceB.InstanceID}})
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, dbtools.FixtureInstanceA.InstanceMetadata.Metadata.String(), w.Body.String())
+	})
+
+	t.Run("instance selected by header", func(t *testing.T) {
+		router := *testHTTPServerWithConfig(t, TestServerConfig{UnixSocket: &v1api.UnixSocketIdentity{
+			InstanceIDHeader: "X-Instance-ID",
+		}})
+
+		w := getOverUnixSocket(router, v1api.GetMetadataPath(), http.Header{"X-Instance-Id": {dbtools.FixtureInstanceB.InstanceID}})
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, dbtools.FixtureInstanceB.InstanceMetadata.Metadata.String(), w.Body.String())
+
+		w = getOverUnixSocket(router, v1api.GetUserdataPath(), http.Header{"X-Instance-Id": {dbtools.FixtureInstanceA.InstanceID}})
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, string(dbtools.FixtureInstanceA.InstanceUserdata.Userdata.Bytes), w.Body.String())
+
+		w = getOverUnixSocket(router, v1api.GetMetadataPath(), nil)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("no identity", func(t *testing.T) {
+		router := *testHTTPServer(t)
+
+		w := getOverUnixSocket(router, v1api.GetMetadataPath(), nil)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+}
@@ -0,0 +1,46 @@
+package metadataservice
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/volatiletech/null/v8"
+
+	"go.hollow.sh/metadataservice/internal/models"
+	"go.hollow.sh/metadataservice/internal/userdata"
+)
+
+// userdataEncodingQuery finds how an instance's stored userdata is encoded.
+// There's no row for userdata stored raw.
+const userdataEncodingQuery = `SELECT encoding FROM instance_userdata_encodings WHERE instance_id = $1`
+
+// findDecodedUserdata finds the userdata for an instance, decoded according to
+// how it was stored, ready to be served to the instance.
+func (r *Router) findDecodedUserdata(ctx context.Context, instanceID string) (*models.InstanceUserdatum, error) {
+	stored, err := models.FindInstanceUserdatum(ctx, r.DB, instanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	var encoding string
+
+	err = r.DB.GetContext(ctx, &encoding, userdataEncodingQuery, instanceID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return stored, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	decoded, err := userdata.Decode(stored.Userdata.Bytes, encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	result := *stored
+	result.Userdata = null.NewBytes(decoded, stored.Userdata.Valid)
+
+	return &result, nil
+}